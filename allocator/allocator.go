@@ -9,6 +9,7 @@ import (
 	peer "github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/limits"
 )
 
 var log = logging.Logger("graphsync_allocator")
@@ -19,9 +20,13 @@ type Allocator struct {
 
 	allocLk                sync.RWMutex
 	totalAllocatedAllPeers uint64
+	peakAllocatedAllPeers  uint64
 	nextAllocIndex         uint64
 	peerStatuses           map[peer.ID]*peerStatus
 	peerStatusQueue        pq.PQ
+
+	// records when allocations are deferred by either limit, may be nil
+	limitRecorder *limits.Recorder
 }
 
 func NewAllocator(maxAllowedAllocatedTotal uint64, maxAllowedAllocatedPerPeer uint64) *Allocator {
@@ -34,6 +39,47 @@ func NewAllocator(maxAllowedAllocatedTotal uint64, maxAllowedAllocatedPerPeer ui
 	}
 }
 
+// SetLimits changes the maximum memory that may be allocated in total and
+// per peer. Existing allocations are kept, so lowering the limits only defers
+// new allocations until enough memory is released
+func (a *Allocator) SetLimits(maxAllowedAllocatedTotal uint64, maxAllowedAllocatedPerPeer uint64) {
+	a.allocLk.Lock()
+	defer a.allocLk.Unlock()
+	a.maxAllowedAllocatedTotal = maxAllowedAllocatedTotal
+	if a.maxAllowedAllocatedPerPeer != maxAllowedAllocatedPerPeer {
+		a.maxAllowedAllocatedPerPeer = maxAllowedAllocatedPerPeer
+		// the queue ordering depends on the per peer limit, so rebuild it
+		peerStatusQueue := pq.New(makePeerStatusCompare(maxAllowedAllocatedPerPeer))
+		for _, status := range a.peerStatuses {
+			peerStatusQueue.Push(status)
+		}
+		a.peerStatusQueue = peerStatusQueue
+	}
+	a.processPendingAllocations()
+}
+
+// SetLimitRecorder sets where to record allocations deferred because the
+// total or per peer limit was reached
+func (a *Allocator) SetLimitRecorder(limitRecorder *limits.Recorder) {
+	a.allocLk.Lock()
+	defer a.allocLk.Unlock()
+	a.limitRecorder = limitRecorder
+}
+
+// LargestPeerAllocation returns the memory allocated for the peer with the
+// most memory allocated
+func (a *Allocator) LargestPeerAllocation() uint64 {
+	a.allocLk.RLock()
+	defer a.allocLk.RUnlock()
+	largest := uint64(0)
+	for _, status := range a.peerStatuses {
+		if status.totalAllocated > largest {
+			largest = status.totalAllocated
+		}
+	}
+	return largest
+}
+
 func (a *Allocator) AllocatedForPeer(p peer.ID) uint64 {
 	a.allocLk.RLock()
 	defer a.allocLk.RUnlock()
@@ -45,7 +91,11 @@ func (a *Allocator) AllocatedForPeer(p peer.ID) uint64 {
 	return status.totalAllocated
 }
 
-func (a *Allocator) AllocateBlockMemory(p peer.ID, amount uint64) <-chan error {
+// AllocateBlockMemory allocates memory for blocks sent to the given peer. When
+// the memory is not yet available, the allocation waits, and a peer's pending
+// allocations are granted highest priority first, then in the order they were
+// made
+func (a *Allocator) AllocateBlockMemory(p peer.ID, amount uint64, priority graphsync.Priority) <-chan error {
 	responseChan := make(chan error, 1)
 	a.allocLk.Lock()
 	defer a.allocLk.Unlock()
@@ -61,20 +111,65 @@ func (a *Allocator) AllocateBlockMemory(p peer.ID, amount uint64) <-chan error {
 	}
 
 	if (a.totalAllocatedAllPeers+amount <= a.maxAllowedAllocatedTotal) && (status.totalAllocated+amount <= a.maxAllowedAllocatedPerPeer) && len(status.pendingAllocations) == 0 {
-		a.totalAllocatedAllPeers += amount
-		status.totalAllocated += amount
+		a.addAllocated(status, amount)
 		log.Debugw("bytes allocated", "amount", amount, "peer", p, "peer total", status.totalAllocated, "global total", a.totalAllocatedAllPeers)
 		responseChan <- nil
 	} else {
+		if a.totalAllocatedAllPeers+amount > a.maxAllowedAllocatedTotal {
+			a.limitRecorder.Hit(graphsync.LimitMaxMemoryResponder, graphsync.LimitScopeGlobal)
+		}
+		if status.totalAllocated+amount > a.maxAllowedAllocatedPerPeer {
+			a.limitRecorder.Hit(graphsync.LimitMaxMemoryPerPeerResponder, graphsync.LimitScopePeer)
+		}
 		log.Debugw("byte allocation deferred pending memory release", "amount", amount, "peer", p, "peer total", status.totalAllocated, "global total", a.totalAllocatedAllPeers, "max per peer", a.maxAllowedAllocatedPerPeer, "global max", a.maxAllowedAllocatedTotal)
-		pendingAllocation := pendingAllocation{p, amount, responseChan, a.nextAllocIndex}
+		pendingAllocation := pendingAllocation{p, amount, priority, responseChan, a.nextAllocIndex}
 		a.nextAllocIndex++
-		status.pendingAllocations = append(status.pendingAllocations, pendingAllocation)
+		status.queuePendingAllocation(pendingAllocation)
 	}
 	a.peerStatusQueue.Update(status.Index())
 	return responseChan
 }
 
+// addAllocated counts memory granted to the given peer
+func (a *Allocator) addAllocated(status *peerStatus, amount uint64) {
+	a.totalAllocatedAllPeers += amount
+	status.totalAllocated += amount
+	if a.totalAllocatedAllPeers > a.peakAllocatedAllPeers {
+		a.peakAllocatedAllPeers = a.totalAllocatedAllPeers
+	}
+}
+
+// CancelAllocation withdraws an allocation returned by AllocateBlockMemory
+// that the caller no longer wants and has not read from. If the allocation is
+// still pending it is removed from the queue, and if it was already granted
+// its memory is released
+func (a *Allocator) CancelAllocation(p peer.ID, allocation <-chan error, amount uint64) {
+	a.allocLk.Lock()
+	defer a.allocLk.Unlock()
+
+	status, ok := a.peerStatuses[p]
+	if !ok {
+		// the peer was deallocated, along with anything it was granted
+		return
+	}
+	for i, pendingAllocation := range status.pendingAllocations {
+		if pendingAllocation.response == allocation {
+			status.pendingAllocations = append(status.pendingAllocations[:i], status.pendingAllocations[i+1:]...)
+			log.Debugw("pending allocation cancelled", "amount", amount, "peer", p)
+			a.peerStatusQueue.Update(status.Index())
+			a.processPendingAllocations()
+			return
+		}
+	}
+	select {
+	case err := <-allocation:
+		if err == nil {
+			a.releaseBlockMemory(status, amount)
+		}
+	default:
+	}
+}
+
 func (a *Allocator) ReleaseBlockMemory(p peer.ID, amount uint64) error {
 	a.allocLk.Lock()
 	defer a.allocLk.Unlock()
@@ -83,6 +178,12 @@ func (a *Allocator) ReleaseBlockMemory(p peer.ID, amount uint64) error {
 	if !ok {
 		return errors.New("cannot deallocate from peer with no allocations")
 	}
+	a.releaseBlockMemory(status, amount)
+	return nil
+}
+
+func (a *Allocator) releaseBlockMemory(status *peerStatus, amount uint64) {
+	p := status.p
 	if status.totalAllocated >= amount {
 		status.totalAllocated -= amount
 	} else {
@@ -100,7 +201,6 @@ func (a *Allocator) ReleaseBlockMemory(p peer.ID, amount uint64) error {
 	log.Debugw("memory released", "amount", amount, "peer", p, "peer total", status.totalAllocated, "global total", a.totalAllocatedAllPeers, "max per peer", a.maxAllowedAllocatedPerPeer, "global max", a.maxAllowedAllocatedTotal)
 	a.peerStatusQueue.Update(status.Index())
 	a.processPendingAllocations()
-	return nil
 }
 
 func (a *Allocator) ReleasePeerMemory(p peer.ID) error {
@@ -154,8 +254,7 @@ func (a *Allocator) processNextPendingAllocationForPeer(nextPeer *peerStatus) bo
 	if nextPeer.totalAllocated+pendingAllocation.amount > a.maxAllowedAllocatedPerPeer {
 		return false
 	}
-	a.totalAllocatedAllPeers += pendingAllocation.amount
-	nextPeer.totalAllocated += pendingAllocation.amount
+	a.addAllocated(nextPeer, pendingAllocation.amount)
 	nextPeer.pendingAllocations = nextPeer.pendingAllocations[1:]
 	log.Debugw("bytes allocated", "amount", pendingAllocation.amount, "peer", nextPeer.p, "peer total", nextPeer.totalAllocated, "global total", a.totalAllocatedAllPeers)
 	pendingAllocation.response <- nil
@@ -182,6 +281,7 @@ func (a *Allocator) Stats() graphsync.ResponseStats {
 		MaxAllowedAllocatedTotal:       a.maxAllowedAllocatedTotal,
 		MaxAllowedAllocatedPerPeer:     a.maxAllowedAllocatedPerPeer,
 		TotalAllocatedAllPeers:         a.totalAllocatedAllPeers,
+		PeakAllocatedAllPeers:          a.peakAllocatedAllPeers,
 		TotalPendingAllocations:        totalPendingAllocations,
 		NumPeersWithPendingAllocations: numPeersWithPendingAllocations,
 	}
@@ -197,10 +297,23 @@ type peerStatus struct {
 type pendingAllocation struct {
 	p          peer.ID
 	amount     uint64
+	priority   graphsync.Priority
 	response   chan error
 	allocIndex uint64
 }
 
+// queuePendingAllocation adds an allocation after every pending allocation of
+// the same or higher priority
+func (ps *peerStatus) queuePendingAllocation(pa pendingAllocation) {
+	i := len(ps.pendingAllocations)
+	for i > 0 && ps.pendingAllocations[i-1].priority < pa.priority {
+		i--
+	}
+	ps.pendingAllocations = append(ps.pendingAllocations, pendingAllocation{})
+	copy(ps.pendingAllocations[i+1:], ps.pendingAllocations[i:])
+	ps.pendingAllocations[i] = pa
+}
+
 // SetIndex stores the int index.
 func (ps *peerStatus) SetIndex(index int) {
 	ps.index = index
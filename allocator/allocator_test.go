@@ -2,12 +2,15 @@ package allocator_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/ipfs/go-graphsync"
 	"github.com/ipfs/go-graphsync/allocator"
+	"github.com/ipfs/go-graphsync/limits"
 	"github.com/ipfs/go-graphsync/testutil"
 )
 
@@ -346,7 +349,7 @@ func TestAllocator(t *testing.T) {
 			for _, step := range data.steps {
 				switch op := step.op.(type) {
 				case alloc:
-					allocated := allocator.AllocateBlockMemory(op.p, op.amount)
+					allocated := allocator.AllocateBlockMemory(op.p, op.amount, 0)
 					select {
 					case <-allocated:
 					default:
@@ -394,6 +397,117 @@ func TestAllocator(t *testing.T) {
 	}
 }
 
+func TestAllocatorSetLimits(t *testing.T) {
+	peers := testutil.GeneratePeers(2)
+	allocator := allocator.NewAllocator(1000, 1000)
+
+	require.NoError(t, <-allocator.AllocateBlockMemory(peers[0], 400, 0))
+
+	// lowering the limits defers new allocations, but keeps existing ones
+	allocator.SetLimits(500, 250)
+	pending := allocator.AllocateBlockMemory(peers[1], 200, 0)
+	require.Len(t, pending, 0)
+	stats := allocator.Stats()
+	require.Equal(t, uint64(500), stats.MaxAllowedAllocatedTotal)
+	require.Equal(t, uint64(250), stats.MaxAllowedAllocatedPerPeer)
+	require.Equal(t, uint64(400), stats.TotalAllocatedAllPeers)
+	require.Equal(t, uint64(200), stats.TotalPendingAllocations)
+
+	// raising them again processes pending allocations
+	allocator.SetLimits(1000, 1000)
+	require.NoError(t, <-pending)
+	stats = allocator.Stats()
+	require.Equal(t, uint64(600), stats.TotalAllocatedAllPeers)
+	require.Equal(t, uint64(0), stats.TotalPendingAllocations)
+}
+
+func TestAllocatorPriority(t *testing.T) {
+	peers := testutil.GeneratePeers(2)
+	allocator := allocator.NewAllocator(1000, 300)
+
+	require.NoError(t, <-allocator.AllocateBlockMemory(peers[0], 300, 0))
+
+	// pending allocations for a peer are granted highest priority first, then
+	// in the order they were made
+	low := allocator.AllocateBlockMemory(peers[0], 100, 1)
+	high := allocator.AllocateBlockMemory(peers[0], 100, 10)
+	lowLater := allocator.AllocateBlockMemory(peers[0], 100, 1)
+	highLater := allocator.AllocateBlockMemory(peers[0], 100, 10)
+	require.Len(t, low, 0)
+	require.Len(t, high, 0)
+
+	require.NoError(t, allocator.ReleaseBlockMemory(peers[0], 100))
+	require.NoError(t, <-high)
+	require.Len(t, highLater, 0)
+	require.NoError(t, allocator.ReleaseBlockMemory(peers[0], 100))
+	require.NoError(t, <-highLater)
+	require.Len(t, low, 0)
+	require.NoError(t, allocator.ReleaseBlockMemory(peers[0], 100))
+	require.NoError(t, <-low)
+	require.Len(t, lowLater, 0)
+	require.NoError(t, allocator.ReleaseBlockMemory(peers[0], 100))
+	require.NoError(t, <-lowLater)
+}
+
+func TestAllocatorCancelAllocation(t *testing.T) {
+	peers := testutil.GeneratePeers(2)
+	allocator := allocator.NewAllocator(1000, 1000)
+
+	granted := allocator.AllocateBlockMemory(peers[0], 600, 0)
+	pending := allocator.AllocateBlockMemory(peers[0], 600, 0)
+	waiting := allocator.AllocateBlockMemory(peers[0], 300, 0)
+	require.Len(t, pending, 0)
+	require.Len(t, waiting, 0)
+
+	// cancelling a pending allocation lets the allocations behind it through
+	allocator.CancelAllocation(peers[0], pending, 600)
+	require.NoError(t, <-waiting)
+	stats := allocator.Stats()
+	require.Equal(t, uint64(900), stats.TotalAllocatedAllPeers)
+	require.Equal(t, uint64(0), stats.TotalPendingAllocations)
+
+	// cancelling a granted allocation that was never read releases it
+	allocator.CancelAllocation(peers[0], granted, 600)
+	stats = allocator.Stats()
+	require.Equal(t, uint64(300), stats.TotalAllocatedAllPeers)
+	require.Equal(t, uint64(900), stats.PeakAllocatedAllPeers)
+
+	// cancelling an allocation of a peer that was deallocated does nothing
+	deallocated := allocator.AllocateBlockMemory(peers[1], 800, 0)
+	require.Len(t, deallocated, 0)
+	require.NoError(t, allocator.ReleasePeerMemory(peers[1]))
+	allocator.CancelAllocation(peers[1], deallocated, 800)
+	stats = allocator.Stats()
+	require.Equal(t, uint64(300), stats.TotalAllocatedAllPeers)
+	require.Equal(t, uint64(0), stats.TotalPendingAllocations)
+}
+
+func TestAllocatorLimitHits(t *testing.T) {
+	peers := testutil.GeneratePeers(2)
+	allocator := allocator.NewAllocator(1000, 600)
+	limitRecorder := limits.NewRecorder(time.Minute, nil)
+	allocator.SetLimitRecorder(limitRecorder)
+
+	require.NoError(t, <-allocator.AllocateBlockMemory(peers[0], 500, 0))
+	require.NoError(t, <-allocator.AllocateBlockMemory(peers[1], 400, 0))
+	require.Equal(t, uint64(500), allocator.LargestPeerAllocation())
+
+	// over the total limit only
+	allocator.AllocateBlockMemory(peers[1], 150, 0)
+	hits, lastHit := limitRecorder.Hits(graphsync.LimitMaxMemoryResponder)
+	require.Equal(t, uint64(1), hits)
+	require.False(t, lastHit.IsZero())
+	hits, _ = limitRecorder.Hits(graphsync.LimitMaxMemoryPerPeerResponder)
+	require.Equal(t, uint64(0), hits)
+
+	// over both limits
+	allocator.AllocateBlockMemory(peers[0], 150, 0)
+	hits, _ = limitRecorder.Hits(graphsync.LimitMaxMemoryResponder)
+	require.Equal(t, uint64(2), hits)
+	hits, _ = limitRecorder.Hits(graphsync.LimitMaxMemoryPerPeerResponder)
+	require.Equal(t, uint64(1), hits)
+}
+
 func readPending(t *testing.T, pending []pendingResultWithChan) []pendingResultWithChan {
 	t.Helper()
 	morePending := true
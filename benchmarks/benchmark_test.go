@@ -29,6 +29,8 @@ import (
 	"github.com/ipld/go-ipld-prime/node/basicnode"
 	ipldselector "github.com/ipld/go-ipld-prime/traversal/selector"
 	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p-core/peer"
+	tnet "github.com/libp2p/go-libp2p-testing/net"
 	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/sync/errgroup"
@@ -36,6 +38,8 @@ import (
 	"github.com/ipfs/go-graphsync/benchmarks/testinstance"
 	tn "github.com/ipfs/go-graphsync/benchmarks/testnet"
 	graphsync "github.com/ipfs/go-graphsync/impl"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	gsnet "github.com/ipfs/go-graphsync/network"
 )
 
 type runStats struct {
@@ -75,6 +79,64 @@ func BenchmarkRoundtripSuccess(b *testing.B) {
 	})
 }
 
+func BenchmarkMessageCoalescing(b *testing.B) {
+	ctx := context.Background()
+	tdm, err := newTempDirMaker(b)
+	require.NoError(b, err)
+	// 10000 leaves of 200 bytes each
+	df := allFilesUniformSize(10000*200, 200, defaultUnixfsLinksPerLevel, true)
+	b.Run("test-10000-200B-no-delay", func(b *testing.B) {
+		benchmarkMessageCoalescing(ctx, b, df, tdm, nil)
+	})
+	b.Run("test-10000-200B-5ms-delay", func(b *testing.B) {
+		benchmarkMessageCoalescing(ctx, b, df, tdm, []graphsync.Option{graphsync.MessageSendDelay(5 * time.Millisecond)})
+	})
+}
+
+// benchmarkMessageCoalescing fetches a file of many small blocks and reports
+// the number of response messages sent for each fetch alongside the time taken
+func benchmarkMessageCoalescing(ctx context.Context, b *testing.B, df distFunc, tdm *tempDirMaker, options []graphsync.Option) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	mn := mocknet.New()
+	var responseMessages int64
+	net := &countingNetwork{tn.StreamNet(ctx, mn), &responseMessages}
+	ig := testinstance.NewTestInstanceGenerator(ctx, net, options, tdm, false)
+	instances, err := ig.Instances(1 + b.N)
+	require.NoError(b, err)
+	root := df(ctx, b, instances[:1])[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+
+	allSelector := ssb.ExploreRecursive(ipldselector.RecursionLimitNone(),
+		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+
+	runtime.GC()
+	atomic.StoreInt64(&responseMessages, 0)
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		fetcher := instances[i+1]
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		start := time.Now()
+		responseChan, errChan := fetcher.Exchange.Request(ctx, instances[0].Peer, cidlink.Link{Cid: root}, allSelector)
+		for range responseChan {
+		}
+		for err := range errChan {
+			b.Fatalf("received error on request: %s", err.Error())
+		}
+		result := runStats{
+			Time: time.Since(start),
+			Name: b.Name(),
+		}
+		benchmarkLog = append(benchmarkLog, result)
+		cancel()
+		fetcher.Close()
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(&responseMessages))/float64(b.N), "msgs/op")
+	testinstance.Close(instances)
+	ig.Close()
+}
+
 func benchmarkRepeatedDisconnects(ctx context.Context, b *testing.B, numnodes int, df distFunc, tdm *tempDirMaker) {
 	ctx, cancel := context.WithCancel(ctx)
 	mn := mocknet.New()
@@ -322,6 +384,42 @@ func allFilesMissingTopLevelBlock(size uint64, unixfsChunkSize uint64, unixfsLin
 	}
 }
 
+// countingNetwork counts the messages with responses sent by every instance
+// on the network
+type countingNetwork struct {
+	tn.Network
+	responseMessages *int64
+}
+
+func (cn *countingNetwork) Adapter(p tnet.Identity) gsnet.GraphSyncNetwork {
+	return &countingAdapter{cn.Network.Adapter(p), cn.responseMessages}
+}
+
+type countingAdapter struct {
+	gsnet.GraphSyncNetwork
+	responseMessages *int64
+}
+
+func (ca *countingAdapter) NewMessageSender(ctx context.Context, p peer.ID, opts gsnet.MessageSenderOpts) (gsnet.MessageSender, error) {
+	sender, err := ca.GraphSyncNetwork.NewMessageSender(ctx, p, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &countingSender{sender, ca.responseMessages}, nil
+}
+
+type countingSender struct {
+	gsnet.MessageSender
+	responseMessages *int64
+}
+
+func (cs *countingSender) SendMsg(ctx context.Context, msg gsmsg.GraphSyncMessage) error {
+	if len(msg.Responses()) > 0 || len(msg.Blocks()) > 0 {
+		atomic.AddInt64(cs.responseMessages, 1)
+	}
+	return cs.MessageSender.SendMsg(ctx, msg)
+}
+
 type tempDirMaker struct {
 	tdm        string
 	tempDirSeq int32
@@ -0,0 +1,26 @@
+package carframing
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/ipfs/go-cid"
+)
+
+// WriteBlock writes a block to w as a CAR block section: the length of the
+// rest of the section as an unsigned varint, then the CID, then the block data
+func WriteBlock(w io.Writer, c cid.Cid, data []byte) error {
+	cidBytes := c.Bytes()
+	section := make([]byte, 0, binary.MaxVarintLen64+len(cidBytes)+len(data))
+	section = appendUvarint(section, uint64(len(cidBytes)+len(data)))
+	section = append(section, cidBytes...)
+	section = append(section, data...)
+	_, err := w.Write(section)
+	return err
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], v)
+	return append(buf, scratch[:n]...)
+}
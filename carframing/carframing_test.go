@@ -0,0 +1,37 @@
+package carframing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestWriteBlock(t *testing.T) {
+	blks := testutil.GenerateBlocksOfSize(3, 200)
+	var buf bytes.Buffer
+	for _, blk := range blks {
+		require.NoError(t, WriteBlock(&buf, blk.Cid(), blk.RawData()))
+	}
+
+	reader := bufio.NewReader(&buf)
+	for _, blk := range blks {
+		length, err := binary.ReadUvarint(reader)
+		require.NoError(t, err)
+		section := make([]byte, length)
+		_, err = io.ReadFull(reader, section)
+		require.NoError(t, err)
+		n, c, err := cid.CidFromBytes(section)
+		require.NoError(t, err)
+		require.Equal(t, blk.Cid(), c)
+		require.Equal(t, blk.RawData(), section[n:])
+	}
+	_, err := reader.ReadByte()
+	require.Equal(t, io.EOF, err)
+}
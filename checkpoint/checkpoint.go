@@ -0,0 +1,170 @@
+package checkpoint
+
+import (
+	"errors"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/cidset"
+)
+
+// EncodeCheckpoints encodes request checkpoints as DAG-CBOR, so they can be
+// stored until the requests are resumed
+func EncodeCheckpoints(checkpoints []graphsync.RequestCheckpoint) ([]byte, error) {
+	list := fluent.MustBuildList(basicnode.Prototype.List, int64(len(checkpoints)), func(la fluent.ListAssembler) {
+		for _, checkpoint := range checkpoints {
+			la.AssembleValue().AssignNode(encodeCheckpoint(checkpoint))
+		}
+	})
+	return ipld.Encode(list, dagcbor.Encode)
+}
+
+func encodeCheckpoint(checkpoint graphsync.RequestCheckpoint) datamodel.Node {
+	received := checkpoint.Received
+	if received == nil {
+		received = cid.NewSet()
+	}
+	return fluent.MustBuildMap(basicnode.Prototype.Map, 5, func(ma fluent.MapAssembler) {
+		ma.AssembleEntry("Peer").AssignBytes([]byte(checkpoint.Peer))
+		ma.AssembleEntry("Root").AssignLink(cidlink.Link{Cid: checkpoint.Root})
+		ma.AssembleEntry("Selector").AssignNode(checkpoint.Selector)
+		ma.AssembleEntry("Extensions").CreateMap(int64(len(checkpoint.Extensions)), func(ma fluent.MapAssembler) {
+			for _, extension := range checkpoint.Extensions {
+				ma.AssembleEntry(string(extension.Name)).AssignNode(extension.Data)
+			}
+		})
+		ma.AssembleEntry("Received").AssignNode(cidset.EncodeCidSet(received))
+	})
+}
+
+// DecodeCheckpoints decodes request checkpoints encoded with EncodeCheckpoints
+func DecodeCheckpoints(data []byte) ([]graphsync.RequestCheckpoint, error) {
+	node, err := ipld.Decode(data, dagcbor.Decode)
+	if err != nil {
+		return nil, err
+	}
+	if node.Kind() != datamodel.Kind_List {
+		return nil, errors.New("did not receive a list of checkpoints")
+	}
+	checkpoints := make([]graphsync.RequestCheckpoint, 0, node.Length())
+	iter := node.ListIterator()
+	for !iter.Done() {
+		_, next, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		checkpoint, err := decodeCheckpoint(next)
+		if err != nil {
+			return nil, err
+		}
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	return checkpoints, nil
+}
+
+func decodeCheckpoint(node datamodel.Node) (graphsync.RequestCheckpoint, error) {
+	if node.Kind() != datamodel.Kind_Map {
+		return graphsync.RequestCheckpoint{}, errors.New("did not receive a checkpoint map")
+	}
+	peerNode, err := node.LookupByString("Peer")
+	if err != nil {
+		return graphsync.RequestCheckpoint{}, err
+	}
+	peerBytes, err := peerNode.AsBytes()
+	if err != nil {
+		return graphsync.RequestCheckpoint{}, err
+	}
+	rootNode, err := node.LookupByString("Root")
+	if err != nil {
+		return graphsync.RequestCheckpoint{}, err
+	}
+	root, err := rootNode.AsLink()
+	if err != nil {
+		return graphsync.RequestCheckpoint{}, err
+	}
+	rootCid, ok := root.(cidlink.Link)
+	if !ok {
+		return graphsync.RequestCheckpoint{}, errors.New("root is not a CID link")
+	}
+	selector, err := node.LookupByString("Selector")
+	if err != nil {
+		return graphsync.RequestCheckpoint{}, err
+	}
+	extensionsNode, err := node.LookupByString("Extensions")
+	if err != nil {
+		return graphsync.RequestCheckpoint{}, err
+	}
+	if extensionsNode.Kind() != datamodel.Kind_Map {
+		return graphsync.RequestCheckpoint{}, errors.New("did not receive a map of extensions")
+	}
+	var extensions []graphsync.ExtensionData
+	extensionsIter := extensionsNode.MapIterator()
+	for !extensionsIter.Done() {
+		nameNode, data, err := extensionsIter.Next()
+		if err != nil {
+			return graphsync.RequestCheckpoint{}, err
+		}
+		name, err := nameNode.AsString()
+		if err != nil {
+			return graphsync.RequestCheckpoint{}, err
+		}
+		extensions = append(extensions, graphsync.ExtensionData{Name: graphsync.ExtensionName(name), Data: data})
+	}
+	receivedNode, err := node.LookupByString("Received")
+	if err != nil {
+		return graphsync.RequestCheckpoint{}, err
+	}
+	received, err := cidset.DecodeCidSet(receivedNode)
+	if err != nil {
+		return graphsync.RequestCheckpoint{}, err
+	}
+	return graphsync.RequestCheckpoint{
+		Peer:       peer.ID(peerBytes),
+		Root:       rootCid.Cid,
+		Selector:   selector,
+		Extensions: extensions,
+		Received:   received,
+	}, nil
+}
+
+// EncodeProgressState encodes the progress of a request as DAG-CBOR, for a
+// graphsync.PersistenceStore to save
+func EncodeProgressState(state graphsync.ProgressState) ([]byte, error) {
+	received := state.Received
+	if received == nil {
+		received = cid.NewSet()
+	}
+	node := fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(ma fluent.MapAssembler) {
+		ma.AssembleEntry("Received").AssignNode(cidset.EncodeCidSet(received))
+	})
+	return ipld.Encode(node, dagcbor.Encode)
+}
+
+// DecodeProgressState decodes the progress of a request encoded with
+// EncodeProgressState
+func DecodeProgressState(data []byte) (graphsync.ProgressState, error) {
+	node, err := ipld.Decode(data, dagcbor.Decode)
+	if err != nil {
+		return graphsync.ProgressState{}, err
+	}
+	if node.Kind() != datamodel.Kind_Map {
+		return graphsync.ProgressState{}, errors.New("did not receive a progress state map")
+	}
+	receivedNode, err := node.LookupByString("Received")
+	if err != nil {
+		return graphsync.ProgressState{}, err
+	}
+	received, err := cidset.DecodeCidSet(receivedNode)
+	if err != nil {
+		return graphsync.ProgressState{}, err
+	}
+	return graphsync.ProgressState{Received: received}, nil
+}
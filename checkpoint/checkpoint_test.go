@@ -0,0 +1,80 @@
+package checkpoint
+
+import (
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestEncodeDecodeCheckpoints(t *testing.T) {
+	peers := testutil.GeneratePeers(2)
+	cids := testutil.GenerateCids(4)
+	received := cid.NewSet()
+	received.Add(cids[1])
+	received.Add(cids[2])
+	checkpoints := []graphsync.RequestCheckpoint{
+		{
+			Peer:     peers[0],
+			Root:     cids[0],
+			Selector: selectorparse.CommonSelector_ExploreAllRecursively,
+			Extensions: []graphsync.ExtensionData{
+				{Name: "app/voucher", Data: basicnode.NewString("apples")},
+			},
+			Received: received,
+		},
+		{
+			Peer:     peers[1],
+			Root:     cids[3],
+			Selector: selectorparse.CommonSelector_MatchPoint,
+		},
+	}
+
+	data, err := EncodeCheckpoints(checkpoints)
+	require.NoError(t, err)
+	decoded, err := DecodeCheckpoints(data)
+	require.NoError(t, err)
+	require.Len(t, decoded, 2)
+	for i, checkpoint := range checkpoints {
+		require.Equal(t, checkpoint.Peer, decoded[i].Peer)
+		require.Equal(t, checkpoint.Root, decoded[i].Root)
+		require.True(t, ipld.DeepEqual(checkpoint.Selector, decoded[i].Selector))
+		require.Len(t, decoded[i].Extensions, len(checkpoint.Extensions))
+		for j, extension := range checkpoint.Extensions {
+			require.Equal(t, extension.Name, decoded[i].Extensions[j].Name)
+			require.True(t, ipld.DeepEqual(extension.Data, decoded[i].Extensions[j].Data))
+		}
+	}
+	require.ElementsMatch(t, received.Keys(), decoded[0].Received.Keys())
+	require.Equal(t, 0, decoded[1].Received.Len())
+
+	_, err = DecodeCheckpoints([]byte("not cbor"))
+	require.Error(t, err)
+}
+
+func TestEncodeDecodeProgressState(t *testing.T) {
+	received := cid.NewSet()
+	for _, c := range testutil.GenerateCids(3) {
+		received.Add(c)
+	}
+	data, err := EncodeProgressState(graphsync.ProgressState{Received: received})
+	require.NoError(t, err)
+	decoded, err := DecodeProgressState(data)
+	require.NoError(t, err)
+	require.ElementsMatch(t, received.Keys(), decoded.Received.Keys())
+
+	data, err = EncodeProgressState(graphsync.ProgressState{})
+	require.NoError(t, err)
+	decoded, err = DecodeProgressState(data)
+	require.NoError(t, err)
+	require.Equal(t, 0, decoded.Received.Len())
+
+	_, err = DecodeProgressState([]byte("not cbor"))
+	require.Error(t, err)
+}
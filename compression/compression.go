@@ -0,0 +1,133 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+// MinBlockSize is the size in bytes of the smallest block whose data is
+// compressed. Smaller blocks gain too little to be worth compressing
+const MinBlockSize = 256
+
+// MaxDecompressedSize is the largest size in bytes the built in codecs will
+// decompress block data to, so a peer cannot exhaust memory with a small
+// message that decompresses to a huge block
+const MaxDecompressedSize = 20 << 20
+
+var (
+	codecsLk sync.RWMutex
+	codecs   = map[string]graphsync.CompressionCodec{}
+)
+
+func init() {
+	Register(Gzip())
+}
+
+// Register makes a codec available to decompress block data received from
+// peers. Registering a codec with the same name as another replaces it
+func Register(codec graphsync.CompressionCodec) {
+	codecsLk.Lock()
+	defer codecsLk.Unlock()
+	codecs[codec.Name()] = codec
+}
+
+// Lookup returns the registered codec with the given name
+func Lookup(name string) (graphsync.CompressionCodec, bool) {
+	codecsLk.RLock()
+	defer codecsLk.RUnlock()
+	codec, ok := codecs[name]
+	return codec, ok
+}
+
+// Gzip returns a codec that compresses block data with gzip
+func Gzip() graphsync.CompressionCodec {
+	return gzipCodec{}
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	decompressed, err := io.ReadAll(io.LimitReader(r, MaxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > MaxDecompressedSize {
+		return nil, fmt.Errorf("decompressed block exceeds %d bytes", MaxDecompressedSize)
+	}
+	return decompressed, nil
+}
+
+// EncodeCodecNames encodes the names of the codecs a requestor can decompress
+// for the block-compression extension on a request
+func EncodeCodecNames(names []string) datamodel.Node {
+	return fluent.MustBuildList(basicnode.Prototype.List, int64(len(names)), func(la fluent.ListAssembler) {
+		for _, name := range names {
+			la.AssembleValue().AssignString(name)
+		}
+	})
+}
+
+// DecodeCodecNames decodes the names of the codecs a requestor can decompress
+// from the block-compression extension on a request
+func DecodeCodecNames(data datamodel.Node) ([]string, error) {
+	if data.Kind() != datamodel.Kind_List {
+		return nil, errors.New("did not receive a list of codec names")
+	}
+	names := make([]string, 0, data.Length())
+	iter := data.ListIterator()
+	for !iter.Done() {
+		_, next, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		name, err := next.AsString()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// EncodeCodecName encodes the name of the codec a responder compresses blocks
+// with for the block-compression extension on a response
+func EncodeCodecName(name string) datamodel.Node {
+	return basicnode.NewString(name)
+}
+
+// DecodeCodecName decodes the name of the codec a responder compresses blocks
+// with from the block-compression extension on a response
+func DecodeCodecName(data datamodel.Node) (string, error) {
+	return data.AsString()
+}
@@ -0,0 +1,50 @@
+package compression
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGzip(t *testing.T) {
+	data := bytes.Repeat([]byte("graphsync "), 1000)
+	codec := Gzip()
+	compressed, err := codec.Compress(data)
+	require.NoError(t, err)
+	require.Less(t, len(compressed), len(data))
+	decompressed, err := codec.Decompress(compressed)
+	require.NoError(t, err)
+	require.Equal(t, data, decompressed)
+
+	_, err = codec.Decompress([]byte("not gzip"))
+	require.Error(t, err)
+
+	// refuses to decompress data larger than the limit
+	compressed, err = codec.Compress(make([]byte, MaxDecompressedSize+1))
+	require.NoError(t, err)
+	_, err = codec.Decompress(compressed)
+	require.Error(t, err)
+}
+
+func TestRegistry(t *testing.T) {
+	codec, ok := Lookup("gzip")
+	require.True(t, ok)
+	require.Equal(t, "gzip", codec.Name())
+	_, ok = Lookup("unknown")
+	require.False(t, ok)
+}
+
+func TestDecodeEncodeCodecNames(t *testing.T) {
+	names := []string{"gzip", "zstd"}
+	decoded, err := DecodeCodecNames(EncodeCodecNames(names))
+	require.NoError(t, err)
+	require.Equal(t, names, decoded)
+	_, err = DecodeCodecNames(basicnode.NewString("gzip"))
+	require.Error(t, err)
+
+	name, err := DecodeCodecName(EncodeCodecName("gzip"))
+	require.NoError(t, err)
+	require.Equal(t, "gzip", name)
+}
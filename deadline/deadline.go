@@ -0,0 +1,31 @@
+package deadline
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+// EncodeDeadline returns encoded cbor data for the time left until a request's
+// deadline, as a whole number of milliseconds. A deadline that has already
+// passed is encoded as zero
+func EncodeDeadline(timeLeft time.Duration) datamodel.Node {
+	if timeLeft < 0 {
+		timeLeft = 0
+	}
+	return basicnode.NewInt(timeLeft.Milliseconds())
+}
+
+// DecodeDeadline returns the time left until a request's deadline
+func DecodeDeadline(data datamodel.Node) (time.Duration, error) {
+	ms, err := data.AsInt()
+	if err != nil {
+		return 0, err
+	}
+	if ms < 0 {
+		return 0, errors.New("deadline must not be negative")
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
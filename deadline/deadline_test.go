@@ -0,0 +1,30 @@
+package deadline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeEncodeDeadline(t *testing.T) {
+	decoded, err := DecodeDeadline(EncodeDeadline(1500 * time.Millisecond))
+	require.NoError(t, err)
+	require.Equal(t, 1500*time.Millisecond, decoded)
+
+	// sub-millisecond precision is dropped
+	decoded, err = DecodeDeadline(EncodeDeadline(2*time.Second + 300*time.Microsecond))
+	require.NoError(t, err)
+	require.Equal(t, 2*time.Second, decoded)
+
+	// a deadline that has passed leaves no time
+	decoded, err = DecodeDeadline(EncodeDeadline(-time.Second))
+	require.NoError(t, err)
+	require.Equal(t, time.Duration(0), decoded)
+
+	_, err = DecodeDeadline(basicnode.NewInt(-1))
+	require.Error(t, err)
+	_, err = DecodeDeadline(basicnode.NewString("soon"))
+	require.Error(t, err)
+}
@@ -4,8 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime"
 	"github.com/ipld/go-ipld-prime/datamodel"
@@ -74,8 +80,154 @@ const (
 	// ExtensionDeDupByKey tells the responding peer to only deduplicate block sending
 	// for requests that have the same key. The data for the extension is a string key
 	ExtensionDeDupByKey = ExtensionName("graphsync/dedup-by-key")
+
+	// ExtensionSelectorBudgetExceeded is sent by the responding peer with the
+	// final response when it stops a traversal for exceeding its link or depth
+	// budget. The data for the extension is the kind of budget exceeded
+	ExtensionSelectorBudgetExceeded = ExtensionName("graphsync/selector-budget-exceeded")
+
+	// ExtensionSelectorProposal is sent by the responding peer, with a rejection
+	// and no blocks, when it offers to serve an alternate selector in place of
+	// the one requested. The data for the extension is a map of the proposed
+	// Selector and the Reason for the proposal
+	ExtensionSelectorProposal = ExtensionName("graphsync/selector-proposal")
+
+	// ExtensionSelectorProposalAccepted is sent by the requesting peer when it
+	// re-issues a request with a selector the responder proposed. The data for
+	// the extension is the selector originally requested
+	ExtensionSelectorProposalAccepted = ExtensionName("graphsync/selector-proposal-accepted")
+
+	// ExtensionResume tells the responding peer which blocks the requesting peer
+	// already received from an interrupted attempt at the same request, so they
+	// are not sent again. The data for the extension is a list of CIDs, like
+	// ExtensionDoNotSendCIDs
+	ExtensionResume = ExtensionName("graphsync/resume")
+
+	// ExtensionFailureReason is sent by the responding peer with the final
+	// response when a request hook ends the request with an error. The data for
+	// the extension is the error message, as a string
+	ExtensionFailureReason = ExtensionName("graphsync/failure-reason")
+
+	// ExtensionRemoteError is sent by the responding peer with the final
+	// response when a hook ends the request with a RemoteError. The data for
+	// the extension is a map of the error's Code and Message, and its Payload
+	// if it has one
+	ExtensionRemoteError = ExtensionName("graphsync/remote-error")
+
+	// ExtensionMetadataOnly tells the responding peer to traverse the selector
+	// as usual but send only the link metadata for the traversal, with no block
+	// data. The data for the extension is ignored
+	ExtensionMetadataOnly = ExtensionName("graphsync/metadata-only")
+
+	// ExtensionSupportedExtensions lets peers discover which extensions the
+	// other understands. The requesting peer sends it with its first request to
+	// a peer, listing the extensions it supports, and the responding peer sends
+	// back the ones it also supports with its first response to the request.
+	// The data for the extension is a list of extension names, as strings
+	ExtensionSupportedExtensions = ExtensionName("graphsync/supported-extensions")
+
+	// ExtensionCancelAck is listed in the supported-extensions extension by
+	// requesting peers that understand a final RequestCancelled status sent in
+	// reply to their cancel request. Only requesting peers that list it get the
+	// reply, which carries the extension so the requesting peer can tell it
+	// from a response cancelled for another reason. Older requesting peers
+	// pause a request by cancelling it, and would take the reply as a failure.
+	// The data for the extension is ignored
+	ExtensionCancelAck = ExtensionName("graphsync/cancel-ack")
+
+	// ExtensionDeadline tells the responding peer how long the requesting peer
+	// will wait for the request to finish, so the responding peer can stop
+	// working on it once the requesting peer has given up. It is sent
+	// automatically when a request's context has a deadline. The data for the
+	// extension is the time left until the deadline, in milliseconds
+	ExtensionDeadline = ExtensionName("graphsync/deadline")
+
+	// ExtensionBlockCompression asks the responding peer to compress the blocks
+	// it sends. The requesting peer sends it with a list of the names of the
+	// compression codecs it can decompress, as strings, and the responding peer
+	// sends back the name of the codec it compresses blocks with, as a string.
+	// It is only understood by peers configured with a compression codec
+	ExtensionBlockCompression = ExtensionName("graphsync/block-compression")
 )
 
+// KnownExtensions returns the names of the extensions graphsync itself
+// understands
+func KnownExtensions() []ExtensionName {
+	return []ExtensionName{
+		ExtensionDoNotSendCIDs,
+		ExtensionsDoNotSendFirstBlocks,
+		ExtensionDeDupByKey,
+		ExtensionSelectorBudgetExceeded,
+		ExtensionSelectorProposal,
+		ExtensionSelectorProposalAccepted,
+		ExtensionResume,
+		ExtensionFailureReason,
+		ExtensionRemoteError,
+		ExtensionMetadataOnly,
+		ExtensionDeadline,
+		ExtensionCancelAck,
+	}
+}
+
+// ResumeState describes what an interrupted request already received, so that
+// a new attempt at the request can pick up where it left off
+type ResumeState struct {
+	// Received is the set of blocks already received
+	Received *cid.Set
+}
+
+// RequestCheckpoint is the state of an in progress outgoing request needed to
+// resume it in another process, such as after a restart, without fetching the
+// blocks it already received again
+type RequestCheckpoint struct {
+	Peer     peer.ID
+	Root     cid.Cid
+	Selector ipld.Node
+	// Extensions are the extensions on the request other than those graphsync
+	// itself uses
+	Extensions []ExtensionData
+	// Received is the set of blocks the request already received and stored
+	Received *cid.Set
+}
+
+// ProgressState is the progress an outgoing request has made, saved by a
+// PersistenceStore so the request can be resumed after a restart
+type ProgressState struct {
+	// Received is the set of blocks the request already received and stored
+	Received *cid.Set
+}
+
+// PersistenceStore saves the progress of outgoing requests as they run, so
+// requests for large DAGs can be resumed with ResumeRequest after a restart
+// without fetching again the blocks already received. Progress is saved
+// periodically and when the exchange is closed, so blocks received since the
+// last save are fetched again on resume
+type PersistenceStore interface {
+	// SaveProgress stores the progress of a request, replacing any progress
+	// saved for it before
+	SaveProgress(requestID RequestID, state ProgressState) error
+	// LoadProgress returns the progress last saved for a request, or false if
+	// none was saved
+	LoadProgress(requestID RequestID) (ProgressState, bool, error)
+}
+
+// ResumedRequest is a request re-issued from a checkpoint
+type ResumedRequest struct {
+	Checkpoint RequestCheckpoint
+	Responses  <-chan ResponseProgress
+	Errors     <-chan error
+}
+
+// RequestIDInUseErr is an error message received on the error channel when a new
+// request is given the ID of a request that is in progress
+type RequestIDInUseErr struct {
+	RequestID RequestID
+}
+
+func (e RequestIDInUseErr) Error() string {
+	return fmt.Sprintf("request id %s is already in use", e.RequestID)
+}
+
 // RequestClientCancelledErr is an error message received on the error channel when the request is cancelled on by the client code,
 // either by closing the passed request context or calling CancelRequest
 type RequestClientCancelledErr struct{}
@@ -84,6 +236,50 @@ func (e RequestClientCancelledErr) Error() string {
 	return "request cancelled by client"
 }
 
+// SelectorBudgetExceededErr is an error message received on the error channel when
+// the responder stopped the traversal for exceeding its link or depth budget.
+// Blocks received before the budget was exceeded are still valid
+type SelectorBudgetExceededErr struct {
+	// Kind is the kind of budget exceeded, if the responder sent it
+	Kind string
+}
+
+func (e SelectorBudgetExceededErr) Error() string {
+	if e.Kind == "" {
+		return "request failed - responder budget exceeded"
+	}
+	return fmt.Sprintf("request failed - responder %s budget exceeded", e.Kind)
+}
+
+// SelectorProposal is an alternate selector a responder offers to serve in place
+// of the selector that was requested
+type SelectorProposal struct {
+	Selector ipld.Node
+	Reason   string
+}
+
+// SelectorProposalDeclinedErr is an error message received on the error channel when
+// the responder proposed an alternate selector and no selector proposal hook accepted it
+type SelectorProposalDeclinedErr struct {
+	Proposal SelectorProposal
+}
+
+func (e SelectorProposalDeclinedErr) Error() string {
+	return fmt.Sprintf("request failed - declined responder proposal of alternate selector: %s", e.Proposal.Reason)
+}
+
+// SelectorProposalLimitErr is an error message received on the error channel
+// when the responder proposed an alternate selector after the request was
+// already re-issued the most times allowed with selectors it proposed
+type SelectorProposalLimitErr struct {
+	Proposal SelectorProposal
+	Reissued int
+}
+
+func (e SelectorProposalLimitErr) Error() string {
+	return fmt.Sprintf("request failed - responder proposed another alternate selector after %d re-issues: %s", e.Reissued, e.Proposal.Reason)
+}
+
 // RequestFailedBusyErr is an error message received on the error channel when the peer is busy
 type RequestFailedBusyErr struct{}
 
@@ -112,6 +308,15 @@ func (e RequestFailedUnknownErr) Error() string {
 	return "request failed - unknown reason"
 }
 
+// RequestCompletedPartialErr is an error message received on the error channel when the responder completed
+// the request but only sent part of the requested DAG, for instance because it was missing blocks. It is the
+// last error for the request, and does not mean the blocks received were invalid
+type RequestCompletedPartialErr struct{}
+
+func (e RequestCompletedPartialErr) Error() string {
+	return "request completed partially - responder sent only part of the requested data"
+}
+
 // RequestCancelledErr is an error message received on the error channel that indicates the responder cancelled a request
 type RequestCancelledErr struct{}
 
@@ -119,6 +324,154 @@ func (e RequestCancelledErr) Error() string {
 	return "request failed - responder cancelled"
 }
 
+// FailureReasonErr is an error message received on the error channel when the
+// responder explained why it failed the request. Err is the error for the
+// response status, and is matched by errors.Is and errors.As
+type FailureReasonErr struct {
+	Err    error
+	Reason string
+}
+
+func (e FailureReasonErr) Error() string {
+	return fmt.Sprintf("%s: %s", e.Err, e.Reason)
+}
+
+func (e FailureReasonErr) Unwrap() error {
+	return e.Err
+}
+
+// RemoteError is an error with a code and message that a responder hook ends
+// a request with, by passing it to TerminateWithError, so the requestor can
+// tell why the request failed. The requestor receives it on the error channel.
+// Codes are agreed between applications, and mean nothing to graphsync
+type RemoteError struct {
+	// Err is the error for the response status on the requestor, and is
+	// matched by errors.Is and errors.As. It is not sent by the responder
+	Err error
+
+	code    int64
+	message string
+	payload ipld.Node
+}
+
+// NewRemoteError returns a RemoteError with the given code and message
+func NewRemoteError(code int64, message string) RemoteError {
+	return RemoteError{code: code, message: message}
+}
+
+// WithPayload returns a copy of the error that also sends the given data to
+// the requestor
+func (e RemoteError) WithPayload(payload ipld.Node) RemoteError {
+	e.payload = payload
+	return e
+}
+
+// Code returns the application defined code for the error
+func (e RemoteError) Code() int64 {
+	return e.code
+}
+
+// Message returns the message for the error
+func (e RemoteError) Message() string {
+	return e.message
+}
+
+// Payload returns the data sent with the error, or nil if there was none
+func (e RemoteError) Payload() ipld.Node {
+	return e.payload
+}
+
+func (e RemoteError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("remote error %d: %s", e.code, e.message)
+	}
+	return fmt.Sprintf("%s: remote error %d: %s", e.Err, e.code, e.message)
+}
+
+func (e RemoteError) Unwrap() error {
+	return e.Err
+}
+
+// RequestRejectedErr is an error message received on the error channel when the responder did not accept the request
+type RequestRejectedErr struct{}
+
+func (e RequestRejectedErr) Error() string {
+	return "request failed - rejected by responder"
+}
+
+// UnknownResponseStatusErr is an error message received on the error channel when the responder ended the
+// request with a status code this implementation does not recognise
+type UnknownResponseStatusErr struct {
+	Code ResponseStatusCode
+}
+
+func (e UnknownResponseStatusErr) Error() string {
+	return fmt.Sprintf("request failed - unknown response status code: %d", e.Code)
+}
+
+// MalformedResponseErr is an error message received on the error channel when
+// the responder sent a message that could not be decoded. The responses it held
+// are lost, so every request in progress with the peer fails
+type MalformedResponseErr struct {
+	Peer peer.ID
+	Err  error
+}
+
+func (e MalformedResponseErr) Error() string {
+	return fmt.Sprintf("request failed - malformed response from peer %s: %s", e.Peer, e.Err)
+}
+
+func (e MalformedResponseErr) Unwrap() error {
+	return e.Err
+}
+
+// RequestAttemptErr describes the network error that ended the attempt to
+// make a request to a single peer
+type RequestAttemptErr struct {
+	Peer peer.ID
+	Err  error
+}
+
+func (e RequestAttemptErr) Error() string {
+	return fmt.Sprintf("request to peer %s failed: %s", e.Peer, e.Err)
+}
+
+func (e RequestAttemptErr) Unwrap() error {
+	return e.Err
+}
+
+// RetryPeersFailedErr is an error message received on the error channel when a
+// request with retry peers failed with a network error on every attempt
+type RetryPeersFailedErr struct {
+	Attempts []RequestAttemptErr
+}
+
+func (e RetryPeersFailedErr) Error() string {
+	attempts := make([]string, 0, len(e.Attempts))
+	for _, attempt := range e.Attempts {
+		attempts = append(attempts, attempt.Error())
+	}
+	return fmt.Sprintf("request failed - every attempt failed: %s", strings.Join(attempts, "; "))
+}
+
+// BlocksNotSentErr is passed to network error listeners when a response fails
+// to send with blocks still unsent, either in the message that failed or
+// queued behind it. Blocks are listed in the order they were queued, and are
+// never reported to block sent listeners. Err is the network error, and is
+// matched by errors.Is and errors.As
+type BlocksNotSentErr struct {
+	Blocks []BlockData
+	Err    error
+}
+
+func (e BlocksNotSentErr) Error() string {
+	return fmt.Sprintf("%s (%d blocks not sent)", e.Err, len(e.Blocks))
+}
+
+func (e BlocksNotSentErr) Unwrap() error {
+	return e.Err
+}
+
 // RequestNotFoundErr indicates that a request with a particular request ID was not found
 type RequestNotFoundErr struct{}
 
@@ -126,9 +479,17 @@ func (e RequestNotFoundErr) Error() string {
 	return "request not found"
 }
 
+// ExchangeClosedErr indicates a request was made, or was still in progress,
+// after the graphsync exchange was closed
+type ExchangeClosedErr struct{}
+
+func (e ExchangeClosedErr) Error() string {
+	return "graphsync exchange closed"
+}
+
 // RemoteMissingBlockErr indicates that the remote peer was missing a block
 // in the selector requested, and we also don't have it locally.
-// It is a  -terminal error in the error stream
+// It is a non-terminal error in the error stream
 // for a request and does NOT cause a request to fail completely
 type RemoteMissingBlockErr struct {
 	Link ipld.Link
@@ -152,19 +513,115 @@ func (e RemoteIncorrectResponseError) Error() string {
 	return fmt.Sprintf("expected link (%s) at path %s does not match link sent by remote (%s), possible malicious responder", e.LocalLink, e.Path, e.RemoteLink)
 }
 
+// ErrDenylistedCID indicates a traversal reached a link whose CID is on the
+// configured denylist. On the requestor, it is a terminal error for the request
+// and the block is never stored.
+type ErrDenylistedCID struct {
+	Link ipld.Link
+	Path ipld.Path
+}
+
+func (e ErrDenylistedCID) Error() string {
+	return fmt.Sprintf("traversal reached denylisted block (%s) at path %s", e.Link, e.Path)
+}
+
+// ErrPeerDisconnected indicates the remote peer disconnected before a request
+// finished. On the requestor, it is a terminal error for the request, and on
+// the responder, it is the error network error listeners receive for each
+// response to the peer
+type ErrPeerDisconnected struct {
+	Peer peer.ID
+}
+
+func (e ErrPeerDisconnected) Error() string {
+	return fmt.Sprintf("disconnected from peer %s", e.Peer)
+}
+
+// ErrBlockVerificationFailed indicates a block received from the remote peer
+// does not hash to its CID, so it is corrupted or was sent by a malicious
+// responder. It is a terminal error for the request.
+type ErrBlockVerificationFailed struct {
+	Cid cid.Cid
+}
+
+func (e ErrBlockVerificationFailed) Error() string {
+	return fmt.Sprintf("received block does not match its cid (%s)", e.Cid)
+}
+
+// ErrInvalidBlock indicates strict verification rejected a block received
+// from the remote peer before it was stored, because it does not hash to the
+// link it was sent for or is larger than allowed. It is a terminal error for
+// the request.
+type ErrInvalidBlock struct {
+	Link   ipld.Link
+	Reason string
+}
+
+func (e ErrInvalidBlock) Error() string {
+	return fmt.Sprintf("invalid block received for %s: %s", e.Link, e.Reason)
+}
+
 var (
 	// ErrExtensionAlreadyRegistered means a user extension can be registered only once
 	ErrExtensionAlreadyRegistered = errors.New("extension already registered")
+	// ErrGraphsyncClosed means a request was made, or was still in progress,
+	// after the graphsync exchange was closed. It is an ExchangeClosedErr, so
+	// errors.Is matches either
+	ErrGraphsyncClosed error = ExchangeClosedErr{}
 )
 
 // ResponseProgress is the fundamental unit of responses making progress in Graphsync.
 type ResponseProgress struct {
-	Node      ipld.Node // a node which matched the graphsync query
+	Node      ipld.Node // a node visited by the graphsync query
 	Path      ipld.Path // the path of that node relative to the traversal start
 	LastBlock struct {  // LastBlock stores the Path and Link of the last block edge we had to load.
 		Path ipld.Path
 		Link ipld.Link
 	}
+	Stat ResponseStat // Stat is the data transferred for the request up to and including this node
+	// Matched is true when the selector matched the node, so Path is a path
+	// the selector selects, and false when the traversal only walked through
+	// the node on the way to others
+	Matched bool
+}
+
+// RootSelector pairs a root with the selector to traverse from it, for one of
+// several requests made to a peer together
+type RootSelector struct {
+	Root     ipld.Link
+	Selector ipld.Node
+}
+
+// SubRequestProgress is a ResponseProgress for one of several requests made
+// to a peer together. Index is the position of the request's RootSelector
+type SubRequestProgress struct {
+	ResponseProgress
+	Index     int
+	RequestID RequestID
+}
+
+// SubRequestError is an error for one of several requests made to a peer
+// together. Index is the position of the request's RootSelector
+type SubRequestError struct {
+	Index     int
+	RequestID RequestID
+	Err       error
+}
+
+func (e SubRequestError) Error() string {
+	return fmt.Sprintf("request %d (%s) failed: %s", e.Index, e.RequestID, e.Err)
+}
+
+// Unwrap returns the error from the sub-request
+func (e SubRequestError) Unwrap() error {
+	return e.Err
+}
+
+// ResponseStat summarizes the data transferred for a single request
+type ResponseStat struct {
+	// BytesReceived is the total size of the blocks received over the network
+	// for the request. Blocks loaded from the local store are not counted
+	BytesReceived uint64
 }
 
 // RequestData describes a received graphsync request.
@@ -284,6 +741,28 @@ type IncomingRequestHookActions interface {
 	TerminateWithError(error)
 	ValidateRequest()
 	PauseResponse()
+	// ProposeAlternateSelector rejects the request as asked, offering the
+	// requestor the given selector instead
+	ProposeAlternateSelector(selector ipld.Node, reason string)
+	// ValidateSelector replaces the selector the response traverses with the
+	// given one, for example to normalize it or impose a depth limit. The
+	// default selector validator checks the replacement rather than the
+	// original, while later hooks still see the requestor's selector
+	ValidateSelector(validated ipld.Node)
+	// OverridePriority changes the priority the response's blocks are sent
+	// with, in place of the priority the requestor asked for
+	OverridePriority(Priority)
+	// ResponseContext returns a context that lives as long as the response. It
+	// is cancelled exactly once, when the response ends, whether it completes,
+	// fails, is rejected or is cancelled, so hooks can use it to clean up
+	// resources they start for the response
+	ResponseContext() context.Context
+	// PeerExtensions returns the extensions the requestor listed in the
+	// ExtensionSupportedExtensions extension of the first request it sent
+	// since it connected, so hooks for later requests from the peer can see
+	// them too. reported is false if the requestor has not listed its
+	// extensions
+	PeerExtensions() (names []ExtensionName, reported bool)
 }
 
 // OutgoingBlockHookActions are actions that an outgoing block hook can take to
@@ -292,6 +771,10 @@ type OutgoingBlockHookActions interface {
 	SendExtensionData(ExtensionData)
 	TerminateWithError(error)
 	PauseResponse()
+	// BytesSent returns the total size of the blocks sent over the network for
+	// the response, including this block. Blocks the requestor already has, and
+	// so are not sent, are not counted
+	BytesSent() uint64
 }
 
 // OutgoingRequestHookActions are actions that an outgoing request hook can take
@@ -299,6 +782,15 @@ type OutgoingBlockHookActions interface {
 type OutgoingRequestHookActions interface {
 	UsePersistenceOption(name string)
 	UseLinkTargetNodePrototypeChooser(traversal.LinkTargetNodePrototypeChooser)
+	// OverridePriority changes the priority the request is sent and queued with
+	OverridePriority(Priority)
+	// UseResumeState sends the request with a resume extension, so the
+	// responder does not send the blocks already received in the given state
+	UseResumeState(ResumeState)
+	// AddExtensionData sends the request with the given extension. It replaces
+	// any extension with the same name passed to Request or added by an earlier
+	// hook
+	AddExtensionData(ExtensionData)
 }
 
 // IncomingResponseHookActions are actions that incoming response hook can take
@@ -316,6 +808,12 @@ type IncomingBlockHookActions interface {
 	PauseRequest()
 }
 
+// SelectorProposalHookActions are actions that a selector proposal hook can take
+// in response to an alternate selector proposed by the responder
+type SelectorProposalHookActions interface {
+	AcceptProposal()
+}
+
 // RequestUpdatedHookActions are actions that can be taken in a request updated hook to
 // change execution of the response
 type RequestUpdatedHookActions interface {
@@ -324,16 +822,40 @@ type RequestUpdatedHookActions interface {
 	UnpauseResponse()
 }
 
+// CompletingResponseHookActions are actions that a completing response hook can
+// take to add to the final response
+type CompletingResponseHookActions interface {
+	SendExtensionData(ExtensionData)
+}
+
 // OnIncomingRequestHook is a hook that runs each time a new request is received.
 // It receives the peer that sent the request and all data about the request.
 // It receives an interface for customizing the response to this request
 type OnIncomingRequestHook func(p peer.ID, request RequestData, hookActions IncomingRequestHookActions)
 
+// AsyncRequestValidator accepts or rejects an incoming request, and may take
+// as long as it needs to decide, for example to ask an external service. It
+// runs on its own goroutine once incoming request hooks accept the request,
+// and nothing is sent for the request until every validator accepts it. The
+// request is rejected if a validator returns false or an error, or if ctx is
+// done before it returns. Extensions are sent to the requestor either way
+type AsyncRequestValidator func(ctx context.Context, p peer.ID, request RequestData) (accepted bool, extensions []ExtensionData, err error)
+
 // OnIncomingResponseHook is a hook that runs each time a new response is received.
 // It receives the peer that sent the response and all data about the response.
 // It receives an interface for customizing how we handle the ongoing execution of the request
 type OnIncomingResponseHook func(p peer.ID, responseData ResponseData, hookActions IncomingResponseHookActions)
 
+// ResponseHookFilter decides whether an incoming response hook runs for a
+// response. It runs before the hook, so it should be cheap
+type ResponseHookFilter func(p peer.ID, responseData ResponseData) bool
+
+// OnIncomingExtensionResponseHook is a hook that runs each time a response
+// carrying a particular extension is received. It receives the peer that sent
+// the response, the response, and the data for the extension it was
+// registered for
+type OnIncomingExtensionResponseHook func(p peer.ID, responseData ResponseData, extension ExtensionData, hookActions IncomingResponseHookActions)
+
 // OnIncomingBlockHook is a hook that runs each time a new block is validated as
 // part of the response, regardless of whether it came locally or over the network
 // It receives that sent the response, the most recent response, a link for the block received,
@@ -348,6 +870,10 @@ type OnIncomingBlockHook func(p peer.ID, responseData ResponseData, blockData Bl
 // It receives an interface for customizing how we handle executing this request
 type OnOutgoingRequestHook func(p peer.ID, request RequestData, hookActions OutgoingRequestHookActions)
 
+// RequestHookFilter decides whether an outgoing request hook runs for a
+// request. It runs before the hook, so it should be cheap
+type RequestHookFilter func(p peer.ID, request RequestData) bool
+
 // OnOutgoingBlockHook is a hook that runs immediately after a requestor sends a new block
 // on a response
 // It receives the peer we're sending a request to, all the data aobut the request, a link for the block sent,
@@ -360,22 +886,66 @@ type OnOutgoingBlockHook func(p peer.ID, request RequestData, block BlockData, h
 // It receives an interface to taking further action on the response
 type OnRequestUpdatedHook func(p peer.ID, request RequestData, updateRequest RequestData, hookActions RequestUpdatedHookActions)
 
-// OnBlockSentListener runs when a block is sent over the wire
+// OnCompletingResponseHook is a hook that runs on the responder when a response
+// ends, before the message with its final status is queued
+// It receives the peer we're sending to, the request, and the final status
+// Extension data it sends goes out in the same response as the final status
+type OnCompletingResponseHook func(p peer.ID, request RequestData, status ResponseStatusCode, hookActions CompletingResponseHookActions)
+
+// OnSelectorProposalHook is a hook that runs when a responder proposes an alternate
+// selector for an outgoing request. If any hook accepts the proposal, the request
+// is re-issued with the proposed selector; otherwise it fails with SelectorProposalDeclinedErr
+type OnSelectorProposalHook func(p peer.ID, request RequestData, proposal SelectorProposal, hookActions SelectorProposalHookActions)
+
+// OnBlockSentListener runs once the message containing a block has been
+// written to the network. Blocks that are queued but never written are not
+// reported. For each response, it runs for blocks in the order they were sent,
+// and never after a network error listener runs for the same response
 type OnBlockSentListener func(p peer.ID, request RequestData, block BlockData)
 
-// OnNetworkErrorListener runs when queued data is not able to be sent
+// OnNetworkErrorListener runs when queued data is not able to be sent. If
+// blocks for the response were lost, err is a BlocksNotSentErr listing them
 type OnNetworkErrorListener func(p peer.ID, request RequestData, err error)
 
+// OnNegotiationCompleteListener runs on the requesting peer when a responding
+// peer reports which of the requesting peer's supported extensions it also
+// supports. Extensions it does not support are no longer sent to it
+type OnNegotiationCompleteListener func(p peer.ID, supported []ExtensionName)
+
+// OnPeerActivityListener runs with active set to true when graphsync starts
+// work on a request to or from a peer it had no requests in progress with, in
+// either direction, and with active set to false once it has had none in
+// progress with the peer for a short while, so a quick succession of requests
+// is reported once. Listeners run on their own goroutine, in the order the
+// changes happened, and may call back into graphsync
+type OnPeerActivityListener func(p peer.ID, active bool)
+
+// OnLimitHitListener runs the first time a limit is hit in each reporting
+// interval, so a limit that is hit continuously is reported once per interval.
+// Listeners run on their own goroutine
+type OnLimitHitListener func(event LimitHitEvent)
+
 // OnReceiverNetworkErrorListener runs when errors occur receiving data over the wire
 type OnReceiverNetworkErrorListener func(p peer.ID, err error)
 
 // OnResponseCompletedListener provides a way to listen for when responder has finished serving a response
 type OnResponseCompletedListener func(p peer.ID, request RequestData, status ResponseStatusCode)
 
+// OnCompletedResponseHook is called on the requestor exactly once when an
+// outgoing request finishes, after its response channel is closed. The status
+// is the terminal status from the responder, or RequestCancelled if the
+// request was cancelled locally or its context expired. Extensions are those
+// on the last response received
+type OnCompletedResponseHook func(p peer.ID, request RequestData, status ResponseStatusCode, extensions []ExtensionData)
+
 // OnRequestProcessingListener is called when a request actually begins processing (reaches
 // the top of the request queue)
 type OnRequestProcessingListener func(p peer.ID, request RequestData, inProgressRequestCount int)
 
+// OnIncomingRequestQueuedHook is called when an incoming request is accepted
+// into the responder's queue, which may be some time before it begins processing
+type OnIncomingRequestQueuedHook func(p peer.ID, request RequestData)
+
 // OnRequestorCancelledListener provides a way to listen for responses the requestor canncels
 type OnRequestorCancelledListener func(p peer.ID, request RequestData)
 
@@ -392,6 +962,90 @@ type RequestStats struct {
 	Pending uint64
 }
 
+// PendingRequestInfo describes an outgoing request that is waiting for a
+// dispatch slot
+type PendingRequestInfo struct {
+	RequestID RequestID
+	Peer      peer.ID
+	Priority  Priority
+	// DependsOn lists the requests this request needs blocks from, set with
+	// WithRequestDependencies
+	DependsOn []RequestID
+	// Resumed is set for a request queued again after it was paused or
+	// re-issued. It already held a dispatch slot, so it should not wait behind
+	// new requests or for the peer's in progress limit
+	Resumed bool
+	// QueuedAt is when the request was last added to the queue
+	QueuedAt time.Time
+}
+
+// RequestScheduler decides the order queued outgoing requests are dispatched
+// in. It is told as requests are queued and finish, so it can keep them
+// ordered rather than look through all of them for each dispatch. Its methods
+// are called with the request queue locked, so they must be cheap and must
+// not call into graphsync
+type RequestScheduler interface {
+	// Push adds a request waiting to be dispatched
+	Push(info PendingRequestInfo)
+	// Next takes the request to dispatch next out of the waiting requests,
+	// returning false to dispatch nothing for now. It is called whenever a
+	// dispatch slot may be free
+	Next() (RequestID, bool)
+	// Done is called when a dispatched request finishes running, or a waiting
+	// request is removed before it is dispatched
+	Done(requestID RequestID)
+}
+
+// RequestSchedulerFunc picks which pending outgoing request to dispatch next.
+// It returns an index into pending, or -1 to dispatch nothing for now. It is
+// called whenever a dispatch slot may be free, so it must be cheap
+type RequestSchedulerFunc func(pending []PendingRequestInfo) int
+
+// InProgressRequestInfo describes an outgoing request that has not yet
+// completed
+type InProgressRequestInfo struct {
+	RequestID RequestID
+	Peer      peer.ID
+	Root      cid.Cid
+	// Selector is the request's selector encoded as DAG-JSON
+	Selector string
+	State    RequestState
+	// BlocksProcessed and BytesProcessed count the blocks traversed so far,
+	// whether received from the network or loaded from the local store
+	BlocksProcessed uint64
+	BytesProcessed  uint64
+	// StartTime is when the request was made
+	StartTime time.Time
+	// PersistenceOption is the name of the persistence option outgoing request
+	// hooks chose for the request, empty for the default
+	PersistenceOption string
+	// Extensions are the extensions on the request other than those graphsync
+	// itself uses
+	Extensions []ExtensionData
+}
+
+// InProgressResponseInfo describes an incoming request the responder has not
+// yet finished responding to
+type InProgressResponseInfo struct {
+	RequestID RequestID
+	Peer      peer.ID
+	Root      cid.Cid
+	// Selector is the request's selector encoded as DAG-JSON
+	Selector string
+	State    RequestState
+	// BlocksProcessed and BytesProcessed count the blocks queued to send so far
+	BlocksProcessed uint64
+	BytesProcessed  uint64
+	// StartTime is when the request was received
+	StartTime time.Time
+	// PersistenceOption is the name of the persistence option incoming request
+	// hooks chose for the response, empty for the default
+	PersistenceOption string
+	// Extensions are the extensions on the request other than those graphsync
+	// itself uses
+	Extensions []ExtensionData
+}
+
 // ResponseStats offer statistics about memory allocations for responses
 type ResponseStats struct {
 	// MaxAllowedAllocatedTotal is the preconfigured limit on allocations
@@ -403,6 +1057,9 @@ type ResponseStats struct {
 	// TotalAllocatedAllPeers indicates the amount of memory allocated for blocks
 	// across all peers
 	TotalAllocatedAllPeers uint64
+	// PeakAllocatedAllPeers is the most memory allocated for blocks across
+	// all peers at any one time
+	PeakAllocatedAllPeers uint64
 	// TotalPendingAllocations indicates the amount awaiting freeing up of memory
 	TotalPendingAllocations uint64
 	// NumPeersWithPendingAllocations indicates the number of peers that
@@ -411,16 +1068,243 @@ type ResponseStats struct {
 	NumPeersWithPendingAllocations uint64
 }
 
+// ThrottleStats describes the current throttle level and the limits
+// that are in effect as a result
+type ThrottleStats struct {
+	// Level is the current throttle level, where 1.0 is unrestricted
+	Level float64
+	// MaxInProgressOutgoingRequests is the effective number of outgoing
+	// requests processed in parallel
+	MaxInProgressOutgoingRequests uint64
+	// MaxInProgressIncomingRequests is the effective number of incoming
+	// requests processed in parallel
+	MaxInProgressIncomingRequests uint64
+	// MaxMemoryResponder is the effective limit on memory used queueing
+	// responses for all peers
+	MaxMemoryResponder uint64
+	// MaxMemoryPerPeerResponder is the effective limit on memory used queueing
+	// responses for an individual peer
+	MaxMemoryPerPeerResponder uint64
+	// MaxOutgoingBytesPerSecond is the effective limit on the rate blocks are
+	// sent to all peers combined, 0 if there is no limit
+	MaxOutgoingBytesPerSecond uint64
+	// MaxOutgoingBytesPerSecondPerPeer is the effective limit on the rate
+	// blocks are sent to an individual peer, 0 if there is no limit
+	MaxOutgoingBytesPerSecondPerPeer uint64
+}
+
 // Stats describes statistics about the Graphsync implementations
 // current state
 type Stats struct {
 	// Stats for the graphsync requestor
 	OutgoingRequests  RequestStats
 	IncomingResponses ResponseStats
+	// CompletedOutgoingRequests describes the requestor's record of requests
+	// that have recently completed
+	CompletedOutgoingRequests TombstoneStats
+	// OutgoingVerificationTime is the total time outgoing requests that have
+	// ended spent verifying responses and storing the blocks received
+	OutgoingVerificationTime time.Duration
 
 	// Stats for the graphsync responder
 	IncomingRequests  RequestStats
 	OutgoingResponses ResponseStats
+
+	// Throttle describes the current throttle level and effective limits
+	Throttle ThrottleStats
+
+	// Limits reports each active limit, how close it is to being reached, and
+	// how often it has been hit
+	Limits []LimitReport
+
+	// Transfers counts the blocks and bytes transferred across all peers
+	Transfers TransferStats
+
+	// OutgoingRequestCounts and IncomingRequestCounts count requests in each
+	// state across all peers, kept current as requests change state
+	OutgoingRequestCounts RequestCounts
+	IncomingRequestCounts RequestCounts
+	// Peers breaks the request counts down for each peer with requests in
+	// progress, or that has had requests since it last disconnected
+	Peers map[peer.ID]PeerStats
+}
+
+// RequestCounts counts requests in each state, for a peer or in total
+type RequestCounts struct {
+	Queued  uint64
+	Running uint64
+	Paused  uint64
+	// CompletingSend is only used for incoming requests
+	CompletingSend uint64
+	// Errored counts requests that have ended with an error
+	Errored uint64
+}
+
+// InProgress is the number of requests that have not yet ended, in any state
+func (rc RequestCounts) InProgress() uint64 {
+	return rc.Queued + rc.Running + rc.Paused + rc.CompletingSend
+}
+
+// PeerStats counts the requests to and from a single peer
+type PeerStats struct {
+	OutgoingRequests RequestCounts
+	IncomingRequests RequestCounts
+}
+
+// TransferStats counts the blocks and bytes transferred for a request, for a
+// peer, or in total. Requestor and responder counts are kept separately
+type TransferStats struct {
+	// BlocksReceived and BytesReceived count blocks a requestor received from
+	// the network. A block that arrives once in a message, but is used by
+	// several requests, counts once for each of them
+	BlocksReceived uint64
+	BytesReceived  uint64
+	// BlocksLocal and BytesLocal count blocks a requestor loaded from its local
+	// store instead, because the responder did not send them -- for instance,
+	// because they were duplicates the requestor already had
+	BlocksLocal uint64
+	BytesLocal  uint64
+	// BlocksWasted and BytesWasted count blocks a requestor received that no
+	// response in the same message referenced. They are discarded
+	BlocksWasted uint64
+	BytesWasted  uint64
+	// BlocksQueued and BytesQueued count blocks a responder queued to send
+	BlocksQueued uint64
+	BytesQueued  uint64
+	// BlocksSent and BytesSent count blocks a responder actually sent over the
+	// network. These lag behind the queued counts while messages are waiting
+	// to go out
+	BlocksSent uint64
+	BytesSent  uint64
+}
+
+// LimitName identifies a limit in a LimitReport. Names match the options
+// used to configure each limit, and are stable across releases
+type LimitName string
+
+const (
+	// LimitMaxMemoryResponder limits memory used queueing responses for all peers
+	LimitMaxMemoryResponder = LimitName("MaxMemoryResponder")
+	// LimitMaxMemoryPerPeerResponder limits memory used queueing responses for
+	// an individual peer
+	LimitMaxMemoryPerPeerResponder = LimitName("MaxMemoryPerPeerResponder")
+	// LimitMaxInProgressIncomingRequests limits incoming requests processed in parallel
+	LimitMaxInProgressIncomingRequests = LimitName("MaxInProgressIncomingRequests")
+	// LimitMaxInProgressOutgoingRequests limits outgoing requests processed in parallel
+	LimitMaxInProgressOutgoingRequests = LimitName("MaxInProgressOutgoingRequests")
+	// LimitMaxLinksPerIncomingRequests limits links traversed for an incoming request
+	LimitMaxLinksPerIncomingRequests = LimitName("MaxLinksPerIncomingRequests")
+	// LimitMaxLinksPerOutgoingRequests limits links traversed for an outgoing request
+	LimitMaxLinksPerOutgoingRequests = LimitName("MaxLinksPerOutgoingRequests")
+	// LimitMaxRecursionDepth limits how deep an incoming request may traverse
+	LimitMaxRecursionDepth = LimitName("MaxRecursionDepth")
+	// LimitMaxRequestTombstones limits how many completed requests are remembered
+	LimitMaxRequestTombstones = LimitName("MaxRequestTombstones")
+	// LimitMaxLateMessagesPerPeer limits responses accepted each second from a
+	// peer for requests no longer in progress
+	LimitMaxLateMessagesPerPeer = LimitName("MaxLateMessagesPerPeer")
+	// LimitMaxOutgoingBytesPerSecond limits the rate blocks are sent to all peers
+	LimitMaxOutgoingBytesPerSecond = LimitName("MaxOutgoingBytesPerSecond")
+	// LimitMaxOutgoingBytesPerSecondPerPeer limits the rate blocks are sent to
+	// an individual peer
+	LimitMaxOutgoingBytesPerSecondPerPeer = LimitName("MaxOutgoingBytesPerSecondPerPeer")
+)
+
+// LimitScope describes what a limit applies to
+type LimitScope string
+
+const (
+	// LimitScopeGlobal limits apply across all peers and requests
+	LimitScopeGlobal = LimitScope("global")
+	// LimitScopePeer limits apply to each peer separately
+	LimitScopePeer = LimitScope("peer")
+	// LimitScopeRequest limits apply to each request separately
+	LimitScopeRequest = LimitScope("request")
+)
+
+// LimitReport describes a configured limit, its current utilization, and how
+// often it has been hit
+type LimitReport struct {
+	Name  LimitName
+	Scope LimitScope
+	// Configured is the value the limit is currently set to
+	Configured uint64
+	// Utilization is how much of the limit is currently in use. For peer
+	// scoped limits this is the peer closest to the limit. It is zero for
+	// limits whose usage is not tracked between hits
+	Utilization uint64
+	// Hits is the number of times the limit has been hit since startup
+	Hits uint64
+	// LastHit is when the limit was last hit, or zero if it never was
+	LastHit time.Time
+}
+
+// LimitHitEvent describes a limit that was hit
+type LimitHitEvent struct {
+	Name  LimitName
+	Scope LimitScope
+	// Hits is the number of times the limit has been hit since startup
+	Hits      uint64
+	Timestamp time.Time
+}
+
+// MetricsRecorder receives counts and timings as requests and responses
+// progress. Methods are called from graphsync's internal threads, so
+// implementations must be safe for concurrent use and return quickly
+type MetricsRecorder interface {
+	// RecordOutgoingRequestQueued is called when a new outgoing request is queued
+	RecordOutgoingRequestQueued()
+	// RecordOutgoingRequestStarted is called when an outgoing request begins
+	// processing
+	RecordOutgoingRequestStarted()
+	// RecordBlockReceived is called for each block received from a responder
+	RecordBlockReceived(bytes uint64)
+	// RecordOutgoingRequestCompleted is called when an outgoing request ends,
+	// with the time since it was made and whether it ended without error
+	RecordOutgoingRequestCompleted(duration time.Duration, success bool)
+	// RecordIncomingRequestQueued is called when an incoming request is
+	// accepted, whether it is queued for processing or starts paused
+	RecordIncomingRequestQueued()
+	// RecordIncomingRequestStarted is called when an incoming request begins
+	// processing
+	RecordIncomingRequestStarted()
+	// RecordBlockSent is called for each block sent to a requestor
+	RecordBlockSent(bytes uint64)
+	// RecordIncomingRequestCompleted is called when the response to an incoming
+	// request ends, with the time since the request arrived and whether the
+	// response ended without error
+	RecordIncomingRequestCompleted(duration time.Duration, success bool)
+}
+
+// NoopMetricsRecorder is a MetricsRecorder that discards everything, used
+// when no recorder is configured
+type NoopMetricsRecorder struct{}
+
+var _ MetricsRecorder = (*NoopMetricsRecorder)(nil)
+
+func (*NoopMetricsRecorder) RecordOutgoingRequestQueued()                                        {}
+func (*NoopMetricsRecorder) RecordOutgoingRequestStarted()                                       {}
+func (*NoopMetricsRecorder) RecordBlockReceived(bytes uint64)                                    {}
+func (*NoopMetricsRecorder) RecordOutgoingRequestCompleted(duration time.Duration, success bool) {}
+func (*NoopMetricsRecorder) RecordIncomingRequestQueued()                                        {}
+func (*NoopMetricsRecorder) RecordIncomingRequestStarted()                                       {}
+func (*NoopMetricsRecorder) RecordBlockSent(bytes uint64)                                        {}
+func (*NoopMetricsRecorder) RecordIncomingRequestCompleted(duration time.Duration, success bool) {}
+
+// TombstoneStats describes the record a requestor keeps of recently completed
+// requests, and the responses that arrived for requests no longer in progress
+type TombstoneStats struct {
+	// Count is the number of completed requests currently remembered
+	Count uint64
+	// LateMessagesAbsorbed is the number of responses received for completed
+	// requests that were still remembered
+	LateMessagesAbsorbed uint64
+	// UnknownMessagesDropped is the number of responses received for requests
+	// that were neither in progress nor remembered
+	UnknownMessagesDropped uint64
+	// RateLimitedMessages is the number of responses for requests no longer in
+	// progress dropped because a peer sent more than MaxLateMessagesPerPeer
+	RateLimitedMessages uint64
 }
 
 // RequestState describes the current general state of a request
@@ -433,6 +1317,111 @@ type RequestStates map[RequestID]RequestState
 // initializing a request
 type RequestIDContextKey struct{}
 
+// MaxLinksContextKey is used to set a link budget for a single request in
+// context when initializing a request, overriding the default budget for
+// outgoing requests. The value is a uint64, where 0 means no limit. Links
+// loaded from the local store count against the budget
+type MaxLinksContextKey struct{}
+
+// RetryPeersContextKey is used to set peers to retry a single request with in
+// context when initializing a request. The value is a RetryPeers
+type RetryPeersContextKey struct{}
+
+// RetryPeers are the peers a request is sent to, in order, when the request to
+// the previous peer fails with a network error. Blocks already received are
+// not requested again. Requests that fail for any other reason, such as being
+// rejected, are not retried
+type RetryPeers struct {
+	Peers []peer.ID
+	// MaxAttempts is the most peers the request is sent to, counting the peer
+	// it is first sent to. 0 means the request may be sent to every peer
+	MaxAttempts int
+}
+
+// WithRetryPeers returns a context that sets the given retry peers for requests
+// initialized with it
+func WithRetryPeers(ctx context.Context, peers []peer.ID, maxAttempts int) context.Context {
+	return context.WithValue(ctx, RetryPeersContextKey{}, RetryPeers{Peers: peers, MaxAttempts: maxAttempts})
+}
+
+// ResumeFromLocalStoreContextKey is used to resume a single request from the
+// blocks already in the local store in context when initializing a request. The
+// value is a bool. When true, the blocks for the traversal found in the default
+// store are sent to the responding peer in a resume extension, so a request
+// interrupted by a restart or disconnect is not downloaded again from scratch
+type ResumeFromLocalStoreContextKey struct{}
+
+// WithResumeFromLocalStore returns a context that resumes requests initialized
+// with it from the blocks already in the local store
+func WithResumeFromLocalStore(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ResumeFromLocalStoreContextKey{}, true)
+}
+
+// RequestDependenciesContextKey is used to set the requests a single request
+// depends on in context when initializing a request. The value is a
+// []RequestID. While the request is queued or in progress, the requests it
+// depends on are dispatched with at least its priority
+type RequestDependenciesContextKey struct{}
+
+// WithRequestDependencies returns a context for a request that needs blocks
+// the given requests also fetch. The default scheduler raises each of those
+// requests to the priority of a request initialized with it, until that
+// request finishes. Set a request's ID with RequestIDContextKey to depend on
+// it before it is made
+func WithRequestDependencies(ctx context.Context, requestIDs ...RequestID) context.Context {
+	return context.WithValue(ctx, RequestDependenciesContextKey{}, requestIDs)
+}
+
+// LinkTargetNodePrototypeChooserContextKey is used to set the node prototype
+// chooser for the traversal of a single request in context when initializing a
+// request. The value is a traversal.LinkTargetNodePrototypeChooser, and it takes
+// precedence over a chooser set by an outgoing request hook
+type LinkTargetNodePrototypeChooserContextKey struct{}
+
+// WithLinkTargetNodePrototypeChooser returns a context that sets the given node
+// prototype chooser for requests initialized with it
+func WithLinkTargetNodePrototypeChooser(ctx context.Context, chooser traversal.LinkTargetNodePrototypeChooser) context.Context {
+	return context.WithValue(ctx, LinkTargetNodePrototypeChooserContextKey{}, chooser)
+}
+
+type requestInfoContextKey struct{}
+
+type requestInfo struct {
+	requestID RequestID
+	p         peer.ID
+}
+
+// ContextWithRequestInfo returns a context that carries the ID of a request
+// and the remote peer it is exchanged with. Graphsync sets it on the
+// LinkContext passed to loaders and storers, so they can tell which request a
+// block belongs to
+func ContextWithRequestInfo(ctx context.Context, requestID RequestID, p peer.ID) context.Context {
+	return context.WithValue(ctx, requestInfoContextKey{}, requestInfo{requestID, p})
+}
+
+// RequestIDFromContext returns the ID of the request a load or store is for,
+// when called with the context from the LinkContext graphsync passes to
+// loaders and storers. That context is cancelled when the request is cancelled,
+// and for a response, also when it is paused
+func RequestIDFromContext(ctx context.Context) (RequestID, bool) {
+	info, ok := ctx.Value(requestInfoContextKey{}).(requestInfo)
+	return info.requestID, ok
+}
+
+// PeerFromContext returns the remote peer of the request a load or store is
+// for, when called with the context from the LinkContext graphsync passes to
+// loaders and storers
+func PeerFromContext(ctx context.Context) (peer.ID, bool) {
+	info, ok := ctx.Value(requestInfoContextKey{}).(requestInfo)
+	return info.p, ok
+}
+
+// RequestIDAllocator chooses the ID for a new outgoing request, when one is not
+// set in the request context. IDs must be well-formed UUIDs, and an ID that is
+// already in use fails the request with a RequestIDInUseErr. It may be called
+// concurrently
+type RequestIDAllocator func(p peer.ID, root cid.Cid, selector ipld.Node) RequestID
+
 const (
 	// Queued means a request has been received and is queued for processing
 	Queued RequestState = iota
@@ -460,11 +1449,169 @@ func (rs RequestState) String() string {
 	}
 }
 
+// RequestEventName identifies a lifecycle transition of an outgoing request
+type RequestEventName string
+
+const (
+	// RequestEventStarted means the request reached the top of the queue and
+	// began executing
+	RequestEventStarted = RequestEventName("Started")
+
+	// RequestEventPaused means the request was paused
+	RequestEventPaused = RequestEventName("Paused")
+
+	// RequestEventResumed means a paused request was unpaused and queued to
+	// execute again
+	RequestEventResumed = RequestEventName("Resumed")
+
+	// RequestEventCompleted means the request finished without a terminal error
+	RequestEventCompleted = RequestEventName("Completed")
+
+	// RequestEventErrored means the request finished with a terminal error
+	RequestEventErrored = RequestEventName("Errored")
+)
+
+// IsTerminal returns true if no further events follow this event
+func (n RequestEventName) IsTerminal() bool {
+	return n == RequestEventCompleted || n == RequestEventErrored
+}
+
+// RequestEvent describes a single lifecycle transition of an outgoing request
+type RequestEvent struct {
+	Name      RequestEventName
+	RequestID RequestID
+	Timestamp time.Time
+	// Err is the terminal error, and is only set for RequestEventErrored
+	Err error
+	// Duration is the time from the request being made until it ended, and
+	// is only set for terminal events
+	Duration time.Duration
+	// VerificationTime is the part of Duration spent verifying responses
+	// against the local traversal and storing the blocks received. The rest is
+	// time spent transferring and waiting on the remote peer. Only set for
+	// terminal events
+	VerificationTime time.Duration
+	// Transfer counts the blocks the request received and loaded locally. Only
+	// set for terminal events
+	Transfer TransferStats
+}
+
+// RetryOptions configures how a requestor retries requests that fail for
+// transient reasons, such as the responder reporting it is busy or the
+// request failing to send. Requests that fail for any other reason, including
+// errors from hooks, are never retried
+type RetryOptions struct {
+	// MaxAttempts is the total number of times a request is attempted,
+	// including the first. Values below 2 disable retries
+	MaxAttempts int
+	// InitialDelay is the time to wait before the first retry
+	InitialDelay time.Duration
+	// Multiplier scales the delay after each retry. Values below 1 are treated as 1
+	Multiplier float64
+	// Jitter randomizes each delay by up to half its length in either direction
+	Jitter bool
+}
+
+// Delay returns the time to wait before the given retry, starting at 1 for the
+// first retry
+func (ro RetryOptions) Delay(retry int) time.Duration {
+	multiplier := ro.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	delay := float64(ro.InitialDelay) * math.Pow(multiplier, float64(retry-1))
+	if ro.Jitter {
+		delay = delay * (0.5 + rand.Float64())
+	}
+	return time.Duration(delay)
+}
+
+// TombstoneOptions bounds the record a requestor keeps of recently completed
+// requests, which it uses to recognise responses that arrive after a request
+// has ended and to tell late event subscribers how a request ended
+type TombstoneOptions struct {
+	// MaxCount is the number of completed requests remembered. Once exceeded,
+	// the least recently used are forgotten first, where a completed request
+	// is used when it absorbs a late response or a subscriber asks how it
+	// ended. Zero uses the default
+	MaxCount int
+	// MaxAge is how long a completed request is remembered after it was last
+	// used. Zero means completed requests are only forgotten to stay under
+	// MaxCount
+	MaxAge time.Duration
+	// MaxLateMessagesPerPeer is the number of responses for requests no longer
+	// in progress accepted from a single peer each second. Responses over the
+	// limit are dropped without being checked against completed requests.
+	// Zero means no limit
+	MaxLateMessagesPerPeer int
+}
+
+// RequestTombstone describes a recently completed outgoing request
+type RequestTombstone struct {
+	RequestID RequestID
+	Peer      peer.ID
+	// Event is the event that ended the request
+	Event RequestEvent
+}
+
+// Transport carries graphsync messages between peers over streams. It lets
+// graphsync run over transports other than a libp2p host, such as WebRTC data
+// channels or custom multiplexers. Each stream carries varint length prefixed
+// messages in the current wire format
+type Transport interface {
+	// OpenStream opens a new outgoing stream to the given peer
+	OpenStream(ctx context.Context, p peer.ID) (io.ReadWriteCloser, error)
+	// SetStreamHandler registers the function called with each new incoming
+	// stream and the peer that opened it. The handler owns the stream and
+	// closes it when done
+	SetStreamHandler(fn func(peer.ID, io.ReadWriteCloser))
+}
+
+// CompressionCodec compresses block data sent over the wire. Only the data of
+// each block is compressed; CIDs and link metadata are sent as is
+type CompressionCodec interface {
+	// Name identifies the codec to peers, and must be the same on both
+	Name() string
+	// Compress returns the compressed form of data
+	Compress(data []byte) ([]byte, error)
+	// Decompress returns the data that was compressed
+	Decompress(data []byte) ([]byte, error)
+}
+
 // GraphExchange is a protocol that can exchange IPLD graphs based on a selector
 type GraphExchange interface {
 	// Request initiates a new GraphSync request to the given peer using the given selector spec.
 	Request(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, extensions ...ExtensionData) (<-chan ResponseProgress, <-chan error)
 
+	// RequestMany initiates several GraphSync requests to the given peer at once, merging their
+	// responses and errors into a single pair of channels tagged with the request they belong to
+	RequestMany(ctx context.Context, p peer.ID, roots []RootSelector, extensions ...ExtensionData) (<-chan SubRequestProgress, <-chan error)
+
+	// RequestCids initiates a new metadata only GraphSync request to the given peer, which
+	// traverses the selector without sending blocks, and returns the CIDs of the blocks the
+	// peer has for the traversal, in traversal order
+	RequestCids(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, extensions ...ExtensionData) (<-chan cid.Cid, <-chan error)
+
+	// RequestRawBlocks initiates a new GraphSync request to the given peer using the given selector spec,
+	// also delivering each block the traversal loads, once verified, in traversal order. It is for callers
+	// that store blocks themselves: with a persistence option that discards what is written to it, graphsync
+	// does not store the blocks at all. A block the traversal reaches more than once is only sent by the peer
+	// once, so such a persistence option fails traversals that revisit blocks. The block channel is buffered
+	// like the response channel and closes with it, and must be read alongside it so the traversal keeps going
+	RequestRawBlocks(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, extensions ...ExtensionData) (<-chan ResponseProgress, <-chan blocks.Block, <-chan error)
+
+	// RequestWithFailover initiates a new GraphSync request using the given selector spec, trying
+	// each of the given peers in order until one of them completes the traversal
+	RequestWithFailover(ctx context.Context, peers []peer.ID, root ipld.Link, selector ipld.Node, extensions ...ExtensionData) (<-chan ResponseProgress, <-chan error)
+
+	// RequestFromPeers initiates the same GraphSync request to each of the given peers at once,
+	// delivering responses from whichever peer responds first and cancelling the rest
+	RequestFromPeers(ctx context.Context, peers []peer.ID, root ipld.Link, selector ipld.Node, extensions ...ExtensionData) (<-chan ResponseProgress, <-chan error)
+
+	// RequestCAR initiates a new GraphSync request to the given peer using the given selector spec,
+	// returning a reader of the blocks the traversal reaches, framed as CAR block sections
+	RequestCAR(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, extensions ...ExtensionData) (io.ReadCloser, <-chan error)
+
 	// RegisterPersistenceOption registers an alternate loader/storer combo that can be substituted for the default
 	RegisterPersistenceOption(name string, lsys ipld.LinkSystem) error
 
@@ -474,21 +1621,40 @@ type GraphExchange interface {
 	// RegisterIncomingRequestHook adds a hook that runs when a request is received
 	RegisterIncomingRequestHook(hook OnIncomingRequestHook) UnregisterHookFunc
 
+	// RegisterAsyncRequestValidator adds a validator that runs off the message
+	// processing path for each request that incoming request hooks accept
+	RegisterAsyncRequestValidator(validator AsyncRequestValidator) UnregisterHookFunc
+
 	// RegisterIncomingResponseHook adds a hook that runs when a response is received
 	RegisterIncomingResponseHook(OnIncomingResponseHook) UnregisterHookFunc
 
+	// RegisterIncomingResponseHookWithFilter adds a hook that runs when a response is received, for
+	// only the responses the filter returns true for
+	RegisterIncomingResponseHookWithFilter(filter ResponseHookFilter, hook OnIncomingResponseHook) UnregisterHookFunc
+
+	// RegisterIncomingExtensionResponseHook adds a hook that runs when a response carrying the
+	// named extension is received
+	RegisterIncomingExtensionResponseHook(name ExtensionName, hook OnIncomingExtensionResponseHook) UnregisterHookFunc
+
 	// RegisterIncomingBlockHook adds a hook that runs when a block is received and validated (put in block store)
 	RegisterIncomingBlockHook(OnIncomingBlockHook) UnregisterHookFunc
 
 	// RegisterOutgoingRequestHook adds a hook that runs immediately prior to sending a new request
 	RegisterOutgoingRequestHook(hook OnOutgoingRequestHook) UnregisterHookFunc
 
+	// RegisterOutgoingRequestHookWithFilter adds a hook that runs immediately prior to sending a new request,
+	// for only the requests the filter returns true for
+	RegisterOutgoingRequestHookWithFilter(filter RequestHookFilter, hook OnOutgoingRequestHook) UnregisterHookFunc
+
 	// RegisterOutgoingBlockHook adds a hook that runs every time a block is sent from a responder
 	RegisterOutgoingBlockHook(hook OnOutgoingBlockHook) UnregisterHookFunc
 
 	// RegisterRequestUpdatedHook adds a hook that runs every time an update to a request is received
 	RegisterRequestUpdatedHook(hook OnRequestUpdatedHook) UnregisterHookFunc
 
+	// RegisterSelectorProposalHook adds a hook that runs when a responder proposes an alternate selector for an outgoing request
+	RegisterSelectorProposalHook(hook OnSelectorProposalHook) UnregisterHookFunc
+
 	// RegisterOutgoingRequestProcessingListener adds a listener that gets called when an outgoing request actually begins processing (reaches
 	// the top of the outgoing request queue)
 	RegisterOutgoingRequestProcessingListener(listener OnRequestProcessingListener) UnregisterHookFunc
@@ -497,9 +1663,21 @@ type GraphExchange interface {
 	// the top of the outgoing request queue)
 	RegisterIncomingRequestProcessingListener(listener OnRequestProcessingListener) UnregisterHookFunc
 
+	// RegisterIncomingRequestQueuedHook adds a hook that gets called when an incoming request is accepted
+	// into the responder's queue, before it begins processing
+	RegisterIncomingRequestQueuedHook(hook OnIncomingRequestQueuedHook) UnregisterHookFunc
+
 	// RegisterCompletedResponseListener adds a listener on the responder for completed responses
 	RegisterCompletedResponseListener(listener OnResponseCompletedListener) UnregisterHookFunc
 
+	// RegisterCompletingResponseHook adds a hook on the responder that runs when
+	// a response ends, and can send extension data with the final status
+	RegisterCompletingResponseHook(hook OnCompletingResponseHook) UnregisterHookFunc
+
+	// RegisterCompletedResponseHook adds a hook on the requestor that runs once
+	// for each outgoing request when it finishes
+	RegisterCompletedResponseHook(hook OnCompletedResponseHook) UnregisterHookFunc
+
 	// RegisterRequestorCancelledListener adds a listener on the responder for
 	// responses cancelled by the requestor
 	RegisterRequestorCancelledListener(listener OnRequestorCancelledListener) UnregisterHookFunc
@@ -513,14 +1691,30 @@ type GraphExchange interface {
 	// RegisterReceiverNetworkErrorListener adds a listener for when errors occur receiving data over the wire
 	RegisterReceiverNetworkErrorListener(listener OnReceiverNetworkErrorListener) UnregisterHookFunc
 
-	// Pause pauses an in progress request or response (may take 1 or more blocks to process)
+	// RegisterLimitHitListener adds a listener for when a limit is hit for the
+	// first time in a reporting interval
+	RegisterLimitHitListener(listener OnLimitHitListener) UnregisterHookFunc
+
+	// RegisterNegotiationCompleteListener adds a listener for when a peer
+	// reports the extensions it supports
+	RegisterNegotiationCompleteListener(listener OnNegotiationCompleteListener) UnregisterHookFunc
+
+	// RegisterPeerActivityListener adds a listener for when graphsync starts
+	// and stops having requests in progress with a peer
+	RegisterPeerActivityListener(listener OnPeerActivityListener) UnregisterHookFunc
+
+	// Pause pauses an in progress request or response (may take 1 or more blocks to process).
+	// Pausing an outgoing request that is already paused does nothing
 	Pause(context.Context, RequestID) error
 
 	// Unpause unpauses a request or response that was paused
 	// Can also send extensions with unpause
 	Unpause(context.Context, RequestID, ...ExtensionData) error
 
-	// Cancel cancels an in progress request or response
+	// Cancel cancels an in progress request or response. Other requests are
+	// unaffected, even if they share the cancelled request's context, and a
+	// request or response that is unknown or already finished returns a
+	// RequestNotFoundErr
 	Cancel(context.Context, RequestID) error
 
 	// SendUpdate sends an update for an in progress request or response
@@ -528,4 +1722,57 @@ type GraphExchange interface {
 
 	// Stats produces insight on the current state of a graphsync exchange
 	Stats() Stats
+
+	// CompletedRequests lists the recently completed outgoing requests that are
+	// still remembered, in the order they completed
+	CompletedRequests() []RequestTombstone
+
+	// InProgressRequests lists the outgoing requests that have not yet
+	// completed, in the order they started
+	InProgressRequests() []InProgressRequestInfo
+
+	// InProgressResponses lists the incoming requests that are still being
+	// responded to, in the order they arrived
+	InProgressResponses() []InProgressResponseInfo
+
+	// LimitsReport lists every active limit with its configured value, current
+	// utilization, and how often it has been hit
+	LimitsReport() []LimitReport
+
+	// RequestTransferStats returns the blocks and bytes transferred so far for an
+	// in progress outgoing request or incoming request
+	RequestTransferStats(RequestID) (TransferStats, bool)
+
+	// PeerTransferStats returns the blocks and bytes transferred to and from a
+	// connected peer
+	PeerTransferStats(peer.ID) TransferStats
+
+	// PeerRequestCounts counts the requests to and from a peer in each state.
+	// It is cheap enough to call from an incoming request hook, for example to
+	// turn away low priority requests from a peer that already has many in
+	// progress. The request being processed by the hook is not yet counted
+	PeerRequestCounts(peer.ID) PeerStats
+
+	// BlockPeer rejects all new requests from the given peer, before any
+	// request hooks run. Responses already in progress are not affected
+	BlockPeer(peer.ID)
+
+	// UnblockPeer accepts requests again from a peer blocked with BlockPeer
+	UnblockPeer(peer.ID)
+
+	// SetThrottle scales the configured limits on in progress requests,
+	// responder memory and outgoing bandwidth by a level between 0 and 1, where
+	// 1 restores the configured limits. Work already in progress is never
+	// cancelled; new work waits until usage falls under the scaled limits
+	SetThrottle(level float64)
+
+	// Close shuts down the exchange gracefully. New requests fail immediately
+	// with ErrGraphsyncClosed, and new incoming requests are rejected. Requests
+	// and responses in progress may finish within a configured drain timeout;
+	// after that, requests are cancelled with ErrGraphsyncClosed and responses
+	// end with a cancellation status. Close returns once all outstanding
+	// messages are sent and all internal processes have stopped, or returns an
+	// error if ctx is cancelled first, in which case requests still in
+	// progress end with ExchangeClosedErr
+	Close(ctx context.Context) error
 }
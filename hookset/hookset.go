@@ -0,0 +1,176 @@
+package hookset
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hannahhoward/go-pubsub"
+	logging "github.com/ipfs/go-log/v2"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/panics"
+)
+
+var log = logging.Logger("graphsync")
+
+// HookExecutionObserver is told when each hook in a set starts and finishes
+// running, to find the hooks that add latency to requests. hookIndex is the
+// position of the hook in the order the set runs its hooks, and hookType names
+// the kind of hooks in the set. Observers are called from the goroutine that
+// runs the hook, and must be safe for concurrent use
+type HookExecutionObserver interface {
+	HookStarted(hookIndex int, hookType string)
+	HookFinished(hookIndex int, hookType string, duration time.Duration, err error)
+}
+
+// HookSet is a set of hooks or listeners that events are published to. Unlike
+// a plain pubsub, all of its hooks can be unregistered at once, and hooks may
+// be registered and unregistered at any time, including from inside a hook
+// while an event is being published. Each publish runs the hooks registered
+// when it started, so changes take effect from the next event. A hook that
+// panics is recovered, and the publish fails with a panics.RecoveredPanicErr
+type HookSet struct {
+	dispatcher   pubsub.Dispatcher
+	hookType     string
+	observer     HookExecutionObserver
+	panicHandler panics.PanicHandler
+
+	lk sync.Mutex
+	// hooks is replaced rather than modified, so a publish can run the hooks
+	// it read without holding the lock
+	hooks   []registeredHook
+	nextKey uint64
+}
+
+// registeredHook is a hook keyed so it can be found to unregister it
+type registeredHook struct {
+	key  uint64
+	hook pubsub.SubscriberFn
+}
+
+// Option configures a hook set
+type Option func(*HookSet)
+
+// WithHookType names the kind of hooks in the set, for the execution observer
+func WithHookType(hookType string) Option {
+	return func(hs *HookSet) {
+		hs.hookType = hookType
+	}
+}
+
+// WithExecutionObserver tells the given observer when each hook in the set
+// starts and finishes running
+func WithExecutionObserver(observer HookExecutionObserver) Option {
+	return func(hs *HookSet) {
+		hs.observer = observer
+	}
+}
+
+// WithPanicCallback calls the given function with each panic recovered from a
+// hook in the set, in addition to failing the publish
+func WithPanicCallback(callback panics.CallBackFn) Option {
+	return func(hs *HookSet) {
+		hs.panicHandler = panics.MakeHandler(callback)
+	}
+}
+
+// New returns a new, empty hook set that dispatches events with the given
+// dispatcher
+func New(dispatcher pubsub.Dispatcher, options ...Option) *HookSet {
+	hs := &HookSet{
+		dispatcher:   dispatcher,
+		panicHandler: panics.MakeHandler(nil),
+	}
+	for _, option := range options {
+		option(hs)
+	}
+	return hs
+}
+
+// Run runs a hook of the set that is called other than through Publish, such
+// as one run in its own goroutine. As with Publish, the execution observer,
+// if there is one, is told when it starts and finishes, and a panic is
+// recovered and returned as an error
+func (hs *HookSet) Run(hookIndex int, run func() error) error {
+	if hs.observer == nil {
+		return hs.recoverPanic(hookIndex, run)
+	}
+	hs.observer.HookStarted(hookIndex, hs.hookType)
+	start := time.Now()
+	err := hs.recoverPanic(hookIndex, run)
+	hs.observer.HookFinished(hookIndex, hs.hookType, time.Since(start), err)
+	return err
+}
+
+func (hs *HookSet) recoverPanic(hookIndex int, run func() error) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = hs.panicHandler(recovered)
+			log.Warnw("recovered from panic in hook", "hook type", hs.hookType, "hook index", hookIndex, "error", err)
+		}
+	}()
+	return run()
+}
+
+// Register adds a hook to the set. The returned function removes it, and does
+// nothing if the hook was already removed by UnregisterAll
+func (hs *HookSet) Register(hook pubsub.SubscriberFn) graphsync.UnregisterHookFunc {
+	hs.lk.Lock()
+	defer hs.lk.Unlock()
+	key := hs.nextKey
+	hs.nextKey++
+	hooks := make([]registeredHook, 0, len(hs.hooks)+1)
+	hooks = append(hooks, hs.hooks...)
+	hs.hooks = append(hooks, registeredHook{key, hook})
+	return func() {
+		hs.lk.Lock()
+		defer hs.lk.Unlock()
+		hooks := make([]registeredHook, 0, len(hs.hooks))
+		for _, rh := range hs.hooks {
+			if rh.key != key {
+				hooks = append(hooks, rh)
+			}
+		}
+		hs.hooks = hooks
+	}
+}
+
+func (hs *HookSet) current() []registeredHook {
+	hs.lk.Lock()
+	defer hs.lk.Unlock()
+	return hs.hooks
+}
+
+// Publish dispatches an event to every hook in the set, in the order they
+// were registered, stopping at the first hook whose dispatch returns an error
+// or panics
+func (hs *HookSet) Publish(event pubsub.Event) error {
+	for hookIndex, rh := range hs.current() {
+		hook := rh.hook
+		err := hs.Run(hookIndex, func() error {
+			return hs.dispatcher(event, hook)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hooks returns the hooks in the set, in the order Publish dispatches to them
+func (hs *HookSet) Hooks() []pubsub.SubscriberFn {
+	registered := hs.current()
+	hooks := make([]pubsub.SubscriberFn, 0, len(registered))
+	for _, rh := range registered {
+		hooks = append(hooks, rh.hook)
+	}
+	return hooks
+}
+
+// UnregisterAll removes every hook from the set. A publish already in
+// progress finishes with the hooks that were registered when it started
+func (hs *HookSet) UnregisterAll() {
+	hs.lk.Lock()
+	defer hs.lk.Unlock()
+	hs.hooks = nil
+}
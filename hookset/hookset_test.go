@@ -0,0 +1,283 @@
+package hookset_test
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hannahhoward/go-pubsub"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/ipfs/go-graphsync/hookset"
+	"github.com/ipfs/go-graphsync/panics"
+)
+
+type hook func(int)
+
+func dispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+	subscriberFn.(hook)(event.(int))
+	return nil
+}
+
+func TestUnregisterAll(t *testing.T) {
+	hs := hookset.New(dispatcher)
+	var calls int32
+	count := hook(func(n int) { atomic.AddInt32(&calls, int32(n)) })
+	hs.Register(count)
+	unregister := hs.Register(count)
+	require.NoError(t, hs.Publish(1))
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	hs.UnregisterAll()
+	require.NoError(t, hs.Publish(1))
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// unregistering a hook removed by UnregisterAll does not affect new hooks
+	hs.Register(count)
+	unregister()
+	require.NoError(t, hs.Publish(1))
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestUnregisterAllWhilePublishing(t *testing.T) {
+	hs := hookset.New(dispatcher)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				hs.Register(hook(func(int) {}))
+				_ = hs.Publish(j)
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		hs.UnregisterAll()
+	}
+	wg.Wait()
+	hs.UnregisterAll()
+	published := false
+	hs.Register(hook(func(int) { published = true }))
+	require.NoError(t, hs.Publish(0))
+	require.True(t, published)
+}
+
+func TestRegisterFromHook(t *testing.T) {
+	hs := hookset.New(dispatcher)
+	var calls []int
+	var unregisterSecond func()
+	hs.Register(hook(func(n int) {
+		calls = append(calls, n)
+		if n == 1 {
+			// registered hooks take effect from the next publish
+			hs.Register(hook(func(n int) { calls = append(calls, n*100) }))
+			unregisterSecond()
+		}
+	}))
+	unregisterSecond = hs.Register(hook(func(n int) { calls = append(calls, n*10) }))
+	require.NoError(t, hs.Publish(1))
+	require.Equal(t, []int{1, 10}, calls)
+	calls = nil
+	require.NoError(t, hs.Publish(2))
+	require.Equal(t, []int{2, 200}, calls)
+}
+
+func TestUnregisterKeepsOrder(t *testing.T) {
+	hs := hookset.New(dispatcher)
+	var calls []int
+	hs.Register(hook(func(n int) { calls = append(calls, 1) }))
+	unregister := hs.Register(hook(func(n int) { calls = append(calls, 2) }))
+	hs.Register(hook(func(n int) { calls = append(calls, 3) }))
+	hs.Register(hook(func(n int) { calls = append(calls, 4) }))
+	unregister()
+	require.NoError(t, hs.Publish(0))
+	require.Equal(t, []int{1, 3, 4}, calls)
+}
+
+func TestHookPanics(t *testing.T) {
+	var recovered []interface{}
+	hs := hookset.New(dispatcher, hookset.WithPanicCallback(func(recoverObj interface{}, debugStackTrace string) {
+		recovered = append(recovered, recoverObj)
+	}))
+	var calls int
+	hs.Register(hook(func(n int) { calls++ }))
+	hs.Register(hook(func(n int) {
+		if n < 0 {
+			panic("something went wrong")
+		}
+	}))
+	hs.Register(hook(func(n int) { calls++ }))
+
+	// a panic stops the publish, and is returned with its stack
+	err := hs.Publish(-1)
+	var panicErr panics.RecoveredPanicErr
+	require.True(t, errors.As(err, &panicErr))
+	require.Equal(t, "something went wrong", panicErr.PanicObj)
+	require.Contains(t, panicErr.DebugStackTrace, "hookset_test.go")
+	require.Equal(t, 1, calls)
+	require.Equal(t, []interface{}{"something went wrong"}, recovered)
+
+	// later publishes are unaffected
+	require.NoError(t, hs.Publish(1))
+	require.Equal(t, 3, calls)
+
+	// hooks run outside of publish are recovered too
+	err = hs.Run(0, func() error { panic("run failed") })
+	require.True(t, errors.As(err, &panicErr))
+	require.Equal(t, "run failed", panicErr.PanicObj)
+}
+
+func TestRegisterWhilePublishing(t *testing.T) {
+	hs := hookset.New(dispatcher)
+	var calls int32
+	hs.Register(hook(func(int) { atomic.AddInt32(&calls, 1) }))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				hs.Register(hook(func(int) {}))()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				// hooks that register and unregister hooks do not deadlock
+				unregister := hs.Register(hook(func(int) {
+					hs.Register(hook(func(int) {}))()
+				}))
+				_ = hs.Publish(j)
+				unregister()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				_ = hs.Publish(j)
+				_ = hs.Hooks()
+			}
+		}()
+	}
+	wg.Wait()
+	// the first hook was never unregistered, so it saw every publish
+	require.Equal(t, int32(4*1000), atomic.LoadInt32(&calls))
+	require.Len(t, hs.Hooks(), 1)
+}
+
+func TestHooks(t *testing.T) {
+	hs := hookset.New(dispatcher)
+	require.Empty(t, hs.Hooks())
+	var calls []int
+	hs.Register(hook(func(n int) { calls = append(calls, n) }))
+	unregister := hs.Register(hook(func(n int) { calls = append(calls, n*10) }))
+	hs.Register(hook(func(n int) { calls = append(calls, n*100) }))
+
+	// hooks are listed in the order they are published to, without being called
+	hooks := hs.Hooks()
+	require.Len(t, hooks, 3)
+	require.Empty(t, calls)
+	for _, h := range hooks {
+		h.(hook)(1)
+	}
+	require.NoError(t, hs.Publish(1))
+	require.Equal(t, calls[:3], calls[3:])
+
+	unregister()
+	require.Len(t, hs.Hooks(), 2)
+	hs.UnregisterAll()
+	require.Empty(t, hs.Hooks())
+}
+
+type observation struct {
+	hookIndex int
+	hookType  string
+	finished  bool
+	duration  time.Duration
+	err       error
+}
+
+type recordingObserver struct {
+	observations []observation
+}
+
+func (ro *recordingObserver) HookStarted(hookIndex int, hookType string) {
+	ro.observations = append(ro.observations, observation{hookIndex: hookIndex, hookType: hookType})
+}
+
+func (ro *recordingObserver) HookFinished(hookIndex int, hookType string, duration time.Duration, err error) {
+	ro.observations = append(ro.observations, observation{hookIndex, hookType, true, duration, err})
+}
+
+func TestExecutionObserver(t *testing.T) {
+	errHook := errors.New("hook failed")
+	failingDispatcher := func(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+		subscriberFn.(hook)(event.(int))
+		if event.(int) < 0 {
+			return errHook
+		}
+		return nil
+	}
+	obs := &recordingObserver{}
+	hs := hookset.New(failingDispatcher, hookset.WithHookType("test"), hookset.WithExecutionObserver(obs))
+	hs.Register(hook(func(int) {}))
+	hs.Register(hook(func(int) { time.Sleep(10 * time.Millisecond) }))
+	hs.Register(hook(func(int) {}))
+
+	// each hook is timed, in order, and each publish counts hooks from zero
+	require.NoError(t, hs.Publish(1))
+	require.Len(t, obs.observations, 6)
+	for i := 0; i < 3; i++ {
+		started, finished := obs.observations[2*i], obs.observations[2*i+1]
+		require.Equal(t, observation{hookIndex: i, hookType: "test"}, started)
+		require.True(t, finished.finished)
+		require.Equal(t, i, finished.hookIndex)
+		require.Equal(t, "test", finished.hookType)
+		require.NoError(t, finished.err)
+	}
+	require.GreaterOrEqual(t, obs.observations[3].duration, 10*time.Millisecond)
+
+	// a failing hook is reported with its error, and stops the publish
+	obs.observations = nil
+	require.Equal(t, errHook, hs.Publish(-1))
+	require.Len(t, obs.observations, 2)
+	require.Equal(t, 0, obs.observations[1].hookIndex)
+	require.Equal(t, errHook, obs.observations[1].err)
+
+	// hooks run outside of publish are observed with the given index
+	obs.observations = nil
+	require.Equal(t, errHook, hs.Run(5, func() error { return errHook }))
+	require.Len(t, obs.observations, 2)
+	require.Equal(t, observation{hookIndex: 5, hookType: "test"}, obs.observations[0])
+	require.Equal(t, errHook, obs.observations[1].err)
+
+	// listing hooks is not observed
+	obs.observations = nil
+	require.Len(t, hs.Hooks(), 3)
+	require.Empty(t, obs.observations)
+}
+
+func TestLoggingObserver(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	obs := hookset.LoggingObserver(zap.New(core), 50*time.Millisecond)
+	obs.HookStarted(0, "test")
+	obs.HookFinished(0, "test", 10*time.Millisecond, nil)
+	require.Equal(t, 0, logs.Len())
+
+	obs.HookStarted(1, "test")
+	obs.HookFinished(1, "test", 100*time.Millisecond, errors.New("hook failed"))
+	entries := logs.AllUntimed()
+	require.Len(t, entries, 1)
+	require.Equal(t, zapcore.DebugLevel, entries[0].Level)
+	fields := entries[0].ContextMap()
+	require.Equal(t, "test", fields["hook type"])
+	require.Equal(t, int64(1), fields["hook index"])
+	require.Equal(t, 100*time.Millisecond, fields["duration"])
+	require.Equal(t, "hook failed", fields["error"])
+}
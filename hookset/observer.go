@@ -0,0 +1,31 @@
+package hookset
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type loggingObserver struct {
+	logger    *zap.Logger
+	threshold time.Duration
+}
+
+// LoggingObserver returns an execution observer that logs, at debug level,
+// each hook that takes longer than the given threshold to run
+func LoggingObserver(logger *zap.Logger, threshold time.Duration) HookExecutionObserver {
+	return loggingObserver{logger, threshold}
+}
+
+func (lo loggingObserver) HookStarted(hookIndex int, hookType string) {}
+
+func (lo loggingObserver) HookFinished(hookIndex int, hookType string, duration time.Duration, err error) {
+	if duration <= lo.threshold {
+		return
+	}
+	lo.logger.Debug("slow hook",
+		zap.String("hook type", hookType),
+		zap.Int("hook index", hookIndex),
+		zap.Duration("duration", duration),
+		zap.Error(err))
+}
@@ -0,0 +1,29 @@
+package graphsync
+
+import (
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// BlockPeer rejects all new requests from the given peer. Requests from a
+// blocked peer are rejected as they arrive from the network, before any
+// request hooks run or any blocks are loaded. Responses already in progress
+// are not affected
+func (gs *GraphSync) BlockPeer(p peer.ID) {
+	gs.blockedPeersLk.Lock()
+	defer gs.blockedPeersLk.Unlock()
+	gs.blockedPeers[p] = struct{}{}
+}
+
+// UnblockPeer accepts requests again from a peer blocked with BlockPeer
+func (gs *GraphSync) UnblockPeer(p peer.ID) {
+	gs.blockedPeersLk.Lock()
+	defer gs.blockedPeersLk.Unlock()
+	delete(gs.blockedPeers, p)
+}
+
+func (gs *GraphSync) isBlocked(p peer.ID) bool {
+	gs.blockedPeersLk.RLock()
+	defer gs.blockedPeersLk.RUnlock()
+	_, blocked := gs.blockedPeers[p]
+	return blocked
+}
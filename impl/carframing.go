@@ -0,0 +1,86 @@
+package graphsync
+
+import (
+	"context"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/carframing"
+)
+
+// RequestCAR initiates a new GraphSync request for the given root and selector,
+// returning a reader of the blocks the traversal reaches, in traversal order,
+// each framed as a CAR block section. Each block appears once. No CAR header is
+// written, so the output can follow a header written by the caller. Blocks are
+// read back from the link system the exchange was created with. Errors are
+// delivered on the returned channel, and also end the reader. Closing the
+// reader cancels the request
+func (gs *GraphSync) RequestCAR(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, extensions ...graphsync.ExtensionData) (io.ReadCloser, <-chan error) {
+	requestCtx, cancel := context.WithCancel(ctx)
+	responses, errs := gs.Request(requestCtx, p, root, selector, extensions...)
+	reader, writer := io.Pipe()
+	outgoingErrors := make(chan error)
+	go gs.runCARFraming(ctx, cancel, root, responses, errs, writer, outgoingErrors)
+	return reader, outgoingErrors
+}
+
+func (gs *GraphSync) runCARFraming(ctx context.Context,
+	cancel context.CancelFunc,
+	root ipld.Link,
+	responses <-chan graphsync.ResponseProgress,
+	incomingErrors <-chan error,
+	writer *io.PipeWriter,
+	outgoingErrors chan<- error) {
+	defer close(outgoingErrors)
+	defer cancel()
+
+	framed := cid.NewSet()
+	var framingErr error
+	for response := range responses {
+		if framingErr != nil {
+			continue
+		}
+		lnk := response.LastBlock.Link
+		if lnk == nil {
+			lnk = root
+		}
+		asCidLink, ok := lnk.(cidlink.Link)
+		if !ok || !framed.Visit(asCidLink.Cid) {
+			continue
+		}
+		data, err := gs.linkSystem.LoadRaw(ipld.LinkContext{Ctx: ctx}, lnk)
+		if err == nil {
+			err = carframing.WriteBlock(writer, asCidLink.Cid, data)
+		}
+		if err != nil {
+			// stop the request, but keep reading so it can wind down
+			framingErr = err
+			cancel()
+		}
+	}
+
+	var errs []error
+	for err := range incomingErrors {
+		errs = append(errs, err)
+	}
+	if framingErr != nil && framingErr != io.ErrClosedPipe {
+		errs = append([]error{framingErr}, errs...)
+	}
+	if len(errs) > 0 {
+		_ = writer.CloseWithError(errs[0])
+	} else {
+		_ = writer.Close()
+	}
+	for _, err := range errs {
+		select {
+		case outgoingErrors <- err:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package graphsync
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/cidset"
+)
+
+var errNoFailoverPeers = errors.New("request failed: no peers to request from")
+
+// RequestWithFailover initiates a new GraphSync request for the given root and
+// selector, trying each of the given peers in order until one of them completes
+// the traversal. When a peer fails, blocks already received from it are kept in
+// the local store and are not requested again from the next peer, and nodes are
+// never delivered twice on the returned channel. Errors are only delivered for
+// the last peer tried
+func (gs *GraphSync) RequestWithFailover(ctx context.Context, peers []peer.ID, root ipld.Link, selector ipld.Node, extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
+	outgoingResponses := make(chan graphsync.ResponseProgress)
+	outgoingErrors := make(chan error)
+	go gs.runFailover(ctx, peers, root, selector, extensions, outgoingResponses, outgoingErrors)
+	return outgoingResponses, outgoingErrors
+}
+
+func (gs *GraphSync) runFailover(ctx context.Context,
+	peers []peer.ID,
+	root ipld.Link,
+	selector ipld.Node,
+	extensions []graphsync.ExtensionData,
+	outgoingResponses chan<- graphsync.ResponseProgress,
+	outgoingErrors chan<- error) {
+	defer close(outgoingResponses)
+	defer close(outgoingErrors)
+
+	if len(peers) == 0 {
+		select {
+		case outgoingErrors <- errNoFailoverPeers:
+		case <-ctx.Done():
+		}
+		return
+	}
+
+	// traversals are deterministic, so a node is identified by its path
+	delivered := make(map[string]struct{})
+	received := cid.NewSet()
+	var errs []error
+	for i, p := range peers {
+		responses, incomingErrors := gs.Request(ctx, p, root, selector, withDoNotSendCids(extensions, received)...)
+		errs = nil
+		for responses != nil || incomingErrors != nil {
+			select {
+			case response, ok := <-responses:
+				if !ok {
+					responses = nil
+					continue
+				}
+				recordReceivedBlock(received, root, response)
+				path := response.Path.String()
+				if _, ok := delivered[path]; ok {
+					continue
+				}
+				delivered[path] = struct{}{}
+				select {
+				case outgoingResponses <- response:
+				case <-ctx.Done():
+					return
+				}
+			case err, ok := <-incomingErrors:
+				if !ok {
+					incomingErrors = nil
+					continue
+				}
+				errs = append(errs, err)
+			}
+		}
+		if len(errs) == 0 || ctx.Err() != nil {
+			break
+		}
+		if i < len(peers)-1 {
+			log.Infow("graphsync request failed, failing over to next peer", "peer", p, "next peer", peers[i+1], "errors", errs)
+		}
+	}
+	for _, err := range errs {
+		select {
+		case outgoingErrors <- err:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// recordReceivedBlock tracks the block a response was read from, so that it
+// can be excluded from requests to later peers
+func recordReceivedBlock(received *cid.Set, root ipld.Link, response graphsync.ResponseProgress) {
+	lnk := response.LastBlock.Link
+	if lnk == nil {
+		lnk = root
+	}
+	if asCidLink, ok := lnk.(cidlink.Link); ok {
+		received.Add(asCidLink.Cid)
+	}
+}
+
+// withDoNotSendCids adds the given cids to any do-not-send-cids extension
+// present in extensions, or adds the extension if it is not present
+func withDoNotSendCids(extensions []graphsync.ExtensionData, cids *cid.Set) []graphsync.ExtensionData {
+	if cids.Len() == 0 {
+		return extensions
+	}
+	doNotSend := cid.NewSet()
+	_ = cids.ForEach(func(c cid.Cid) error {
+		doNotSend.Add(c)
+		return nil
+	})
+	merged := make([]graphsync.ExtensionData, 0, len(extensions)+1)
+	for _, extension := range extensions {
+		if extension.Name != graphsync.ExtensionDoNotSendCIDs {
+			merged = append(merged, extension)
+			continue
+		}
+		if existing, err := cidset.DecodeCidSet(extension.Data); err == nil {
+			_ = existing.ForEach(func(c cid.Cid) error {
+				doNotSend.Add(c)
+				return nil
+			})
+		}
+	}
+	return append(merged, graphsync.ExtensionData{
+		Name: graphsync.ExtensionDoNotSendCIDs,
+		Data: cidset.EncodeCidSet(doNotSend),
+	})
+}
@@ -3,11 +3,17 @@ package graphsync
 import (
 	"context"
 	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipfs/go-peertaskqueue"
 	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/traversal"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
@@ -15,14 +21,20 @@ import (
 
 	"github.com/ipfs/go-graphsync"
 	"github.com/ipfs/go-graphsync/allocator"
+	"github.com/ipfs/go-graphsync/compression"
+	"github.com/ipfs/go-graphsync/hookset"
+	"github.com/ipfs/go-graphsync/limits"
 	"github.com/ipfs/go-graphsync/listeners"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/messagequeue"
 	gsnet "github.com/ipfs/go-graphsync/network"
 	"github.com/ipfs/go-graphsync/panics"
+	"github.com/ipfs/go-graphsync/peeractivity"
 	"github.com/ipfs/go-graphsync/peermanager"
 	"github.com/ipfs/go-graphsync/peerstate"
 	"github.com/ipfs/go-graphsync/persistenceoptions"
+	"github.com/ipfs/go-graphsync/ratelimiter"
+	"github.com/ipfs/go-graphsync/requestcounts"
 	"github.com/ipfs/go-graphsync/requestmanager"
 	"github.com/ipfs/go-graphsync/requestmanager/executor"
 	requestorhooks "github.com/ipfs/go-graphsync/requestmanager/hooks"
@@ -30,8 +42,10 @@ import (
 	responderhooks "github.com/ipfs/go-graphsync/responsemanager/hooks"
 	"github.com/ipfs/go-graphsync/responsemanager/queryexecutor"
 	"github.com/ipfs/go-graphsync/responsemanager/responseassembler"
+	"github.com/ipfs/go-graphsync/selectorcache"
 	"github.com/ipfs/go-graphsync/selectorvalidator"
 	"github.com/ipfs/go-graphsync/taskqueue"
+	"github.com/ipfs/go-graphsync/transferstats"
 )
 
 var log = logging.Logger("graphsync")
@@ -42,6 +56,16 @@ const defaultMaxMemoryPerPeer = uint64(16 << 20)
 const defaultMaxInProgressRequests = uint64(6)
 const defaultMessageSendRetries = 10
 const defaultSendMessageTimeout = 10 * time.Minute
+const defaultRequestTombstoneMaxAge = 10 * time.Minute
+const defaultMaxLateMessagesPerPeer = 100
+const defaultLimitHitInterval = time.Minute
+const defaultResponseLoadConcurrency = 1
+const defaultAsyncValidationTimeout = time.Minute
+const defaultProgressSaveInterval = 30 * time.Second
+const defaultPeerActivityDebounce = 500 * time.Millisecond
+const defaultMaxReceivedBlockSize = uint64(2 << 20)
+const minThrottleLevel = 0.01
+const minThrottledMemory = uint64(1 << 20)
 
 // GraphSync is an instance of a GraphSync exchange that implements
 // the graphsync protocol.
@@ -51,16 +75,20 @@ type GraphSync struct {
 	requestManager                     *requestmanager.RequestManager
 	responseManager                    *responsemanager.ResponseManager
 	queryExecutor                      *queryexecutor.QueryExecutor
-	responseQueue                      taskqueue.TaskQueue
-	requestQueue                       taskqueue.TaskQueue
+	responseQueue                      *taskqueue.WorkerTaskQueue
+	requestQueue                       *taskqueue.WorkerTaskQueue
 	requestExecutor                    *executor.Executor
 	responseAssembler                  *responseassembler.ResponseAssembler
 	peerManager                        *peermanager.PeerMessageManager
 	incomingRequestHooks               *responderhooks.IncomingRequestHooks
 	outgoingBlockHooks                 *responderhooks.OutgoingBlockHooks
 	requestUpdatedHooks                *responderhooks.RequestUpdatedHooks
+	completingResponseHooks            *responderhooks.CompletingResponseHooks
+	asyncRequestValidators             *responderhooks.AsyncRequestValidators
 	incomingRequestProcessingListeners *listeners.RequestProcessingListeners
+	incomingRequestQueuedHooks         *listeners.RequestQueuedHooks
 	outgoingRequestProcessingListeners *listeners.RequestProcessingListeners
+	completedResponseHooks             *listeners.CompletedResponseHooks
 	completedResponseListeners         *listeners.CompletedResponseListeners
 	requestorCancelledListeners        *listeners.RequestorCancelledListeners
 	blockSentListeners                 *listeners.BlockSentListeners
@@ -69,10 +97,46 @@ type GraphSync struct {
 	incomingResponseHooks              *requestorhooks.IncomingResponseHooks
 	outgoingRequestHooks               *requestorhooks.OutgoingRequestHooks
 	incomingBlockHooks                 *requestorhooks.IncomingBlockHooks
+	selectorProposalHooks              *requestorhooks.SelectorProposalHooks
 	persistenceOptions                 *persistenceoptions.PersistenceOptions
+	progressStore                      graphsync.PersistenceStore
 	ctx                                context.Context
 	cancel                             context.CancelFunc
 	responseAllocator                  *allocator.Allocator
+	rateLimiter                        *ratelimiter.RateLimiter
+	limitRecorder                      *limits.Recorder
+	limitHitListeners                  *listeners.LimitHitListeners
+	negotiationCompleteListeners       *listeners.NegotiationCompleteListeners
+	peerActivityListeners              *listeners.PeerActivityListeners
+	transferStats                      *transferstats.Tracker
+	outgoingRequestCounts              *requestcounts.Tracker
+	incomingRequestCounts              *requestcounts.Tracker
+
+	// configured limits that are not throttled
+	maxLinksPerOutgoingRequest uint64
+	maxLinksPerIncomingRequest uint64
+	maxRecursionDepth          int64
+	tombstoneOptions           graphsync.TombstoneOptions
+	drainTimeout               time.Duration
+
+	// configured limits, scaled by the throttle level
+	totalMaxMemoryResponder          uint64
+	maxMemoryPerPeerResponder        uint64
+	maxInProgressIncomingRequests    uint64
+	maxInProgressOutgoingRequests    uint64
+	maxOutgoingBytesPerSecond        uint64
+	maxOutgoingBytesPerSecondPerPeer uint64
+	throttleLk                       sync.RWMutex
+	throttle                         graphsync.ThrottleStats
+
+	// peers whose new requests are rejected
+	blockedPeersLk sync.RWMutex
+	blockedPeers   map[peer.ID]struct{}
+
+	// set once Close is called, read atomically
+	closed    int32
+	closeOnce sync.Once
+	closeErr  error
 }
 
 type graphsyncConfigOptions struct {
@@ -80,13 +144,47 @@ type graphsyncConfigOptions struct {
 	maxMemoryPerPeerResponder            uint64
 	maxInProgressIncomingRequests        uint64
 	maxInProgressIncomingRequestsPerPeer uint64
+	rejectIncomingRequestsOverPeerLimit  bool
 	maxInProgressOutgoingRequests        uint64
+	maxInProgressOutgoingRequestsPerPeer uint64
+	responseLoadConcurrency              int
 	registerDefaultValidator             bool
+	concurrentIncomingRequestHooks       bool
+	hookExecutionObserver                hookset.HookExecutionObserver
 	maxLinksPerOutgoingRequest           uint64
 	maxLinksPerIncomingRequest           uint64
+	maxRecursionDepthIncomingRequest     int64
 	messageSendRetries                   int
 	sendMessageTimeout                   time.Duration
+	maxMessageSize                       int
+	messageSendDelay                     time.Duration
 	panicCallback                        panics.CallBackFn
+	cidDenylist                          func(cid.Cid) bool
+	verifyBlocks                         bool
+	strictVerification                   bool
+	maxReceivedBlockSize                 uint64
+	requestBatchWindow                   time.Duration
+	requestScheduler                     graphsync.RequestScheduler
+	retryOptions                         graphsync.RetryOptions
+	maxSelectorProposals                 int
+	tombstoneOptions                     graphsync.TombstoneOptions
+	selectorCacheSize                    int
+	limitHitInterval                     time.Duration
+	peerActivityDebounce                 time.Duration
+	metricsRecorder                      graphsync.MetricsRecorder
+	requestIDAllocator                   graphsync.RequestIDAllocator
+	maxProgressBuffer                    int
+	peerStateTTL                         time.Duration
+	maxOutgoingBytesPerSecond            uint64
+	maxOutgoingBytesPerSecondPerPeer     uint64
+	drainTimeout                         time.Duration
+	asyncValidationTimeout               time.Duration
+	supportedExtensions                  []graphsync.ExtensionName
+	blockCompression                     graphsync.CompressionCodec
+	defaultChooser                       traversal.LinkTargetNodePrototypeChooser
+	progressStore                        graphsync.PersistenceStore
+	progressSaveInterval                 time.Duration
+	transport                            graphsync.Transport
 }
 
 // Option defines the functional option type that can be used to configure
@@ -101,6 +199,26 @@ func RejectAllRequestsByDefault() Option {
 	}
 }
 
+// ConcurrentIncomingRequestHooks runs the incoming request hooks for each
+// request at the same time rather than one after another, which cuts the
+// latency of many independent hooks. Their actions are combined as if they had
+// run in the order registered. Hooks must be safe to run concurrently with
+// each other
+func ConcurrentIncomingRequestHooks() Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.concurrentIncomingRequestHooks = true
+	}
+}
+
+// ObserveHookExecution tells the given observer when each registered hook
+// starts and finishes running, to find the hooks that add latency to
+// requests. hookset.LoggingObserver logs the hooks slower than a threshold
+func ObserveHookExecution(observer hookset.HookExecutionObserver) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.hookExecutionObserver = observer
+	}
+}
+
 // MaxMemoryResponder defines the maximum amount of memory the responder
 // may consume queueing up messages for a response in total
 func MaxMemoryResponder(totalMaxMemory uint64) Option {
@@ -117,14 +235,69 @@ func MaxMemoryPerPeerResponder(maxMemoryPerPeer uint64) Option {
 	}
 }
 
+// MaxOutgoingBytesPerSecond limits the rate blocks are sent in responses to
+// all peers combined. Responses slow down to stay under the limit, rather than
+// failing
+// A value of 0 = infinity, or no limit
+func MaxOutgoingBytesPerSecond(maxOutgoingBytesPerSecond uint64) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.maxOutgoingBytesPerSecond = maxOutgoingBytesPerSecond
+	}
+}
+
+// MaxOutgoingBytesPerSecondPerPeer limits the rate blocks are sent in
+// responses to each peer. Responses slow down to stay under the limit, rather
+// than failing
+// A value of 0 = infinity, or no limit
+func MaxOutgoingBytesPerSecondPerPeer(maxOutgoingBytesPerSecondPerPeer uint64) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.maxOutgoingBytesPerSecondPerPeer = maxOutgoingBytesPerSecondPerPeer
+	}
+}
+
 // MaxInProgressIncomingRequests changes the maximum number of
-// incoming graphsync requests that are processed in parallel (default 6)
+// incoming graphsync requests that are processed in parallel (default 6).
+// Requests beyond the limit wait in a queue that is fair across peers and
+// ordered by request priority within a peer
 func MaxInProgressIncomingRequests(maxInProgressIncomingRequests uint64) Option {
 	return func(gs *graphsyncConfigOptions) {
 		gs.maxInProgressIncomingRequests = maxInProgressIncomingRequests
 	}
 }
 
+// MaxInProgressRequests changes the maximum number of incoming graphsync
+// requests that are processed in parallel (default 6). It is equivalent to
+// MaxInProgressIncomingRequests.
+//
+// Deprecated: use MaxInProgressIncomingRequests
+func MaxInProgressRequests(maxInProgressRequests uint64) Option {
+	return MaxInProgressIncomingRequests(maxInProgressRequests)
+}
+
+// ResponseWorkerCount sets how many workers traverse incoming graphsync
+// requests in parallel (default 6). Waiting requests are handed to workers
+// round-robin across peers, so a peer with many queued requests does not hold
+// up the others. It is equivalent to MaxInProgressIncomingRequests. Values
+// below one are ignored
+func ResponseWorkerCount(n int) Option {
+	return func(gs *graphsyncConfigOptions) {
+		if n > 0 {
+			gs.maxInProgressIncomingRequests = uint64(n)
+		}
+	}
+}
+
+// ResponseLoadConcurrency sets how many blocks the responder may read from
+// storage at once for each response (default 1). With more than one, the
+// blocks linked from each block loaded are read ahead of the traversal, which
+// helps when storage reads have high latency. Blocks are still sent in
+// traversal order
+func ResponseLoadConcurrency(n int) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.responseLoadConcurrency = n
+	}
+}
+
 // MaxInProgressIncomingRequestsPerPeer changes the maximum number of
 // incoming graphsync requests that are processed in parallel on a per-peer basis.
 // The value is not set by default.
@@ -139,16 +312,52 @@ func MaxInProgressIncomingRequestsPerPeer(maxInProgressIncomingRequestsPerPeer u
 	}
 }
 
+// MaxInProgressRequestsPerPeer changes the maximum number of incoming
+// graphsync requests from each peer that are processed in parallel. It is
+// equivalent to MaxInProgressIncomingRequestsPerPeer
+func MaxInProgressRequestsPerPeer(maxInProgressRequestsPerPeer uint64) Option {
+	return MaxInProgressIncomingRequestsPerPeer(maxInProgressRequestsPerPeer)
+}
+
+// RejectIncomingRequestsOverPeerLimit rejects new requests from a peer that
+// already has MaxInProgressIncomingRequestsPerPeer responses in progress,
+// rather than queueing them behind that peer's other requests. Responses that
+// are queued, paused or still sending count towards the limit, as well as
+// those being traversed. Rejected requests end with RequestRejected before any
+// request hooks run. It has no effect unless
+// MaxInProgressIncomingRequestsPerPeer is set
+func RejectIncomingRequestsOverPeerLimit() Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.rejectIncomingRequestsOverPeerLimit = true
+	}
+}
+
 // MaxInProgressOutgoingRequests changes the maximum number of
-// outgoing graphsync requests that are processed in parallel (default 6)
+// outgoing graphsync requests that are processed in parallel (default 6).
+// Requests beyond the limit wait in a queue that is fair across peers, and are
+// not sent to the remote peer until they leave the queue
 func MaxInProgressOutgoingRequests(maxInProgressOutgoingRequests uint64) Option {
 	return func(gs *graphsyncConfigOptions) {
 		gs.maxInProgressOutgoingRequests = maxInProgressOutgoingRequests
 	}
 }
 
+// MaxConcurrentOutgoingRequestsPerPeer limits how many outgoing graphsync
+// requests to each peer are in progress at once. Requests beyond the limit
+// wait locally and are sent in priority order, oldest first among requests of
+// equal priority, as requests to the peer finish. Waiting requests can still
+// be cancelled. Values below one are ignored
+func MaxConcurrentOutgoingRequestsPerPeer(n int) Option {
+	return func(gs *graphsyncConfigOptions) {
+		if n > 0 {
+			gs.maxInProgressOutgoingRequestsPerPeer = uint64(n)
+		}
+	}
+}
+
 // MaxLinksPerOutgoingRequests changes the allowed number of links an outgoing
-// request can traverse before failing
+// request can traverse before failing. A single request can set its own budget
+// with graphsync.MaxLinksContextKey
 // A value of 0 = infinity, or no limit
 func MaxLinksPerOutgoingRequests(maxLinksPerOutgoingRequest uint64) Option {
 	return func(gs *graphsyncConfigOptions) {
@@ -156,8 +365,34 @@ func MaxLinksPerOutgoingRequests(maxLinksPerOutgoingRequest uint64) Option {
 	}
 }
 
+// MaxProgressBuffer limits how many responses are buffered for each outgoing
+// request while waiting for the caller to read them. Blocks are verified and
+// stored as they arrive until the buffer is full, then the traversal waits for
+// the caller. Responses are never dropped, and are always delivered in
+// traversal order.
+// A value of 0 = infinity, or no limit
+func MaxProgressBuffer(maxProgressBuffer int) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.maxProgressBuffer = maxProgressBuffer
+	}
+}
+
+// WithPeerStateTTL sets how long message queues are kept for peers that are
+// not connected once they go unused. The extensions negotiated with the peer,
+// its rate limit and its transfer and request counts are evicted along with
+// its queue. State for connected peers is never evicted. This bounds memory
+// for long running nodes that talk to many peers
+// A value of 0 = never evict state for peers that are not connected
+func WithPeerStateTTL(peerStateTTL time.Duration) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.peerStateTTL = peerStateTTL
+	}
+}
+
 // MaxLinksPerIncomingRequests changes the allowed number of links an incoming
-// request can traverse before failing
+// request can traverse before failing. The budget is counted across the whole
+// traversal, and requests that exceed it are terminated, with the requestor
+// receiving a SelectorBudgetExceededErr.
 // A value of 0 = infinity, or no limit
 func MaxLinksPerIncomingRequests(maxLinksPerIncomingRequest uint64) Option {
 	return func(gs *graphsyncConfigOptions) {
@@ -165,6 +400,36 @@ func MaxLinksPerIncomingRequests(maxLinksPerIncomingRequest uint64) Option {
 	}
 }
 
+// MaxLinksTraversed limits the number of links the responder will traverse
+// across the whole of an incoming request. Requests that exceed the budget are
+// terminated, with the requestor receiving a SelectorBudgetExceededErr.
+// It is equivalent to MaxLinksPerIncomingRequests
+// A value of 0 = infinity, or no limit
+func MaxLinksTraversed(maxLinksTraversed uint64) Option {
+	return MaxLinksPerIncomingRequests(maxLinksTraversed)
+}
+
+// SelectorCache caches up to maxEntries compiled selectors on the responder,
+// along with the result of validating them, so that requests reusing a
+// selector do not compile and validate it again. Only useful when many
+// incoming requests share a small set of selectors.
+// A value of 0 = no cache
+func SelectorCache(maxEntries int) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.selectorCacheSize = maxEntries
+	}
+}
+
+// MaxRecursionDepth limits how many links deep from the root the responder
+// will traverse for an incoming request. Requests that go deeper are
+// terminated, with the requestor receiving a SelectorBudgetExceededErr.
+// A value of 0 = infinity, or no limit
+func MaxRecursionDepth(maxRecursionDepth int64) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.maxRecursionDepthIncomingRequest = maxRecursionDepth
+	}
+}
+
 // MessageSendRetries sets the number of times graphsync will send
 // attempt to send a message before giving up.
 // Lower to increase the speed at which an unresponsive peer is
@@ -190,6 +455,48 @@ func SendMessageTimeout(sendMessageTimeout time.Duration) Option {
 	}
 }
 
+// MaxMessageSize sets the largest encoded message, in bytes, that is sent or
+// received. Larger incoming messages are rejected before they are read, and
+// responses are split across as many messages as needed to keep the block
+// data in each to half the limit, leaving room for the rest of the message.
+// A block too large for that is sent in a message of its own.
+// The limit applies to the network passed to New if it implements
+// network.MessageSizeLimiter, as the networks in this module do, and to the
+// network built for WithTransport.
+//
+// If not set, network.DefaultMaxMessageSize is used, and block data in a
+// response message is limited to 512KiB.
+func MaxMessageSize(maxMessageSize int) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.maxMessageSize = maxMessageSize
+	}
+}
+
+// MessageSendDelay holds back a response message with room for more block
+// data for up to the given delay, so that small responses and blocks queued
+// close together are sent as one message rather than many. A message is sent
+// without waiting once its block data reaches the limit set by MaxMessageSize,
+// and requests are never held back. Useful for DAGs of many small blocks,
+// where the overhead of each message dominates.
+//
+// If not set, messages are sent as soon as the queue is free.
+func MessageSendDelay(delay time.Duration) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.messageSendDelay = delay
+	}
+}
+
+// WithTransport exchanges messages over streams from the given transport
+// instead of the network passed to New, which may then be nil. Use it to run
+// graphsync over transports other than a libp2p host. Transports report no
+// connection events, so message queues for a peer are only evicted through
+// WithPeerStateTTL
+func WithTransport(transport graphsync.Transport) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.transport = transport
+	}
+}
+
 // PanicCallback allows calling code to receive information about panics that
 // Graphsync recovers from. Graphsync recovers panics that occur during
 // per-request execution in order to keep the over all system running, although
@@ -200,6 +507,219 @@ func PanicCallback(callbackFn panics.CallBackFn) Option {
 	}
 }
 
+// WithBlockVerification checks that every block received from a remote peer
+// hashes to its CID, terminating the request with
+// graphsync.ErrBlockVerificationFailed if it does not. Link systems without
+// TrustedStorage already verify blocks as they are loaded, so it is only needed
+// for trusted storage that does not rely on the transport to verify blocks
+func WithBlockVerification() Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.verifyBlocks = true
+	}
+}
+
+// StrictVerification checks every block received from a remote peer as the
+// message arrives, before any of it is stored or traversed. Blocks must hash
+// to the link they were sent for and be no larger than MaxReceivedBlockSize,
+// otherwise the request is cancelled and fails with graphsync.ErrInvalidBlock
+func StrictVerification(enabled bool) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.strictVerification = enabled
+	}
+}
+
+// MaxReceivedBlockSize sets the largest block accepted from a remote peer with
+// StrictVerification. Zero means no limit. Defaults to 2MiB
+func MaxReceivedBlockSize(size uint64) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.maxReceivedBlockSize = size
+	}
+}
+
+// WithCIDDenylist sets a function that is consulted for every link reached
+// in a traversal, before the block is loaded, stored or sent.
+// As a requestor, a request that reaches a denylisted CID fails with
+// graphsync.ErrDenylistedCID. As a responder, denylisted links are treated as
+// missing and the traversal does not descend into them.
+func WithCIDDenylist(deny func(cid.Cid) bool) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.cidDenylist = deny
+	}
+}
+
+// RequestManagerWithRequestBatching holds new outgoing requests for up to the
+// given window, so that requests to the same peer issued in a burst are sent
+// together in a single message.
+// A value of 0 (the default) sends each request as soon as it's ready.
+func RequestManagerWithRequestBatching(window time.Duration) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.requestBatchWindow = window
+	}
+}
+
+// RequestManagerWithScheduler sets a callback that picks which queued
+// outgoing request is dispatched next, in place of the default ordering by
+// priority. See graphsync.RequestSchedulerFunc
+func RequestManagerWithScheduler(scheduler graphsync.RequestSchedulerFunc) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.requestScheduler = requestmanager.NewFuncScheduler(scheduler)
+	}
+}
+
+// WithRequestScheduler sets the scheduler that picks which queued outgoing
+// request is dispatched next. By default, requests are dispatched in order of
+// priority, and a request inherits the priority of higher priority requests
+// that depend on it while they are queued or in progress. See
+// graphsync.WithRequestDependencies
+func WithRequestScheduler(scheduler graphsync.RequestScheduler) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.requestScheduler = scheduler
+	}
+}
+
+// WithTombstoneOptions sets how many recently completed outgoing requests are
+// remembered and for how long, and how many responses for requests no longer
+// in progress are accepted from each peer.
+// Defaults to remembering 1024 requests for up to 10 minutes, and accepting
+// 100 such responses per second from each peer.
+func WithTombstoneOptions(tombstoneOptions graphsync.TombstoneOptions) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.tombstoneOptions = tombstoneOptions
+	}
+}
+
+// LimitHitInterval sets how often listeners registered with
+// RegisterLimitHitListener are notified about a limit that is hit
+// continuously. Listeners hear about the first hit on each limit in each
+// interval. Defaults to one minute.
+func LimitHitInterval(interval time.Duration) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.limitHitInterval = interval
+	}
+}
+
+// PeerActivityDebounce sets how long a peer must have no requests in progress,
+// in either direction, before listeners registered with
+// RegisterPeerActivityListener hear it is inactive. A request that starts
+// within the delay keeps the peer active, so a quick succession of short
+// requests does not report the peer going active and inactive each time.
+// Defaults to 500 milliseconds.
+func PeerActivityDebounce(debounce time.Duration) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.peerActivityDebounce = debounce
+	}
+}
+
+// WithRetryOptions enables automatic retries, with exponential backoff, of
+// outgoing requests that fail for transient reasons (a busy responder or
+// a failure to send the request).
+// Requests are not retried by default.
+func WithRetryOptions(retryOptions graphsync.RetryOptions) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.retryOptions = retryOptions
+	}
+}
+
+// MaxSelectorProposals sets the most times an outgoing request is re-issued
+// with an alternate selector the responder proposed and a selector proposal
+// hook accepted. A request the responder rejects with another proposal after
+// that fails with graphsync.SelectorProposalLimitErr. Defaults to 1.
+func MaxSelectorProposals(maxSelectorProposals int) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.maxSelectorProposals = maxSelectorProposals
+	}
+}
+
+// WithMetricsRecorder reports counts and timings of requests, responses and
+// blocks to the given recorder. By default metrics are not recorded
+func WithMetricsRecorder(metricsRecorder graphsync.MetricsRecorder) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.metricsRecorder = metricsRecorder
+	}
+}
+
+// WithRequestIDAllocator chooses IDs for outgoing requests with the given
+// allocator, so they can be derived from IDs used elsewhere. IDs set in the
+// request context still take precedence. A request retried with another peer
+// gets a new ID from the allocator for each retry. By default IDs are random
+func WithRequestIDAllocator(requestIDAllocator graphsync.RequestIDAllocator) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.requestIDAllocator = requestIDAllocator
+	}
+}
+
+// DrainTimeout sets how long Close lets requests and responses already in
+// progress carry on before cancelling them. New requests are turned away
+// while they finish. A value of 0 (the default) cancels them straight away
+func DrainTimeout(drainTimeout time.Duration) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.drainTimeout = drainTimeout
+	}
+}
+
+// AsyncRequestValidationTimeout sets how long async request validators have to
+// decide whether to accept a request before it is rejected. A value of 0 lets
+// them take as long as the response is in progress.
+//
+// If not set, a default of 1 minute is used.
+func AsyncRequestValidationTimeout(timeout time.Duration) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.asyncValidationTimeout = timeout
+	}
+}
+
+// SupportedExtensions adds extensions the application understands, through
+// its hooks, to the extensions graphsync itself understands. Peers learn which
+// extensions each other supports with the first request between them, and
+// extensions in the list that a peer does not support are left out of later
+// requests to it. Extensions that are not in the list are always sent
+func SupportedExtensions(extensions ...graphsync.ExtensionName) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.supportedExtensions = append(gs.supportedExtensions, extensions...)
+	}
+}
+
+// BlockCompression compresses block data sent to and asks for compressed block
+// data from peers that also use the given codec. Blocks sent to or from peers
+// that do not support it, and blocks too small to benefit, are sent
+// uncompressed. CIDs and metadata are never compressed
+func BlockCompression(codec graphsync.CompressionCodec) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.blockCompression = codec
+		gs.supportedExtensions = append(gs.supportedExtensions, graphsync.ExtensionBlockCompression)
+	}
+}
+
+// DefaultLinkTargetNodePrototypeChooser sets the node prototype chooser for the
+// traversals of outgoing requests and incoming requests, so applications need
+// not set one with a hook for every request. A chooser set for a single request
+// with graphsync.WithLinkTargetNodePrototypeChooser takes precedence, then one
+// set by a hook, then this one, and if none is set, a chooser supporting
+// dag-pb and basic nodes is used
+func DefaultLinkTargetNodePrototypeChooser(chooser traversal.LinkTargetNodePrototypeChooser) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.defaultChooser = chooser
+	}
+}
+
+// WithPersistence saves the progress of outgoing requests to the given store
+// as they run, so they can be resumed with ResumeRequest after a restart.
+// Progress is saved every 30 seconds, unless set otherwise with
+// ProgressSaveInterval, and when the exchange is closed
+func WithPersistence(store graphsync.PersistenceStore) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.progressStore = store
+	}
+}
+
+// ProgressSaveInterval sets how often the progress of outgoing requests is
+// saved to the store set with WithPersistence
+func ProgressSaveInterval(interval time.Duration) Option {
+	return func(gs *graphsyncConfigOptions) {
+		gs.progressSaveInterval = interval
+	}
+}
+
 // New creates a new GraphSync Exchange on the given network,
 // and the given link loader+storer.
 func New(parent context.Context, network gsnet.GraphSyncNetwork,
@@ -211,66 +731,159 @@ func New(parent context.Context, network gsnet.GraphSyncNetwork,
 		maxMemoryPerPeerResponder:     defaultMaxMemoryPerPeer,
 		maxInProgressIncomingRequests: defaultMaxInProgressRequests,
 		maxInProgressOutgoingRequests: defaultMaxInProgressRequests,
+		responseLoadConcurrency:       defaultResponseLoadConcurrency,
 		registerDefaultValidator:      true,
 		messageSendRetries:            defaultMessageSendRetries,
 		sendMessageTimeout:            defaultSendMessageTimeout,
+		asyncValidationTimeout:        defaultAsyncValidationTimeout,
+		progressSaveInterval:          defaultProgressSaveInterval,
+		maxSelectorProposals:          requestmanager.DefaultMaxSelectorProposals,
 		panicCallback:                 nil,
+		tombstoneOptions: graphsync.TombstoneOptions{
+			MaxCount:               requestmanager.DefaultMaxTombstones,
+			MaxAge:                 defaultRequestTombstoneMaxAge,
+			MaxLateMessagesPerPeer: defaultMaxLateMessagesPerPeer,
+		},
+		limitHitInterval:     defaultLimitHitInterval,
+		peerActivityDebounce: defaultPeerActivityDebounce,
+		maxReceivedBlockSize: defaultMaxReceivedBlockSize,
+		supportedExtensions:  graphsync.KnownExtensions(),
 	}
 	for _, option := range options {
 		option(gsConfig)
 	}
-	incomingResponseHooks := requestorhooks.NewResponseHooks()
-	outgoingRequestHooks := requestorhooks.NewRequestHooks()
-	incomingBlockHooks := requestorhooks.NewBlockHooks()
+	if gsConfig.transport != nil {
+		network = gsnet.NewFromTransport(gsConfig.transport, gsConfig.panicCallback, gsConfig.maxMessageSize)
+	} else if gsConfig.maxMessageSize > 0 {
+		if limiter, ok := network.(gsnet.MessageSizeLimiter); ok {
+			limiter.SetMaxMessageSize(gsConfig.maxMessageSize)
+		} else {
+			log.Warnw("network does not support MaxMessageSize, only responses are split to fit", "max message size", gsConfig.maxMessageSize)
+		}
+	}
+	hookOptions := []hookset.Option{hookset.WithPanicCallback(gsConfig.panicCallback)}
+	if gsConfig.hookExecutionObserver != nil {
+		hookOptions = append(hookOptions, hookset.WithExecutionObserver(gsConfig.hookExecutionObserver))
+	}
+	incomingResponseHooks := requestorhooks.NewResponseHooks(hookOptions...)
+	outgoingRequestHooks := requestorhooks.NewRequestHooks(hookOptions...)
+	incomingBlockHooks := requestorhooks.NewBlockHooks(hookOptions...)
+	if gsConfig.verifyBlocks {
+		// registered before user hooks, so it runs ahead of them
+		incomingBlockHooks.Register(executor.VerifyBlock)
+	}
+	selectorProposalHooks := requestorhooks.NewSelectorProposalHooks(hookOptions...)
 	networkErrorListeners := listeners.NewNetworkErrorListeners()
 	receiverErrorListeners := listeners.NewReceiverNetworkErrorListeners()
 	outgoingRequestProcessingListeners := listeners.NewRequestProcessingListeners()
+	completedResponseHooks := listeners.NewCompletedResponseHooks()
 	incomingRequestProcessingListeners := listeners.NewRequestProcessingListeners()
+	incomingRequestQueuedHooks := listeners.NewRequestQueuedHooks()
 	persistenceOptions := persistenceoptions.New()
-	incomingRequestHooks := responderhooks.NewRequestHooks(persistenceOptions)
-	outgoingBlockHooks := responderhooks.NewBlockHooks()
-	requestUpdatedHooks := responderhooks.NewUpdateHooks()
+	var selectorCache *selectorcache.SelectorCache
+	if gsConfig.selectorCacheSize > 0 {
+		selectorCache = selectorcache.New(gsConfig.selectorCacheSize)
+	}
+	requestHookOptions := []responderhooks.Option{
+		responderhooks.WithExecutionObserver(gsConfig.hookExecutionObserver),
+		responderhooks.WithPanicCallback(gsConfig.panicCallback),
+	}
+	if gsConfig.concurrentIncomingRequestHooks {
+		requestHookOptions = append(requestHookOptions, responderhooks.WithConcurrentExecution())
+	}
+	if gsConfig.registerDefaultValidator {
+		// run after user hooks, so it checks any selector they substitute
+		if selectorCache != nil {
+			requestHookOptions = append(requestHookOptions, responderhooks.WithSelectorValidator(selectorvalidator.CachedSelectorValidator(maxRecursionDepth, selectorCache)))
+		} else {
+			requestHookOptions = append(requestHookOptions, responderhooks.WithSelectorValidator(selectorvalidator.SelectorValidator(maxRecursionDepth)))
+		}
+	}
+	incomingRequestHooks := responderhooks.NewRequestHooks(persistenceOptions, requestHookOptions...)
+	outgoingBlockHooks := responderhooks.NewBlockHooks(hookOptions...)
+	requestUpdatedHooks := responderhooks.NewUpdateHooks(hookOptions...)
+	completingResponseHooks := responderhooks.NewCompletingResponseHooks(hookOptions...)
+	asyncRequestValidators := responderhooks.NewAsyncRequestValidators(hookOptions...)
 	completedResponseListeners := listeners.NewCompletedResponseListeners()
 	requestorCancelledListeners := listeners.NewRequestorCancelledListeners()
 	blockSentListeners := listeners.NewBlockSentListeners()
-	if gsConfig.registerDefaultValidator {
-		incomingRequestHooks.Register(selectorvalidator.SelectorValidator(maxRecursionDepth))
-	}
+	limitHitListeners := listeners.NewLimitHitListeners()
+	negotiationCompleteListeners := listeners.NewNegotiationCompleteListeners()
+	limitRecorder := limits.NewRecorder(gsConfig.limitHitInterval, limitHitListeners)
+	transferStats := transferstats.New()
+	peerActivityListeners := listeners.NewPeerActivityListeners()
+	peerActivity := peeractivity.New(gsConfig.peerActivityDebounce, peerActivityListeners)
+	outgoingRequestCounts := requestcounts.New()
+	outgoingRequestCounts.SetPeerActivity(peerActivity)
+	incomingRequestCounts := requestcounts.New()
+	incomingRequestCounts.SetPeerActivity(peerActivity)
 	responseAllocator := allocator.NewAllocator(gsConfig.totalMaxMemoryResponder, gsConfig.maxMemoryPerPeerResponder)
+	responseAllocator.SetLimitRecorder(limitRecorder)
+	var rateLimiter *ratelimiter.RateLimiter
+	if gsConfig.maxOutgoingBytesPerSecond > 0 || gsConfig.maxOutgoingBytesPerSecondPerPeer > 0 {
+		rateLimiter = ratelimiter.New(gsConfig.maxOutgoingBytesPerSecond, gsConfig.maxOutgoingBytesPerSecondPerPeer)
+		rateLimiter.SetLimitRecorder(limitRecorder)
+	}
 	createMessageQueue := func(ctx context.Context, p peer.ID) peermanager.PeerQueue {
-		return messagequeue.New(ctx, p, network, responseAllocator, gsConfig.messageSendRetries, gsConfig.sendMessageTimeout)
+		messageQueue := messagequeue.New(ctx, p, network, responseAllocator, gsConfig.messageSendRetries, gsConfig.sendMessageTimeout)
+		if gsConfig.maxMessageSize > 0 {
+			messageQueue.SetMaxMessageSize(uint64(gsConfig.maxMessageSize) / 2)
+		}
+		if gsConfig.messageSendDelay > 0 {
+			messageQueue.SetSendDelay(gsConfig.messageSendDelay)
+		}
+		return messageQueue
 	}
-	peerManager := peermanager.NewMessageManager(ctx, createMessageQueue)
+	peerManager := peermanager.NewMessageManager(ctx, createMessageQueue, gsConfig.peerStateTTL)
 
-	requestQueue := taskqueue.NewTaskQueue(ctx)
-	requestManager := requestmanager.New(ctx, persistenceOptions, linkSystem, outgoingRequestHooks, incomingResponseHooks, networkErrorListeners, outgoingRequestProcessingListeners, requestQueue, network.ConnectionManager(), gsConfig.maxLinksPerOutgoingRequest, gsConfig.panicCallback)
-	requestExecutor := executor.NewExecutor(requestManager, incomingBlockHooks)
+	// the default scheduler applies the per peer limit itself, so resumed
+	// requests can skip it. A custom scheduler is held to it by the queue
+	var requestQueueOpts []peertaskqueue.Option
+	requestScheduler := gsConfig.requestScheduler
+	if requestScheduler == nil {
+		requestScheduler = requestmanager.NewPriorityScheduler(gsConfig.maxInProgressOutgoingRequestsPerPeer)
+	} else if gsConfig.maxInProgressOutgoingRequestsPerPeer > 0 {
+		requestQueueOpts = append(requestQueueOpts, peertaskqueue.MaxOutstandingWorkPerPeer(int(gsConfig.maxInProgressOutgoingRequestsPerPeer)))
+	}
+	requestQueue := taskqueue.NewTaskQueue(ctx, requestQueueOpts...)
+	requestQueue.SetLimitRecorder(limitRecorder, graphsync.LimitMaxInProgressOutgoingRequests)
+	requestQueue.SetScheduler(requestScheduler)
+	requestManager := requestmanager.New(ctx, persistenceOptions, linkSystem, outgoingRequestHooks, incomingResponseHooks, selectorProposalHooks, networkErrorListeners, outgoingRequestProcessingListeners, completedResponseHooks, requestQueue, network.ConnectionManager(), gsConfig.maxLinksPerOutgoingRequest, gsConfig.panicCallback, gsConfig.requestBatchWindow, gsConfig.retryOptions, gsConfig.tombstoneOptions, limitRecorder, gsConfig.maxProgressBuffer)
+	requestExecutor := executor.NewExecutor(requestManager, incomingBlockHooks, gsConfig.cidDenylist)
 	responseAssembler := responseassembler.New(ctx, peerManager)
 	var ptqopts []peertaskqueue.Option
 	if gsConfig.maxInProgressIncomingRequestsPerPeer > 0 {
 		ptqopts = append(ptqopts, peertaskqueue.MaxOutstandingWorkPerPeer(int(gsConfig.maxInProgressIncomingRequestsPerPeer)))
 	}
 	responseQueue := taskqueue.NewTaskQueue(ctx, ptqopts...)
+	responseQueue.SetLimitRecorder(limitRecorder, graphsync.LimitMaxInProgressIncomingRequests)
 	responseManager := responsemanager.New(
 		ctx,
 		linkSystem,
 		responseAssembler,
 		incomingRequestProcessingListeners,
+		incomingRequestQueuedHooks,
 		incomingRequestHooks,
 		requestUpdatedHooks,
+		completingResponseHooks,
 		completedResponseListeners,
 		requestorCancelledListeners,
 		blockSentListeners,
 		networkErrorListeners,
 		network.ConnectionManager(),
 		gsConfig.maxLinksPerIncomingRequest,
+		gsConfig.maxRecursionDepthIncomingRequest,
 		gsConfig.panicCallback,
-		responseQueue)
+		responseQueue,
+		selectorCache)
 	queryExecutor := queryexecutor.New(
 		ctx,
 		responseManager,
 		outgoingBlockHooks,
 		requestUpdatedHooks,
+		gsConfig.cidDenylist,
+		limitRecorder,
+		rateLimiter,
 	)
 	graphSync := &GraphSync{
 		network:                            network,
@@ -284,25 +897,96 @@ func New(parent context.Context, network gsnet.GraphSyncNetwork,
 		responseAssembler:                  responseAssembler,
 		peerManager:                        peerManager,
 		incomingRequestProcessingListeners: incomingRequestProcessingListeners,
+		incomingRequestQueuedHooks:         incomingRequestQueuedHooks,
 		outgoingRequestProcessingListeners: outgoingRequestProcessingListeners,
+		completedResponseHooks:             completedResponseHooks,
 		incomingRequestHooks:               incomingRequestHooks,
 		outgoingBlockHooks:                 outgoingBlockHooks,
 		requestUpdatedHooks:                requestUpdatedHooks,
+		completingResponseHooks:            completingResponseHooks,
+		asyncRequestValidators:             asyncRequestValidators,
 		completedResponseListeners:         completedResponseListeners,
 		requestorCancelledListeners:        requestorCancelledListeners,
 		blockSentListeners:                 blockSentListeners,
 		networkErrorListeners:              networkErrorListeners,
 		receiverErrorListeners:             receiverErrorListeners,
 		incomingResponseHooks:              incomingResponseHooks,
+		selectorProposalHooks:              selectorProposalHooks,
 		outgoingRequestHooks:               outgoingRequestHooks,
 		incomingBlockHooks:                 incomingBlockHooks,
 		persistenceOptions:                 persistenceOptions,
+		progressStore:                      gsConfig.progressStore,
 		ctx:                                ctx,
 		cancel:                             cancel,
 		responseAllocator:                  responseAllocator,
+		rateLimiter:                        rateLimiter,
+		limitRecorder:                      limitRecorder,
+		limitHitListeners:                  limitHitListeners,
+		negotiationCompleteListeners:       negotiationCompleteListeners,
+		transferStats:                      transferStats,
+		peerActivityListeners:              peerActivityListeners,
+		outgoingRequestCounts:              outgoingRequestCounts,
+		incomingRequestCounts:              incomingRequestCounts,
+		maxLinksPerOutgoingRequest:         gsConfig.maxLinksPerOutgoingRequest,
+		maxLinksPerIncomingRequest:         gsConfig.maxLinksPerIncomingRequest,
+		maxRecursionDepth:                  gsConfig.maxRecursionDepthIncomingRequest,
+		tombstoneOptions:                   gsConfig.tombstoneOptions,
+		maxOutgoingBytesPerSecond:          gsConfig.maxOutgoingBytesPerSecond,
+		maxOutgoingBytesPerSecondPerPeer:   gsConfig.maxOutgoingBytesPerSecondPerPeer,
+		drainTimeout:                       gsConfig.drainTimeout,
+		blockedPeers:                       make(map[peer.ID]struct{}),
+		totalMaxMemoryResponder:            gsConfig.totalMaxMemoryResponder,
+		maxMemoryPerPeerResponder:          gsConfig.maxMemoryPerPeerResponder,
+		maxInProgressIncomingRequests:      gsConfig.maxInProgressIncomingRequests,
+		maxInProgressOutgoingRequests:      gsConfig.maxInProgressOutgoingRequests,
+		throttle: graphsync.ThrottleStats{
+			Level:                            1.0,
+			MaxInProgressOutgoingRequests:    gsConfig.maxInProgressOutgoingRequests,
+			MaxInProgressIncomingRequests:    gsConfig.maxInProgressIncomingRequests,
+			MaxMemoryResponder:               gsConfig.totalMaxMemoryResponder,
+			MaxMemoryPerPeerResponder:        gsConfig.maxMemoryPerPeerResponder,
+			MaxOutgoingBytesPerSecond:        gsConfig.maxOutgoingBytesPerSecond,
+			MaxOutgoingBytesPerSecondPerPeer: gsConfig.maxOutgoingBytesPerSecondPerPeer,
+		},
 	}
 
+	if gsConfig.metricsRecorder != nil {
+		requestManager.SetMetricsRecorder(gsConfig.metricsRecorder)
+		responseManager.SetMetricsRecorder(gsConfig.metricsRecorder)
+	}
+	if gsConfig.requestIDAllocator != nil {
+		requestManager.SetRequestIDAllocator(gsConfig.requestIDAllocator)
+	}
+	requestManager.SetTransferStats(transferStats)
+	requestManager.SetMaxSelectorProposals(gsConfig.maxSelectorProposals)
+	if gsConfig.strictVerification {
+		requestManager.SetStrictVerification(gsConfig.maxReceivedBlockSize)
+	}
+	requestManager.SetRequestCounts(outgoingRequestCounts)
+	requestManager.SetSupportedExtensions(gsConfig.supportedExtensions, negotiationCompleteListeners)
+	responseManager.SetSupportedExtensions(gsConfig.supportedExtensions)
+	if gsConfig.defaultChooser != nil {
+		requestManager.SetDefaultChooser(gsConfig.defaultChooser)
+		responseManager.SetDefaultChooser(gsConfig.defaultChooser)
+	}
+	if gsConfig.progressStore != nil {
+		requestManager.SetProgressStore(gsConfig.progressStore, gsConfig.progressSaveInterval)
+	}
+	if gsConfig.blockCompression != nil {
+		compression.Register(gsConfig.blockCompression)
+		requestManager.SetBlockCompression(gsConfig.blockCompression)
+		responseManager.SetBlockCompression(gsConfig.blockCompression)
+	}
+	responseManager.SetTransferStats(transferStats)
+	responseManager.SetRequestCounts(incomingRequestCounts)
+	responseManager.SetLoadConcurrency(gsConfig.responseLoadConcurrency)
+	responseManager.SetAsyncValidators(asyncRequestValidators, gsConfig.asyncValidationTimeout)
+	if gsConfig.rejectIncomingRequestsOverPeerLimit {
+		responseManager.SetMaxInProgressPerPeer(gsConfig.maxInProgressIncomingRequestsPerPeer)
+	}
+	graphSync.trackTransfers(transferStats)
 	requestManager.SetDelegate(peerManager)
+	peerManager.SetEvictionListener(graphSync.peerStateEvicted)
 	requestManager.Startup()
 	requestQueue.Startup(gsConfig.maxInProgressOutgoingRequests, requestExecutor)
 	responseManager.Startup()
@@ -312,8 +996,74 @@ func New(parent context.Context, network gsnet.GraphSyncNetwork,
 	return graphSync
 }
 
+// peerStateEvicted evicts the rest of the state kept for a peer once its
+// message queue is evicted for being idle. The extensions a requestor reported
+// to this node as responder are kept, since the requestor does not list them
+// again until it forgets this node's list itself
+func (gs *GraphSync) peerStateEvicted(p peer.ID) {
+	gs.requestManager.PeerEvicted(p)
+	gs.rateLimiter.ForgetPeer(p)
+	gs.transferStats.ForgetPeer(p)
+	gs.outgoingRequestCounts.ForgetPeer(p)
+	gs.incomingRequestCounts.ForgetPeer(p)
+}
+
 // Request initiates a new GraphSync request to the given peer using the given selector spec.
 func (gs *GraphSync) Request(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
+	if gs.isClosed() {
+		responseChan := make(chan graphsync.ResponseProgress)
+		close(responseChan)
+		return responseChan, closedErrorChan()
+	}
+	if resume, _ := ctx.Value(graphsync.ResumeFromLocalStoreContextKey{}).(bool); resume {
+		var err error
+		extensions, err = gs.withLocalResumeState(ctx, root, selector, extensions)
+		if err != nil {
+			responseChan := make(chan graphsync.ResponseProgress)
+			close(responseChan)
+			return responseChan, errorChan(err)
+		}
+	}
+	if retryPeers, ok := ctx.Value(graphsync.RetryPeersContextKey{}).(graphsync.RetryPeers); ok {
+		return gs.requestWithRetryPeers(ctx, p, retryPeers, root, selector, extensions)
+	}
+	return gs.request(ctx, p, root, selector, extensions...)
+}
+
+// RequestCids initiates a new metadata only GraphSync request to the given
+// peer, returning the CIDs of the blocks the peer has for the traversal
+func (gs *GraphSync) RequestCids(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, extensions ...graphsync.ExtensionData) (<-chan cid.Cid, <-chan error) {
+	if gs.isClosed() {
+		cids := make(chan cid.Cid)
+		close(cids)
+		return cids, closedErrorChan()
+	}
+	ctx, _ = otel.Tracer("graphsync").Start(ctx, "requestCids", trace.WithAttributes(
+		attribute.String("peerID", p.Pretty()),
+		attribute.String("root", root.String()),
+	))
+	return gs.requestManager.RequestCids(ctx, p, root, selector, extensions...)
+}
+
+// RequestRawBlocks initiates a new GraphSync request to the given peer, also
+// delivering each block the traversal loads, in traversal order
+func (gs *GraphSync) RequestRawBlocks(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan blocks.Block, <-chan error) {
+	if gs.isClosed() {
+		responseChan := make(chan graphsync.ResponseProgress)
+		close(responseChan)
+		blockChan := make(chan blocks.Block)
+		close(blockChan)
+		return responseChan, blockChan, closedErrorChan()
+	}
+	ctx, _ = otel.Tracer("graphsync").Start(ctx, "requestRawBlocks", trace.WithAttributes(
+		attribute.String("peerID", p.Pretty()),
+		attribute.String("root", root.String()),
+	))
+	return gs.requestManager.RequestRawBlocks(ctx, p, root, selector, extensions...)
+}
+
+// request starts a single request to the given peer, ignoring retry peers
+func (gs *GraphSync) request(ctx context.Context, p peer.ID, root ipld.Link, selector ipld.Node, extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
 	var extNames []string
 	for _, ext := range extensions {
 		extNames = append(extNames, string(ext.Name))
@@ -326,6 +1076,17 @@ func (gs *GraphSync) Request(ctx context.Context, p peer.ID, root ipld.Link, sel
 	return gs.requestManager.NewRequest(ctx, p, root, selector, extensions...)
 }
 
+// RequestMany initiates several GraphSync requests to the given peer at once. Responses and errors
+// from every request are merged into a single pair of channels, tagged with the request they belong to
+func (gs *GraphSync) RequestMany(ctx context.Context, p peer.ID, roots []graphsync.RootSelector, extensions ...graphsync.ExtensionData) (<-chan graphsync.SubRequestProgress, <-chan error) {
+	if gs.isClosed() {
+		responseChan := make(chan graphsync.SubRequestProgress)
+		close(responseChan)
+		return responseChan, closedErrorChan()
+	}
+	return gs.requestManager.RequestMany(ctx, p, roots, extensions...)
+}
+
 // RegisterIncomingRequestHook adds a hook that runs when a request is received
 // If overrideDefaultValidation is set to true, then if the hook does not error,
 // it is considered to have "validated" the request -- and that validation supersedes
@@ -334,22 +1095,61 @@ func (gs *GraphSync) RegisterIncomingRequestHook(hook graphsync.OnIncomingReques
 	return gs.incomingRequestHooks.Register(hook)
 }
 
-// RegisterIncomingRequestQueuedHook adds a hook that runs when a new incoming request is added
-// to the responder's task queue.
+// RegisterAsyncRequestValidator adds a validator that decides whether to
+// accept requests once incoming request hooks accept them. Validators run on
+// their own goroutine, so they may block, for example on a network call, and
+// no blocks are sent for a request until every validator accepts it
+func (gs *GraphSync) RegisterAsyncRequestValidator(validator graphsync.AsyncRequestValidator) graphsync.UnregisterHookFunc {
+	return gs.asyncRequestValidators.Register(validator)
+}
+
+// RegisterIncomingRequestProcessingListener adds a listener that gets called when an incoming request
+// actually begins processing (reaches the top of the responder's task queue)
 func (gs *GraphSync) RegisterIncomingRequestProcessingListener(listener graphsync.OnRequestProcessingListener) graphsync.UnregisterHookFunc {
 	return gs.incomingRequestProcessingListeners.Register(listener)
 }
 
+// RegisterIncomingRequestQueuedHook adds a hook that runs when a new incoming request is added
+// to the responder's task queue.
+func (gs *GraphSync) RegisterIncomingRequestQueuedHook(hook graphsync.OnIncomingRequestQueuedHook) graphsync.UnregisterHookFunc {
+	return gs.incomingRequestQueuedHooks.Register(hook)
+}
+
 // RegisterIncomingResponseHook adds a hook that runs when a response is received
 func (gs *GraphSync) RegisterIncomingResponseHook(hook graphsync.OnIncomingResponseHook) graphsync.UnregisterHookFunc {
 	return gs.incomingResponseHooks.Register(hook)
 }
 
+// RegisterIncomingResponseHookWithFilter adds a hook that runs when a response is received, for
+// only the responses the filter returns true for
+func (gs *GraphSync) RegisterIncomingResponseHookWithFilter(filter graphsync.ResponseHookFilter, hook graphsync.OnIncomingResponseHook) graphsync.UnregisterHookFunc {
+	return gs.incomingResponseHooks.RegisterWithFilter(filter, hook)
+}
+
+// RegisterIncomingExtensionResponseHook adds a hook that runs when a response carrying the
+// named extension is received
+func (gs *GraphSync) RegisterIncomingExtensionResponseHook(name graphsync.ExtensionName, hook graphsync.OnIncomingExtensionResponseHook) graphsync.UnregisterHookFunc {
+	return gs.incomingResponseHooks.RegisterExtensionResponseHook(name, hook)
+}
+
+// RegisterSelectorProposalHook adds a hook that runs when a responder proposes an alternate selector
+// for an outgoing request. A hook may accept the proposal, in which case the request is re-issued
+// with the proposed selector
+func (gs *GraphSync) RegisterSelectorProposalHook(hook graphsync.OnSelectorProposalHook) graphsync.UnregisterHookFunc {
+	return gs.selectorProposalHooks.Register(hook)
+}
+
 // RegisterOutgoingRequestHook adds a hook that runs immediately prior to sending a new request
 func (gs *GraphSync) RegisterOutgoingRequestHook(hook graphsync.OnOutgoingRequestHook) graphsync.UnregisterHookFunc {
 	return gs.outgoingRequestHooks.Register(hook)
 }
 
+// RegisterOutgoingRequestHookWithFilter adds a hook that runs immediately prior to sending a new
+// request, for only the requests the filter returns true for
+func (gs *GraphSync) RegisterOutgoingRequestHookWithFilter(filter graphsync.RequestHookFilter, hook graphsync.OnOutgoingRequestHook) graphsync.UnregisterHookFunc {
+	return gs.outgoingRequestHooks.RegisterWithFilter(filter, hook)
+}
+
 // RegisterPersistenceOption registers an alternate loader/storer combo that can be substituted for the default
 func (gs *GraphSync) RegisterPersistenceOption(name string, lsys ipld.LinkSystem) error {
 	return gs.persistenceOptions.Register(name, lsys)
@@ -370,6 +1170,12 @@ func (gs *GraphSync) RegisterRequestUpdatedHook(hook graphsync.OnRequestUpdatedH
 	return gs.requestUpdatedHooks.Register(hook)
 }
 
+// RegisterCompletingResponseHook registers a hook that runs on the responder
+// when a response ends, and can send extension data with the final status
+func (gs *GraphSync) RegisterCompletingResponseHook(hook graphsync.OnCompletingResponseHook) graphsync.UnregisterHookFunc {
+	return gs.completingResponseHooks.Register(hook)
+}
+
 // RegisterOutgoingRequestProcessingListener adds a listener that gets called when a request actually begins processing (reaches
 // the top of the outgoing request queue)
 func (gs *GraphSync) RegisterOutgoingRequestProcessingListener(listener graphsync.OnRequestProcessingListener) graphsync.UnregisterHookFunc {
@@ -381,6 +1187,12 @@ func (gs *GraphSync) RegisterCompletedResponseListener(listener graphsync.OnResp
 	return gs.completedResponseListeners.Register(listener)
 }
 
+// RegisterCompletedResponseHook adds a hook on the requestor that runs once for
+// each outgoing request when it finishes, with its terminal status
+func (gs *GraphSync) RegisterCompletedResponseHook(hook graphsync.OnCompletedResponseHook) graphsync.UnregisterHookFunc {
+	return gs.completedResponseHooks.Register(hook)
+}
+
 // RegisterIncomingBlockHook adds a hook that runs when a block is received and validated (put in block store)
 func (gs *GraphSync) RegisterIncomingBlockHook(hook graphsync.OnIncomingBlockHook) graphsync.UnregisterHookFunc {
 	return gs.incomingBlockHooks.Register(hook)
@@ -407,6 +1219,24 @@ func (gs *GraphSync) RegisterReceiverNetworkErrorListener(listener graphsync.OnR
 	return gs.receiverErrorListeners.Register(listener)
 }
 
+// RegisterLimitHitListener adds a listener for when a limit is hit for the
+// first time in a reporting interval
+func (gs *GraphSync) RegisterLimitHitListener(listener graphsync.OnLimitHitListener) graphsync.UnregisterHookFunc {
+	return gs.limitHitListeners.Register(listener)
+}
+
+// RegisterNegotiationCompleteListener adds a listener for when a peer reports
+// the extensions it supports
+func (gs *GraphSync) RegisterNegotiationCompleteListener(listener graphsync.OnNegotiationCompleteListener) graphsync.UnregisterHookFunc {
+	return gs.negotiationCompleteListeners.Register(listener)
+}
+
+// RegisterPeerActivityListener adds a listener for when graphsync starts and
+// stops having requests in progress with a peer
+func (gs *GraphSync) RegisterPeerActivityListener(listener graphsync.OnPeerActivityListener) graphsync.UnregisterHookFunc {
+	return gs.peerActivityListeners.Register(listener)
+}
+
 // Pause pauses an in progress request or response
 func (gs *GraphSync) Pause(ctx context.Context, requestID graphsync.RequestID) error {
 	var reqNotFound graphsync.RequestNotFoundErr
@@ -450,12 +1280,174 @@ func (gs *GraphSync) Stats() graphsync.Stats {
 	outgoingRequestStats := gs.requestQueue.Stats()
 	incomingRequestStats := gs.responseQueue.Stats()
 	outgoingResponseStats := gs.responseAllocator.Stats()
+	gs.throttleLk.RLock()
+	throttle := gs.throttle
+	gs.throttleLk.RUnlock()
 
 	return graphsync.Stats{
-		OutgoingRequests:  outgoingRequestStats,
-		IncomingRequests:  incomingRequestStats,
-		OutgoingResponses: outgoingResponseStats,
+		OutgoingRequests:          outgoingRequestStats,
+		CompletedOutgoingRequests: gs.requestManager.TombstoneStats(),
+		OutgoingVerificationTime:  gs.requestManager.VerificationTime(),
+		IncomingRequests:          incomingRequestStats,
+		OutgoingResponses:         outgoingResponseStats,
+		Throttle:                  throttle,
+		Limits:                    gs.LimitsReport(),
+		Transfers:                 gs.transferStats.Total(),
+		OutgoingRequestCounts:     gs.outgoingRequestCounts.Total(),
+		IncomingRequestCounts:     gs.incomingRequestCounts.Total(),
+		Peers:                     gs.peerStats(),
+	}
+}
+
+// peerStats combines the request counts for each peer in both directions
+func (gs *GraphSync) peerStats() map[peer.ID]graphsync.PeerStats {
+	outgoing := gs.outgoingRequestCounts.Peers()
+	incoming := gs.incomingRequestCounts.Peers()
+	peers := make(map[peer.ID]graphsync.PeerStats, len(outgoing)+len(incoming))
+	for p, counts := range outgoing {
+		peers[p] = graphsync.PeerStats{OutgoingRequests: counts}
+	}
+	for p, counts := range incoming {
+		peerStats := peers[p]
+		peerStats.IncomingRequests = counts
+		peers[p] = peerStats
+	}
+	return peers
+}
+
+// PeerRequestCounts counts the requests to and from a peer in each state
+func (gs *GraphSync) PeerRequestCounts(p peer.ID) graphsync.PeerStats {
+	return graphsync.PeerStats{
+		OutgoingRequests: gs.outgoingRequestCounts.Peer(p),
+		IncomingRequests: gs.incomingRequestCounts.Peer(p),
+	}
+}
+
+// CompletedRequests lists the recently completed outgoing requests that are
+// still remembered, in the order they completed
+func (gs *GraphSync) CompletedRequests() []graphsync.RequestTombstone {
+	return gs.requestManager.CompletedRequests()
+}
+
+// InProgressRequests lists the outgoing requests that have not yet completed,
+// in the order they started
+func (gs *GraphSync) InProgressRequests() []graphsync.InProgressRequestInfo {
+	return gs.requestManager.InProgressRequests()
+}
+
+// ExportRequestState returns a checkpoint for each outgoing request that has
+// not yet completed, listing the blocks it already received. The checkpoints
+// can be encoded with the checkpoint package and stored, for example before
+// shutting down, then resumed with ImportRequestState
+func (gs *GraphSync) ExportRequestState() ([]graphsync.RequestCheckpoint, error) {
+	return gs.requestManager.ExportState()
+}
+
+// ImportRequestState re-issues the requests in the given checkpoints, asking
+// each remote peer not to send the blocks already received. Resuming only
+// works if the remote peers are still reachable and the blocks received are
+// still in the local store. Anything in flight when the checkpoints were taken
+// is fetched again
+func (gs *GraphSync) ImportRequestState(ctx context.Context, checkpoints []graphsync.RequestCheckpoint) []graphsync.ResumedRequest {
+	return gs.requestManager.ImportState(ctx, checkpoints)
+}
+
+// InProgressResponses lists the incoming requests that are still being
+// responded to, in the order they arrived
+func (gs *GraphSync) InProgressResponses() []graphsync.InProgressResponseInfo {
+	return gs.responseManager.InProgressResponses()
+}
+
+// LimitsReport lists every active limit with its configured value, current
+// utilization, and how often it has been hit. Limits that are not set are
+// left out
+func (gs *GraphSync) LimitsReport() []graphsync.LimitReport {
+	gs.throttleLk.RLock()
+	throttle := gs.throttle
+	gs.throttleLk.RUnlock()
+	responseStats := gs.responseAllocator.Stats()
+
+	var report []graphsync.LimitReport
+	addLimit := func(name graphsync.LimitName, scope graphsync.LimitScope, configured uint64, utilization uint64) {
+		if configured == 0 {
+			return
+		}
+		hits, lastHit := gs.limitRecorder.Hits(name)
+		report = append(report, graphsync.LimitReport{
+			Name:        name,
+			Scope:       scope,
+			Configured:  configured,
+			Utilization: utilization,
+			Hits:        hits,
+			LastHit:     lastHit,
+		})
+	}
+	addLimit(graphsync.LimitMaxMemoryResponder, graphsync.LimitScopeGlobal, throttle.MaxMemoryResponder, responseStats.TotalAllocatedAllPeers)
+	addLimit(graphsync.LimitMaxMemoryPerPeerResponder, graphsync.LimitScopePeer, throttle.MaxMemoryPerPeerResponder, gs.responseAllocator.LargestPeerAllocation())
+	addLimit(graphsync.LimitMaxInProgressIncomingRequests, graphsync.LimitScopeGlobal, throttle.MaxInProgressIncomingRequests, gs.responseQueue.Stats().Active)
+	addLimit(graphsync.LimitMaxInProgressOutgoingRequests, graphsync.LimitScopeGlobal, throttle.MaxInProgressOutgoingRequests, gs.requestQueue.Stats().Active)
+	addLimit(graphsync.LimitMaxLinksPerIncomingRequests, graphsync.LimitScopeRequest, gs.maxLinksPerIncomingRequest, 0)
+	addLimit(graphsync.LimitMaxLinksPerOutgoingRequests, graphsync.LimitScopeRequest, gs.maxLinksPerOutgoingRequest, 0)
+	if gs.maxRecursionDepth > 0 {
+		addLimit(graphsync.LimitMaxRecursionDepth, graphsync.LimitScopeRequest, uint64(gs.maxRecursionDepth), 0)
+	}
+	maxTombstones := gs.tombstoneOptions.MaxCount
+	if maxTombstones <= 0 {
+		maxTombstones = requestmanager.DefaultMaxTombstones
+	}
+	addLimit(graphsync.LimitMaxRequestTombstones, graphsync.LimitScopeGlobal, uint64(maxTombstones), gs.requestManager.TombstoneStats().Count)
+	if gs.tombstoneOptions.MaxLateMessagesPerPeer > 0 {
+		addLimit(graphsync.LimitMaxLateMessagesPerPeer, graphsync.LimitScopePeer, uint64(gs.tombstoneOptions.MaxLateMessagesPerPeer), 0)
+	}
+	addLimit(graphsync.LimitMaxOutgoingBytesPerSecond, graphsync.LimitScopeGlobal, throttle.MaxOutgoingBytesPerSecond, 0)
+	addLimit(graphsync.LimitMaxOutgoingBytesPerSecondPerPeer, graphsync.LimitScopePeer, throttle.MaxOutgoingBytesPerSecondPerPeer, 0)
+	return report
+}
+
+// SetThrottle scales the configured limits on in progress requests, responder
+// memory and outgoing bandwidth by the given level, between 0 (exclusive) and
+// 1, where 1 restores the configured limits. Levels outside that range are
+// clamped.
+// Changes apply gradually -- in progress requests are never cancelled, but new
+// work is held back until usage falls under the new limits.
+func (gs *GraphSync) SetThrottle(level float64) {
+	if level > 1 || math.IsNaN(level) {
+		level = 1
+	}
+	if level < minThrottleLevel {
+		level = minThrottleLevel
+	}
+	// limits that are set never scale to zero, as a bandwidth limit of zero
+	// would no longer limit anything
+	throttle := graphsync.ThrottleStats{
+		Level:                            level,
+		MaxInProgressOutgoingRequests:    scaleLimit(gs.maxInProgressOutgoingRequests, level, 1),
+		MaxInProgressIncomingRequests:    scaleLimit(gs.maxInProgressIncomingRequests, level, 1),
+		MaxMemoryResponder:               scaleLimit(gs.totalMaxMemoryResponder, level, minThrottledMemory),
+		MaxMemoryPerPeerResponder:        scaleLimit(gs.maxMemoryPerPeerResponder, level, minThrottledMemory),
+		MaxOutgoingBytesPerSecond:        scaleLimit(gs.maxOutgoingBytesPerSecond, level, 1),
+		MaxOutgoingBytesPerSecondPerPeer: scaleLimit(gs.maxOutgoingBytesPerSecondPerPeer, level, 1),
 	}
+	gs.throttleLk.Lock()
+	defer gs.throttleLk.Unlock()
+	gs.throttle = throttle
+	gs.requestQueue.SetWorkerLimit(throttle.MaxInProgressOutgoingRequests)
+	gs.responseQueue.SetWorkerLimit(throttle.MaxInProgressIncomingRequests)
+	gs.responseAllocator.SetLimits(throttle.MaxMemoryResponder, throttle.MaxMemoryPerPeerResponder)
+	gs.rateLimiter.SetLimits(throttle.MaxOutgoingBytesPerSecond, throttle.MaxOutgoingBytesPerSecondPerPeer)
+}
+
+// scaleLimit scales a configured limit by the throttle level, never going
+// below the given floor unless the configured limit is already lower
+func scaleLimit(limit uint64, level float64, floor uint64) uint64 {
+	scaled := uint64(math.Round(float64(limit) * level))
+	if scaled < floor {
+		if limit < floor {
+			return limit
+		}
+		return floor
+	}
+	return scaled
 }
 
 // PeerState describes the state of graphsync for a given peer
@@ -472,6 +1464,87 @@ func (gs *GraphSync) PeerState(p peer.ID) PeerState {
 	}
 }
 
+// SubscribeToRequestEvents returns a feed of lifecycle events (started, paused,
+// resumed, completed, errored) for an outgoing request, and a function to
+// unsubscribe. Requests that have already ended report their terminal event
+// for as long as they are remembered, as bounded by WithTombstoneOptions
+func (gs *GraphSync) SubscribeToRequestEvents(requestID graphsync.RequestID) (<-chan graphsync.RequestEvent, func()) {
+	return gs.requestManager.SubscribeToRequestEvents(requestID)
+}
+
+// Close shuts down the exchange gracefully. New requests fail immediately
+// with ErrGraphsyncClosed, and new incoming requests are rejected. Requests and
+// responses in progress may carry on for up to the drain timeout; after that,
+// requests are cancelled with ErrGraphsyncClosed and responses end with a
+// cancellation status. Close returns once all outstanding messages are sent
+// and all internal processes have stopped. If ctx is cancelled first, Close
+// stops straight away, ending any requests still in progress with
+// ErrGraphsyncClosed, and returns the context's error
+func (gs *GraphSync) Close(ctx context.Context) error {
+	gs.closeOnce.Do(func() {
+		atomic.StoreInt32(&gs.closed, 1)
+		gs.closeErr = gs.drain(ctx)
+		gs.cancel()
+		if gs.closeErr != nil {
+			return
+		}
+		for _, stopped := range []<-chan struct{}{gs.requestManager.Stopped(), gs.responseManager.Stopped()} {
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				gs.closeErr = ctx.Err()
+				return
+			}
+		}
+	})
+	return gs.closeErr
+}
+
+// drain lets in progress requests and responses finish for up to the drain
+// timeout, then ends the rest and sends any messages still queued for peers
+func (gs *GraphSync) drain(ctx context.Context) error {
+	if gs.drainTimeout > 0 {
+		drainCtx, cancel := context.WithTimeout(ctx, gs.drainTimeout)
+		defer cancel()
+		// requests and responses drain at the same time, so both stop taking
+		// new work straight away. Whatever is still in progress when the drain
+		// timeout expires is cancelled below
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_ = gs.requestManager.Drain(drainCtx, graphsync.ErrGraphsyncClosed)
+		}()
+		go func() {
+			defer wg.Done()
+			_ = gs.responseManager.Drain(drainCtx)
+		}()
+		wg.Wait()
+	}
+	if err := gs.requestManager.CancelAllRequests(ctx, graphsync.ErrGraphsyncClosed); err != nil {
+		return err
+	}
+	if err := gs.responseManager.CancelAllResponses(ctx); err != nil {
+		return err
+	}
+	return gs.peerManager.Drain(ctx)
+}
+
+func (gs *GraphSync) isClosed() bool {
+	return atomic.LoadInt32(&gs.closed) != 0
+}
+
+func closedErrorChan() <-chan error {
+	return errorChan(graphsync.ErrGraphsyncClosed)
+}
+
+func errorChan(err error) <-chan error {
+	errChan := make(chan error, 1)
+	errChan <- err
+	close(errChan)
+	return errChan
+}
+
 type graphSyncReceiver GraphSync
 
 func (gsr *graphSyncReceiver) graphSync() *GraphSync {
@@ -485,15 +1558,22 @@ func (gsr *graphSyncReceiver) ReceiveMessage(
 	sender peer.ID,
 	incoming gsmsg.GraphSyncMessage) {
 
+	// messages received while closing still reach the managers, which reject
+	// new requests and finish those in progress, and ignore messages once
+	// they have stopped
 	requests := incoming.Requests()
 	responses := incoming.Responses()
 	blocks := incoming.Blocks()
 
 	if len(requests) > 0 {
-		gsr.graphSync().responseManager.ProcessRequests(ctx, sender, requests)
+		if gsr.graphSync().isBlocked(sender) {
+			gsr.graphSync().responseManager.RejectRequests(ctx, sender, requests)
+		} else {
+			gsr.graphSync().responseManager.ProcessRequests(ctx, sender, requests)
+		}
 	}
 	if len(responses) > 0 || len(blocks) > 0 {
-		gsr.graphSync().requestManager.ProcessResponses(sender, responses, blocks)
+		gsr.graphSync().requestManager.ProcessMessage(sender, incoming)
 	}
 }
 
@@ -502,16 +1582,34 @@ func (gsr *graphSyncReceiver) ReceiveMessage(
 func (gsr *graphSyncReceiver) ReceiveError(p peer.ID, err error) {
 	log.Infof("Graphsync ReceiveError from %s: %s", p, err)
 	gsr.receiverErrorListeners.NotifyNetworkErrorListeners(p, err)
+	var malformedErr gsnet.MalformedMessageErr
+	if errors.As(err, &malformedErr) {
+		gsr.graphSync().requestManager.ReceivedMalformedMessage(p, malformedErr.Err)
+	}
 }
 
 // Connected is part of the networks 's Receiver interface and handles peers connecting
 // on the network
 func (gsr *graphSyncReceiver) Connected(p peer.ID) {
+	if gsr.graphSync().isClosed() {
+		return
+	}
 	gsr.graphSync().peerManager.Connected(p)
 }
 
 // Connected is part of the networks 's Receiver interface and handles peers connecting
 // on the network
 func (gsr *graphSyncReceiver) Disconnected(p peer.ID) {
-	gsr.graphSync().peerManager.Disconnected(p)
+	if !gsr.graphSync().peerManager.Disconnected(p) {
+		// other connections to the peer are still open
+		return
+	}
+	gsr.graphSync().requestManager.Disconnected(p)
+	// drop the link tracking of old responses before a new request from the
+	// peer can reuse their IDs
+	gsr.graphSync().responseAssembler.Disconnected(p)
+	gsr.graphSync().responseManager.Disconnected(p)
+	gsr.graphSync().transferStats.ForgetPeer(p)
+	gsr.graphSync().outgoingRequestCounts.ForgetPeer(p)
+	gsr.graphSync().incomingRequestCounts.ForgetPeer(p)
 }
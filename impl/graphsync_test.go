@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -11,6 +12,9 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -35,6 +39,7 @@ import (
 	"github.com/ipld/go-ipld-prime/linking"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
 	"github.com/ipld/go-ipld-prime/traversal/selector"
 	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	"github.com/libp2p/go-libp2p-core/host"
@@ -45,12 +50,15 @@ import (
 
 	"github.com/ipfs/go-graphsync"
 	"github.com/ipfs/go-graphsync/cidset"
+	"github.com/ipfs/go-graphsync/compression"
 	"github.com/ipfs/go-graphsync/donotsendfirstblocks"
 	"github.com/ipfs/go-graphsync/ipldutil"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/metadata"
 	gsnet "github.com/ipfs/go-graphsync/network"
 	"github.com/ipfs/go-graphsync/requestmanager/hooks"
+	"github.com/ipfs/go-graphsync/responsemanager/queryexecutor"
 	"github.com/ipfs/go-graphsync/storeutil"
-	"github.com/ipfs/go-graphsync/taskqueue"
 	"github.com/ipfs/go-graphsync/testutil"
 )
 
@@ -65,6 +73,9 @@ var protocolsForTest = map[string]struct {
 	host2Protocols []protocol.ID
 }{
 	"(v2.0 -> v2.0)": {nil, nil},
+	"(v1.0 -> v1.0)": {[]protocol.ID{gsnet.ProtocolGraphsync_1_0_0}, []protocol.ID{gsnet.ProtocolGraphsync_1_0_0}},
+	"(v2.0 -> v1.0)": {nil, []protocol.ID{gsnet.ProtocolGraphsync_1_0_0}},
+	"(v1.0 -> v2.0)": {[]protocol.ID{gsnet.ProtocolGraphsync_1_0_0}, nil},
 }
 
 func TestRejectRequestsByDefault(t *testing.T) {
@@ -158,10 +169,45 @@ func TestGraphsyncRoundTripRequestBudgetRequestor(t *testing.T) {
 	// has ErrBudgetExceeded exception recorded in the right place
 	tracing.SingleExceptionEvent(t, "request(0)->executeTask(0)", "ErrBudgetExceeded", "traversal budget exceeded", true)
 	if wasCancelled {
-		tracing.SingleExceptionEvent(t, "response(0)->executeTask(0)", "ContextCancelError", ipldutil.ContextCancelError{}.Error(), true)
+		tracing.SingleExceptionEvent(t, "response(0)->executeTask(0)", "errorString", queryexecutor.ErrCancelledByRequestor.Error(), true)
 	}
 }
 
+func TestGraphsyncRoundTripRequestBudgetFromContext(t *testing.T) {
+
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// the budget set for the request overrides the default
+	var linksToTraverse uint64 = 5
+	requestor := td.GraphSyncHost1(MaxLinksPerOutgoingRequests(50))
+
+	// setup receiving peer to just record message coming in
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2()
+	assertCancelOrComplete := assertCancelOrCompleteFunction(responder, 1)
+	requestCtx := context.WithValue(ctx, graphsync.MaxLinksContextKey{}, linksToTraverse)
+	progressChan, errChan := requestor.Request(requestCtx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+
+	blockChain.VerifyResponseRange(ctx, progressChan, 0, int(linksToTraverse))
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	require.Len(t, errs, 1)
+	var budgetErr *traversal.ErrBudgetExceeded
+	require.True(t, errors.As(errs[0], &budgetErr), "should fail with a budget error")
+	require.Equal(t, "link", budgetErr.BudgetKind)
+	require.Len(t, td.blockStore1, int(linksToTraverse), "did not store all blocks")
+
+	drain(requestor)
+	drain(responder)
+	assertCancelOrComplete(ctx, t)
+}
+
 func TestGraphsyncRoundTripRequestBudgetResponder(t *testing.T) {
 	// create network
 	ctx := context.Background()
@@ -209,15 +255,32 @@ func TestGraphsyncRoundTripRequestBudgetResponder(t *testing.T) {
 	tracing.SingleExceptionEvent(t, "request(0)->executeTask(0)", "ContextCancelError", ipldutil.ContextCancelError{}.Error(), false)
 }
 
-func TestGraphsyncRoundTrip(t *testing.T) {
-	for pname, ps := range protocolsForTest {
-		t.Run(pname, func(t *testing.T) {
+func TestGraphsyncRoundTripSelectorBudgetResponder(t *testing.T) {
+	testCases := map[string]struct {
+		option         Option
+		expectedKind   string
+		expectedBlocks int
+	}{
+		"links traversed": {
+			option:       MaxLinksTraversed(5),
+			expectedKind: "link",
+			// response budgets don't include the root block
+			expectedBlocks: 5,
+		},
+		"recursion depth": {
+			option:       MaxRecursionDepth(5),
+			expectedKind: "depth",
+			// the root is at depth zero
+			expectedBlocks: 6,
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
 			// create network
 			ctx := context.Background()
-			ctx, collectTracing := testutil.SetupTracing(ctx)
 			ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 			defer cancel()
-			td := newOptionalGsTestData(ctx, t, ps.host1Protocols, ps.host2Protocols)
+			td := newGsTestData(ctx, t)
 
 			// initialize graphsync on first node to make requests
 			requestor := td.GraphSyncHost1()
@@ -227,165 +290,242 @@ func TestGraphsyncRoundTrip(t *testing.T) {
 			blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
 
 			// initialize graphsync on second node to response to requests
-			responder := td.GraphSyncHost2()
+			responder := td.GraphSyncHost2(data.option)
 			assertComplete := assertCompletionFunction(responder, 1)
+			finalResponseStatusChan := make(chan graphsync.ResponseStatusCode, 1)
+			responder.RegisterCompletedResponseListener(func(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode) {
+				finalResponseStatusChan <- status
+			})
 
-			var receivedResponseData datamodel.Node
-			var receivedRequestData datamodel.Node
+			progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
 
-			requestor.RegisterIncomingResponseHook(
-				func(p peer.ID, responseData graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
-					data, has := responseData.Extension(td.extensionName)
-					if has {
-						receivedResponseData = data
-					}
-				})
+			// blocks sent before the budget ran out are still verified and stored
+			blockChain.VerifyResponseRange(ctx, progressChan, 0, data.expectedBlocks)
+			errs := testutil.CollectErrors(ctx, t, errChan)
+			require.Len(t, errs, 1)
+			var budgetErr graphsync.SelectorBudgetExceededErr
+			require.True(t, errors.As(errs[0], &budgetErr))
+			require.Equal(t, data.expectedKind, budgetErr.Kind)
+			require.Len(t, td.blockStore1, data.expectedBlocks, "did not store expected blocks")
+
+			drain(requestor)
+			drain(responder)
+			assertComplete(ctx, t)
+			var finalResponseStatus graphsync.ResponseStatusCode
+			testutil.AssertReceive(ctx, t, finalResponseStatusChan, &finalResponseStatus, "should receive status")
+			require.Equal(t, graphsync.RequestFailedBudgetExceeded, finalResponseStatus)
+		})
+	}
+}
+
+func TestGraphsyncRoundTripSelectorProposal(t *testing.T) {
+	testCases := map[string]struct {
+		accept bool
+	}{
+		"accepted": {accept: true},
+		"declined": {},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			// create network
+			ctx := context.Background()
+			ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+			defer cancel()
+			td := newGsTestData(ctx, t)
+
+			// initialize graphsync on first node to make requests
+			requestor := td.GraphSyncHost1()
 
+			// setup receiving peer to just record message coming in
+			blockChainLength := 100
+			blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+
+			// only serve the first few blocks of the chain
+			ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+			proposedSelector := ssb.ExploreRecursive(selector.RecursionLimitDepth(5),
+				ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+					efsb.Insert("Parents", ssb.ExploreAll(
+						ssb.ExploreRecursiveEdge()))
+				})).Node()
+
+			// initialize graphsync on second node to response to requests
+			responder := td.GraphSyncHost2()
+			var originalSelector ipld.Node
 			responder.RegisterIncomingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
-				var has bool
-				receivedRequestData, has = requestData.Extension(td.extensionName)
-				if !has {
-					hookActions.TerminateWithError(errors.New("Missing extension"))
-				} else {
-					hookActions.SendExtensionData(td.extensionResponse)
+				if original, ok := requestData.Extension(graphsync.ExtensionSelectorProposalAccepted); ok {
+					originalSelector = original
+					hookActions.ValidateRequest()
+					return
 				}
+				hookActions.ProposeAlternateSelector(proposedSelector, "chain too long")
 			})
-
-			finalResponseStatusChan := make(chan graphsync.ResponseStatusCode, 1)
-			responder.RegisterCompletedResponseListener(func(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode) {
-				select {
-				case finalResponseStatusChan <- status:
-				default:
+			var proposals []graphsync.SelectorProposal
+			requestor.RegisterSelectorProposalHook(func(p peer.ID, request graphsync.RequestData, proposal graphsync.SelectorProposal, hookActions graphsync.SelectorProposalHookActions) {
+				proposals = append(proposals, proposal)
+				if data.accept {
+					hookActions.AcceptProposal()
 				}
 			})
-			progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
 
-			blockChain.VerifyWholeChain(ctx, progressChan)
-			testutil.VerifyEmptyErrors(ctx, t, errChan)
-			require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+			progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
 
-			// verify extension roundtrip
-			require.Equal(t, td.extensionData, receivedRequestData, "did not receive correct extension request data")
-			require.Equal(t, td.extensionResponseData, receivedResponseData, "did not receive correct extension response data")
+			if !data.accept {
+				testutil.VerifyEmptyResponse(ctx, t, progressChan)
+				errs := testutil.CollectErrors(ctx, t, errChan)
+				require.Len(t, errs, 1)
+				var declinedErr graphsync.SelectorProposalDeclinedErr
+				require.True(t, errors.As(errs[0], &declinedErr))
+				require.Equal(t, "chain too long", declinedErr.Proposal.Reason)
+				require.Empty(t, td.blockStore1)
+				require.Len(t, proposals, 1)
+				return
+			}
 
-			// verify listener
-			var finalResponseStatus graphsync.ResponseStatusCode
-			testutil.AssertReceive(ctx, t, finalResponseStatusChan, &finalResponseStatus, "should receive status")
-			require.Equal(t, graphsync.RequestCompletedFull, finalResponseStatus)
+			// the traversal is verified against the proposed selector
+			responses := testutil.CollectResponses(ctx, t, progressChan)
+			testutil.VerifyEmptyErrors(ctx, t, errChan)
+			require.Len(t, proposals, 1)
+			require.Equal(t, "chain too long", proposals[0].Reason)
+			require.True(t, ipld.DeepEqual(blockChain.Selector(), originalSelector))
+			blockChain.VerifyResponseRangeSync(responses, 0, 5)
+			require.Len(t, td.blockStore1, 5, "did not store expected blocks")
 
 			drain(requestor)
 			drain(responder)
-			assertComplete(ctx, t)
+		})
+	}
+}
 
-			tracing := collectTracing(t)
+func TestGraphsyncRoundTripRemoteError(t *testing.T) {
+	notFound := graphsync.NewRemoteError(404, "not found")
+	rateLimited := graphsync.NewRemoteError(429, "rate limited").WithPayload(basicnode.NewInt(30))
+	testCases := map[string]struct {
+		requestHookErr error
+		blockHookErr   error
+		expectedRemote *graphsync.RemoteError
+		expectedStatus error
+		blocksReceived int
+	}{
+		"request hook": {
+			requestHookErr: notFound,
+			expectedRemote: &notFound,
+			expectedStatus: graphsync.RequestFailedUnknownErr{},
+		},
+		"block hook": {
+			blockHookErr:   fmt.Errorf("throttled: %w", rateLimited),
+			expectedRemote: &rateLimited,
+			expectedStatus: graphsync.RequestFailedUnknownErr{},
+			blocksReceived: 5,
+		},
+		"block hook plain error": {
+			blockHookErr:   errors.New("something went wrong"),
+			expectedStatus: graphsync.RequestFailedUnknownErr{},
+			blocksReceived: 5,
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			// create network
+			ctx := context.Background()
+			ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+			defer cancel()
+			td := newGsTestData(ctx, t)
 
-			traceStrings := tracing.TracesToStrings()
-			require.Contains(t, traceStrings, "response(0)->executeTask(0)->processBlock(0)->loadBlock(0)")
-			require.Contains(t, traceStrings, "response(0)->executeTask(0)->processBlock(0)->sendBlock(0)->processBlockHooks(0)")
-			require.Contains(t, traceStrings, "request(0)->newRequest(0)")
-			require.Contains(t, traceStrings, "request(0)->executeTask(0)")
-			require.Contains(t, traceStrings, "request(0)->terminateRequest(0)")
-			require.Contains(t, traceStrings, "processResponses(0)")        // should have one of these per response
-			require.Contains(t, traceStrings, "request(0)->verifyBlock(0)") // should have one of these per block
+			// initialize graphsync on first node to make requests
+			requestor := td.GraphSyncHost1()
 
-			processUpdateSpan := tracing.FindSpanByTraceString("response(0)")
-			require.Equal(t, int64(0), testutil.AttributeValueInTraceSpan(t, *processUpdateSpan, "priority").AsInt64())
-			require.Equal(t, []string{string(td.extensionName)}, testutil.AttributeValueInTraceSpan(t, *processUpdateSpan, "extensions").AsStringSlice())
+			// setup receiving peer to just record message coming in
+			blockChainLength := 100
+			blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
 
-			// each verifyBlock span should link to a cacheProcess span that stored it
+			// initialize graphsync on second node to response to requests
+			responder := td.GraphSyncHost2()
+			responder.RegisterIncomingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+				if data.requestHookErr != nil {
+					hookActions.TerminateWithError(data.requestHookErr)
+					return
+				}
+				hookActions.ValidateRequest()
+			})
+			var blocksSent int
+			responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+				blocksSent++
+				if data.blockHookErr != nil && blocksSent == data.blocksReceived {
+					hookActions.TerminateWithError(data.blockHookErr)
+				}
+			})
 
-			processResponsesSpans := tracing.FindSpans("processResponses")
-			processResponsesLinks := make(map[string]int64)
-			verifyBlockSpans := tracing.FindSpans("verifyBlock")
+			progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
 
-			for _, verifyBlockSpan := range verifyBlockSpans {
-				require.Len(t, verifyBlockSpan.Links, 1, "verifyBlock span should have one link")
-				found := false
-				for _, prcessResponseSpan := range processResponsesSpans {
-					sid := prcessResponseSpan.SpanContext.SpanID().String()
-					if verifyBlockSpan.Links[0].SpanContext.SpanID().String() == sid {
-						found = true
-						processResponsesLinks[sid] = processResponsesLinks[sid] + 1
-						break
-					}
+			responses := testutil.CollectResponses(ctx, t, progressChan)
+			errs := testutil.CollectErrors(ctx, t, errChan)
+			require.Len(t, errs, 1)
+			require.True(t, errors.Is(errs[0], data.expectedStatus))
+			var remoteErr graphsync.RemoteError
+			if data.expectedRemote == nil {
+				require.False(t, errors.As(errs[0], &remoteErr))
+			} else {
+				require.True(t, errors.As(errs[0], &remoteErr))
+				require.Equal(t, data.expectedRemote.Code(), remoteErr.Code())
+				require.Equal(t, data.expectedRemote.Message(), remoteErr.Message())
+				if data.expectedRemote.Payload() == nil {
+					require.Nil(t, remoteErr.Payload())
+				} else {
+					require.True(t, ipld.DeepEqual(data.expectedRemote.Payload(), remoteErr.Payload()))
 				}
-				require.True(t, found, "verifyBlock should link to a known cacheProcess span")
 			}
+			blockChain.VerifyResponseRangeSync(responses, 0, data.blocksReceived)
 
-			// each cacheProcess span should be linked to one verifyBlock span per block it stored
-
-			for _, processResponseSpan := range processResponsesSpans {
-				blockCount := testutil.AttributeValueInTraceSpan(t, processResponseSpan, "blockCount").AsInt64()
-				require.Equal(t, processResponsesLinks[processResponseSpan.SpanContext.SpanID().String()], blockCount, "cacheProcess span should be linked to one verifyBlock span per block it processed")
-			}
+			drain(requestor)
+			drain(responder)
 		})
 	}
 }
 
-func TestGraphsyncRoundTripHooksOrder(t *testing.T) {
-
+func TestGraphsyncRoundTripDenylistRequestor(t *testing.T) {
 	// create network
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 	td := newGsTestData(ctx, t)
 
-	// initialize graphsync on first node to make requests
-	requestor := td.GraphSyncHost1()
-
 	// setup receiving peer to just record message coming in
 	blockChainLength := 100
 	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
 
+	deniedIndex := 5
+	denied := blockChain.LinkTipIndex(deniedIndex).(cidlink.Link).Cid
+	// initialize graphsync on first node to make requests, refusing a block mid chain
+	requestor := td.GraphSyncHost1(WithCIDDenylist(func(c cid.Cid) bool {
+		return c.Equals(denied)
+	}))
+
 	// initialize graphsync on second node to response to requests
 	responder := td.GraphSyncHost2()
-	hooksCalled := make(chan string, 5)
+	assertCancelOrComplete := assertCancelOrCompleteFunction(responder, 1)
 
-	requestor.RegisterOutgoingRequestHook(func(peer.ID, graphsync.RequestData, graphsync.OutgoingRequestHookActions) {
-		hooksCalled <- "outgoing request started"
-	})
-	requestor.RegisterOutgoingRequestProcessingListener(func(peer.ID, graphsync.RequestData, int) {
-		hooksCalled <- "outgoing request processing"
-	})
-	responder.RegisterCompletedResponseListener(func(peer.ID, graphsync.RequestData, graphsync.ResponseStatusCode) {
-		hooksCalled <- "incoming request complete"
-	})
-	responder.RegisterIncomingRequestHook(func(_ peer.ID, _ graphsync.RequestData, actions graphsync.IncomingRequestHookActions) {
-		hooksCalled <- "incoming request received"
-		actions.ValidateRequest()
-	})
-	responder.RegisterIncomingRequestProcessingListener(func(peer.ID, graphsync.RequestData, int) {
-		hooksCalled <- "incoming request processing"
-	})
 	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
 
-	blockChain.VerifyWholeChain(ctx, progressChan)
-	testutil.VerifyEmptyErrors(ctx, t, errChan)
-	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+	blockChain.VerifyResponseRange(ctx, progressChan, 0, deniedIndex)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	require.Len(t, errs, 1)
+	var denylistErr graphsync.ErrDenylistedCID
+	require.True(t, errors.As(errs[0], &denylistErr))
+	require.Equal(t, denied, denylistErr.Link.(cidlink.Link).Cid)
 
-	var calledHooks []string
-	for i := 0; i < 5; i++ {
-		select {
-		case <-ctx.Done():
-			t.Fatal("did not receive all events")
-		case calledHook := <-hooksCalled:
-			calledHooks = append(calledHooks, calledHook)
-		}
-	}
-	require.Equal(t, []string{
-		"outgoing request started",
-		"outgoing request processing",
-		"incoming request received",
-		"incoming request processing",
-		"incoming request complete",
-	}, calledHooks)
-}
+	// the denylisted block must never reach the store
+	require.Len(t, td.blockStore1, deniedIndex, "did not store expected blocks")
+	_, stored := td.blockStore1[cidlink.Link{Cid: denied}]
+	require.False(t, stored, "stored denylisted block")
 
-func TestGraphsyncRoundTripPartial(t *testing.T) {
+	drain(requestor)
+	drain(responder)
+	assertCancelOrComplete(ctx, t)
+}
 
+func TestGraphsyncRoundTripDenylistResponder(t *testing.T) {
 	// create network
 	ctx := context.Background()
-	ctx, collectTracing := testutil.SetupTracing(ctx)
 	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 	td := newGsTestData(ctx, t)
@@ -393,15 +533,16 @@ func TestGraphsyncRoundTripPartial(t *testing.T) {
 	// initialize graphsync on first node to make requests
 	requestor := td.GraphSyncHost1()
 
-	// setup an IPLD tree and put all but 1 node into the second nodes block store
-	tree := testutil.NewTestIPLDTree()
-	td.blockStore2[tree.LeafAlphaLnk] = tree.LeafAlphaBlock.RawData()
-	td.blockStore2[tree.MiddleMapNodeLnk] = tree.MiddleMapBlock.RawData()
-	td.blockStore2[tree.MiddleListNodeLnk] = tree.MiddleListBlock.RawData()
-	td.blockStore2[tree.RootNodeLnk] = tree.RootBlock.RawData()
+	// setup receiving peer to just record message coming in
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
 
-	// initialize graphsync on second node to response to requests
-	responder := td.GraphSyncHost2()
+	deniedIndex := 5
+	denied := blockChain.LinkTipIndex(deniedIndex).(cidlink.Link).Cid
+	// initialize graphsync on second node to response to requests, refusing a block mid chain
+	responder := td.GraphSyncHost2(WithCIDDenylist(func(c cid.Cid) bool {
+		return c.Equals(denied)
+	}))
 	assertComplete := assertCompletionFunction(responder, 1)
 
 	finalResponseStatusChan := make(chan graphsync.ResponseStatusCode, 1)
@@ -411,23 +552,19 @@ func TestGraphsyncRoundTripPartial(t *testing.T) {
 		default:
 		}
 	})
-	// create a selector to traverse the whole tree
-	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
-	allSelector := ssb.ExploreRecursive(selector.RecursionLimitDepth(10),
-		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
 
-	_, errChan := requestor.Request(ctx, td.host2.ID(), tree.RootNodeLnk, allSelector)
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
 
-	for err := range errChan {
-		// verify the error is received for leaf beta node being missing
-		require.EqualError(t, err, fmt.Sprintf("remote peer is missing block (%s) at path linkedList/2", tree.LeafBetaLnk.String()))
-	}
-	require.Equal(t, tree.LeafAlphaBlock.RawData(), td.blockStore1[tree.LeafAlphaLnk])
-	require.Equal(t, tree.MiddleListBlock.RawData(), td.blockStore1[tree.MiddleListNodeLnk])
-	require.Equal(t, tree.MiddleMapBlock.RawData(), td.blockStore1[tree.MiddleMapNodeLnk])
-	require.Equal(t, tree.RootBlock.RawData(), td.blockStore1[tree.RootNodeLnk])
+	// the responder treats the denylisted block as missing and does not descend past it
+	blockChain.VerifyResponseRange(ctx, progressChan, 0, deniedIndex)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	require.Len(t, errs, 2)
+	var missingErr graphsync.RemoteMissingBlockErr
+	require.True(t, errors.As(errs[0], &missingErr))
+	require.Equal(t, denied, missingErr.Link.(cidlink.Link).Cid)
+	require.ErrorIs(t, errs[1], graphsync.RequestCompletedPartialErr{})
+	require.Len(t, td.blockStore1, deniedIndex, "did not store expected blocks")
 
-	// verify listener
 	var finalResponseStatus graphsync.ResponseStatusCode
 	testutil.AssertReceive(ctx, t, finalResponseStatusChan, &finalResponseStatus, "should receive status")
 	require.Equal(t, graphsync.RequestCompletedPartial, finalResponseStatus)
@@ -435,16 +572,1919 @@ func TestGraphsyncRoundTripPartial(t *testing.T) {
 	drain(requestor)
 	drain(responder)
 	assertComplete(ctx, t)
+}
 
-	tracing := collectTracing(t)
-	traceStrings := tracing.TracesToStrings()
-	require.Contains(t, traceStrings, "response(0)->executeTask(0)->processBlock(0)->loadBlock(0)")
-	require.Contains(t, traceStrings, "response(0)->executeTask(0)->processBlock(0)->sendBlock(0)->processBlockHooks(0)")
-	require.Contains(t, traceStrings, "request(0)->newRequest(0)")
-	require.Contains(t, traceStrings, "request(0)->executeTask(0)")
-	require.Contains(t, traceStrings, "request(0)->terminateRequest(0)")
-	require.Contains(t, traceStrings, "processResponses(0)")        // should have one of these per response
-	require.Contains(t, traceStrings, "request(0)->verifyBlock(0)") // should have one of these per block
+func TestGraphsyncRoundTripMissingBlockMetadata(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// setup responder with a block missing mid chain
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+	missingIndex := 5
+	missing := blockChain.LinkTipIndex(missingIndex)
+	delete(td.blockStore2, missing)
+	responder := td.GraphSyncHost2()
+	assertComplete := assertCompletionFunction(responder, 1)
+
+	// the requestor reads which links the responder reported missing
+	var missingLinks []cid.Cid
+	var missingLinksLk sync.Mutex
+	requestor.RegisterIncomingResponseHook(func(p peer.ID, responseData graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
+		missingLinksLk.Lock()
+		missingLinks = append(missingLinks, metadata.FromLinkMetadata(responseData.Metadata()).Missing()...)
+		missingLinksLk.Unlock()
+	})
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+
+	blockChain.VerifyResponseRange(ctx, progressChan, 0, missingIndex)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	require.Len(t, errs, 2)
+	require.ErrorIs(t, errs[1], graphsync.RequestCompletedPartialErr{})
+	missingLinksLk.Lock()
+	require.Equal(t, []cid.Cid{missing.(cidlink.Link).Cid}, missingLinks)
+	missingLinksLk.Unlock()
+
+	drain(requestor)
+	drain(responder)
+	assertComplete(ctx, t)
+}
+
+func TestGraphsyncRoundTripLoadConcurrency(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// setup responder with a block missing mid chain, loading blocks ahead
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+	missingIndex := 50
+	delete(td.blockStore2, blockChain.LinkTipIndex(missingIndex))
+	responder := td.GraphSyncHost2(ResponseLoadConcurrency(4))
+	assertComplete := assertCompletionFunction(responder, 1)
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+
+	// blocks still arrive in traversal order, up to the missing block
+	blockChain.VerifyResponseRange(ctx, progressChan, 0, missingIndex)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	require.Len(t, errs, 2)
+	require.ErrorIs(t, errs[1], graphsync.RequestCompletedPartialErr{})
+	require.Len(t, td.blockStore1, missingIndex, "did not store expected blocks")
+
+	drain(requestor)
+	drain(responder)
+	assertComplete(ctx, t)
+}
+
+func TestGraphsyncBlockPeer(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// setup receiving peer to just record message coming in
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+
+	// initialize graphsync on second node to response to requests, blocking the requestor
+	responder := td.GraphSyncHost2()
+	var hookCalls int32
+	responder.RegisterIncomingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+		atomic.AddInt32(&hookCalls, 1)
+	})
+	responder.BlockPeer(td.host1.ID())
+
+	// the request is rejected before any request hooks run
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+	testutil.VerifyEmptyResponse(ctx, t, progressChan)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	require.Len(t, errs, 1)
+	require.True(t, errors.Is(errs[0], graphsync.RequestRejectedErr{}))
+	require.Equal(t, int32(0), atomic.LoadInt32(&hookCalls))
+	require.Len(t, td.blockStore1, 0, "should not store any blocks")
+
+	// once unblocked, requests are processed normally
+	responder.UnblockPeer(td.host1.ID())
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.Equal(t, int32(1), atomic.LoadInt32(&hookCalls))
+	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+
+	drain(requestor)
+	drain(responder)
+}
+
+func TestGraphsyncRoundTripPriority(t *testing.T) {
+	testCases := map[string]struct {
+		// priorities the requestor asks for
+		requestedLow, requestedHigh graphsync.Priority
+		// whether the responder sets priorities itself
+		responderOverrides bool
+	}{
+		"requested priority": {
+			requestedLow:  1,
+			requestedHigh: 10,
+		},
+		"priority overridden by responder": {
+			requestedLow:       10,
+			requestedHigh:      1,
+			responderOverrides: true,
+		},
+	}
+	for testCase, data := range testCases {
+		data := data
+		t.Run(testCase, func(t *testing.T) {
+			// create network
+			ctx := context.Background()
+			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			td := newGsTestData(ctx, t)
+			// a slow link keeps blocks in memory while they wait to be sent
+			for _, link := range td.mn.LinksBetweenPeers(td.host1.ID(), td.host2.ID()) {
+				link.SetOptions(mocknet.LinkOptions{Bandwidth: 1000000})
+			}
+
+			// initialize graphsync on first node to make requests
+			requestor := td.GraphSyncHost1()
+
+			// setup two separate chains on the responder
+			blockChainLength := 100
+			lowChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 1000, blockChainLength)
+			highChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 1000, blockChainLength)
+
+			// only one block fits in memory at a time, so the responder must pick
+			// which request's blocks to queue next
+			responder := td.GraphSyncHost2(MaxMemoryPerPeerResponder(1500))
+
+			priorityExtension := graphsync.ExtensionName("priority")
+			requestor.RegisterOutgoingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+				if data, has := requestData.Extension(priorityExtension); has {
+					priority, err := data.AsInt()
+					require.NoError(t, err)
+					hookActions.OverridePriority(graphsync.Priority(priority))
+				}
+			})
+			responder.RegisterIncomingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+				hookActions.ValidateRequest()
+				if !data.responderOverrides {
+					return
+				}
+				if requestData.Root().Equals(highChain.TipLink.(cidlink.Link).Cid) {
+					hookActions.OverridePriority(10)
+				} else {
+					hookActions.OverridePriority(1)
+				}
+			})
+
+			finished := make(chan string, 2)
+			request := func(name string, blockChain *testutil.TestBlockChain, priority graphsync.Priority) {
+				progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), graphsync.ExtensionData{
+					Name: priorityExtension,
+					Data: basicnode.NewInt(int64(priority)),
+				})
+				go func() {
+					blockChain.VerifyWholeChain(ctx, progressChan)
+					testutil.VerifyEmptyErrors(ctx, t, errChan)
+					finished <- name
+				}()
+			}
+			// the low priority request starts first, but should finish last
+			request("low", lowChain, data.requestedLow)
+			request("high", highChain, data.requestedHigh)
+
+			var first, second string
+			testutil.AssertReceive(ctx, t, finished, &first, "should finish first request")
+			testutil.AssertReceive(ctx, t, finished, &second, "should finish second request")
+			require.Equal(t, "high", first)
+			require.Equal(t, "low", second)
+
+			drain(requestor)
+			drain(responder)
+		})
+	}
+}
+
+func TestGraphsyncThrottle(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// setup a separate chain for each request, so that no request can be
+	// satisfied from blocks the requestor already has
+	requestCount := 8
+	blockChainLength := 20
+	blockChains := make([]*testutil.TestBlockChain, 0, 2*requestCount)
+	for i := 0; i < 2*requestCount; i++ {
+		blockChains = append(blockChains, testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength))
+	}
+
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2(
+		MaxInProgressIncomingRequests(4),
+		MaxOutgoingBytesPerSecond(1<<20),
+		MaxOutgoingBytesPerSecondPerPeer(1<<19),
+	)
+
+	stats := responder.Stats()
+	require.Equal(t, graphsync.ThrottleStats{
+		Level:                            1.0,
+		MaxInProgressOutgoingRequests:    defaultMaxInProgressRequests,
+		MaxInProgressIncomingRequests:    4,
+		MaxMemoryResponder:               defaultTotalMaxMemory,
+		MaxMemoryPerPeerResponder:        defaultMaxMemoryPerPeer,
+		MaxOutgoingBytesPerSecond:        1 << 20,
+		MaxOutgoingBytesPerSecondPerPeer: 1 << 19,
+	}, stats.Throttle)
+
+	runRequests := func(blockChains []*testutil.TestBlockChain) {
+		var wg sync.WaitGroup
+		for _, blockChain := range blockChains {
+			progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_ = testutil.CollectResponses(ctx, t, progressChan)
+				testutil.VerifyEmptyErrors(ctx, t, errChan)
+			}()
+		}
+		wg.Wait()
+	}
+
+	runRequests(blockChains[:requestCount])
+
+	// throttling scales every limit, and the limits report shows the values in
+	// effect
+	responder.SetThrottle(0.5)
+	stats = responder.Stats()
+	require.Equal(t, graphsync.ThrottleStats{
+		Level:                            0.5,
+		MaxInProgressOutgoingRequests:    defaultMaxInProgressRequests / 2,
+		MaxInProgressIncomingRequests:    2,
+		MaxMemoryResponder:               defaultTotalMaxMemory / 2,
+		MaxMemoryPerPeerResponder:        defaultMaxMemoryPerPeer / 2,
+		MaxOutgoingBytesPerSecond:        1 << 19,
+		MaxOutgoingBytesPerSecondPerPeer: 1 << 18,
+	}, stats.Throttle)
+	configured := make(map[graphsync.LimitName]uint64)
+	for _, limit := range responder.(*GraphSync).LimitsReport() {
+		configured[limit.Name] = limit.Configured
+	}
+	require.Equal(t, uint64(2), configured[graphsync.LimitMaxInProgressIncomingRequests])
+	require.Equal(t, uint64(defaultTotalMaxMemory/2), configured[graphsync.LimitMaxMemoryResponder])
+	require.Equal(t, uint64(1<<19), configured[graphsync.LimitMaxOutgoingBytesPerSecond])
+	require.Equal(t, uint64(1<<18), configured[graphsync.LimitMaxOutgoingBytesPerSecondPerPeer])
+
+	// requests still complete under the lower limits
+	runRequests(blockChains[requestCount:])
+
+	// the level is clamped, but limits never scale to zero
+	responder.SetThrottle(0)
+	stats = responder.Stats()
+	require.Equal(t, minThrottleLevel, stats.Throttle.Level)
+	require.Equal(t, uint64(1), stats.Throttle.MaxInProgressIncomingRequests)
+	require.Equal(t, uint64(10486), stats.Throttle.MaxOutgoingBytesPerSecond)
+
+	// restoring the throttle restores the configured limits
+	responder.SetThrottle(1.0)
+	stats = responder.Stats()
+	require.Equal(t, uint64(4), stats.Throttle.MaxInProgressIncomingRequests)
+	require.Equal(t, uint64(1<<20), stats.Throttle.MaxOutgoingBytesPerSecond)
+	require.Equal(t, uint64(1<<19), stats.Throttle.MaxOutgoingBytesPerSecondPerPeer)
+
+	drain(requestor)
+	drain(responder)
+}
+
+func TestGraphsyncLimitsReportRequestor(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	var linksToTraverse uint64 = 5
+	requestor := td.GraphSyncHost1(
+		MaxInProgressOutgoingRequests(1),
+		MaxLinksPerOutgoingRequests(linksToTraverse),
+		WithTombstoneOptions(graphsync.TombstoneOptions{MaxCount: 1}),
+	)
+	limitHits := make(chan graphsync.LimitHitEvent, 10)
+	requestor.RegisterLimitHitListener(func(event graphsync.LimitHitEvent) {
+		limitHits <- event
+	})
+
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+	blockChain2 := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+
+	// initialize graphsync on second node to response to requests, holding the
+	// first response until the second request is queued
+	responder := td.GraphSyncHost2()
+	release := make(chan struct{})
+	var blocksSent int32
+	responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		if atomic.AddInt32(&blocksSent, 1) == 2 {
+			<-release
+		}
+	})
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+	blockChain.VerifyResponseRange(ctx, progressChan, 0, 1)
+	progressChan2, errChan2 := requestor.Request(ctx, td.host2.ID(), blockChain2.TipLink, blockChain2.Selector(), td.extension)
+	close(release)
+
+	blockChain.VerifyResponseRange(ctx, progressChan, 1, int(linksToTraverse))
+	testutil.VerifySingleTerminalError(ctx, t, errChan)
+	blockChain2.VerifyResponseRange(ctx, progressChan2, 0, int(linksToTraverse))
+	testutil.VerifySingleTerminalError(ctx, t, errChan2)
+	drain(requestor)
+
+	report := make(map[graphsync.LimitName]graphsync.LimitReport)
+	for _, limit := range requestor.LimitsReport() {
+		report[limit.Name] = limit
+	}
+	outgoing := report[graphsync.LimitMaxInProgressOutgoingRequests]
+	require.Equal(t, graphsync.LimitScopeGlobal, outgoing.Scope)
+	require.Equal(t, uint64(1), outgoing.Configured)
+	require.Equal(t, uint64(1), outgoing.Hits)
+	require.False(t, outgoing.LastHit.IsZero())
+	links := report[graphsync.LimitMaxLinksPerOutgoingRequests]
+	require.Equal(t, graphsync.LimitScopeRequest, links.Scope)
+	require.Equal(t, linksToTraverse, links.Configured)
+	require.Equal(t, uint64(2), links.Hits)
+	tombstones := report[graphsync.LimitMaxRequestTombstones]
+	require.Equal(t, uint64(1), tombstones.Configured)
+	require.Equal(t, uint64(1), tombstones.Utilization)
+	require.Equal(t, uint64(1), tombstones.Hits)
+	require.Equal(t, uint64(0), report[graphsync.LimitMaxMemoryResponder].Hits)
+	require.Equal(t, requestor.LimitsReport(), requestor.Stats().Limits)
+
+	// listeners hear about the first hit on each limit
+	notified := make(map[graphsync.LimitName]bool)
+	for len(notified) < 3 {
+		var event graphsync.LimitHitEvent
+		testutil.AssertReceive(ctx, t, limitHits, &event, "should notify limit hits")
+		require.False(t, notified[event.Name], "should notify once per interval")
+		notified[event.Name] = true
+	}
+	require.True(t, notified[graphsync.LimitMaxInProgressOutgoingRequests])
+	require.True(t, notified[graphsync.LimitMaxLinksPerOutgoingRequests])
+	require.True(t, notified[graphsync.LimitMaxRequestTombstones])
+}
+
+func TestGraphsyncLimitsReportResponder(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+	blockChain2 := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+
+	// initialize graphsync on second node to response to requests, holding the
+	// first response until the second request is queued
+	responder := td.GraphSyncHost2(
+		MaxInProgressIncomingRequests(1),
+		MaxMemoryResponder(1000),
+		MaxMemoryPerPeerResponder(1000),
+	)
+	release := make(chan struct{})
+	var blocksSent int32
+	responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		if atomic.AddInt32(&blocksSent, 1) == 2 {
+			<-release
+		}
+	})
+	var queued int32
+	responder.RegisterIncomingRequestQueuedHook(func(p peer.ID, request graphsync.RequestData) {
+		if atomic.AddInt32(&queued, 1) == 2 {
+			close(release)
+		}
+	})
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+	blockChain.VerifyResponseRange(ctx, progressChan, 0, 1)
+	progressChan2, errChan2 := requestor.Request(ctx, td.host2.ID(), blockChain2.TipLink, blockChain2.Selector(), td.extension)
+
+	blockChain.VerifyRemainder(ctx, progressChan, 1)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	blockChain2.VerifyWholeChain(ctx, progressChan2)
+	testutil.VerifyEmptyErrors(ctx, t, errChan2)
+	drain(responder)
+
+	report := make(map[graphsync.LimitName]graphsync.LimitReport)
+	for _, limit := range responder.LimitsReport() {
+		report[limit.Name] = limit
+	}
+	incoming := report[graphsync.LimitMaxInProgressIncomingRequests]
+	require.Equal(t, graphsync.LimitScopeGlobal, incoming.Scope)
+	require.Equal(t, uint64(1), incoming.Configured)
+	require.Equal(t, uint64(1), incoming.Hits)
+	memory := report[graphsync.LimitMaxMemoryResponder]
+	require.Equal(t, uint64(1000), memory.Configured)
+	require.NotZero(t, memory.Hits)
+	memoryPerPeer := report[graphsync.LimitMaxMemoryPerPeerResponder]
+	require.Equal(t, graphsync.LimitScopePeer, memoryPerPeer.Scope)
+	require.NotZero(t, memoryPerPeer.Hits)
+	require.Equal(t, uint64(0), report[graphsync.LimitMaxInProgressOutgoingRequests].Hits)
+	_, ok := report[graphsync.LimitMaxLinksPerIncomingRequests]
+	require.False(t, ok, "should leave out limits that are not set")
+}
+
+// What this test does:
+// - Several requests for chains of blocks are served at once over a slow
+// network, with a memory ceiling far below the size of the chains, and one of
+// the requests is cancelled part way through
+// - Verify the memory allocated for queued blocks never goes over the
+// ceiling, and all of it is released once the responses finish
+func TestGraphsyncResponderMemoryCeiling(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+	td.mn.SetLinkDefaults(mocknet.LinkOptions{Latency: 20 * time.Millisecond, Bandwidth: 3000000})
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	blockSize := 1000
+	blockChainLength := 50
+	blockChains := make([]*testutil.TestBlockChain, 0, 3)
+	for i := 0; i < 3; i++ {
+		blockChains = append(blockChains, testutil.SetupBlockChain(ctx, t, td.persistence2, uint64(blockSize), blockChainLength))
+	}
+
+	// initialize graphsync on second node to response to requests, with room
+	// for only a few blocks at a time
+	maxMemory := uint64(3 * blockSize)
+	responder := td.GraphSyncHost2(
+		MaxMemoryResponder(maxMemory),
+		MaxMemoryPerPeerResponder(maxMemory),
+	)
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChains[0].TipLink, blockChains[0].Selector())
+	progressChan2, errChan2 := requestor.Request(ctx, td.host2.ID(), blockChains[1].TipLink, blockChains[1].Selector())
+	cancelCtx, cancelRequest := context.WithCancel(ctx)
+	defer cancelRequest()
+	progressChan3, errChan3 := requestor.Request(cancelCtx, td.host2.ID(), blockChains[2].TipLink, blockChains[2].Selector())
+
+	blockChains[2].VerifyResponseRange(ctx, progressChan3, 0, 5)
+	cancelRequest()
+	blockChains[0].VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	blockChains[1].VerifyWholeChain(ctx, progressChan2)
+	testutil.VerifyEmptyErrors(ctx, t, errChan2)
+	testutil.CollectResponses(ctx, t, progressChan3)
+	testutil.VerifyHasErrors(ctx, t, errChan3)
+	drain(responder)
+
+	require.Eventually(t, func() bool {
+		stats := responder.Stats().OutgoingResponses
+		return stats.TotalAllocatedAllPeers == 0 && stats.TotalPendingAllocations == 0
+	}, 2*time.Second, 10*time.Millisecond, "memory should be released once responses finish")
+	stats := responder.Stats().OutgoingResponses
+	require.LessOrEqual(t, stats.PeakAllocatedAllPeers, maxMemory)
+	require.GreaterOrEqual(t, stats.PeakAllocatedAllPeers, uint64(blockSize))
+	for _, limit := range responder.LimitsReport() {
+		if limit.Name == graphsync.LimitMaxMemoryResponder {
+			require.NotZero(t, limit.Hits, "responses should have waited on memory")
+		}
+	}
+}
+
+func TestMetricsRecorder(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestorMetrics := &testMetricsRecorder{}
+	requestor := td.GraphSyncHost1(WithMetricsRecorder(requestorMetrics))
+
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+	chainBytes := uint64(0)
+	for _, blk := range blockChain.AllBlocks() {
+		chainBytes += uint64(len(blk.RawData()))
+	}
+
+	responderMetrics := &testMetricsRecorder{}
+	responder := td.GraphSyncHost2(WithMetricsRecorder(responderMetrics))
+	assertComplete := assertCompletionFunction(responder, 1)
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	assertComplete(ctx, t)
+
+	requestorSnapshot := requestorMetrics.snapshot()
+	require.Equal(t, uint64(1), requestorSnapshot.outgoingQueued)
+	require.Equal(t, uint64(1), requestorSnapshot.outgoingStarted)
+	require.Equal(t, chainBytes, requestorSnapshot.bytesReceived)
+	require.Equal(t, []bool{true}, requestorSnapshot.outgoingCompleted)
+	require.Zero(t, requestorSnapshot.incomingQueued)
+	require.Zero(t, requestorSnapshot.bytesSent)
+
+	// the responder finishes once the final status is sent
+	require.Eventually(t, func() bool {
+		return len(responderMetrics.snapshot().incomingCompleted) == 1
+	}, time.Second, 10*time.Millisecond)
+	responderSnapshot := responderMetrics.snapshot()
+	require.Equal(t, uint64(1), responderSnapshot.incomingQueued)
+	require.Equal(t, uint64(1), responderSnapshot.incomingStarted)
+	require.Equal(t, chainBytes, responderSnapshot.bytesSent)
+	require.Equal(t, []bool{true}, responderSnapshot.incomingCompleted)
+	require.Zero(t, responderSnapshot.outgoingQueued)
+	require.Zero(t, responderSnapshot.bytesReceived)
+}
+
+type testMetricsRecorder struct {
+	lk      sync.Mutex
+	metrics recordedMetrics
+}
+
+type recordedMetrics struct {
+	outgoingQueued    uint64
+	outgoingStarted   uint64
+	bytesReceived     uint64
+	outgoingCompleted []bool
+	incomingQueued    uint64
+	incomingStarted   uint64
+	bytesSent         uint64
+	incomingCompleted []bool
+}
+
+func (r *testMetricsRecorder) record(update func(*recordedMetrics)) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	update(&r.metrics)
+}
+
+func (r *testMetricsRecorder) snapshot() recordedMetrics {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	snapshot := r.metrics
+	snapshot.outgoingCompleted = append([]bool(nil), r.metrics.outgoingCompleted...)
+	snapshot.incomingCompleted = append([]bool(nil), r.metrics.incomingCompleted...)
+	return snapshot
+}
+
+func (r *testMetricsRecorder) RecordOutgoingRequestQueued() {
+	r.record(func(m *recordedMetrics) { m.outgoingQueued++ })
+}
+
+func (r *testMetricsRecorder) RecordOutgoingRequestStarted() {
+	r.record(func(m *recordedMetrics) { m.outgoingStarted++ })
+}
+
+func (r *testMetricsRecorder) RecordBlockReceived(bytes uint64) {
+	r.record(func(m *recordedMetrics) { m.bytesReceived += bytes })
+}
+
+func (r *testMetricsRecorder) RecordOutgoingRequestCompleted(duration time.Duration, success bool) {
+	r.record(func(m *recordedMetrics) { m.outgoingCompleted = append(m.outgoingCompleted, success) })
+}
+
+func (r *testMetricsRecorder) RecordIncomingRequestQueued() {
+	r.record(func(m *recordedMetrics) { m.incomingQueued++ })
+}
+
+func (r *testMetricsRecorder) RecordIncomingRequestStarted() {
+	r.record(func(m *recordedMetrics) { m.incomingStarted++ })
+}
+
+func (r *testMetricsRecorder) RecordBlockSent(bytes uint64) {
+	r.record(func(m *recordedMetrics) { m.bytesSent += bytes })
+}
+
+func (r *testMetricsRecorder) RecordIncomingRequestCompleted(duration time.Duration, success bool) {
+	r.record(func(m *recordedMetrics) { m.incomingCompleted = append(m.incomingCompleted, success) })
+}
+
+func TestGraphsyncRoundTrip(t *testing.T) {
+	for pname, ps := range protocolsForTest {
+		t.Run(pname, func(t *testing.T) {
+			// create network
+			ctx := context.Background()
+			ctx, collectTracing := testutil.SetupTracing(ctx)
+			ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+			defer cancel()
+			td := newOptionalGsTestData(ctx, t, ps.host1Protocols, ps.host2Protocols)
+
+			// initialize graphsync on first node to make requests
+			requestor := td.GraphSyncHost1()
+
+			// setup receiving peer to just record message coming in
+			blockChainLength := 100
+			blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+
+			// initialize graphsync on second node to response to requests
+			responder := td.GraphSyncHost2()
+			assertComplete := assertCompletionFunction(responder, 1)
+
+			var receivedResponseData datamodel.Node
+			var receivedRequestData datamodel.Node
+
+			requestor.RegisterIncomingResponseHook(
+				func(p peer.ID, responseData graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
+					data, has := responseData.Extension(td.extensionName)
+					if has {
+						receivedResponseData = data
+					}
+				})
+
+			responder.RegisterIncomingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+				var has bool
+				receivedRequestData, has = requestData.Extension(td.extensionName)
+				if !has {
+					hookActions.TerminateWithError(errors.New("Missing extension"))
+				} else {
+					hookActions.SendExtensionData(td.extensionResponse)
+				}
+			})
+
+			finalResponseStatusChan := make(chan graphsync.ResponseStatusCode, 1)
+			responder.RegisterCompletedResponseListener(func(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode) {
+				select {
+				case finalResponseStatusChan <- status:
+				default:
+				}
+			})
+			progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+
+			blockChain.VerifyWholeChain(ctx, progressChan)
+			testutil.VerifyEmptyErrors(ctx, t, errChan)
+			require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+
+			// verify extension roundtrip
+			require.Equal(t, td.extensionData, receivedRequestData, "did not receive correct extension request data")
+			require.Equal(t, td.extensionResponseData, receivedResponseData, "did not receive correct extension response data")
+
+			// verify listener
+			var finalResponseStatus graphsync.ResponseStatusCode
+			testutil.AssertReceive(ctx, t, finalResponseStatusChan, &finalResponseStatus, "should receive status")
+			require.Equal(t, graphsync.RequestCompletedFull, finalResponseStatus)
+
+			drain(requestor)
+			drain(responder)
+			assertComplete(ctx, t)
+
+			tracing := collectTracing(t)
+
+			traceStrings := tracing.TracesToStrings()
+			require.Contains(t, traceStrings, "response(0)->executeTask(0)->processBlock(0)->loadBlock(0)")
+			require.Contains(t, traceStrings, "response(0)->executeTask(0)->processBlock(0)->sendBlock(0)->processBlockHooks(0)")
+			require.Contains(t, traceStrings, "request(0)->newRequest(0)")
+			require.Contains(t, traceStrings, "request(0)->executeTask(0)")
+			require.Contains(t, traceStrings, "request(0)->terminateRequest(0)")
+			require.Contains(t, traceStrings, "processResponses(0)")        // should have one of these per response
+			require.Contains(t, traceStrings, "request(0)->verifyBlock(0)") // should have one of these per block
+
+			processUpdateSpan := tracing.FindSpanByTraceString("response(0)")
+			require.Equal(t, int64(0), testutil.AttributeValueInTraceSpan(t, *processUpdateSpan, "priority").AsInt64())
+			// the request context has a timeout, so its deadline is sent as well
+			require.ElementsMatch(t, []string{string(td.extensionName), string(graphsync.ExtensionSupportedExtensions), string(graphsync.ExtensionDeadline)}, testutil.AttributeValueInTraceSpan(t, *processUpdateSpan, "extensions").AsStringSlice())
+
+			// each verifyBlock span should link to a cacheProcess span that stored it
+
+			processResponsesSpans := tracing.FindSpans("processResponses")
+			processResponsesLinks := make(map[string]int64)
+			verifyBlockSpans := tracing.FindSpans("verifyBlock")
+
+			for _, verifyBlockSpan := range verifyBlockSpans {
+				require.Len(t, verifyBlockSpan.Links, 1, "verifyBlock span should have one link")
+				found := false
+				for _, prcessResponseSpan := range processResponsesSpans {
+					sid := prcessResponseSpan.SpanContext.SpanID().String()
+					if verifyBlockSpan.Links[0].SpanContext.SpanID().String() == sid {
+						found = true
+						processResponsesLinks[sid] = processResponsesLinks[sid] + 1
+						break
+					}
+				}
+				require.True(t, found, "verifyBlock should link to a known cacheProcess span")
+			}
+
+			// each cacheProcess span should be linked to one verifyBlock span per block it stored
+
+			for _, processResponseSpan := range processResponsesSpans {
+				blockCount := testutil.AttributeValueInTraceSpan(t, processResponseSpan, "blockCount").AsInt64()
+				require.Equal(t, processResponsesLinks[processResponseSpan.SpanContext.SpanID().String()], blockCount, "cacheProcess span should be linked to one verifyBlock span per block it processed")
+			}
+		})
+	}
+}
+
+func TestGraphsyncRoundTripHooksOrder(t *testing.T) {
+
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// setup receiving peer to just record message coming in
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2()
+	hooksCalled := make(chan string, 5)
+
+	requestor.RegisterOutgoingRequestHook(func(peer.ID, graphsync.RequestData, graphsync.OutgoingRequestHookActions) {
+		hooksCalled <- "outgoing request started"
+	})
+	requestor.RegisterOutgoingRequestProcessingListener(func(peer.ID, graphsync.RequestData, int) {
+		hooksCalled <- "outgoing request processing"
+	})
+	responder.RegisterCompletedResponseListener(func(peer.ID, graphsync.RequestData, graphsync.ResponseStatusCode) {
+		hooksCalled <- "incoming request complete"
+	})
+	responder.RegisterIncomingRequestHook(func(_ peer.ID, _ graphsync.RequestData, actions graphsync.IncomingRequestHookActions) {
+		hooksCalled <- "incoming request received"
+		actions.ValidateRequest()
+	})
+	responder.RegisterIncomingRequestProcessingListener(func(peer.ID, graphsync.RequestData, int) {
+		hooksCalled <- "incoming request processing"
+	})
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+
+	var calledHooks []string
+	for i := 0; i < 5; i++ {
+		select {
+		case <-ctx.Done():
+			t.Fatal("did not receive all events")
+		case calledHook := <-hooksCalled:
+			calledHooks = append(calledHooks, calledHook)
+		}
+	}
+	require.Equal(t, []string{
+		"outgoing request started",
+		"outgoing request processing",
+		"incoming request received",
+		"incoming request processing",
+		"incoming request complete",
+	}, calledHooks)
+}
+
+func TestGraphsyncRoundTripMaxMessageSize(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// setup receiving peer to just record message coming in
+	blockChainLength := 20
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 1000, blockChainLength)
+
+	// initialize graphsync on second node to response to requests, with a
+	// message size limit too small for two blocks in one message
+	responder := td.GraphSyncHost2(MaxMessageSize(2500))
+	assertComplete := assertCompletionFunction(responder, 1)
+
+	var messagesReceived int64
+	requestor.RegisterIncomingResponseHook(func(p peer.ID, responseData graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
+		atomic.AddInt64(&messagesReceived, 1)
+	})
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+
+	// every block arrives in a message of its own, and the traversal sees them
+	// in order
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+	require.GreaterOrEqual(t, atomic.LoadInt64(&messagesReceived), int64(blockChainLength))
+	assertComplete(ctx, t)
+}
+
+func TestGraphsyncMaxMessageSizeRejectsLargeMessages(t *testing.T) {
+	testCases := map[string]func(td *gsTestData, options ...Option) (graphsync.GraphExchange, graphsync.GraphExchange){
+		"network passed to New": func(td *gsTestData, options ...Option) (graphsync.GraphExchange, graphsync.GraphExchange) {
+			return td.GraphSyncHost1(), td.GraphSyncHost2(options...)
+		},
+		// both sides exchange messages over the libp2p networks as plain
+		// transports
+		"transport": func(td *gsTestData, options ...Option) (graphsync.GraphExchange, graphsync.GraphExchange) {
+			requestor := New(td.ctx, nil, td.persistence1, WithTransport(td.gsnet1.(graphsync.Transport)))
+			responder := New(td.ctx, nil, td.persistence2, append([]Option{WithTransport(td.gsnet2.(graphsync.Transport))}, options...)...)
+			return requestor, responder
+		},
+	}
+	for testCase, setup := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			// create network
+			ctx := context.Background()
+			ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+			defer cancel()
+			td := newGsTestData(ctx, t)
+
+			blockChainLength := 10
+			blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+
+			requestor, responder := setup(td, MaxMessageSize(16<<10))
+			receiveErrors := make(chan error, 1)
+			responder.RegisterReceiverNetworkErrorListener(func(p peer.ID, err error) {
+				select {
+				case receiveErrors <- err:
+				default:
+				}
+			})
+
+			// a request larger than the responder accepts is rejected when received
+			oversizedCtx, oversizedCancel := context.WithCancel(ctx)
+			largeExtension := graphsync.ExtensionData{
+				Name: td.extensionName,
+				Data: basicnode.NewBytes(testutil.RandomBytes(32 << 10)),
+			}
+			_, _ = requestor.Request(oversizedCtx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), largeExtension)
+			var receiveErr error
+			testutil.AssertReceive(ctx, t, receiveErrors, &receiveErr, "should receive an error")
+			var tooLargeErr gsnet.MessageTooLargeErr
+			require.True(t, errors.As(receiveErr, &tooLargeErr))
+			require.Equal(t, 16<<10, tooLargeErr.MaxSize)
+			oversizedCancel()
+
+			// other requests are still served
+			progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+			blockChain.VerifyWholeChain(ctx, progressChan)
+			testutil.VerifyEmptyErrors(ctx, t, errChan)
+
+			drain(requestor)
+			drain(responder)
+		})
+	}
+}
+
+func TestGraphsyncUnknownAndMalformedResponses(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	// the DAG-CBOR protocol cannot carry a status outside the known set, so
+	// the responder speaks the protobuf protocol, which can
+	td := newOptionalGsTestData(ctx, t, nil, []protocol.ID{gsnet.ProtocolGraphsync_1_0_0})
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// setup receiving peer to just record requests coming in
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, 10)
+	recorder := &requestRecorder{requests: make(chan gsmsg.GraphSyncRequest, 1)}
+	td.gsnet2.SetDelegate(recorder)
+
+	// a response with a status this implementation does not know ends the
+	// request
+	_, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+	var request gsmsg.GraphSyncRequest
+	testutil.AssertReceive(ctx, t, recorder.requests, &request, "should receive request")
+	unknownStatus := gsmsg.NewResponse(request.ID(), graphsync.ResponseStatusCode(39), nil)
+	require.NoError(t, td.gsnet2.SendMessage(ctx, td.host1.ID(), gsmsg.NewMessage(nil, map[graphsync.RequestID]gsmsg.GraphSyncResponse{request.ID(): unknownStatus}, nil)))
+	var err error
+	testutil.AssertReceive(ctx, t, errChan, &err, "should receive an error")
+	require.Equal(t, graphsync.UnknownResponseStatusErr{Code: 39}, err)
+
+	// a message that cannot be decoded fails requests in progress with the peer
+	_, errChan = requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+	testutil.AssertReceive(ctx, t, recorder.requests, &request, "should receive request")
+	s, err := td.host2.NewStream(ctx, td.host1.ID(), gsnet.ProtocolGraphsync_1_0_0)
+	require.NoError(t, err)
+	garbage := []byte{0xff, 0xff, 0xff, 0xff}
+	frame := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(frame, uint64(len(garbage)))
+	_, err = s.Write(append(frame[:n], garbage...))
+	require.NoError(t, err)
+	testutil.AssertReceive(ctx, t, errChan, &err, "should receive an error")
+	var malformedErr graphsync.MalformedResponseErr
+	require.True(t, errors.As(err, &malformedErr))
+	require.Equal(t, td.host2.ID(), malformedErr.Peer)
+
+	drain(requestor)
+}
+
+// requestRecorder is a network receiver that records the requests it receives
+type requestRecorder struct {
+	requests chan gsmsg.GraphSyncRequest
+}
+
+func (rr *requestRecorder) ReceiveMessage(ctx context.Context, sender peer.ID, incoming gsmsg.GraphSyncMessage) {
+	for _, request := range incoming.Requests() {
+		if request.Type() == graphsync.RequestTypeNew {
+			rr.requests <- request
+		}
+	}
+}
+
+func (rr *requestRecorder) ReceiveError(p peer.ID, err error) {}
+
+func (rr *requestRecorder) Connected(p peer.ID) {}
+
+func (rr *requestRecorder) Disconnected(p peer.ID) {}
+
+func TestGraphsyncRoundTripRequestCids(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// setup receiving peer to just record message coming in
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2()
+	assertComplete := assertCompletionFunction(responder, 1)
+
+	var blocksTraversed, bytesSent uint64
+	responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		atomic.AddUint64(&blocksTraversed, 1)
+		atomic.AddUint64(&bytesSent, blockData.BlockSizeOnWire())
+	})
+
+	cids, errChan := requestor.RequestCids(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+	var receivedCids []cid.Cid
+	for c := range cids {
+		receivedCids = append(receivedCids, c)
+	}
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+
+	// the responder traverses the whole chain, but sends no blocks
+	var expectedCids []cid.Cid
+	for _, blk := range blockChain.AllBlocks() {
+		expectedCids = append(expectedCids, blk.Cid())
+	}
+	require.Equal(t, expectedCids, receivedCids)
+	assertComplete(ctx, t)
+	require.Equal(t, uint64(blockChainLength), atomic.LoadUint64(&blocksTraversed))
+	require.Zero(t, atomic.LoadUint64(&bytesSent))
+	require.Empty(t, td.blockStore1, "should not store any blocks")
+}
+
+func TestGraphsyncRoundTripCompletingResponseHook(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// setup receiving peer to just record message coming in
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2()
+
+	// the responder sends a receipt of the bytes sent with the final status
+	receiptExtension := graphsync.ExtensionName("receipt")
+	var bytesSent uint64
+	responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		atomic.AddUint64(&bytesSent, blockData.BlockSizeOnWire())
+	})
+	responder.RegisterCompletingResponseHook(func(p peer.ID, requestData graphsync.RequestData, status graphsync.ResponseStatusCode, hookActions graphsync.CompletingResponseHookActions) {
+		if status == graphsync.RequestCompletedFull {
+			hookActions.SendExtensionData(graphsync.ExtensionData{
+				Name: receiptExtension,
+				Data: basicnode.NewInt(int64(atomic.LoadUint64(&bytesSent))),
+			})
+		}
+	})
+
+	// the receipt arrives with the final status, and is seen by response hooks
+	// and completed response hooks
+	terminalReceipts := make(chan int64, 1)
+	requestor.RegisterIncomingResponseHook(func(p peer.ID, responseData graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
+		if data, ok := responseData.Extension(receiptExtension); ok {
+			require.Equal(t, graphsync.RequestCompletedFull, responseData.Status())
+			receipt, err := data.AsInt()
+			require.NoError(t, err)
+			terminalReceipts <- receipt
+		}
+	})
+	completedExtensions := make(chan []graphsync.ExtensionData, 1)
+	requestor.RegisterCompletedResponseHook(func(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode, extensions []graphsync.ExtensionData) {
+		completedExtensions <- extensions
+	})
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+
+	var received uint64
+	for _, data := range td.blockStore1 {
+		received += uint64(len(data))
+	}
+	var receipt int64
+	testutil.AssertReceive(ctx, t, terminalReceipts, &receipt, "should receive receipt")
+	require.Equal(t, int64(received), receipt)
+	var extensions []graphsync.ExtensionData
+	testutil.AssertReceive(ctx, t, completedExtensions, &extensions, "should complete request")
+	require.Contains(t, extensions, graphsync.ExtensionData{
+		Name: receiptExtension,
+		Data: basicnode.NewInt(receipt),
+	})
+}
+
+func TestGraphsyncRoundTripResponseStat(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// setup receiving peer to just record message coming in
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2()
+	var bytesSent uint64
+	responder.RegisterOutgoingBlockHook(func(p peer.ID, request graphsync.RequestData, block graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		atomic.StoreUint64(&bytesSent, hookActions.BytesSent())
+	})
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+	responses := testutil.CollectResponses(ctx, t, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	blockChain.VerifyWholeChainSync(responses)
+
+	var totalBytes uint64
+	for _, data := range td.blockStore1 {
+		totalBytes += uint64(len(data))
+	}
+	var lastBytesReceived uint64
+	for _, response := range responses {
+		require.GreaterOrEqual(t, response.Stat.BytesReceived, lastBytesReceived)
+		lastBytesReceived = response.Stat.BytesReceived
+	}
+	require.Equal(t, totalBytes, lastBytesReceived)
+	// the responder counts the same bytes the requestor received
+	require.Equal(t, totalBytes, atomic.LoadUint64(&bytesSent))
+
+	// blocks loaded locally are not counted
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+	responses = testutil.CollectResponses(ctx, t, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	blockChain.VerifyWholeChainSync(responses)
+	require.Zero(t, responses[len(responses)-1].Stat.BytesReceived)
+
+	drain(requestor)
+	drain(responder)
+}
+
+func TestGraphsyncRoundTripSelectorCache(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// two chains of the same length are requested with the same selector
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+	blockChain2 := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+	require.Equal(t, blockChain.Selector(), blockChain2.Selector())
+
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2(SelectorCache(4))
+
+	for _, chain := range []*testutil.TestBlockChain{blockChain, blockChain2} {
+		progressChan, errChan := requestor.Request(ctx, td.host2.ID(), chain.TipLink, chain.Selector(), td.extension)
+		chain.VerifyWholeChain(ctx, progressChan)
+		testutil.VerifyEmptyErrors(ctx, t, errChan)
+	}
+
+	// a selector that fails validation is rejected every time
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	unboundedSelector := ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	for i := 0; i < 2; i++ {
+		progressChan, errChan := requestor.Request(ctx, td.host2.ID(), testutil.NewTestLink(), unboundedSelector, td.extension)
+		testutil.VerifyEmptyResponse(ctx, t, progressChan)
+		errs := testutil.CollectErrors(ctx, t, errChan)
+		require.Len(t, errs, 1)
+		require.IsType(t, graphsync.RequestRejectedErr{}, errs[0])
+	}
+
+	drain(requestor)
+	drain(responder)
+}
+
+func TestGraphsyncRoundTripFailover(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// setup receiving peer to just record message coming in
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+
+	// a third peer has the same chain, but stops responding partway through
+	failingHost, err := td.mn.GenPeer()
+	require.NoError(t, err, "error generating host")
+	require.NoError(t, td.mn.LinkAll(), "error linking hosts")
+	failingBlockStore := make(map[ipld.Link][]byte, len(td.blockStore2))
+	for lnk, data := range td.blockStore2 {
+		failingBlockStore[lnk] = data
+	}
+	failingResponder := New(ctx, gsnet.NewFromLibp2pHost(failingHost), testutil.NewTestStore(failingBlockStore), MaxLinksPerIncomingRequests(5))
+
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2()
+	var blocksSent int64
+	responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		if blockData.BlockSizeOnWire() > 0 {
+			atomic.AddInt64(&blocksSent, 1)
+		}
+	})
+
+	progressChan, errChan := requestor.RequestWithFailover(ctx, []peer.ID{failingHost.ID(), td.host2.ID()}, blockChain.TipLink, blockChain.Selector(), td.extension)
+
+	// every node is delivered exactly once, and errors from the failed peer are not delivered
+	responses := testutil.CollectResponses(ctx, t, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	blockChain.VerifyWholeChainSync(responses)
+	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+
+	drain(requestor)
+	drain(responder)
+	drain(failingResponder)
+	// blocks received from the failed peer are not fetched again
+	require.Equal(t, int64(blockChainLength-5), atomic.LoadInt64(&blocksSent))
+}
+
+func TestGraphsyncRoundTripFromPeers(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+
+	// a third peer has none of the chain, and a fourth has all of it but is slow to respond
+	emptyHost, err := td.mn.GenPeer()
+	require.NoError(t, err, "error generating host")
+	slowHost, err := td.mn.GenPeer()
+	require.NoError(t, err, "error generating host")
+	require.NoError(t, td.mn.LinkAll(), "error linking hosts")
+	emptyResponder := New(ctx, gsnet.NewFromLibp2pHost(emptyHost), testutil.NewTestStore(make(map[ipld.Link][]byte)))
+	slowResponder := New(ctx, gsnet.NewFromLibp2pHost(slowHost), testutil.NewTestStore(td.blockStore2))
+	slowResponder.RegisterIncomingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+		time.Sleep(500 * time.Millisecond)
+	})
+	var slowBlocksSent int64
+	slowResponder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		if blockData.BlockSizeOnWire() > 0 {
+			atomic.AddInt64(&slowBlocksSent, 1)
+		}
+	})
+
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2()
+
+	progressChan, errChan := requestor.RequestFromPeers(ctx, []peer.ID{emptyHost.ID(), slowHost.ID(), td.host2.ID()}, blockChain.TipLink, blockChain.Selector(), td.extension)
+
+	// the fastest peer delivers the whole chain, and errors from the empty peer are not delivered
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+
+	drain(requestor)
+	drain(responder)
+	drain(emptyResponder)
+	drain(slowResponder)
+	// the slow peer's request was cancelled before it finished
+	require.Less(t, atomic.LoadInt64(&slowBlocksSent), int64(blockChainLength))
+}
+
+func TestGraphsyncRoundTripRetryPeers(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests, recording the peer
+	// each request ID is allocated for
+	var allocatedLk sync.Mutex
+	var allocatedFor []peer.ID
+	requestor := td.GraphSyncHost1(WithRequestIDAllocator(func(p peer.ID, root cid.Cid, selector ipld.Node) graphsync.RequestID {
+		allocatedLk.Lock()
+		defer allocatedLk.Unlock()
+		allocatedFor = append(allocatedFor, p)
+		return graphsync.NewRequestID()
+	}))
+
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+
+	// a third peer has the same chain, but the network to it fails partway through
+	failingHost, err := td.mn.GenPeer()
+	require.NoError(t, err, "error generating host")
+	require.NoError(t, td.mn.LinkAll(), "error linking hosts")
+	failingResponder := New(ctx, gsnet.NewFromLibp2pHost(failingHost), testutil.NewTestStore(td.blockStore2))
+	stopPoint := 50
+	var failingBlocksSent int64
+	failingResponder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		if atomic.AddInt64(&failingBlocksSent, 1) == int64(stopPoint) {
+			hookActions.PauseResponse()
+		}
+	})
+
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2()
+	var blocksSent int64
+	responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		if blockData.BlockSizeOnWire() > 0 {
+			atomic.AddInt64(&blocksSent, 1)
+		}
+	})
+
+	requestCtx := graphsync.WithRetryPeers(ctx, []peer.ID{td.host2.ID()}, 0)
+	progressChan, errChan := requestor.Request(requestCtx, failingHost.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+	blockChain.VerifyResponseRange(ctx, progressChan, 0, stopPoint)
+
+	// cut the network to the failing peer, so the request is retried with the next peer
+	require.NoError(t, td.mn.DisconnectPeers(td.host1.ID(), failingHost.ID()))
+	require.NoError(t, td.mn.UnlinkPeers(td.host1.ID(), failingHost.ID()))
+
+	// every node is delivered exactly once, and blocks received from the failed peer are not fetched again
+	blockChain.VerifyRemainder(ctx, progressChan, stopPoint)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+	drain(requestor)
+	drain(responder)
+	require.Equal(t, int64(blockChainLength-stopPoint), atomic.LoadInt64(&blocksSent))
+	// the retry gets its ID from the allocator too
+	allocatedLk.Lock()
+	require.Equal(t, []peer.ID{failingHost.ID(), td.host2.ID()}, allocatedFor)
+	allocatedLk.Unlock()
+
+	t.Run("rejections are not retried", func(t *testing.T) {
+		blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+		rejectingHost, err := td.mn.GenPeer()
+		require.NoError(t, err, "error generating host")
+		_, err = td.mn.LinkPeers(td.host1.ID(), rejectingHost.ID())
+		require.NoError(t, err, "error linking hosts")
+		rejectingResponder := New(ctx, gsnet.NewFromLibp2pHost(rejectingHost), td.persistence2, RejectAllRequestsByDefault())
+		var retried int64
+		responder.RegisterIncomingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			atomic.AddInt64(&retried, 1)
+		})
+
+		progressChan, errChan := requestor.Request(requestCtx, rejectingHost.ID(), blockChain.TipLink, blockChain.Selector())
+		testutil.VerifyEmptyResponse(ctx, t, progressChan)
+		testutil.AssertReceive(ctx, t, errChan, &err, "should receive an error")
+		require.True(t, errors.As(err, &graphsync.RequestRejectedErr{}))
+		drain(rejectingResponder)
+		require.Zero(t, atomic.LoadInt64(&retried))
+	})
+
+	t.Run("every attempt fails", func(t *testing.T) {
+		blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+		// neither the failing peer, which is no longer linked, nor a new peer
+		// that was never linked can be reached
+		unreachable, err := td.mn.GenPeer()
+		require.NoError(t, err, "error generating host")
+		requestCtx := graphsync.WithRetryPeers(ctx, []peer.ID{unreachable.ID(), td.host2.ID()}, 2)
+		progressChan, errChan := requestor.Request(requestCtx, failingHost.ID(), blockChain.TipLink, blockChain.Selector())
+		testutil.VerifyEmptyResponse(ctx, t, progressChan)
+		testutil.AssertReceive(ctx, t, errChan, &err, "should receive an error")
+		var failedErr graphsync.RetryPeersFailedErr
+		require.True(t, errors.As(err, &failedErr))
+		require.Len(t, failedErr.Attempts, 2)
+		require.Equal(t, failingHost.ID(), failedErr.Attempts[0].Peer)
+		require.Equal(t, unreachable.ID(), failedErr.Attempts[1].Peer)
+	})
+}
+
+func TestGraphsyncRoundTripRateLimited(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// setup receiving peer to just record message coming in
+	blockChainLength := 50
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 1000, blockChainLength)
+
+	// initialize graphsync on second node to response to requests, sending
+	// about two seconds worth of blocks
+	bytesPerSecond := uint64(20000)
+	responder := td.GraphSyncHost2(MaxOutgoingBytesPerSecond(bytesPerSecond))
+	var bytesSent uint64
+	responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		atomic.AddUint64(&bytesSent, blockData.BlockSizeOnWire())
+	})
+	assertComplete := assertCompletionFunction(responder, 1)
+
+	start := time.Now()
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	elapsed := time.Since(start)
+	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+
+	drain(requestor)
+	drain(responder)
+	assertComplete(ctx, t)
+
+	// up to one second's worth is sent right away, then the limit holds
+	sent := atomic.LoadUint64(&bytesSent)
+	require.Greater(t, sent, 2*bytesPerSecond)
+	require.LessOrEqual(t, float64(sent), float64(bytesPerSecond)*(elapsed.Seconds()+1))
+	for _, limit := range responder.LimitsReport() {
+		if limit.Name == graphsync.LimitMaxOutgoingBytesPerSecond {
+			require.Equal(t, bytesPerSecond, limit.Configured)
+			require.NotZero(t, limit.Hits)
+		}
+	}
+}
+
+func TestGraphsyncRoundTripPartial(t *testing.T) {
+
+	// create network
+	ctx := context.Background()
+	ctx, collectTracing := testutil.SetupTracing(ctx)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// setup an IPLD tree and put all but 1 node into the second nodes block store
+	tree := testutil.NewTestIPLDTree()
+	td.blockStore2[tree.LeafAlphaLnk] = tree.LeafAlphaBlock.RawData()
+	td.blockStore2[tree.MiddleMapNodeLnk] = tree.MiddleMapBlock.RawData()
+	td.blockStore2[tree.MiddleListNodeLnk] = tree.MiddleListBlock.RawData()
+	td.blockStore2[tree.RootNodeLnk] = tree.RootBlock.RawData()
+
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2()
+	assertComplete := assertCompletionFunction(responder, 1)
+
+	finalResponseStatusChan := make(chan graphsync.ResponseStatusCode, 1)
+	responder.RegisterCompletedResponseListener(func(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode) {
+		select {
+		case finalResponseStatusChan <- status:
+		default:
+		}
+	})
+	// create a selector to traverse the whole tree
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	allSelector := ssb.ExploreRecursive(selector.RecursionLimitDepth(10),
+		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+
+	_, errChan := requestor.Request(ctx, td.host2.ID(), tree.RootNodeLnk, allSelector)
+
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	require.Len(t, errs, 2)
+	// verify the error is received for leaf beta node being missing
+	require.EqualError(t, errs[0], fmt.Sprintf("remote peer is missing block (%s) at path linkedList/2", tree.LeafBetaLnk.String()))
+	require.ErrorIs(t, errs[1], graphsync.RequestCompletedPartialErr{})
+	require.Equal(t, tree.LeafAlphaBlock.RawData(), td.blockStore1[tree.LeafAlphaLnk])
+	require.Equal(t, tree.MiddleListBlock.RawData(), td.blockStore1[tree.MiddleListNodeLnk])
+	require.Equal(t, tree.MiddleMapBlock.RawData(), td.blockStore1[tree.MiddleMapNodeLnk])
+	require.Equal(t, tree.RootBlock.RawData(), td.blockStore1[tree.RootNodeLnk])
+
+	// verify listener
+	var finalResponseStatus graphsync.ResponseStatusCode
+	testutil.AssertReceive(ctx, t, finalResponseStatusChan, &finalResponseStatus, "should receive status")
+	require.Equal(t, graphsync.RequestCompletedPartial, finalResponseStatus)
+
+	drain(requestor)
+	drain(responder)
+	assertComplete(ctx, t)
+
+	tracing := collectTracing(t)
+	traceStrings := tracing.TracesToStrings()
+	require.Contains(t, traceStrings, "response(0)->executeTask(0)->processBlock(0)->loadBlock(0)")
+	require.Contains(t, traceStrings, "response(0)->executeTask(0)->processBlock(0)->sendBlock(0)->processBlockHooks(0)")
+	require.Contains(t, traceStrings, "request(0)->newRequest(0)")
+	require.Contains(t, traceStrings, "request(0)->executeTask(0)")
+	require.Contains(t, traceStrings, "request(0)->terminateRequest(0)")
+	require.Contains(t, traceStrings, "processResponses(0)")        // should have one of these per response
+	require.Contains(t, traceStrings, "request(0)->verifyBlock(0)") // should have one of these per block
+}
+
+func TestGraphsyncRoundTripResume(t *testing.T) {
+
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// setup receiving peer to just record message coming in
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+
+	// an earlier attempt at the request received the first half of the chain
+	firstHalf := blockChain.Blocks(0, 50)
+	received := cid.NewSet()
+	for _, blk := range firstHalf {
+		td.blockStore1[cidlink.Link{Cid: blk.Cid()}] = blk.RawData()
+		received.Add(blk.Cid())
+	}
+	requestor.RegisterOutgoingRequestHook(func(p peer.ID, request graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+		hookActions.UseResumeState(graphsync.ResumeState{Received: received})
+	})
+
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2()
+	assertComplete := assertCompletionFunction(responder, 1)
+
+	var receivedResume bool
+	responder.RegisterIncomingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+		_, receivedResume = requestData.Extension(graphsync.ExtensionResume)
+		hookActions.ValidateRequest()
+	})
+	totalSentOnWire := 0
+	responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		if blockData.BlockSizeOnWire() > 0 {
+			totalSentOnWire++
+		}
+	})
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+	require.True(t, receivedResume, "should send resume extension")
+	require.Equal(t, blockChainLength-received.Len(), totalSentOnWire, "should not send blocks already received")
+
+	drain(requestor)
+	drain(responder)
+	assertComplete(ctx, t)
+}
+
+func TestGraphsyncRoundTripResumeFromLocalStore(t *testing.T) {
+	blockChainLength := 100
+	testCases := map[string]struct {
+		receivedBlocks  int
+		partialFrontier bool
+	}{
+		"nothing received":              {receivedBlocks: 0},
+		"root received":                 {receivedBlocks: 1},
+		"prefix received":               {receivedBlocks: 37},
+		"all but last received":         {receivedBlocks: blockChainLength - 1},
+		"prefix and part of next block": {receivedBlocks: 37, partialFrontier: true},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			// create network
+			ctx := context.Background()
+			ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+			defer cancel()
+			td := newGsTestData(ctx, t)
+			// partly written blocks are only detected in storage that is not trusted
+			td.persistence1.TrustedStorage = false
+
+			// initialize graphsync on first node to make requests
+			requestor := td.GraphSyncHost1()
+
+			// setup receiving peer to just record message coming in
+			blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+
+			// an earlier attempt at the request stored a prefix of the chain before
+			// the node restarted
+			for _, blk := range blockChain.Blocks(0, data.receivedBlocks) {
+				td.blockStore1[cidlink.Link{Cid: blk.Cid()}] = blk.RawData()
+			}
+			frontier := blockChain.Blocks(data.receivedBlocks, data.receivedBlocks+1)[0]
+			if data.partialFrontier {
+				td.blockStore1[cidlink.Link{Cid: frontier.Cid()}] = frontier.RawData()[:len(frontier.RawData())/2]
+			}
+
+			resumeState, err := requestor.(*GraphSync).LocalResumeState(ctx, blockChain.TipLink, blockChain.Selector())
+			require.NoError(t, err)
+			require.Equal(t, data.receivedBlocks, resumeState.Received.Len())
+
+			// initialize graphsync on second node to response to requests
+			responder := td.GraphSyncHost2()
+			assertComplete := assertCompletionFunction(responder, 1)
+
+			var receivedResume bool
+			responder.RegisterIncomingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+				_, receivedResume = requestData.Extension(graphsync.ExtensionResume)
+				hookActions.ValidateRequest()
+			})
+			var totalSentOnWire int64
+			responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+				if blockData.BlockSizeOnWire() > 0 {
+					atomic.AddInt64(&totalSentOnWire, 1)
+				}
+			})
+
+			progressChan, errChan := requestor.Request(graphsync.WithResumeFromLocalStore(ctx), td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+
+			blockChain.VerifyWholeChain(ctx, progressChan)
+			testutil.VerifyEmptyErrors(ctx, t, errChan)
+			require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+			require.Equal(t, frontier.RawData(), td.blockStore1[cidlink.Link{Cid: frontier.Cid()}])
+			require.Equal(t, data.receivedBlocks > 0, receivedResume)
+			require.Equal(t, int64(blockChainLength-data.receivedBlocks), atomic.LoadInt64(&totalSentOnWire), "should not send blocks already received")
+
+			drain(requestor)
+			drain(responder)
+			assertComplete(ctx, t)
+		})
+	}
+}
+
+type fakeProgressStore struct {
+	lk     sync.Mutex
+	states map[graphsync.RequestID]graphsync.ProgressState
+}
+
+func (fps *fakeProgressStore) SaveProgress(requestID graphsync.RequestID, state graphsync.ProgressState) error {
+	fps.lk.Lock()
+	defer fps.lk.Unlock()
+	fps.states[requestID] = state
+	return nil
+}
+
+func (fps *fakeProgressStore) LoadProgress(requestID graphsync.RequestID) (graphsync.ProgressState, bool, error) {
+	fps.lk.Lock()
+	defer fps.lk.Unlock()
+	state, ok := fps.states[requestID]
+	return state, ok, nil
+}
+
+func TestGraphsyncRoundTripResumeRequest(t *testing.T) {
+
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// an earlier process saved the progress of the request after receiving the
+	// first half of the chain
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+	requestID := graphsync.NewRequestID()
+	received := cid.NewSet()
+	for _, blk := range blockChain.Blocks(0, 50) {
+		td.blockStore1[cidlink.Link{Cid: blk.Cid()}] = blk.RawData()
+		received.Add(blk.Cid())
+	}
+	store := &fakeProgressStore{states: map[graphsync.RequestID]graphsync.ProgressState{
+		requestID: {Received: received},
+	}}
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1(WithPersistence(store), ProgressSaveInterval(10*time.Millisecond))
+
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2()
+	assertComplete := assertCompletionFunction(responder, 1)
+
+	var receivedResume bool
+	responder.RegisterIncomingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+		_, receivedResume = requestData.Extension(graphsync.ExtensionResume)
+		hookActions.ValidateRequest()
+	})
+	var totalSentOnWire int64
+	responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		if blockData.BlockSizeOnWire() > 0 {
+			atomic.AddInt64(&totalSentOnWire, 1)
+		}
+	})
+
+	progressChan, errChan := requestor.(*GraphSync).ResumeRequest(ctx, td.host2.ID(), requestID, blockChain.TipLink, blockChain.Selector())
+
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+	require.True(t, receivedResume, "should send resume extension")
+	require.Equal(t, int64(blockChainLength-received.Len()), atomic.LoadInt64(&totalSentOnWire), "should not send blocks already received")
+
+	// without a store, there is nothing to resume from
+	_, errChan = responder.(*GraphSync).ResumeRequest(ctx, td.host1.ID(), requestID, blockChain.TipLink, blockChain.Selector())
+	testutil.VerifySingleTerminalError(ctx, t, errChan)
+
+	drain(requestor)
+	drain(responder)
+	assertComplete(ctx, t)
+}
+
+func TestGraphsyncResumeRequestAfterDisconnect(t *testing.T) {
+
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+	store := &fakeProgressStore{states: map[graphsync.RequestID]graphsync.ProgressState{}}
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1(WithPersistence(store), ProgressSaveInterval(10*time.Millisecond))
+
+	// initialize graphsync on second node to response to requests, pausing
+	// the first response halfway through
+	responder := td.GraphSyncHost2()
+	stopPoint := 50
+	var blocksSent int64
+	responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		if atomic.AddInt64(&blocksSent, 1) == int64(stopPoint) {
+			hookActions.PauseResponse()
+		}
+	})
+
+	requestID := graphsync.NewRequestID()
+	progressChan, errChan := requestor.(*GraphSync).ResumeRequest(ctx, td.host2.ID(), requestID, blockChain.TipLink, blockChain.Selector())
+	blockChain.VerifyResponseRange(ctx, progressChan, 0, stopPoint)
+	require.Eventually(t, func() bool {
+		state, ok, _ := store.LoadProgress(requestID)
+		return ok && state.Received != nil && state.Received.Len() == stopPoint
+	}, time.Second, 10*time.Millisecond, "should save progress")
+
+	// the connection drops, ending the request
+	require.NoError(t, td.mn.DisconnectPeers(td.host1.ID(), td.host2.ID()))
+	var err error
+	testutil.AssertReceive(ctx, t, errChan, &err, "should receive an error")
+	require.Equal(t, graphsync.ErrPeerDisconnected{Peer: td.host2.ID()}, err)
+
+	// the request is resumed with the same ID once the peer is reachable again
+	_, err = td.mn.ConnectPeers(td.host1.ID(), td.host2.ID())
+	require.NoError(t, err)
+	progressChan, errChan = requestor.(*GraphSync).ResumeRequest(ctx, td.host2.ID(), requestID, blockChain.TipLink, blockChain.Selector())
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+
+	drain(requestor)
+	drain(responder)
+}
+
+func TestGraphsyncRoundTripExtensionNegotiation(t *testing.T) {
+
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests, supporting an
+	// extension the responder does not
+	requestor := td.GraphSyncHost1(SupportedExtensions(td.extensionName))
+	negotiated := make(chan []graphsync.ExtensionName, 1)
+	requestor.RegisterNegotiationCompleteListener(func(p peer.ID, supported []graphsync.ExtensionName) {
+		negotiated <- supported
+	})
+
+	// setup receiving peer to just record message coming in
+	blockChainLength := 10
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+	otherBlockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2()
+	assertComplete := assertCompletionFunction(responder, 2)
+
+	receivedExtensions := make(chan bool, 2)
+	responder.RegisterIncomingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+		_, has := requestData.Extension(td.extensionName)
+		receivedExtensions <- has
+		hookActions.ValidateRequest()
+	})
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	var received bool
+	testutil.AssertReceive(ctx, t, receivedExtensions, &received, "should receive first request")
+	require.True(t, received, "should send extension before negotiation completes")
+
+	var supported []graphsync.ExtensionName
+	testutil.AssertReceive(ctx, t, negotiated, &supported, "should complete negotiation")
+	require.Equal(t, graphsync.KnownExtensions(), supported)
+
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), otherBlockChain.TipLink, otherBlockChain.Selector(), td.extension)
+	otherBlockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	testutil.AssertReceive(ctx, t, receivedExtensions, &received, "should receive second request")
+	require.False(t, received, "should not send extension the responder does not support")
+
+	drain(requestor)
+	drain(responder)
+	assertComplete(ctx, t)
+}
+
+func TestGraphsyncRoundTripBlockCompression(t *testing.T) {
+	testCases := map[string]struct {
+		requestorCompresses bool
+		responderCompresses bool
+		expectCompression   bool
+	}{
+		"both peers compress": {
+			requestorCompresses: true,
+			responderCompresses: true,
+			expectCompression:   true,
+		},
+		"only responder compresses": {
+			responderCompresses: true,
+		},
+		"only requestor compresses": {
+			requestorCompresses: true,
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			// create network
+			ctx := context.Background()
+			ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+			defer cancel()
+			td := newGsTestData(ctx, t)
+
+			var requestorOptions, responderOptions []Option
+			if data.requestorCompresses {
+				requestorOptions = append(requestorOptions, BlockCompression(compression.Gzip()))
+			}
+			if data.responderCompresses {
+				responderOptions = append(responderOptions, BlockCompression(compression.Gzip()))
+			}
+			requestor := td.GraphSyncHost1(requestorOptions...)
+			negotiated := make(chan []graphsync.ExtensionName, 1)
+			requestor.RegisterNegotiationCompleteListener(func(p peer.ID, supported []graphsync.ExtensionName) {
+				negotiated <- supported
+			})
+			compressedWith := make(chan string, 2)
+			requestor.RegisterIncomingResponseHook(func(p peer.ID, responseData graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
+				if data, has := responseData.Extension(graphsync.ExtensionBlockCompression); has {
+					name, err := compression.DecodeCodecName(data)
+					require.NoError(t, err)
+					compressedWith <- name
+				}
+			})
+
+			// setup receiving peer to just record message coming in
+			blockChainLength := 10
+			blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 1000, blockChainLength)
+			otherBlockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 1000, blockChainLength)
+
+			// initialize graphsync on second node to response to requests
+			responder := td.GraphSyncHost2(responderOptions...)
+			assertComplete := assertCompletionFunction(responder, 2)
+
+			requestedCompression := make(chan bool, 2)
+			responder.RegisterIncomingRequestHook(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+				_, has := requestData.Extension(graphsync.ExtensionBlockCompression)
+				requestedCompression <- has
+				hookActions.ValidateRequest()
+			})
+
+			progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+			blockChain.VerifyWholeChain(ctx, progressChan)
+			testutil.VerifyEmptyErrors(ctx, t, errChan)
+			var requested bool
+			testutil.AssertReceive(ctx, t, requestedCompression, &requested, "should receive first request")
+			require.Equal(t, data.requestorCompresses, requested)
+			testutil.AssertDoesReceive(ctx, t, negotiated, "should complete negotiation")
+
+			progressChan, errChan = requestor.Request(ctx, td.host2.ID(), otherBlockChain.TipLink, otherBlockChain.Selector())
+			otherBlockChain.VerifyWholeChain(ctx, progressChan)
+			testutil.VerifyEmptyErrors(ctx, t, errChan)
+			testutil.AssertReceive(ctx, t, requestedCompression, &requested, "should receive second request")
+			// once negotiated, compression is only requested from a responder that supports it
+			require.Equal(t, data.expectCompression, requested)
+
+			if data.expectCompression {
+				var name string
+				testutil.AssertReceive(ctx, t, compressedWith, &name, "should compress first response")
+				require.Equal(t, "gzip", name)
+				testutil.AssertReceive(ctx, t, compressedWith, &name, "should compress second response")
+				require.Equal(t, "gzip", name)
+			} else {
+				testutil.AssertChannelEmpty(t, compressedWith, "should not compress responses")
+			}
+
+			drain(requestor)
+			drain(responder)
+			assertComplete(ctx, t)
+		})
+	}
+}
+
+func TestGraphsyncRoundTripCAR(t *testing.T) {
+
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// setup receiving peer to just record message coming in
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2()
+	assertComplete := assertCompletionFunction(responder, 1)
+
+	reader, errChan := requestor.RequestCAR(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector())
+	framed, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+
+	// blocks are framed once each, in traversal order
+	framedReader := bytes.NewReader(framed)
+	for _, blk := range blockChain.AllBlocks() {
+		length, err := binary.ReadUvarint(framedReader)
+		require.NoError(t, err)
+		section := make([]byte, length)
+		_, err = io.ReadFull(framedReader, section)
+		require.NoError(t, err)
+		n, c, err := cid.CidFromBytes(section)
+		require.NoError(t, err)
+		require.Equal(t, blk.Cid(), c)
+		require.Equal(t, blk.RawData(), section[n:])
+	}
+	require.Zero(t, framedReader.Len(), "should not frame extra blocks")
+
+	drain(requestor)
+	drain(responder)
+	assertComplete(ctx, t)
 }
 
 func TestGraphsyncRoundTripIgnoreCids(t *testing.T) {
@@ -520,6 +2560,89 @@ func TestGraphsyncRoundTripIgnoreCids(t *testing.T) {
 	), tracing.TracesToStrings())
 }
 
+func TestGraphsyncRoundTripTransferStats(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	// the requestor already has the first half of the chain, and asks the
+	// responder not to send it
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+	var localBytes, remoteBytes uint64
+	set := cid.NewSet()
+	for i, blk := range blockChain.AllBlocks() {
+		if i < 50 {
+			td.blockStore1[cidlink.Link{Cid: blk.Cid()}] = blk.RawData()
+			set.Add(blk.Cid())
+			localBytes += uint64(len(blk.RawData()))
+		} else {
+			remoteBytes += uint64(len(blk.RawData()))
+		}
+	}
+	extension := graphsync.ExtensionData{
+		Name: graphsync.ExtensionDoNotSendCIDs,
+		Data: cidset.EncodeCidSet(set),
+	}
+
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2()
+	assertComplete := assertCompletionFunction(responder, 1)
+
+	// counts include every block processed so far while the request runs
+	var inProgress graphsync.TransferStats
+	var inProgressFound bool
+	requestor.RegisterIncomingBlockHook(func(p peer.ID, responseData graphsync.ResponseData, blockData graphsync.BlockData, hookActions graphsync.IncomingBlockHookActions) {
+		if blockData.Index() == 75 {
+			inProgress, inProgressFound = requestor.RequestTransferStats(responseData.RequestID())
+		}
+	})
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), extension)
+
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	drain(requestor)
+	drain(responder)
+	assertComplete(ctx, t)
+
+	require.True(t, inProgressFound)
+	require.Equal(t, uint64(50), inProgress.BlocksLocal)
+	require.Equal(t, uint64(25), inProgress.BlocksReceived)
+
+	expectedRequestor := graphsync.TransferStats{
+		BlocksReceived: 50,
+		BytesReceived:  remoteBytes,
+		BlocksLocal:    50,
+		BytesLocal:     localBytes,
+	}
+	require.Equal(t, expectedRequestor, requestor.Stats().Transfers)
+	require.Equal(t, expectedRequestor, requestor.PeerTransferStats(td.host2.ID()))
+	completed := requestor.CompletedRequests()
+	require.Len(t, completed, 1)
+	require.Equal(t, expectedRequestor, completed[0].Event.Transfer)
+	_, stillTracked := requestor.RequestTransferStats(completed[0].RequestID)
+	require.False(t, stillTracked, "should stop tracking a request once it ends")
+	stats := requestor.Stats()
+	require.Equal(t, graphsync.RequestCounts{}, stats.OutgoingRequestCounts)
+	require.Contains(t, stats.Peers, td.host2.ID())
+	require.Equal(t, graphsync.RequestCounts{}, stats.Peers[td.host2.ID()].OutgoingRequests)
+
+	expectedResponder := graphsync.TransferStats{
+		BlocksQueued: 50,
+		BytesQueued:  remoteBytes,
+		BlocksSent:   50,
+		BytesSent:    remoteBytes,
+	}
+	require.Equal(t, expectedResponder, responder.Stats().Transfers)
+	require.Equal(t, expectedResponder, responder.PeerTransferStats(td.host1.ID()))
+}
+
 func TestGraphsyncRoundTripIgnoreNBlocks(t *testing.T) {
 
 	// create network
@@ -658,6 +2781,23 @@ func TestPauseResume(t *testing.T) {
 	require.Len(t, responderPeerState.IncomingState.Diagnostics(), 0)
 
 	requestID := <-requestIDChan
+	inProgressResponses := responder.InProgressResponses()
+	require.Len(t, inProgressResponses, 1)
+	require.Equal(t, requestID, inProgressResponses[0].RequestID)
+	require.Equal(t, td.host1.ID(), inProgressResponses[0].Peer)
+	require.Equal(t, blockChain.TipLink.(cidlink.Link).Cid, inProgressResponses[0].Root)
+	require.Equal(t, graphsync.Paused, inProgressResponses[0].State)
+	require.Equal(t, uint64(stopPoint), inProgressResponses[0].BlocksProcessed)
+	// the requestor may still be running hooks for the last block
+	require.Eventually(t, func() bool {
+		inProgressRequests := requestor.InProgressRequests()
+		return len(inProgressRequests) == 1 &&
+			inProgressRequests[0].RequestID == requestID &&
+			inProgressRequests[0].Selector == inProgressResponses[0].Selector &&
+			inProgressRequests[0].State == graphsync.Running &&
+			inProgressRequests[0].BlocksProcessed == uint64(stopPoint)
+	}, time.Second, 10*time.Millisecond)
+
 	err := responder.Unpause(ctx, requestID)
 	require.NoError(t, err)
 
@@ -668,6 +2808,11 @@ func TestPauseResume(t *testing.T) {
 	drain(requestor)
 	drain(responder)
 	assertOneRequestCompletes(ctx, t)
+	require.Empty(t, requestor.InProgressRequests())
+	// the completed listener may run before the responder finishes the task
+	require.Eventually(t, func() bool {
+		return len(responder.InProgressResponses()) == 0
+	}, time.Second, 10*time.Millisecond)
 
 	tracing := collectTracing(t)
 
@@ -686,6 +2831,76 @@ func TestPauseResume(t *testing.T) {
 	tracing.SingleExceptionEvent(t, "response(0)->executeTask(0)", "github.com/ipfs/go-graphsync/responsemanager/hooks.ErrPaused", hooks.ErrPaused{}.Error(), false)
 }
 
+func TestResponseIterator(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+	_ = td.GraphSyncHost2()
+
+	iterator := graphsync.NewResponseIterator(ctx, requestor, td.host2.ID(), blockChain.TipLink.(cidlink.Link).Cid, blockChain.Selector())
+	var blocks int
+	for {
+		progress, err := iterator.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if progress.LastBlock.Path.String() == progress.Path.String() {
+			blocks++
+		}
+	}
+	require.Equal(t, blockChainLength, blocks)
+	require.Len(t, td.blockStore1, blockChainLength, "did not store all blocks")
+
+	require.NoError(t, iterator.Close())
+	_, err := iterator.Next()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestResponseIteratorClose(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	requestor := td.GraphSyncHost1()
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+	responder := td.GraphSyncHost2()
+
+	// hold the response partway through, so the request is still in flight
+	stopPoint := 50
+	blocksSent := 0
+	responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		blocksSent++
+		if blocksSent == stopPoint {
+			hookActions.PauseResponse()
+		}
+	})
+
+	iterator := graphsync.NewResponseIterator(ctx, requestor, td.host2.ID(), blockChain.TipLink.(cidlink.Link).Cid, blockChain.Selector())
+	_, err := iterator.Next()
+	require.NoError(t, err)
+	require.Len(t, requestor.InProgressRequests(), 1)
+
+	require.NoError(t, iterator.Close())
+	_, err = iterator.Next()
+	require.Equal(t, io.EOF, err)
+
+	// closing cancels the request on both sides
+	require.Eventually(t, func() bool {
+		return len(requestor.InProgressRequests()) == 0 && len(responder.InProgressResponses()) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	require.NoError(t, iterator.Close())
+}
+
 func TestPauseResumeRequest(t *testing.T) {
 
 	// create network
@@ -966,6 +3181,63 @@ func TestPauseResumeViaUpdateOnBlockHook(t *testing.T) {
 	tracing.SingleExceptionEvent(t, "response(0)->executeTask(0)", "github.com/ipfs/go-graphsync/responsemanager/hooks.ErrPaused", hooks.ErrPaused{}.Error(), false)
 }
 
+func TestRequestorCancellation(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+
+	// initialize graphsync on second node to response to requests, pausing
+	// part way through so the response is still in progress when cancelled
+	responder := td.GraphSyncHost2()
+	stopPoint := 50
+	blocksSent := 0
+	responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		blocksSent++
+		if blocksSent == stopPoint {
+			hookActions.PauseResponse()
+		}
+	})
+	cancelled := make(chan graphsync.RequestID, 1)
+	responder.RegisterRequestorCancelledListener(func(p peer.ID, request graphsync.RequestData) {
+		cancelled <- request.ID()
+	})
+	finalResponseStatusChan := make(chan graphsync.ResponseStatusCode, 1)
+	responder.RegisterCompletedResponseListener(func(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode) {
+		finalResponseStatusChan <- status
+	})
+
+	requestCtx, requestCancel := context.WithCancel(ctx)
+	defer requestCancel()
+	progressChan, errChan := requestor.Request(requestCtx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+	blockChain.VerifyResponseRange(ctx, progressChan, 0, stopPoint)
+	requestCancel()
+	testutil.VerifySingleTerminalError(ctx, t, errChan)
+
+	// the responder learns the requestor went away, and ends the response
+	var requestID graphsync.RequestID
+	testutil.AssertReceive(ctx, t, cancelled, &requestID, "responder should be told the requestor cancelled")
+	var finalResponseStatus graphsync.ResponseStatusCode
+	testutil.AssertReceive(ctx, t, finalResponseStatusChan, &finalResponseStatus, "should receive status")
+	require.Equal(t, graphsync.RequestCancelled, finalResponseStatus)
+	require.Equal(t, stopPoint, blocksSent)
+
+	require.Eventually(t, func() bool {
+		stats := responder.Stats()
+		return stats.IncomingRequests.Active == 0 && stats.OutgoingResponses.TotalAllocatedAllPeers == 0
+	}, time.Second, 10*time.Millisecond, "should release all responder state for the request")
+
+	drain(requestor)
+	drain(responder)
+}
+
 func TestNetworkDisconnect(t *testing.T) {
 	// create network
 	ctx := context.Background()
@@ -1009,13 +3281,6 @@ func TestNetworkDisconnect(t *testing.T) {
 		default:
 		}
 	})
-	receiverError := make(chan error, 1)
-	requestor.RegisterReceiverNetworkErrorListener(func(p peer.ID, err error) {
-		select {
-		case receiverError <- err:
-		default:
-		}
-	})
 	requestCtx, requestCancel := context.WithTimeout(ctx, 1*time.Second)
 	defer requestCancel()
 	progressChan, errChan := requestor.Request(requestCtx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
@@ -1028,14 +3293,21 @@ func TestNetworkDisconnect(t *testing.T) {
 	// unlink peers so they cannot communicate
 	require.NoError(t, td.mn.DisconnectPeers(td.host1.ID(), td.host2.ID()))
 	require.NoError(t, td.mn.UnlinkPeers(td.host1.ID(), td.host2.ID()))
-	requestID := <-requestIDChan
-	err := responder.Unpause(ctx, requestID)
-	require.NoError(t, err)
 
+	// both sides end the request rather than waiting on the lost peer
+	var err error
 	testutil.AssertReceive(ctx, t, networkError, &err, "should receive network error")
+	require.Equal(t, graphsync.ErrPeerDisconnected{Peer: td.host1.ID()}, err)
 	testutil.AssertReceive(ctx, t, errChan, &err, "should receive an error")
-	require.EqualError(t, err, graphsync.RequestClientCancelledErr{}.Error())
-	testutil.AssertReceive(ctx, t, receiverError, &err, "should receive an error on receiver side")
+	require.Equal(t, graphsync.ErrPeerDisconnected{Peer: td.host2.ID()}, err)
+
+	// the paused response is gone, so there is nothing to unpause
+	requestID := <-requestIDChan
+	require.Error(t, responder.Unpause(ctx, requestID))
+	require.Eventually(t, func() bool {
+		stats := responder.Stats()
+		return stats.IncomingRequests.Active == 0 && stats.OutgoingResponses.TotalAllocatedAllPeers == 0
+	}, time.Second, 10*time.Millisecond, "should release all responder state for the request")
 
 	drain(requestor)
 	drain(responder)
@@ -1046,9 +3318,6 @@ func TestNetworkDisconnect(t *testing.T) {
 	require.Contains(t, traceStrings, "response(0)->transaction(0)->execute(0)->buildMessage(0)")
 	require.Contains(t, traceStrings, "response(0)->executeTask(0)->processBlock(0)->loadBlock(0)")
 	require.Contains(t, traceStrings, "response(0)->executeTask(0)->processBlock(0)->sendBlock(0)->processBlockHooks(0)")
-	require.Contains(t, traceStrings, "response(0)->abortRequest(0)")
-	require.Contains(t, traceStrings, "response(0)->executeTask(1)->processBlock(0)->loadBlock(0)")
-	require.Contains(t, traceStrings, "response(0)->executeTask(1)->processBlock(0)->sendBlock(0)->processBlockHooks(0)")
 	require.Contains(t, traceStrings, "request(0)->newRequest(0)")
 	require.Contains(t, traceStrings, "request(0)->executeTask(0)")
 	require.Contains(t, traceStrings, "request(0)->terminateRequest(0)")
@@ -1059,6 +3328,189 @@ func TestNetworkDisconnect(t *testing.T) {
 	tracing.SingleExceptionEvent(t, "request(0)->executeTask(0)", "ContextCancelError", ipldutil.ContextCancelError{}.Error(), false)
 }
 
+func TestClose(t *testing.T) {
+	// other tests may leave graphsync instances running
+	goroutinesBefore := graphsyncGoroutines()
+
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1()
+
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+
+	// initialize graphsync on second node to response to requests, pausing
+	// responses part way through so they are still in progress when closed
+	responder := td.GraphSyncHost2()
+	stopPoint := 50
+	blocksSent := 0
+	responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		blocksSent++
+		if blocksSent == stopPoint {
+			hookActions.PauseResponse()
+		}
+	})
+	cancelledByResponder := make(chan struct{}, 1)
+	responder.RegisterRequestorCancelledListener(func(p peer.ID, request graphsync.RequestData) {
+		cancelledByResponder <- struct{}{}
+	})
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+	blockChain.VerifyResponseRange(ctx, progressChan, 0, stopPoint)
+
+	// closing the responder ends the paused response with a cancellation
+	require.NoError(t, responder.Close(ctx))
+	testutil.VerifySingleTerminalError(ctx, t, errChan)
+	require.NoError(t, responder.Close(ctx), "should be able to close twice")
+
+	// the closed responder ignores new requests, so this request stays in
+	// progress until the requestor is closed
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+	require.NoError(t, requestor.Close(ctx))
+	// blocks stored by the first request may already have loaded locally
+	testutil.CollectResponses(ctx, t, progressChan)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	require.Len(t, errs, 1)
+	require.IsType(t, graphsync.ExchangeClosedErr{}, errs[0])
+	testutil.AssertChannelEmpty(t, cancelledByResponder, "closed responder should not process cancels")
+
+	// new requests fail immediately
+	progressChan, errChan = requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+	testutil.VerifyEmptyResponse(ctx, t, progressChan)
+	errs = testutil.CollectErrors(ctx, t, errChan)
+	require.Len(t, errs, 1)
+	require.IsType(t, graphsync.ExchangeClosedErr{}, errs[0])
+	require.ErrorIs(t, errs[0], graphsync.ErrGraphsyncClosed)
+
+	require.Eventually(t, func() bool {
+		return graphsyncGoroutines() <= goroutinesBefore
+	}, 2*time.Second, 10*time.Millisecond, "should stop all goroutines started by graphsync")
+}
+
+func TestCloseDrainsInProgressTransfers(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// each node requests a chain from the other, and each pauses its response
+	// part way through, so both transfers are in progress when node 2 closes
+	gs1 := td.GraphSyncHost1()
+	gs2 := td.GraphSyncHost2(DrainTimeout(4 * time.Second))
+	blockChainLength := 100
+	blockChain1 := testutil.SetupBlockChain(ctx, t, td.persistence1, 100, blockChainLength)
+	blockChain2 := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+	stopPoint := 50
+	pauseAt := func(gs graphsync.GraphExchange) <-chan graphsync.RequestID {
+		paused := make(chan graphsync.RequestID, 1)
+		var blocksSent int32
+		gs.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+			if atomic.AddInt32(&blocksSent, 1) == int32(stopPoint) {
+				hookActions.PauseResponse()
+				paused <- requestData.ID()
+			}
+		})
+		return paused
+	}
+	paused1 := pauseAt(gs1)
+	paused2 := pauseAt(gs2)
+
+	progressChan1, errChan1 := gs1.Request(ctx, td.host2.ID(), blockChain2.TipLink, blockChain2.Selector(), td.extension)
+	progressChan2, errChan2 := gs2.Request(ctx, td.host1.ID(), blockChain1.TipLink, blockChain1.Selector(), td.extension)
+	blockChain2.VerifyResponseRange(ctx, progressChan1, 0, stopPoint)
+	blockChain1.VerifyResponseRange(ctx, progressChan2, 0, stopPoint)
+	var pausedResponse1, pausedResponse2 graphsync.RequestID
+	testutil.AssertReceive(ctx, t, paused1, &pausedResponse1, "node 1 should pause its response")
+	testutil.AssertReceive(ctx, t, paused2, &pausedResponse2, "node 2 should pause its response")
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- gs2.Close(ctx)
+	}()
+
+	// the closing node fails its own new requests, and rejects new requests
+	// from other nodes
+	requestFails := func(requestor graphsync.GraphExchange, p peer.ID, blockChain *testutil.TestBlockChain, expectedErr error) func() bool {
+		return func() bool {
+			progressChan, errChan := requestor.Request(ctx, p, blockChain.TipLink, blockChain.Selector())
+			testutil.CollectResponses(ctx, t, progressChan)
+			errs := testutil.CollectErrors(ctx, t, errChan)
+			return len(errs) == 1 && errors.Is(errs[0], expectedErr)
+		}
+	}
+	require.Eventually(t, requestFails(gs2, td.host1.ID(), blockChain1, graphsync.ExchangeClosedErr{}), 2*time.Second, 10*time.Millisecond, "closing node should fail new requests")
+	require.Eventually(t, requestFails(gs1, td.host2.ID(), blockChain2, graphsync.RequestRejectedErr{}), 2*time.Second, 10*time.Millisecond, "closing node should reject new requests")
+	testutil.AssertChannelEmpty(t, closed, "close should wait for transfers in progress")
+
+	// both transfers finish once unpaused, and then close completes
+	require.NoError(t, gs1.Unpause(ctx, pausedResponse1))
+	require.NoError(t, gs2.Unpause(ctx, pausedResponse2))
+	blockChain2.VerifyRemainder(ctx, progressChan1, stopPoint)
+	blockChain1.VerifyRemainder(ctx, progressChan2, stopPoint)
+	testutil.VerifyEmptyErrors(ctx, t, errChan1)
+	testutil.VerifyEmptyErrors(ctx, t, errChan2)
+	var err error
+	testutil.AssertReceive(ctx, t, closed, &err, "close should complete")
+	require.NoError(t, err)
+	require.NoError(t, gs1.Close(ctx))
+}
+
+func TestCloseContextExpires(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	// the requestor waits a long time for transfers to drain, but the responder
+	// never finishes its response
+	requestor := td.GraphSyncHost1(DrainTimeout(time.Minute))
+	responder := td.GraphSyncHost2()
+	blockChainLength := 100
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+	stopPoint := 50
+	var blocksSent int32
+	responder.RegisterOutgoingBlockHook(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		if atomic.AddInt32(&blocksSent, 1) == int32(stopPoint) {
+			hookActions.PauseResponse()
+		}
+	})
+
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+	blockChain.VerifyResponseRange(ctx, progressChan, 0, stopPoint)
+
+	// close gives up when its context expires, and the request still ends with
+	// an error saying the exchange closed
+	closeCtx, closeCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer closeCancel()
+	require.ErrorIs(t, requestor.Close(closeCtx), context.DeadlineExceeded)
+	testutil.CollectResponses(ctx, t, progressChan)
+	errs := testutil.CollectErrors(ctx, t, errChan)
+	require.Len(t, errs, 1)
+	require.IsType(t, graphsync.ExchangeClosedErr{}, errs[0])
+	require.NoError(t, responder.Close(ctx))
+}
+
+// graphsyncGoroutines counts running goroutines executing graphsync code,
+// excluding tests
+func graphsyncGoroutines() int {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	count := 0
+	for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+		if bytes.Contains(stack, []byte("github.com/ipfs/go-graphsync/")) && !bytes.Contains(stack, []byte("_test.go")) {
+			count++
+		}
+	}
+	return count
+}
+
 func TestConnectFail(t *testing.T) {
 
 	// create network
@@ -1345,6 +3797,49 @@ func TestRoundTripLargeBlocksSlowNetwork(t *testing.T) {
 	), tracing.TracesToStrings())
 }
 
+// What this test does:
+// - Two nodes on a slow network each request a chain of large blocks from the
+// other at the same time, with little memory for queued responses
+// - Verify both requests complete, so responses queued for a peer never hold
+// up requests to that peer, or processing of responses from it
+func TestBidirectionalLargeBlocksSlowNetwork(t *testing.T) {
+
+	// create network
+	if testing.Short() {
+		t.Skip()
+	}
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+	td.mn.SetLinkDefaults(mocknet.LinkOptions{Latency: 100 * time.Millisecond, Bandwidth: 3000000})
+
+	// each node holds a chain the other wants
+	blockChainLength := 40
+	blockChain1 := testutil.SetupBlockChain(ctx, t, td.persistence1, 200000, blockChainLength)
+	blockChain2 := testutil.SetupBlockChain(ctx, t, td.persistence2, 200000, blockChainLength)
+
+	gs1 := td.GraphSyncHost1(MaxMemoryPerPeerResponder(1 << 20))
+	gs2 := td.GraphSyncHost2(MaxMemoryPerPeerResponder(1 << 20))
+	assertComplete1 := assertCompletionFunction(gs1, 1)
+	assertComplete2 := assertCompletionFunction(gs2, 1)
+
+	progressChan1, errChan1 := gs1.Request(ctx, td.host2.ID(), blockChain2.TipLink, blockChain2.Selector())
+	progressChan2, errChan2 := gs2.Request(ctx, td.host1.ID(), blockChain1.TipLink, blockChain1.Selector())
+
+	blockChain2.VerifyWholeChain(ctx, progressChan1)
+	testutil.VerifyEmptyErrors(ctx, t, errChan1)
+	blockChain1.VerifyWholeChain(ctx, progressChan2)
+	testutil.VerifyEmptyErrors(ctx, t, errChan2)
+
+	drain(gs1)
+	drain(gs2)
+	assertComplete1(ctx, t)
+	assertComplete2(ctx, t)
+	require.Len(t, td.blockStore1, 2*blockChainLength, "did not store all blocks")
+	require.Len(t, td.blockStore2, 2*blockChainLength, "did not store all blocks")
+}
+
 // What this test does:
 // - Import a directory via UnixFSV1
 // - setup a graphsync request from one node to the other
@@ -1628,6 +4123,71 @@ func TestUnixFSFetch(t *testing.T) {
 	require.Contains(t, traceStrings, "request(0)->verifyBlock(0)") // should have one of these per block
 }
 
+func TestGraphsyncPeerActivityListeners(t *testing.T) {
+	// create network
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	td := newGsTestData(ctx, t)
+
+	type activityEvent struct {
+		p      peer.ID
+		active bool
+	}
+	debounce := 200 * time.Millisecond
+
+	// initialize graphsync on first node to make requests
+	requestor := td.GraphSyncHost1(PeerActivityDebounce(debounce))
+	requestorEvents := make(chan activityEvent, 10)
+	requestor.RegisterPeerActivityListener(func(p peer.ID, active bool) {
+		requestorEvents <- activityEvent{p, active}
+	})
+
+	// setup receiving peer to just record message coming in
+	blockChainLength := 20
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence2, 100, blockChainLength)
+
+	// initialize graphsync on second node to response to requests
+	responder := td.GraphSyncHost2(PeerActivityDebounce(debounce))
+	responderEvents := make(chan activityEvent, 10)
+	unregister := responder.RegisterPeerActivityListener(func(p peer.ID, active bool) {
+		// listeners may call back into graphsync
+		_ = responder.Stats()
+		responderEvents <- activityEvent{p, active}
+	})
+
+	// requests in quick succession are reported as one period of activity
+	for i := 0; i < 3; i++ {
+		progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+		blockChain.VerifyWholeChain(ctx, progressChan)
+		testutil.VerifyEmptyErrors(ctx, t, errChan)
+	}
+
+	var event activityEvent
+	testutil.AssertReceive(ctx, t, requestorEvents, &event, "requestor should report responder active")
+	require.Equal(t, activityEvent{td.host2.ID(), true}, event)
+	testutil.AssertReceive(ctx, t, responderEvents, &event, "responder should report requestor active")
+	require.Equal(t, activityEvent{td.host1.ID(), true}, event)
+	testutil.AssertReceive(ctx, t, requestorEvents, &event, "requestor should report responder inactive")
+	require.Equal(t, activityEvent{td.host2.ID(), false}, event)
+	testutil.AssertReceive(ctx, t, responderEvents, &event, "responder should report requestor inactive")
+	require.Equal(t, activityEvent{td.host1.ID(), false}, event)
+
+	// unregistered listeners hear nothing more
+	unregister()
+	progressChan, errChan := requestor.Request(ctx, td.host2.ID(), blockChain.TipLink, blockChain.Selector(), td.extension)
+	blockChain.VerifyWholeChain(ctx, progressChan)
+	testutil.VerifyEmptyErrors(ctx, t, errChan)
+	testutil.AssertReceive(ctx, t, requestorEvents, &event, "requestor should report responder active")
+	require.Equal(t, activityEvent{td.host2.ID(), true}, event)
+	testutil.AssertReceive(ctx, t, requestorEvents, &event, "requestor should report responder inactive")
+	require.Equal(t, activityEvent{td.host2.ID(), false}, event)
+	require.Empty(t, responderEvents)
+
+	drain(requestor)
+	drain(responder)
+}
+
 func TestGraphsyncBlockListeners(t *testing.T) {
 
 	// create network
@@ -1929,8 +4489,8 @@ type gsTestData struct {
 }
 
 func drain(gs graphsync.GraphExchange) {
-	gs.(*GraphSync).requestQueue.(*taskqueue.WorkerTaskQueue).WaitForNoActiveTasks()
-	gs.(*GraphSync).responseQueue.(*taskqueue.WorkerTaskQueue).WaitForNoActiveTasks()
+	gs.(*GraphSync).requestQueue.WaitForNoActiveTasks()
+	gs.(*GraphSync).responseQueue.WaitForNoActiveTasks()
 }
 
 func assertAllResponsesReceivedFunction(gs graphsync.GraphExchange) func(context.Context, *testing.T) int {
@@ -0,0 +1,141 @@
+package graphsync
+
+import (
+	"context"
+
+	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+// RequestFromPeers initiates the same GraphSync request to each of the given
+// peers at once. The first peer to deliver a response wins: requests to the
+// other peers are cancelled, and only the winner's responses and errors are
+// delivered. If every peer fails before delivering a response, errors are only
+// delivered for the last peer to fail. Each request is queued like any other
+// request to its peer, so per peer limits still apply
+func (gs *GraphSync) RequestFromPeers(ctx context.Context, peers []peer.ID, root ipld.Link, selector ipld.Node, extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
+	outgoingResponses := make(chan graphsync.ResponseProgress)
+	outgoingErrors := make(chan error)
+	go gs.runRace(ctx, peers, root, selector, extensions, outgoingResponses, outgoingErrors)
+	return outgoingResponses, outgoingErrors
+}
+
+// raceEntrant is the request to a single peer in a race
+type raceEntrant struct {
+	cancel    context.CancelFunc
+	responses <-chan graphsync.ResponseProgress
+	errors    <-chan error
+
+	// set before the entrant is reported as finished
+	won   bool
+	first graphsync.ResponseProgress
+	errs  []error
+}
+
+// awaitFirstResponse waits for the entrant's first response, or for its
+// request to end without one, then reports the entrant as finished
+func (re *raceEntrant) awaitFirstResponse(finished chan<- *raceEntrant) {
+	if response, ok := <-re.responses; ok {
+		re.won = true
+		re.first = response
+		finished <- re
+		return
+	}
+	for err := range re.errors {
+		re.errs = append(re.errs, err)
+	}
+	finished <- re
+}
+
+// drain reads the rest of a cancelled entrant's responses and errors, so its
+// request can shut down
+func (re *raceEntrant) drain() {
+	for range re.responses {
+	}
+	for range re.errors {
+	}
+}
+
+func (gs *GraphSync) runRace(ctx context.Context,
+	peers []peer.ID,
+	root ipld.Link,
+	selector ipld.Node,
+	extensions []graphsync.ExtensionData,
+	outgoingResponses chan<- graphsync.ResponseProgress,
+	outgoingErrors chan<- error) {
+	defer close(outgoingResponses)
+	defer close(outgoingErrors)
+
+	if len(peers) == 0 {
+		select {
+		case outgoingErrors <- errNoFailoverPeers:
+		case <-ctx.Done():
+		}
+		return
+	}
+
+	// buffered so entrants that finish after the race is decided never block
+	finished := make(chan *raceEntrant, len(peers))
+	entrants := make([]*raceEntrant, 0, len(peers))
+	for _, p := range peers {
+		requestCtx, cancel := context.WithCancel(ctx)
+		responses, errs := gs.Request(requestCtx, p, root, selector, extensions...)
+		entrant := &raceEntrant{cancel: cancel, responses: responses, errors: errs}
+		entrants = append(entrants, entrant)
+		go entrant.awaitFirstResponse(finished)
+	}
+
+	var winner *raceEntrant
+	var errs []error
+	for range entrants {
+		entrant := <-finished
+		if entrant.won {
+			winner = entrant
+			break
+		}
+		errs = entrant.errs
+	}
+	for _, entrant := range entrants {
+		if entrant != winner {
+			entrant.cancel()
+			go entrant.drain()
+		}
+	}
+
+	if winner == nil {
+		for _, err := range errs {
+			select {
+			case outgoingErrors <- err:
+			case <-ctx.Done():
+				return
+			}
+		}
+		return
+	}
+
+	defer winner.cancel()
+	select {
+	case outgoingResponses <- winner.first:
+	case <-ctx.Done():
+		go winner.drain()
+		return
+	}
+	for response := range winner.responses {
+		select {
+		case outgoingResponses <- response:
+		case <-ctx.Done():
+			go winner.drain()
+			return
+		}
+	}
+	for err := range winner.errors {
+		select {
+		case outgoingErrors <- err:
+		case <-ctx.Done():
+			go winner.drain()
+			return
+		}
+	}
+}
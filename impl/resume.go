@@ -0,0 +1,137 @@
+package graphsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/ipfs/go-cid"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	ipld "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/cidset"
+)
+
+// LocalResumeState returns the state of an interrupted request for the given
+// root and selector, from the blocks for the traversal already in the default
+// store. It walks the selector over the local blocks only, skipping the parts
+// of the DAG below blocks that are missing or, unless the store is trusted, do
+// not match their link, such as a block only partly written before the node
+// stopped. The state can be persisted and used with the UseResumeState hook
+// action, or recomputed when the request is restarted
+func (gs *GraphSync) LocalResumeState(ctx context.Context, root ipld.Link, selectorNode ipld.Node) (graphsync.ResumeState, error) {
+	sel, err := selector.ParseSelector(selectorNode)
+	if err != nil {
+		return graphsync.ResumeState{}, err
+	}
+	received := cid.NewSet()
+	lsys := gs.linkSystem
+	lsys.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		data, ok := gs.loadLocalBlock(lctx, lnk)
+		if !ok {
+			return nil, traversal.SkipMe{}
+		}
+		if asCidLink, ok := lnk.(cidlink.Link); ok {
+			received.Add(asCidLink.Cid)
+		}
+		return bytes.NewReader(data), nil
+	}
+	// blocks are verified as they are read
+	lsys.TrustedStorage = true
+
+	chooser := dagpb.AddSupportToChooser(basicnode.Chooser)
+	lctx := ipld.LinkContext{Ctx: ctx}
+	prototype, err := chooser(root, lctx)
+	if err != nil {
+		return graphsync.ResumeState{}, err
+	}
+	rootNode, err := lsys.Load(lctx, root, prototype)
+	if err != nil {
+		if _, ok := err.(traversal.SkipMe); ok {
+			return graphsync.ResumeState{Received: received}, nil
+		}
+		return graphsync.ResumeState{}, err
+	}
+	err = traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkSystem:                     lsys,
+			LinkTargetNodePrototypeChooser: chooser,
+		},
+	}.WalkAdv(rootNode, sel, func(traversal.Progress, ipld.Node, traversal.VisitReason) error { return nil })
+	if err != nil {
+		return graphsync.ResumeState{}, err
+	}
+	return graphsync.ResumeState{Received: received}, nil
+}
+
+// loadLocalBlock reads a block from the default store, returning false if it is
+// missing or does not match its link
+func (gs *GraphSync) loadLocalBlock(lctx ipld.LinkContext, lnk ipld.Link) ([]byte, bool) {
+	reader, err := gs.linkSystem.StorageReadOpener(lctx, lnk)
+	if err != nil {
+		return nil, false
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, false
+	}
+	if asCidLink, ok := lnk.(cidlink.Link); ok && !gs.linkSystem.TrustedStorage {
+		c, err := asCidLink.Cid.Prefix().Sum(data)
+		if err != nil || !c.Equals(asCidLink.Cid) {
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+// withLocalResumeState adds a resume extension for the blocks for the given
+// root and selector already in the default store
+func (gs *GraphSync) withLocalResumeState(ctx context.Context, root ipld.Link, selectorNode ipld.Node, extensions []graphsync.ExtensionData) ([]graphsync.ExtensionData, error) {
+	resumeState, err := gs.LocalResumeState(ctx, root, selectorNode)
+	if err != nil {
+		return nil, err
+	}
+	if resumeState.Received.Len() == 0 {
+		return extensions, nil
+	}
+	return append(extensions, graphsync.ExtensionData{
+		Name: graphsync.ExtensionResume,
+		Data: cidset.EncodeCidSet(resumeState.Received),
+	}), nil
+}
+
+// ResumeRequest restarts a request interrupted by a restart, using the same
+// request ID so its progress continues to be saved in the same place. The
+// progress last saved for the request in the store set with WithPersistence is
+// sent to the peer in a resume extension, so the blocks already received are
+// loaded from the local store rather than fetched again
+func (gs *GraphSync) ResumeRequest(ctx context.Context, p peer.ID, requestID graphsync.RequestID, root ipld.Link, selector ipld.Node, extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
+	if gs.progressStore == nil {
+		responseChan := make(chan graphsync.ResponseProgress)
+		close(responseChan)
+		return responseChan, errorChan(errors.New("no persistence store to resume requests from"))
+	}
+	state, ok, err := gs.progressStore.LoadProgress(requestID)
+	if err != nil {
+		responseChan := make(chan graphsync.ResponseProgress)
+		close(responseChan)
+		return responseChan, errorChan(err)
+	}
+	if ok && state.Received != nil && state.Received.Len() > 0 {
+		extensions = append(extensions[:len(extensions):len(extensions)], graphsync.ExtensionData{
+			Name: graphsync.ExtensionResume,
+			Data: cidset.EncodeCidSet(state.Received),
+		})
+	}
+	ctx = context.WithValue(ctx, graphsync.RequestIDContextKey{}, requestID)
+	return gs.Request(ctx, p, root, selector, extensions...)
+}
@@ -0,0 +1,156 @@
+package graphsync
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+// requestWithRetryPeers makes a request to the given peer, then to each of the
+// retry peers in turn while attempts end with a network error. Like
+// RequestWithFailover, blocks already received are not requested again and
+// nodes are never delivered twice. Errors are only delivered for the last
+// attempt, and if it ended with a network error, a RetryPeersFailedErr
+// describes every attempt
+func (gs *GraphSync) requestWithRetryPeers(ctx context.Context, p peer.ID, retryPeers graphsync.RetryPeers, root ipld.Link, selector ipld.Node, extensions []graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
+	peers := append([]peer.ID{p}, retryPeers.Peers...)
+	if retryPeers.MaxAttempts > 0 && retryPeers.MaxAttempts < len(peers) {
+		peers = peers[:retryPeers.MaxAttempts]
+	}
+	outgoingResponses := make(chan graphsync.ResponseProgress)
+	outgoingErrors := make(chan error)
+	go gs.runRetryPeers(ctx, peers, root, selector, extensions, outgoingResponses, outgoingErrors)
+	return outgoingResponses, outgoingErrors
+}
+
+// retryAttempt is the request to a single peer for a request with retry peers
+type retryAttempt struct {
+	p          peer.ID
+	errs       []error
+	networkErr error
+}
+
+func (gs *GraphSync) runRetryPeers(ctx context.Context,
+	peers []peer.ID,
+	root ipld.Link,
+	selector ipld.Node,
+	extensions []graphsync.ExtensionData,
+	outgoingResponses chan<- graphsync.ResponseProgress,
+	outgoingErrors chan<- error) {
+	defer close(outgoingErrors)
+
+	// responses are closed before errors are delivered, as callers often read
+	// every response before reading errors
+	errs := gs.retryPeers(ctx, peers, root, selector, extensions, outgoingResponses)
+	close(outgoingResponses)
+	for _, err := range errs {
+		select {
+		case outgoingErrors <- err:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// retryPeers makes the attempts for a request with retry peers, delivering
+// their responses, and returns the errors to deliver for the request
+func (gs *GraphSync) retryPeers(ctx context.Context,
+	peers []peer.ID,
+	root ipld.Link,
+	selector ipld.Node,
+	extensions []graphsync.ExtensionData,
+	outgoingResponses chan<- graphsync.ResponseProgress) []error {
+	// traversals are deterministic, so a node is identified by its path
+	delivered := make(map[string]struct{})
+	received := cid.NewSet()
+	var failed []graphsync.RequestAttemptErr
+	for i, p := range peers {
+		// the request id on ctx, if any, is only used for the first attempt, as
+		// a request id cannot be reused
+		requestID, ok := ctx.Value(graphsync.RequestIDContextKey{}).(graphsync.RequestID)
+		if !ok || i > 0 {
+			requestID = gs.requestManager.AllocateRequestID(p, root, selector)
+		}
+		attempt := &retryAttempt{p: p}
+		if !gs.runRetryAttempt(ctx, attempt, requestID, root, selector, withDoNotSendCids(extensions, received), delivered, received, outgoingResponses) {
+			return nil
+		}
+		// a request that completed before it was cancelled has no errors
+		if attempt.networkErr == nil || len(attempt.errs) == 0 || ctx.Err() != nil {
+			return attempt.errs
+		}
+		failed = append(failed, graphsync.RequestAttemptErr{Peer: p, Err: attempt.networkErr})
+		if i < len(peers)-1 {
+			log.Infow("graphsync request failed with network error, retrying with next peer", "peer", p, "next peer", peers[i+1], "error", attempt.networkErr)
+		}
+	}
+	return []error{graphsync.RetryPeersFailedErr{Attempts: failed}}
+}
+
+// runRetryAttempt makes the request to the attempt's peer, delivering nodes
+// that were not delivered by earlier attempts, and cancels the request if a
+// network error is reported for it. It returns false if ctx was cancelled while
+// delivering a node
+func (gs *GraphSync) runRetryAttempt(ctx context.Context,
+	attempt *retryAttempt,
+	requestID graphsync.RequestID,
+	root ipld.Link,
+	selector ipld.Node,
+	extensions []graphsync.ExtensionData,
+	delivered map[string]struct{},
+	received *cid.Set,
+	outgoingResponses chan<- graphsync.ResponseProgress) bool {
+	attemptCtx, cancel := context.WithCancel(context.WithValue(ctx, graphsync.RequestIDContextKey{}, requestID))
+	defer cancel()
+
+	networkErrs := make(chan error, 1)
+	unregister := gs.RegisterNetworkErrorListener(func(p peer.ID, request graphsync.RequestData, err error) {
+		if request.ID() != requestID {
+			return
+		}
+		select {
+		case networkErrs <- err:
+		default:
+		}
+	})
+	defer unregister()
+
+	responses, incomingErrors := gs.request(attemptCtx, attempt.p, root, selector, extensions...)
+	for responses != nil || incomingErrors != nil {
+		select {
+		case response, ok := <-responses:
+			if !ok {
+				responses = nil
+				continue
+			}
+			recordReceivedBlock(received, root, response)
+			path := response.Path.String()
+			if _, ok := delivered[path]; ok {
+				continue
+			}
+			delivered[path] = struct{}{}
+			select {
+			case outgoingResponses <- response:
+			case <-ctx.Done():
+				return false
+			}
+		case err, ok := <-incomingErrors:
+			if !ok {
+				incomingErrors = nil
+				continue
+			}
+			attempt.errs = append(attempt.errs, err)
+		case err := <-networkErrs:
+			// the request cannot finish, so stop it rather than wait for it to
+			// time out
+			attempt.networkErr = err
+			networkErrs = nil
+			cancel()
+		}
+	}
+	return true
+}
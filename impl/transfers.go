@@ -0,0 +1,42 @@
+package graphsync
+
+import (
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/transferstats"
+)
+
+// trackTransfers registers hooks and listeners that count blocks transferred
+// for each request and peer
+func (gs *GraphSync) trackTransfers(transferStats *transferstats.Tracker) {
+	gs.incomingBlockHooks.Register(func(p peer.ID, responseData graphsync.ResponseData, blockData graphsync.BlockData, hookActions graphsync.IncomingBlockHookActions) {
+		if blockData.BlockSizeOnWire() > 0 {
+			transferStats.RecordReceived(p, responseData.RequestID(), blockData.BlockSizeOnWire())
+		} else if blockData.BlockSize() > 0 {
+			transferStats.RecordLocal(p, responseData.RequestID(), blockData.BlockSize())
+		}
+	})
+	gs.outgoingBlockHooks.Register(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		if blockData.BlockSizeOnWire() > 0 {
+			transferStats.RecordQueued(p, requestData.ID(), blockData.BlockSizeOnWire())
+		}
+	})
+	gs.blockSentListeners.Register(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData) {
+		if blockData.BlockSizeOnWire() > 0 {
+			transferStats.RecordSent(p, requestData.ID(), blockData.BlockSizeOnWire())
+		}
+	})
+}
+
+// RequestTransferStats returns the blocks and bytes transferred so far for an
+// in progress outgoing request or incoming request
+func (gs *GraphSync) RequestTransferStats(requestID graphsync.RequestID) (graphsync.TransferStats, bool) {
+	return gs.transferStats.Request(requestID)
+}
+
+// PeerTransferStats returns the blocks and bytes transferred to and from a
+// connected peer. Counts are discarded when the peer disconnects
+func (gs *GraphSync) PeerTransferStats(p peer.ID) graphsync.TransferStats {
+	return gs.transferStats.Peer(p)
+}
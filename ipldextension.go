@@ -0,0 +1,101 @@
+package graphsync
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/node/bindnode"
+	"github.com/ipld/go-ipld-prime/schema"
+)
+
+// NewIPLDExtension builds extension data from an IPLD node, as it will be sent
+// on the wire. Typed nodes are sent as their representation. The node is
+// encoded as dag-cbor up front, so a node that cannot be sent fails here
+// rather than when the message is sent, and the extension holds a copy that
+// is unaffected by later changes to values the node wraps. A nil node sends
+// the extension with no data
+func NewIPLDExtension(name ExtensionName, node datamodel.Node) (ExtensionData, error) {
+	if node == nil {
+		return ExtensionData{Name: name}, nil
+	}
+	if typed, ok := node.(schema.TypedNode); ok {
+		node = typed.Representation()
+	}
+	var buf bytes.Buffer
+	if err := dagcbor.Encode(node, &buf); err != nil {
+		return ExtensionData{}, fmt.Errorf("encoding data for extension %s: %w", name, err)
+	}
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := dagcbor.Decode(nb, &buf); err != nil {
+		return ExtensionData{}, fmt.Errorf("decoding data for extension %s: %w", name, err)
+	}
+	return ExtensionData{Name: name, Data: nb.Build()}, nil
+}
+
+// DecodeIPLDExtension returns the data for an extension as an untyped IPLD
+// node, or nil if the extension has no data
+func DecodeIPLDExtension(ext ExtensionData) (datamodel.Node, error) {
+	if ext.Data == nil || ext.Data.IsNull() || ext.Data.IsAbsent() {
+		return nil, nil
+	}
+	if typed, ok := ext.Data.(schema.TypedNode); ok {
+		return typed.Representation(), nil
+	}
+	return ext.Data, nil
+}
+
+// IPLDExtensionCodec converts between extension data and Go values of a type
+// described by an IPLD schema, so hooks can send and read extensions without
+// handling IPLD nodes themselves
+type IPLDExtensionCodec struct {
+	name       ExtensionName
+	schemaType schema.Type
+	prototype  schema.TypedPrototype
+}
+
+// NewIPLDExtensionCodec returns a codec for the named extension whose data is
+// a value of the type ptrType points to, as described by schemaType. If
+// schemaType is nil, the schema is inferred from the Go type
+func NewIPLDExtensionCodec(name ExtensionName, ptrType interface{}, schemaType schema.Type) *IPLDExtensionCodec {
+	return &IPLDExtensionCodec{
+		name:       name,
+		schemaType: schemaType,
+		prototype:  bindnode.Prototype(ptrType, schemaType),
+	}
+}
+
+// Name returns the name of the extension the codec is for
+func (c *IPLDExtensionCodec) Name() ExtensionName {
+	return c.name
+}
+
+// Encode builds extension data from a pointer to a value of the codec's type
+func (c *IPLDExtensionCodec) Encode(ptrVal interface{}) (ext ExtensionData, err error) {
+	// bindnode panics on values that do not match the schema
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("encoding data for extension %s: %v", c.name, r)
+		}
+	}()
+	return NewIPLDExtension(c.name, bindnode.Wrap(ptrVal, c.schemaType))
+}
+
+// Decode reads extension data into a new value of the codec's type, returning
+// a pointer to it. Extensions with no data decode to nil
+func (c *IPLDExtensionCodec) Decode(ext ExtensionData) (interface{}, error) {
+	if ext.Name != c.name {
+		return nil, fmt.Errorf("cannot decode extension %s as %s", ext.Name, c.name)
+	}
+	data, err := DecodeIPLDExtension(ext)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	nb := c.prototype.Representation().NewBuilder()
+	if err := datamodel.Copy(data, nb); err != nil {
+		return nil, fmt.Errorf("decoding data for extension %s: %w", c.name, err)
+	}
+	return bindnode.Unwrap(nb.Build()), nil
+}
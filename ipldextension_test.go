@@ -0,0 +1,85 @@
+package graphsync_test
+
+import (
+	"testing"
+
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+const extensionName = graphsync.ExtensionName("graphsync/test-deal")
+
+type dealProposal struct {
+	DealID uint64
+	Label  string
+}
+
+func TestIPLDExtension(t *testing.T) {
+	node := fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(ma fluent.MapAssembler) {
+		ma.AssembleEntry("DealID").AssignInt(12345)
+	})
+	ext, err := graphsync.NewIPLDExtension(extensionName, node)
+	require.NoError(t, err)
+	require.Equal(t, extensionName, ext.Name)
+	decoded, err := graphsync.DecodeIPLDExtension(ext)
+	require.NoError(t, err)
+	require.True(t, ipld.DeepEqual(node, decoded))
+
+	// no data
+	ext, err = graphsync.NewIPLDExtension(extensionName, nil)
+	require.NoError(t, err)
+	require.Nil(t, ext.Data)
+	decoded, err = graphsync.DecodeIPLDExtension(ext)
+	require.NoError(t, err)
+	require.Nil(t, decoded)
+	decoded, err = graphsync.DecodeIPLDExtension(graphsync.ExtensionData{Name: extensionName, Data: datamodel.Null})
+	require.NoError(t, err)
+	require.Nil(t, decoded)
+}
+
+func TestIPLDExtensionCodec(t *testing.T) {
+	ts, err := ipld.LoadSchemaBytes([]byte(`
+		type DealProposal struct {
+			DealID Int
+			Label String
+		}
+	`))
+	require.NoError(t, err)
+	codec := graphsync.NewIPLDExtensionCodec(extensionName, (*dealProposal)(nil), ts.TypeByName("DealProposal"))
+	require.Equal(t, extensionName, codec.Name())
+
+	proposal := &dealProposal{DealID: 12345, Label: "deal-12345"}
+	ext, err := codec.Encode(proposal)
+	require.NoError(t, err)
+
+	// make sure the extension survives a trip over the wire
+	data, err := ipld.Encode(ext.Data, dagcbor.Encode)
+	require.NoError(t, err)
+	wire, err := ipld.Decode(data, dagcbor.Decode)
+	require.NoError(t, err)
+
+	decoded, err := codec.Decode(graphsync.ExtensionData{Name: extensionName, Data: wire})
+	require.NoError(t, err)
+	require.Equal(t, proposal, decoded)
+
+	// data that does not match the schema
+	_, err = codec.Decode(graphsync.ExtensionData{Name: extensionName, Data: basicnode.NewString("not a deal")})
+	require.Error(t, err)
+	_, err = codec.Encode(&struct{ Other bool }{true})
+	require.Error(t, err)
+
+	// extensions with another name
+	_, err = codec.Decode(graphsync.ExtensionData{Name: "graphsync/other", Data: wire})
+	require.Error(t, err)
+
+	// no data
+	decoded, err = codec.Decode(graphsync.ExtensionData{Name: extensionName})
+	require.NoError(t, err)
+	require.Nil(t, decoded)
+}
@@ -0,0 +1,225 @@
+package ipldutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/ipld/go-ipld-prime"
+)
+
+// prefetchedBlocksPerWorker bounds how many prefetched blocks may wait to be
+// used for each worker, so reads for links a selector never follows do not
+// pile up
+const prefetchedBlocksPerWorker = 4
+
+var errPrefetchDropped = errors.New("prefetch dropped")
+
+// Prefetcher reads blocks for a traversal ahead of time. Each time the
+// traversal decodes a block, the blocks it links to are queued to be read by
+// background workers, so they are likely ready by the time the traversal
+// reaches them. Prefetch must be set as the traversal's BlockDecoded callback,
+// and Load as its loader. Links are read with the link context the traversal
+// would give them, with the path, link node and parent node of the link. The traversal still loads blocks one at a time and in order;
+// only the storage reads overlap. When the prefetch window is full, the oldest
+// prefetched block is dropped and read again if the traversal reaches it
+type Prefetcher struct {
+	ctx        context.Context
+	lsys       ipld.LinkSystem
+	maxPending int
+	queue      chan *prefetch
+
+	lk      sync.Mutex
+	pending map[ipld.Link]*prefetch
+	order   []ipld.Link
+}
+
+type prefetch struct {
+	lnk     ipld.Link
+	lnkCtx  ipld.LinkContext
+	done    chan struct{}
+	dropped bool
+	data    []byte
+	err     error
+}
+
+// NewPrefetcher starts a prefetcher with the given number of workers reading
+// from the link system's storage. The workers stop when ctx is cancelled
+func NewPrefetcher(ctx context.Context, lsys ipld.LinkSystem, workers int) *Prefetcher {
+	maxPending := workers * prefetchedBlocksPerWorker
+	p := &Prefetcher{
+		ctx:        ctx,
+		lsys:       lsys,
+		maxPending: maxPending,
+		queue:      make(chan *prefetch, maxPending),
+		pending:    make(map[ipld.Link]*prefetch),
+	}
+	for i := 0; i < workers; i++ {
+		go p.run()
+	}
+	return p
+}
+
+// Load is a BlockReadOpener for the traversal. It returns the prefetched block
+// for the link when there is one, and otherwise reads the block itself. Errors
+// are always from reading the block directly, so they are the same as without
+// prefetching
+func (p *Prefetcher) Load(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+	data, ok := p.take(lnkCtx.Ctx, lnk)
+	if !ok {
+		var err error
+		data, err = p.read(lnkCtx, lnk)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bytes.NewBuffer(data), nil
+}
+
+func (p *Prefetcher) run() {
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case pf := <-p.queue:
+			if p.isDropped(pf) {
+				pf.err = errPrefetchDropped
+			} else {
+				pf.data, pf.err = p.read(pf.lnkCtx, pf.lnk)
+			}
+			close(pf.done)
+		}
+	}
+}
+
+func (p *Prefetcher) read(lnkCtx ipld.LinkContext, lnk ipld.Link) ([]byte, error) {
+	reader, err := p.lsys.StorageReadOpener(lnkCtx, lnk)
+	if err != nil {
+		return nil, err
+	}
+	if buf, ok := reader.(*bytes.Buffer); ok {
+		return buf.Bytes(), nil
+	}
+	return ioutil.ReadAll(reader)
+}
+
+// take removes the prefetch for the link, waiting for it if it is still being
+// read. It returns false if the block was not prefetched successfully
+func (p *Prefetcher) take(ctx context.Context, lnk ipld.Link) ([]byte, bool) {
+	p.lk.Lock()
+	pf, ok := p.pending[lnk]
+	if ok {
+		p.remove(lnk)
+	}
+	p.lk.Unlock()
+	if !ok {
+		return nil, false
+	}
+	if ctx == nil {
+		ctx = p.ctx
+	}
+	select {
+	case <-pf.done:
+	case <-ctx.Done():
+		return nil, false
+	case <-p.ctx.Done():
+		return nil, false
+	}
+	return pf.data, pf.err == nil
+}
+
+// Prefetch queues reads for the links in a block the traversal has decoded,
+// given the link context the block was loaded with
+func (p *Prefetcher) Prefetch(lnkCtx ipld.LinkContext, nd ipld.Node) {
+	if lnkCtx.Ctx == nil {
+		lnkCtx.Ctx = p.ctx
+	}
+	links := appendLinks(nil, lnkCtx.Ctx, lnkCtx.LinkPath, nd, nil)
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	for _, link := range links {
+		if _, ok := p.pending[link.lnk]; ok {
+			continue
+		}
+		if len(p.pending) >= p.maxPending {
+			p.pending[p.order[0]].dropped = true
+			p.remove(p.order[0])
+		}
+		pf := &prefetch{lnk: link.lnk, lnkCtx: link.lnkCtx, done: make(chan struct{})}
+		select {
+		case p.queue <- pf:
+			p.pending[link.lnk] = pf
+			p.order = append(p.order, link.lnk)
+		default:
+			// the workers are behind on reads for blocks already dropped
+			return
+		}
+	}
+}
+
+type linkToPrefetch struct {
+	lnk    ipld.Link
+	lnkCtx ipld.LinkContext
+}
+
+// appendLinks appends the links in the node at the given path, in the order a
+// traversal visits them, with the link context a traversal would load each
+// one with
+func appendLinks(links []linkToPrefetch, ctx context.Context, path ipld.Path, nd ipld.Node, parent ipld.Node) []linkToPrefetch {
+	switch nd.Kind() {
+	case ipld.Kind_Link:
+		lnk, err := nd.AsLink()
+		if err != nil {
+			return links
+		}
+		return append(links, linkToPrefetch{lnk, ipld.LinkContext{
+			Ctx:        ctx,
+			LinkPath:   path,
+			LinkNode:   nd,
+			ParentNode: parent,
+		}})
+	case ipld.Kind_Map:
+		itr := nd.MapIterator()
+		for !itr.Done() {
+			k, v, err := itr.Next()
+			if err != nil {
+				return links
+			}
+			key, err := k.AsString()
+			if err != nil {
+				continue
+			}
+			links = appendLinks(links, ctx, path.AppendSegment(ipld.PathSegmentOfString(key)), v, nd)
+		}
+	case ipld.Kind_List:
+		itr := nd.ListIterator()
+		for !itr.Done() {
+			i, v, err := itr.Next()
+			if err != nil {
+				return links
+			}
+			links = appendLinks(links, ctx, path.AppendSegment(ipld.PathSegmentOfInt(i)), v, nd)
+		}
+	}
+	return links
+}
+
+func (p *Prefetcher) isDropped(pf *prefetch) bool {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	return pf.dropped
+}
+
+// remove must be called with the lock held
+func (p *Prefetcher) remove(lnk ipld.Link) {
+	delete(p.pending, lnk)
+	for i, pendingLnk := range p.order {
+		if pendingLnk == lnk {
+			p.order = append(p.order[:i], p.order[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package ipldutil
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestPrefetcher(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	store := make(map[ipld.Link][]byte)
+	root, leaves := buildWideDAG(t, testutil.NewTestStore(store), 4, 8)
+
+	sequential := newSlowStore(store, time.Millisecond)
+	expectedLoads, err := traverseWithLoader(ctx, t, root, sequential.lsys.StorageReadOpener, nil)
+	require.NoError(t, err)
+	require.Len(t, expectedLoads, 1+4+4*8)
+	require.EqualValues(t, 1, sequential.maxInFlight)
+
+	prefetched := newSlowStore(store, time.Millisecond)
+	prefetchCtx, prefetchCancel := context.WithCancel(ctx)
+	prefetcher := NewPrefetcher(prefetchCtx, prefetched.lsys, 8)
+	loads, err := traverseWithLoader(ctx, t, root, prefetcher.Load, prefetcher.Prefetch)
+	prefetchCancel()
+	require.NoError(t, err)
+	require.Equal(t, expectedLoads, loads)
+	require.Greater(t, atomic.LoadInt32(&prefetched.maxInFlight), int32(1))
+	// prefetched blocks are read with the link context the traversal uses
+	require.Equal(t, sequential.readPaths(), prefetched.readPaths())
+
+	// missing blocks fail the same way with or without prefetching
+	delete(store, leaves[5])
+	expectedLoads, expectedErr := traverseWithLoader(ctx, t, root, newSlowStore(store, 0).lsys.StorageReadOpener, nil)
+	prefetchCtx, prefetchCancel = context.WithCancel(ctx)
+	defer prefetchCancel()
+	prefetcher = NewPrefetcher(prefetchCtx, newSlowStore(store, 0).lsys, 8)
+	loads, err = traverseWithLoader(ctx, t, root, prefetcher.Load, prefetcher.Prefetch)
+	require.Equal(t, expectedLoads, loads)
+	require.Equal(t, expectedErr, err)
+}
+
+func BenchmarkPrefetcher(b *testing.B) {
+	ctx := context.Background()
+	store := make(map[ipld.Link][]byte)
+	root, _ := buildWideDAG(b, testutil.NewTestStore(store), 8, 16)
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			slow := newSlowStore(store, time.Millisecond)
+			for i := 0; i < b.N; i++ {
+				loader := slow.lsys.StorageReadOpener
+				var blockDecoded func(ipld.LinkContext, ipld.Node)
+				prefetchCtx, prefetchCancel := context.WithCancel(ctx)
+				if workers > 1 {
+					prefetcher := NewPrefetcher(prefetchCtx, slow.lsys, workers)
+					loader = prefetcher.Load
+					blockDecoded = prefetcher.Prefetch
+				}
+				_, err := traverseWithLoader(ctx, b, root, loader, blockDecoded)
+				prefetchCancel()
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+// traverseWithLoader traverses everything under root, loading blocks with the
+// given loader the way the responder does, and returns the links loaded in
+// order
+func traverseWithLoader(ctx context.Context, t testing.TB, root ipld.Link, loader ipld.BlockReadOpener, blockDecoded func(ipld.LinkContext, ipld.Node)) ([]ipld.Link, error) {
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	sel := ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	traverser := TraversalBuilder{
+		Root:         root,
+		Selector:     sel,
+		BlockDecoded: blockDecoded,
+	}.Start(ctx)
+	defer traverser.Shutdown(ctx)
+	var loads []ipld.Link
+	for {
+		isComplete, err := traverser.IsComplete()
+		if isComplete {
+			return loads, err
+		}
+		lnk, lnkCtx := traverser.CurrentRequest()
+		loads = append(loads, lnk)
+		reader, err := loader(lnkCtx, lnk)
+		if err != nil {
+			traverser.Error(traversal.SkipMe{})
+			continue
+		}
+		require.NoError(t, traverser.Advance(reader))
+	}
+}
+
+// buildWideDAG stores a root linking to the given number of middle nodes,
+// each linking to the given number of leaves, and returns the root and leaves
+func buildWideDAG(t testing.TB, lsys ipld.LinkSystem, middles int, leavesPerMiddle int) (ipld.Link, []ipld.Link) {
+	lp := cidlink.LinkPrototype{Prefix: cid.Prefix{
+		Version:  1,
+		Codec:    0x71,
+		MhType:   0x13,
+		MhLength: 4,
+	}}
+	store := func(node ipld.Node) ipld.Link {
+		lnk, err := lsys.Store(ipld.LinkContext{}, lp, node)
+		require.NoError(t, err)
+		return lnk
+	}
+	var leaves []ipld.Link
+	var middleLinks []ipld.Link
+	for i := 0; i < middles; i++ {
+		var children []ipld.Link
+		for j := 0; j < leavesPerMiddle; j++ {
+			leaf := store(basicnode.NewBytes(testutil.RandomBytes(100)))
+			children = append(children, leaf)
+			leaves = append(leaves, leaf)
+		}
+		middleLinks = append(middleLinks, store(linkList(children)))
+	}
+	return store(linkList(middleLinks)), leaves
+}
+
+func linkList(links []ipld.Link) ipld.Node {
+	return fluent.MustBuildList(basicnode.Prototype.List, int64(len(links)), func(la fluent.ListAssembler) {
+		for _, lnk := range links {
+			la.AssembleValue().AssignLink(lnk)
+		}
+	})
+}
+
+// slowStore reads from a block store with a fixed delay, and records the most
+// reads in flight at once and the path each link was read at
+type slowStore struct {
+	lsys        ipld.LinkSystem
+	inFlight    int32
+	maxInFlight int32
+
+	pathsLk sync.Mutex
+	paths   map[ipld.Link]string
+}
+
+func newSlowStore(store map[ipld.Link][]byte, latency time.Duration) *slowStore {
+	ss := &slowStore{paths: make(map[ipld.Link]string)}
+	underlying := testutil.NewTestStore(store)
+	ss.lsys = underlying
+	ss.lsys.StorageReadOpener = func(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		ss.pathsLk.Lock()
+		ss.paths[lnk] = lnkCtx.LinkPath.String()
+		ss.pathsLk.Unlock()
+		inFlight := atomic.AddInt32(&ss.inFlight, 1)
+		defer atomic.AddInt32(&ss.inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&ss.maxInFlight)
+			if inFlight <= max || atomic.CompareAndSwapInt32(&ss.maxInFlight, max, inFlight) {
+				break
+			}
+		}
+		time.Sleep(latency)
+		return underlying.StorageReadOpener(lnkCtx, lnk)
+	}
+	return ss
+}
+
+func (ss *slowStore) readPaths() map[ipld.Link]string {
+	ss.pathsLk.Lock()
+	defer ss.pathsLk.Unlock()
+	paths := make(map[ipld.Link]string, len(ss.paths))
+	for lnk, path := range ss.paths {
+		paths[lnk] = path
+	}
+	return paths
+}
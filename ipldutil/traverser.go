@@ -49,6 +49,14 @@ type TraversalBuilder struct {
 	Chooser       traversal.LinkTargetNodePrototypeChooser
 	Budget        *traversal.Budget
 	PanicCallback panics.CallBackFn
+	// MaxLinkDepth limits how many links deep from the root the traversal
+	// may go. A value of 0 = infinity, or no limit
+	MaxLinkDepth int64
+	// ParseSelector compiles the selector. Defaults to selector.ParseSelector
+	ParseSelector func(ipld.Node) (selector.Selector, error)
+	// BlockDecoded, if set, is called with each block the traversal loads,
+	// once it is decoded and verified and before the traversal walks it
+	BlockDecoded func(ipld.LinkContext, ipld.Node)
 }
 
 // Traverser is an interface for performing a selector traversal that operates iteratively --
@@ -93,21 +101,26 @@ type nextResponse struct {
 func (tb TraversalBuilder) Start(parentCtx context.Context) Traverser {
 	ctx, cancel := context.WithCancel(parentCtx)
 	t := &traverser{
-		ctx:          ctx,
-		cancel:       cancel,
-		root:         tb.Root,
-		selector:     tb.Selector,
-		linkSystem:   tb.LinkSystem,
-		budget:       tb.Budget,
-		responses:    make(chan nextResponse),
-		stopped:      make(chan struct{}),
-		panicHandler: panics.MakeHandler(tb.PanicCallback),
+		ctx:           ctx,
+		cancel:        cancel,
+		root:          tb.Root,
+		selector:      tb.Selector,
+		linkSystem:    tb.LinkSystem,
+		budget:        tb.Budget,
+		maxLinkDepth:  tb.MaxLinkDepth,
+		parseSelector: tb.ParseSelector,
+		responses:     make(chan nextResponse),
+		stopped:       make(chan struct{}),
+		panicHandler:  panics.MakeHandler(tb.PanicCallback),
 	}
 	if tb.Visitor != nil {
 		t.visitor = tb.Visitor
 	} else {
 		t.visitor = defaultVisitor
 	}
+	if t.parseSelector == nil {
+		t.parseSelector = selector.ParseSelector
+	}
 	if tb.Chooser != nil {
 		t.chooser = tb.Chooser
 	} else {
@@ -123,6 +136,11 @@ func (tb TraversalBuilder) Start(parentCtx context.Context) Traverser {
 		t.linkSystem.HasherChooser = defaultLinkSystem.HasherChooser
 	}
 	t.linkSystem.StorageReadOpener = t.loader
+	if tb.BlockDecoded != nil {
+		t.blockDecoded = tb.BlockDecoded
+		t.reifier = tb.LinkSystem.NodeReifier
+		t.linkSystem.NodeReifier = t.nodeReifier
+	}
 	t.start()
 	return t
 }
@@ -130,16 +148,26 @@ func (tb TraversalBuilder) Start(parentCtx context.Context) Traverser {
 // traverser is a class to perform a selector traversal that stops every time a new block is loaded
 // and waits for manual input (in the form of advance or error)
 type traverser struct {
-	blocksCount  int
-	ctx          context.Context
-	cancel       context.CancelFunc
-	root         ipld.Link
-	selector     ipld.Node
-	visitor      traversal.AdvVisitFn
-	linkSystem   ipld.LinkSystem
-	chooser      traversal.LinkTargetNodePrototypeChooser
-	budget       *traversal.Budget
-	panicHandler panics.PanicHandler
+	blocksCount   int
+	ctx           context.Context
+	cancel        context.CancelFunc
+	root          ipld.Link
+	selector      ipld.Node
+	visitor       traversal.AdvVisitFn
+	linkSystem    ipld.LinkSystem
+	chooser       traversal.LinkTargetNodePrototypeChooser
+	budget        *traversal.Budget
+	maxLinkDepth  int64
+	panicHandler  panics.PanicHandler
+	parseSelector func(ipld.Node) (selector.Selector, error)
+	blockDecoded  func(ipld.LinkContext, ipld.Node)
+	reifier       ipld.NodeReifier
+
+	// ancestors holds the path and depth of each loaded block the traversal
+	// has not finished yet, from the root down to the most recently loaded
+	// block. The traversal is depth first, so a block is finished once a link
+	// outside it is loaded, and is dropped then
+	ancestors []loadedBlock
 
 	// stateMu is held while a block is being loaded.
 	// It is released when a StorageReadOpener callback is received,
@@ -166,6 +194,14 @@ func (t *traverser) NBlocksTraversed() int {
 }
 
 func (t *traverser) loader(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+	if t.maxLinkDepth > 0 {
+		depth := t.linkDepth(lnkCtx.LinkPath)
+		if depth > t.maxLinkDepth {
+			// the lock is still held, and is released when the error completes the traversal
+			return nil, &traversal.ErrBudgetExceeded{BudgetKind: "depth", Path: lnkCtx.LinkPath, Link: lnk}
+		}
+		t.ancestors = append(t.ancestors, loadedBlock{lnkCtx.LinkPath, depth})
+	}
 	// A StorageReadOpener call came in; update the state and release the lock.
 	// We can't simply unlock the mutex inside the <-t.responses case,
 	// as then we'd deadlock with the other side trying to send.
@@ -186,6 +222,55 @@ func (t *traverser) loader(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, e
 	}
 }
 
+// nodeReifier is called by the link system with each decoded block. It hands
+// the block to the BlockDecoded callback, then to the link system's own
+// reifier if there is one
+func (t *traverser) nodeReifier(lnkCtx ipld.LinkContext, nd ipld.Node, lsys *ipld.LinkSystem) (ipld.Node, error) {
+	t.blockDecoded(lnkCtx, nd)
+	if t.reifier == nil {
+		return nd, nil
+	}
+	return t.reifier(lnkCtx, nd, lsys)
+}
+
+// loadedBlock is the path and depth of a block loaded in a traversal
+type loadedBlock struct {
+	path  ipld.Path
+	depth int64
+}
+
+// linkDepth returns the depth of the link at the given path, which is one more
+// than the depth of the block containing it -- the closest unfinished block
+// whose path is a prefix of this one. Blocks the link is not in are finished,
+// and are dropped from the ancestors. The root is at depth 0
+func (t *traverser) linkDepth(linkPath ipld.Path) int64 {
+	if linkPath.Len() == 0 {
+		return 0
+	}
+	for len(t.ancestors) > 0 {
+		parent := t.ancestors[len(t.ancestors)-1]
+		if isPathPrefix(parent.path, linkPath) {
+			return parent.depth + 1
+		}
+		t.ancestors = t.ancestors[:len(t.ancestors)-1]
+	}
+	return 1
+}
+
+// isPathPrefix returns true if prefix is a strict prefix of path
+func isPathPrefix(prefix ipld.Path, path ipld.Path) bool {
+	if prefix.Len() >= path.Len() {
+		return false
+	}
+	segments := path.Segments()
+	for i, segment := range prefix.Segments() {
+		if !segment.Equals(segments[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 func (t *traverser) writeDone(err error) {
 	t.isDone = true
 	t.completionErr = err
@@ -226,7 +311,7 @@ func (t *traverser) start() {
 			return
 		}
 
-		sel, err := selector.ParseSelector(t.selector)
+		sel, err := t.parseSelector(t.selector)
 		if err != nil {
 			t.writeDone(err)
 			return
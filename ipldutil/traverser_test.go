@@ -139,6 +139,66 @@ func TestTraverser(t *testing.T) {
 		checkTraverseSequence(ctx, t, traverser, []blocks.Block{}, &traversal.ErrBudgetExceeded{BudgetKind: "link", Link: blockChain.TipLink})
 	})
 
+	t.Run("errors correctly, with max link depth", func(t *testing.T) {
+		store := make(map[ipld.Link][]byte)
+		persistence := testutil.NewTestStore(store)
+		blockChain := testutil.SetupBlockChain(ctx, t, persistence, 100, 10)
+		traverser := TraversalBuilder{
+			Root:       blockChain.TipLink,
+			Selector:   blockChain.Selector(),
+			Chooser:    blockChain.Chooser,
+			LinkSystem: persistence,
+			Visitor: func(tp traversal.Progress, node ipld.Node, r traversal.VisitReason) error {
+				return nil
+			},
+			MaxLinkDepth: 3,
+		}.Start(ctx)
+		for _, blk := range blockChain.Blocks(0, 4) {
+			lnk, _ := traverser.CurrentRequest()
+			require.Equal(t, blk.Cid(), lnk.(cidlink.Link).Cid)
+			require.NoError(t, traverser.Advance(bytes.NewBuffer(blk.RawData())))
+		}
+		isComplete, err := traverser.IsComplete()
+		require.True(t, isComplete)
+		var budgetErr *traversal.ErrBudgetExceeded
+		require.True(t, errors.As(err, &budgetErr))
+		require.Equal(t, "depth", budgetErr.BudgetKind)
+		require.Equal(t, blockChain.LinkTipIndex(4), budgetErr.Link)
+	})
+
+	t.Run("traverses correctly, with max link depth, only tracking unfinished blocks", func(t *testing.T) {
+		testdata := testutil.NewTestIPLDTree()
+		ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+		sel := ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+		tr := TraversalBuilder{
+			Root:         testdata.RootNodeLnk,
+			Selector:     sel,
+			MaxLinkDepth: 2,
+		}.Start(ctx)
+		// the root and the middle block it is in stay tracked for each leaf, but
+		// finished blocks are dropped
+		expectedAncestors := []int{1, 2, 3, 3, 3, 3, 2, 3, 2}
+		for i, blk := range []blocks.Block{
+			testdata.RootBlock,
+			testdata.MiddleListBlock,
+			testdata.LeafAlphaBlock,
+			testdata.LeafAlphaBlock,
+			testdata.LeafBetaBlock,
+			testdata.LeafAlphaBlock,
+			testdata.MiddleMapBlock,
+			testdata.LeafAlphaBlock,
+			testdata.LeafAlphaBlock,
+		} {
+			lnk, _ := tr.CurrentRequest()
+			require.Equal(t, blk.Cid(), lnk.(cidlink.Link).Cid)
+			require.Len(t, tr.(*traverser).ancestors, expectedAncestors[i])
+			require.NoError(t, tr.Advance(bytes.NewBuffer(blk.RawData())))
+		}
+		isComplete, err := tr.IsComplete()
+		require.True(t, isComplete)
+		require.NoError(t, err)
+	})
+
 	t.Run("started with shutdown context, then calls methods after done", func(t *testing.T) {
 		cancelledCtx, cancel := context.WithCancel(ctx)
 		cancel()
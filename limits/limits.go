@@ -0,0 +1,79 @@
+package limits
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/listeners"
+)
+
+// Recorder counts how often each limit is hit, and notifies listeners the
+// first time each limit is hit in a reporting interval. A nil Recorder ignores
+// hits, so components can run without one. It is safe for concurrent use
+type Recorder struct {
+	interval  time.Duration
+	listeners *listeners.LimitHitListeners
+
+	lk      sync.Mutex
+	records map[graphsync.LimitName]*record
+}
+
+type record struct {
+	hits    uint64
+	lastHit time.Time
+	// start of the interval in which listeners were last notified
+	notified time.Time
+}
+
+// NewRecorder returns a recorder that notifies the given listeners at most
+// once per interval for each limit
+func NewRecorder(interval time.Duration, listeners *listeners.LimitHitListeners) *Recorder {
+	return &Recorder{
+		interval:  interval,
+		listeners: listeners,
+		records:   make(map[graphsync.LimitName]*record),
+	}
+}
+
+// Hit records that the named limit was hit. Listeners are notified on a
+// separate goroutine, so components may record hits while holding locks
+func (r *Recorder) Hit(name graphsync.LimitName, scope graphsync.LimitScope) {
+	if r == nil {
+		return
+	}
+	now := time.Now()
+	r.lk.Lock()
+	rec, ok := r.records[name]
+	if !ok {
+		rec = &record{}
+		r.records[name] = rec
+	}
+	rec.hits++
+	rec.lastHit = now
+	notify := rec.notified.IsZero() || now.Sub(rec.notified) >= r.interval
+	if notify {
+		rec.notified = now
+	}
+	event := graphsync.LimitHitEvent{Name: name, Scope: scope, Hits: rec.hits, Timestamp: now}
+	r.lk.Unlock()
+
+	if notify && r.listeners != nil {
+		go r.listeners.NotifyLimitHitListeners(event)
+	}
+}
+
+// Hits returns how many times the named limit has been hit, and when it was
+// last hit
+func (r *Recorder) Hits(name graphsync.LimitName) (uint64, time.Time) {
+	if r == nil {
+		return 0, time.Time{}
+	}
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	rec, ok := r.records[name]
+	if !ok {
+		return 0, time.Time{}
+	}
+	return rec.hits, rec.lastHit
+}
@@ -0,0 +1,62 @@
+package limits
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/listeners"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestRecorder(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	limitHitListeners := listeners.NewLimitHitListeners()
+	events := make(chan graphsync.LimitHitEvent, 10)
+	limitHitListeners.Register(func(event graphsync.LimitHitEvent) {
+		events <- event
+	})
+	recorder := NewRecorder(100*time.Millisecond, limitHitListeners)
+
+	hits, lastHit := recorder.Hits(graphsync.LimitMaxMemoryResponder)
+	require.Equal(t, uint64(0), hits)
+	require.True(t, lastHit.IsZero())
+
+	recorder.Hit(graphsync.LimitMaxMemoryResponder, graphsync.LimitScopeGlobal)
+	var event graphsync.LimitHitEvent
+	testutil.AssertReceive(ctx, t, events, &event, "should notify on first hit")
+	require.Equal(t, graphsync.LimitMaxMemoryResponder, event.Name)
+	require.Equal(t, graphsync.LimitScopeGlobal, event.Scope)
+	require.Equal(t, uint64(1), event.Hits)
+
+	// further hits in the same interval are counted without notifying
+	recorder.Hit(graphsync.LimitMaxMemoryResponder, graphsync.LimitScopeGlobal)
+	recorder.Hit(graphsync.LimitMaxMemoryResponder, graphsync.LimitScopeGlobal)
+	hits, lastHit = recorder.Hits(graphsync.LimitMaxMemoryResponder)
+	require.Equal(t, uint64(3), hits)
+	require.False(t, lastHit.IsZero())
+
+	// each limit is notified separately
+	recorder.Hit(graphsync.LimitMaxMemoryPerPeerResponder, graphsync.LimitScopePeer)
+	testutil.AssertReceive(ctx, t, events, &event, "should notify on first hit of another limit")
+	require.Equal(t, graphsync.LimitMaxMemoryPerPeerResponder, event.Name)
+	testutil.AssertChannelEmpty(t, events, "should notify once per interval")
+
+	time.Sleep(100 * time.Millisecond)
+	recorder.Hit(graphsync.LimitMaxMemoryResponder, graphsync.LimitScopeGlobal)
+	testutil.AssertReceive(ctx, t, events, &event, "should notify again in the next interval")
+	require.Equal(t, graphsync.LimitMaxMemoryResponder, event.Name)
+	require.Equal(t, uint64(4), event.Hits)
+
+	// a nil recorder ignores hits
+	var nilRecorder *Recorder
+	nilRecorder.Hit(graphsync.LimitMaxMemoryResponder, graphsync.LimitScopeGlobal)
+	hits, _ = nilRecorder.Hits(graphsync.LimitMaxMemoryResponder)
+	require.Equal(t, uint64(0), hits)
+}
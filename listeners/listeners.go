@@ -5,11 +5,12 @@ import (
 	peer "github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/hookset"
 )
 
 // CompletedResponseListeners is a set of listeners for completed responses
 type CompletedResponseListeners struct {
-	pubSub *pubsub.PubSub
+	hooks *hookset.HookSet
 }
 
 type internalCompletedResponseEvent struct {
@@ -27,22 +28,27 @@ func completedResponseDispatcher(event pubsub.Event, subscriberFn pubsub.Subscri
 
 // NewCompletedResponseListeners returns a new list of completed response listeners
 func NewCompletedResponseListeners() *CompletedResponseListeners {
-	return &CompletedResponseListeners{pubSub: pubsub.New(completedResponseDispatcher)}
+	return &CompletedResponseListeners{hooks: hookset.New(completedResponseDispatcher)}
 }
 
 // Register registers an listener for completed responses
 func (crl *CompletedResponseListeners) Register(listener graphsync.OnResponseCompletedListener) graphsync.UnregisterHookFunc {
-	return graphsync.UnregisterHookFunc(crl.pubSub.Subscribe(listener))
+	return crl.hooks.Register(listener)
+}
+
+// UnregisterAll removes all registered listeners
+func (crl *CompletedResponseListeners) UnregisterAll() {
+	crl.hooks.UnregisterAll()
 }
 
 // NotifyCompletedListeners runs notifies all completed listeners that a response has completed
 func (crl *CompletedResponseListeners) NotifyCompletedListeners(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode) {
-	_ = crl.pubSub.Publish(internalCompletedResponseEvent{p, request, status})
+	_ = crl.hooks.Publish(internalCompletedResponseEvent{p, request, status})
 }
 
 // RequestorCancelledListeners is a set of listeners for when requestors cancel
 type RequestorCancelledListeners struct {
-	pubSub *pubsub.PubSub
+	hooks *hookset.HookSet
 }
 
 type internalRequestorCancelledEvent struct {
@@ -59,22 +65,27 @@ func requestorCancelledDispatcher(event pubsub.Event, subscriberFn pubsub.Subscr
 
 // NewRequestorCancelledListeners returns a new list of listeners for when requestors cancel
 func NewRequestorCancelledListeners() *RequestorCancelledListeners {
-	return &RequestorCancelledListeners{pubSub: pubsub.New(requestorCancelledDispatcher)}
+	return &RequestorCancelledListeners{hooks: hookset.New(requestorCancelledDispatcher)}
 }
 
 // Register registers an listener for completed responses
 func (rcl *RequestorCancelledListeners) Register(listener graphsync.OnRequestorCancelledListener) graphsync.UnregisterHookFunc {
-	return graphsync.UnregisterHookFunc(rcl.pubSub.Subscribe(listener))
+	return rcl.hooks.Register(listener)
+}
+
+// UnregisterAll removes all registered listeners
+func (rcl *RequestorCancelledListeners) UnregisterAll() {
+	rcl.hooks.UnregisterAll()
 }
 
 // NotifyCancelledListeners notifies all listeners that a requestor cancelled a response
 func (rcl *RequestorCancelledListeners) NotifyCancelledListeners(p peer.ID, request graphsync.RequestData) {
-	_ = rcl.pubSub.Publish(internalRequestorCancelledEvent{p, request})
+	_ = rcl.hooks.Publish(internalRequestorCancelledEvent{p, request})
 }
 
 // RequestProcessingListeners is a set of listeners for when requests begin processing
 type RequestProcessingListeners struct {
-	pubSub *pubsub.PubSub
+	hooks *hookset.HookSet
 }
 
 type internalRequestProcessingEvent struct {
@@ -92,22 +103,103 @@ func requestProcessingDispatcher(event pubsub.Event, subscriberFn pubsub.Subscri
 
 // NewRequestProcessingListeners returns a new list of listeners for when requestors cancel
 func NewRequestProcessingListeners() *RequestProcessingListeners {
-	return &RequestProcessingListeners{pubSub: pubsub.New(requestProcessingDispatcher)}
+	return &RequestProcessingListeners{hooks: hookset.New(requestProcessingDispatcher)}
 }
 
 // Register registers an listener for responses that are processing
 func (rpl *RequestProcessingListeners) Register(listener graphsync.OnRequestProcessingListener) graphsync.UnregisterHookFunc {
-	return graphsync.UnregisterHookFunc(rpl.pubSub.Subscribe(listener))
+	return rpl.hooks.Register(listener)
+}
+
+// UnregisterAll removes all registered listeners
+func (rpl *RequestProcessingListeners) UnregisterAll() {
+	rpl.hooks.UnregisterAll()
 }
 
 // NotifyRequestProcessingListeners notifies all listeners that a requestor cancelled a response
 func (rpl *RequestProcessingListeners) NotifyRequestProcessingListeners(p peer.ID, request graphsync.RequestData, inProgressRequestCount int) {
-	_ = rpl.pubSub.Publish(internalRequestProcessingEvent{p, request, inProgressRequestCount})
+	_ = rpl.hooks.Publish(internalRequestProcessingEvent{p, request, inProgressRequestCount})
+}
+
+// RequestQueuedHooks is a set of hooks for when incoming requests are queued
+type RequestQueuedHooks struct {
+	hooks *hookset.HookSet
+}
+
+type internalRequestQueuedEvent struct {
+	p       peer.ID
+	request graphsync.RequestData
+}
+
+func requestQueuedDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+	ie := event.(internalRequestQueuedEvent)
+	hook := subscriberFn.(graphsync.OnIncomingRequestQueuedHook)
+	hook(ie.p, ie.request)
+	return nil
+}
+
+// NewRequestQueuedHooks returns a new list of hooks for when requests are queued
+func NewRequestQueuedHooks() *RequestQueuedHooks {
+	return &RequestQueuedHooks{hooks: hookset.New(requestQueuedDispatcher)}
+}
+
+// Register registers a hook for requests that are queued
+func (rqh *RequestQueuedHooks) Register(hook graphsync.OnIncomingRequestQueuedHook) graphsync.UnregisterHookFunc {
+	return rqh.hooks.Register(hook)
+}
+
+// UnregisterAll removes all registered hooks
+func (rqh *RequestQueuedHooks) UnregisterAll() {
+	rqh.hooks.UnregisterAll()
+}
+
+// ProcessRequestQueuedHooks notifies all hooks that a request was queued
+func (rqh *RequestQueuedHooks) ProcessRequestQueuedHooks(p peer.ID, request graphsync.RequestData) {
+	_ = rqh.hooks.Publish(internalRequestQueuedEvent{p, request})
+}
+
+// CompletedResponseHooks is a set of hooks for when outgoing requests finish
+type CompletedResponseHooks struct {
+	hooks *hookset.HookSet
+}
+
+type internalCompletedResponseHookEvent struct {
+	p          peer.ID
+	request    graphsync.RequestData
+	status     graphsync.ResponseStatusCode
+	extensions []graphsync.ExtensionData
+}
+
+func completedResponseHookDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+	ie := event.(internalCompletedResponseHookEvent)
+	hook := subscriberFn.(graphsync.OnCompletedResponseHook)
+	hook(ie.p, ie.request, ie.status, ie.extensions)
+	return nil
+}
+
+// NewCompletedResponseHooks returns a new list of hooks for when outgoing requests finish
+func NewCompletedResponseHooks() *CompletedResponseHooks {
+	return &CompletedResponseHooks{hooks: hookset.New(completedResponseHookDispatcher)}
+}
+
+// Register registers a hook for outgoing requests that finish
+func (crh *CompletedResponseHooks) Register(hook graphsync.OnCompletedResponseHook) graphsync.UnregisterHookFunc {
+	return crh.hooks.Register(hook)
+}
+
+// UnregisterAll removes all registered hooks
+func (crh *CompletedResponseHooks) UnregisterAll() {
+	crh.hooks.UnregisterAll()
+}
+
+// ProcessCompletedResponseHooks notifies all hooks that an outgoing request finished
+func (crh *CompletedResponseHooks) ProcessCompletedResponseHooks(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode, extensions []graphsync.ExtensionData) {
+	_ = crh.hooks.Publish(internalCompletedResponseHookEvent{p, request, status, extensions})
 }
 
 // BlockSentListeners is a set of listeners for when requestors cancel
 type BlockSentListeners struct {
-	pubSub *pubsub.PubSub
+	hooks *hookset.HookSet
 }
 
 type internalBlockSentEvent struct {
@@ -125,22 +217,27 @@ func blockSentDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) e
 
 // NewBlockSentListeners returns a new list of listeners for when requestors cancel
 func NewBlockSentListeners() *BlockSentListeners {
-	return &BlockSentListeners{pubSub: pubsub.New(blockSentDispatcher)}
+	return &BlockSentListeners{hooks: hookset.New(blockSentDispatcher)}
 }
 
 // Register registers an listener for completed responses
 func (bsl *BlockSentListeners) Register(listener graphsync.OnBlockSentListener) graphsync.UnregisterHookFunc {
-	return graphsync.UnregisterHookFunc(bsl.pubSub.Subscribe(listener))
+	return bsl.hooks.Register(listener)
+}
+
+// UnregisterAll removes all registered listeners
+func (bsl *BlockSentListeners) UnregisterAll() {
+	bsl.hooks.UnregisterAll()
 }
 
 // NotifyBlockSentListeners notifies all listeners that a requestor cancelled a response
 func (bsl *BlockSentListeners) NotifyBlockSentListeners(p peer.ID, request graphsync.RequestData, block graphsync.BlockData) {
-	_ = bsl.pubSub.Publish(internalBlockSentEvent{p, request, block})
+	_ = bsl.hooks.Publish(internalBlockSentEvent{p, request, block})
 }
 
 // NetworkErrorListeners is a set of listeners for when requestors cancel
 type NetworkErrorListeners struct {
-	pubSub *pubsub.PubSub
+	hooks *hookset.HookSet
 }
 
 type internalNetworkErrorEvent struct {
@@ -158,22 +255,27 @@ func networkErrorDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn
 
 // NewNetworkErrorListeners returns a new list of listeners for when requestors cancel
 func NewNetworkErrorListeners() *NetworkErrorListeners {
-	return &NetworkErrorListeners{pubSub: pubsub.New(networkErrorDispatcher)}
+	return &NetworkErrorListeners{hooks: hookset.New(networkErrorDispatcher)}
 }
 
 // Register registers an listener for completed responses
 func (nel *NetworkErrorListeners) Register(listener graphsync.OnNetworkErrorListener) graphsync.UnregisterHookFunc {
-	return graphsync.UnregisterHookFunc(nel.pubSub.Subscribe(listener))
+	return nel.hooks.Register(listener)
+}
+
+// UnregisterAll removes all registered listeners
+func (nel *NetworkErrorListeners) UnregisterAll() {
+	nel.hooks.UnregisterAll()
 }
 
 // NotifyNetworkErrorListeners notifies all listeners that a requestor cancelled a response
 func (nel *NetworkErrorListeners) NotifyNetworkErrorListeners(p peer.ID, request graphsync.RequestData, err error) {
-	_ = nel.pubSub.Publish(internalNetworkErrorEvent{p, request, err})
+	_ = nel.hooks.Publish(internalNetworkErrorEvent{p, request, err})
 }
 
 // NetworkReceiverErrorListeners is a set of listeners for network errors on the receiving side
 type NetworkReceiverErrorListeners struct {
-	pubSub *pubsub.PubSub
+	hooks *hookset.HookSet
 }
 
 type receiverNetworkErrorEvent struct {
@@ -190,15 +292,133 @@ func receiverNetworkErrorDispatcher(event pubsub.Event, subscriberFn pubsub.Subs
 
 // NewReceiverNetworkErrorListeners returns a new list of listeners for receiving errors
 func NewReceiverNetworkErrorListeners() *NetworkReceiverErrorListeners {
-	return &NetworkReceiverErrorListeners{pubSub: pubsub.New(receiverNetworkErrorDispatcher)}
+	return &NetworkReceiverErrorListeners{hooks: hookset.New(receiverNetworkErrorDispatcher)}
 }
 
 // Register registers an listener for completed responses
 func (nel *NetworkReceiverErrorListeners) Register(listener graphsync.OnReceiverNetworkErrorListener) graphsync.UnregisterHookFunc {
-	return graphsync.UnregisterHookFunc(nel.pubSub.Subscribe(listener))
+	return nel.hooks.Register(listener)
+}
+
+// UnregisterAll removes all registered listeners
+func (nel *NetworkReceiverErrorListeners) UnregisterAll() {
+	nel.hooks.UnregisterAll()
 }
 
 // NotifyReceiverNetworkErrorListeners notifies all listeners that a receive connection failed
 func (nel *NetworkReceiverErrorListeners) NotifyNetworkErrorListeners(p peer.ID, err error) {
-	_ = nel.pubSub.Publish(receiverNetworkErrorEvent{p, err})
+	_ = nel.hooks.Publish(receiverNetworkErrorEvent{p, err})
+}
+
+// LimitHitListeners is a set of listeners for when limits are hit
+type LimitHitListeners struct {
+	hooks *hookset.HookSet
+}
+
+func limitHitDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+	ie := event.(graphsync.LimitHitEvent)
+	listener := subscriberFn.(graphsync.OnLimitHitListener)
+	listener(ie)
+	return nil
+}
+
+// NewLimitHitListeners returns a new list of listeners for when limits are hit
+func NewLimitHitListeners() *LimitHitListeners {
+	return &LimitHitListeners{hooks: hookset.New(limitHitDispatcher)}
+}
+
+// Register registers a listener for when limits are hit
+func (lhl *LimitHitListeners) Register(listener graphsync.OnLimitHitListener) graphsync.UnregisterHookFunc {
+	return lhl.hooks.Register(listener)
+}
+
+// UnregisterAll removes all registered listeners
+func (lhl *LimitHitListeners) UnregisterAll() {
+	lhl.hooks.UnregisterAll()
+}
+
+// NotifyLimitHitListeners notifies all listeners that a limit was hit
+func (lhl *LimitHitListeners) NotifyLimitHitListeners(event graphsync.LimitHitEvent) {
+	_ = lhl.hooks.Publish(event)
+}
+
+// NegotiationCompleteListeners is a set of listeners for when peers report the
+// extensions they support
+type NegotiationCompleteListeners struct {
+	hooks *hookset.HookSet
+}
+
+type internalNegotiationCompleteEvent struct {
+	p         peer.ID
+	supported []graphsync.ExtensionName
+}
+
+func negotiationCompleteDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+	ie := event.(internalNegotiationCompleteEvent)
+	listener := subscriberFn.(graphsync.OnNegotiationCompleteListener)
+	listener(ie.p, ie.supported)
+	return nil
+}
+
+// NewNegotiationCompleteListeners returns a new list of listeners for when
+// peers report the extensions they support
+func NewNegotiationCompleteListeners() *NegotiationCompleteListeners {
+	return &NegotiationCompleteListeners{hooks: hookset.New(negotiationCompleteDispatcher)}
+}
+
+// Register registers a listener for when peers report the extensions they support
+func (ncl *NegotiationCompleteListeners) Register(listener graphsync.OnNegotiationCompleteListener) graphsync.UnregisterHookFunc {
+	return ncl.hooks.Register(listener)
+}
+
+// UnregisterAll removes all registered listeners
+func (ncl *NegotiationCompleteListeners) UnregisterAll() {
+	ncl.hooks.UnregisterAll()
+}
+
+// NotifyNegotiationCompleteListeners notifies all listeners that a peer
+// reported the extensions it supports
+func (ncl *NegotiationCompleteListeners) NotifyNegotiationCompleteListeners(p peer.ID, supported []graphsync.ExtensionName) {
+	_ = ncl.hooks.Publish(internalNegotiationCompleteEvent{p, supported})
+}
+
+// PeerActivityListeners is a set of listeners for when requests start and stop
+// being in progress with peers
+type PeerActivityListeners struct {
+	hooks *hookset.HookSet
+}
+
+type internalPeerActivityEvent struct {
+	p      peer.ID
+	active bool
+}
+
+func peerActivityDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+	ie := event.(internalPeerActivityEvent)
+	listener := subscriberFn.(graphsync.OnPeerActivityListener)
+	listener(ie.p, ie.active)
+	return nil
+}
+
+// NewPeerActivityListeners returns a new list of listeners for when requests
+// start and stop being in progress with peers
+func NewPeerActivityListeners() *PeerActivityListeners {
+	return &PeerActivityListeners{hooks: hookset.New(peerActivityDispatcher)}
+}
+
+// Register registers a listener for when requests start and stop being in
+// progress with peers
+func (pal *PeerActivityListeners) Register(listener graphsync.OnPeerActivityListener) graphsync.UnregisterHookFunc {
+	return pal.hooks.Register(listener)
+}
+
+// UnregisterAll removes all registered listeners
+func (pal *PeerActivityListeners) UnregisterAll() {
+	pal.hooks.UnregisterAll()
+}
+
+// NotifyPeerActivityListeners notifies all listeners that requests started or
+// stopped being in progress with a peer
+func (pal *PeerActivityListeners) NotifyPeerActivityListeners(p peer.ID, active bool) {
+	_ = pal.hooks.Publish(internalPeerActivityEvent{p, active})
 }
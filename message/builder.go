@@ -19,6 +19,7 @@ type Builder struct {
 	outgoingResponses  map[graphsync.RequestID][]GraphSyncLinkMetadatum
 	extensions         map[graphsync.RequestID][]graphsync.ExtensionData
 	requests           map[graphsync.RequestID]GraphSyncRequest
+	blockCompression   graphsync.CompressionCodec
 }
 
 // NewBuilder generates a new Builder.
@@ -53,6 +54,12 @@ func (b *Builder) AddExtensionData(requestID graphsync.RequestID, extension grap
 	}
 }
 
+// SetBlockCompression compresses the blocks in the message with the given
+// codec when it is sent
+func (b *Builder) SetBlockCompression(codec graphsync.CompressionCodec) {
+	b.blockCompression = codec
+}
+
 // BlockSize returns the total size of all blocks in this message
 func (b *Builder) BlockSize() uint64 {
 	return b.blkSize
@@ -113,9 +120,7 @@ func (b *Builder) Build() (GraphSyncMessage, error) {
 		status, isComplete := b.completedResponses[requestID]
 		responses[requestID] = NewResponse(requestID, responseCode(status, isComplete), linkMap, b.extensions[requestID]...)
 	}
-	return GraphSyncMessage{
-		b.requests, responses, b.outgoingBlocks,
-	}, nil
+	return NewMessage(b.requests, responses, b.outgoingBlocks).WithBlockCompression(b.blockCompression), nil
 }
 
 func responseCode(status graphsync.ResponseStatusCode, isComplete bool) graphsync.ResponseStatusCode {
@@ -86,12 +86,22 @@ type GraphSyncBlock struct {
 	Data   []byte
 }
 
+// GraphSyncCompressedBlock is a container for representing compressed block
+// data for bindnode, it's decompressed and converted to a block.Block by the
+// message translation layer
+type GraphSyncCompressedBlock struct {
+	Prefix []byte
+	Codec  string
+	Data   []byte
+}
+
 // GraphSyncMessage is a container for representing extension data for bindnode,
 // it's converted to a message.GraphSyncMessage by the message translation layer
 type GraphSyncMessage struct {
-	Requests  *[]GraphSyncRequest
-	Responses *[]GraphSyncResponse
-	Blocks    *[]GraphSyncBlock
+	Requests         *[]GraphSyncRequest
+	Responses        *[]GraphSyncResponse
+	Blocks           *[]GraphSyncBlock
+	CompressedBlocks *[]GraphSyncCompressedBlock
 }
 
 type GraphSyncMessageRoot struct {
@@ -3,6 +3,7 @@ package message
 import (
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 
 	blocks "github.com/ipfs/go-block-format"
@@ -42,13 +43,19 @@ type GraphSyncRequest struct {
 	requestType graphsync.RequestType
 }
 
+// SelectorString returns the request's selector encoded as DAG-JSON, or "nil"
+// if the request has no selector
+func (gsr GraphSyncRequest) SelectorString() string {
+	if gsr.selector == nil {
+		return "nil"
+	}
+	byts, _ := ipld.Encode(gsr.selector, dagjson.Encode)
+	return string(byts)
+}
+
 // String returns a human-readable form of a GraphSyncRequest
 func (gsr GraphSyncRequest) String() string {
-	sel := "nil"
-	if gsr.selector != nil {
-		byts, _ := ipld.Encode(gsr.selector, dagjson.Encode)
-		sel = string(byts)
-	}
+	sel := gsr.SelectorString()
 	extStr := strings.Builder{}
 	for _, name := range gsr.ExtensionNames() {
 		extStr.WriteString(string(name))
@@ -101,12 +108,27 @@ func (gsr GraphSyncResponse) String() string {
 	)
 }
 
+// Version identifies the wire format a message was sent or received in
+type Version int
+
+const (
+	// VersionUnknown is the version of a message that has not been sent or
+	// received over the wire
+	VersionUnknown Version = iota
+	// Version1 is the protobuf format of the /ipfs/graphsync/1.0.0 protocol
+	Version1
+	// Version2 is the DAG-CBOR format of the /ipfs/graphsync/2.0.0 protocol
+	Version2
+)
+
 // GraphSyncMessage is the internal representation form of a message sent or
 // received over the wire
 type GraphSyncMessage struct {
-	requests  map[graphsync.RequestID]GraphSyncRequest
-	responses map[graphsync.RequestID]GraphSyncResponse
-	blocks    map[cid.Cid]blocks.Block
+	requests         map[graphsync.RequestID]GraphSyncRequest
+	responses        map[graphsync.RequestID]GraphSyncResponse
+	blocks           map[cid.Cid]blocks.Block
+	version          Version
+	blockCompression graphsync.CompressionCodec
 }
 
 // NewMessage generates a new message containing the provided requests,
@@ -116,7 +138,33 @@ func NewMessage(
 	responses map[graphsync.RequestID]GraphSyncResponse,
 	blocks map[cid.Cid]blocks.Block,
 ) GraphSyncMessage {
-	return GraphSyncMessage{requests, responses, blocks}
+	return GraphSyncMessage{requests, responses, blocks, VersionUnknown, nil}
+}
+
+// Version returns the wire format version negotiated with the peer the message
+// was received from, or VersionUnknown for messages built locally
+func (gsm GraphSyncMessage) Version() Version {
+	return gsm.version
+}
+
+// WithVersion returns a copy of the message marked as sent or received in the
+// given wire format version
+func (gsm GraphSyncMessage) WithVersion(version Version) GraphSyncMessage {
+	gsm.version = version
+	return gsm
+}
+
+// BlockCompression returns the codec the message's blocks are compressed with
+// when sent, or nil if they are sent uncompressed
+func (gsm GraphSyncMessage) BlockCompression() graphsync.CompressionCodec {
+	return gsm.blockCompression
+}
+
+// WithBlockCompression returns a copy of the message whose blocks are
+// compressed with the given codec when sent, in wire formats that support it
+func (gsm GraphSyncMessage) WithBlockCompression(codec graphsync.CompressionCodec) GraphSyncMessage {
+	gsm.blockCompression = codec
+	return gsm
 }
 
 // String returns a human-readable (multi-line) form of a GraphSyncMessage and
@@ -267,7 +315,7 @@ func (gsm GraphSyncMessage) Clone() GraphSyncMessage {
 	for cid, block := range gsm.blocks {
 		blocks[cid] = block
 	}
-	return GraphSyncMessage{requests, responses, blocks}
+	return GraphSyncMessage{requests, responses, blocks, gsm.version, gsm.blockCompression}
 }
 
 // ID Returns the request ID for this Request
@@ -304,6 +352,29 @@ func (gsr GraphSyncRequest) ExtensionNames() []graphsync.ExtensionName {
 	return extNames
 }
 
+// ApplicationExtensions returns the extensions included in this request other
+// than those graphsync itself uses, sorted by name
+func (gsr GraphSyncRequest) ApplicationExtensions() []graphsync.ExtensionData {
+	internal := map[graphsync.ExtensionName]struct{}{
+		graphsync.ExtensionSupportedExtensions: {},
+		graphsync.ExtensionBlockCompression:    {},
+	}
+	for _, name := range graphsync.KnownExtensions() {
+		internal[name] = struct{}{}
+	}
+	var extensions []graphsync.ExtensionData
+	for name, data := range gsr.extensions {
+		if _, ok := internal[graphsync.ExtensionName(name)]; ok {
+			continue
+		}
+		extensions = append(extensions, graphsync.ExtensionData{Name: graphsync.ExtensionName(name), Data: data})
+	}
+	sort.Slice(extensions, func(i, j int) bool {
+		return extensions[i].Name < extensions[j].Name
+	})
+	return extensions
+}
+
 // RequestType returns the type of this request (new, cancel, update, etc.)
 func (gsr GraphSyncRequest) Type() graphsync.RequestType { return gsr.requestType }
 
@@ -370,6 +441,25 @@ func (gsr GraphSyncRequest) ReplaceExtensions(extensions []graphsync.ExtensionDa
 	return req
 }
 
+// ReplacePriority creates a new request identical to this one, but with the
+// given priority
+func (gsr GraphSyncRequest) ReplacePriority(priority graphsync.Priority) GraphSyncRequest {
+	return newRequest(gsr.id, gsr.root, gsr.selector, priority, gsr.requestType, gsr.extensions)
+}
+
+// RemoveExtensions creates a new request identical to this one, but without
+// the extensions with the given names
+func (gsr GraphSyncRequest) RemoveExtensions(names []graphsync.ExtensionName) GraphSyncRequest {
+	extensions := make(map[string]datamodel.Node, len(gsr.extensions))
+	for name, data := range gsr.extensions {
+		extensions[name] = data
+	}
+	for _, name := range names {
+		delete(extensions, string(name))
+	}
+	return newRequest(gsr.id, gsr.root, gsr.selector, gsr.priority, gsr.requestType, extensions)
+}
+
 // MergeExtensions merges the given list of extensions to produce a new request with the combination of the old request
 // plus the new extensions. When an old extension and a new extension are both present, mergeFunc is called to produce
 // the result
@@ -0,0 +1,349 @@
+package v1
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-msgio"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/message"
+	pb "github.com/ipfs/go-graphsync/message/v1/pb"
+)
+
+type v1RequestKey struct {
+	p  peer.ID
+	id int32
+}
+
+// requestIDMap maps between request IDs and the integer ids v1 peers use
+type requestIDMap struct {
+	fromV1Map map[v1RequestKey]graphsync.RequestID
+	toV1Map   map[graphsync.RequestID]int32
+}
+
+func newRequestIDMap() requestIDMap {
+	return requestIDMap{
+		fromV1Map: make(map[v1RequestKey]graphsync.RequestID),
+		toV1Map:   make(map[graphsync.RequestID]int32),
+	}
+}
+
+// MessageHandler is used to hold per-peer state for each connection. The v1
+// protocol identifies requests with integers rather than UUIDs, so the handler
+// maps between the two for each peer
+type MessageHandler struct {
+	mapLock sync.Mutex
+	// each host can have multiple peerIDs, so our integer requestID mapping for
+	// protocol v1.X needs to be a combo of peerID and requestID. Requests we
+	// make and requests peers make are numbered independently, so each gets
+	// its own mapping
+	outgoing  requestIDMap
+	incoming  requestIDMap
+	nextIntID int32
+}
+
+// NewMessageHandler instantiates a new MessageHandler instance
+func NewMessageHandler() *MessageHandler {
+	return &MessageHandler{
+		outgoing: newRequestIDMap(),
+		incoming: newRequestIDMap(),
+	}
+}
+
+// FromNet can read a network stream to deserialized a GraphSyncMessage
+func (mh *MessageHandler) FromNet(p peer.ID, r io.Reader) (message.GraphSyncMessage, error) {
+	reader := msgio.NewVarintReaderSize(r, network.MessageSizeMax)
+	return mh.FromMsgReader(p, reader)
+}
+
+// FromMsgReader can deserialize a protobuf message into a GraphySyncMessage
+func (mh *MessageHandler) FromMsgReader(p peer.ID, r msgio.Reader) (message.GraphSyncMessage, error) {
+	msg, err := r.ReadMsg()
+	if err != nil {
+		return message.GraphSyncMessage{}, err
+	}
+
+	var pbm pb.Message
+	err = pbm.Unmarshal(msg)
+	r.ReleaseMsg(msg)
+	if err != nil {
+		return message.GraphSyncMessage{}, err
+	}
+
+	return mh.fromProto(p, &pbm)
+}
+
+// toProto converts a GraphSyncMessage to its pb.Message equivalent
+func (mh *MessageHandler) toProto(p peer.ID, gsm message.GraphSyncMessage) (*pb.Message, error) {
+	mh.mapLock.Lock()
+	defer mh.mapLock.Unlock()
+
+	pbm := new(pb.Message)
+	requests := gsm.Requests()
+	pbm.Requests = make([]*pb.Message_Request, 0, len(requests))
+	for _, request := range requests {
+		var selector []byte
+		var err error
+		if request.Selector() != nil {
+			selector, err = ipld.Encode(request.Selector(), dagcbor.Encode)
+			if err != nil {
+				return nil, err
+			}
+		}
+		ext, err := toEncodedExtensions(request, nil)
+		if err != nil {
+			return nil, err
+		}
+		var root []byte
+		if request.Root().Defined() {
+			root = request.Root().Bytes()
+		}
+		pbm.Requests = append(pbm.Requests, &pb.Message_Request{
+			Id:         mh.toV1ID(&mh.outgoing, p, request.ID()),
+			Root:       root,
+			Selector:   selector,
+			Priority:   int32(request.Priority()),
+			Cancel:     request.Type() == graphsync.RequestTypeCancel,
+			Update:     request.Type() == graphsync.RequestTypeUpdate,
+			Extensions: ext,
+		})
+	}
+
+	responses := gsm.Responses()
+	pbm.Responses = make([]*pb.Message_Response, 0, len(responses))
+	for _, response := range responses {
+		ext, err := toEncodedExtensions(response, response.Metadata())
+		if err != nil {
+			return nil, err
+		}
+		pbm.Responses = append(pbm.Responses, &pb.Message_Response{
+			Id:         mh.toV1ID(&mh.incoming, p, response.RequestID()),
+			Status:     int32(response.Status()),
+			Extensions: ext,
+		})
+		if response.Status().IsTerminal() {
+			mh.incoming.remove(p, response.RequestID())
+		}
+	}
+
+	blocks := gsm.Blocks()
+	pbm.Data = make([]*pb.Message_Block, 0, len(blocks))
+	for _, b := range blocks {
+		pbm.Data = append(pbm.Data, &pb.Message_Block{
+			Prefix: b.Cid().Prefix().Bytes(),
+			Data:   b.RawData(),
+		})
+	}
+	return pbm, nil
+}
+
+// ToNet writes a GraphSyncMessage in its v1 protobuf format to a writer,
+// prefixed with a length uvar
+func (mh *MessageHandler) ToNet(p peer.ID, gsm message.GraphSyncMessage, w io.Writer) error {
+	msg, err := mh.toProto(p, gsm)
+	if err != nil {
+		return err
+	}
+	body := msg.Marshal(nil)
+	out := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(body))
+	n := binary.PutUvarint(out, uint64(len(body)))
+	_, err = w.Write(append(out[:n], body...))
+	return err
+}
+
+// Mapping from a pb.Message object to a GraphSyncMessage object
+func (mh *MessageHandler) fromProto(p peer.ID, pbm *pb.Message) (message.GraphSyncMessage, error) {
+	mh.mapLock.Lock()
+	defer mh.mapLock.Unlock()
+
+	requests := make(map[graphsync.RequestID]message.GraphSyncRequest, len(pbm.GetRequests()))
+	for _, req := range pbm.GetRequests() {
+		if req == nil {
+			return message.GraphSyncMessage{}, errors.New("request is nil")
+		}
+		id := mh.fromV1ID(&mh.incoming, p, req.Id)
+
+		if req.Cancel {
+			requests[id] = message.NewCancelRequest(id)
+			continue
+		}
+
+		exts, _, err := fromEncodedExtensions(req.GetExtensions())
+		if err != nil {
+			return message.GraphSyncMessage{}, err
+		}
+
+		if req.Update {
+			requests[id] = message.NewUpdateRequest(id, exts...)
+			continue
+		}
+
+		root, err := cid.Cast(req.Root)
+		if err != nil {
+			return message.GraphSyncMessage{}, err
+		}
+
+		var selector datamodel.Node
+		if len(req.Selector) > 0 {
+			selector, err = ipld.Decode(req.Selector, dagcbor.Decode)
+			if err != nil {
+				return message.GraphSyncMessage{}, err
+			}
+		}
+
+		requests[id] = message.NewRequest(id, root, selector, graphsync.Priority(req.Priority), exts...)
+	}
+
+	responses := make(map[graphsync.RequestID]message.GraphSyncResponse, len(pbm.GetResponses()))
+	for _, res := range pbm.GetResponses() {
+		if res == nil {
+			return message.GraphSyncMessage{}, errors.New("response is nil")
+		}
+		id := mh.fromV1ID(&mh.outgoing, p, res.Id)
+		exts, metadata, err := fromEncodedExtensions(res.GetExtensions())
+		if err != nil {
+			return message.GraphSyncMessage{}, err
+		}
+		status := graphsync.ResponseStatusCode(res.Status)
+		responses[id] = message.NewResponse(id, status, metadata, exts...)
+		if status.IsTerminal() {
+			mh.outgoing.remove(p, id)
+		}
+	}
+
+	blks := make(map[cid.Cid]blocks.Block, len(pbm.GetData()))
+	for _, b := range pbm.GetData() {
+		if b == nil {
+			return message.GraphSyncMessage{}, errors.New("block is nil")
+		}
+
+		pref, err := cid.PrefixFromBytes(b.Prefix)
+		if err != nil {
+			return message.GraphSyncMessage{}, err
+		}
+
+		c, err := pref.Sum(b.Data)
+		if err != nil {
+			return message.GraphSyncMessage{}, err
+		}
+
+		blk, err := blocks.NewBlockWithCid(b.Data, c)
+		if err != nil {
+			return message.GraphSyncMessage{}, err
+		}
+
+		blks[blk.Cid()] = blk
+	}
+
+	return message.NewMessage(requests, responses, blks).WithVersion(message.Version1), nil
+}
+
+// toEncodedExtensions encodes extension data as DAG-CBOR bytes, adding the
+// link metadata for responses as an extension since v1 has no metadata field
+func toEncodedExtensions(part message.MessagePartWithExtensions, linkMetadata graphsync.LinkMetadata) (map[string][]byte, error) {
+	names := part.ExtensionNames()
+	out := make(map[string][]byte, len(names))
+	for _, name := range names {
+		data, ok := part.Extension(name)
+		if !ok || data == nil {
+			out[string(name)] = nil
+			continue
+		}
+		byts, err := ipld.Encode(data, dagcbor.Encode)
+		if err != nil {
+			return nil, err
+		}
+		out[string(name)] = byts
+	}
+	if linkMetadata != nil && linkMetadata.Length() > 0 {
+		byts, err := ipld.Encode(encodeMetadata(linkMetadata), dagcbor.Encode)
+		if err != nil {
+			return nil, err
+		}
+		out[string(extensionMetadata)] = byts
+	}
+	return out, nil
+}
+
+// fromEncodedExtensions decodes DAG-CBOR extension data, separating out the
+// link metadata extension
+func fromEncodedExtensions(in map[string][]byte) ([]graphsync.ExtensionData, []message.GraphSyncLinkMetadatum, error) {
+	out := make([]graphsync.ExtensionData, 0, len(in))
+	var md []message.GraphSyncLinkMetadatum
+	for name, data := range in {
+		var node datamodel.Node
+		if len(data) > 0 {
+			var err error
+			node, err = ipld.Decode(data, dagcbor.Decode)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if name == string(extensionMetadata) {
+			if node == nil {
+				continue
+			}
+			var err error
+			md, err = decodeMetadata(node)
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		out = append(out, graphsync.ExtensionData{Name: graphsync.ExtensionName(name), Data: node})
+	}
+	return out, md, nil
+}
+
+// toV1ID returns the integer id a v1 peer knows a request by, assigning a new
+// one if the request has not been seen before
+func (mh *MessageHandler) toV1ID(ids *requestIDMap, p peer.ID, id graphsync.RequestID) int32 {
+	iid, ok := ids.toV1Map[id]
+	if !ok {
+		// the counter wraps around in a long lived node, so skip ids still
+		// used by open requests to the peer
+		for {
+			iid = mh.nextIntID
+			mh.nextIntID++
+			if _, inUse := ids.fromV1Map[v1RequestKey{p, iid}]; !inUse {
+				break
+			}
+		}
+		ids.toV1Map[id] = iid
+		ids.fromV1Map[v1RequestKey{p, iid}] = id
+	}
+	return iid
+}
+
+// fromV1ID returns the request ID for an integer id used by a v1 peer,
+// assigning a new one if the peer has not used the id before
+func (mh *MessageHandler) fromV1ID(ids *requestIDMap, p peer.ID, iid int32) graphsync.RequestID {
+	key := v1RequestKey{p, iid}
+	id, ok := ids.fromV1Map[key]
+	if !ok {
+		id = graphsync.NewRequestID()
+		ids.fromV1Map[key] = id
+		ids.toV1Map[id] = iid
+	}
+	return id
+}
+
+// remove forgets a request once its final response is sent or received
+func (ids requestIDMap) remove(p peer.ID, id graphsync.RequestID) {
+	iid, ok := ids.toV1Map[id]
+	if !ok {
+		return
+	}
+	delete(ids.toV1Map, id)
+	delete(ids.fromV1Map, v1RequestKey{p, iid})
+}
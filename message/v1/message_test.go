@@ -0,0 +1,245 @@
+package v1
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestToNetFromNetEquivalency(t *testing.T) {
+	root := testutil.GenerateCids(1)[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	extensionName := graphsync.ExtensionName("graphsync/awesome")
+	extension := graphsync.ExtensionData{
+		Name: extensionName,
+		Data: basicnode.NewBytes(testutil.RandomBytes(100)),
+	}
+	id := graphsync.NewRequestID()
+	priority := graphsync.Priority(rand.Int31())
+	requester := peer.ID("requester")
+	responder := peer.ID("responder")
+	requesterHandler := NewMessageHandler()
+	responderHandler := NewMessageHandler()
+
+	// send a request
+	builder := message.NewBuilder()
+	builder.AddRequest(message.NewRequest(id, root, selector, priority, extension))
+	gsm, err := builder.Build()
+	require.NoError(t, err)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, requesterHandler.ToNet(responder, gsm, buf), "did not serialize protobuf message")
+	deserialized, err := responderHandler.FromNet(requester, buf)
+	require.NoError(t, err, "did not deserialize protobuf message")
+	require.Equal(t, message.Version1, deserialized.Version())
+
+	deserializedRequests := deserialized.Requests()
+	require.Len(t, deserializedRequests, 1, "did not add request to deserialized message")
+	deserializedRequest := deserializedRequests[0]
+	extensionData, found := deserializedRequest.Extension(extensionName)
+	require.Equal(t, graphsync.RequestTypeNew, deserializedRequest.Type())
+	require.Equal(t, priority, deserializedRequest.Priority())
+	require.Equal(t, root.String(), deserializedRequest.Root().String())
+	require.Equal(t, selector, deserializedRequest.Selector())
+	require.True(t, found)
+	require.Equal(t, extension.Data, extensionData)
+
+	// respond with blocks and metadata, using the id the responder knows the
+	// request by
+	responderID := deserializedRequest.ID()
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	builder = message.NewBuilder()
+	builder.AddLink(responderID, cidlink.Link{Cid: blks[0].Cid()}, graphsync.LinkActionPresent)
+	builder.AddLink(responderID, cidlink.Link{Cid: blks[1].Cid()}, graphsync.LinkActionMissing)
+	builder.AddLink(responderID, cidlink.Link{Cid: blks[2].Cid()}, graphsync.LinkActionPresent)
+	builder.AddExtensionData(responderID, extension)
+	builder.AddBlock(blks[0])
+	builder.AddBlock(blks[2])
+	builder.AddResponseCode(responderID, graphsync.RequestCompletedPartial)
+	gsm, err = builder.Build()
+	require.NoError(t, err)
+
+	buf = new(bytes.Buffer)
+	require.NoError(t, responderHandler.ToNet(requester, gsm, buf), "did not serialize protobuf message")
+	deserialized, err = requesterHandler.FromNet(responder, buf)
+	require.NoError(t, err, "did not deserialize protobuf message")
+	require.Equal(t, message.Version1, deserialized.Version())
+
+	deserializedResponses := deserialized.Responses()
+	require.Len(t, deserializedResponses, 1, "did not add response to deserialized message")
+	deserializedResponse := deserializedResponses[0]
+	require.Equal(t, id, deserializedResponse.RequestID())
+	require.Equal(t, graphsync.RequestCompletedPartial, deserializedResponse.Status())
+	extensionData, found = deserializedResponse.Extension(extensionName)
+	require.True(t, found)
+	require.Equal(t, extension.Data, extensionData)
+	_, found = deserializedResponse.Extension(extensionMetadata)
+	require.False(t, found, "metadata should not be exposed as an extension")
+	require.Equal(t, []message.GraphSyncLinkMetadatum{
+		{Link: blks[0].Cid(), Action: graphsync.LinkActionPresent},
+		{Link: blks[1].Cid(), Action: graphsync.LinkActionMissing},
+		{Link: blks[2].Cid(), Action: graphsync.LinkActionPresent},
+	}, deserializedResponse.Metadata().(message.GraphSyncLinkMetadata).RawMetadata())
+
+	keys := make(map[cid.Cid]bool)
+	for _, b := range deserialized.Blocks() {
+		keys[b.Cid()] = true
+	}
+	require.Len(t, keys, 2)
+	require.True(t, keys[blks[0].Cid()])
+	require.True(t, keys[blks[2].Cid()])
+
+	// the request is forgotten once it completes
+	require.Empty(t, requesterHandler.outgoing.toV1Map)
+	require.Empty(t, responderHandler.incoming.toV1Map)
+}
+
+func TestRequestCancelAndUpdate(t *testing.T) {
+	root := testutil.GenerateCids(1)[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	id := graphsync.NewRequestID()
+	update := graphsync.ExtensionData{
+		Name: graphsync.ExtensionName("graphsync/awesome"),
+		Data: basicnode.NewString("update"),
+	}
+	requester := peer.ID("requester")
+	responder := peer.ID("responder")
+	requesterHandler := NewMessageHandler()
+	responderHandler := NewMessageHandler()
+
+	var received []graphsync.RequestID
+	for _, request := range []message.GraphSyncRequest{
+		message.NewRequest(id, root, selector, graphsync.Priority(0)),
+		message.NewUpdateRequest(id, update),
+		message.NewCancelRequest(id),
+	} {
+		builder := message.NewBuilder()
+		builder.AddRequest(request)
+		gsm, err := builder.Build()
+		require.NoError(t, err)
+		buf := new(bytes.Buffer)
+		require.NoError(t, requesterHandler.ToNet(responder, gsm, buf))
+		deserialized, err := responderHandler.FromNet(requester, buf)
+		require.NoError(t, err)
+		deserializedRequests := deserialized.Requests()
+		require.Len(t, deserializedRequests, 1)
+		require.Equal(t, request.Type(), deserializedRequests[0].Type())
+		if request.Type() == graphsync.RequestTypeUpdate {
+			data, found := deserializedRequests[0].Extension(update.Name)
+			require.True(t, found)
+			require.Equal(t, update.Data, data)
+		}
+		received = append(received, deserializedRequests[0].ID())
+	}
+
+	// all messages refer to the same request on the responder
+	require.Equal(t, received[0], received[1])
+	require.Equal(t, received[0], received[2])
+}
+
+func TestRequestIDsPerPeer(t *testing.T) {
+	root := testutil.GenerateCids(1)[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	peers := testutil.GeneratePeers(2)
+	mh := NewMessageHandler()
+	senders := []*MessageHandler{NewMessageHandler(), NewMessageHandler()}
+
+	// both peers number their first request 0
+	var received []graphsync.RequestID
+	for i, p := range peers {
+		builder := message.NewBuilder()
+		builder.AddRequest(message.NewRequest(graphsync.NewRequestID(), root, selector, graphsync.Priority(0)))
+		gsm, err := builder.Build()
+		require.NoError(t, err)
+		buf := new(bytes.Buffer)
+		require.NoError(t, senders[i].ToNet(peer.ID("receiver"), gsm, buf))
+		deserialized, err := mh.FromNet(p, buf)
+		require.NoError(t, err)
+		received = append(received, deserialized.Requests()[0].ID())
+	}
+	require.NotEqual(t, received[0], received[1])
+
+	// a request we make is distinct from one the peer makes with the same number
+	outgoing := graphsync.NewRequestID()
+	builder := message.NewBuilder()
+	builder.AddRequest(message.NewRequest(outgoing, root, selector, graphsync.Priority(0)))
+	gsm, err := builder.Build()
+	require.NoError(t, err)
+	require.NoError(t, mh.ToNet(peers[0], gsm, new(bytes.Buffer)))
+
+	builder = message.NewBuilder()
+	builder.AddResponseCode(received[0], graphsync.RequestCompletedFull)
+	gsm, err = builder.Build()
+	require.NoError(t, err)
+	buf := new(bytes.Buffer)
+	require.NoError(t, mh.ToNet(peers[0], gsm, buf))
+	deserialized, err := senders[0].FromNet(peer.ID("receiver"), buf)
+	require.NoError(t, err)
+	require.Len(t, deserialized.Responses(), 1)
+	require.NotEqual(t, outgoing, deserialized.Responses()[0].RequestID())
+}
+
+func TestRequestIDWraparound(t *testing.T) {
+	root := testutil.GenerateCids(1)[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	p := peer.ID("responder")
+	mh := NewMessageHandler()
+	sendRequest := func() int32 {
+		builder := message.NewBuilder()
+		builder.AddRequest(message.NewRequest(graphsync.NewRequestID(), root, selector, graphsync.Priority(0)))
+		gsm, err := builder.Build()
+		require.NoError(t, err)
+		pbMessage, err := mh.toProto(p, gsm)
+		require.NoError(t, err)
+		return pbMessage.Requests[0].Id
+	}
+
+	// the first request is still open when the counter wraps around to its id
+	require.Equal(t, int32(0), sendRequest())
+	mh.nextIntID = math.MaxInt32
+	require.Equal(t, int32(math.MaxInt32), sendRequest())
+	mh.nextIntID = -1
+	require.Equal(t, int32(-1), sendRequest())
+	require.Equal(t, int32(1), sendRequest())
+}
+
+func TestAppendBlock(t *testing.T) {
+	strs := make([]string, 2)
+	strs = append(strs, "Celeritas")
+	strs = append(strs, "Incendia")
+
+	builder := message.NewBuilder()
+	for _, str := range strs {
+		block := blocks.NewBlock([]byte(str))
+		builder.AddBlock(block)
+	}
+	m, err := builder.Build()
+	require.NoError(t, err)
+
+	mh := NewMessageHandler()
+	pbMessage, err := mh.toProto(peer.ID("foo"), m)
+	require.NoError(t, err, "serializing to protobuf errored")
+
+	// assert strings are in proto message
+	for _, block := range pbMessage.GetData() {
+		s := bytes.NewBuffer(block.Data).String()
+		require.Contains(t, strs, s)
+	}
+}
@@ -0,0 +1,93 @@
+package v1
+
+import (
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/message"
+)
+
+// extensionMetadata carries the link metadata for a response in the v1
+// protocol, as a list of {link, blockPresent} maps
+const extensionMetadata = graphsync.ExtensionName("graphsync/response-metadata")
+
+// encodeMetadata converts link metadata to its v1 form. v1 only records
+// whether each block was present, so every other action is sent as missing
+func encodeMetadata(linkMetadata graphsync.LinkMetadata) datamodel.Node {
+	nb := basicnode.Prototype.List.NewBuilder()
+	la, err := nb.BeginList(linkMetadata.Length())
+	if err != nil {
+		panic(err)
+	}
+	linkMetadata.Iterate(func(c cid.Cid, action graphsync.LinkAction) {
+		ma, err := la.AssembleValue().BeginMap(2)
+		if err != nil {
+			panic(err)
+		}
+		if err := ma.AssembleKey().AssignString("link"); err != nil {
+			panic(err)
+		}
+		if err := ma.AssembleValue().AssignLink(cidlink.Link{Cid: c}); err != nil {
+			panic(err)
+		}
+		if err := ma.AssembleKey().AssignString("blockPresent"); err != nil {
+			panic(err)
+		}
+		if err := ma.AssembleValue().AssignBool(action == graphsync.LinkActionPresent); err != nil {
+			panic(err)
+		}
+		if err := ma.Finish(); err != nil {
+			panic(err)
+		}
+	})
+	if err := la.Finish(); err != nil {
+		panic(err)
+	}
+	return nb.Build()
+}
+
+// decodeMetadata reads link metadata from its v1 form
+func decodeMetadata(node datamodel.Node) ([]message.GraphSyncLinkMetadatum, error) {
+	if node.Kind() != datamodel.Kind_List {
+		return nil, fmt.Errorf("invalid metadata: expected list, got %s", node.Kind())
+	}
+	md := make([]message.GraphSyncLinkMetadatum, 0, node.Length())
+	itr := node.ListIterator()
+	for !itr.Done() {
+		_, item, err := itr.Next()
+		if err != nil {
+			return nil, err
+		}
+		linkNode, err := item.LookupByString("link")
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata: %w", err)
+		}
+		link, err := linkNode.AsLink()
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata: %w", err)
+		}
+		cl, ok := link.(cidlink.Link)
+		if !ok {
+			return nil, fmt.Errorf("invalid metadata: unsupported link type")
+		}
+		presentNode, err := item.LookupByString("blockPresent")
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata: %w", err)
+		}
+		present, err := presentNode.AsBool()
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata: %w", err)
+		}
+		action := graphsync.LinkActionMissing
+		if present {
+			action = graphsync.LinkActionPresent
+		}
+		md = append(md, message.GraphSyncLinkMetadatum{Link: cl.Cid, Action: action})
+	}
+	return md, nil
+}
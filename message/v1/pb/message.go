@@ -0,0 +1,338 @@
+// Package graphsync_message_pb reads and writes the protobuf messages of the
+// version 1 graphsync protocol, as described in message.proto. The encoding is
+// written against protowire directly since the version 1 format is fixed
+package graphsync_message_pb
+
+import (
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Message is a version 1 graphsync message
+type Message struct {
+	CompleteRequestList bool
+	Requests            []*Message_Request
+	Responses           []*Message_Response
+	Data                []*Message_Block
+}
+
+// Message_Request is a request in a version 1 graphsync message
+type Message_Request struct {
+	Id         int32
+	Root       []byte
+	Selector   []byte
+	Extensions map[string][]byte
+	Priority   int32
+	Cancel     bool
+	Update     bool
+}
+
+// Message_Response is a response in a version 1 graphsync message
+type Message_Response struct {
+	Id         int32
+	Status     int32
+	Extensions map[string][]byte
+}
+
+// Message_Block is a block in a version 1 graphsync message
+type Message_Block struct {
+	Prefix []byte
+	Data   []byte
+}
+
+// GetRequests returns the requests in the message
+func (m *Message) GetRequests() []*Message_Request {
+	if m != nil {
+		return m.Requests
+	}
+	return nil
+}
+
+// GetResponses returns the responses in the message
+func (m *Message) GetResponses() []*Message_Response {
+	if m != nil {
+		return m.Responses
+	}
+	return nil
+}
+
+// GetData returns the blocks in the message
+func (m *Message) GetData() []*Message_Block {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+// GetExtensions returns the extensions on the request
+func (m *Message_Request) GetExtensions() map[string][]byte {
+	if m != nil {
+		return m.Extensions
+	}
+	return nil
+}
+
+// GetExtensions returns the extensions on the response
+func (m *Message_Response) GetExtensions() map[string][]byte {
+	if m != nil {
+		return m.Extensions
+	}
+	return nil
+}
+
+// Marshal appends the protobuf encoding of the message to b
+func (m *Message) Marshal(b []byte) []byte {
+	if m.CompleteRequestList {
+		b = appendBool(b, 1, true)
+	}
+	for _, req := range m.Requests {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, req.marshal(nil))
+	}
+	for _, res := range m.Responses {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, res.marshal(nil))
+	}
+	for _, blk := range m.Data {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, blk.marshal(nil))
+	}
+	return b
+}
+
+func (m *Message_Request) marshal(b []byte) []byte {
+	b = appendInt32(b, 1, m.Id)
+	b = appendBytes(b, 2, m.Root)
+	b = appendBytes(b, 3, m.Selector)
+	b = appendExtensions(b, 4, m.Extensions)
+	b = appendInt32(b, 5, m.Priority)
+	b = appendBool(b, 6, m.Cancel)
+	b = appendBool(b, 7, m.Update)
+	return b
+}
+
+func (m *Message_Response) marshal(b []byte) []byte {
+	b = appendInt32(b, 1, m.Id)
+	b = appendInt32(b, 2, m.Status)
+	b = appendExtensions(b, 3, m.Extensions)
+	return b
+}
+
+func (m *Message_Block) marshal(b []byte) []byte {
+	b = appendBytes(b, 1, m.Prefix)
+	b = appendBytes(b, 2, m.Data)
+	return b
+}
+
+// Unmarshal reads a message from its protobuf encoding
+func (m *Message) Unmarshal(b []byte) error {
+	*m = Message{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.CompleteRequestList = protowire.DecodeBool(v)
+			return n, nil
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			req := new(Message_Request)
+			if err := req.unmarshal(v); err != nil {
+				return 0, err
+			}
+			m.Requests = append(m.Requests, req)
+			return n, nil
+		case num == 3 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			res := new(Message_Response)
+			if err := res.unmarshal(v); err != nil {
+				return 0, err
+			}
+			m.Responses = append(m.Responses, res)
+			return n, nil
+		case num == 4 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			blk := new(Message_Block)
+			if err := blk.unmarshal(v); err != nil {
+				return 0, err
+			}
+			m.Data = append(m.Data, blk)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+func (m *Message_Request) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			return consumeInt32(b, &m.Id), nil
+		case num == 2 && typ == protowire.BytesType:
+			return consumeBytes(b, &m.Root), nil
+		case num == 3 && typ == protowire.BytesType:
+			return consumeBytes(b, &m.Selector), nil
+		case num == 4 && typ == protowire.BytesType:
+			if m.Extensions == nil {
+				m.Extensions = make(map[string][]byte)
+			}
+			return consumeExtension(b, m.Extensions)
+		case num == 5 && typ == protowire.VarintType:
+			return consumeInt32(b, &m.Priority), nil
+		case num == 6 && typ == protowire.VarintType:
+			return consumeBool(b, &m.Cancel), nil
+		case num == 7 && typ == protowire.VarintType:
+			return consumeBool(b, &m.Update), nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+func (m *Message_Response) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			return consumeInt32(b, &m.Id), nil
+		case num == 2 && typ == protowire.VarintType:
+			return consumeInt32(b, &m.Status), nil
+		case num == 3 && typ == protowire.BytesType:
+			if m.Extensions == nil {
+				m.Extensions = make(map[string][]byte)
+			}
+			return consumeExtension(b, m.Extensions)
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+func (m *Message_Block) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			return consumeBytes(b, &m.Prefix), nil
+		case num == 2 && typ == protowire.BytesType:
+			return consumeBytes(b, &m.Data), nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+// consumeFields reads each field in b, passing the bytes following its tag to
+// consumeValue, which returns how many of them the value used
+func consumeFields(b []byte, consumeValue func(protowire.Number, protowire.Type, []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n, err := consumeValue(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func consumeInt32(b []byte, v *int32) int {
+	x, n := protowire.ConsumeVarint(b)
+	*v = int32(x)
+	return n
+}
+
+func consumeBool(b []byte, v *bool) int {
+	x, n := protowire.ConsumeVarint(b)
+	*v = protowire.DecodeBool(x)
+	return n
+}
+
+func consumeBytes(b []byte, v *[]byte) int {
+	x, n := protowire.ConsumeBytes(b)
+	if n >= 0 {
+		*v = append([]byte{}, x...)
+	}
+	return n
+}
+
+// consumeExtension reads a single map entry into extensions
+func consumeExtension(b []byte, extensions map[string][]byte) (int, error) {
+	entry, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return n, nil
+	}
+	var key string
+	var value []byte
+	err := consumeFields(entry, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			key = v
+			return n, nil
+		case num == 2 && typ == protowire.BytesType:
+			return consumeBytes(b, &value), nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	extensions[key] = value
+	return n, nil
+}
+
+func appendInt32(b []byte, num protowire.Number, v int32) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, protowire.EncodeBool(v))
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// appendExtensions writes extensions as map entries, sorted by name so the
+// encoding is deterministic
+func appendExtensions(b []byte, num protowire.Number, extensions map[string][]byte) []byte {
+	names := make([]string, 0, len(extensions))
+	for name := range extensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, name)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, extensions[name])
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
@@ -0,0 +1,67 @@
+package graphsync_message_pb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageEncoding(t *testing.T) {
+	msg := &Message{
+		CompleteRequestList: true,
+		Requests: []*Message_Request{{
+			Id:         1,
+			Root:       []byte{0x01, 0x02},
+			Selector:   []byte{0xa0},
+			Extensions: map[string][]byte{"a": {0x01}},
+			Priority:   2,
+			Update:     true,
+		}},
+		Responses: []*Message_Response{{
+			Id:     1,
+			Status: 20,
+		}},
+		Data: []*Message_Block{{
+			Prefix: []byte{0x01},
+			Data:   []byte{0x02},
+		}},
+	}
+	expected := []byte{
+		// completeRequestList
+		0x08, 0x01,
+		// requests
+		0x12, 0x15,
+		0x08, 0x01, // id
+		0x12, 0x02, 0x01, 0x02, // root
+		0x1a, 0x01, 0xa0, // selector
+		0x22, 0x06, 0x0a, 0x01, 'a', 0x12, 0x01, 0x01, // extensions
+		0x28, 0x02, // priority
+		0x38, 0x01, // update
+		// responses
+		0x1a, 0x04,
+		0x08, 0x01, // id
+		0x10, 0x14, // status
+		// data
+		0x22, 0x06,
+		0x0a, 0x01, 0x01, // prefix
+		0x12, 0x01, 0x02, // data
+	}
+	require.Equal(t, expected, msg.Marshal(nil))
+
+	var decoded Message
+	require.NoError(t, decoded.Unmarshal(expected))
+	require.Equal(t, msg, &decoded)
+
+	// negative numbers are sign extended
+	msg = &Message{Requests: []*Message_Request{{Priority: -1}}}
+	encoded := msg.Marshal(nil)
+	require.Equal(t, []byte{0x12, 0x0b, 0x28, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, encoded)
+	require.NoError(t, decoded.Unmarshal(encoded))
+	require.Equal(t, msg, &decoded)
+
+	// unknown fields are skipped
+	require.NoError(t, decoded.Unmarshal([]byte{0x28, 0x05, 0x12, 0x02, 0x48, 0x01}))
+	require.Equal(t, &Message{Requests: []*Message_Request{{}}}, &decoded)
+
+	require.Error(t, decoded.Unmarshal([]byte{0x12, 0x05, 0x08}))
+}
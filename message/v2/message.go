@@ -16,6 +16,7 @@ import (
 	"github.com/libp2p/go-msgio"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/compression"
 	"github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/message/ipldbind"
 )
@@ -111,13 +112,35 @@ func (mh *MessageHandler) toIPLD(gsm message.GraphSyncMessage) (*ipldbind.GraphS
 	blocks := gsm.Blocks()
 	if len(blocks) > 0 {
 		ibmBlocks := make([]ipldbind.GraphSyncBlock, 0, len(blocks))
+		var ibmCompressedBlocks []ipldbind.GraphSyncCompressedBlock
+		codec := gsm.BlockCompression()
 		for _, b := range blocks {
+			if codec != nil && len(b.RawData()) >= compression.MinBlockSize {
+				compressed, err := codec.Compress(b.RawData())
+				if err != nil {
+					return nil, err
+				}
+				// send blocks that do not compress as is
+				if len(compressed) < len(b.RawData()) {
+					ibmCompressedBlocks = append(ibmCompressedBlocks, ipldbind.GraphSyncCompressedBlock{
+						Prefix: b.Cid().Prefix().Bytes(),
+						Codec:  codec.Name(),
+						Data:   compressed,
+					})
+					continue
+				}
+			}
 			ibmBlocks = append(ibmBlocks, ipldbind.GraphSyncBlock{
 				Data:   b.RawData(),
 				Prefix: b.Cid().Prefix().Bytes(),
 			})
 		}
-		ibm.Blocks = &ibmBlocks
+		if len(ibmBlocks) > 0 {
+			ibm.Blocks = &ibmBlocks
+		}
+		if len(ibmCompressedBlocks) > 0 {
+			ibm.CompressedBlocks = &ibmCompressedBlocks
+		}
 	}
 
 	return &ipldbind.GraphSyncMessageRoot{Gs2: ibm}, nil
@@ -222,27 +245,50 @@ func (mh *MessageHandler) fromIPLD(ibm *ipldbind.GraphSyncMessageRoot) (message.
 	}
 
 	var blks map[cid.Cid]blocks.Block
+	if ibm.Gs2.Blocks != nil || ibm.Gs2.CompressedBlocks != nil {
+		blks = make(map[cid.Cid]blocks.Block)
+	}
 	if ibm.Gs2.Blocks != nil {
-		blks = make(map[cid.Cid]blocks.Block, len(*ibm.Gs2.Blocks))
 		for _, b := range *ibm.Gs2.Blocks {
-			pref, err := cid.PrefixFromBytes(b.Prefix)
+			blk, err := blockFromPrefix(b.Prefix, b.Data)
 			if err != nil {
 				return message.GraphSyncMessage{}, err
 			}
-
-			c, err := pref.Sum(b.Data)
+			blks[blk.Cid()] = blk
+		}
+	}
+	if ibm.Gs2.CompressedBlocks != nil {
+		for _, b := range *ibm.Gs2.CompressedBlocks {
+			codec, ok := compression.Lookup(b.Codec)
+			if !ok {
+				return message.GraphSyncMessage{}, fmt.Errorf("unknown block compression codec: %s", b.Codec)
+			}
+			data, err := codec.Decompress(b.Data)
 			if err != nil {
 				return message.GraphSyncMessage{}, err
 			}
-
-			blk, err := blocks.NewBlockWithCid(b.Data, c)
+			blk, err := blockFromPrefix(b.Prefix, data)
 			if err != nil {
 				return message.GraphSyncMessage{}, err
 			}
-
 			blks[blk.Cid()] = blk
 		}
 	}
 
-	return message.NewMessage(requests, responses, blks), nil
+	return message.NewMessage(requests, responses, blks).WithVersion(message.Version2), nil
+}
+
+// blockFromPrefix builds a block from its data and the prefix of its CID
+func blockFromPrefix(prefix []byte, data []byte) (blocks.Block, error) {
+	pref, err := cid.PrefixFromBytes(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := pref.Sum(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return blocks.NewBlockWithCid(data, c)
 }
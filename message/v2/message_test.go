@@ -15,6 +15,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/compression"
 	"github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/testutil"
 )
@@ -146,6 +147,50 @@ func TestAppendBlock(t *testing.T) {
 	}
 }
 
+func TestBlockCompression(t *testing.T) {
+	small := blocks.NewBlock([]byte("small block"))
+	compressible := blocks.NewBlock(bytes.Repeat([]byte("compressible "), 100))
+	incompressible := blocks.NewBlock(testutil.RandomBytes(1000))
+
+	builder := message.NewBuilder()
+	builder.SetBlockCompression(compression.Gzip())
+	builder.AddBlock(small)
+	builder.AddBlock(compressible)
+	builder.AddBlock(incompressible)
+	gsm, err := builder.Build()
+	require.NoError(t, err)
+
+	mh := NewMessageHandler()
+	gsmIpld, err := mh.toIPLD(gsm)
+	require.NoError(t, err)
+	// only blocks large enough and that shrink are compressed
+	require.Len(t, *gsmIpld.Gs2.Blocks, 2)
+	require.Len(t, *gsmIpld.Gs2.CompressedBlocks, 1)
+	compressed := (*gsmIpld.Gs2.CompressedBlocks)[0]
+	require.Equal(t, "gzip", compressed.Codec)
+	require.Equal(t, compressible.Cid().Prefix().Bytes(), compressed.Prefix)
+	require.Less(t, len(compressed.Data), len(compressible.RawData()))
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, mh.ToNet(peer.ID("foo"), gsm, buf))
+	deserialized, err := mh.FromNet(peer.ID("bar"), buf)
+	require.NoError(t, err)
+	keys := make(map[cid.Cid][]byte)
+	for _, b := range deserialized.Blocks() {
+		keys[b.Cid()] = b.RawData()
+	}
+	require.Len(t, keys, 3)
+	require.Equal(t, small.RawData(), keys[small.Cid()])
+	require.Equal(t, compressible.RawData(), keys[compressible.Cid()])
+	require.Equal(t, incompressible.RawData(), keys[incompressible.Cid()])
+
+	// blocks compressed with an unknown codec are rejected
+	compressed.Codec = "unknown"
+	(*gsmIpld.Gs2.CompressedBlocks)[0] = compressed
+	_, err = mh.fromIPLD(gsmIpld)
+	require.EqualError(t, err, "unknown block compression codec: unknown")
+}
+
 func contains(strs []string, x string) bool {
 	for _, s := range strs {
 		if s == x {
@@ -263,6 +308,8 @@ func TestToNetFromNetEquivalency(t *testing.T) {
 	require.NoError(t, err, "did not serialize dag-cbor message")
 	deserialized, err := mh.FromNet(peer.ID("foo"), buf)
 	require.NoError(t, err, "did not deserialize dag-cbor message")
+	require.Equal(t, message.VersionUnknown, gsm.Version())
+	require.Equal(t, message.Version2, deserialized.Version())
 
 	requests := gsm.Requests()
 	require.Len(t, requests, 1, "did not add request to message")
@@ -4,6 +4,8 @@ import (
 	"context"
 	"io"
 
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+
 	"github.com/ipfs/go-graphsync"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/notifications"
@@ -18,6 +20,7 @@ type Builder struct {
 	responseStreams map[graphsync.RequestID]io.Closer
 	subscribers     map[graphsync.RequestID]notifications.Subscriber
 	blockData       map[graphsync.RequestID][]graphsync.BlockData
+	extensionSizes  map[graphsync.RequestID]uint64
 }
 
 // NewBuilder sets up a new builder for the given topic
@@ -29,6 +32,7 @@ func NewBuilder(ctx context.Context, topic Topic) *Builder {
 		responseStreams: make(map[graphsync.RequestID]io.Closer),
 		subscribers:     make(map[graphsync.RequestID]notifications.Subscriber),
 		blockData:       make(map[graphsync.RequestID][]graphsync.BlockData),
+		extensionSizes:  make(map[graphsync.RequestID]uint64),
 	}
 }
 
@@ -51,14 +55,34 @@ func (b *Builder) AddBlockData(requestID graphsync.RequestID, blockData graphsyn
 	b.blockData[requestID] = append(b.blockData[requestID], blockData)
 }
 
+// AddExtensionData adds the given extension data to the message, counting its
+// size with the memory allocated for the message
+func (b *Builder) AddExtensionData(requestID graphsync.RequestID, extension graphsync.ExtensionData) {
+	b.Builder.AddExtensionData(requestID, extension)
+	b.extensionSizes[requestID] += extensionSize(extension)
+}
+
 // ScrubResponse removes the given responses from the message and metadata
 func (b *Builder) ScrubResponses(requestIDs []graphsync.RequestID) uint64 {
+	extensionsFreed := uint64(0)
 	for _, requestID := range requestIDs {
 		delete(b.responseStreams, requestID)
 		delete(b.subscribers, requestID)
 		delete(b.blockData, requestID)
+		extensionsFreed += b.extensionSizes[requestID]
+		delete(b.extensionSizes, requestID)
 	}
-	return b.Builder.ScrubResponses(requestIDs)
+	return b.Builder.ScrubResponses(requestIDs) + extensionsFreed
+}
+
+// allocatedSize returns the memory allocated for the message: its blocks and
+// extension data
+func (b *Builder) allocatedSize() uint64 {
+	size := b.BlockSize()
+	for _, extensionSize := range b.extensionSizes {
+		size += extensionSize
+	}
+	return size
 }
 
 // ResponseStreams inspect current response stream state
@@ -76,6 +100,15 @@ func (b *Builder) BlockData() map[graphsync.RequestID][]graphsync.BlockData {
 	return b.blockData
 }
 
+func extensionSize(extension graphsync.ExtensionData) uint64 {
+	if extension.Data == nil {
+		return 0
+	}
+	// encoding errors are picked up when the message is built
+	size, _ := dagcbor.EncodedLength(extension.Data)
+	return uint64(size)
+}
+
 func (b *Builder) build(publisher notifications.Publisher) (gsmsg.GraphSyncMessage, internalMetadata, error) {
 	message, err := b.Build()
 	if err != nil {
@@ -91,7 +124,7 @@ func (b *Builder) build(publisher notifications.Publisher) (gsmsg.GraphSyncMessa
 		},
 		ctx:             b.ctx,
 		topic:           b.topic,
-		msgSize:         b.BlockSize(),
+		msgSize:         b.allocatedSize(),
 		responseStreams: b.responseStreams,
 	}, nil
 }
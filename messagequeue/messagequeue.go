@@ -24,7 +24,9 @@ import (
 var log = logging.Logger("graphsync")
 
 // max block size is the maximum size for batching blocks in a single payload
-const maxBlockSize uint64 = 512 * 1024
+// defaultMaxMessageSize is the default limit on the block data in a single
+// message
+const defaultMaxMessageSize uint64 = 512 * 1024
 
 type Topic uint64
 
@@ -55,9 +57,10 @@ type MessageNetwork interface {
 }
 
 type Allocator interface {
-	AllocateBlockMemory(p peer.ID, amount uint64) <-chan error
+	AllocateBlockMemory(p peer.ID, amount uint64, priority graphsync.Priority) <-chan error
 	ReleasePeerMemory(p peer.ID) error
 	ReleaseBlockMemory(p peer.ID, amount uint64) error
+	CancelAllocation(p peer.ID, allocation <-chan error, amount uint64)
 }
 
 // MessageQueue implements queue of want messages to send to peers.
@@ -68,16 +71,22 @@ type MessageQueue struct {
 
 	outgoingWork chan struct{}
 	done         chan struct{}
+	draining     chan struct{}
+	drainOnce    sync.Once
+	stopped      chan struct{}
 
 	// internal do not touch outside go routines
 	sender             gsnet.MessageSender
 	eventPublisher     notifications.Publisher
 	buildersLk         sync.RWMutex
 	builders           []*Builder
+	requestBuilder     *Builder
 	nextBuilderTopic   Topic
 	allocator          Allocator
 	maxRetries         int
 	sendMessageTimeout time.Duration
+	maxMessageSize     uint64
+	sendDelay          time.Duration
 }
 
 // New creats a new MessageQueue.
@@ -88,52 +97,114 @@ func New(ctx context.Context, p peer.ID, network MessageNetwork, allocator Alloc
 		p:                  p,
 		outgoingWork:       make(chan struct{}, 1),
 		done:               make(chan struct{}),
+		draining:           make(chan struct{}),
+		stopped:            make(chan struct{}),
 		eventPublisher:     notifications.NewPublisher(),
 		allocator:          allocator,
 		maxRetries:         maxRetries,
 		sendMessageTimeout: sendMessageTimeout,
+		maxMessageSize:     defaultMaxMessageSize,
 	}
 }
 
+// SetMaxMessageSize sets the limit on the block data in a single message.
+// Responses are split across messages so that no message goes over the
+// limit, except that a single block larger than the limit is sent in a
+// message of its own. It must be called before Startup
+func (mq *MessageQueue) SetMaxMessageSize(maxMessageSize uint64) {
+	mq.maxMessageSize = maxMessageSize
+}
+
+// SetSendDelay sets how long a response message with room for more block data
+// waits for more responses before it is sent, so that small responses queued
+// close together go out as one message. A message is sent without waiting
+// once it reaches the max message size. Request messages never wait. It must
+// be called before Startup
+func (mq *MessageQueue) SetSendDelay(sendDelay time.Duration) {
+	mq.sendDelay = sendDelay
+}
+
 // AllocateAndBuildMessage allows you to work modify the next message that is sent in the queue.
 // If blkSize > 0, message building may block until enough memory has been freed from the queues to allocate the message.
-func (mq *MessageQueue) AllocateAndBuildMessage(size uint64, buildMessageFn func(*Builder)) {
+// While waiting, messages with a higher priority are given memory first. If ctx is cancelled while waiting, the
+// allocation is withdrawn and the message is not built. Memory the build function does not use, such as when it
+// decides not to add its blocks, is released straight away
+func (mq *MessageQueue) AllocateAndBuildMessage(ctx context.Context, size uint64, priority graphsync.Priority, buildMessageFn func(*Builder)) {
 	if size > 0 {
+		allocation := mq.allocator.AllocateBlockMemory(mq.p, size, priority)
 		select {
-		case <-mq.allocator.AllocateBlockMemory(mq.p, size):
+		case <-allocation:
+		case <-ctx.Done():
+			mq.allocator.CancelAllocation(mq.p, allocation, size)
+			return
 		case <-mq.ctx.Done():
+			mq.allocator.CancelAllocation(mq.p, allocation, size)
 			return
 		}
 	}
-	if mq.buildMessage(size, buildMessageFn) {
+	hasWork, used := mq.buildMessage(size, buildMessageFn)
+	if used < size {
+		_ = mq.allocator.ReleaseBlockMemory(mq.p, size-used)
+	}
+	if hasWork {
 		mq.signalWork()
 	}
 }
 
-func (mq *MessageQueue) buildMessage(size uint64, buildMessageFn func(*Builder)) bool {
+// BuildRequestMessage allows you to modify the next request message that is sent in the queue.
+// Request messages are sent ahead of any queued responses and never wait on block memory,
+// so requests to a peer are not held up behind responses to that peer's own requests
+func (mq *MessageQueue) BuildRequestMessage(buildMessageFn func(*Builder)) {
+	mq.buildersLk.Lock()
+	builder := mq.requestBuilder
+	if builder == nil {
+		builder = mq.newBuilder()
+	}
+	buildMessageFn(builder)
+	hasWork := !builder.Empty()
+	if hasWork {
+		mq.requestBuilder = builder
+	}
+	mq.buildersLk.Unlock()
+	if hasWork {
+		mq.signalWork()
+	}
+}
+
+// buildMessage adds to the last message in the queue, returning whether it has
+// anything to send and how much its allocated size grew
+func (mq *MessageQueue) buildMessage(size uint64, buildMessageFn func(*Builder)) (bool, uint64) {
 	mq.buildersLk.Lock()
 	defer mq.buildersLk.Unlock()
-	if shouldBeginNewResponse(mq.builders, size) {
-		topic := mq.nextBuilderTopic
-		mq.nextBuilderTopic++
-		ctx, _ := otel.Tracer("graphsync").Start(mq.ctx, "message", trace.WithAttributes(
-			attribute.Int64("topic", int64(topic)),
-		))
-		mq.builders = append(mq.builders, NewBuilder(ctx, topic))
+	if size > mq.maxMessageSize {
+		log.Infow("block data exceeds max message size, sending in its own message", "peer", mq.p, "size", size, "max message size", mq.maxMessageSize)
+	}
+	if shouldBeginNewResponse(mq.builders, size, mq.maxMessageSize) {
+		mq.builders = append(mq.builders, mq.newBuilder())
 	}
 	builder := mq.builders[len(mq.builders)-1]
+	allocatedBefore := builder.allocatedSize()
 	buildMessageFn(builder)
-	return !builder.Empty()
+	return !builder.Empty(), builder.allocatedSize() - allocatedBefore
+}
+
+func (mq *MessageQueue) newBuilder() *Builder {
+	topic := mq.nextBuilderTopic
+	mq.nextBuilderTopic++
+	ctx, _ := otel.Tracer("graphsync").Start(mq.ctx, "message", trace.WithAttributes(
+		attribute.Int64("topic", int64(topic)),
+	))
+	return NewBuilder(ctx, topic)
 }
 
-func shouldBeginNewResponse(builders []*Builder, blkSize uint64) bool {
+func shouldBeginNewResponse(builders []*Builder, blkSize uint64, maxMessageSize uint64) bool {
 	if len(builders) == 0 {
 		return true
 	}
 	if blkSize == 0 {
 		return false
 	}
-	return builders[len(builders)-1].BlockSize()+blkSize > maxBlockSize
+	return builders[len(builders)-1].BlockSize()+blkSize > maxMessageSize
 }
 
 // Startup starts the processing of messages, and creates an initial message
@@ -147,16 +218,34 @@ func (mq *MessageQueue) Shutdown() {
 	close(mq.done)
 }
 
+// Drain sends all messages already queued, then stops the processing of
+// messages for a message queue. It returns once the queue has stopped, or
+// ctx is cancelled
+func (mq *MessageQueue) Drain(ctx context.Context) error {
+	mq.drainOnce.Do(func() {
+		close(mq.draining)
+	})
+	select {
+	case <-mq.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (mq *MessageQueue) runQueue() {
 	defer func() {
 		_ = mq.allocator.ReleasePeerMemory(mq.p)
 		mq.eventPublisher.Shutdown()
+		close(mq.stopped)
 	}()
 	mq.eventPublisher.Startup()
 	for {
 		select {
 		case <-mq.outgoingWork:
-			mq.sendMessage()
+			if mq.waitToCoalesce() {
+				mq.sendMessage()
+			}
 		case <-mq.done:
 			select {
 			case <-mq.outgoingWork:
@@ -180,6 +269,14 @@ func (mq *MessageQueue) runQueue() {
 				mq.sender.Close()
 			}
 			return
+		case <-mq.draining:
+			for mq.hasQueuedMessages() {
+				mq.sendMessage()
+			}
+			if mq.sender != nil {
+				mq.sender.Close()
+			}
+			return
 		case <-mq.ctx.Done():
 			if mq.sender != nil {
 				_ = mq.sender.Reset()
@@ -189,6 +286,61 @@ func (mq *MessageQueue) runQueue() {
 	}
 }
 
+// waitToCoalesce holds back the next response message while it has room for
+// more block data, for up to the send delay. Requests queued meanwhile are
+// sent without waiting. It returns false if the queue is stopping and the
+// message should not be sent
+func (mq *MessageQueue) waitToCoalesce() bool {
+	if mq.sendDelay <= 0 {
+		return true
+	}
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for {
+		if mq.hasQueuedRequest() {
+			mq.sendMessage()
+			continue
+		}
+		if !mq.canCoalesce() {
+			return true
+		}
+		if timer == nil {
+			timer = time.NewTimer(mq.sendDelay)
+		}
+		select {
+		case <-timer.C:
+			return true
+		case <-mq.outgoingWork:
+		case <-mq.draining:
+			return true
+		case <-mq.done:
+			// leave the queued messages for shutdown to clean up
+			mq.signalWork()
+			return false
+		case <-mq.ctx.Done():
+			return false
+		}
+	}
+}
+
+func (mq *MessageQueue) hasQueuedRequest() bool {
+	mq.buildersLk.RLock()
+	defer mq.buildersLk.RUnlock()
+	return mq.requestBuilder != nil
+}
+
+// canCoalesce returns true if the only queued response message has room for
+// more block data
+func (mq *MessageQueue) canCoalesce() bool {
+	mq.buildersLk.RLock()
+	defer mq.buildersLk.RUnlock()
+	return len(mq.builders) == 1 && mq.builders[0].BlockSize() < mq.maxMessageSize
+}
+
 func (mq *MessageQueue) signalWork() {
 	select {
 	case mq.outgoingWork <- struct{}{}:
@@ -201,12 +353,19 @@ var errEmptyMessage = errors.New("empty Message")
 func (mq *MessageQueue) extractOutgoingMessage() (gsmsg.GraphSyncMessage, internalMetadata, error) {
 	// grab outgoing message
 	mq.buildersLk.Lock()
-	if len(mq.builders) == 0 {
+	var builder *Builder
+	switch {
+	case mq.requestBuilder != nil:
+		// requests jump ahead of queued responses
+		builder = mq.requestBuilder
+		mq.requestBuilder = nil
+	case len(mq.builders) > 0:
+		builder = mq.builders[0]
+		mq.builders = mq.builders[1:]
+	default:
 		mq.buildersLk.Unlock()
 		return gsmsg.GraphSyncMessage{}, internalMetadata{}, errEmptyMessage
 	}
-	builder := mq.builders[0]
-	mq.builders = mq.builders[1:]
 	// if there are more queued messages, signal we still have more work
 	if len(mq.builders) > 0 {
 		select {
@@ -221,6 +380,12 @@ func (mq *MessageQueue) extractOutgoingMessage() (gsmsg.GraphSyncMessage, intern
 	return builder.build(mq.eventPublisher)
 }
 
+func (mq *MessageQueue) hasQueuedMessages() bool {
+	mq.buildersLk.RLock()
+	defer mq.buildersLk.RUnlock()
+	return mq.requestBuilder != nil || len(mq.builders) > 0
+}
+
 func (mq *MessageQueue) sendMessage() {
 	message, metadata, err := mq.extractOutgoingMessage()
 
@@ -256,13 +421,29 @@ func (mq *MessageQueue) sendMessage() {
 	mq.publishError(metadata, fmt.Errorf("expended retries on SendMsg(%s)", mq.p))
 }
 
-func (mq *MessageQueue) scrubResponseStreams(responseStreams map[graphsync.RequestID]io.Closer) {
+// scrubResponseStreams closes the given response streams and removes their
+// responses from queued messages, returning the block data for the blocks
+// removed
+func (mq *MessageQueue) scrubResponseStreams(responseStreams map[graphsync.RequestID]io.Closer) map[graphsync.RequestID][]graphsync.BlockData {
 	requestIDs := make([]graphsync.RequestID, 0, len(responseStreams))
 	for requestID, responseStream := range responseStreams {
 		_ = responseStream.Close()
 		requestIDs = append(requestIDs, requestID)
 	}
-	totalFreed := mq.scrubResponses(requestIDs)
+	totalFreed, blockData := mq.scrubResponses(requestIDs)
+	mq.releaseScrubbed(totalFreed)
+	return blockData
+}
+
+// ScrubResponses removes the given responses and their blocks from all
+// messages that are queued but not yet sent, and frees the memory allocated
+// for the blocks
+func (mq *MessageQueue) ScrubResponses(requestIDs []graphsync.RequestID) {
+	totalFreed, _ := mq.scrubResponses(requestIDs)
+	mq.releaseScrubbed(totalFreed)
+}
+
+func (mq *MessageQueue) releaseScrubbed(totalFreed uint64) {
 	if totalFreed > 0 {
 		err := mq.allocator.ReleaseBlockMemory(mq.p, totalFreed)
 		if err != nil {
@@ -271,27 +452,39 @@ func (mq *MessageQueue) scrubResponseStreams(responseStreams map[graphsync.Reque
 	}
 }
 
-// ScrubResponses removes the given response and associated blocks
-// from all pending messages in the queue
-func (mq *MessageQueue) scrubResponses(requestIDs []graphsync.RequestID) uint64 {
+// scrubResponses removes the given response and associated blocks
+// from all pending messages in the queue, returning the memory freed and the
+// block data for the blocks removed, in queue order
+func (mq *MessageQueue) scrubResponses(requestIDs []graphsync.RequestID) (uint64, map[graphsync.RequestID][]graphsync.BlockData) {
 	mq.buildersLk.Lock()
 	newBuilders := make([]*Builder, 0, len(mq.builders))
 	totalFreed := uint64(0)
+	blockData := make(map[graphsync.RequestID][]graphsync.BlockData)
 	for _, builder := range mq.builders {
-		totalFreed = builder.ScrubResponses(requestIDs)
+		for _, requestID := range requestIDs {
+			if scrubbed := builder.blockData[requestID]; len(scrubbed) > 0 {
+				blockData[requestID] = append(blockData[requestID], scrubbed...)
+			}
+		}
+		totalFreed += builder.ScrubResponses(requestIDs)
 		if !builder.Empty() {
 			newBuilders = append(newBuilders, builder)
 		}
 	}
 	mq.builders = newBuilders
 	mq.buildersLk.Unlock()
-	return totalFreed
+	return totalFreed, blockData
 }
 
 func (mq *MessageQueue) initializeSender() error {
 	if mq.sender != nil {
 		return nil
 	}
+	// an abandoned send can return before the queue stops on cancellation,
+	// so don't reconnect to send anything further
+	if err := mq.ctx.Err(); err != nil {
+		return err
+	}
 	nsender, err := openSender(mq.ctx, mq.network, mq.p, mq.sendMessageTimeout)
 	if err != nil {
 		return err
@@ -300,8 +493,30 @@ func (mq *MessageQueue) initializeSender() error {
 	return nil
 }
 
+// sendWithTimeout sends a message on the current sender, giving up once the send
+// timeout passes even if the sender ignores its deadline. An abandoned send is
+// unblocked when the sender is reset
+func (mq *MessageQueue) sendWithTimeout(message gsmsg.GraphSyncMessage) error {
+	if mq.sendMessageTimeout <= 0 {
+		return mq.sender.SendMsg(mq.ctx, message)
+	}
+	ctx, cancel := context.WithTimeout(mq.ctx, mq.sendMessageTimeout)
+	defer cancel()
+	sender := mq.sender
+	sent := make(chan error, 1)
+	go func() {
+		sent <- sender.SendMsg(ctx, message)
+	}()
+	select {
+	case err := <-sent:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("sending message to peer %s: %w", mq.p, ctx.Err())
+	}
+}
+
 func (mq *MessageQueue) attemptSendAndRecovery(message gsmsg.GraphSyncMessage, metadata internalMetadata) bool {
-	err := mq.sender.SendMsg(mq.ctx, message)
+	err := mq.sendWithTimeout(message)
 	if err == nil {
 		mq.publishSent(metadata)
 		return true
@@ -373,8 +588,22 @@ func (mq *MessageQueue) publishSent(metadata internalMetadata) {
 	_ = mq.allocator.ReleaseBlockMemory(mq.p, metadata.msgSize)
 }
 
+// publishError reports a message that failed to send. Blocks for the same
+// responses that were queued behind it will not be sent either, so they are
+// removed from the queue and reported after the message's own blocks
 func (mq *MessageQueue) publishError(metadata internalMetadata, err error) {
-	mq.scrubResponseStreams(metadata.responseStreams)
-	mq.eventPublisher.Publish(metadata.topic, Event{Name: Error, Err: err, Metadata: metadata.public})
+	scrubbed := mq.scrubResponseStreams(metadata.responseStreams)
+	public := metadata.public
+	if len(scrubbed) > 0 {
+		blockData := make(map[graphsync.RequestID][]graphsync.BlockData, len(public.BlockData)+len(scrubbed))
+		for requestID, blocks := range public.BlockData {
+			blockData[requestID] = blocks
+		}
+		for requestID, blocks := range scrubbed {
+			blockData[requestID] = append(append([]graphsync.BlockData(nil), blockData[requestID]...), blocks...)
+		}
+		public.BlockData = blockData
+	}
+	mq.eventPublisher.Publish(metadata.topic, Event{Name: Error, Err: err, Metadata: public})
 	_ = mq.allocator.ReleaseBlockMemory(mq.p, metadata.msgSize)
 }
@@ -6,9 +6,12 @@ import (
 	"fmt"
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/ipld/go-ipld-prime/node/basicnode"
 	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
@@ -46,7 +49,7 @@ func TestStartupAndShutdown(t *testing.T) {
 	root := testutil.GenerateCids(1)[0]
 
 	waitGroup.Add(1)
-	messageQueue.AllocateAndBuildMessage(0, func(b *Builder) {
+	messageQueue.AllocateAndBuildMessage(ctx, 0, 0, func(b *Builder) {
 		b.AddRequest(gsmsg.NewRequest(id, root, selector, priority))
 	})
 
@@ -57,6 +60,53 @@ func TestStartupAndShutdown(t *testing.T) {
 	testutil.AssertDoesReceiveFirst(t, fullClosedChan, "message sender should be closed", resetChan, ctx.Done())
 }
 
+func TestDrain(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan gsmsg.GraphSyncMessage)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	var waitGroup sync.WaitGroup
+	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
+	allocator := allocator2.NewAllocator(1<<30, 1<<30)
+
+	messageQueue := New(ctx, peer, messageNetwork, allocator, messageSendRetries, sendMessageTimeout)
+	messageQueue.Startup()
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	root := testutil.GenerateCids(1)[0]
+
+	waitGroup.Add(1)
+	id := graphsync.NewRequestID()
+	messageQueue.AllocateAndBuildMessage(ctx, 0, 0, func(b *Builder) {
+		b.AddRequest(gsmsg.NewRequest(id, root, selector, graphsync.Priority(rand.Int31())))
+	})
+	var message gsmsg.GraphSyncMessage
+	testutil.AssertReceive(ctx, t, messagesSent, &message, "message was not sent")
+
+	// queue another message while the first is still being sent
+	id2 := graphsync.NewRequestID()
+	messageQueue.AllocateAndBuildMessage(ctx, 0, 0, func(b *Builder) {
+		b.AddRequest(gsmsg.NewRequest(id2, root, selector, graphsync.Priority(rand.Int31())))
+	})
+	drained := make(chan error, 1)
+	go func() {
+		drained <- messageQueue.Drain(ctx)
+	}()
+
+	testutil.AssertReceive(ctx, t, messagesSent, &message, "queued message should be sent before stopping")
+	require.Len(t, message.Requests(), 1)
+	require.Equal(t, id2, message.Requests()[0].ID())
+	var err error
+	testutil.AssertReceive(ctx, t, drained, &err, "drain should complete")
+	require.NoError(t, err)
+	testutil.AssertDoesReceiveFirst(t, fullClosedChan, "message sender should be closed", resetChan, ctx.Done())
+}
+
 func TestShutdownDuringMessageSend(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
@@ -85,7 +135,7 @@ func TestShutdownDuringMessageSend(t *testing.T) {
 
 	// setup a message and advance as far as beginning to send it
 	waitGroup.Add(1)
-	messageQueue.AllocateAndBuildMessage(0, func(b *Builder) {
+	messageQueue.AllocateAndBuildMessage(ctx, 0, 0, func(b *Builder) {
 		b.AddRequest(gsmsg.NewRequest(id, root, selector, priority))
 	})
 	waitGroup.Wait()
@@ -137,7 +187,7 @@ func TestProcessingNotification(t *testing.T) {
 	status := graphsync.RequestCompletedFull
 	blkData := testutil.NewFakeBlockData()
 	subscriber := testutil.NewTestSubscriber(5)
-	messageQueue.AllocateAndBuildMessage(0, func(b *Builder) {
+	messageQueue.AllocateAndBuildMessage(ctx, 0, 0, func(b *Builder) {
 		b.AddResponseCode(responseID, status)
 		b.AddExtensionData(responseID, extension)
 		b.AddBlockData(responseID, blkData)
@@ -205,7 +255,7 @@ func TestDedupingMessages(t *testing.T) {
 	selector := ssb.Matcher().Node()
 	root := testutil.GenerateCids(1)[0]
 
-	messageQueue.AllocateAndBuildMessage(0, func(b *Builder) {
+	messageQueue.AllocateAndBuildMessage(ctx, 0, 0, func(b *Builder) {
 		b.AddRequest(gsmsg.NewRequest(id, root, selector, priority))
 	})
 	// wait for send attempt
@@ -219,7 +269,7 @@ func TestDedupingMessages(t *testing.T) {
 	selector3 := ssb.ExploreIndex(0, ssb.Matcher()).Node()
 	root3 := testutil.GenerateCids(1)[0]
 
-	messageQueue.AllocateAndBuildMessage(0, func(b *Builder) {
+	messageQueue.AllocateAndBuildMessage(ctx, 0, 0, func(b *Builder) {
 		b.AddRequest(gsmsg.NewRequest(id2, root2, selector2, priority2))
 		b.AddRequest(gsmsg.NewRequest(id3, root3, selector3, priority3))
 	})
@@ -280,7 +330,7 @@ func TestSendsVeryLargeBlocksResponses(t *testing.T) {
 
 	// generate large blocks before proceeding
 	blks := testutil.GenerateBlocksOfSize(5, 1000000)
-	messageQueue.AllocateAndBuildMessage(uint64(len(blks[0].RawData())), func(b *Builder) {
+	messageQueue.AllocateAndBuildMessage(ctx, uint64(len(blks[0].RawData())), 0, func(b *Builder) {
 		b.AddBlock(blks[0])
 	})
 	waitGroup.Wait()
@@ -292,13 +342,13 @@ func TestSendsVeryLargeBlocksResponses(t *testing.T) {
 	require.True(t, blks[0].Cid().Equals(msgBlks[0].Cid()))
 
 	// Send 3 very large blocks
-	messageQueue.AllocateAndBuildMessage(uint64(len(blks[1].RawData())), func(b *Builder) {
+	messageQueue.AllocateAndBuildMessage(ctx, uint64(len(blks[1].RawData())), 0, func(b *Builder) {
 		b.AddBlock(blks[1])
 	})
-	messageQueue.AllocateAndBuildMessage(uint64(len(blks[2].RawData())), func(b *Builder) {
+	messageQueue.AllocateAndBuildMessage(ctx, uint64(len(blks[2].RawData())), 0, func(b *Builder) {
 		b.AddBlock(blks[2])
 	})
-	messageQueue.AllocateAndBuildMessage(uint64(len(blks[3].RawData())), func(b *Builder) {
+	messageQueue.AllocateAndBuildMessage(ctx, uint64(len(blks[3].RawData())), 0, func(b *Builder) {
 		b.AddBlock(blks[3])
 	})
 
@@ -318,6 +368,122 @@ func TestSendsVeryLargeBlocksResponses(t *testing.T) {
 	require.True(t, blks[3].Cid().Equals(msgBlks[0].Cid()))
 }
 
+func TestMaxMessageSize(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan gsmsg.GraphSyncMessage)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	var waitGroup sync.WaitGroup
+	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
+	allocator := allocator2.NewAllocator(1<<30, 1<<30)
+
+	messageQueue := New(ctx, peer, messageNetwork, allocator, messageSendRetries, sendMessageTimeout)
+	messageQueue.SetMaxMessageSize(1000)
+	messageQueue.Startup()
+	waitGroup.Add(1)
+
+	// the first message fills up to the limit, so later blocks can't join it
+	// while it is sent
+	first := testutil.GenerateBlocksOfSize(1, 1000)[0]
+	messageQueue.AllocateAndBuildMessage(ctx, uint64(len(first.RawData())), 0, func(b *Builder) {
+		b.AddBlock(first)
+	})
+	waitGroup.Wait()
+
+	// blocks that add up to exactly the limit share a message, a block over the
+	// limit is sent alone, and the next block starts a new message
+	blks := append(testutil.GenerateBlocksOfSize(2, 400), testutil.GenerateBlocksOfSize(1, 200)...)
+	blks = append(blks, testutil.GenerateBlocksOfSize(1, 1500)...)
+	blks = append(blks, testutil.GenerateBlocksOfSize(1, 100)...)
+	for _, blk := range blks {
+		blk := blk
+		messageQueue.AllocateAndBuildMessage(ctx, uint64(len(blk.RawData())), 0, func(b *Builder) {
+			b.AddBlock(blk)
+		})
+	}
+
+	for _, expected := range [][]blocks.Block{{first}, blks[:3], blks[3:4], blks[4:]} {
+		var message gsmsg.GraphSyncMessage
+		testutil.AssertReceive(ctx, t, messagesSent, &message, "message did not send")
+		require.ElementsMatch(t, expected, message.Blocks())
+	}
+}
+
+func TestSendDelayCoalescesResponses(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan gsmsg.GraphSyncMessage)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	var waitGroup sync.WaitGroup
+	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
+	allocator := allocator2.NewAllocator(1<<30, 1<<30)
+
+	sendDelay := 500 * time.Millisecond
+	messageQueue := New(ctx, peer, messageNetwork, allocator, messageSendRetries, sendMessageTimeout)
+	messageQueue.SetMaxMessageSize(1000)
+	messageQueue.SetSendDelay(sendDelay)
+	messageQueue.Startup()
+	waitGroup.Add(1)
+
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	root := testutil.GenerateCids(1)[0]
+	promptly := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(ctx, sendDelay/5)
+	}
+
+	// small blocks wait for more to join them, but a request queued meanwhile
+	// is sent without waiting
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	for _, blk := range blks {
+		blk := blk
+		messageQueue.AllocateAndBuildMessage(ctx, uint64(len(blk.RawData())), 0, func(b *Builder) {
+			b.AddBlock(blk)
+		})
+	}
+	id := graphsync.NewRequestID()
+	messageQueue.BuildRequestMessage(func(b *Builder) {
+		b.AddRequest(gsmsg.NewRequest(id, root, selector, graphsync.Priority(rand.Int31())))
+	})
+	var message gsmsg.GraphSyncMessage
+	promptCtx, promptCancel := promptly()
+	testutil.AssertReceive(promptCtx, t, messagesSent, &message, "request should be sent without waiting")
+	promptCancel()
+	require.Len(t, message.Requests(), 1)
+	require.Equal(t, id, message.Requests()[0].ID())
+	require.Empty(t, message.Blocks())
+
+	// a block that fills the message sends it without waiting out the delay
+	last := testutil.GenerateBlocksOfSize(1, 700)[0]
+	messageQueue.AllocateAndBuildMessage(ctx, uint64(len(last.RawData())), 0, func(b *Builder) {
+		b.AddBlock(last)
+	})
+	promptCtx, promptCancel = promptly()
+	testutil.AssertReceive(promptCtx, t, messagesSent, &message, "full message should be sent without waiting")
+	promptCancel()
+	require.ElementsMatch(t, append(blks, last), message.Blocks())
+
+	// a message with room left is sent once the delay passes
+	blk := testutil.GenerateBlocksOfSize(1, 100)[0]
+	queued := time.Now()
+	messageQueue.AllocateAndBuildMessage(ctx, uint64(len(blk.RawData())), 0, func(b *Builder) {
+		b.AddBlock(blk)
+	})
+	testutil.AssertReceive(ctx, t, messagesSent, &message, "message did not send")
+	require.GreaterOrEqual(t, time.Since(queued), sendDelay)
+	require.ElementsMatch(t, []blocks.Block{blk}, message.Blocks())
+}
+
 func TestSendsResponsesMemoryPressure(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
@@ -340,14 +506,14 @@ func TestSendsResponsesMemoryPressure(t *testing.T) {
 
 	// start sending block that exceeds memory limit
 	blks := testutil.GenerateBlocksOfSize(2, 999)
-	messageQueue.AllocateAndBuildMessage(uint64(len(blks[0].RawData())), func(b *Builder) {
+	messageQueue.AllocateAndBuildMessage(ctx, uint64(len(blks[0].RawData())), 0, func(b *Builder) {
 		b.AddBlock(blks[0])
 	})
 
 	finishes := make(chan string, 2)
 	go func() {
 		// attempt to send second block. Should block until memory is released
-		messageQueue.AllocateAndBuildMessage(uint64(len(blks[1].RawData())), func(b *Builder) {
+		messageQueue.AllocateAndBuildMessage(ctx, uint64(len(blks[1].RawData())), 0, func(b *Builder) {
 			b.AddBlock(blks[1])
 		})
 		finishes <- "sent message"
@@ -376,6 +542,213 @@ func TestSendsResponsesMemoryPressure(t *testing.T) {
 	}
 }
 
+func TestCancelledAllocationReleasesMemory(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	p := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan gsmsg.GraphSyncMessage)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	var waitGroup sync.WaitGroup
+	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
+	allocator := allocator2.NewAllocator(1000, 1000)
+
+	messageQueue := New(ctx, p, messageNetwork, allocator, messageSendRetries, sendMessageTimeout)
+	messageQueue.Startup()
+	waitGroup.Add(1)
+
+	blks := testutil.GenerateBlocksOfSize(2, 600)
+	messageQueue.AllocateAndBuildMessage(ctx, uint64(len(blks[0].RawData())), 0, func(b *Builder) {
+		b.AddBlock(blks[0])
+	})
+
+	// a message waiting on memory is abandoned when its context is cancelled,
+	// and its allocation is withdrawn
+	buildCtx, cancelBuild := context.WithCancel(ctx)
+	finished := make(chan struct{})
+	built := false
+	go func() {
+		messageQueue.AllocateAndBuildMessage(buildCtx, uint64(len(blks[1].RawData())), 0, func(b *Builder) {
+			built = true
+			b.AddBlock(blks[1])
+		})
+		close(finished)
+	}()
+	require.Eventually(t, func() bool { return allocator.Stats().TotalPendingAllocations > 0 }, time.Second, 10*time.Millisecond)
+	cancelBuild()
+	testutil.AssertDoesReceive(ctx, t, finished, "build should be abandoned")
+	require.False(t, built)
+	require.Equal(t, uint64(0), allocator.Stats().TotalPendingAllocations)
+
+	var message gsmsg.GraphSyncMessage
+	testutil.AssertReceive(ctx, t, messagesSent, &message, "message did not send")
+	require.Eventually(t, func() bool { return allocator.AllocatedForPeer(p) == 0 }, time.Second, 10*time.Millisecond)
+
+	// memory a build does not use is released straight away
+	messageQueue.AllocateAndBuildMessage(ctx, 500, 0, func(b *Builder) {})
+	require.Equal(t, uint64(0), allocator.AllocatedForPeer(p))
+}
+
+func TestReleasesExtensionMemory(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	p := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan gsmsg.GraphSyncMessage)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	var waitGroup sync.WaitGroup
+	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
+	allocator := allocator2.NewAllocator(1<<30, 1<<30)
+
+	messageQueue := New(ctx, p, messageNetwork, allocator, messageSendRetries, sendMessageTimeout)
+	messageQueue.Startup()
+	waitGroup.Add(1)
+
+	// memory allocated for extension data as well as blocks is released once
+	// the message is sent
+	requestID := graphsync.NewRequestID()
+	blk := testutil.GenerateBlocksOfSize(1, 100)[0]
+	extension := graphsync.ExtensionData{
+		Name: graphsync.ExtensionName("AppleSauce/McGee"),
+		Data: basicnode.NewBytes(testutil.RandomBytes(100)),
+	}
+	extensionSize, err := dagcbor.EncodedLength(extension.Data)
+	require.NoError(t, err)
+	messageQueue.AllocateAndBuildMessage(ctx, uint64(len(blk.RawData()))+uint64(extensionSize), 0, func(b *Builder) {
+		b.AddBlock(blk)
+		b.AddLink(requestID, cidlink.Link{Cid: blk.Cid()}, graphsync.LinkActionPresent)
+		b.AddExtensionData(requestID, extension)
+	})
+	require.NotZero(t, allocator.AllocatedForPeer(p))
+
+	var message gsmsg.GraphSyncMessage
+	testutil.AssertReceive(ctx, t, messagesSent, &message, "message did not send")
+	require.Eventually(t, func() bool { return allocator.AllocatedForPeer(p) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestRequestsSentAheadOfResponses(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	p := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan gsmsg.GraphSyncMessage)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	var waitGroup sync.WaitGroup
+	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
+
+	// use allocator with very small limit
+	allocator := allocator2.NewAllocator(1000, 1000)
+
+	messageQueue := New(ctx, p, messageNetwork, allocator, messageSendRetries, sendMessageTimeout)
+	messageQueue.Startup()
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	root := testutil.GenerateCids(1)[0]
+	responseID := graphsync.NewRequestID()
+	requestID := graphsync.NewRequestID()
+
+	// hold up the queue sending a block that uses up all memory
+	waitGroup.Add(1)
+	blks := testutil.GenerateBlocksOfSize(2, 999)
+	messageQueue.AllocateAndBuildMessage(ctx, uint64(len(blks[0].RawData())), 0, func(b *Builder) {
+		b.AddBlock(blks[0])
+		b.AddLink(responseID, cidlink.Link{Cid: blks[0].Cid()}, graphsync.LinkActionPresent)
+	})
+	waitGroup.Wait()
+
+	// queue a response behind it, and another that must wait on memory
+	messageQueue.AllocateAndBuildMessage(ctx, 0, 0, func(b *Builder) {
+		b.AddExtensionData(responseID, graphsync.ExtensionData{Name: "test", Data: basicnode.NewString("data")})
+	})
+	blockedResponse := make(chan struct{})
+	go func() {
+		messageQueue.AllocateAndBuildMessage(ctx, uint64(len(blks[1].RawData())), 0, func(b *Builder) {
+			b.AddBlock(blks[1])
+			b.AddLink(responseID, cidlink.Link{Cid: blks[1].Cid()}, graphsync.LinkActionPresent)
+		})
+		close(blockedResponse)
+	}()
+
+	// queueing a request should not wait on memory for responses
+	messageQueue.BuildRequestMessage(func(b *Builder) {
+		b.AddRequest(gsmsg.NewRequest(requestID, root, selector, graphsync.Priority(rand.Int31())))
+	})
+	testutil.AssertChannelEmpty(t, blockedResponse, "response should wait on memory")
+
+	var message gsmsg.GraphSyncMessage
+	testutil.AssertReceive(ctx, t, messagesSent, &message, "first message should send")
+	require.Len(t, message.Blocks(), 1)
+	testutil.AssertReceive(ctx, t, messagesSent, &message, "request should send next")
+	require.Len(t, message.Requests(), 1)
+	require.Equal(t, requestID, message.Requests()[0].ID())
+	require.Len(t, message.Responses(), 0)
+	testutil.AssertReceive(ctx, t, messagesSent, &message, "queued responses should send after the request")
+	require.Len(t, message.Responses(), 1)
+	require.Equal(t, responseID, message.Responses()[0].RequestID())
+}
+
+func TestScrubResponses(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan gsmsg.GraphSyncMessage)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	requestID1 := graphsync.NewRequestID()
+	requestID2 := graphsync.NewRequestID()
+	messageSender := &fakeMessageSender{nil, fullClosedChan, resetChan, messagesSent}
+	var waitGroup sync.WaitGroup
+	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
+	allocator := allocator2.NewAllocator(1<<30, 1<<30)
+
+	messageQueue := New(ctx, peer, messageNetwork, allocator, messageSendRetries, sendMessageTimeout)
+	messageQueue.Startup()
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	root := testutil.GenerateCids(1)[0]
+
+	// hold up the queue sending a first message
+	waitGroup.Add(1)
+	messageQueue.AllocateAndBuildMessage(ctx, 0, 0, func(b *Builder) {
+		b.AddRequest(gsmsg.NewRequest(graphsync.NewRequestID(), root, selector, graphsync.Priority(rand.Int31())))
+	})
+	waitGroup.Wait()
+
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	messageQueue.AllocateAndBuildMessage(ctx, uint64(len(blks[0].RawData())), 0, func(b *Builder) {
+		b.AddBlock(blks[0])
+		b.AddLink(requestID1, cidlink.Link{Cid: blks[0].Cid()}, graphsync.LinkActionPresent)
+	})
+	messageQueue.AllocateAndBuildMessage(ctx, uint64(len(blks[1].RawData())), 0, func(b *Builder) {
+		b.AddBlock(blks[1])
+		b.AddLink(requestID2, cidlink.Link{Cid: blks[1].Cid()}, graphsync.LinkActionPresent)
+	})
+	require.Equal(t, uint64(len(blks[0].RawData())+len(blks[1].RawData())), allocator.Stats().TotalAllocatedAllPeers)
+
+	messageQueue.ScrubResponses([]graphsync.RequestID{requestID1})
+	require.Equal(t, uint64(len(blks[1].RawData())), allocator.Stats().TotalAllocatedAllPeers)
+
+	var message gsmsg.GraphSyncMessage
+	testutil.AssertReceive(ctx, t, messagesSent, &message, "first message should send")
+	require.Len(t, message.Requests(), 1)
+	testutil.AssertReceive(ctx, t, messagesSent, &message, "remaining response should send")
+	require.Len(t, message.Responses(), 1)
+	require.Equal(t, requestID2, message.Responses()[0].RequestID())
+	require.Len(t, message.Blocks(), 1)
+	require.True(t, blks[1].Cid().Equals(message.Blocks()[0].Cid()))
+}
+
 func TestNetworkErrorClearResponses(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
@@ -401,7 +774,7 @@ func TestNetworkErrorClearResponses(t *testing.T) {
 	blks := testutil.GenerateBlocksOfSize(5, 1000000)
 	subscriber := testutil.NewTestSubscriber(5)
 
-	messageQueue.AllocateAndBuildMessage(uint64(len(blks[0].RawData())), func(b *Builder) {
+	messageQueue.AllocateAndBuildMessage(ctx, uint64(len(blks[0].RawData())), 0, func(b *Builder) {
 		b.AddBlock(blks[0])
 		b.AddLink(requestID1, cidlink.Link{Cid: blks[0].Cid()}, graphsync.LinkActionPresent)
 		b.SetSubscriber(requestID1, subscriber)
@@ -428,17 +801,17 @@ func TestNetworkErrorClearResponses(t *testing.T) {
 	fc1 := &fakeCloser{fms: messageSender}
 	fc2 := &fakeCloser{fms: messageSender}
 	// Send 3 very large blocks
-	messageQueue.AllocateAndBuildMessage(uint64(len(blks[1].RawData())), func(b *Builder) {
+	messageQueue.AllocateAndBuildMessage(ctx, uint64(len(blks[1].RawData())), 0, func(b *Builder) {
 		b.AddBlock(blks[1])
 		b.SetResponseStream(requestID1, fc1)
 		b.AddLink(requestID1, cidlink.Link{Cid: blks[1].Cid()}, graphsync.LinkActionPresent)
 	})
-	messageQueue.AllocateAndBuildMessage(uint64(len(blks[2].RawData())), func(b *Builder) {
+	messageQueue.AllocateAndBuildMessage(ctx, uint64(len(blks[2].RawData())), 0, func(b *Builder) {
 		b.AddBlock(blks[2])
 		b.SetResponseStream(requestID1, fc1)
 		b.AddLink(requestID1, cidlink.Link{Cid: blks[2].Cid()}, graphsync.LinkActionPresent)
 	})
-	messageQueue.AllocateAndBuildMessage(uint64(len(blks[3].RawData())), func(b *Builder) {
+	messageQueue.AllocateAndBuildMessage(ctx, uint64(len(blks[3].RawData())), 0, func(b *Builder) {
 		b.SetResponseStream(requestID2, fc2)
 		b.AddLink(requestID2, cidlink.Link{Cid: blks[3].Cid()}, graphsync.LinkActionPresent)
 		b.AddBlock(blks[3])
@@ -464,6 +837,121 @@ func TestNetworkErrorClearResponses(t *testing.T) {
 	require.False(t, fc2.closed)
 }
 
+func TestNetworkErrorReportsUnsentBlocks(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	peer := testutil.GeneratePeers(1)[0]
+	messagesSent := make(chan gsmsg.GraphSyncMessage)
+	resetChan := make(chan struct{}, 1)
+	fullClosedChan := make(chan struct{}, 1)
+	messageSender := &fakeMessageSender{errors.New("something went wrong"), fullClosedChan, resetChan, messagesSent}
+	var waitGroup sync.WaitGroup
+	// the sender is opened once, then reopened after the failed attempt
+	waitGroup.Add(2)
+	messageNetwork := &fakeMessageNetwork{nil, nil, messageSender, &waitGroup}
+	allocator := allocator2.NewAllocator(1<<30, 1<<30)
+
+	messageQueue := New(ctx, peer, messageNetwork, allocator, 1, sendMessageTimeout)
+	messageQueue.Startup()
+
+	// each block is large enough to go in its own message
+	requestID := graphsync.NewRequestID()
+	blks := testutil.GenerateBlocksOfSize(2, 300000)
+	blockData := []graphsync.BlockData{testutil.NewFakeBlockData(), testutil.NewFakeBlockData()}
+	subscriber := testutil.NewTestSubscriber(5)
+	for i, blk := range blks {
+		messageQueue.AllocateAndBuildMessage(ctx, uint64(len(blk.RawData())), 0, func(b *Builder) {
+			b.AddBlock(blk)
+			b.AddLink(requestID, cidlink.Link{Cid: blk.Cid()}, graphsync.LinkActionPresent)
+			b.AddBlockData(requestID, blockData[i])
+			b.SetResponseStream(requestID, &fakeCloser{fms: messageSender})
+			b.SetSubscriber(requestID, subscriber)
+		})
+	}
+
+	// the first message fails, and the second is removed from the queue
+	var message gsmsg.GraphSyncMessage
+	testutil.AssertReceive(ctx, t, messagesSent, &message, "message did not send")
+	require.True(t, blks[0].Cid().Equals(message.Blocks()[0].Cid()))
+	responseCodes := map[graphsync.RequestID]graphsync.ResponseStatusCode{
+		requestID: graphsync.PartialResponse,
+	}
+	subscriber.ExpectEventsAllTopics(ctx, t, []notifications.Event{
+		Event{Name: Queued, Metadata: Metadata{
+			ResponseCodes: responseCodes,
+			BlockData:     map[graphsync.RequestID][]graphsync.BlockData{requestID: blockData[:1]},
+		}},
+		// blocks removed from later messages are reported with the failure
+		Event{Name: Error, Err: fmt.Errorf("expended retries on SendMsg(%s)", peer), Metadata: Metadata{
+			ResponseCodes: responseCodes,
+			BlockData:     map[graphsync.RequestID][]graphsync.BlockData{requestID: blockData},
+		}},
+	})
+	subscriber.ExpectNCloses(ctx, t, 1)
+	waitGroup.Wait()
+	require.Zero(t, allocator.Stats().TotalAllocatedAllPeers)
+}
+
+func TestSendTimeout(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	peers := testutil.GeneratePeers(2)
+	stalledPeer, healthyPeer := peers[0], peers[1]
+	allocator := allocator2.NewAllocator(1<<30, 1<<30)
+	const retries, timeout = 2, 50 * time.Millisecond
+
+	// sends to the stalled peer hang until the sender is reset
+	stalledSender := &hangingMessageSender{reset: make(chan struct{}, retries)}
+	var stalledWait sync.WaitGroup
+	// the sender is opened once, then reopened after each failed attempt
+	stalledWait.Add(retries + 1)
+	stalledQueue := New(ctx, stalledPeer, &fakeMessageNetwork{nil, nil, stalledSender, &stalledWait}, allocator, retries, timeout)
+	stalledQueue.Startup()
+	defer stalledQueue.Shutdown()
+
+	messagesSent := make(chan gsmsg.GraphSyncMessage, 1)
+	healthySender := &fakeMessageSender{nil, make(chan struct{}, 1), make(chan struct{}, 1), messagesSent}
+	var healthyWait sync.WaitGroup
+	healthyWait.Add(1)
+	healthyQueue := New(ctx, healthyPeer, &fakeMessageNetwork{nil, nil, healthySender, &healthyWait}, allocator, retries, timeout)
+	healthyQueue.Startup()
+	defer healthyQueue.Shutdown()
+
+	responseID := graphsync.NewRequestID()
+	subscriber := testutil.NewTestSubscriber(5)
+	stalledQueue.AllocateAndBuildMessage(ctx, 0, 0, func(b *Builder) {
+		b.AddResponseCode(responseID, graphsync.RequestCompletedFull)
+		b.SetSubscriber(responseID, subscriber)
+	})
+	healthyID := graphsync.NewRequestID()
+	healthyQueue.AllocateAndBuildMessage(ctx, 0, 0, func(b *Builder) {
+		b.AddResponseCode(healthyID, graphsync.RequestCompletedFull)
+	})
+
+	// the healthy peer is not held up by the stalled one
+	var message gsmsg.GraphSyncMessage
+	testutil.AssertReceive(ctx, t, messagesSent, &message, "message to healthy peer did not send")
+	require.Equal(t, healthyID, message.Responses()[0].RequestID())
+
+	expectedMetadata := Metadata{
+		ResponseCodes: map[graphsync.RequestID]graphsync.ResponseStatusCode{
+			responseID: graphsync.RequestCompletedFull,
+		},
+		BlockData: map[graphsync.RequestID][]graphsync.BlockData{},
+	}
+	subscriber.ExpectEventsAllTopics(ctx, t, []notifications.Event{
+		Event{Name: Queued, Metadata: expectedMetadata},
+		Event{Name: Error, Metadata: expectedMetadata, Err: fmt.Errorf("expended retries on SendMsg(%s)", stalledPeer)},
+	})
+	subscriber.ExpectNCloses(ctx, t, 1)
+	stalledWait.Wait()
+	require.EqualValues(t, retries, atomic.LoadInt32(&stalledSender.attempts))
+}
+
 const sendMessageTimeout = 10 * time.Minute
 const messageSendRetries = 10
 
@@ -500,6 +988,21 @@ func (fms *fakeMessageSender) SendMsg(ctx context.Context, msg gsmsg.GraphSyncMe
 func (fms *fakeMessageSender) Close() error { fms.fullClosed <- struct{}{}; return nil }
 func (fms *fakeMessageSender) Reset() error { fms.reset <- struct{}{}; return nil }
 
+// hangingMessageSender is a sender for a stalled connection, where each send
+// blocks until the sender is reset
+type hangingMessageSender struct {
+	attempts int32
+	reset    chan struct{}
+}
+
+func (hms *hangingMessageSender) SendMsg(ctx context.Context, msg gsmsg.GraphSyncMessage) error {
+	atomic.AddInt32(&hms.attempts, 1)
+	<-hms.reset
+	return errors.New("stream reset")
+}
+func (hms *hangingMessageSender) Close() error { return nil }
+func (hms *hangingMessageSender) Reset() error { hms.reset <- struct{}{}; return nil }
+
 type fakeCloser struct {
 	fms    *fakeMessageSender
 	closed bool
@@ -0,0 +1,96 @@
+package metadata
+
+import (
+	"errors"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+// Item is the metadata for one link in a response. BlockPresent is false when
+// the responder reported the block missing. A present block may still be left
+// out of the response, such as when it was already sent
+type Item struct {
+	Link         cid.Cid
+	BlockPresent bool
+}
+
+// Metadata is the metadata for the links in a response, in traversal order
+type Metadata []Item
+
+// FromLinkMetadata returns the metadata for the link metadata in a response,
+// such as from ResponseData.Metadata in an incoming response hook
+func FromLinkMetadata(linkMetadata graphsync.LinkMetadata) Metadata {
+	md := make(Metadata, 0, linkMetadata.Length())
+	linkMetadata.Iterate(func(c cid.Cid, action graphsync.LinkAction) {
+		md = append(md, Item{Link: c, BlockPresent: action != graphsync.LinkActionMissing})
+	})
+	return md
+}
+
+// Missing returns the links the responder reported missing, in order
+func (md Metadata) Missing() []cid.Cid {
+	var missing []cid.Cid
+	for _, item := range md {
+		if !item.BlockPresent {
+			missing = append(missing, item.Link)
+		}
+	}
+	return missing
+}
+
+// EncodeMetadata encodes metadata as a list of maps with link and blockPresent
+// fields
+func EncodeMetadata(md Metadata) datamodel.Node {
+	return fluent.MustBuildList(basicnode.Prototype.List, int64(len(md)), func(la fluent.ListAssembler) {
+		for _, item := range md {
+			item := item
+			la.AssembleValue().CreateMap(2, func(ma fluent.MapAssembler) {
+				ma.AssembleEntry("link").AssignLink(cidlink.Link{Cid: item.Link})
+				ma.AssembleEntry("blockPresent").AssignBool(item.BlockPresent)
+			})
+		}
+	})
+}
+
+// DecodeMetadata decodes metadata encoded with EncodeMetadata
+func DecodeMetadata(data datamodel.Node) (Metadata, error) {
+	if data.Kind() != datamodel.Kind_List {
+		return nil, errors.New("did not receive a list of metadata items")
+	}
+	md := make(Metadata, 0, data.Length())
+	iter := data.ListIterator()
+	for !iter.Done() {
+		_, next, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		linkNode, err := next.LookupByString("link")
+		if err != nil {
+			return nil, err
+		}
+		link, err := linkNode.AsLink()
+		if err != nil {
+			return nil, err
+		}
+		asCidLink, ok := link.(cidlink.Link)
+		if !ok {
+			return nil, errors.New("contained non CID link")
+		}
+		blockPresentNode, err := next.LookupByString("blockPresent")
+		if err != nil {
+			return nil, err
+		}
+		blockPresent, err := blockPresentNode.AsBool()
+		if err != nil {
+			return nil, err
+		}
+		md = append(md, Item{Link: asCidLink.Cid, BlockPresent: blockPresent})
+	}
+	return md, nil
+}
@@ -0,0 +1,52 @@
+package metadata
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestDecodeEncodeMetadata(t *testing.T) {
+	cids := testutil.GenerateCids(10)
+	md := make(Metadata, 0, len(cids))
+	for i, c := range cids {
+		md = append(md, Item{Link: c, BlockPresent: i%3 != 0})
+	}
+
+	// round trip through the CBOR encoding
+	var buf bytes.Buffer
+	require.NoError(t, dagcbor.Encode(EncodeMetadata(md), &buf))
+	nb := basicnode.Prototype.Any.NewBuilder()
+	require.NoError(t, dagcbor.Decode(nb, &buf))
+	decoded, err := DecodeMetadata(nb.Build())
+	require.NoError(t, err)
+	require.Equal(t, md, decoded)
+
+	_, err = DecodeMetadata(basicnode.NewString("not metadata"))
+	require.Error(t, err)
+}
+
+func TestFromLinkMetadata(t *testing.T) {
+	cids := testutil.GenerateCids(4)
+	linkMetadata := gsmsg.NewLinkMetadata([]gsmsg.GraphSyncLinkMetadatum{
+		{Link: cids[0], Action: graphsync.LinkActionPresent},
+		{Link: cids[1], Action: graphsync.LinkActionMissing},
+		{Link: cids[2], Action: graphsync.LinkActionDuplicateNotSent},
+		{Link: cids[3], Action: graphsync.LinkActionDuplicateDAGSkipped},
+	})
+	md := FromLinkMetadata(linkMetadata)
+	require.Equal(t, Metadata{
+		{Link: cids[0], BlockPresent: true},
+		{Link: cids[1], BlockPresent: false},
+		{Link: cids[2], BlockPresent: true},
+		{Link: cids[3], BlockPresent: true},
+	}, md)
+	require.Equal(t, cids[1:2], md.Missing())
+}
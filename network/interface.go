@@ -11,7 +11,11 @@ import (
 )
 
 var (
-	// ProtocolGraphsync is the protocol identifier for graphsync messages
+	// ProtocolGraphsync_1_0_0 is the protocol identifier for the protobuf
+	// graphsync message format
+	ProtocolGraphsync_1_0_0 protocol.ID = "/ipfs/graphsync/1.0.0"
+	// ProtocolGraphsync_2_0_0 is the protocol identifier for the DAG-CBOR
+	// graphsync message format
 	ProtocolGraphsync_2_0_0 protocol.ID = "/ipfs/graphsync/2.0.0"
 )
 
@@ -41,6 +45,13 @@ type MessageSenderOpts struct {
 	SendTimeout time.Duration
 }
 
+// MessageSizeLimiter is implemented by networks whose limit on the size of
+// messages can be changed after they are created. The limit must be set
+// before SetDelegate is called
+type MessageSizeLimiter interface {
+	SetMaxMessageSize(size int)
+}
+
 // ConnManager provides the methods needed to protect and unprotect connections
 type ConnManager interface {
 	Protect(peer.ID, string)
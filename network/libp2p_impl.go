@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"sort"
 	"time"
 
 	logging "github.com/ipfs/go-log/v2"
@@ -14,7 +15,9 @@ import (
 	"github.com/libp2p/go-msgio"
 	ma "github.com/multiformats/go-multiaddr"
 
+	"github.com/ipfs/go-graphsync"
 	gsmsg "github.com/ipfs/go-graphsync/message"
+	gsmsgv1 "github.com/ipfs/go-graphsync/message/v1"
 	gsmsgv2 "github.com/ipfs/go-graphsync/message/v2"
 	"github.com/ipfs/go-graphsync/panics"
 )
@@ -23,17 +26,29 @@ var log = logging.Logger("graphsync_network")
 
 var sendMessageTimeout = time.Minute * 10
 
+var _ graphsync.Transport = (*libp2pGraphSyncNetwork)(nil)
+
 // Option is an option for configuring the libp2p storage market network
 type Option func(*libp2pGraphSyncNetwork)
 
-// DataTransferProtocols OVERWRITES the default libp2p protocols we use for
-// graphsync with the specified protocols
+// GraphsyncProtocols OVERWRITES the default libp2p protocols we use for
+// graphsync with the specified protocols. Unsupported protocols are ignored.
+// When opening a stream, the newest protocol both peers support is used
 func GraphsyncProtocols(protocols []protocol.ID) Option {
 	return func(gsnet *libp2pGraphSyncNetwork) {
 		gsnet.setProtocols(protocols)
 	}
 }
 
+// MaxMessageSize sets the largest message, in bytes, that will be sent or
+// received. Streams carrying larger messages are reset without reading the
+// message, leaving the connection and other streams open
+func MaxMessageSize(size int) Option {
+	return func(gsnet *libp2pGraphSyncNetwork) {
+		gsnet.maxMessageSize = size
+	}
+}
+
 // PanicCallback allows calling code to receive information about panics that
 // Graphsync recovers from. Graphsync recovers panics that occur during
 // message handling in order to keep the over all system running, although
@@ -47,8 +62,9 @@ func PanicCallback(callbackFn panics.CallBackFn) Option {
 // NewFromLibp2pHost returns a GraphSyncNetwork supported by underlying Libp2p host.
 func NewFromLibp2pHost(host host.Host, options ...Option) GraphSyncNetwork {
 	graphSyncNetwork := libp2pGraphSyncNetwork{
-		host:      host,
-		protocols: []protocol.ID{ProtocolGraphsync_2_0_0},
+		host:           host,
+		protocols:      []protocol.ID{ProtocolGraphsync_2_0_0, ProtocolGraphsync_1_0_0},
+		maxMessageSize: DefaultMaxMessageSize,
 	}
 
 	for _, option := range options {
@@ -58,6 +74,7 @@ func NewFromLibp2pHost(host host.Host, options ...Option) GraphSyncNetwork {
 	graphSyncNetwork.panicHandler = panics.MakeHandler(graphSyncNetwork.panicCallback)
 
 	graphSyncNetwork.messageHandlerSelector = &messageHandlerSelector{
+		v1MessageHandler: gsmsgv1.NewMessageHandler(),
 		v2MessageHandler: gsmsgv2.NewMessageHandler(),
 		panicHandler:     graphSyncNetwork.panicHandler,
 	}
@@ -83,6 +100,7 @@ func (mhe messageHandlerErrorer) ToNet(peer.ID, gsmsg.GraphSyncMessage, io.Write
 }
 
 type messageHandlerSelector struct {
+	v1MessageHandler gsmsg.MessageHandler
 	v2MessageHandler gsmsg.MessageHandler
 
 	panicHandler panics.PanicHandler
@@ -90,6 +108,8 @@ type messageHandlerSelector struct {
 
 func (smh messageHandlerSelector) Select(protocol protocol.ID) gsmsg.MessageHandler {
 	switch protocol {
+	case ProtocolGraphsync_1_0_0:
+		return smh.v1MessageHandler
 	case ProtocolGraphsync_2_0_0:
 		return smh.v2MessageHandler
 	default:
@@ -107,12 +127,14 @@ type libp2pGraphSyncNetwork struct {
 	messageHandlerSelector *messageHandlerSelector
 	panicCallback          panics.CallBackFn
 	panicHandler           panics.PanicHandler
+	maxMessageSize         int
 }
 
 type streamMessageSender struct {
 	s                      network.Stream
 	opts                   MessageSenderOpts
 	messageHandlerSelector *messageHandlerSelector
+	maxMessageSize         int
 }
 
 func (s *streamMessageSender) Close() error {
@@ -124,10 +146,10 @@ func (s *streamMessageSender) Reset() error {
 }
 
 func (s *streamMessageSender) SendMsg(ctx context.Context, msg gsmsg.GraphSyncMessage) error {
-	return msgToStream(ctx, s.s, s.messageHandlerSelector, msg, s.opts.SendTimeout)
+	return msgToStream(ctx, s.s, s.messageHandlerSelector, msg, s.opts.SendTimeout, s.maxMessageSize)
 }
 
-func msgToStream(ctx context.Context, s network.Stream, mh *messageHandlerSelector, msg gsmsg.GraphSyncMessage, timeout time.Duration) (err error) {
+func msgToStream(ctx context.Context, s network.Stream, mh *messageHandlerSelector, msg gsmsg.GraphSyncMessage, timeout time.Duration, maxMessageSize int) (err error) {
 	defer func() {
 		if rerr := mh.panicHandler(recover()); rerr != nil {
 			log.Warnf("recovered panic handling message: %s", err)
@@ -146,7 +168,7 @@ func msgToStream(ctx context.Context, s network.Stream, mh *messageHandlerSelect
 		log.Warnf("error setting deadline: %s", err)
 	}
 
-	if err := mh.Select(s.Protocol()).ToNet(s.Conn().RemotePeer(), msg, s); err != nil {
+	if err := writeMessage(s.Conn().RemotePeer(), mh.Select(s.Protocol()), msg, s, maxMessageSize); err != nil {
 		log.Debugf("error: %s", err)
 		return err
 	}
@@ -168,9 +190,12 @@ func (gsnet *libp2pGraphSyncNetwork) NewMessageSender(ctx context.Context, p pee
 		s:                      s,
 		opts:                   setDefaults(opts),
 		messageHandlerSelector: gsnet.messageHandlerSelector,
+		maxMessageSize:         gsnet.maxMessageSize,
 	}, nil
 }
 
+// newStreamToPeer opens a stream using the first protocol in gsnet.protocols
+// the peer supports, which is the newest since they are kept newest first
 func (gsnet *libp2pGraphSyncNetwork) newStreamToPeer(ctx context.Context, p peer.ID) (network.Stream, error) {
 	return gsnet.host.NewStream(ctx, p, gsnet.protocols...)
 }
@@ -185,7 +210,7 @@ func (gsnet *libp2pGraphSyncNetwork) SendMessage(
 		return err
 	}
 
-	if err = msgToStream(ctx, s, gsnet.messageHandlerSelector, outgoing, sendMessageTimeout); err != nil {
+	if err = msgToStream(ctx, s, gsnet.messageHandlerSelector, outgoing, sendMessageTimeout, gsnet.maxMessageSize); err != nil {
 		_ = s.Reset()
 		return err
 	}
@@ -223,10 +248,10 @@ func (gsnet *libp2pGraphSyncNetwork) handleNewStream(s network.Stream) {
 		return
 	}
 
-	reader := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+	reader := msgio.NewVarintReaderSize(s, gsnet.maxMessageSize)
 	for {
 		p = s.Conn().RemotePeer()
-		received, err := gsnet.messageHandlerSelector.Select(s.Protocol()).FromMsgReader(s.Conn().RemotePeer(), reader)
+		received, err := readMessage(p, gsnet.messageHandlerSelector.Select(s.Protocol()), reader, gsnet.maxMessageSize)
 
 		if err != nil {
 			if err != io.EOF {
@@ -244,18 +269,49 @@ func (gsnet *libp2pGraphSyncNetwork) handleNewStream(s network.Stream) {
 	}
 }
 
+// OpenStream opens a new stream to the given peer using the first graphsync
+// protocol the peer supports
+func (gsnet *libp2pGraphSyncNetwork) OpenStream(ctx context.Context, p peer.ID) (io.ReadWriteCloser, error) {
+	return gsnet.newStreamToPeer(ctx, p)
+}
+
+// SetStreamHandler passes new graphsync streams from the host to the given
+// function, replacing the handler installed by SetDelegate
+func (gsnet *libp2pGraphSyncNetwork) SetStreamHandler(fn func(peer.ID, io.ReadWriteCloser)) {
+	for _, p := range gsnet.protocols {
+		gsnet.host.SetStreamHandler(p, func(s network.Stream) {
+			fn(s.Conn().RemotePeer(), s)
+		})
+	}
+}
+
 func (gsnet *libp2pGraphSyncNetwork) ConnectionManager() ConnManager {
 	return gsnet.host.ConnManager()
 }
 
+// SetMaxMessageSize sets the largest message, in bytes, that will be sent or
+// received, as MaxMessageSize does
+func (gsnet *libp2pGraphSyncNetwork) SetMaxMessageSize(size int) {
+	gsnet.maxMessageSize = size
+}
+
+// protocolVersions are the message format versions for each protocol we
+// support
+var protocolVersions = map[protocol.ID]gsmsg.Version{
+	ProtocolGraphsync_1_0_0: gsmsg.Version1,
+	ProtocolGraphsync_2_0_0: gsmsg.Version2,
+}
+
 func (gsnet *libp2pGraphSyncNetwork) setProtocols(protocols []protocol.ID) {
 	gsnet.protocols = make([]protocol.ID, 0)
 	for _, proto := range protocols {
-		switch proto {
-		case ProtocolGraphsync_2_0_0:
-			gsnet.protocols = append([]protocol.ID{}, proto)
+		if _, ok := protocolVersions[proto]; ok {
+			gsnet.protocols = append(gsnet.protocols, proto)
 		}
 	}
+	sort.SliceStable(gsnet.protocols, func(i, j int) bool {
+		return protocolVersions[gsnet.protocols[i]] > protocolVersions[gsnet.protocols[j]]
+	})
 }
 
 type libp2pGraphSyncNotifee libp2pGraphSyncNetwork
@@ -2,13 +2,16 @@ package network
 
 import (
 	"context"
+	"errors"
 	"math/rand"
 	"testing"
 	"time"
 
 	"github.com/ipld/go-ipld-prime/node/basicnode"
 	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
 	"github.com/stretchr/testify/require"
 
@@ -23,6 +26,7 @@ type receiver struct {
 	lastMessage     gsmsg.GraphSyncMessage
 	lastSender      peer.ID
 	connectedPeers  chan peer.ID
+	errors          chan error
 }
 
 func (r *receiver) ReceiveMessage(
@@ -37,7 +41,10 @@ func (r *receiver) ReceiveMessage(
 	}
 }
 
-func (r *receiver) ReceiveError(_ peer.ID, _ error) {
+func (r *receiver) ReceiveError(_ peer.ID, err error) {
+	if r.errors != nil {
+		r.errors <- err
+	}
 }
 
 func (r *receiver) Connected(p peer.ID) {
@@ -122,9 +129,158 @@ func TestMessageSendAndReceive(t *testing.T) {
 	require.Equal(t, sentResponse.Status(), receivedResponse.Status())
 	require.True(t, found)
 	require.Equal(t, extension.Data, extensionData)
+	require.Equal(t, gsmsg.Version2, received.Version())
 
 	for i := 0; i < 2; i++ {
 		testutil.AssertDoesReceive(ctx, t, r.connectedPeers, "peers were not notified")
 	}
+}
+
+func TestProtocolNegotiation(t *testing.T) {
+	testCases := map[string]struct {
+		protocols1      []protocol.ID
+		protocols2      []protocol.ID
+		expectedVersion gsmsg.Version
+	}{
+		"both peers support all versions": {
+			expectedVersion: gsmsg.Version2,
+		},
+		"falls back to v1 for v1 only peer": {
+			protocols2:      []protocol.ID{ProtocolGraphsync_1_0_0},
+			expectedVersion: gsmsg.Version1,
+		},
+		"v1 only peer talking to peer supporting all versions": {
+			protocols1:      []protocol.ID{ProtocolGraphsync_1_0_0},
+			expectedVersion: gsmsg.Version1,
+		},
+		"prefers newest version regardless of configured order": {
+			protocols1:      []protocol.ID{ProtocolGraphsync_1_0_0, ProtocolGraphsync_2_0_0},
+			protocols2:      []protocol.ID{ProtocolGraphsync_1_0_0, ProtocolGraphsync_2_0_0},
+			expectedVersion: gsmsg.Version2,
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ctx := context.Background()
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			mn := mocknet.New()
+
+			host1, err := mn.GenPeer()
+			require.NoError(t, err)
+			host2, err := mn.GenPeer()
+			require.NoError(t, err)
+			require.NoError(t, mn.LinkAll())
+			var opts1, opts2 []Option
+			if data.protocols1 != nil {
+				opts1 = append(opts1, GraphsyncProtocols(data.protocols1))
+			}
+			if data.protocols2 != nil {
+				opts2 = append(opts2, GraphsyncProtocols(data.protocols2))
+			}
+			gsnet1 := NewFromLibp2pHost(host1, opts1...)
+			gsnet2 := NewFromLibp2pHost(host2, opts2...)
+			r1 := &receiver{
+				messageReceived: make(chan struct{}),
+				connectedPeers:  make(chan peer.ID, 2),
+			}
+			r2 := &receiver{
+				messageReceived: make(chan struct{}),
+				connectedPeers:  make(chan peer.ID, 2),
+			}
+			gsnet1.SetDelegate(r1)
+			gsnet2.SetDelegate(r2)
+			require.NoError(t, gsnet1.ConnectTo(ctx, host2.ID()))
+
+			root := testutil.GenerateCids(1)[0]
+			selector := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any).Matcher().Node()
+			id := graphsync.NewRequestID()
+			builder := gsmsg.NewBuilder()
+			builder.AddRequest(gsmsg.NewRequest(id, root, selector, graphsync.Priority(0)))
+			request, err := builder.Build()
+			require.NoError(t, err)
+
+			require.NoError(t, gsnet1.SendMessage(ctx, host2.ID(), request))
+			testutil.AssertDoesReceive(ctx, t, r2.messageReceived, "request did not send")
+			require.Equal(t, data.expectedVersion, r2.lastMessage.Version())
+			receivedRequests := r2.lastMessage.Requests()
+			require.Len(t, receivedRequests, 1)
+			require.Equal(t, root.String(), receivedRequests[0].Root().String())
+
+			// responses use the ID the request was sent with
+			builder = gsmsg.NewBuilder()
+			builder.AddResponseCode(receivedRequests[0].ID(), graphsync.RequestCompletedFull)
+			response, err := builder.Build()
+			require.NoError(t, err)
+			require.NoError(t, gsnet2.SendMessage(ctx, host1.ID(), response))
+			testutil.AssertDoesReceive(ctx, t, r1.messageReceived, "response did not send")
+			require.Equal(t, data.expectedVersion, r1.lastMessage.Version())
+			receivedResponses := r1.lastMessage.Responses()
+			require.Len(t, receivedResponses, 1)
+			require.Equal(t, id, receivedResponses[0].RequestID())
+			require.Equal(t, graphsync.RequestCompletedFull, receivedResponses[0].Status())
+		})
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	mn := mocknet.New()
+
+	host1, err := mn.GenPeer()
+	require.NoError(t, err)
+	host2, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+	gsnet1 := NewFromLibp2pHost(host1)
+	gsnet2 := NewFromLibp2pHost(host2, MaxMessageSize(1024))
+	r1 := &receiver{
+		messageReceived: make(chan struct{}),
+		connectedPeers:  make(chan peer.ID, 2),
+	}
+	r2 := &receiver{
+		messageReceived: make(chan struct{}),
+		connectedPeers:  make(chan peer.ID, 2),
+		errors:          make(chan error, 1),
+	}
+	gsnet1.SetDelegate(r1)
+	gsnet2.SetDelegate(r2)
+	require.NoError(t, gsnet1.ConnectTo(ctx, host2.ID()))
+
+	root := testutil.GenerateCids(1)[0]
+	selector := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any).Matcher().Node()
+	buildMessage := func(extensionSize int64) gsmsg.GraphSyncMessage {
+		builder := gsmsg.NewBuilder()
+		builder.AddRequest(gsmsg.NewRequest(graphsync.NewRequestID(), root, selector, graphsync.Priority(0), graphsync.ExtensionData{
+			Name: graphsync.ExtensionName("graphsync/awesome"),
+			Data: basicnode.NewBytes(testutil.RandomBytes(extensionSize)),
+		}))
+		msg, err := builder.Build()
+		require.NoError(t, err)
+		return msg
+	}
+
+	// the receiving peer rejects messages over its limit
+	_ = gsnet1.SendMessage(ctx, host2.ID(), buildMessage(10000))
+	var receivedErr error
+	testutil.AssertReceive(ctx, t, r2.errors, &receivedErr, "oversized message was not rejected")
+	var tooLarge MessageTooLargeErr
+	require.True(t, errors.As(receivedErr, &tooLarge))
+	require.Equal(t, 1024, tooLarge.MaxSize)
+	require.Greater(t, tooLarge.Size, uint64(10000))
+
+	// the connection survives, and other messages still arrive
+	require.Equal(t, network.Connected, host1.Network().Connectedness(host2.ID()))
+	small := buildMessage(100)
+	require.NoError(t, gsnet1.SendMessage(ctx, host2.ID(), small))
+	testutil.AssertDoesReceive(ctx, t, r2.messageReceived, "message did not send")
+	require.Equal(t, small.Requests()[0].ID(), r2.lastMessage.Requests()[0].ID())
 
+	// the sending peer refuses to send messages over its limit
+	err = gsnet2.SendMessage(ctx, host1.ID(), buildMessage(10000))
+	require.True(t, errors.As(err, &tooLarge))
+	require.NoError(t, gsnet2.SendMessage(ctx, host1.ID(), small))
+	testutil.AssertDoesReceive(ctx, t, r1.messageReceived, "message did not send")
 }
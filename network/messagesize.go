@@ -0,0 +1,93 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-msgio"
+
+	gsmsg "github.com/ipfs/go-graphsync/message"
+)
+
+// DefaultMaxMessageSize is the default limit on the encoded size of a single
+// message sent or received, in bytes
+const DefaultMaxMessageSize = 20 << 20
+
+// MessageTooLargeErr is returned when a message sent or received exceeds the
+// maximum message size
+type MessageTooLargeErr struct {
+	Size    uint64
+	MaxSize int
+}
+
+func (e MessageTooLargeErr) Error() string {
+	return fmt.Sprintf("message of %d bytes exceeds max message size of %d bytes", e.Size, e.MaxSize)
+}
+
+// MalformedMessageErr is returned when a message is read in full from a
+// stream but cannot be decoded
+type MalformedMessageErr struct {
+	Err error
+}
+
+func (e MalformedMessageErr) Error() string {
+	return fmt.Sprintf("malformed message: %s", e.Err)
+}
+
+func (e MalformedMessageErr) Unwrap() error {
+	return e.Err
+}
+
+// readMessage reads the next message from a stream. Messages larger than
+// maxMessageSize are rejected from their length prefix, before any of the
+// message is read. A message that is read but fails to decode is reported as
+// a MalformedMessageErr
+func readMessage(p peer.ID, mh gsmsg.MessageHandler, reader msgio.Reader, maxMessageSize int) (gsmsg.GraphSyncMessage, error) {
+	size, err := reader.NextMsgLen()
+	if err != nil {
+		return gsmsg.GraphSyncMessage{}, err
+	}
+	if size > maxMessageSize {
+		return gsmsg.GraphSyncMessage{}, MessageTooLargeErr{uint64(size), maxMessageSize}
+	}
+	tracked := &readTracker{Reader: reader}
+	msg, err := mh.FromMsgReader(p, tracked)
+	if err != nil && tracked.read {
+		return gsmsg.GraphSyncMessage{}, MalformedMessageErr{err}
+	}
+	return msg, err
+}
+
+// readTracker records whether a whole message was read, so decoding errors
+// can be told apart from errors reading the stream
+type readTracker struct {
+	msgio.Reader
+	read bool
+}
+
+func (rt *readTracker) ReadMsg() ([]byte, error) {
+	msg, err := rt.Reader.ReadMsg()
+	rt.read = err == nil
+	return msg, err
+}
+
+// writeMessage encodes a message and writes it to a stream, or writes nothing
+// if the encoded message exceeds maxMessageSize, since the peer would reject it
+func writeMessage(p peer.ID, mh gsmsg.MessageHandler, msg gsmsg.GraphSyncMessage, w io.Writer, maxMessageSize int) error {
+	buf := new(bytes.Buffer)
+	if err := mh.ToNet(p, msg, buf); err != nil {
+		return err
+	}
+	size, n := binary.Uvarint(buf.Bytes())
+	if n <= 0 {
+		return fmt.Errorf("invalid length prefix for encoded message")
+	}
+	if size > uint64(maxMessageSize) {
+		return MessageTooLargeErr{size, maxMessageSize}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,211 @@
+package network
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-msgio"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	gsmsgv2 "github.com/ipfs/go-graphsync/message/v2"
+	"github.com/ipfs/go-graphsync/panics"
+)
+
+// NewFromTransport returns a GraphSyncNetwork that sends and receives messages
+// over streams from the given transport. Transports have no notion of
+// connections, so the receiver is never told peers connected or disconnected,
+// ConnectTo does nothing, and connections are never protected. Messages larger
+// than maxMessageSize are neither sent nor received; if it is zero,
+// DefaultMaxMessageSize is used
+func NewFromTransport(transport graphsync.Transport, panicCallback panics.CallBackFn, maxMessageSize int) GraphSyncNetwork {
+	if maxMessageSize == 0 {
+		maxMessageSize = DefaultMaxMessageSize
+	}
+	return &transportGraphSyncNetwork{
+		transport:      transport,
+		messageHandler: gsmsgv2.NewMessageHandler(),
+		panicHandler:   panics.MakeHandler(panicCallback),
+		maxMessageSize: maxMessageSize,
+	}
+}
+
+// transportGraphSyncNetwork implements the graphsync network interface on top
+// of a generic stream transport
+type transportGraphSyncNetwork struct {
+	transport graphsync.Transport
+	// inbound messages from the network are forwarded to the receiver
+	receiver       Receiver
+	messageHandler gsmsg.MessageHandler
+	panicHandler   panics.PanicHandler
+	maxMessageSize int
+}
+
+// writeDeadliner is implemented by transport streams that support write
+// deadlines
+type writeDeadliner interface {
+	SetWriteDeadline(time.Time) error
+}
+
+// resetter is implemented by transport streams that can be aborted
+type resetter interface {
+	Reset() error
+}
+
+type transportMessageSender struct {
+	p              peer.ID
+	s              io.ReadWriteCloser
+	opts           MessageSenderOpts
+	messageHandler gsmsg.MessageHandler
+	panicHandler   panics.PanicHandler
+	maxMessageSize int
+}
+
+func (s *transportMessageSender) Close() error {
+	return s.s.Close()
+}
+
+func (s *transportMessageSender) Reset() error {
+	return resetStream(s.s)
+}
+
+func (s *transportMessageSender) SendMsg(ctx context.Context, msg gsmsg.GraphSyncMessage) error {
+	return msgToTransportStream(ctx, s.p, s.s, s.messageHandler, s.panicHandler, msg, s.opts.SendTimeout, s.maxMessageSize)
+}
+
+func resetStream(s io.ReadWriteCloser) error {
+	if r, ok := s.(resetter); ok {
+		return r.Reset()
+	}
+	return s.Close()
+}
+
+func msgToTransportStream(ctx context.Context, p peer.ID, s io.ReadWriteCloser, mh gsmsg.MessageHandler, panicHandler panics.PanicHandler, msg gsmsg.GraphSyncMessage, timeout time.Duration, maxMessageSize int) (err error) {
+	defer func() {
+		if rerr := panicHandler(recover()); rerr != nil {
+			log.Warnf("recovered panic handling message: %s", rerr)
+			err = rerr
+		}
+	}()
+
+	log.Debugf("Outgoing message with %d requests, %d responses, and %d blocks",
+		len(msg.Requests()), len(msg.Responses()), len(msg.Blocks()))
+
+	wd, hasDeadline := s.(writeDeadliner)
+	if hasDeadline {
+		deadline := time.Now().Add(timeout)
+		if dl, ok := ctx.Deadline(); ok {
+			deadline = dl
+		}
+		if err := wd.SetWriteDeadline(deadline); err != nil {
+			log.Warnf("error setting deadline: %s", err)
+		}
+	}
+
+	if err := writeMessage(p, mh, msg, s, maxMessageSize); err != nil {
+		log.Debugf("error: %s", err)
+		return err
+	}
+
+	if hasDeadline {
+		if err := wd.SetWriteDeadline(time.Time{}); err != nil {
+			log.Warnf("error resetting deadline: %s", err)
+		}
+	}
+	return nil
+}
+
+func (gsnet *transportGraphSyncNetwork) NewMessageSender(ctx context.Context, p peer.ID, opts MessageSenderOpts) (MessageSender, error) {
+	s, err := gsnet.transport.OpenStream(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	return &transportMessageSender{
+		p:              p,
+		s:              s,
+		opts:           setDefaults(opts),
+		messageHandler: gsnet.messageHandler,
+		panicHandler:   gsnet.panicHandler,
+		maxMessageSize: gsnet.maxMessageSize,
+	}, nil
+}
+
+func (gsnet *transportGraphSyncNetwork) SendMessage(
+	ctx context.Context,
+	p peer.ID,
+	outgoing gsmsg.GraphSyncMessage) error {
+
+	s, err := gsnet.transport.OpenStream(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	if err = msgToTransportStream(ctx, p, s, gsnet.messageHandler, gsnet.panicHandler, outgoing, sendMessageTimeout, gsnet.maxMessageSize); err != nil {
+		_ = resetStream(s)
+		return err
+	}
+
+	return s.Close()
+}
+
+func (gsnet *transportGraphSyncNetwork) SetDelegate(r Receiver) {
+	gsnet.receiver = r
+	gsnet.transport.SetStreamHandler(gsnet.handleNewStream)
+}
+
+func (gsnet *transportGraphSyncNetwork) ConnectTo(ctx context.Context, p peer.ID) error {
+	return nil
+}
+
+// handleNewStream receives a new stream from the transport.
+func (gsnet *transportGraphSyncNetwork) handleNewStream(p peer.ID, s io.ReadWriteCloser) {
+	defer s.Close()
+	defer func() {
+		if rerr := gsnet.panicHandler(recover()); rerr != nil {
+			log.Debugf("graphsync net handleNewStream recovered error from %s error: %s", p, rerr)
+			_ = resetStream(s)
+			go gsnet.receiver.ReceiveError(p, rerr)
+		}
+	}()
+
+	if gsnet.receiver == nil {
+		_ = resetStream(s)
+		return
+	}
+
+	reader := msgio.NewVarintReaderSize(s, gsnet.maxMessageSize)
+	for {
+		received, err := readMessage(p, gsnet.messageHandler, reader, gsnet.maxMessageSize)
+		if err != nil {
+			if err != io.EOF {
+				_ = resetStream(s)
+				go gsnet.receiver.ReceiveError(p, err)
+				log.Debugf("graphsync net handleNewStream from %s error: %s", p, err)
+			}
+			return
+		}
+
+		log.Debugf("graphsync net handleNewStream from %s", p)
+		gsnet.receiver.ReceiveMessage(context.Background(), p, received)
+	}
+}
+
+func (gsnet *transportGraphSyncNetwork) ConnectionManager() ConnManager {
+	return nullConnManager{}
+}
+
+// SetMaxMessageSize sets the largest message, in bytes, that will be sent or
+// received
+func (gsnet *transportGraphSyncNetwork) SetMaxMessageSize(size int) {
+	gsnet.maxMessageSize = size
+}
+
+// nullConnManager ignores connection protection, for transports without
+// connections to protect
+type nullConnManager struct{}
+
+func (nullConnManager) Protect(peer.ID, string)        {}
+func (nullConnManager) Unprotect(peer.ID, string) bool { return false }
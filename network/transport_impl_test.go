@@ -0,0 +1,81 @@
+package network
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+// pipeTransport connects peers through in memory pipes
+type pipeTransport struct {
+	self    peer.ID
+	peers   map[peer.ID]*pipeTransport
+	handler func(peer.ID, io.ReadWriteCloser)
+}
+
+func (pt *pipeTransport) OpenStream(ctx context.Context, p peer.ID) (io.ReadWriteCloser, error) {
+	local, remote := net.Pipe()
+	go pt.peers[p].handler(pt.self, remote)
+	return local, nil
+}
+
+func (pt *pipeTransport) SetStreamHandler(fn func(peer.ID, io.ReadWriteCloser)) {
+	pt.handler = fn
+}
+
+func TestMessageSendAndReceiveOverTransport(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	peers := testutil.GeneratePeers(2)
+	transports := map[peer.ID]*pipeTransport{}
+	for _, p := range peers {
+		transports[p] = &pipeTransport{self: p, peers: transports}
+	}
+	gsnet1 := NewFromTransport(transports[peers[0]], nil, 0)
+	gsnet2 := NewFromTransport(transports[peers[1]], nil, 0)
+	r := &receiver{
+		messageReceived: make(chan struct{}),
+		connectedPeers:  make(chan peer.ID, 2),
+	}
+	gsnet1.SetDelegate(r)
+	gsnet2.SetDelegate(r)
+
+	root := testutil.GenerateCids(1)[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	selector := ssb.Matcher().Node()
+	id := graphsync.NewRequestID()
+
+	builder := gsmsg.NewBuilder()
+	builder.AddRequest(gsmsg.NewRequest(id, root, selector, graphsync.Priority(0)))
+	sent, err := builder.Build()
+	require.NoError(t, err)
+
+	require.NoError(t, gsnet1.ConnectTo(ctx, peers[1]))
+	sender, err := gsnet1.NewMessageSender(ctx, peers[1], MessageSenderOpts{})
+	require.NoError(t, err)
+	require.NoError(t, sender.SendMsg(ctx, sent))
+
+	testutil.AssertDoesReceive(ctx, t, r.messageReceived, "message did not send")
+	require.Equal(t, peers[0], r.lastSender, "incorrect peer sent message")
+	receivedRequests := r.lastMessage.Requests()
+	require.Len(t, receivedRequests, 1, "did not add request to received message")
+	require.Equal(t, id, receivedRequests[0].ID())
+	require.Equal(t, root.String(), receivedRequests[0].Root().String())
+	require.NoError(t, sender.Close())
+
+	// transports have no connections to report
+	testutil.AssertChannelEmpty(t, r.connectedPeers, "peers should not be notified")
+}
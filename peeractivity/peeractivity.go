@@ -0,0 +1,142 @@
+package peeractivity
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync/listeners"
+)
+
+// Tracker counts the requests in progress with each peer, in both directions,
+// and notifies listeners when a peer goes from having none to having some, and
+// back. A peer is only reported inactive once it has had no requests in
+// progress for the debounce delay, so a quick succession of short requests is
+// reported once. A nil Tracker ignores everything recorded. It is safe for
+// concurrent use
+type Tracker struct {
+	debounce  time.Duration
+	listeners *listeners.PeerActivityListeners
+
+	lk         sync.Mutex
+	peers      map[peer.ID]*activity
+	pending    []event
+	delivering bool
+}
+
+type activity struct {
+	inProgress int
+	// idleGeneration is changed each time the peer becomes idle or busy
+	// again, so a timer started for an earlier idle period does nothing
+	idleGeneration uint64
+}
+
+type event struct {
+	p      peer.ID
+	active bool
+}
+
+// New returns a tracker that notifies the given listeners, reporting peers
+// inactive after the given debounce delay with no requests in progress
+func New(debounce time.Duration, listeners *listeners.PeerActivityListeners) *Tracker {
+	return &Tracker{
+		debounce:  debounce,
+		listeners: listeners,
+		peers:     make(map[peer.ID]*activity),
+	}
+}
+
+// Started records that a request to or from the given peer is in progress
+func (t *Tracker) Started(p peer.ID) {
+	if t == nil {
+		return
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	a, ok := t.peers[p]
+	if !ok {
+		a = &activity{}
+		t.peers[p] = a
+		t.notify(event{p, true})
+	}
+	a.inProgress++
+	a.idleGeneration++
+}
+
+// Finished records that a request to or from the given peer is no longer in
+// progress
+func (t *Tracker) Finished(p peer.ID) {
+	if t == nil {
+		return
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	a, ok := t.peers[p]
+	if !ok || a.inProgress == 0 {
+		return
+	}
+	a.inProgress--
+	if a.inProgress > 0 {
+		return
+	}
+	a.idleGeneration++
+	generation := a.idleGeneration
+	time.AfterFunc(t.debounce, func() {
+		t.idle(p, generation)
+	})
+}
+
+// idle reports a peer inactive if it has had no requests in progress since
+// the idle period with the given generation began
+func (t *Tracker) idle(p peer.ID, generation uint64) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	a, ok := t.peers[p]
+	if !ok || a.idleGeneration != generation {
+		return
+	}
+	delete(t.peers, p)
+	t.notify(event{p, false})
+}
+
+// notify queues an event for listeners. Events are delivered in order on a
+// separate goroutine, so listeners never run while the tracker is locked and
+// may call back into graphsync. It must be called with the tracker locked
+func (t *Tracker) notify(e event) {
+	if t.listeners == nil {
+		return
+	}
+	t.pending = append(t.pending, e)
+	if !t.delivering {
+		t.delivering = true
+		go t.deliver()
+	}
+}
+
+func (t *Tracker) deliver() {
+	for {
+		t.lk.Lock()
+		if len(t.pending) == 0 {
+			t.delivering = false
+			t.lk.Unlock()
+			return
+		}
+		e := t.pending[0]
+		t.pending = t.pending[1:]
+		t.lk.Unlock()
+		t.listeners.NotifyPeerActivityListeners(e.p, e.active)
+	}
+}
+
+// Active returns true if the given peer has requests in progress, or finished
+// its last one less than the debounce delay ago
+func (t *Tracker) Active(p peer.ID) bool {
+	if t == nil {
+		return false
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	_, ok := t.peers[p]
+	return ok
+}
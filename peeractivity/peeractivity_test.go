@@ -0,0 +1,98 @@
+package peeractivity
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync/listeners"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+type activityEvent struct {
+	p      peer.ID
+	active bool
+}
+
+func TestTracker(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(2)
+	debounce := 100 * time.Millisecond
+	activityListeners := listeners.NewPeerActivityListeners()
+	events := make(chan activityEvent, 10)
+	unregister := activityListeners.Register(func(p peer.ID, active bool) {
+		events <- activityEvent{p, active}
+	})
+	tracker := New(debounce, activityListeners)
+
+	// a peer is reported active when its first request starts
+	tracker.Started(peers[0])
+	tracker.Started(peers[0])
+	var event activityEvent
+	testutil.AssertReceive(ctx, t, events, &event, "should report active")
+	require.Equal(t, activityEvent{peers[0], true}, event)
+	require.True(t, tracker.Active(peers[0]))
+
+	// a request that starts within the debounce delay keeps the peer active
+	tracker.Finished(peers[0])
+	tracker.Finished(peers[0])
+	time.Sleep(debounce / 2)
+	tracker.Started(peers[0])
+	tracker.Finished(peers[0])
+	finished := time.Now()
+	tracker.Started(peers[1])
+	testutil.AssertReceive(ctx, t, events, &event, "should report active")
+	require.Equal(t, activityEvent{peers[1], true}, event)
+
+	// the peer is reported inactive once it has been idle for the delay
+	testutil.AssertReceive(ctx, t, events, &event, "should report inactive")
+	require.Equal(t, activityEvent{peers[0], false}, event)
+	require.GreaterOrEqual(t, time.Since(finished), debounce)
+	require.False(t, tracker.Active(peers[0]))
+	require.True(t, tracker.Active(peers[1]))
+
+	// unmatched finishes are ignored
+	tracker.Finished(peers[0])
+
+	unregister()
+	tracker.Finished(peers[1])
+	time.Sleep(2 * debounce)
+	require.False(t, tracker.Active(peers[1]))
+	require.Empty(t, events)
+}
+
+func TestTrackerListenerCallsBack(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	p := testutil.GeneratePeers(1)[0]
+	activityListeners := listeners.NewPeerActivityListeners()
+	events := make(chan bool, 10)
+	var tracker *Tracker
+	activityListeners.Register(func(p peer.ID, active bool) {
+		// listeners may record activity themselves without deadlocking
+		if active {
+			tracker.Finished(p)
+		}
+		events <- active
+	})
+	tracker = New(0, activityListeners)
+	tracker.Started(p)
+
+	var active bool
+	testutil.AssertReceive(ctx, t, events, &active, "should report active")
+	require.True(t, active)
+	testutil.AssertReceive(ctx, t, events, &active, "should report inactive")
+	require.False(t, active)
+}
+
+func TestNilTracker(t *testing.T) {
+	var tracker *Tracker
+	p := testutil.GeneratePeers(1)[0]
+	tracker.Started(p)
+	tracker.Finished(p)
+	require.False(t, tracker.Active(p))
+}
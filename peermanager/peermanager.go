@@ -3,7 +3,10 @@ package peermanager
 import (
 	"context"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/benbjohnson/clock"
 	"github.com/libp2p/go-libp2p-core/peer"
 )
 
@@ -21,24 +24,49 @@ type PeerProcessFactory func(ctx context.Context, p peer.ID) PeerHandler
 type peerProcessInstance struct {
 	refcnt  int
 	process PeerHandler
+	// unix nanoseconds when the process was last used, read atomically
+	lastUsed int64
 }
 
 // PeerManager manages a pool of peers and sends messages to peers in the pool.
 type PeerManager struct {
 	peerProcesses   map[peer.ID]*peerProcessInstance
 	peerProcessesLk sync.RWMutex
+	// called with each peer whose process is evicted, may be nil
+	evictionListener func(p peer.ID)
 
 	createPeerProcess PeerProcessFactory
 	ctx               context.Context
+	clock             clock.Clock
 }
 
 // New creates a new PeerManager, given a context and a peerQueueFactory.
-func New(ctx context.Context, createPeerQueue PeerProcessFactory) *PeerManager {
-	return &PeerManager{
+// If peerStateTTL > 0, processes for peers that are not connected are shut
+// down once they have been idle for peerStateTTL
+func New(ctx context.Context, createPeerQueue PeerProcessFactory, peerStateTTL time.Duration) *PeerManager {
+	return newPeerManager(ctx, createPeerQueue, peerStateTTL, clock.New())
+}
+
+func newPeerManager(ctx context.Context, createPeerQueue PeerProcessFactory, peerStateTTL time.Duration, clock clock.Clock) *PeerManager {
+	pm := &PeerManager{
 		peerProcesses:     make(map[peer.ID]*peerProcessInstance),
 		createPeerProcess: createPeerQueue,
 		ctx:               ctx,
+		clock:             clock,
+	}
+	if peerStateTTL > 0 {
+		go pm.run(pm.clock.Ticker(peerStateTTL), peerStateTTL)
 	}
+	return pm
+}
+
+// SetEvictionListener sets a function called with each peer whose process is
+// evicted for being idle, so other state kept for the peer can be evicted with
+// it
+func (pm *PeerManager) SetEvictionListener(evictionListener func(p peer.ID)) {
+	pm.peerProcessesLk.Lock()
+	pm.evictionListener = evictionListener
+	pm.peerProcessesLk.Unlock()
 }
 
 // ConnectedPeers returns a list of peers this PeerManager is managing.
@@ -60,19 +88,20 @@ func (pm *PeerManager) Connected(p peer.ID) {
 	pm.peerProcessesLk.Unlock()
 }
 
-// Disconnected is called to remove a peer from the pool.
-func (pm *PeerManager) Disconnected(p peer.ID) {
+// Disconnected is called to remove a peer from the pool. It returns false if
+// other connections to the peer remain open.
+func (pm *PeerManager) Disconnected(p peer.ID) bool {
 	pm.peerProcessesLk.Lock()
 	pq, ok := pm.peerProcesses[p]
 	if !ok {
 		pm.peerProcessesLk.Unlock()
-		return
+		return true
 	}
 
 	pq.refcnt--
 	if pq.refcnt > 0 {
 		pm.peerProcessesLk.Unlock()
-		return
+		return false
 	}
 
 	delete(pm.peerProcesses, p)
@@ -81,6 +110,7 @@ func (pm *PeerManager) Disconnected(p peer.ID) {
 	if pprocess, ok := pq.process.(PeerProcess); ok {
 		pprocess.Shutdown()
 	}
+	return true
 }
 
 // GetProcess returns the process for the given peer
@@ -90,6 +120,7 @@ func (pm *PeerManager) GetProcess(
 	pm.peerProcessesLk.RLock()
 	pqi, ok := pm.peerProcesses[p]
 	if ok {
+		pm.touch(pqi)
 		pm.peerProcessesLk.RUnlock()
 		return pqi.process
 	}
@@ -98,6 +129,7 @@ func (pm *PeerManager) GetProcess(
 	// another writer grabbed the Lock first and made the process)
 	pm.peerProcessesLk.Lock()
 	pqi = pm.getOrCreate(p)
+	pm.touch(pqi)
 	pm.peerProcessesLk.Unlock()
 	return pqi.process
 }
@@ -109,8 +141,52 @@ func (pm *PeerManager) getOrCreate(p peer.ID) *peerProcessInstance {
 		if pprocess, ok := pq.(PeerProcess); ok {
 			pprocess.Startup()
 		}
-		pqi = &peerProcessInstance{0, pq}
+		pqi = &peerProcessInstance{refcnt: 0, process: pq}
+		pm.touch(pqi)
 		pm.peerProcesses[p] = pqi
 	}
 	return pqi
 }
+
+func (pm *PeerManager) touch(pqi *peerProcessInstance) {
+	atomic.StoreInt64(&pqi.lastUsed, pm.clock.Now().UnixNano())
+}
+
+// run periodically evicts stale peer processes until the context is cancelled
+func (pm *PeerManager) run(ticker *clock.Ticker, peerStateTTL time.Duration) {
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			pm.evictStale(now, peerStateTTL)
+		case <-pm.ctx.Done():
+			return
+		}
+	}
+}
+
+// evictStale shuts down processes for peers that are not connected and have
+// been idle for at least peerStateTTL. Connected peers are never evicted
+func (pm *PeerManager) evictStale(now time.Time, peerStateTTL time.Duration) {
+	cutoff := now.Add(-peerStateTTL).UnixNano()
+	evicted := make(map[peer.ID]*peerProcessInstance)
+	pm.peerProcessesLk.Lock()
+	for p, pqi := range pm.peerProcesses {
+		if pqi.refcnt > 0 || atomic.LoadInt64(&pqi.lastUsed) > cutoff {
+			continue
+		}
+		delete(pm.peerProcesses, p)
+		evicted[p] = pqi
+	}
+	evictionListener := pm.evictionListener
+	pm.peerProcessesLk.Unlock()
+
+	for p, pqi := range evicted {
+		if pprocess, ok := pqi.process.(PeerProcess); ok {
+			pprocess.Shutdown()
+		}
+		if evictionListener != nil {
+			evictionListener(p)
+		}
+	}
+}
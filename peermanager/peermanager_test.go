@@ -2,9 +2,13 @@ package peermanager
 
 import (
 	"context"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/benbjohnson/clock"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
 
 	"github.com/ipfs/go-graphsync/testutil"
 )
@@ -23,7 +27,7 @@ func TestAddingAndRemovingPeers(t *testing.T) {
 
 	tp := testutil.GeneratePeers(5)
 	peer1, peer2, peer3, peer4, peer5 := tp[0], tp[1], tp[2], tp[3], tp[4]
-	peerManager := New(ctx, peerProcessFatory)
+	peerManager := New(ctx, peerProcessFatory, 0)
 
 	peerManager.Connected(peer1)
 	peerManager.Connected(peer2)
@@ -51,3 +55,57 @@ func TestAddingAndRemovingPeers(t *testing.T) {
 
 	testutil.AssertContainsPeer(t, connectedPeers, peer2)
 }
+
+type shutdownRecorder struct {
+	shutdown int32
+}
+
+func (sr *shutdownRecorder) Startup()  {}
+func (sr *shutdownRecorder) Shutdown() { atomic.StoreInt32(&sr.shutdown, 1) }
+
+func TestEvictingStalePeerState(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	processes := make(map[peer.ID]*shutdownRecorder)
+	peerProcessFatory := func(ctx context.Context, p peer.ID) PeerHandler {
+		process := &shutdownRecorder{}
+		processes[p] = process
+		return process
+	}
+
+	tp := testutil.GeneratePeers(3)
+	connectedPeer, idlePeer, activePeer := tp[0], tp[1], tp[2]
+	mockClock := clock.NewMock()
+	ttl := time.Minute
+	peerManager := newPeerManager(ctx, peerProcessFatory, ttl, mockClock)
+	evicted := make(chan peer.ID, 3)
+	peerManager.SetEvictionListener(func(p peer.ID) {
+		evicted <- p
+	})
+
+	peerManager.Connected(connectedPeer)
+	peerManager.GetProcess(idlePeer)
+	peerManager.GetProcess(activePeer)
+
+	mockClock.Add(ttl / 2)
+	peerManager.GetProcess(activePeer)
+	mockClock.Add(ttl / 2)
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&processes[idlePeer].shutdown) == 1
+	}, time.Second, 10*time.Millisecond, "idle peer state should be evicted")
+	require.NotContains(t, peerManager.ConnectedPeers(), idlePeer)
+	var evictedPeer peer.ID
+	testutil.AssertReceive(ctx, t, evicted, &evictedPeer, "should notify eviction")
+	require.Equal(t, idlePeer, evictedPeer)
+	require.Contains(t, peerManager.ConnectedPeers(), activePeer, "recently used peer state should be kept")
+
+	mockClock.Add(ttl)
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&processes[activePeer].shutdown) == 1
+	}, time.Second, 10*time.Millisecond, "peer state should be evicted once idle")
+	testutil.AssertReceive(ctx, t, evicted, &evictedPeer, "should notify eviction")
+	require.Equal(t, activePeer, evictedPeer)
+	require.Equal(t, int32(0), atomic.LoadInt32(&processes[connectedPeer].shutdown), "connected peer should never be evicted")
+	require.Contains(t, peerManager.ConnectedPeers(), connectedPeer)
+	testutil.AssertChannelEmpty(t, evicted, "connected peer should never be evicted")
+}
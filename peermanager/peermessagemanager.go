@@ -2,16 +2,22 @@ package peermanager
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/peer"
 
+	"github.com/ipfs/go-graphsync"
 	"github.com/ipfs/go-graphsync/messagequeue"
 )
 
 // PeerQueue is a process that sends messages to a peer
 type PeerQueue interface {
 	PeerProcess
-	AllocateAndBuildMessage(blkSize uint64, buildMessageFn func(*messagequeue.Builder))
+	AllocateAndBuildMessage(ctx context.Context, blkSize uint64, priority graphsync.Priority, buildMessageFn func(*messagequeue.Builder))
+	BuildRequestMessage(buildMessageFn func(*messagequeue.Builder))
+	Drain(ctx context.Context) error
+	ScrubResponses(requestIDs []graphsync.RequestID)
 }
 
 // PeerQueueFactory provides a function that will create a PeerQueue.
@@ -22,18 +28,57 @@ type PeerMessageManager struct {
 	*PeerManager
 }
 
-// NewMessageManager generates a new manger for sending messages
-func NewMessageManager(ctx context.Context, createPeerQueue PeerQueueFactory) *PeerMessageManager {
+// NewMessageManager generates a new manger for sending messages. Queues for
+// peers that are not connected are shut down once idle for peerStateTTL, if
+// peerStateTTL > 0
+func NewMessageManager(ctx context.Context, createPeerQueue PeerQueueFactory, peerStateTTL time.Duration) *PeerMessageManager {
 	return &PeerMessageManager{
 		PeerManager: New(ctx, func(ctx context.Context, p peer.ID) PeerHandler {
 			return createPeerQueue(ctx, p)
-		}),
+		}, peerStateTTL),
 	}
 }
 
 // BuildMessage allows you to modify the next message that is sent for the given peer
-// If blkSize > 0, message building may block until enough memory has been freed from the queues to allocate the message.
-func (pmm *PeerMessageManager) AllocateAndBuildMessage(p peer.ID, blkSize uint64, buildMessageFn func(*messagequeue.Builder)) {
+// If blkSize > 0, message building may block until enough memory has been freed from the queues to allocate the message,
+// or until ctx is cancelled, in which case the message is not built.
+func (pmm *PeerMessageManager) AllocateAndBuildMessage(ctx context.Context, p peer.ID, blkSize uint64, priority graphsync.Priority, buildMessageFn func(*messagequeue.Builder)) {
 	pq := pmm.GetProcess(p).(PeerQueue)
-	pq.AllocateAndBuildMessage(blkSize, buildMessageFn)
+	pq.AllocateAndBuildMessage(ctx, blkSize, priority, buildMessageFn)
+}
+
+// BuildRequestMessage allows you to modify the next request message that is sent for the given peer.
+// Request messages are sent ahead of queued responses and never wait on block memory.
+func (pmm *PeerMessageManager) BuildRequestMessage(p peer.ID, buildMessageFn func(*messagequeue.Builder)) {
+	pq := pmm.GetProcess(p).(PeerQueue)
+	pq.BuildRequestMessage(buildMessageFn)
+}
+
+// ScrubResponses removes the given responses from any messages queued for
+// the given peer that have not yet been sent
+func (pmm *PeerMessageManager) ScrubResponses(p peer.ID, requestIDs []graphsync.RequestID) {
+	pq := pmm.GetProcess(p).(PeerQueue)
+	pq.ScrubResponses(requestIDs)
+}
+
+// Drain sends all messages already queued for every peer, then stops each
+// peer's queue. It returns once all queues have stopped, or ctx is cancelled
+func (pmm *PeerMessageManager) Drain(ctx context.Context) error {
+	peers := pmm.ConnectedPeers()
+	errs := make([]error, len(peers))
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		wg.Add(1)
+		go func(i int, pq PeerQueue) {
+			defer wg.Done()
+			errs[i] = pq.Drain(ctx)
+		}(i, pmm.GetProcess(p).(PeerQueue))
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
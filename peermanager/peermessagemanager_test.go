@@ -29,7 +29,7 @@ type fakePeer struct {
 	messagesSent chan messageSent
 }
 
-func (fp *fakePeer) AllocateAndBuildMessage(blkSize uint64, buildMessage func(b *messagequeue.Builder)) {
+func (fp *fakePeer) AllocateAndBuildMessage(ctx context.Context, blkSize uint64, priority graphsync.Priority, buildMessage func(b *messagequeue.Builder)) {
 	builder := messagequeue.NewBuilder(context.TODO(), messagequeue.Topic(0))
 	buildMessage(builder)
 	message, err := builder.Build()
@@ -42,6 +42,14 @@ func (fp *fakePeer) AllocateAndBuildMessage(blkSize uint64, buildMessage func(b
 
 func (fp *fakePeer) Startup()  {}
 func (fp *fakePeer) Shutdown() {}
+func (fp *fakePeer) Drain(ctx context.Context) error {
+	return nil
+}
+func (fp *fakePeer) BuildRequestMessage(buildMessage func(b *messagequeue.Builder)) {
+	fp.AllocateAndBuildMessage(context.TODO(), 0, 0, buildMessage)
+}
+
+func (fp *fakePeer) ScrubResponses(requestIDs []graphsync.RequestID) {}
 
 //func (fp *fakePeer) AddRequest(graphSyncRequest gsmsg.GraphSyncRequest, notifees ...notifications.Notifee) {
 //	message := gsmsg.New()
@@ -73,17 +81,17 @@ func TestSendingMessagesToPeers(t *testing.T) {
 	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
 	selector := ssb.Matcher().Node()
 
-	peerManager := NewMessageManager(ctx, peerQueueFactory)
+	peerManager := NewMessageManager(ctx, peerQueueFactory, 0)
 
 	request := gsmsg.NewRequest(id, root, selector, priority)
-	peerManager.AllocateAndBuildMessage(tp[0], 0, func(b *messagequeue.Builder) {
+	peerManager.AllocateAndBuildMessage(ctx, tp[0], 0, 0, func(b *messagequeue.Builder) {
 		b.AddRequest(request)
 	})
-	peerManager.AllocateAndBuildMessage(tp[1], 0, func(b *messagequeue.Builder) {
+	peerManager.AllocateAndBuildMessage(ctx, tp[1], 0, 0, func(b *messagequeue.Builder) {
 		b.AddRequest(request)
 	})
 	cancelRequest := gsmsg.NewCancelRequest(id)
-	peerManager.AllocateAndBuildMessage(tp[0], 0, func(b *messagequeue.Builder) {
+	peerManager.AllocateAndBuildMessage(ctx, tp[0], 0, 0, func(b *messagequeue.Builder) {
 		b.AddRequest(cancelRequest)
 	})
 
@@ -0,0 +1,248 @@
+package ratelimiter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/limits"
+)
+
+// sweepInterval is how often buckets for peers that have gone idle are
+// forgotten
+const sweepInterval = time.Second
+
+// RateLimiter limits the rate bytes are sent, in total and to each peer,
+// using token buckets that hold up to one second's worth of bytes. Sending
+// more than is available puts a bucket into debt, so blocks larger than the
+// limit are still sent, just after a longer wait. A nil RateLimiter, or one
+// with both limits set to zero, never delays sends. It is safe for concurrent
+// use
+type RateLimiter struct {
+	bytesPerSecond        uint64
+	bytesPerSecondPerPeer uint64
+	clock                 clock.Clock
+
+	lk          sync.Mutex
+	total       *bucket
+	peerBuckets map[peer.ID]*bucket
+	lastSweep   time.Time
+
+	// records reservations delayed by either limit, may be nil
+	limitRecorder *limits.Recorder
+}
+
+// New returns a rate limiter allowing bytesPerSecond in total and
+// bytesPerSecondPerPeer to each peer. A value of 0 = no limit
+func New(bytesPerSecond uint64, bytesPerSecondPerPeer uint64) *RateLimiter {
+	return newRateLimiter(bytesPerSecond, bytesPerSecondPerPeer, clock.New())
+}
+
+func newRateLimiter(bytesPerSecond uint64, bytesPerSecondPerPeer uint64, clock clock.Clock) *RateLimiter {
+	rl := &RateLimiter{
+		bytesPerSecond:        bytesPerSecond,
+		bytesPerSecondPerPeer: bytesPerSecondPerPeer,
+		clock:                 clock,
+		peerBuckets:           make(map[peer.ID]*bucket),
+		lastSweep:             clock.Now(),
+	}
+	if bytesPerSecond > 0 {
+		rl.total = newBucket(bytesPerSecond, clock.Now())
+	}
+	return rl
+}
+
+// SetLimits changes the bytes per second allowed in total and to each peer.
+// A value of 0 = no limit. Bytes already sent still count against the new
+// limits, so lowering them delays sends until the buckets refill at the new
+// rate
+func (rl *RateLimiter) SetLimits(bytesPerSecond uint64, bytesPerSecondPerPeer uint64) {
+	if rl == nil {
+		return
+	}
+	rl.lk.Lock()
+	defer rl.lk.Unlock()
+	now := rl.clock.Now()
+	rl.bytesPerSecond = bytesPerSecond
+	switch {
+	case bytesPerSecond == 0:
+		rl.total = nil
+	case rl.total == nil:
+		rl.total = newBucket(bytesPerSecond, now)
+	default:
+		rl.total.setRate(bytesPerSecond, now)
+	}
+	rl.bytesPerSecondPerPeer = bytesPerSecondPerPeer
+	for p, peerBucket := range rl.peerBuckets {
+		if bytesPerSecondPerPeer == 0 {
+			delete(rl.peerBuckets, p)
+		} else {
+			peerBucket.setRate(bytesPerSecondPerPeer, now)
+		}
+	}
+}
+
+// SetLimitRecorder sets where to record reservations delayed because the
+// total or per peer limit was reached
+func (rl *RateLimiter) SetLimitRecorder(limitRecorder *limits.Recorder) {
+	rl.lk.Lock()
+	defer rl.lk.Unlock()
+	rl.limitRecorder = limitRecorder
+}
+
+// Reservation is a claim on bytes from a RateLimiter
+type Reservation struct {
+	rl     *RateLimiter
+	p      peer.ID
+	amount uint64
+	delay  time.Duration
+}
+
+// Delay is how long to wait before sending the reserved bytes
+func (r *Reservation) Delay() time.Duration {
+	if r == nil {
+		return 0
+	}
+	return r.delay
+}
+
+// Cancel returns the reserved bytes to the limiter, for when they will not be
+// sent after all
+func (r *Reservation) Cancel() {
+	if r == nil || r.rl == nil {
+		return
+	}
+	r.rl.cancel(r.p, r.amount)
+}
+
+// Reserve claims amount bytes to send to the given peer, returning a
+// reservation that says how long to wait before sending them
+func (rl *RateLimiter) Reserve(p peer.ID, amount uint64) *Reservation {
+	if rl == nil {
+		return &Reservation{}
+	}
+	rl.lk.Lock()
+	defer rl.lk.Unlock()
+	now := rl.clock.Now()
+	rl.sweep(now)
+
+	var delay time.Duration
+	if rl.total != nil {
+		if totalDelay := rl.total.take(amount, now); totalDelay > 0 {
+			rl.limitRecorder.Hit(graphsync.LimitMaxOutgoingBytesPerSecond, graphsync.LimitScopeGlobal)
+			delay = totalDelay
+		}
+	}
+	if rl.bytesPerSecondPerPeer > 0 {
+		peerBucket, ok := rl.peerBuckets[p]
+		if !ok {
+			peerBucket = newBucket(rl.bytesPerSecondPerPeer, now)
+			rl.peerBuckets[p] = peerBucket
+		}
+		if peerDelay := peerBucket.take(amount, now); peerDelay > 0 {
+			rl.limitRecorder.Hit(graphsync.LimitMaxOutgoingBytesPerSecondPerPeer, graphsync.LimitScopePeer)
+			if peerDelay > delay {
+				delay = peerDelay
+			}
+		}
+	}
+	return &Reservation{rl: rl, p: p, amount: amount, delay: delay}
+}
+
+func (rl *RateLimiter) cancel(p peer.ID, amount uint64) {
+	rl.lk.Lock()
+	defer rl.lk.Unlock()
+	now := rl.clock.Now()
+	if rl.total != nil {
+		rl.total.give(amount, now)
+	}
+	if peerBucket, ok := rl.peerBuckets[p]; ok {
+		peerBucket.give(amount, now)
+	}
+}
+
+// ForgetPeer discards the bucket for the given peer, so the peer starts with
+// a full bucket if it is sent to again
+func (rl *RateLimiter) ForgetPeer(p peer.ID) {
+	if rl == nil {
+		return
+	}
+	rl.lk.Lock()
+	delete(rl.peerBuckets, p)
+	rl.lk.Unlock()
+}
+
+// sweep forgets buckets for peers that have refilled completely, since a new
+// bucket for the same peer would start out identical
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < sweepInterval {
+		return
+	}
+	rl.lastSweep = now
+	for p, peerBucket := range rl.peerBuckets {
+		if peerBucket.full(now) {
+			delete(rl.peerBuckets, p)
+		}
+	}
+}
+
+// bucket is a token bucket refilled at rate bytes per second, holding at most
+// one second's worth of bytes. tokens goes negative when the bucket is in debt
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate uint64, now time.Time) *bucket {
+	return &bucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last)
+	if elapsed <= 0 {
+		return
+	}
+	b.last = now
+	b.tokens += elapsed.Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+// take removes amount bytes from the bucket, returning how long until the
+// bucket is out of debt
+func (b *bucket) take(amount uint64, now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens -= float64(amount)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *bucket) give(amount uint64, now time.Time) {
+	b.refill(now)
+	b.tokens += float64(amount)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+// setRate changes the refill rate, refilling at the old rate up to now first.
+// The bucket holds at most one second's worth of bytes at the new rate
+func (b *bucket) setRate(rate uint64, now time.Time) {
+	b.refill(now)
+	b.rate = float64(rate)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+func (b *bucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.rate
+}
@@ -0,0 +1,108 @@
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/limits"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestSustainedThroughput(t *testing.T) {
+	mockClock := clock.NewMock()
+	rateLimiter := newRateLimiter(1000, 0, mockClock)
+	peers := testutil.GeneratePeers(3)
+
+	// send as fast as allowed for ten seconds, waiting as each reservation says
+	start := mockClock.Now()
+	var sent uint64
+	for i := 0; mockClock.Since(start) < 10*time.Second; i++ {
+		reservation := rateLimiter.Reserve(peers[i%len(peers)], 150)
+		mockClock.Add(reservation.Delay())
+		sent += 150
+	}
+	elapsed := mockClock.Since(start)
+	// one second's worth may be sent up front, but no more than that
+	require.LessOrEqual(t, float64(sent), 1000*elapsed.Seconds()+1000)
+	require.GreaterOrEqual(t, float64(sent), 1000*elapsed.Seconds())
+}
+
+func TestPerPeerLimit(t *testing.T) {
+	mockClock := clock.NewMock()
+	limitRecorder := limits.NewRecorder(time.Minute, nil)
+	rateLimiter := newRateLimiter(0, 100, mockClock)
+	rateLimiter.SetLimitRecorder(limitRecorder)
+	peers := testutil.GeneratePeers(2)
+
+	require.Zero(t, rateLimiter.Reserve(peers[0], 100).Delay())
+	require.Equal(t, 500*time.Millisecond, rateLimiter.Reserve(peers[0], 50).Delay())
+	// other peers have their own allowance
+	require.Zero(t, rateLimiter.Reserve(peers[1], 100).Delay())
+	hits, _ := limitRecorder.Hits(graphsync.LimitMaxOutgoingBytesPerSecondPerPeer)
+	require.Equal(t, uint64(1), hits)
+
+	// buckets for idle peers are forgotten once they refill
+	mockClock.Add(2 * time.Second)
+	require.Zero(t, rateLimiter.Reserve(peers[0], 10).Delay())
+	require.Len(t, rateLimiter.peerBuckets, 1)
+
+	// a forgotten peer starts over with a full bucket
+	rateLimiter.ForgetPeer(peers[0])
+	require.Empty(t, rateLimiter.peerBuckets)
+	require.Zero(t, rateLimiter.Reserve(peers[0], 100).Delay())
+}
+
+func TestCancelReservation(t *testing.T) {
+	mockClock := clock.NewMock()
+	rateLimiter := newRateLimiter(100, 100, mockClock)
+	p := testutil.GeneratePeers(1)[0]
+
+	require.Zero(t, rateLimiter.Reserve(p, 100).Delay())
+	reservation := rateLimiter.Reserve(p, 200)
+	require.Equal(t, 2*time.Second, reservation.Delay())
+
+	// bytes that are never sent are returned to the limiter
+	reservation.Cancel()
+	require.Equal(t, time.Second, rateLimiter.Reserve(p, 100).Delay())
+}
+
+func TestSetLimits(t *testing.T) {
+	mockClock := clock.NewMock()
+	rateLimiter := newRateLimiter(1000, 500, mockClock)
+	peers := testutil.GeneratePeers(2)
+
+	require.Zero(t, rateLimiter.Reserve(peers[0], 500).Delay())
+
+	// lowering the limits caps what is left to a second's worth at the new
+	// rates, and refills at them
+	rateLimiter.SetLimits(200, 100)
+	require.Zero(t, rateLimiter.Reserve(peers[1], 100).Delay())
+	require.Equal(t, time.Second, rateLimiter.Reserve(peers[0], 100).Delay())
+	require.Equal(t, 2*time.Second, rateLimiter.Reserve(peers[1], 200).Delay())
+
+	// raising them refills at the new rates, and removing them stops delays
+	mockClock.Add(2 * time.Second)
+	rateLimiter.SetLimits(1000, 0)
+	require.Zero(t, rateLimiter.Reserve(peers[0], 200).Delay())
+	require.Empty(t, rateLimiter.peerBuckets)
+	rateLimiter.SetLimits(0, 0)
+	require.Zero(t, rateLimiter.Reserve(peers[0], 1<<30).Delay())
+
+	// limits can be added to a limiter that had none
+	rateLimiter.SetLimits(0, 100)
+	require.Zero(t, rateLimiter.Reserve(peers[1], 100).Delay())
+	require.Equal(t, time.Second, rateLimiter.Reserve(peers[1], 100).Delay())
+}
+
+func TestNoLimits(t *testing.T) {
+	p := testutil.GeneratePeers(1)[0]
+	require.Zero(t, New(0, 0).Reserve(p, 1<<30).Delay())
+	var rateLimiter *RateLimiter
+	reservation := rateLimiter.Reserve(p, 1<<30)
+	require.Zero(t, reservation.Delay())
+	reservation.Cancel()
+}
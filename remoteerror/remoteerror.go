@@ -0,0 +1,55 @@
+package remoteerror
+
+import (
+	"errors"
+
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+// EncodeRemoteError encodes an error for the remote-error extension
+func EncodeRemoteError(remoteErr graphsync.RemoteError) datamodel.Node {
+	size := int64(2)
+	if remoteErr.Payload() != nil {
+		size++
+	}
+	return fluent.MustBuildMap(basicnode.Prototype.Map, size, func(ma fluent.MapAssembler) {
+		ma.AssembleEntry("Code").AssignInt(remoteErr.Code())
+		ma.AssembleEntry("Message").AssignString(remoteErr.Message())
+		if remoteErr.Payload() != nil {
+			ma.AssembleEntry("Payload").AssignNode(remoteErr.Payload())
+		}
+	})
+}
+
+// DecodeRemoteError decodes an error from data for the remote-error extension
+func DecodeRemoteError(data datamodel.Node) (graphsync.RemoteError, error) {
+	if data.Kind() != datamodel.Kind_Map {
+		return graphsync.RemoteError{}, errors.New("did not receive a remote error map")
+	}
+	codeNode, err := data.LookupByString("Code")
+	if err != nil {
+		return graphsync.RemoteError{}, err
+	}
+	code, err := codeNode.AsInt()
+	if err != nil {
+		return graphsync.RemoteError{}, err
+	}
+	messageNode, err := data.LookupByString("Message")
+	if err != nil {
+		return graphsync.RemoteError{}, err
+	}
+	message, err := messageNode.AsString()
+	if err != nil {
+		return graphsync.RemoteError{}, err
+	}
+	remoteErr := graphsync.NewRemoteError(code, message)
+	payload, err := data.LookupByString("Payload")
+	if err == nil {
+		remoteErr = remoteErr.WithPayload(payload)
+	}
+	return remoteErr, nil
+}
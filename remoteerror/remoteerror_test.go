@@ -0,0 +1,47 @@
+package remoteerror
+
+import (
+	"testing"
+
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+func TestDecodeEncodeRemoteError(t *testing.T) {
+	// make sure the error survives a trip over the wire
+	roundTrip := func(remoteErr graphsync.RemoteError) graphsync.RemoteError {
+		data, err := ipld.Encode(EncodeRemoteError(remoteErr), dagcbor.Encode)
+		require.NoError(t, err)
+		wire, err := ipld.Decode(data, dagcbor.Decode)
+		require.NoError(t, err)
+		decoded, err := DecodeRemoteError(wire)
+		require.NoError(t, err, "decode errored")
+		return decoded
+	}
+
+	decoded := roundTrip(graphsync.NewRemoteError(404, "not found"))
+	require.Equal(t, int64(404), decoded.Code())
+	require.Equal(t, "not found", decoded.Message())
+	require.Nil(t, decoded.Payload())
+
+	payload := basicnode.NewInt(30)
+	decoded = roundTrip(graphsync.NewRemoteError(429, "rate limited").WithPayload(payload))
+	require.Equal(t, int64(429), decoded.Code())
+	require.Equal(t, "rate limited", decoded.Message())
+	require.True(t, ipld.DeepEqual(payload, decoded.Payload()))
+
+	_, err := DecodeRemoteError(basicnode.NewString("not a remote error"))
+	require.Error(t, err)
+	_, err = DecodeRemoteError(fluent.MustBuildMap(basicnode.Prototype.Map, 0, func(ma fluent.MapAssembler) {}))
+	require.Error(t, err)
+	_, err = DecodeRemoteError(fluent.MustBuildMap(basicnode.Prototype.Map, 2, func(ma fluent.MapAssembler) {
+		ma.AssembleEntry("Code").AssignString("404")
+		ma.AssembleEntry("Message").AssignString("not found")
+	}))
+	require.Error(t, err)
+}
@@ -0,0 +1,193 @@
+package requestcounts
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/peeractivity"
+)
+
+// Tracker counts the requests in each state for each peer and in total, along
+// with the requests that ended in error. A request is counted from Add until
+// Remove, and moved between states with Move, so counts can be read at any
+// time without asking the request or response manager. It is safe for
+// concurrent use. A nil Tracker ignores everything recorded
+type Tracker struct {
+	lk       sync.RWMutex
+	peers    map[peer.ID]*counters
+	total    counters
+	activity *peeractivity.Tracker
+}
+
+// counters are accessed atomically
+type counters struct {
+	queued         uint64
+	running        uint64
+	paused         uint64
+	completingSend uint64
+	errored        uint64
+}
+
+func (c *counters) state(state graphsync.RequestState) *uint64 {
+	switch state {
+	case graphsync.Queued:
+		return &c.queued
+	case graphsync.Running:
+		return &c.running
+	case graphsync.Paused:
+		return &c.paused
+	case graphsync.CompletingSend:
+		return &c.completingSend
+	default:
+		return nil
+	}
+}
+
+func (c *counters) add(state graphsync.RequestState, delta uint64) {
+	if count := c.state(state); count != nil {
+		atomic.AddUint64(count, delta)
+	}
+}
+
+func (c *counters) counts() graphsync.RequestCounts {
+	return graphsync.RequestCounts{
+		Queued:         atomic.LoadUint64(&c.queued),
+		Running:        atomic.LoadUint64(&c.running),
+		Paused:         atomic.LoadUint64(&c.paused),
+		CompletingSend: atomic.LoadUint64(&c.completingSend),
+		Errored:        atomic.LoadUint64(&c.errored),
+	}
+}
+
+// New returns a tracker with nothing recorded
+func New() *Tracker {
+	return &Tracker{
+		peers: make(map[peer.ID]*counters),
+	}
+}
+
+// SetPeerActivity sets where requests are recorded as they start and finish,
+// to track the peers with requests in progress in either direction. It must be
+// called before any requests are counted
+func (t *Tracker) SetPeerActivity(activity *peeractivity.Tracker) {
+	t.activity = activity
+}
+
+// Add starts counting a new request to or from the given peer in the given
+// state
+func (t *Tracker) Add(p peer.ID, state graphsync.RequestState) {
+	if t == nil {
+		return
+	}
+	t.peer(p, true).add(state, 1)
+	t.total.add(state, 1)
+	t.activity.Started(p)
+}
+
+// Move counts a request as having moved from one state to another
+func (t *Tracker) Move(p peer.ID, from graphsync.RequestState, to graphsync.RequestState) {
+	if t == nil || from == to {
+		return
+	}
+	if c := t.peer(p, false); c != nil {
+		c.add(from, ^uint64(0))
+		c.add(to, 1)
+	}
+	t.total.add(from, ^uint64(0))
+	t.total.add(to, 1)
+}
+
+// Remove stops counting a request that ended in the given state, counting it
+// as errored if it ended with an error
+func (t *Tracker) Remove(p peer.ID, state graphsync.RequestState, err error) {
+	if t == nil {
+		return
+	}
+	if c := t.peer(p, false); c != nil {
+		c.add(state, ^uint64(0))
+		if err != nil {
+			atomic.AddUint64(&c.errored, 1)
+		}
+	}
+	t.total.add(state, ^uint64(0))
+	if err != nil {
+		atomic.AddUint64(&t.total.errored, 1)
+	}
+	t.activity.Finished(p)
+}
+
+func (t *Tracker) peer(p peer.ID, create bool) *counters {
+	t.lk.RLock()
+	c, ok := t.peers[p]
+	t.lk.RUnlock()
+	if ok || !create {
+		return c
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if c, ok = t.peers[p]; !ok {
+		c = &counters{}
+		t.peers[p] = c
+	}
+	return c
+}
+
+// ForgetPeer discards the counts for the given peer, unless it still has
+// requests in progress
+func (t *Tracker) ForgetPeer(p peer.ID) {
+	if t == nil {
+		return
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	c, ok := t.peers[p]
+	if !ok {
+		return
+	}
+	counts := c.counts()
+	if counts.Queued+counts.Running+counts.Paused+counts.CompletingSend == 0 {
+		delete(t.peers, p)
+	}
+}
+
+// Peers returns the counts for each peer that has had requests since it was
+// last forgotten
+func (t *Tracker) Peers() map[peer.ID]graphsync.RequestCounts {
+	if t == nil {
+		return nil
+	}
+	t.lk.RLock()
+	peers := make(map[peer.ID]*counters, len(t.peers))
+	for p, c := range t.peers {
+		peers[p] = c
+	}
+	t.lk.RUnlock()
+	counts := make(map[peer.ID]graphsync.RequestCounts, len(peers))
+	for p, c := range peers {
+		counts[p] = c.counts()
+	}
+	return counts
+}
+
+// Peer returns the counts for the given peer
+func (t *Tracker) Peer(p peer.ID) graphsync.RequestCounts {
+	if t == nil {
+		return graphsync.RequestCounts{}
+	}
+	c := t.peer(p, false)
+	if c == nil {
+		return graphsync.RequestCounts{}
+	}
+	return c.counts()
+}
+
+// Total returns the counts across all peers
+func (t *Tracker) Total() graphsync.RequestCounts {
+	if t == nil {
+		return graphsync.RequestCounts{}
+	}
+	return t.total.counts()
+}
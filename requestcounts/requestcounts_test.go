@@ -0,0 +1,76 @@
+package requestcounts
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestTracker(t *testing.T) {
+	tracker := New()
+	peers := testutil.GeneratePeers(2)
+
+	tracker.Add(peers[0], graphsync.Queued)
+	tracker.Add(peers[0], graphsync.Queued)
+	tracker.Add(peers[1], graphsync.Queued)
+	tracker.Move(peers[0], graphsync.Queued, graphsync.Running)
+	tracker.Move(peers[1], graphsync.Queued, graphsync.Paused)
+
+	require.Equal(t, graphsync.RequestCounts{Queued: 1, Running: 1, Paused: 1}, tracker.Total())
+	peerCounts := tracker.Peers()
+	require.Equal(t, graphsync.RequestCounts{Queued: 1, Running: 1}, peerCounts[peers[0]])
+	require.Equal(t, graphsync.RequestCounts{Paused: 1}, peerCounts[peers[1]])
+	require.Equal(t, peerCounts[peers[0]], tracker.Peer(peers[0]))
+	require.Equal(t, uint64(2), tracker.Peer(peers[0]).InProgress())
+
+	// peers with requests in progress are not forgotten
+	tracker.ForgetPeer(peers[0])
+	require.Contains(t, tracker.Peers(), peers[0])
+
+	tracker.Move(peers[0], graphsync.Running, graphsync.CompletingSend)
+	tracker.Remove(peers[0], graphsync.CompletingSend, nil)
+	tracker.Remove(peers[0], graphsync.Queued, errors.New("something went wrong"))
+	require.Equal(t, graphsync.RequestCounts{Errored: 1}, tracker.Peers()[peers[0]])
+	require.Equal(t, graphsync.RequestCounts{Paused: 1, Errored: 1}, tracker.Total())
+
+	// finished peers are forgotten, but still count in total
+	tracker.ForgetPeer(peers[0])
+	require.NotContains(t, tracker.Peers(), peers[0])
+	require.Equal(t, graphsync.RequestCounts{}, tracker.Peer(peers[0]))
+	require.Equal(t, uint64(1), tracker.Total().Errored)
+}
+
+func TestTrackerConcurrentAccess(t *testing.T) {
+	tracker := New()
+	peers := testutil.GeneratePeers(5)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		p := peers[i%len(peers)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tracker.Add(p, graphsync.Queued)
+			tracker.Move(p, graphsync.Queued, graphsync.Running)
+			_ = tracker.Peers()
+			tracker.Remove(p, graphsync.Running, nil)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, graphsync.RequestCounts{}, tracker.Total())
+}
+
+func TestNilTracker(t *testing.T) {
+	var tracker *Tracker
+	p := testutil.GeneratePeers(1)[0]
+	tracker.Add(p, graphsync.Queued)
+	tracker.Move(p, graphsync.Queued, graphsync.Running)
+	tracker.Remove(p, graphsync.Running, nil)
+	tracker.ForgetPeer(p)
+	require.Nil(t, tracker.Peers())
+	require.Equal(t, graphsync.RequestCounts{}, tracker.Total())
+}
@@ -4,22 +4,33 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/benbjohnson/clock"
 	"github.com/hannahhoward/go-pubsub"
 	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipfs/go-peertaskqueue/peertask"
 	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
 	"github.com/ipld/go-ipld-prime/traversal"
 	"github.com/ipld/go-ipld-prime/traversal/selector"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/cidset"
+	"github.com/ipfs/go-graphsync/deadline"
 	"github.com/ipfs/go-graphsync/ipldutil"
+	"github.com/ipfs/go-graphsync/limits"
 	"github.com/ipfs/go-graphsync/listeners"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/messagequeue"
@@ -27,10 +38,13 @@ import (
 	"github.com/ipfs/go-graphsync/notifications"
 	"github.com/ipfs/go-graphsync/panics"
 	"github.com/ipfs/go-graphsync/peerstate"
+	"github.com/ipfs/go-graphsync/requestcounts"
 	"github.com/ipfs/go-graphsync/requestmanager/executor"
 	"github.com/ipfs/go-graphsync/requestmanager/hooks"
 	"github.com/ipfs/go-graphsync/requestmanager/reconciledloader"
+	"github.com/ipfs/go-graphsync/requestmanager/types"
 	"github.com/ipfs/go-graphsync/taskqueue"
+	"github.com/ipfs/go-graphsync/transferstats"
 )
 
 // The code in this file implements the public interface of the request manager.
@@ -57,18 +71,55 @@ type inProgressRequestStatus struct {
 	onTerminated         []chan<- error
 	request              gsmsg.GraphSyncRequest
 	doNotSendFirstBlocks int64
-	nodeStyleChooser     traversal.LinkTargetNodePrototypeChooser
-	inProgressChan       chan graphsync.ResponseProgress
-	inProgressErr        chan error
-	traverser            ipldutil.Traverser
-	traverserCancel      context.CancelFunc
-	lsys                 *ipld.LinkSystem
-	reconciledLoader     *reconciledloader.ReconciledLoader
+	dependsOn            []graphsync.RequestID
+	// the persistence option the request stores blocks in, empty for the default
+	persistenceOption string
+	// maximum number of links to traverse. A value of zero = infinity, or no limit
+	maxLinks uint64
+	// metadata only requests are not traversed locally, and deliver the links
+	// in the responder's metadata instead
+	metadataOnly     bool
+	nodeStyleChooser traversal.LinkTargetNodePrototypeChooser
+	inProgressChan   chan graphsync.ResponseProgress
+	inProgressErr    chan error
+	// receives the raw data of each block the traversal loads, nil unless the
+	// request was made with RequestRawBlocks
+	rawBlocks        chan blocks.Block
+	completed        chan completedResponse
+	traverser        ipldutil.Traverser
+	traverserCancel  context.CancelFunc
+	lsys             *ipld.LinkSystem
+	reconciledLoader *reconciledloader.ReconciledLoader
+	traversalError   error
+	eventSubscribers []*requestEventSubscriber
+	messageTaps      []*messageTap
+	retries          int
+	bytesReceived    uint64
+	// the blocks the request has loaded and verified so far
+	receivedCids *types.ReceivedCids
+	// verification time of reconciled loaders discarded when the request was
+	// re-issued
+	priorVerificationTime time.Duration
+	// request to re-issue once the current execution stops, after the remote
+	// peer proposed an alternate selector that was accepted
+	reissueRequest *gsmsg.GraphSyncRequest
+	// the number of times the request was re-issued with a proposed selector
+	selectorProposals int
+	// RequestCancelled responses still expected from the remote peer in reply
+	// to the cancels sent when the request paused. Only peers that negotiated
+	// ExtensionCancelAck reply
+	cancelAcksExpected int
+	// the successful status the request was completed with by the remote
+	// peer, zero until then
+	completedStatus graphsync.ResponseStatusCode
+	// whether the remote peer reported any block as missing, which means the
+	// request can only complete partially
+	remoteMissingBlocks bool
 }
 
 // PeerHandler is an interface that can send requests to peers
 type PeerHandler interface {
-	AllocateAndBuildMessage(p peer.ID, blkSize uint64, buildMessageFn func(*messagequeue.Builder))
+	BuildRequestMessage(p peer.ID, buildMessageFn func(*messagequeue.Builder))
 }
 
 // PersistenceOptions is an interface for getting loaders by name
@@ -91,14 +142,57 @@ type RequestManager struct {
 	// maximum number of links to traverse per request. A value of zero = infinity, or no limit
 	maxLinksPerRequest uint64
 	panicCallback      panics.CallBackFn
+	// coalesces new requests to the same peer, nil if batching is disabled
+	batcher      *requestBatcher
+	retryOptions graphsync.RetryOptions
+	// the most times a request is re-issued with a selector the remote peer
+	// proposed
+	maxSelectorProposals int
 
 	// dont touch out side of run loop
 	inProgressRequestStatuses          map[graphsync.RequestID]*inProgressRequestStatus
 	requestHooks                       RequestHooks
 	responseHooks                      ResponseHooks
+	selectorProposalHooks              SelectorProposalHooks
 	networkErrorListeners              *listeners.NetworkErrorListeners
 	outgoingRequestProcessingListeners *listeners.RequestProcessingListeners
+	completedResponseHooks             *listeners.CompletedResponseHooks
 	requestQueue                       taskqueue.TaskQueue
+	tombstones                         *tombstones
+	// records traversals stopped by the link budget, may be nil
+	limitRecorder *limits.Recorder
+	metrics       graphsync.MetricsRecorder
+	// chooses IDs for new requests
+	requestIDAllocator graphsync.RequestIDAllocator
+	// counts blocks transferred for each request, may be nil
+	transferStats *transferstats.Tracker
+	// counts requests in each state, may be nil
+	requestCounts *requestcounts.Tracker
+	// learns the extensions each peer supports, nil if negotiation is disabled
+	negotiation *extensionNegotiation
+	// re-hashes and size checks blocks before they are ingested
+	strictVerification bool
+	// largest block accepted with strict verification, zero for no limit
+	maxBlockSize uint64
+	// asks responders to compress blocks with this codec, may be nil
+	blockCompression graphsync.CompressionCodec
+	// chooses node prototypes for traversals when neither the request nor
+	// hooks set a chooser, nil for the built in default
+	defaultChooser traversal.LinkTargetNodePrototypeChooser
+	// saves the progress of requests every progressInterval, may be nil
+	progressStore    graphsync.PersistenceStore
+	progressInterval time.Duration
+	// once set, new requests fail immediately with this error
+	closedErr error
+	// closed once there are no requests in progress
+	drainedWaiters []chan struct{}
+
+	// closed when the internal thread exits
+	stopped chan struct{}
+
+	// cumulative nanoseconds ended requests spent on verification, accessed
+	// atomically
+	verificationTime int64
 }
 
 type requestManagerMessage interface {
@@ -115,37 +209,105 @@ type ResponseHooks interface {
 	ProcessResponseHooks(p peer.ID, response graphsync.ResponseData) hooks.UpdateResult
 }
 
+// SelectorProposalHooks run for alternate selectors proposed by responders
+type SelectorProposalHooks interface {
+	ProcessSelectorProposalHooks(p peer.ID, request graphsync.RequestData, proposal graphsync.SelectorProposal) bool
+}
+
 // New generates a new request manager from a context, network, and selectorQuerier
 func New(ctx context.Context,
 	persistenceOptions PersistenceOptions,
 	linkSystem ipld.LinkSystem,
 	requestHooks RequestHooks,
 	responseHooks ResponseHooks,
+	selectorProposalHooks SelectorProposalHooks,
 	networkErrorListeners *listeners.NetworkErrorListeners,
 	outgoingRequestProcessingListeners *listeners.RequestProcessingListeners,
+	completedResponseHooks *listeners.CompletedResponseHooks,
 	requestQueue taskqueue.TaskQueue,
 	connManager network.ConnManager,
 	maxLinksPerRequest uint64,
 	panicCallback panics.CallBackFn,
+	requestBatchWindow time.Duration,
+	retryOptions graphsync.RetryOptions,
+	tombstoneOptions graphsync.TombstoneOptions,
+	limitRecorder *limits.Recorder,
+	maxProgressBuffer int,
 ) *RequestManager {
 	ctx, cancel := context.WithCancel(ctx)
-	return &RequestManager{
+	rm := &RequestManager{
 		ctx:                                ctx,
 		cancel:                             cancel,
 		persistenceOptions:                 persistenceOptions,
 		disconnectNotif:                    pubsub.New(disconnectDispatcher),
 		linkSystem:                         linkSystem,
-		rc:                                 newResponseCollector(ctx),
+		rc:                                 newResponseCollector(ctx, maxProgressBuffer),
 		messages:                           make(chan requestManagerMessage, 16),
 		inProgressRequestStatuses:          make(map[graphsync.RequestID]*inProgressRequestStatus),
+		tombstones:                         newTombstones(tombstoneOptions, clock.New(), limitRecorder),
+		limitRecorder:                      limitRecorder,
+		metrics:                            &graphsync.NoopMetricsRecorder{},
+		requestIDAllocator:                 defaultRequestIDAllocator,
+		stopped:                            make(chan struct{}),
 		requestHooks:                       requestHooks,
 		responseHooks:                      responseHooks,
+		selectorProposalHooks:              selectorProposalHooks,
 		networkErrorListeners:              networkErrorListeners,
 		outgoingRequestProcessingListeners: outgoingRequestProcessingListeners,
+		completedResponseHooks:             completedResponseHooks,
 		requestQueue:                       requestQueue,
 		connManager:                        connManager,
 		maxLinksPerRequest:                 maxLinksPerRequest,
 		panicCallback:                      panicCallback,
+		retryOptions:                       retryOptions,
+		maxSelectorProposals:               DefaultMaxSelectorProposals,
+	}
+	if requestBatchWindow > 0 {
+		rm.batcher = newRequestBatcher(requestBatchWindow, clock.New(), rm.sendRequests)
+	}
+	return rm
+}
+
+// DefaultMaxSelectorProposals is the most times a request is re-issued with a
+// proposed selector when no limit is configured
+const DefaultMaxSelectorProposals = 1
+
+// Drain fails any new requests with the given error, and lets requests
+// already in progress carry on. Requests still in progress when the request
+// manager shuts down also end with the error. It returns once no requests are
+// in progress, or ctx is cancelled
+func (rm *RequestManager) Drain(ctx context.Context, terminalError error) error {
+	rm.rc.setClosedErr(terminalError)
+	drained := make(chan struct{})
+	rm.send(&drainRequestsMessage{terminalError, drained}, ctx.Done())
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-rm.ctx.Done():
+		return errors.New("context cancelled")
+	case <-drained:
+		return nil
+	}
+}
+
+// CancelAllRequests cancels every in progress request with the given error,
+// sending cancels to peers for requests already sent, and fails any new
+// requests with the same error. It returns once all requests have terminated,
+// or ctx is cancelled
+func (rm *RequestManager) CancelAllRequests(ctx context.Context, terminalError error) error {
+	rm.rc.setClosedErr(terminalError)
+	if rm.progressStore != nil {
+		rm.saveProgress()
+	}
+	drained := make(chan struct{})
+	rm.send(&cancelAllRequestsMessage{terminalError, drained}, ctx.Done())
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-rm.ctx.Done():
+		return errors.New("context cancelled")
+	case <-drained:
+		return nil
 	}
 }
 
@@ -154,11 +316,122 @@ func (rm *RequestManager) SetDelegate(peerHandler PeerHandler) {
 	rm.peerHandler = peerHandler
 }
 
+// SetMetricsRecorder sets where the request manager reports request and
+// block metrics. It must be called before Startup
+func (rm *RequestManager) SetMetricsRecorder(metrics graphsync.MetricsRecorder) {
+	rm.metrics = metrics
+}
+
+// SetRequestIDAllocator sets how the request manager chooses IDs for new
+// requests. It must be called before Startup
+func (rm *RequestManager) SetRequestIDAllocator(requestIDAllocator graphsync.RequestIDAllocator) {
+	rm.requestIDAllocator = requestIDAllocator
+}
+
+// SetTransferStats sets where blocks transferred for each request are counted.
+// The request manager tracks each request from when it starts until it ends,
+// and reports its counts on the terminal request event. It must be called before Startup
+func (rm *RequestManager) SetTransferStats(transferStats *transferstats.Tracker) {
+	rm.transferStats = transferStats
+}
+
+// SetRequestCounts sets where requests are counted in each state as they move
+// between states. It must be called before Startup
+func (rm *RequestManager) SetRequestCounts(requestCounts *requestcounts.Tracker) {
+	rm.requestCounts = requestCounts
+}
+
+// SetSupportedExtensions enables extension negotiation. The first request to
+// each peer lists the given extensions, and once the peer reports which of them
+// it supports, the others are left out of later requests to it. Listeners are
+// notified when a peer reports the extensions it supports. It must be called
+// before Startup
+func (rm *RequestManager) SetSupportedExtensions(supportedExtensions []graphsync.ExtensionName, negotiationListeners *listeners.NegotiationCompleteListeners) {
+	rm.negotiation = newExtensionNegotiation(supportedExtensions, negotiationListeners)
+}
+
+// SetMaxSelectorProposals sets the most times a request is re-issued with a
+// selector the remote peer proposed, so a peer that keeps proposing selectors
+// cannot keep a request going forever. Once the limit is reached, a request
+// that is rejected with another proposal fails with
+// graphsync.SelectorProposalLimitErr. It must be called before Startup
+func (rm *RequestManager) SetMaxSelectorProposals(maxSelectorProposals int) {
+	rm.maxSelectorProposals = maxSelectorProposals
+}
+
+// SetBlockCompression asks responders to compress the blocks they send with
+// the given codec. Responders that do not support it send blocks uncompressed.
+// It must be called before Startup
+func (rm *RequestManager) SetBlockCompression(codec graphsync.CompressionCodec) {
+	rm.blockCompression = codec
+}
+
+// SetStrictVerification checks every block received against the link it was
+// sent for, and rejects blocks larger than maxBlockSize, before the block
+// reaches a traversal or the local store. A request that receives an invalid
+// block is cancelled and fails with graphsync.ErrInvalidBlock. A maxBlockSize
+// of zero does not limit block size. It must be called before Startup
+func (rm *RequestManager) SetStrictVerification(maxBlockSize uint64) {
+	rm.strictVerification = true
+	rm.maxBlockSize = maxBlockSize
+}
+
+// SetDefaultChooser sets the node prototype chooser for the traversals of
+// requests that neither set their own nor have one set by hooks. It must be
+// called before Startup
+func (rm *RequestManager) SetDefaultChooser(chooser traversal.LinkTargetNodePrototypeChooser) {
+	rm.defaultChooser = chooser
+}
+
+// SetProgressStore saves the progress of requests in progress to the given
+// store every interval, and when all requests are cancelled as the exchange
+// closes. It must be called before Startup
+func (rm *RequestManager) SetProgressStore(store graphsync.PersistenceStore, interval time.Duration) {
+	rm.progressStore = store
+	rm.progressInterval = interval
+}
+
+func defaultRequestIDAllocator(peer.ID, cid.Cid, ipld.Node) graphsync.RequestID {
+	return graphsync.NewRequestID()
+}
+
+// hasExtension returns true if the given extensions include one with the name
+func hasExtension(extensions []graphsync.ExtensionData, name graphsync.ExtensionName) bool {
+	for _, extension := range extensions {
+		if extension.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// AllocateRequestID chooses the ID for a new request to the given peer, in
+// the same way as for requests made without an ID in their context
+func (rm *RequestManager) AllocateRequestID(p peer.ID, root ipld.Link, selectorNode ipld.Node) graphsync.RequestID {
+	var rootCid cid.Cid
+	if asCidLink, ok := root.(cidlink.Link); ok {
+		rootCid = asCidLink.Cid
+	}
+	return rm.requestIDAllocator(p, rootCid, selectorNode)
+}
+
 type inProgressRequest struct {
 	requestID     graphsync.RequestID
 	request       gsmsg.GraphSyncRequest
 	incoming      chan graphsync.ResponseProgress
 	incomingError chan error
+	// nil unless the request delivers raw blocks
+	incomingBlocks chan blocks.Block
+	// receives the final status once the request terminates, nil if the
+	// request failed before it started
+	completed <-chan completedResponse
+}
+
+// completedResponse is the outcome of an outgoing request, passed to
+// completed response hooks
+type completedResponse struct {
+	status     graphsync.ResponseStatusCode
+	extensions []graphsync.ExtensionData
 }
 
 // NewRequest initiates a new GraphSync request to the given peer.
@@ -167,6 +440,29 @@ func (rm *RequestManager) NewRequest(ctx context.Context,
 	root ipld.Link,
 	selectorNode ipld.Node,
 	extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan error) {
+	responses, _, errs := rm.startRequest(ctx, p, root, selectorNode, false, extensions)
+	return responses, errs
+}
+
+// RequestRawBlocks initiates a new GraphSync request to the given peer, also
+// delivering the raw data of each block the traversal loads, in traversal
+// order. Blocks are buffered like responses, so once the buffer is full the
+// traversal waits for the caller to read them. The block channel closes when
+// the response channel does
+func (rm *RequestManager) RequestRawBlocks(ctx context.Context,
+	p peer.ID,
+	root ipld.Link,
+	selectorNode ipld.Node,
+	extensions ...graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan blocks.Block, <-chan error) {
+	return rm.startRequest(ctx, p, root, selectorNode, true, extensions)
+}
+
+func (rm *RequestManager) startRequest(ctx context.Context,
+	p peer.ID,
+	root ipld.Link,
+	selectorNode ipld.Node,
+	rawBlocks bool,
+	extensions []graphsync.ExtensionData) (<-chan graphsync.ResponseProgress, <-chan blocks.Block, <-chan error) {
 
 	span := trace.SpanFromContext(ctx)
 
@@ -175,22 +471,42 @@ func (rm *RequestManager) NewRequest(ctx context.Context,
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
 		defer span.End()
-		return rm.singleErrorResponse(err)
+		responses, errs := rm.singleErrorResponse(err)
+		return responses, closedBlocks(), errs
+	}
+
+	requestID, ok := ctx.Value(graphsync.RequestIDContextKey{}).(graphsync.RequestID)
+	if !ok {
+		requestID = rm.AllocateRequestID(p, root, selectorNode)
 	}
 
-	requestID := graphsync.NewRequestID()
-	idFromContext := ctx.Value(graphsync.RequestIDContextKey{})
-	if existingRequestID, ok := idFromContext.(graphsync.RequestID); ok {
-		requestID = existingRequestID
+	// let the responder know how long we will wait, unless the caller already has
+	if ctxDeadline, ok := ctx.Deadline(); ok && !hasExtension(extensions, graphsync.ExtensionDeadline) {
+		extensions = append(extensions[:len(extensions):len(extensions)], graphsync.ExtensionData{
+			Name: graphsync.ExtensionDeadline,
+			Data: deadline.EncodeDeadline(time.Until(ctxDeadline)),
+		})
 	}
 
 	inProgressRequestChan := make(chan inProgressRequest)
 
-	rm.send(&newRequestMessage{requestID, span, p, root, selectorNode, extensions, inProgressRequestChan}, ctx.Done())
+	// a link budget set for this request overrides the default budget
+	maxLinks, ok := ctx.Value(graphsync.MaxLinksContextKey{}).(uint64)
+	if !ok {
+		maxLinks = rm.maxLinksPerRequest
+	}
+
+	// a chooser set for this request overrides the one from hooks
+	chooser, _ := ctx.Value(graphsync.LinkTargetNodePrototypeChooserContextKey{}).(traversal.LinkTargetNodePrototypeChooser)
+
+	// requests this request needs blocks from are raised to its priority
+	dependsOn, _ := ctx.Value(graphsync.RequestDependenciesContextKey{}).([]graphsync.RequestID)
+	rm.send(&newRequestMessage{requestID, span, p, root, selectorNode, extensions, maxLinks, chooser, dependsOn, rawBlocks, inProgressRequestChan}, ctx.Done())
 	var receivedInProgressRequest inProgressRequest
 	select {
 	case <-rm.ctx.Done():
-		return rm.emptyResponse()
+		responses, errs := rm.emptyResponse()
+		return responses, closedBlocks(), errs
 	case receivedInProgressRequest = <-inProgressRequestChan:
 	}
 
@@ -199,7 +515,13 @@ func (rm *RequestManager) NewRequest(ctx context.Context,
 		rm.networkErrorListeners.NotifyNetworkErrorListeners(p, receivedInProgressRequest.request, neterr)
 	})
 
-	return rm.rc.collectResponses(ctx,
+	var returnedBlocks <-chan blocks.Block
+	if receivedInProgressRequest.incomingBlocks != nil {
+		returnedBlocks = rm.rc.collectBlocks(ctx, receivedInProgressRequest.incomingBlocks)
+	} else {
+		returnedBlocks = closedBlocks()
+	}
+	responses, errs := rm.rc.collectResponses(ctx,
 		receivedInProgressRequest.incoming,
 		receivedInProgressRequest.incomingError,
 		func() {
@@ -207,9 +529,127 @@ func (rm *RequestManager) NewRequest(ctx context.Context,
 				receivedInProgressRequest.incoming,
 				receivedInProgressRequest.incomingError)
 		},
-		// Once the request has completed, stop listening for disconnect events
-		unsub,
+		func() {
+			// Once the request has completed, stop listening for disconnect events
+			unsub()
+			rm.notifyCompletedResponseHooks(ctx, p, receivedInProgressRequest)
+		},
 	)
+	return responses, returnedBlocks, errs
+}
+
+// notifyCompletedResponseHooks runs completed response hooks once the response
+// channel for a request is closed
+func (rm *RequestManager) notifyCompletedResponseHooks(ctx context.Context, p peer.ID, ipr inProgressRequest) {
+	if ipr.completed == nil {
+		return
+	}
+	var completed completedResponse
+	select {
+	case completed = <-ipr.completed:
+	case <-rm.ctx.Done():
+		select {
+		case completed = <-ipr.completed:
+		default:
+			completed.status = graphsync.RequestCancelled
+		}
+	}
+	// a request whose context ended was cancelled locally, whatever the
+	// responder last said
+	if ctx.Err() != nil {
+		completed.status = graphsync.RequestCancelled
+	}
+	rm.completedResponseHooks.ProcessCompletedResponseHooks(p, ipr.request, completed.status, completed.extensions)
+}
+
+// RequestMany initiates several GraphSync requests to the given peer together,
+// so they can share a connection and be sent in fewer messages. Responses and
+// errors from every request are merged into a single pair of channels, tagged
+// with the request they belong to. A failed request does not affect the
+// others, but cancelling ctx cancels them all
+func (rm *RequestManager) RequestMany(ctx context.Context,
+	p peer.ID,
+	roots []graphsync.RootSelector,
+	extensions ...graphsync.ExtensionData) (<-chan graphsync.SubRequestProgress, <-chan error) {
+	outgoingResponses := make(chan graphsync.SubRequestProgress)
+	outgoingErrors := make(chan error)
+	// responses and errors are forwarded separately, so that reading all
+	// responses before reading errors never blocks
+	var responsesWg, errorsWg sync.WaitGroup
+	responsesWg.Add(len(roots))
+	errorsWg.Add(len(roots))
+	for i, root := range roots {
+		// every request gets its own id, even if one was set on ctx
+		requestID := rm.AllocateRequestID(p, root.Root, root.Selector)
+		requestCtx := context.WithValue(ctx, graphsync.RequestIDContextKey{}, requestID)
+		// each request ends its own span when it completes
+		requestCtx, _ = otel.Tracer("graphsync").Start(requestCtx, "request", trace.WithAttributes(
+			attribute.String("peerID", p.Pretty()),
+			attribute.String("root", root.Root.String()),
+			attribute.Int("index", i),
+		))
+		responses, errs := rm.NewRequest(requestCtx, p, root.Root, root.Selector, extensions...)
+		go func(index int) {
+			defer responsesWg.Done()
+			for response := range responses {
+				select {
+				case outgoingResponses <- graphsync.SubRequestProgress{ResponseProgress: response, Index: index, RequestID: requestID}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(i)
+		go func(index int) {
+			defer errorsWg.Done()
+			for err := range errs {
+				select {
+				case outgoingErrors <- graphsync.SubRequestError{Index: index, RequestID: requestID, Err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(i)
+	}
+	go func() {
+		responsesWg.Wait()
+		close(outgoingResponses)
+	}()
+	go func() {
+		errorsWg.Wait()
+		close(outgoingErrors)
+	}()
+	return outgoingResponses, outgoingErrors
+}
+
+// RequestCids initiates a metadata only request to the given peer, which
+// traverses the selector but sends no block data. The returned channel receives
+// the CIDs of the blocks the peer has for the traversal, in traversal order,
+// including any block the traversal reaches more than once. Blocks the peer is
+// missing are reported as RemoteMissingBlockErr errors, and nothing is stored
+// locally
+func (rm *RequestManager) RequestCids(ctx context.Context,
+	p peer.ID,
+	root ipld.Link,
+	selectorNode ipld.Node,
+	extensions ...graphsync.ExtensionData) (<-chan cid.Cid, <-chan error) {
+	extensions = append(extensions, graphsync.ExtensionData{Name: graphsync.ExtensionMetadataOnly, Data: basicnode.NewBool(true)})
+	responses, errs := rm.NewRequest(ctx, p, root, selectorNode, extensions...)
+	cids := make(chan cid.Cid)
+	go func() {
+		defer close(cids)
+		for response := range responses {
+			asCidLink, ok := response.LastBlock.Link.(cidlink.Link)
+			if !ok {
+				continue
+			}
+			select {
+			case cids <- asCidLink.Cid:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return cids, errs
 }
 
 // Dispatch the Disconnect event to subscribers
@@ -230,10 +670,26 @@ func (rm *RequestManager) listenForDisconnect(p peer.ID, onDisconnect func(neter
 	})
 }
 
-// Disconnected is called when a peer disconnects
+// Disconnected is called when a peer disconnects. Requests in progress with
+// the peer fail with graphsync.ErrPeerDisconnected
 func (rm *RequestManager) Disconnected(p peer.ID) {
 	// Notify any listeners that a peer has disconnected
 	_ = rm.disconnectNotif.Publish(p)
+	rm.send(&disconnectedMessage{p}, nil)
+}
+
+// PeerEvicted is called when the state kept for a peer that is not connected
+// is evicted for being idle. The extensions the peer reported are forgotten,
+// so the next request to it negotiates them again
+func (rm *RequestManager) PeerEvicted(p peer.ID) {
+	rm.send(&peerEvictedMessage{p}, nil)
+}
+
+// ReceivedMalformedMessage is called when a message from a peer could not be
+// decoded. The responses it held are lost, so requests in progress with the
+// peer are cancelled and fail with graphsync.MalformedResponseErr
+func (rm *RequestManager) ReceivedMalformedMessage(p peer.ID, err error) {
+	rm.send(&malformedMessageMessage{p, err}, nil)
 }
 
 func (rm *RequestManager) emptyResponse() (chan graphsync.ResponseProgress, chan error) {
@@ -244,6 +700,13 @@ func (rm *RequestManager) emptyResponse() (chan graphsync.ResponseProgress, chan
 	return ch, errCh
 }
 
+// closedBlocks is the block channel of a request that delivers no blocks
+func closedBlocks() chan blocks.Block {
+	blks := make(chan blocks.Block)
+	close(blks)
+	return blks
+}
+
 func (rm *RequestManager) singleErrorResponse(err error) (chan graphsync.ResponseProgress, chan error) {
 	ch := make(chan graphsync.ResponseProgress)
 	close(ch)
@@ -277,13 +740,19 @@ func (rm *RequestManager) cancelRequestAndClose(requestID graphsync.RequestID,
 	}
 }
 
-// CancelRequest cancels the given request ID and waits for the request to terminate
+// CancelRequest cancels the given request ID and waits for the request to terminate.
+// Only that request is cancelled, even if other requests share its context. Its
+// channels are closed after the error channel receives a RequestClientCancelledErr.
+// Cancelling a request that is unknown or already finished returns a RequestNotFoundErr.
+// If ctx is cancelled first, CancelRequest stops waiting and returns the context's error
 func (rm *RequestManager) CancelRequest(ctx context.Context, requestID graphsync.RequestID) error {
 	terminated := make(chan error, 1)
 	rm.send(&cancelRequestMessage{requestID, terminated, graphsync.RequestClientCancelledErr{}}, ctx.Done())
 	select {
 	case <-rm.ctx.Done():
 		return errors.New("context cancelled")
+	case <-ctx.Done():
+		return ctx.Err()
 	case err := <-terminated:
 		return err
 	}
@@ -295,7 +764,34 @@ func (rm *RequestManager) ProcessResponses(p peer.ID,
 	responses []gsmsg.GraphSyncResponse,
 	blks []blocks.Block) {
 
-	rm.send(&processResponsesMessage{p, responses, blks}, nil)
+	rm.send(&processResponsesMessage{p, responses, blks, nil}, nil)
+}
+
+// ProcessMessage ingests a message from the network, updating in progress
+// requests based on its responses and handing the message to any taps on
+// those requests
+func (rm *RequestManager) ProcessMessage(p peer.ID, message gsmsg.GraphSyncMessage) {
+	rm.send(&processResponsesMessage{p, message.Responses(), message.Blocks(), &message}, nil)
+}
+
+// TapMessages returns a channel that receives the raw messages received for
+// the given outgoing request, in arrival order, along with a function to detach
+// the tap that may be called more than once. Delivery never blocks processing
+// of the request -- if the channel is not read quickly enough, messages are
+// dropped. The channel closes when the request terminates or the tap is detached
+func (rm *RequestManager) TapMessages(requestID graphsync.RequestID) (<-chan gsmsg.GraphSyncMessage, func()) {
+	response := make(chan *messageTap, 1)
+	rm.send(&tapMessagesMessage{requestID, response}, nil)
+	select {
+	case <-rm.ctx.Done():
+		messages := make(chan gsmsg.GraphSyncMessage)
+		close(messages)
+		return messages, func() {}
+	case tap := <-response:
+		return tap.messages, func() {
+			rm.send(&untapMessagesMessage{requestID, tap}, nil)
+		}
+	}
 }
 
 // UnpauseRequest unpauses a request that was paused in a block hook based request ID
@@ -311,7 +807,8 @@ func (rm *RequestManager) UnpauseRequest(ctx context.Context, requestID graphsyn
 	}
 }
 
-// PauseRequest pauses an in progress request (may take 1 or more blocks to process)
+// PauseRequest pauses an in progress request (may take 1 or more blocks to process).
+// Pausing a request that is already paused does nothing
 func (rm *RequestManager) PauseRequest(ctx context.Context, requestID graphsync.RequestID) error {
 	response := make(chan error, 1)
 	rm.send(&pauseRequestMessage{requestID, response}, ctx.Done())
@@ -335,6 +832,26 @@ func (rm *RequestManager) UpdateRequest(ctx context.Context, requestID graphsync
 	}
 }
 
+// SubscribeToRequestEvents returns a channel of lifecycle events for the given
+// outgoing request, along with a function to unsubscribe that may be called
+// more than once. The channel closes after a terminal event (Completed or Errored)
+// is delivered or when unsubscribed. If the request has already finished,
+// its terminal event is delivered immediately from the request's tombstone.
+// Once the tombstone is forgotten (see graphsync.TombstoneOptions), the
+// channel is closed without any events, just as for an unknown request.
+func (rm *RequestManager) SubscribeToRequestEvents(requestID graphsync.RequestID) (<-chan graphsync.RequestEvent, func()) {
+	response := make(chan requestEventSubscription, 1)
+	rm.send(&subscribeToRequestEventsMessage{requestID, response}, nil)
+	select {
+	case <-rm.ctx.Done():
+		events := make(chan graphsync.RequestEvent)
+		close(events)
+		return events, func() {}
+	case subscription := <-response:
+		return subscription.events, subscription.unsubscribe
+	}
+}
+
 // GetRequestTask gets data for the given task in the request queue
 func (rm *RequestManager) GetRequestTask(p peer.ID, task *peertask.Task, requestExecutionChan chan executor.RequestTask) {
 	rm.send(&getRequestTaskMessage{p, task, requestExecutionChan}, nil)
@@ -362,18 +879,191 @@ func (rm *RequestManager) PeerState(p peer.ID) peerstate.PeerState {
 	}
 }
 
+// CompletedRequests lists the recently completed requests that are still
+// remembered, in the order they completed
+func (rm *RequestManager) CompletedRequests() []graphsync.RequestTombstone {
+	response := make(chan []graphsync.RequestTombstone, 1)
+	rm.send(&completedRequestsMessage{response}, nil)
+	select {
+	case <-rm.ctx.Done():
+		return nil
+	case completedRequests := <-response:
+		return completedRequests
+	}
+}
+
+// InProgressRequests lists the outgoing requests that have not yet completed,
+// in the order they started. Only a snapshot is taken on the internal thread,
+// so calling this does not hold up in progress requests
+func (rm *RequestManager) InProgressRequests() []graphsync.InProgressRequestInfo {
+	response := make(chan []requestSnapshot, 1)
+	rm.send(&inProgressRequestsMessage{response}, nil)
+	var snapshots []requestSnapshot
+	select {
+	case <-rm.ctx.Done():
+		return nil
+	case snapshots = <-response:
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].startTime.Before(snapshots[j].startTime)
+	})
+	requests := make([]graphsync.InProgressRequestInfo, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		stats, _ := rm.transferStats.Request(snapshot.request.ID())
+		requests = append(requests, graphsync.InProgressRequestInfo{
+			RequestID:         snapshot.request.ID(),
+			Peer:              snapshot.p,
+			Root:              snapshot.request.Root(),
+			Selector:          snapshot.request.SelectorString(),
+			State:             snapshot.state,
+			BlocksProcessed:   stats.BlocksReceived + stats.BlocksLocal,
+			BytesProcessed:    stats.BytesReceived + stats.BytesLocal,
+			StartTime:         snapshot.startTime,
+			PersistenceOption: snapshot.persistenceOption,
+			Extensions:        snapshot.request.ApplicationExtensions(),
+		})
+	}
+	return requests
+}
+
+// ExportState returns a checkpoint for each outgoing request that has not yet
+// completed, in the order they started, from which ImportState can resume the
+// requests in another process. Blocks in flight when the checkpoint is taken
+// are not included, and are fetched again on resume
+func (rm *RequestManager) ExportState() ([]graphsync.RequestCheckpoint, error) {
+	response := make(chan []graphsync.RequestCheckpoint, 1)
+	rm.send(&exportStateMessage{response}, nil)
+	select {
+	case <-rm.ctx.Done():
+		return nil, rm.ctx.Err()
+	case checkpoints := <-response:
+		return checkpoints, nil
+	}
+}
+
+// ImportState re-issues the requests in checkpoints taken with ExportState.
+// Each is sent with a resume extension listing the blocks it already received,
+// so the remote peer skips them and they are loaded from the local store
+// instead. Resuming only works if the remote peer named in the checkpoint is
+// still reachable, and the blocks received are still in the store the request
+// uses
+func (rm *RequestManager) ImportState(ctx context.Context, checkpoints []graphsync.RequestCheckpoint) []graphsync.ResumedRequest {
+	resumed := make([]graphsync.ResumedRequest, 0, len(checkpoints))
+	for _, checkpoint := range checkpoints {
+		extensions := checkpoint.Extensions[:len(checkpoint.Extensions):len(checkpoint.Extensions)]
+		if checkpoint.Received != nil && checkpoint.Received.Len() > 0 {
+			extensions = append(extensions, graphsync.ExtensionData{
+				Name: graphsync.ExtensionResume,
+				Data: cidset.EncodeCidSet(checkpoint.Received),
+			})
+		}
+		responses, errs := rm.NewRequest(ctx, checkpoint.Peer, cidlink.Link{Cid: checkpoint.Root}, checkpoint.Selector, extensions...)
+		resumed = append(resumed, graphsync.ResumedRequest{
+			Checkpoint: checkpoint,
+			Responses:  responses,
+			Errors:     errs,
+		})
+	}
+	return resumed
+}
+
+// TombstoneStats gets stats on recently completed requests and the responses
+// received for requests no longer in progress
+func (rm *RequestManager) TombstoneStats() graphsync.TombstoneStats {
+	response := make(chan graphsync.TombstoneStats, 1)
+	rm.send(&tombstoneStatsMessage{response}, nil)
+	select {
+	case <-rm.ctx.Done():
+		return graphsync.TombstoneStats{}
+	case stats := <-response:
+		return stats
+	}
+}
+
+// VerificationTime returns the total time requests that have ended spent
+// verifying responses and storing the blocks received
+func (rm *RequestManager) VerificationTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&rm.verificationTime))
+}
+
 // SendRequest sends a request to the message queue
+// If request batching is enabled, new requests are held briefly so they can
+// be sent along with other new requests to the same peer
 func (rm *RequestManager) SendRequest(p peer.ID, request gsmsg.GraphSyncRequest) {
-	sub := &reqSubscriber{p, request, rm.networkErrorListeners}
-	rm.peerHandler.AllocateAndBuildMessage(p, 0, func(builder *messagequeue.Builder) {
-		builder.AddRequest(request)
-		builder.SetSubscriber(request.ID(), sub)
+	if rm.batcher != nil {
+		switch request.Type() {
+		case graphsync.RequestTypeNew:
+			rm.batcher.add(p, request)
+			return
+		case graphsync.RequestTypeCancel:
+			// if the request never left, there is nothing to cancel on the remote
+			if !rm.batcher.remove(p, request.ID()) {
+				rm.batcher.sendNow(p, request)
+			}
+		default:
+			// make sure the remote receives a request before any updates to it
+			rm.batcher.flush(p, request)
+		}
+		return
+	}
+	rm.sendRequests(p, []gsmsg.GraphSyncRequest{request})
+}
+
+func (rm *RequestManager) sendRequests(p peer.ID, requests []gsmsg.GraphSyncRequest) {
+	rm.peerHandler.BuildRequestMessage(p, func(builder *messagequeue.Builder) {
+		for _, request := range requests {
+			sub := &reqSubscriber{p, request, rm.networkErrorListeners, rm.onSendError}
+			builder.AddRequest(request)
+			builder.SetSubscriber(request.ID(), sub)
+		}
 	})
 }
 
 // Startup starts processing for the WantManager.
 func (rm *RequestManager) Startup() {
 	go rm.run()
+	if rm.progressStore != nil {
+		go rm.runProgressSaves()
+	}
+}
+
+// runProgressSaves saves the progress of requests in progress every progress
+// interval until the request manager shuts down
+func (rm *RequestManager) runProgressSaves() {
+	ticker := time.NewTicker(rm.progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rm.ctx.Done():
+			return
+		case <-ticker.C:
+			rm.saveProgress()
+		}
+	}
+}
+
+// saveProgress saves the progress of each request in progress. The store is
+// written outside the internal thread, so slow saves do not hold up requests
+func (rm *RequestManager) saveProgress() {
+	response := make(chan map[graphsync.RequestID]graphsync.ProgressState, 1)
+	rm.send(&progressStatesMessage{response}, nil)
+	var states map[graphsync.RequestID]graphsync.ProgressState
+	select {
+	case <-rm.ctx.Done():
+		return
+	case states = <-response:
+	}
+	for requestID, state := range states {
+		if err := rm.progressStore.SaveProgress(requestID, state); err != nil {
+			log.Warnw("failed to save request progress", "request id", requestID.String(), "error", err)
+		}
+	}
+}
+
+// Stopped returns a channel that is closed once the request manager has
+// completely stopped after Shutdown
+func (rm *RequestManager) Stopped() <-chan struct{} {
+	return rm.stopped
 }
 
 // Shutdown ends processing for the want manager.
@@ -389,10 +1079,20 @@ func (rm *RequestManager) send(message requestManagerMessage, done <-chan struct
 	}
 }
 
+// onSendError is called from the message queue when a request fails to send
+func (rm *RequestManager) onSendError(request gsmsg.GraphSyncRequest) {
+	if request.Type() != graphsync.RequestTypeNew {
+		return
+	}
+	// don't block the message queue while waiting on the internal thread
+	go rm.send(&sendErrorMessage{request.ID()}, nil)
+}
+
 type reqSubscriber struct {
 	p                     peer.ID
 	request               gsmsg.GraphSyncRequest
 	networkErrorListeners *listeners.NetworkErrorListeners
+	onError               func(gsmsg.GraphSyncRequest)
 }
 
 func (r *reqSubscriber) OnNext(_ notifications.Topic, event notifications.Event) {
@@ -401,6 +1101,7 @@ func (r *reqSubscriber) OnNext(_ notifications.Topic, event notifications.Event)
 		return
 	}
 	r.networkErrorListeners.NotifyNetworkErrorListeners(r.p, r.request, mqEvt.Err)
+	r.onError(r.request)
 }
 
 func (r reqSubscriber) OnClose(_ notifications.Topic) {
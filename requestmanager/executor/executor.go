@@ -5,10 +5,13 @@ import (
 	"context"
 	"sync/atomic"
 
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipfs/go-peertaskqueue/peertask"
 	"github.com/ipld/go-ipld-prime/datamodel"
 	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/ipld/go-ipld-prime/traversal"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"go.opentelemetry.io/otel"
@@ -42,6 +45,7 @@ type ReconciledLoader interface {
 	SetRemoteOnline(online bool)
 	RetryLastLoad() types.AsyncLoadResult
 	BlockReadOpener(lctx linking.LinkContext, link datamodel.Link) types.AsyncLoadResult
+	NextRemoteLink() (cid.Cid, graphsync.LinkAction, bool)
 }
 
 // Executor handles actually executing graphsync requests and verifying them.
@@ -50,15 +54,19 @@ type ReconciledLoader interface {
 type Executor struct {
 	manager    Manager
 	blockHooks BlockHooks
+	denylist   func(cid.Cid) bool
 }
 
-// NewExecutor returns a new executor
+// NewExecutor returns a new executor. If denylist is not nil, it is consulted
+// for every link before it is loaded, and the request fails if it returns true
 func NewExecutor(
 	manager Manager,
-	blockHooks BlockHooks) *Executor {
+	blockHooks BlockHooks,
+	denylist func(cid.Cid) bool) *Executor {
 	return &Executor{
 		manager:    manager,
 		blockHooks: blockHooks,
+		denylist:   denylist,
 	}
 }
 
@@ -80,7 +88,12 @@ func (e *Executor) ExecuteTask(ctx context.Context, pid peer.ID, task *peertask.
 	defer span.End()
 
 	log.Debugw("beginning request execution", "id", requestTask.Request.ID(), "peer", pid.String(), "root_cid", requestTask.Request.Root().String())
-	err := e.traverse(requestTask)
+	var err error
+	if requestTask.MetadataOnly {
+		err = e.listRemoteLinks(requestTask)
+	} else {
+		err = e.traverse(requestTask)
+	}
 	if err != nil {
 		span.RecordError(err)
 		if !ipldutil.IsContextCancelErr(err) {
@@ -113,6 +126,17 @@ type RequestTask struct {
 	InProgressErr        chan error
 	Empty                bool
 	ReconciledLoader     ReconciledLoader
+	BytesReceived        *uint64
+	// ReceivedCids records the blocks the traversal has loaded and verified,
+	// so the request can be resumed without them. It may be nil
+	ReceivedCids *types.ReceivedCids
+	// MetadataOnly requests have no traverser, and deliver the links in the
+	// remote metadata to InProgressChan instead
+	MetadataOnly   bool
+	InProgressChan chan<- graphsync.ResponseProgress
+	// RawBlocks receives the raw data of each block the traversal loads, once
+	// block hooks accept it. It may be nil
+	RawBlocks chan<- blocks.Block
 }
 
 func (e *Executor) traverse(rt RequestTask) error {
@@ -126,7 +150,13 @@ func (e *Executor) traverse(rt RequestTask) error {
 		}
 		// get current link request
 		lnk, linkContext := rt.Traverser.CurrentRequest()
-		// attempt to load
+		// refuse to load (and therefore store) denylisted blocks
+		if e.isDenylisted(lnk) {
+			return graphsync.ErrDenylistedCID{Link: lnk, Path: linkContext.LinkPath}
+		}
+		// attempt to load, with a context that is cancelled with the request
+		// but keeps the traversal's span
+		linkContext.Ctx = trace.ContextWithSpan(rt.Ctx, trace.SpanFromContext(linkContext.Ctx))
 		log.Debugf("will load link=%s", lnk)
 		result := rt.ReconciledLoader.BlockReadOpener(linkContext, lnk)
 		// if we've only loaded locally so far and hit a missing block
@@ -136,6 +166,13 @@ func (e *Executor) traverse(rt RequestTask) error {
 
 			// tell the loader we're online now
 			rt.ReconciledLoader.SetRemoteOnline(true)
+			// a cancel that took the loader offline before it came online would
+			// otherwise leave the retry below waiting for the remote forever
+			select {
+			case <-rt.Ctx.Done():
+				return ipldutil.ContextCancelError{}
+			default:
+			}
 
 			if err := e.startRemoteRequest(rt); err != nil {
 				return err
@@ -144,11 +181,20 @@ func (e *Executor) traverse(rt RequestTask) error {
 			result = rt.ReconciledLoader.RetryLastLoad()
 		}
 		log.Debugf("successfully loaded link=%s, nBlocksRead=%d", lnk, rt.Traverser.NBlocksTraversed())
+		// count the block before advancing, so nodes in it report it as received
+		if result.Err == nil && !result.Local {
+			atomic.AddUint64(rt.BytesReceived, uint64(len(result.Data)))
+		}
 		// advance the traversal based on results
 		err = e.advanceTraversal(rt, result)
 		if err != nil {
 			return err
 		}
+		if result.Err == nil && rt.ReceivedCids != nil {
+			if asCidLink, ok := lnk.(cidlink.Link); ok {
+				rt.ReceivedCids.Add(asCidLink.Cid)
+			}
+		}
 
 		// check for interrupts and run block hooks
 		err = e.processResult(rt, lnk, result)
@@ -158,6 +204,45 @@ func (e *Executor) traverse(rt RequestTask) error {
 	}
 }
 
+// listRemoteLinks sends a metadata only request, then delivers the links the
+// remote peer traversed, in order, until the remote request ends. Links the
+// remote peer is missing are delivered as errors
+func (e *Executor) listRemoteLinks(rt RequestTask) error {
+	rt.ReconciledLoader.SetRemoteOnline(true)
+	select {
+	case <-rt.Ctx.Done():
+		return ipldutil.ContextCancelError{}
+	default:
+	}
+	log.Debugw("starting remote metadata only request", "id", rt.Request.ID(), "peer", rt.P.String(), "root_cid", rt.Request.Root().String())
+	e.manager.SendRequest(rt.P, rt.Request)
+	for {
+		c, action, ok := rt.ReconciledLoader.NextRemoteLink()
+		if !ok {
+			return nil
+		}
+		link := cidlink.Link{Cid: c}
+		if e.isDenylisted(link) {
+			return graphsync.ErrDenylistedCID{Link: link}
+		}
+		if action == graphsync.LinkActionMissing {
+			select {
+			case <-rt.Ctx.Done():
+				return ipldutil.ContextCancelError{}
+			case rt.InProgressErr <- graphsync.RemoteMissingBlockErr{Link: link}:
+			}
+			continue
+		}
+		var progress graphsync.ResponseProgress
+		progress.LastBlock.Link = link
+		select {
+		case <-rt.Ctx.Done():
+			return ipldutil.ContextCancelError{}
+		case rt.InProgressChan <- progress:
+		}
+	}
+}
+
 func (e *Executor) processBlockHooks(p peer.ID, response graphsync.ResponseData, block graphsync.BlockData) error {
 	result := e.blockHooks.ProcessBlockHooks(p, response, block)
 	if len(result.Extensions) > 0 {
@@ -198,7 +283,10 @@ func (e *Executor) advanceTraversal(rt RequestTask, result types.AsyncLoadResult
 func (e *Executor) processResult(rt RequestTask, link datamodel.Link, result types.AsyncLoadResult) error {
 	var err error
 	if result.Err == nil {
-		err = e.onNewBlock(rt, &blockData{link, result.Local, uint64(len(result.Data)), int64(rt.Traverser.NBlocksTraversed())})
+		err = e.onNewBlock(rt, &blockData{link, result.Local, result.Data, int64(rt.Traverser.NBlocksTraversed())})
+		if err == nil {
+			err = e.sendRawBlock(rt, link, result.Data)
+		}
 	}
 	select {
 	case <-rt.PauseMessages:
@@ -210,6 +298,28 @@ func (e *Executor) processResult(rt RequestTask, link datamodel.Link, result typ
 	return err
 }
 
+// sendRawBlock delivers a loaded block to the request's raw block channel, if
+// it has one, waiting for the caller to make room in its buffer
+func (e *Executor) sendRawBlock(rt RequestTask, link datamodel.Link, data []byte) error {
+	if rt.RawBlocks == nil {
+		return nil
+	}
+	asCidLink, ok := link.(cidlink.Link)
+	if !ok {
+		return nil
+	}
+	blk, err := blocks.NewBlockWithCid(data, asCidLink.Cid)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-rt.Ctx.Done():
+		return ipldutil.ContextCancelError{}
+	case rt.RawBlocks <- blk:
+		return nil
+	}
+}
+
 func (e *Executor) startRemoteRequest(rt RequestTask) error {
 	request := rt.Request
 	doNotSendFirstBlocks := rt.DoNotSendFirstBlocks
@@ -225,15 +335,43 @@ func (e *Executor) startRemoteRequest(rt RequestTask) error {
 	return nil
 }
 
+func (e *Executor) isDenylisted(lnk datamodel.Link) bool {
+	if e.denylist == nil {
+		return false
+	}
+	asCidLink, ok := lnk.(cidlink.Link)
+	return ok && e.denylist(asCidLink.Cid)
+}
+
 func isPausedErr(err error) bool {
 	_, isPaused := err.(hooks.ErrPaused)
 	return isPaused
 }
 
+// VerifyBlock is an incoming block hook that terminates a request with
+// graphsync.ErrBlockVerificationFailed when a block received from the remote
+// peer does not hash to its CID. Link systems without TrustedStorage already
+// verify blocks as the traversal loads them, so it is only needed for trusted
+// storage
+func VerifyBlock(p peer.ID, response graphsync.ResponseData, block graphsync.BlockData, hookActions graphsync.IncomingBlockHookActions) {
+	bd, ok := block.(*blockData)
+	if !ok || bd.local {
+		return
+	}
+	asCidLink, ok := bd.link.(cidlink.Link)
+	if !ok {
+		return
+	}
+	c, err := asCidLink.Cid.Prefix().Sum(bd.data)
+	if err != nil || !c.Equals(asCidLink.Cid) {
+		hookActions.TerminateWithError(graphsync.ErrBlockVerificationFailed{Cid: asCidLink.Cid})
+	}
+}
+
 type blockData struct {
 	link  datamodel.Link
 	local bool
-	size  uint64
+	data  []byte
 	index int64
 }
 
@@ -244,7 +382,7 @@ func (bd *blockData) Link() datamodel.Link {
 
 // BlockSize specifies the size of the block
 func (bd *blockData) BlockSize() uint64 {
-	return bd.size
+	return uint64(len(bd.data))
 }
 
 // BlockSize specifies the amount of data actually transmitted over the network
@@ -252,7 +390,7 @@ func (bd *blockData) BlockSizeOnWire() uint64 {
 	if bd.local {
 		return 0
 	}
-	return bd.size
+	return uint64(len(bd.data))
 }
 
 func (bd *blockData) Index() int64 {
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-peertaskqueue/peertask"
 	_ "github.com/ipld/go-ipld-prime/codec/dagcbor"
 	_ "github.com/ipld/go-ipld-prime/codec/raw"
@@ -35,6 +36,8 @@ func TestRequestExecutionBlockChain(t *testing.T) {
 	testCases := map[string]struct {
 		configureRequestExecution func(p peer.ID, requestID graphsync.RequestID, tbc *testutil.TestBlockChain, ree *requestExecutionEnv)
 		verifyResults             func(t *testing.T, tbc *testutil.TestBlockChain, ree *requestExecutionEnv, responses []graphsync.ResponseProgress, receivedErrors []error)
+		// the traversal does not hash blocks as it loads them
+		trustedStorage bool
 	}{
 		"simple success case": {
 			verifyResults: func(t *testing.T, tbc *testutil.TestBlockChain, ree *requestExecutionEnv, responses []graphsync.ResponseProgress, receivedErrors []error) {
@@ -62,6 +65,12 @@ func TestRequestExecutionBlockChain(t *testing.T) {
 				// we should only call block hooks for blocks we actually received
 				require.Len(t, ree.blookHooksCalled, 5)
 				require.NoError(t, ree.terminalError)
+				// and only count bytes for blocks we actually received
+				var expectedBytes uint64
+				for _, blk := range tbc.Blocks(0, 5) {
+					expectedBytes += uint64(len(blk.RawData()))
+				}
+				require.Equal(t, expectedBytes, ree.bytesReceived)
 			},
 		},
 
@@ -80,6 +89,27 @@ func TestRequestExecutionBlockChain(t *testing.T) {
 				require.EqualError(t, ree.terminalError, "something went wrong")
 			},
 		},
+		"block verification hook catches corrupt block": {
+			trustedStorage: true,
+			configureRequestExecution: func(p peer.ID, requestID graphsync.RequestID, tbc *testutil.TestBlockChain, ree *requestExecutionEnv) {
+				ree.blockHooks = hooks.NewBlockHooks()
+				ree.blockHooks.Register(executor.VerifyBlock)
+				ree.customRemoteBehavior = func() {
+					ree.reconciledLoader.successResponseOn(tbc.Blocks(0, 5))
+					// the sixth block arrives with another block's data
+					ree.reconciledLoader.responseOn(tbc.LinkTipIndex(5), types.AsyncLoadResult{Data: tbc.Blocks(6, 7)[0].RawData(), Local: false})
+				}
+			},
+			verifyResults: func(t *testing.T, tbc *testutil.TestBlockChain, ree *requestExecutionEnv, responses []graphsync.ResponseProgress, receivedErrors []error) {
+				// block hooks run after the traversal visits the block's nodes
+				tbc.VerifyResponseRangeSync(responses[:10], 0, 5)
+				expectedErr := graphsync.ErrBlockVerificationFailed{Cid: tbc.LinkTipIndex(5).(cidlink.Link).Cid}
+				require.Equal(t, []error{expectedErr}, receivedErrors)
+				require.Len(t, ree.requestsSent, 2)
+				require.Equal(t, ree.requestsSent[1].request.Type(), graphsync.RequestTypeCancel)
+				require.Equal(t, expectedErr, ree.terminalError)
+			},
+		},
 		"context cancelled": {
 			configureRequestExecution: func(p peer.ID, requestID graphsync.RequestID, tbc *testutil.TestBlockChain, ree *requestExecutionEnv) {
 				ree.blockHookResults[blockHookKey{p, requestID, tbc.LinkTipIndex(5)}] = hooks.UpdateResult{Err: ipldutil.ContextCancelError{}}
@@ -219,8 +249,9 @@ func TestRequestExecutionBlockChain(t *testing.T) {
 				initialRequest:       true,
 				inProgressErr:        make(chan error, 1),
 				traverser: ipldutil.TraversalBuilder{
-					Root:     tbc.TipLink,
-					Selector: tbc.Selector(),
+					Root:       tbc.TipLink,
+					Selector:   tbc.Selector(),
+					LinkSystem: linking.LinkSystem{TrustedStorage: data.trustedStorage},
 					Visitor: func(tp traversal.Progress, node datamodel.Node, tr traversal.VisitReason) error {
 						responsesReceived = append(responsesReceived, graphsync.ResponseProgress{
 							Node:      node,
@@ -254,7 +285,7 @@ func TestRequestExecutionBlockChain(t *testing.T) {
 					}
 				}
 			}()
-			executor.NewExecutor(ree, ree).ExecuteTask(ctx, ree.p, &peertask.Task{})
+			executor.NewExecutor(ree, ree, nil).ExecuteTask(ctx, ree.p, &peertask.Task{})
 			require.NoError(t, <-errCollectionErr)
 			ree.traverser.Shutdown(ctx)
 			data.verifyResults(t, tbc, ree, responsesReceived, errorsReceived)
@@ -293,10 +324,12 @@ type requestExecutionEnv struct {
 	inProgressErr        chan error
 	initialRequest       bool
 	customRemoteBehavior func()
+	blockHooks           *hooks.IncomingBlockHooks
 	// results
 	requestsSent     []requestSent
 	blookHooksCalled []blockHookKey
 	terminalError    error
+	bytesReceived    uint64
 
 	// deps
 	tbc *testutil.TestBlockChain
@@ -356,6 +389,10 @@ func (frl *fakeReconciledLoader) RetryLastLoad() types.AsyncLoadResult {
 func (frl *fakeReconciledLoader) SetRemoteOnline(online bool) {
 	frl.online = true
 }
+
+func (frl *fakeReconciledLoader) NextRemoteLink() (cid.Cid, graphsync.LinkAction, bool) {
+	return cid.Undef, "", false
+}
 func (ree *requestExecutionEnv) ReleaseRequestTask(_ peer.ID, _ *peertask.Task, err error) {
 	ree.terminalError = err
 	close(ree.inProgressErr)
@@ -376,6 +413,7 @@ func (ree *requestExecutionEnv) GetRequestTask(_ peer.ID, _ *peertask.Task, requ
 		InProgressErr:        ree.inProgressErr,
 		Empty:                false,
 		ReconciledLoader:     ree.reconciledLoader,
+		BytesReceived:        &ree.bytesReceived,
 	}
 	go func() {
 		select {
@@ -399,6 +437,9 @@ func (ree *requestExecutionEnv) SendRequest(p peer.ID, request gsmsg.GraphSyncRe
 func (ree *requestExecutionEnv) ProcessBlockHooks(p peer.ID, response graphsync.ResponseData, blk graphsync.BlockData) hooks.UpdateResult {
 	bhk := blockHookKey{p, response.RequestID(), blk.Link()}
 	ree.blookHooksCalled = append(ree.blookHooksCalled, bhk)
+	if ree.blockHooks != nil {
+		return ree.blockHooks.ProcessBlockHooks(p, response, blk)
+	}
 	return ree.blockHookResults[bhk]
 }
 
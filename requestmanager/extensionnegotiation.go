@@ -0,0 +1,131 @@
+package requestmanager
+
+import (
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/listeners"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/supportedextensions"
+)
+
+// extensionNegotiation learns which extensions each peer supports, by listing
+// the supported extensions with the first request to the peer, so extensions
+// the peer does not support can be left out of later requests to it.
+// Extensions that are not in the supported list are always sent.
+// Only accessed from the request manager's run loop
+type extensionNegotiation struct {
+	supported    []graphsync.ExtensionName
+	supportedSet map[graphsync.ExtensionName]struct{}
+	listeners    *listeners.NegotiationCompleteListeners
+
+	// the extensions each peer reported it supports
+	negotiated map[peer.ID]map[graphsync.ExtensionName]struct{}
+	// the request negotiating extensions with each peer, if any
+	negotiating map[peer.ID]graphsync.RequestID
+}
+
+func newExtensionNegotiation(supported []graphsync.ExtensionName, negotiationListeners *listeners.NegotiationCompleteListeners) *extensionNegotiation {
+	supportedSet := make(map[graphsync.ExtensionName]struct{}, len(supported))
+	for _, name := range supported {
+		supportedSet[name] = struct{}{}
+	}
+	return &extensionNegotiation{
+		supported:    supported,
+		supportedSet: supportedSet,
+		listeners:    negotiationListeners,
+		negotiated:   make(map[peer.ID]map[graphsync.ExtensionName]struct{}),
+		negotiating:  make(map[peer.ID]graphsync.RequestID),
+	}
+}
+
+// prepareRequest removes the extensions a peer does not support from a new
+// request to it, or if the peer has not reported the extensions it supports
+// and no request is already asking, adds the supported-extensions extension
+func (en *extensionNegotiation) prepareRequest(p peer.ID, request gsmsg.GraphSyncRequest) gsmsg.GraphSyncRequest {
+	negotiated, ok := en.negotiated[p]
+	if !ok {
+		if _, negotiating := en.negotiating[p]; negotiating {
+			return request
+		}
+		en.negotiating[p] = request.ID()
+		return request.ReplaceExtensions([]graphsync.ExtensionData{{
+			Name: graphsync.ExtensionSupportedExtensions,
+			Data: supportedextensions.EncodeSupportedExtensions(en.supported),
+		}})
+	}
+	var unsupported []graphsync.ExtensionName
+	for _, name := range request.ExtensionNames() {
+		if _, known := en.supportedSet[name]; !known {
+			continue
+		}
+		if _, ok := negotiated[name]; !ok {
+			unsupported = append(unsupported, name)
+		}
+	}
+	if len(unsupported) == 0 {
+		return request
+	}
+	log.Debugw("leaving out extensions peer does not support", "request id", request.ID().String(), "peer", p, "extensions", unsupported)
+	return request.RemoveExtensions(unsupported)
+}
+
+// mayUse returns true if the given extension is supported here and the peer
+// may support it too, because it reported that it does or it has not yet
+// reported the extensions it supports
+func (en *extensionNegotiation) mayUse(p peer.ID, name graphsync.ExtensionName) bool {
+	if _, ok := en.supportedSet[name]; !ok {
+		return false
+	}
+	negotiated, ok := en.negotiated[p]
+	if !ok {
+		return true
+	}
+	_, ok = negotiated[name]
+	return ok
+}
+
+// processResponse records the extensions a peer supports, if the response is
+// for the request negotiating extensions with the peer and reports them
+func (en *extensionNegotiation) processResponse(p peer.ID, response gsmsg.GraphSyncResponse) {
+	if requestID, ok := en.negotiating[p]; !ok || requestID != response.RequestID() {
+		return
+	}
+	data, ok := response.Extension(graphsync.ExtensionSupportedExtensions)
+	if !ok {
+		return
+	}
+	names, err := supportedextensions.DecodeSupportedExtensions(data)
+	if err != nil {
+		log.Warnw("peer sent invalid supported extensions", "peer", p, "error", err)
+		return
+	}
+	// only extensions we offered can be negotiated
+	names = supportedextensions.Intersect(names, en.supported)
+	negotiated := make(map[graphsync.ExtensionName]struct{}, len(names))
+	for _, name := range names {
+		negotiated[name] = struct{}{}
+	}
+	en.negotiated[p] = negotiated
+	delete(en.negotiating, p)
+	if en.listeners != nil {
+		en.listeners.NotifyNegotiationCompleteListeners(p, names)
+	}
+}
+
+// requestEnded lets the next request to a peer negotiate extensions, if the
+// given request was negotiating and the peer never reported the extensions it
+// supports
+func (en *extensionNegotiation) requestEnded(p peer.ID, requestID graphsync.RequestID) {
+	if negotiatingID, ok := en.negotiating[p]; ok && negotiatingID == requestID {
+		delete(en.negotiating, p)
+	}
+}
+
+// forgetPeer forgets the extensions a peer reported, when the peer
+// disconnects, since the responder forgets the list it was sent, or when
+// state for the peer is evicted. The next request to the peer negotiates
+// again
+func (en *extensionNegotiation) forgetPeer(p peer.ID) {
+	delete(en.negotiated, p)
+}
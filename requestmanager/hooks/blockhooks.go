@@ -5,11 +5,12 @@ import (
 	"github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/hookset"
 )
 
 // IncomingBlockHooks is a set of incoming block hooks that can be processed
 type IncomingBlockHooks struct {
-	pubSub *pubsub.PubSub
+	hooks *hookset.HookSet
 }
 
 type internalBlockHookEvent struct {
@@ -27,18 +28,26 @@ func blockHookDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) e
 }
 
 // NewBlockHooks returns a new list of incoming request hooks
-func NewBlockHooks() *IncomingBlockHooks {
-	return &IncomingBlockHooks{pubSub: pubsub.New(blockHookDispatcher)}
+func NewBlockHooks(options ...hookset.Option) *IncomingBlockHooks {
+	options = append([]hookset.Option{hookset.WithHookType("incoming-block")}, options...)
+	return &IncomingBlockHooks{hooks: hookset.New(blockHookDispatcher, options...)}
 }
 
 // Register registers an extension to process incoming responses
 func (ibh *IncomingBlockHooks) Register(hook graphsync.OnIncomingBlockHook) graphsync.UnregisterHookFunc {
-	return graphsync.UnregisterHookFunc(ibh.pubSub.Subscribe(hook))
+	return ibh.hooks.Register(hook)
+}
+
+// UnregisterAll removes all registered hooks
+func (ibh *IncomingBlockHooks) UnregisterAll() {
+	ibh.hooks.UnregisterAll()
 }
 
 // ProcessBlockHooks runs response hooks against an incoming response
 func (ibh *IncomingBlockHooks) ProcessBlockHooks(p peer.ID, response graphsync.ResponseData, block graphsync.BlockData) UpdateResult {
 	rha := &updateHookActions{}
-	_ = ibh.pubSub.Publish(internalBlockHookEvent{p, response, block, rha})
+	if err := ibh.hooks.Publish(internalBlockHookEvent{p, response, block, rha}); err != nil {
+		rha.err = err
+	}
 	return rha.result()
 }
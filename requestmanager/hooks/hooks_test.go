@@ -3,7 +3,9 @@ package hooks_test
 import (
 	"errors"
 	"testing"
+	"time"
 
+	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime"
 	"github.com/ipld/go-ipld-prime/node/basicnode"
 	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
@@ -11,7 +13,9 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/hookset"
 	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/panics"
 	"github.com/ipfs/go-graphsync/requestmanager/hooks"
 	"github.com/ipfs/go-graphsync/testutil"
 )
@@ -32,6 +36,8 @@ func TestRequestHookProcessing(t *testing.T) {
 	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
 	request := gsmsg.NewRequest(requestID, root, ssb.Matcher().Node(), graphsync.Priority(0), extension)
 	p := testutil.GeneratePeers(1)[0]
+	received := cid.NewSet()
+	received.Add(testutil.GenerateCids(1)[0])
 	testCases := map[string]struct {
 		configure func(t *testing.T, hooks *hooks.OutgoingRequestHooks)
 		assert    func(t *testing.T, result hooks.RequestResult)
@@ -40,6 +46,22 @@ func TestRequestHookProcessing(t *testing.T) {
 			assert: func(t *testing.T, result hooks.RequestResult) {
 				require.Nil(t, result.CustomChooser)
 				require.Empty(t, result.PersistenceOption)
+				require.Equal(t, request.Priority(), result.Priority)
+				require.Nil(t, result.ResumeState.Received)
+			},
+		},
+		"hooks override priority": {
+			configure: func(t *testing.T, hooks *hooks.OutgoingRequestHooks) {
+				hooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+					if _, found := requestData.Extension(extensionName); found {
+						hookActions.OverridePriority(graphsync.Priority(10))
+					}
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.Nil(t, result.CustomChooser)
+				require.Empty(t, result.PersistenceOption)
+				require.Equal(t, graphsync.Priority(10), result.Priority)
 			},
 		},
 		"hooks alter chooser": {
@@ -68,6 +90,66 @@ func TestRequestHookProcessing(t *testing.T) {
 				require.Equal(t, "chainstore", result.PersistenceOption)
 			},
 		},
+		"hooks set resume state": {
+			configure: func(t *testing.T, hooks *hooks.OutgoingRequestHooks) {
+				hooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+					if _, found := requestData.Extension(extensionName); found {
+						hookActions.UseResumeState(graphsync.ResumeState{Received: received})
+					}
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.Equal(t, received, result.ResumeState.Received)
+			},
+		},
+		"hooks add extension data, last writer wins": {
+			configure: func(t *testing.T, hooks *hooks.OutgoingRequestHooks) {
+				hooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+					hookActions.AddExtensionData(graphsync.ExtensionData{Name: "voucher", Data: basicnode.NewString("first")})
+					hookActions.AddExtensionData(graphsync.ExtensionData{Name: "auth", Data: basicnode.NewString("token")})
+				})
+				hooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+					hookActions.AddExtensionData(graphsync.ExtensionData{Name: "voucher", Data: basicnode.NewString("second")})
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.Equal(t, []graphsync.ExtensionData{
+					{Name: "voucher", Data: basicnode.NewString("second")},
+					{Name: "auth", Data: basicnode.NewString("token")},
+				}, result.Extensions)
+			},
+		},
+		"filtered hooks only run when the filter matches": {
+			configure: func(t *testing.T, hooks *hooks.OutgoingRequestHooks) {
+				hooks.RegisterWithFilter(func(p peer.ID, requestData graphsync.RequestData) bool {
+					_, found := requestData.Extension(extensionName)
+					return found
+				}, func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+					hookActions.OverridePriority(graphsync.Priority(10))
+				})
+				hooks.RegisterWithFilter(func(p peer.ID, requestData graphsync.RequestData) bool {
+					return false
+				}, func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+					t.Fatal("hook should not run when its filter does not match")
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.Equal(t, graphsync.Priority(10), result.Priority)
+			},
+		},
+		"filtered hooks unregistered": {
+			configure: func(t *testing.T, hooks *hooks.OutgoingRequestHooks) {
+				unregister := hooks.RegisterWithFilter(func(p peer.ID, requestData graphsync.RequestData) bool {
+					return true
+				}, func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+					hookActions.UsePersistenceOption("chainstore")
+				})
+				unregister()
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.Empty(t, result.PersistenceOption)
+			},
+		},
 		"hooks unregistered": {
 			configure: func(t *testing.T, hooks *hooks.OutgoingRequestHooks) {
 				unregister := hooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
@@ -82,6 +164,23 @@ func TestRequestHookProcessing(t *testing.T) {
 				require.Empty(t, result.PersistenceOption)
 			},
 		},
+		"hook panics": {
+			configure: func(t *testing.T, hooks *hooks.OutgoingRequestHooks) {
+				hooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+					panic("something went wrong")
+				})
+				hooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+					hookActions.UsePersistenceOption("chainstore")
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.Empty(t, result.PersistenceOption)
+				var panicErr panics.RecoveredPanicErr
+				require.True(t, errors.As(result.Err, &panicErr))
+				require.Equal(t, "something went wrong", panicErr.PanicObj)
+				require.Contains(t, panicErr.DebugStackTrace, "hooks_test.go")
+			},
+		},
 	}
 	for testCase, data := range testCases {
 		t.Run(testCase, func(t *testing.T) {
@@ -179,6 +278,23 @@ func TestBlockHookProcessing(t *testing.T) {
 				require.NoError(t, result.Err)
 			},
 		},
+		"hook panics": {
+			configure: func(t *testing.T, hooks *hooks.IncomingBlockHooks) {
+				hooks.Register(func(p peer.ID, responseData graphsync.ResponseData, blockData graphsync.BlockData, hookActions graphsync.IncomingBlockHookActions) {
+					panic("something went wrong")
+				})
+				hooks.Register(func(p peer.ID, responseData graphsync.ResponseData, blockData graphsync.BlockData, hookActions graphsync.IncomingBlockHookActions) {
+					hookActions.UpdateRequestWithExtensions(extensionUpdate)
+				})
+			},
+			assert: func(t *testing.T, result hooks.UpdateResult) {
+				require.Empty(t, result.Extensions)
+				var panicErr panics.RecoveredPanicErr
+				require.True(t, errors.As(result.Err, &panicErr))
+				require.Equal(t, "something went wrong", panicErr.PanicObj)
+				require.Contains(t, panicErr.DebugStackTrace, "hooks_test.go")
+			},
+		},
 	}
 	for testCase, data := range testCases {
 		t.Run(testCase, func(t *testing.T) {
@@ -249,6 +365,101 @@ func TestResponseHookProcessing(t *testing.T) {
 				require.NoError(t, result.Err)
 			},
 		},
+		"hooks update with several extensions at once": {
+			configure: func(t *testing.T, hooks *hooks.IncomingResponseHooks) {
+				hooks.Register(func(p peer.ID, responseData graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
+					hookActions.UpdateRequestWithExtensions(extensionUpdate, extensionResponse)
+				})
+				hooks.Register(func(p peer.ID, responseData graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
+					hookActions.UpdateRequestWithExtensions(extensionUpdate)
+				})
+			},
+			assert: func(t *testing.T, result hooks.UpdateResult) {
+				require.Equal(t, []graphsync.ExtensionData{extensionUpdate, extensionResponse, extensionUpdate}, result.Extensions)
+				require.NoError(t, result.Err)
+			},
+		},
+		"filtered hooks only run when the filter matches": {
+			configure: func(t *testing.T, hooks *hooks.IncomingResponseHooks) {
+				hooks.RegisterWithFilter(func(p peer.ID, responseData graphsync.ResponseData) bool {
+					return false
+				}, func(p peer.ID, responseData graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
+					hookActions.TerminateWithError(errors.New("should not run"))
+				})
+				hooks.RegisterWithFilter(func(p peer.ID, responseData graphsync.ResponseData) bool {
+					_, found := responseData.Extension(extensionName)
+					return found
+				}, func(p peer.ID, responseData graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
+					hookActions.UpdateRequestWithExtensions(extensionUpdate)
+				})
+			},
+			assert: func(t *testing.T, result hooks.UpdateResult) {
+				require.Equal(t, []graphsync.ExtensionData{extensionUpdate}, result.Extensions)
+				require.NoError(t, result.Err)
+			},
+		},
+		"extension hooks only run for extensions on the response": {
+			configure: func(t *testing.T, hooks *hooks.IncomingResponseHooks) {
+				hooks.RegisterExtensionResponseHook("HappyLand/Happenstance", func(p peer.ID, responseData graphsync.ResponseData, extension graphsync.ExtensionData, hookActions graphsync.IncomingResponseHookActions) {
+					hookActions.TerminateWithError(errors.New("should not run"))
+				})
+				hooks.RegisterExtensionResponseHook(extensionName, func(p peer.ID, responseData graphsync.ResponseData, extension graphsync.ExtensionData, hookActions graphsync.IncomingResponseHookActions) {
+					require.Equal(t, extensionResponse, extension)
+					hookActions.UpdateRequestWithExtensions(extensionUpdate)
+				})
+			},
+			assert: func(t *testing.T, result hooks.UpdateResult) {
+				require.Equal(t, []graphsync.ExtensionData{extensionUpdate}, result.Extensions)
+				require.NoError(t, result.Err)
+			},
+		},
+		"extension hooks run after other hooks, and not after an error": {
+			configure: func(t *testing.T, hooks *hooks.IncomingResponseHooks) {
+				hooks.RegisterExtensionResponseHook(extensionName, func(p peer.ID, responseData graphsync.ResponseData, extension graphsync.ExtensionData, hookActions graphsync.IncomingResponseHookActions) {
+					hookActions.UpdateRequestWithExtensions(extensionUpdate)
+				})
+				hooks.Register(func(p peer.ID, responseData graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
+					hookActions.TerminateWithError(errors.New("something went wrong"))
+				})
+			},
+			assert: func(t *testing.T, result hooks.UpdateResult) {
+				require.Empty(t, result.Extensions)
+				require.EqualError(t, result.Err, "something went wrong")
+			},
+		},
+		"extension hooks short circuit on error": {
+			configure: func(t *testing.T, hooks *hooks.IncomingResponseHooks) {
+				hooks.RegisterExtensionResponseHook(extensionName, func(p peer.ID, responseData graphsync.ResponseData, extension graphsync.ExtensionData, hookActions graphsync.IncomingResponseHookActions) {
+					hookActions.TerminateWithError(errors.New("something went wrong"))
+				})
+				hooks.RegisterExtensionResponseHook(extensionName, func(p peer.ID, responseData graphsync.ResponseData, extension graphsync.ExtensionData, hookActions graphsync.IncomingResponseHookActions) {
+					hookActions.UpdateRequestWithExtensions(extensionUpdate)
+				})
+			},
+			assert: func(t *testing.T, result hooks.UpdateResult) {
+				require.Empty(t, result.Extensions)
+				require.EqualError(t, result.Err, "something went wrong")
+			},
+		},
+		"extension hooks unregistered": {
+			configure: func(t *testing.T, hooks *hooks.IncomingResponseHooks) {
+				unregister := hooks.RegisterExtensionResponseHook(extensionName, func(p peer.ID, responseData graphsync.ResponseData, extension graphsync.ExtensionData, hookActions graphsync.IncomingResponseHookActions) {
+					hookActions.TerminateWithError(errors.New("should not run"))
+				})
+				hooks.RegisterExtensionResponseHook(extensionName, func(p peer.ID, responseData graphsync.ResponseData, extension graphsync.ExtensionData, hookActions graphsync.IncomingResponseHookActions) {
+					hookActions.UpdateRequestWithExtensions(extensionUpdate)
+				})
+				unregister()
+				unregisterLast := hooks.RegisterExtensionResponseHook(extensionName, func(p peer.ID, responseData graphsync.ResponseData, extension graphsync.ExtensionData, hookActions graphsync.IncomingResponseHookActions) {
+					hookActions.UpdateRequestWithExtensions(extensionResponse)
+				})
+				unregisterLast()
+			},
+			assert: func(t *testing.T, result hooks.UpdateResult) {
+				require.Equal(t, []graphsync.ExtensionData{extensionUpdate}, result.Extensions)
+				require.NoError(t, result.Err)
+			},
+		},
 		"hooks unregistered": {
 			configure: func(t *testing.T, hooks *hooks.IncomingResponseHooks) {
 				unregister := hooks.Register(func(p peer.ID, responseData graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
@@ -263,6 +474,36 @@ func TestResponseHookProcessing(t *testing.T) {
 				require.NoError(t, result.Err)
 			},
 		},
+		"hook panics": {
+			configure: func(t *testing.T, hooks *hooks.IncomingResponseHooks) {
+				hooks.Register(func(p peer.ID, responseData graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
+					panic("something went wrong")
+				})
+				hooks.RegisterExtensionResponseHook(extensionName, func(p peer.ID, responseData graphsync.ResponseData, extension graphsync.ExtensionData, hookActions graphsync.IncomingResponseHookActions) {
+					hookActions.UpdateRequestWithExtensions(extensionUpdate)
+				})
+			},
+			assert: func(t *testing.T, result hooks.UpdateResult) {
+				require.Empty(t, result.Extensions)
+				var panicErr panics.RecoveredPanicErr
+				require.True(t, errors.As(result.Err, &panicErr))
+				require.Equal(t, "something went wrong", panicErr.PanicObj)
+				require.Contains(t, panicErr.DebugStackTrace, "hooks_test.go")
+			},
+		},
+		"extension hook panics": {
+			configure: func(t *testing.T, hooks *hooks.IncomingResponseHooks) {
+				hooks.RegisterExtensionResponseHook(extensionName, func(p peer.ID, responseData graphsync.ResponseData, extension graphsync.ExtensionData, hookActions graphsync.IncomingResponseHookActions) {
+					panic("something went wrong")
+				})
+			},
+			assert: func(t *testing.T, result hooks.UpdateResult) {
+				var panicErr panics.RecoveredPanicErr
+				require.True(t, errors.As(result.Err, &panicErr))
+				require.Equal(t, "something went wrong", panicErr.PanicObj)
+				require.Contains(t, panicErr.DebugStackTrace, "hooks_test.go")
+			},
+		},
 	}
 	for testCase, data := range testCases {
 		t.Run(testCase, func(t *testing.T) {
@@ -276,4 +517,126 @@ func TestResponseHookProcessing(t *testing.T) {
 			}
 		})
 	}
+
+	t.Run("extension hooks for responses that cannot list their extensions", func(t *testing.T) {
+		hooks := hooks.NewResponseHooks()
+		var received []graphsync.ExtensionData
+		hooks.RegisterExtensionResponseHook(extensionName, func(p peer.ID, responseData graphsync.ResponseData, extension graphsync.ExtensionData, hookActions graphsync.IncomingResponseHookActions) {
+			received = append(received, extension)
+		})
+		hooks.RegisterExtensionResponseHook("HappyLand/Happenstance", func(p peer.ID, responseData graphsync.ResponseData, extension graphsync.ExtensionData, hookActions graphsync.IncomingResponseHookActions) {
+			received = append(received, extension)
+		})
+		result := hooks.ProcessResponseHooks(p, responseDataOnly{response})
+		require.NoError(t, result.Err)
+		require.Equal(t, []graphsync.ExtensionData{extensionResponse}, received)
+	})
+
+	t.Run("execution observer", func(t *testing.T) {
+		observer := &hookObserver{}
+		hooks := hooks.NewResponseHooks(hookset.WithExecutionObserver(observer))
+		hooks.Register(func(p peer.ID, responseData graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
+		})
+		hooks.RegisterWithFilter(func(p peer.ID, responseData graphsync.ResponseData) bool { return false },
+			func(p peer.ID, responseData graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
+			})
+		hooks.RegisterExtensionResponseHook(extensionName, func(p peer.ID, responseData graphsync.ResponseData, extension graphsync.ExtensionData, hookActions graphsync.IncomingResponseHookActions) {
+			hookActions.TerminateWithError(errors.New("something went wrong"))
+		})
+		result := hooks.ProcessResponseHooks(p, response)
+		require.EqualError(t, result.Err, "something went wrong")
+		// extension hooks are numbered after the other hooks
+		require.Equal(t, []int{0, 1, 2}, observer.started)
+		require.Equal(t, []int{0, 1, 2}, observer.finished)
+		require.Equal(t, []string{"incoming-response"}, observer.hookTypes)
+		require.Equal(t, []error{nil, nil, result.Err}, observer.errs)
+	})
+}
+
+type hookObserver struct {
+	started   []int
+	finished  []int
+	hookTypes []string
+	errs      []error
+}
+
+func (ho *hookObserver) HookStarted(hookIndex int, hookType string) {
+	ho.started = append(ho.started, hookIndex)
+	if len(ho.hookTypes) == 0 || ho.hookTypes[len(ho.hookTypes)-1] != hookType {
+		ho.hookTypes = append(ho.hookTypes, hookType)
+	}
+}
+
+func (ho *hookObserver) HookFinished(hookIndex int, hookType string, duration time.Duration, err error) {
+	ho.finished = append(ho.finished, hookIndex)
+	ho.errs = append(ho.errs, err)
+}
+
+// responseDataOnly hides every method of a response but those of
+// graphsync.ResponseData
+type responseDataOnly struct {
+	graphsync.ResponseData
+}
+
+func TestSelectorProposalHookProcessing(t *testing.T) {
+	root := testutil.GenerateCids(1)[0]
+	requestID := graphsync.NewRequestID()
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	request := gsmsg.NewRequest(requestID, root, ssb.ExploreAll(ssb.Matcher()).Node(), graphsync.Priority(0))
+	proposal := graphsync.SelectorProposal{
+		Selector: ssb.Matcher().Node(),
+		Reason:   "too deep",
+	}
+	p := testutil.GeneratePeers(1)[0]
+	testCases := map[string]struct {
+		configure func(t *testing.T, hooks *hooks.SelectorProposalHooks)
+		accepted  bool
+	}{
+		"no hooks": {},
+		"hook declines": {
+			configure: func(t *testing.T, hooks *hooks.SelectorProposalHooks) {
+				hooks.Register(func(p peer.ID, requestData graphsync.RequestData, proposal graphsync.SelectorProposal, hookActions graphsync.SelectorProposalHookActions) {
+				})
+			},
+		},
+		"hook accepts": {
+			configure: func(t *testing.T, hooks *hooks.SelectorProposalHooks) {
+				hooks.Register(func(p peer.ID, requestData graphsync.RequestData, proposal graphsync.SelectorProposal, hookActions graphsync.SelectorProposalHookActions) {
+					require.Equal(t, requestID, requestData.ID())
+					if proposal.Reason == "too deep" {
+						hookActions.AcceptProposal()
+					}
+				})
+			},
+			accepted: true,
+		},
+		"hooks unregistered": {
+			configure: func(t *testing.T, hooks *hooks.SelectorProposalHooks) {
+				unregister := hooks.Register(func(p peer.ID, requestData graphsync.RequestData, proposal graphsync.SelectorProposal, hookActions graphsync.SelectorProposalHookActions) {
+					hookActions.AcceptProposal()
+				})
+				unregister()
+			},
+		},
+		"hook panics": {
+			configure: func(t *testing.T, hooks *hooks.SelectorProposalHooks) {
+				hooks.Register(func(p peer.ID, requestData graphsync.RequestData, proposal graphsync.SelectorProposal, hookActions graphsync.SelectorProposalHookActions) {
+					hookActions.AcceptProposal()
+				})
+				hooks.Register(func(p peer.ID, requestData graphsync.RequestData, proposal graphsync.SelectorProposal, hookActions graphsync.SelectorProposalHookActions) {
+					panic("something went wrong")
+				})
+			},
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			hooks := hooks.NewSelectorProposalHooks()
+			if data.configure != nil {
+				data.configure(t, hooks)
+			}
+			accepted := hooks.ProcessSelectorProposalHooks(p, request, proposal)
+			require.Equal(t, data.accepted, accepted)
+		})
+	}
 }
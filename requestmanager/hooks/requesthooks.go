@@ -6,11 +6,12 @@ import (
 	peer "github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/hookset"
 )
 
 // OutgoingRequestHooks is a set of incoming request hooks that can be processed
 type OutgoingRequestHooks struct {
-	pubSub *pubsub.PubSub
+	hooks *hookset.HookSet
 }
 
 type internalRequestHookEvent struct {
@@ -19,47 +20,87 @@ type internalRequestHookEvent struct {
 	hookActions *requestHookActions
 }
 
+// filteredRequestHook is a hook that only runs for requests its filter
+// returns true for
+type filteredRequestHook struct {
+	filter graphsync.RequestHookFilter
+	hook   graphsync.OnOutgoingRequestHook
+}
+
 func requestHooksDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
 	ie := event.(internalRequestHookEvent)
-	hook := subscriberFn.(graphsync.OnOutgoingRequestHook)
+	hook, ok := subscriberFn.(graphsync.OnOutgoingRequestHook)
+	if !ok {
+		filtered := subscriberFn.(filteredRequestHook)
+		if !filtered.filter(ie.p, ie.request) {
+			return nil
+		}
+		hook = filtered.hook
+	}
 	hook(ie.p, ie.request, ie.hookActions)
 	return nil
 }
 
 // NewRequestHooks returns a new list of incoming request hooks
-func NewRequestHooks() *OutgoingRequestHooks {
+func NewRequestHooks(options ...hookset.Option) *OutgoingRequestHooks {
+	options = append([]hookset.Option{hookset.WithHookType("outgoing-request")}, options...)
 	return &OutgoingRequestHooks{
-		pubSub: pubsub.New(requestHooksDispatcher),
+		hooks: hookset.New(requestHooksDispatcher, options...),
 	}
 }
 
 // Register registers an extension to process outgoing requests
 func (orh *OutgoingRequestHooks) Register(hook graphsync.OnOutgoingRequestHook) graphsync.UnregisterHookFunc {
-	return graphsync.UnregisterHookFunc(orh.pubSub.Subscribe(hook))
+	return orh.hooks.Register(hook)
+}
+
+// RegisterWithFilter registers an extension to process only the outgoing
+// requests the filter returns true for. The filter runs before the hook, so
+// requests it rejects skip the hook entirely
+func (orh *OutgoingRequestHooks) RegisterWithFilter(filter graphsync.RequestHookFilter, hook graphsync.OnOutgoingRequestHook) graphsync.UnregisterHookFunc {
+	return orh.hooks.Register(filteredRequestHook{filter, hook})
+}
+
+// UnregisterAll removes all registered hooks
+func (orh *OutgoingRequestHooks) UnregisterAll() {
+	orh.hooks.UnregisterAll()
 }
 
 // RequestResult is the outcome of running requesthooks
 type RequestResult struct {
 	PersistenceOption string
 	CustomChooser     traversal.LinkTargetNodePrototypeChooser
+	Priority          graphsync.Priority
+	ResumeState       graphsync.ResumeState
+	Extensions        []graphsync.ExtensionData
+	// Err is set if a hook panicked, in which case the request should fail
+	Err error
 }
 
 // ProcessRequestHooks runs request hooks against an outgoing request
 func (orh *OutgoingRequestHooks) ProcessRequestHooks(p peer.ID, request graphsync.RequestData) RequestResult {
-	rha := &requestHookActions{}
-	_ = orh.pubSub.Publish(internalRequestHookEvent{p, request, rha})
-	return rha.result()
+	rha := &requestHookActions{priority: request.Priority()}
+	err := orh.hooks.Publish(internalRequestHookEvent{p, request, rha})
+	result := rha.result()
+	result.Err = err
+	return result
 }
 
 type requestHookActions struct {
 	persistenceOption  string
 	nodeBuilderChooser traversal.LinkTargetNodePrototypeChooser
+	priority           graphsync.Priority
+	resumeState        graphsync.ResumeState
+	extensions         []graphsync.ExtensionData
 }
 
 func (rha *requestHookActions) result() RequestResult {
 	return RequestResult{
 		PersistenceOption: rha.persistenceOption,
 		CustomChooser:     rha.nodeBuilderChooser,
+		Priority:          rha.priority,
+		ResumeState:       rha.resumeState,
+		Extensions:        rha.extensions,
 	}
 }
 
@@ -70,3 +111,21 @@ func (rha *requestHookActions) UsePersistenceOption(name string) {
 func (rha *requestHookActions) UseLinkTargetNodePrototypeChooser(nodeBuilderChooser traversal.LinkTargetNodePrototypeChooser) {
 	rha.nodeBuilderChooser = nodeBuilderChooser
 }
+
+func (rha *requestHookActions) OverridePriority(priority graphsync.Priority) {
+	rha.priority = priority
+}
+
+func (rha *requestHookActions) UseResumeState(resumeState graphsync.ResumeState) {
+	rha.resumeState = resumeState
+}
+
+func (rha *requestHookActions) AddExtensionData(extension graphsync.ExtensionData) {
+	for i, existing := range rha.extensions {
+		if existing.Name == extension.Name {
+			rha.extensions[i] = extension
+			return
+		}
+	}
+	rha.extensions = append(rha.extensions, extension)
+}
@@ -1,10 +1,13 @@
 package hooks
 
 import (
+	"sync"
+
 	"github.com/hannahhoward/go-pubsub"
 	"github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/hookset"
 )
 
 // ErrPaused indicates a request should stop processing, but only cause it's paused
@@ -14,7 +17,21 @@ func (e ErrPaused) Error() string { return "request has been paused" }
 
 // IncomingResponseHooks is a set of incoming response hooks that can be processed
 type IncomingResponseHooks struct {
-	pubSub *pubsub.PubSub
+	hooks *hookset.HookSet
+
+	// hooks for a single extension, looked up by the extensions on each
+	// response. Slices are replaced rather than modified, so a response can
+	// run the hooks it looked up without holding the lock
+	extensionHooksLk sync.RWMutex
+	extensionHooks   map[graphsync.ExtensionName][]extensionHook
+	nextKey          uint64
+}
+
+// extensionHook is a hook for a single extension, keyed so it can be found
+// to unregister it
+type extensionHook struct {
+	key  uint64
+	hook graphsync.OnIncomingExtensionResponseHook
 }
 
 type internalResponseHookEvent struct {
@@ -23,21 +40,87 @@ type internalResponseHookEvent struct {
 	rha      *updateHookActions
 }
 
+// filteredResponseHook is a hook that only runs for responses its filter
+// returns true for
+type filteredResponseHook struct {
+	filter graphsync.ResponseHookFilter
+	hook   graphsync.OnIncomingResponseHook
+}
+
 func responseHookDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
 	ie := event.(internalResponseHookEvent)
-	hook := subscriberFn.(graphsync.OnIncomingResponseHook)
+	ie.rha.hooksRun++
+	hook, ok := subscriberFn.(graphsync.OnIncomingResponseHook)
+	if !ok {
+		filtered := subscriberFn.(filteredResponseHook)
+		if !filtered.filter(ie.p, ie.response) {
+			return nil
+		}
+		hook = filtered.hook
+	}
 	hook(ie.p, ie.response, ie.rha)
 	return ie.rha.err
 }
 
 // NewResponseHooks returns a new list of incoming request hooks
-func NewResponseHooks() *IncomingResponseHooks {
-	return &IncomingResponseHooks{pubSub: pubsub.New(responseHookDispatcher)}
+func NewResponseHooks(options ...hookset.Option) *IncomingResponseHooks {
+	options = append([]hookset.Option{hookset.WithHookType("incoming-response")}, options...)
+	return &IncomingResponseHooks{
+		hooks:          hookset.New(responseHookDispatcher, options...),
+		extensionHooks: make(map[graphsync.ExtensionName][]extensionHook),
+	}
 }
 
 // Register registers an extension to process incoming responses
 func (irh *IncomingResponseHooks) Register(hook graphsync.OnIncomingResponseHook) graphsync.UnregisterHookFunc {
-	return graphsync.UnregisterHookFunc(irh.pubSub.Subscribe(hook))
+	return irh.hooks.Register(hook)
+}
+
+// RegisterWithFilter registers an extension to process only the incoming
+// responses the filter returns true for. The filter runs before the hook, so
+// responses it rejects skip the hook entirely
+func (irh *IncomingResponseHooks) RegisterWithFilter(filter graphsync.ResponseHookFilter, hook graphsync.OnIncomingResponseHook) graphsync.UnregisterHookFunc {
+	return irh.hooks.Register(filteredResponseHook{filter, hook})
+}
+
+// RegisterExtensionResponseHook registers a hook that runs only for incoming
+// responses that carry the named extension, and receives that extension's
+// data. Extension hooks run after the other response hooks, in the order
+// extensions appear on the response, and are skipped once a hook terminates
+// or pauses the request
+func (irh *IncomingResponseHooks) RegisterExtensionResponseHook(name graphsync.ExtensionName, hook graphsync.OnIncomingExtensionResponseHook) graphsync.UnregisterHookFunc {
+	irh.extensionHooksLk.Lock()
+	defer irh.extensionHooksLk.Unlock()
+	irh.nextKey++
+	key := irh.nextKey
+	existing := irh.extensionHooks[name]
+	hooks := make([]extensionHook, 0, len(existing)+1)
+	hooks = append(hooks, existing...)
+	irh.extensionHooks[name] = append(hooks, extensionHook{key, hook})
+	return func() {
+		irh.extensionHooksLk.Lock()
+		defer irh.extensionHooksLk.Unlock()
+		existing := irh.extensionHooks[name]
+		hooks := make([]extensionHook, 0, len(existing))
+		for _, eh := range existing {
+			if eh.key != key {
+				hooks = append(hooks, eh)
+			}
+		}
+		if len(hooks) == 0 {
+			delete(irh.extensionHooks, name)
+			return
+		}
+		irh.extensionHooks[name] = hooks
+	}
+}
+
+// UnregisterAll removes all registered hooks
+func (irh *IncomingResponseHooks) UnregisterAll() {
+	irh.hooks.UnregisterAll()
+	irh.extensionHooksLk.Lock()
+	irh.extensionHooks = make(map[graphsync.ExtensionName][]extensionHook)
+	irh.extensionHooksLk.Unlock()
 }
 
 // UpdateResult is the outcome of running response hooks
@@ -49,13 +132,73 @@ type UpdateResult struct {
 // ProcessResponseHooks runs response hooks against an incoming response
 func (irh *IncomingResponseHooks) ProcessResponseHooks(p peer.ID, response graphsync.ResponseData) UpdateResult {
 	rha := &updateHookActions{}
-	_ = irh.pubSub.Publish(internalResponseHookEvent{p, response, rha})
+	if err := irh.hooks.Publish(internalResponseHookEvent{p, response, rha}); err != nil {
+		rha.err = err
+	}
+	if rha.err == nil {
+		irh.processExtensionHooks(p, response, rha)
+	}
 	return rha.result()
 }
 
+// extensionNamer is implemented by responses that can list their extensions
+type extensionNamer interface {
+	ExtensionNames() []graphsync.ExtensionName
+}
+
+// processExtensionHooks runs the hooks registered for each extension on a
+// response, so the work done depends on the extensions the response carries
+// rather than on every hook registered
+func (irh *IncomingResponseHooks) processExtensionHooks(p peer.ID, response graphsync.ResponseData, rha *updateHookActions) {
+	var names []graphsync.ExtensionName
+	irh.extensionHooksLk.RLock()
+	if len(irh.extensionHooks) == 0 {
+		irh.extensionHooksLk.RUnlock()
+		return
+	}
+	if namer, ok := response.(extensionNamer); ok {
+		names = namer.ExtensionNames()
+	} else {
+		// without a list of its extensions, check the response for each
+		// extension that has hooks
+		for name := range irh.extensionHooks {
+			names = append(names, name)
+		}
+	}
+	irh.extensionHooksLk.RUnlock()
+
+	for _, name := range names {
+		irh.extensionHooksLk.RLock()
+		hooks := irh.extensionHooks[name]
+		irh.extensionHooksLk.RUnlock()
+		if len(hooks) == 0 {
+			continue
+		}
+		data, ok := response.Extension(name)
+		if !ok {
+			continue
+		}
+		extension := graphsync.ExtensionData{Name: name, Data: data}
+		for _, eh := range hooks {
+			// extension hooks are observed as running after the other hooks
+			hookIndex := rha.hooksRun
+			rha.hooksRun++
+			err := irh.hooks.Run(hookIndex, func() error {
+				eh.hook(p, response, extension, rha)
+				return rha.err
+			})
+			if err != nil {
+				rha.err = err
+				return
+			}
+		}
+	}
+}
+
 type updateHookActions struct {
 	err        error
 	extensions []graphsync.ExtensionData
+	hooksRun   int
 }
 
 func (rha *updateHookActions) result() UpdateResult {
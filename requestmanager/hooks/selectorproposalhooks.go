@@ -0,0 +1,64 @@
+package hooks
+
+import (
+	"github.com/hannahhoward/go-pubsub"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/hookset"
+)
+
+// SelectorProposalHooks is a set of hooks that decide whether to accept
+// alternate selectors proposed by responders
+type SelectorProposalHooks struct {
+	hooks *hookset.HookSet
+}
+
+type internalSelectorProposalHookEvent struct {
+	p        peer.ID
+	request  graphsync.RequestData
+	proposal graphsync.SelectorProposal
+	spha     *selectorProposalHookActions
+}
+
+func selectorProposalHookDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+	ie := event.(internalSelectorProposalHookEvent)
+	hook := subscriberFn.(graphsync.OnSelectorProposalHook)
+	hook(ie.p, ie.request, ie.proposal, ie.spha)
+	return nil
+}
+
+// NewSelectorProposalHooks returns a new list of selector proposal hooks
+func NewSelectorProposalHooks(options ...hookset.Option) *SelectorProposalHooks {
+	options = append([]hookset.Option{hookset.WithHookType("selector-proposal")}, options...)
+	return &SelectorProposalHooks{hooks: hookset.New(selectorProposalHookDispatcher, options...)}
+}
+
+// Register registers a hook to process alternate selector proposals
+func (sph *SelectorProposalHooks) Register(hook graphsync.OnSelectorProposalHook) graphsync.UnregisterHookFunc {
+	return sph.hooks.Register(hook)
+}
+
+// UnregisterAll removes all registered hooks
+func (sph *SelectorProposalHooks) UnregisterAll() {
+	sph.hooks.UnregisterAll()
+}
+
+// ProcessSelectorProposalHooks runs selector proposal hooks against a proposal
+// for an outgoing request, returning true if any hook accepted it. A proposal
+// is declined if a hook panics
+func (sph *SelectorProposalHooks) ProcessSelectorProposalHooks(p peer.ID, request graphsync.RequestData, proposal graphsync.SelectorProposal) bool {
+	spha := &selectorProposalHookActions{}
+	if err := sph.hooks.Publish(internalSelectorProposalHookEvent{p, request, proposal, spha}); err != nil {
+		return false
+	}
+	return spha.accepted
+}
+
+type selectorProposalHookActions struct {
+	accepted bool
+}
+
+func (spha *selectorProposalHookActions) AcceptProposal() {
+	spha.accepted = true
+}
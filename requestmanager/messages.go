@@ -1,9 +1,12 @@
 package requestmanager
 
 import (
+	"time"
+
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-peertaskqueue/peertask"
 	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/traversal"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"go.opentelemetry.io/otel/trace"
 
@@ -58,12 +61,38 @@ type processResponsesMessage struct {
 	p         peer.ID
 	responses []gsmsg.GraphSyncResponse
 	blks      []blocks.Block
+	message   *gsmsg.GraphSyncMessage
 }
 
 func (prm *processResponsesMessage) handle(rm *RequestManager) {
+	if prm.message != nil {
+		rm.publishToTaps(prm.p, *prm.message)
+	}
 	rm.processResponses(prm.p, prm.responses, prm.blks)
 }
 
+type tapMessagesMessage struct {
+	requestID graphsync.RequestID
+	response  chan<- *messageTap
+}
+
+func (tmm *tapMessagesMessage) handle(rm *RequestManager) {
+	tap := rm.tapMessages(tmm.requestID)
+	select {
+	case <-rm.ctx.Done():
+	case tmm.response <- tap:
+	}
+}
+
+type untapMessagesMessage struct {
+	requestID graphsync.RequestID
+	tap       *messageTap
+}
+
+func (umm *untapMessagesMessage) handle(rm *RequestManager) {
+	rm.untapMessages(umm.requestID, umm.tap)
+}
+
 type cancelRequestMessage struct {
 	requestID     graphsync.RequestID
 	onTerminated  chan error
@@ -74,6 +103,24 @@ func (crm *cancelRequestMessage) handle(rm *RequestManager) {
 	rm.cancelRequest(crm.requestID, crm.onTerminated, crm.terminalError)
 }
 
+type drainRequestsMessage struct {
+	terminalError error
+	drained       chan struct{}
+}
+
+func (drm *drainRequestsMessage) handle(rm *RequestManager) {
+	rm.drainRequests(drm.terminalError, drm.drained)
+}
+
+type cancelAllRequestsMessage struct {
+	terminalError error
+	drained       chan struct{}
+}
+
+func (carm *cancelAllRequestsMessage) handle(rm *RequestManager) {
+	rm.cancelAllRequests(carm.terminalError, carm.drained)
+}
+
 type getRequestTaskMessage struct {
 	p                    peer.ID
 	task                 *peertask.Task
@@ -110,14 +157,25 @@ type newRequestMessage struct {
 	root                  ipld.Link
 	selector              ipld.Node
 	extensions            []graphsync.ExtensionData
+	maxLinks              uint64
+	chooser               traversal.LinkTargetNodePrototypeChooser
+	dependsOn             []graphsync.RequestID
+	rawBlocks             bool
 	inProgressRequestChan chan<- inProgressRequest
 }
 
 func (nrm *newRequestMessage) handle(rm *RequestManager) {
 	var ipr inProgressRequest
 
-	ipr.request, ipr.incoming, ipr.incomingError = rm.newRequest(nrm.requestID, nrm.span, nrm.p, nrm.root, nrm.selector, nrm.extensions)
+	ipr.request, ipr.incoming, ipr.incomingError = rm.newRequest(nrm.requestID, nrm.span, nrm.p, nrm.root, nrm.selector, nrm.extensions, nrm.maxLinks, nrm.chooser, nrm.dependsOn)
 	ipr.requestID = ipr.request.ID()
+	if status, ok := rm.inProgressRequestStatuses[ipr.requestID]; ok && status.inProgressChan == ipr.incoming {
+		ipr.completed = status.completed
+		if nrm.rawBlocks {
+			status.rawBlocks = make(chan blocks.Block)
+			ipr.incomingBlocks = status.rawBlocks
+		}
+	}
 
 	select {
 	case nrm.inProgressRequestChan <- ipr:
@@ -137,3 +195,139 @@ func (psm *peerStateMessage) handle(rm *RequestManager) {
 	case <-rm.ctx.Done():
 	}
 }
+
+type completedRequestsMessage struct {
+	response chan<- []graphsync.RequestTombstone
+}
+
+func (crm *completedRequestsMessage) handle(rm *RequestManager) {
+	select {
+	case crm.response <- rm.tombstones.list():
+	case <-rm.ctx.Done():
+	}
+}
+
+// requestSnapshot is the state of an in progress request at one moment
+type requestSnapshot struct {
+	p         peer.ID
+	request   gsmsg.GraphSyncRequest
+	state     graphsync.RequestState
+	startTime time.Time
+	// the persistence option the request stores blocks in
+	persistenceOption string
+}
+
+type inProgressRequestsMessage struct {
+	response chan<- []requestSnapshot
+}
+
+func (iprm *inProgressRequestsMessage) handle(rm *RequestManager) {
+	snapshots := make([]requestSnapshot, 0, len(rm.inProgressRequestStatuses))
+	for _, ipr := range rm.inProgressRequestStatuses {
+		snapshots = append(snapshots, requestSnapshot{ipr.p, ipr.request, ipr.state, ipr.startTime, ipr.persistenceOption})
+	}
+	select {
+	case iprm.response <- snapshots:
+	case <-rm.ctx.Done():
+	}
+}
+
+type exportStateMessage struct {
+	response chan<- []graphsync.RequestCheckpoint
+}
+
+func (esm *exportStateMessage) handle(rm *RequestManager) {
+	select {
+	case esm.response <- rm.exportState():
+	case <-rm.ctx.Done():
+	}
+}
+
+type progressStatesMessage struct {
+	response chan<- map[graphsync.RequestID]graphsync.ProgressState
+}
+
+func (psm *progressStatesMessage) handle(rm *RequestManager) {
+	states := make(map[graphsync.RequestID]graphsync.ProgressState, len(rm.inProgressRequestStatuses))
+	for requestID, ipr := range rm.inProgressRequestStatuses {
+		states[requestID] = graphsync.ProgressState{Received: ipr.receivedCids.Snapshot()}
+	}
+	select {
+	case psm.response <- states:
+	case <-rm.ctx.Done():
+	}
+}
+
+type tombstoneStatsMessage struct {
+	response chan<- graphsync.TombstoneStats
+}
+
+func (tsm *tombstoneStatsMessage) handle(rm *RequestManager) {
+	select {
+	case tsm.response <- rm.tombstones.stats():
+	case <-rm.ctx.Done():
+	}
+}
+
+type requestEventSubscription struct {
+	events      <-chan graphsync.RequestEvent
+	unsubscribe func()
+}
+
+type subscribeToRequestEventsMessage struct {
+	requestID graphsync.RequestID
+	response  chan<- requestEventSubscription
+}
+
+func (srem *subscribeToRequestEventsMessage) handle(rm *RequestManager) {
+	events, unsubscribe := rm.subscribeToRequestEvents(srem.requestID)
+	select {
+	case <-rm.ctx.Done():
+		unsubscribe()
+	case srem.response <- requestEventSubscription{events, unsubscribe}:
+	}
+}
+
+type retryRequestMessage struct {
+	requestID graphsync.RequestID
+	retry     int
+}
+
+func (rrm *retryRequestMessage) handle(rm *RequestManager) {
+	rm.retryRequest(rrm.requestID, rrm.retry)
+}
+
+type sendErrorMessage struct {
+	requestID graphsync.RequestID
+}
+
+func (sem *sendErrorMessage) handle(rm *RequestManager) {
+	if ipr, ok := rm.inProgressRequestStatuses[sem.requestID]; ok {
+		rm.scheduleRetry(sem.requestID, ipr)
+	}
+}
+
+type disconnectedMessage struct {
+	p peer.ID
+}
+
+func (dm *disconnectedMessage) handle(rm *RequestManager) {
+	rm.disconnected(dm.p)
+}
+
+type peerEvictedMessage struct {
+	p peer.ID
+}
+
+func (pem *peerEvictedMessage) handle(rm *RequestManager) {
+	rm.peerEvicted(pem.p)
+}
+
+type malformedMessageMessage struct {
+	p   peer.ID
+	err error
+}
+
+func (mmm *malformedMessageMessage) handle(rm *RequestManager) {
+	rm.malformedMessage(mmm.p, mmm.err)
+}
@@ -0,0 +1,84 @@
+package requestmanager
+
+import (
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+)
+
+// messageTapBufferSize is the number of messages a tap holds before further
+// messages are dropped
+const messageTapBufferSize = 16
+
+// messageTap receives the raw messages for a request. Taps are only touched
+// from the internal thread, so no locking is needed
+type messageTap struct {
+	messages chan gsmsg.GraphSyncMessage
+	closed   bool
+}
+
+func (mt *messageTap) publish(message gsmsg.GraphSyncMessage) {
+	if mt.closed {
+		return
+	}
+	select {
+	case mt.messages <- message:
+	default:
+		// never hold up processing for a slow consumer
+	}
+}
+
+func (mt *messageTap) close() {
+	if !mt.closed {
+		mt.closed = true
+		close(mt.messages)
+	}
+}
+
+func (rm *RequestManager) tapMessages(requestID graphsync.RequestID) *messageTap {
+	tap := &messageTap{messages: make(chan gsmsg.GraphSyncMessage, messageTapBufferSize)}
+	ipr, ok := rm.inProgressRequestStatuses[requestID]
+	if !ok {
+		// nothing will ever be received for an unknown request
+		tap.close()
+		return tap
+	}
+	ipr.messageTaps = append(ipr.messageTaps, tap)
+	return tap
+}
+
+func (rm *RequestManager) untapMessages(requestID graphsync.RequestID, tap *messageTap) {
+	tap.close()
+	ipr, ok := rm.inProgressRequestStatuses[requestID]
+	if !ok {
+		return
+	}
+	for i, existing := range ipr.messageTaps {
+		if existing == tap {
+			ipr.messageTaps = append(ipr.messageTaps[:i], ipr.messageTaps[i+1:]...)
+			return
+		}
+	}
+}
+
+// publishToTaps hands a message to the taps of every request from the sending
+// peer that has a response in the message
+func (rm *RequestManager) publishToTaps(p peer.ID, message gsmsg.GraphSyncMessage) {
+	for _, response := range message.Responses() {
+		ipr, ok := rm.inProgressRequestStatuses[response.RequestID()]
+		if !ok || ipr.p != p {
+			continue
+		}
+		for _, tap := range ipr.messageTaps {
+			tap.publish(message)
+		}
+	}
+}
+
+func closeMessageTaps(ipr *inProgressRequestStatus) {
+	for _, tap := range ipr.messageTaps {
+		tap.close()
+	}
+	ipr.messageTaps = nil
+}
@@ -3,7 +3,9 @@ package reconciledloader
 import (
 	"context"
 	"io/ioutil"
+	"time"
 
+	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime/datamodel"
 	"github.com/ipld/go-ipld-prime/linking"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
@@ -72,23 +74,43 @@ func (rl *ReconciledLoader) loadLocal(lctx linking.LinkContext, link datamodel.L
 	if err != nil {
 		return types.AsyncLoadResult{Err: graphsync.RemoteMissingBlockErr{Link: link, Path: lctx.LinkPath}, Local: true}
 	}
+	var localData []byte
 	// skip a stream copy if it's not needed
 	if br, ok := stream.(byteReader); ok {
-		return types.AsyncLoadResult{Data: br.Bytes(), Local: true}
+		localData = br.Bytes()
+	} else {
+		localData, err = ioutil.ReadAll(stream)
+		if err != nil {
+			return types.AsyncLoadResult{Err: graphsync.RemoteMissingBlockErr{Link: link, Path: lctx.LinkPath}, Local: true}
+		}
 	}
-	localData, err := ioutil.ReadAll(stream)
-	if err != nil {
+	// unless the store is trusted, a block that does not match its link, such
+	// as one only partly written before the node stopped, is treated as missing
+	// so it is loaded from the remote instead of failing the traversal
+	if !rl.lsys.TrustedStorage && !matchesLink(link, localData) {
 		return types.AsyncLoadResult{Err: graphsync.RemoteMissingBlockErr{Link: link, Path: lctx.LinkPath}, Local: true}
 	}
 	return types.AsyncLoadResult{Data: localData, Local: true}
 }
 
+func matchesLink(link datamodel.Link, data []byte) bool {
+	asCidLink, ok := link.(cidlink.Link)
+	if !ok {
+		return true
+	}
+	c, err := asCidLink.Cid.Prefix().Sum(data)
+	return err == nil && c.Equals(asCidLink.Cid)
+}
+
 func (rl *ReconciledLoader) loadRemote(lctx linking.LinkContext, link datamodel.Link) ([]byte, error) {
 	rl.lock.Lock()
 	head := rl.remoteQueue.first()
 	buffered := rl.remoteQueue.consume()
 	rl.lock.Unlock()
 
+	start := time.Now()
+	defer rl.addVerificationTime(start)
+
 	// verify it matches the expected next load
 	if !head.link.Equals(link.(cidlink.Link).Cid) {
 		return nil, graphsync.RemoteIncorrectResponseError{
@@ -165,7 +187,9 @@ func (rl *ReconciledLoader) waitRemote() (bool, error) {
 			path := rl.verifier.CurrentPath()
 			head := rl.remoteQueue.first()
 			rl.remoteQueue.consume()
+			start := time.Now()
 			err := rl.verifier.VerifyNext(head.link, head.action.DidFollowLink())
+			rl.addVerificationTime(start)
 			if err != nil {
 				return true, err
 			}
@@ -183,3 +207,23 @@ func (rl *ReconciledLoader) waitRemote() (bool, error) {
 		rl.signal.Wait()
 	}
 }
+
+// NextRemoteLink waits for the next link in the remote responses and consumes
+// it without loading it, returning false once the request is offline and every
+// remote item is consumed. It is for requests that are not traversed locally,
+// so remote items are not verified
+func (rl *ReconciledLoader) NextRemoteLink() (cid.Cid, graphsync.LinkAction, bool) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	for {
+		if !rl.remoteQueue.empty() {
+			head := rl.remoteQueue.first()
+			rl.remoteQueue.consume()
+			return head.link, head.action, true
+		}
+		if !rl.open {
+			return cid.Undef, "", false
+		}
+		rl.signal.Wait()
+	}
+}
@@ -26,6 +26,8 @@ import (
 	"context"
 	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipld/go-ipld-prime/datamodel"
@@ -70,6 +72,10 @@ type ReconciledLoader struct {
 	open        bool
 	verifier    *traversalrecord.Verifier
 	remoteQueue remoteQueue
+
+	// cumulative nanoseconds spent verifying and storing remote blocks,
+	// accessed atomically
+	verificationTime int64
 }
 
 // NewReconciledLoader returns a new reconciled loader for the given requestID & localStore
@@ -85,6 +91,16 @@ func NewReconciledLoader(requestID graphsync.RequestID, localStore *linking.Link
 	}
 }
 
+// VerificationTime returns the total time spent verifying remote responses
+// against the local traversal and storing the blocks they carried
+func (rl *ReconciledLoader) VerificationTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&rl.verificationTime))
+}
+
+func (rl *ReconciledLoader) addVerificationTime(start time.Time) {
+	atomic.AddInt64(&rl.verificationTime, int64(time.Since(start)))
+}
+
 // SetRemoteState records whether or not the request is online
 func (rl *ReconciledLoader) SetRemoteOnline(online bool) {
 	rl.lock.Lock()
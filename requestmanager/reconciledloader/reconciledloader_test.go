@@ -34,6 +34,7 @@ func TestReconciledLoader(t *testing.T) {
 		baseStore           map[datamodel.Link][]byte
 		presentRemoteBlocks []blocks.Block
 		presentLocalBlocks  []blocks.Block
+		partialLocalBlocks  []blocks.Block
 		remoteSeq           []message.GraphSyncLinkMetadatum
 		steps               []step
 	}{
@@ -85,6 +86,33 @@ func TestReconciledLoader(t *testing.T) {
 				// verify we can load the remaining items from the remote
 				syncLoadRange(testChain, 51, 100, false)...),
 		},
+		"partly written local block loads from remote": {
+			root:                testChain.TipLink.(cidlink.Link).Cid,
+			baseStore:           testBCStorage,
+			presentLocalBlocks:  testChain.Blocks(0, 50),
+			partialLocalBlocks:  testChain.Blocks(50, 51),
+			presentRemoteBlocks: testChain.Blocks(50, 100),
+			remoteSeq:           metadataRange(testChain, 0, 100, false),
+			steps: append(append(
+				syncLoadRange(testChain, 0, 50, true),
+				[]step{
+					// the partly written block does not match its link, so is missing
+					syncLoad{
+						loadSeq:        50,
+						expectedResult: types.AsyncLoadResult{Local: true, Err: graphsync.RemoteMissingBlockErr{Link: testChain.LinkTipIndex(50), Path: testChain.PathTipIndex(50)}},
+					},
+					goOnline{},
+					asyncRetry{},
+					injest{
+						metadataStart: 0,
+						metadataEnd:   100,
+					},
+					verifyAsyncResult{
+						expectedResult: types.AsyncLoadResult{Local: false, Data: testChain.Blocks(50, 51)[0].RawData()},
+					},
+				}...),
+				syncLoadRange(testChain, 51, 100, false)...),
+		},
 		"retry while offline": {
 			root:               testChain.TipLink.(cidlink.Link).Cid,
 			baseStore:          testBCStorage,
@@ -586,7 +614,12 @@ func TestReconciledLoader(t *testing.T) {
 			for _, lb := range data.presentLocalBlocks {
 				localStorage[cidlink.Link{Cid: lb.Cid()}] = lb.RawData()
 			}
+			for _, lb := range data.partialLocalBlocks {
+				localStorage[cidlink.Link{Cid: lb.Cid()}] = lb.RawData()[:len(lb.RawData())/2]
+			}
 			localLsys := testutil.NewTestStore(localStorage)
+			// partly written blocks are only detected in storage that is not trusted
+			localLsys.TrustedStorage = len(data.partialLocalBlocks) == 0
 			requestID := graphsync.NewRequestID()
 
 			remoteStorage := make(map[cid.Cid][]byte)
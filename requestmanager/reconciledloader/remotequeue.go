@@ -71,11 +71,12 @@ func (rq *remoteQueue) retryLast() {
 }
 
 func (rq *remoteQueue) consume() uint64 {
-	// release and clear the previous last consumed item
-	if rq.lastConsumed != nil {
+	// release and clear the previous last consumed item, unless it was put
+	// back to retry and is being consumed again
+	if rq.lastConsumed != nil && rq.lastConsumed != rq.head {
 		linkedRemoteItemPool.Put(rq.lastConsumed)
-		rq.lastConsumed = nil
 	}
+	rq.lastConsumed = nil
 	// update our total data size buffered
 	rq.dataSize -= uint64(len(rq.head.block))
 	// wipe the block reference -- if its been consumed, its saved
@@ -0,0 +1,42 @@
+package reconciledloader
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestRemoteQueueRetryLast(t *testing.T) {
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	rq := &remoteQueue{}
+	items := make([]*remotedLinkedItem, 0, len(blks))
+	for _, blk := range blks {
+		item := newRemote()
+		item.link = blk.Cid()
+		item.block = blk.RawData()
+		items = append(items, item)
+	}
+	require.Equal(t, uint64(200), rq.queue(items))
+
+	require.Equal(t, blks[0].Cid(), rq.first().link)
+	require.Equal(t, uint64(100), rq.consume())
+
+	// retrying puts the consumed item back at the front, without its data
+	rq.retryLast()
+	require.Equal(t, blks[0].Cid(), rq.first().link)
+	require.Equal(t, uint64(100), rq.consume())
+
+	// consuming a retried item must not release it while it's still held for
+	// another retry
+	require.NotSame(t, items[0], newRemote())
+	rq.retryLast()
+	require.Equal(t, blks[0].Cid(), rq.first().link)
+	rq.consume()
+	require.Equal(t, blks[1].Cid(), rq.first().link)
+	require.Equal(t, uint64(0), rq.consume())
+	require.True(t, rq.empty())
+	rq.clear()
+	require.Nil(t, rq.lastConsumed)
+}
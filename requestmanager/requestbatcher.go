@@ -0,0 +1,168 @@
+package requestmanager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+)
+
+// requestBatcher holds new requests to a peer for a short window so that
+// requests issued in a burst go out together in a single message
+type requestBatcher struct {
+	window time.Duration
+	clock  clock.Clock
+	send   func(p peer.ID, requests []gsmsg.GraphSyncRequest)
+
+	lk      sync.Mutex
+	pending map[peer.ID]*pendingBatch
+	outbox  map[peer.ID]*peerOutbox
+	closed  bool
+}
+
+type pendingBatch struct {
+	requests []gsmsg.GraphSyncRequest
+	timer    *clock.Timer
+}
+
+// peerOutbox holds requests to a peer that are ready to send. Only one
+// goroutine at a time sends from an outbox, so requests reach the message
+// queue in the order they were added, without holding the lock while sending
+type peerOutbox struct {
+	requests []gsmsg.GraphSyncRequest
+	sending  bool
+}
+
+func newRequestBatcher(window time.Duration, clock clock.Clock, send func(p peer.ID, requests []gsmsg.GraphSyncRequest)) *requestBatcher {
+	return &requestBatcher{
+		window:  window,
+		clock:   clock,
+		send:    send,
+		pending: make(map[peer.ID]*pendingBatch),
+		outbox:  make(map[peer.ID]*peerOutbox),
+	}
+}
+
+// add queues a new request to the batch for the given peer, starting the
+// batch window if this is the first request in the batch
+func (rb *requestBatcher) add(p peer.ID, request gsmsg.GraphSyncRequest) {
+	rb.lk.Lock()
+	defer rb.lk.Unlock()
+	if rb.closed {
+		return
+	}
+	batch, ok := rb.pending[p]
+	if !ok {
+		batch = &pendingBatch{}
+		batch.timer = rb.clock.AfterFunc(rb.window, func() {
+			rb.flushBatch(p, batch)
+		})
+		rb.pending[p] = batch
+	}
+	batch.requests = append(batch.requests, request)
+}
+
+// remove takes a request out of a pending batch, returning true if the
+// request had not yet been sent
+func (rb *requestBatcher) remove(p peer.ID, requestID graphsync.RequestID) bool {
+	rb.lk.Lock()
+	defer rb.lk.Unlock()
+	batch, ok := rb.pending[p]
+	if !ok {
+		return false
+	}
+	for i, request := range batch.requests {
+		if request.ID() == requestID {
+			batch.requests = append(batch.requests[:i], batch.requests[i+1:]...)
+			if len(batch.requests) == 0 {
+				batch.timer.Stop()
+				delete(rb.pending, p)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// flush sends any pending requests for the given peer immediately, followed
+// by the given requests
+func (rb *requestBatcher) flush(p peer.ID, requests ...gsmsg.GraphSyncRequest) {
+	rb.lk.Lock()
+	if batch, ok := rb.pending[p]; ok {
+		rb.takeBatch(p, batch)
+	}
+	rb.enqueue(p, requests)
+}
+
+// sendNow sends the given requests after any requests to the peer that are
+// already being sent, but does not flush the pending batch
+func (rb *requestBatcher) sendNow(p peer.ID, requests ...gsmsg.GraphSyncRequest) {
+	rb.lk.Lock()
+	rb.enqueue(p, requests)
+}
+
+func (rb *requestBatcher) flushBatch(p peer.ID, batch *pendingBatch) {
+	rb.lk.Lock()
+	// the batch may have already been flushed or emptied by the time the timer fires
+	if rb.pending[p] == batch {
+		rb.takeBatch(p, batch)
+	}
+	rb.enqueue(p, nil)
+}
+
+// shutdown stops the timers for all pending batches, and drops their
+// requests. Requests added afterwards are dropped
+func (rb *requestBatcher) shutdown() {
+	rb.lk.Lock()
+	defer rb.lk.Unlock()
+	rb.closed = true
+	for p, batch := range rb.pending {
+		batch.timer.Stop()
+		delete(rb.pending, p)
+	}
+}
+
+// takeBatch moves a pending batch to the peer's outbox. It must be called
+// with the lock held
+func (rb *requestBatcher) takeBatch(p peer.ID, batch *pendingBatch) {
+	batch.timer.Stop()
+	delete(rb.pending, p)
+	outbox := rb.outboxFor(p)
+	outbox.requests = append(outbox.requests, batch.requests...)
+}
+
+func (rb *requestBatcher) outboxFor(p peer.ID) *peerOutbox {
+	outbox, ok := rb.outbox[p]
+	if !ok {
+		outbox = &peerOutbox{}
+		rb.outbox[p] = outbox
+	}
+	return outbox
+}
+
+// enqueue adds requests to the peer's outbox and sends everything in it,
+// unless another goroutine is already sending for the peer, in which case
+// that goroutine sends them too. It must be called with the lock held, and
+// releases it
+func (rb *requestBatcher) enqueue(p peer.ID, requests []gsmsg.GraphSyncRequest) {
+	outbox := rb.outboxFor(p)
+	outbox.requests = append(outbox.requests, requests...)
+	if outbox.sending {
+		rb.lk.Unlock()
+		return
+	}
+	outbox.sending = true
+	for len(outbox.requests) > 0 {
+		toSend := outbox.requests
+		outbox.requests = nil
+		rb.lk.Unlock()
+		rb.send(p, toSend)
+		rb.lk.Lock()
+	}
+	delete(rb.outbox, p)
+	rb.lk.Unlock()
+}
@@ -0,0 +1,147 @@
+package requestmanager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+type sentBatch struct {
+	p        peer.ID
+	requests []gsmsg.GraphSyncRequest
+}
+
+func TestRequestBatcher(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	window := 100 * time.Millisecond
+	peers := testutil.GeneratePeers(2)
+	root := testutil.GenerateCids(1)[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	sel := ssb.Matcher().Node()
+	newRequest := func() gsmsg.GraphSyncRequest {
+		return gsmsg.NewRequest(graphsync.NewRequestID(), root, sel, graphsync.Priority(0))
+	}
+	requestIDs := func(requests []gsmsg.GraphSyncRequest) []graphsync.RequestID {
+		ids := make([]graphsync.RequestID, 0, len(requests))
+		for _, request := range requests {
+			ids = append(ids, request.ID())
+		}
+		return ids
+	}
+	setup := func() (*requestBatcher, *clock.Mock, chan sentBatch) {
+		mockClock := clock.NewMock()
+		sent := make(chan sentBatch, 10)
+		rb := newRequestBatcher(window, mockClock, func(p peer.ID, requests []gsmsg.GraphSyncRequest) {
+			sent <- sentBatch{p, requests}
+		})
+		return rb, mockClock, sent
+	}
+
+	t.Run("sends requests added within the window together", func(t *testing.T) {
+		rb, mockClock, sent := setup()
+		requests := []gsmsg.GraphSyncRequest{newRequest(), newRequest(), newRequest()}
+		for _, request := range requests {
+			rb.add(peers[0], request)
+		}
+		other := newRequest()
+		rb.add(peers[1], other)
+		require.True(t, rb.remove(peers[0], requests[1].ID()))
+		testutil.AssertChannelEmpty(t, sent, "should not send before the window ends")
+
+		mockClock.Add(window)
+		received := make(map[peer.ID][]graphsync.RequestID)
+		for i := 0; i < 2; i++ {
+			var batch sentBatch
+			testutil.AssertReceive(ctx, t, sent, &batch, "should send batch")
+			received[batch.p] = requestIDs(batch.requests)
+		}
+		require.Equal(t, map[peer.ID][]graphsync.RequestID{
+			peers[0]: {requests[0].ID(), requests[2].ID()},
+			peers[1]: {other.ID()},
+		}, received)
+		require.False(t, rb.remove(peers[0], requests[0].ID()), "should not remove sent request")
+	})
+
+	t.Run("flush sends pending requests ahead of the given requests", func(t *testing.T) {
+		rb, mockClock, sent := setup()
+		request := newRequest()
+		rb.add(peers[0], request)
+		update := gsmsg.NewUpdateRequest(request.ID())
+		rb.flush(peers[0], update)
+		var batch sentBatch
+		testutil.AssertReceive(ctx, t, sent, &batch, "should send batch")
+		require.Equal(t, []graphsync.RequestID{request.ID(), request.ID()}, requestIDs(batch.requests))
+		require.Equal(t, graphsync.RequestTypeNew, batch.requests[0].Type())
+		require.Equal(t, graphsync.RequestTypeUpdate, batch.requests[1].Type())
+
+		// the flushed batch's timer no longer sends anything
+		mockClock.Add(window)
+		testutil.AssertChannelEmpty(t, sent, "should not send flushed batch again")
+	})
+
+	t.Run("requests added while sending go out after the requests being sent", func(t *testing.T) {
+		mockClock := clock.NewMock()
+		sending := make(chan struct{})
+		release := make(chan struct{})
+		sent := make(chan sentBatch, 10)
+		firstSend := true
+		rb := newRequestBatcher(window, mockClock, func(p peer.ID, requests []gsmsg.GraphSyncRequest) {
+			sent <- sentBatch{p, requests}
+			if firstSend {
+				firstSend = false
+				close(sending)
+				<-release
+			}
+		})
+		first := newRequest()
+		rb.add(peers[0], first)
+		windowEnded := make(chan struct{})
+		go func() {
+			mockClock.Add(window)
+			close(windowEnded)
+		}()
+		testutil.AssertDoesReceive(ctx, t, sending, "should start sending batch")
+
+		// the send for the batch is still in progress, so these wait for it,
+		// without blocking the caller
+		cancelFirst := gsmsg.NewCancelRequest(first.ID())
+		rb.sendNow(peers[0], cancelFirst)
+		second := newRequest()
+		rb.add(peers[0], second)
+		close(release)
+
+		var batch sentBatch
+		testutil.AssertReceive(ctx, t, sent, &batch, "should send batch")
+		require.Equal(t, []graphsync.RequestID{first.ID()}, requestIDs(batch.requests))
+		testutil.AssertReceive(ctx, t, sent, &batch, "should send cancel")
+		require.Equal(t, []graphsync.RequestID{first.ID()}, requestIDs(batch.requests))
+		require.Equal(t, graphsync.RequestTypeCancel, batch.requests[0].Type())
+		testutil.AssertDoesReceive(ctx, t, windowEnded, "should finish first window")
+		testutil.AssertChannelEmpty(t, sent, "should not send second batch before its window ends")
+		mockClock.Add(window)
+		testutil.AssertReceive(ctx, t, sent, &batch, "should send second batch")
+		require.Equal(t, []graphsync.RequestID{second.ID()}, requestIDs(batch.requests))
+	})
+
+	t.Run("shutdown stops pending batches", func(t *testing.T) {
+		rb, mockClock, sent := setup()
+		rb.add(peers[0], newRequest())
+		rb.shutdown()
+		rb.add(peers[1], newRequest())
+		mockClock.Add(window)
+		testutil.AssertChannelEmpty(t, sent, "should not send after shutdown")
+	})
+}
@@ -0,0 +1,130 @@
+package requestmanager
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+// requestEventSubscriber buffers lifecycle events for a single subscriber so
+// that publishing from the internal thread never blocks on a slow reader
+type requestEventSubscriber struct {
+	ctx       context.Context
+	out       chan graphsync.RequestEvent
+	signal    chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	lk    sync.Mutex
+	queue []graphsync.RequestEvent
+}
+
+func newRequestEventSubscriber(ctx context.Context) *requestEventSubscriber {
+	sub := &requestEventSubscriber{
+		ctx:    ctx,
+		out:    make(chan graphsync.RequestEvent),
+		signal: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go sub.run()
+	return sub
+}
+
+func (s *requestEventSubscriber) publish(event graphsync.RequestEvent) {
+	s.lk.Lock()
+	s.queue = append(s.queue, event)
+	s.lk.Unlock()
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// unsubscribe stops delivery and closes the channel. It is safe to call
+// multiple times
+func (s *requestEventSubscriber) unsubscribe() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+func (s *requestEventSubscriber) isUnsubscribed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *requestEventSubscriber) run() {
+	defer close(s.out)
+	for {
+		s.lk.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.lk.Unlock()
+		for _, event := range queue {
+			select {
+			case s.out <- event:
+			case <-s.done:
+				return
+			case <-s.ctx.Done():
+				return
+			}
+			if event.Name.IsTerminal() {
+				return
+			}
+		}
+		select {
+		case <-s.signal:
+		case <-s.done:
+			return
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (rm *RequestManager) subscribeToRequestEvents(requestID graphsync.RequestID) (<-chan graphsync.RequestEvent, func()) {
+	sub := newRequestEventSubscriber(rm.ctx)
+	if ipr, ok := rm.inProgressRequestStatuses[requestID]; ok {
+		ipr.eventSubscribers = append(ipr.eventSubscribers, sub)
+	} else if tombstone, ok := rm.tombstones.use(requestID); ok {
+		sub.publish(tombstone.Event)
+	} else {
+		// nothing will ever be published for an unknown request
+		sub.unsubscribe()
+	}
+	return sub.out, sub.unsubscribe
+}
+
+func (rm *RequestManager) publishRequestEvent(ipr *inProgressRequestStatus, name graphsync.RequestEventName, err error) {
+	event := graphsync.RequestEvent{
+		Name:      name,
+		RequestID: ipr.request.ID(),
+		Timestamp: time.Now(),
+		Err:       err,
+	}
+	if name.IsTerminal() {
+		event.Duration = event.Timestamp.Sub(ipr.startTime)
+		event.VerificationTime = ipr.verificationTime()
+		atomic.AddInt64(&rm.verificationTime, int64(event.VerificationTime))
+		event.Transfer = rm.transferStats.FinishRequest(ipr.request.ID())
+	}
+	subscribers := ipr.eventSubscribers[:0]
+	for _, sub := range ipr.eventSubscribers {
+		if sub.isUnsubscribed() {
+			continue
+		}
+		sub.publish(event)
+		subscribers = append(subscribers, sub)
+	}
+	ipr.eventSubscribers = subscribers
+	if name.IsTerminal() {
+		rm.tombstones.record(ipr.p, event)
+	}
+}
@@ -4,28 +4,47 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/benbjohnson/clock"
+	"github.com/google/uuid"
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-peertaskqueue"
 	"github.com/ipld/go-ipld-prime"
 	"github.com/ipld/go-ipld-prime/datamodel"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/stretchr/testify/require"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/cidset"
+	"github.com/ipfs/go-graphsync/deadline"
 	"github.com/ipfs/go-graphsync/dedupkey"
+	"github.com/ipfs/go-graphsync/limits"
 	"github.com/ipfs/go-graphsync/listeners"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/messagequeue"
+	"github.com/ipfs/go-graphsync/panics"
 	"github.com/ipfs/go-graphsync/persistenceoptions"
+	"github.com/ipfs/go-graphsync/remoteerror"
 	"github.com/ipfs/go-graphsync/requestmanager/executor"
 	"github.com/ipfs/go-graphsync/requestmanager/hooks"
+	"github.com/ipfs/go-graphsync/selectorproposal"
+	"github.com/ipfs/go-graphsync/supportedextensions"
 	"github.com/ipfs/go-graphsync/taskqueue"
 	"github.com/ipfs/go-graphsync/testutil"
+	"github.com/ipfs/go-graphsync/transferstats"
 )
 
 func TestNormalSimultaneousFetch(t *testing.T) {
@@ -87,6 +106,100 @@ func TestNormalSimultaneousFetch(t *testing.T) {
 	td.tcm.RefuteProtected(t, peers[0])
 }
 
+func TestResponseProgressMatched(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	// walks the whole chain like the chain's own selector, but only matches
+	// the blocks, not the lists of parents it walks through between them
+	blockChainLength := 5
+	blockChain := testutil.SetupBlockChain(ctx, t, td.persistence, 100, blockChainLength)
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	blocksSelector := ssb.ExploreRecursive(selector.RecursionLimitDepth(int64(blockChainLength)),
+		ssb.ExploreUnion(
+			ssb.Matcher(),
+			ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+				efsb.Insert("Parents", ssb.ExploreAll(ssb.ExploreRecursiveEdge()))
+			}))).Node()
+
+	returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], blockChain.TipLink, blocksSelector)
+	requestRecords := readNNetworkRequests(requestCtx, t, td, 1)
+
+	blks := blockChain.AllBlocks()
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(requestRecords[0].gsr.ID(), graphsync.RequestCompletedFull, metadataForBlocks(blks, graphsync.LinkActionPresent)),
+	}, blks)
+
+	responses := testutil.CollectResponses(requestCtx, t, returnedResponseChan)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
+	require.Len(t, responses, 2*blockChainLength)
+	matched := 0
+	for _, response := range responses {
+		// blocks are at "", "Parents/0", "Parents/0/Parents/0"... and their
+		// lists of parents at "Parents", "Parents/0/Parents"...
+		isBlock := response.Path.Len()%2 == 0
+		require.Equal(t, isBlock, response.Matched, "wrong match status for %s", response.Path)
+		if response.Matched {
+			matched++
+		}
+	}
+	require.Equal(t, blockChainLength, matched)
+}
+
+func TestRequestRawBlocks(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	// the caller stores blocks itself, so nothing is kept by graphsync
+	discardStore := cidlink.DefaultLinkSystem()
+	discardStore.StorageReadOpener = func(ipld.LinkContext, ipld.Link) (io.Reader, error) {
+		return nil, errors.New("not found")
+	}
+	discardStore.StorageWriteOpener = func(ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+		return ioutil.Discard, func(ipld.Link) error { return nil }, nil
+	}
+	td.persistenceOptions.Register("discard", discardStore)
+	td.requestHooks.Register(func(p peer.ID, r graphsync.RequestData, ha graphsync.OutgoingRequestHookActions) {
+		ha.UsePersistenceOption("discard")
+	})
+
+	returnedResponseChan, returnedBlockChan, returnedErrorChan := td.requestManager.RequestRawBlocks(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	requestRecords := readNNetworkRequests(requestCtx, t, td, 1)
+
+	blks := td.blockChain.AllBlocks()
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(requestRecords[0].gsr.ID(), graphsync.RequestCompletedFull, metadataForBlocks(blks, graphsync.LinkActionPresent)),
+	}, blks)
+
+	// the response and block channels are read together
+	var received []blocks.Block
+	blocksDone := make(chan struct{})
+	go func() {
+		defer close(blocksDone)
+		for blk := range returnedBlockChan {
+			received = append(received, blk)
+		}
+	}()
+	td.blockChain.VerifyWholeChain(requestCtx, returnedResponseChan)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
+	testutil.AssertDoesReceive(requestCtx, t, blocksDone, "block channel should close with the response channel")
+
+	require.Len(t, received, len(blks))
+	for i, blk := range blks {
+		require.Equal(t, blk.Cid(), received[i].Cid(), "blocks should be delivered in traversal order")
+		require.Equal(t, blk.RawData(), received[i].RawData())
+	}
+	require.Empty(t, td.localBlockStore)
+}
+
 func TestCancelRequestInProgress(t *testing.T) {
 	ctx := context.Background()
 	td := newTestData(ctx, t)
@@ -140,6 +253,48 @@ func TestCancelRequestInProgress(t *testing.T) {
 
 	td.tcm.RefuteProtected(t, peers[0])
 }
+
+func TestCancelRequestInterruptsLoad(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	// blocks loads until they are cancelled
+	loadCtxs := make(chan context.Context, 1)
+	blockingStore := testutil.NewTestStore(make(map[datamodel.Link][]byte))
+	blockingStore.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		loadCtxs <- lctx.Ctx
+		<-lctx.Ctx.Done()
+		return nil, lctx.Ctx.Err()
+	}
+	td.persistenceOptions.Register("blocking", blockingStore)
+	td.requestHooks.Register(func(p peer.ID, r graphsync.RequestData, ha graphsync.OutgoingRequestHookActions) {
+		ha.UsePersistenceOption("blocking")
+	})
+
+	returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+
+	var loadCtx context.Context
+	testutil.AssertReceive(requestCtx, t, loadCtxs, &loadCtx, "should load first block")
+	requestID, ok := graphsync.RequestIDFromContext(loadCtx)
+	require.True(t, ok)
+	p, ok := graphsync.PeerFromContext(loadCtx)
+	require.True(t, ok)
+	require.Equal(t, peers[0], p)
+
+	err := td.requestManager.CancelRequest(requestCtx, requestID)
+	require.NoError(t, err)
+	testutil.AssertDoesReceive(requestCtx, t, loadCtx.Done(), "should cancel the load context")
+
+	testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan)
+	errors := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+	require.Len(t, errors, 1)
+	_, ok = errors[0].(graphsync.RequestClientCancelledErr)
+	require.True(t, ok)
+}
+
 func TestCancelRequestImperativeNoMoreBlocks(t *testing.T) {
 	ctx := context.Background()
 	td := newTestData(ctx, t)
@@ -181,6 +336,45 @@ func TestCancelRequestImperativeNoMoreBlocks(t *testing.T) {
 	require.True(t, ok)
 }
 
+func TestCancelRequestLeavesSiblings(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	// both requests share a context, so only the request ID tells them apart
+	returnedResponseChan1, returnedErrorChan1 := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	returnedResponseChan2, returnedErrorChan2 := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	requestRecords := readNNetworkRequests(requestCtx, t, td, 2)
+	cancelledID := requestRecords[0].gsr.ID()
+	remainingID := requestRecords[1].gsr.ID()
+
+	require.NoError(t, td.requestManager.CancelRequest(requestCtx, cancelledID))
+	rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+	require.Equal(t, graphsync.RequestTypeCancel, rr.gsr.Type())
+	require.Equal(t, cancelledID, rr.gsr.ID())
+	testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan1)
+	errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan1)
+	require.Len(t, errs, 1)
+	require.IsType(t, graphsync.RequestClientCancelledErr{}, errs[0])
+
+	// the other request carries on as normal
+	blks := td.blockChain.AllBlocks()
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(remainingID, graphsync.RequestCompletedFull, metadataForBlocks(blks, graphsync.LinkActionPresent)),
+	}, blks)
+	td.blockChain.VerifyWholeChain(requestCtx, returnedResponseChan2)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan2)
+	testutil.AssertChannelEmpty(t, td.requestRecordChan, "should not cancel the other request")
+
+	// cancelling a request that already finished, or was never made, is an error
+	var notFound graphsync.RequestNotFoundErr
+	require.ErrorAs(t, td.requestManager.CancelRequest(requestCtx, cancelledID), &notFound)
+	require.ErrorAs(t, td.requestManager.CancelRequest(requestCtx, remainingID), &notFound)
+	require.ErrorAs(t, td.requestManager.CancelRequest(requestCtx, graphsync.NewRequestID()), &notFound)
+}
+
 func TestCancelManagerExitsGracefully(t *testing.T) {
 	ctx := context.Background()
 	managerCtx, managerCancel := context.WithCancel(ctx)
@@ -212,6 +406,213 @@ func TestCancelManagerExitsGracefully(t *testing.T) {
 	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
 }
 
+func TestCancelQueuedRequest(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	// occupy every request worker so the next request waits in the queue
+	for i := 0; i < 6; i++ {
+		_, _ = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	}
+	blockingRequests := readNNetworkRequests(requestCtx, t, td, 6)
+
+	queuedCtx, cancelQueued := context.WithCancel(requestCtx)
+	returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(queuedCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	queuedID := td.requestIds[6]
+	cancelQueued()
+
+	testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan)
+	errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+	require.Len(t, errs, 1)
+	require.IsType(t, graphsync.RequestClientCancelledErr{}, errs[0])
+	testutil.AssertChannelEmpty(t, td.requestRecordChan, "should not send anything for a request that never left the queue")
+
+	// the next queued request is sent once a worker frees up, skipping the
+	// cancelled one
+	_, _ = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(blockingRequests[0].gsr.ID(), graphsync.RequestFailedUnknown, nil),
+	}, nil)
+	rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+	require.Equal(t, graphsync.RequestTypeNew, rr.gsr.Type())
+	require.Equal(t, td.requestIds[7], rr.gsr.ID())
+	require.NotEqual(t, queuedID, rr.gsr.ID())
+}
+
+func TestOutgoingRequestHookOverridesPriority(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+		if _, found := requestData.Extension(td.extensionName1); found {
+			hookActions.OverridePriority(graphsync.Priority(10))
+		}
+	})
+
+	// occupy every request worker so the next requests wait in the queue
+	for i := 0; i < 6; i++ {
+		_, _ = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	}
+	blockingRequests := readNNetworkRequests(requestCtx, t, td, 6)
+	for _, rr := range blockingRequests {
+		require.Equal(t, graphsync.Priority(0), rr.gsr.Priority())
+	}
+
+	_, _ = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	_, _ = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector(), td.extension1)
+
+	// the boosted request is sent first, with the overridden priority
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(blockingRequests[0].gsr.ID(), graphsync.RequestFailedUnknown, nil),
+	}, nil)
+	rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+	require.Equal(t, td.requestIds[7], rr.gsr.ID())
+	require.Equal(t, graphsync.Priority(10), rr.gsr.Priority())
+}
+
+func TestPerPeerLimitDispatchesByPriority(t *testing.T) {
+	ctx := context.Background()
+	td := newTestDataWithConfig(ctx, t, testConfig{maxInProgressPerPeer: 1})
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(2)
+
+	td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+		if _, found := requestData.Extension(td.extensionName1); found {
+			hookActions.OverridePriority(graphsync.Priority(10))
+		}
+	})
+
+	// occupy the only slot for the first peer
+	_, _ = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	blockingRequest := readNNetworkRequests(requestCtx, t, td, 1)[0]
+
+	_, _ = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	cancelledCtx, cancelQueued := context.WithCancel(requestCtx)
+	_, queuedErrChan := td.requestManager.NewRequest(cancelledCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector(), td.extension1)
+	_, _ = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector(), td.extension1)
+
+	// requests to other peers are not held back
+	_, _ = td.requestManager.NewRequest(requestCtx, peers[1], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+	require.Equal(t, td.requestIds[4], rr.gsr.ID())
+	testutil.AssertChannelEmpty(t, td.requestRecordChan, "should hold requests to the first peer")
+
+	// a waiting request can be cancelled
+	cancelQueued()
+	errs := testutil.CollectErrors(requestCtx, t, queuedErrChan)
+	require.Len(t, errs, 1)
+	require.IsType(t, graphsync.RequestClientCancelledErr{}, errs[0])
+
+	// the later high priority request is sent before the earlier low priority
+	// one, once the slot frees up
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(blockingRequest.gsr.ID(), graphsync.RequestFailedUnknown, nil),
+	}, nil)
+	rr = readNNetworkRequests(requestCtx, t, td, 1)[0]
+	require.Equal(t, td.requestIds[3], rr.gsr.ID())
+	require.Equal(t, graphsync.Priority(10), rr.gsr.Priority())
+	testutil.AssertChannelEmpty(t, td.requestRecordChan, "should send one request at a time to the first peer")
+
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestFailedUnknown, nil),
+	}, nil)
+	rr = readNNetworkRequests(requestCtx, t, td, 1)[0]
+	require.Equal(t, td.requestIds[1], rr.gsr.ID())
+}
+
+func TestRequestDependenciesRaisePriority(t *testing.T) {
+	ctx := context.Background()
+	td := newTestDataWithConfig(ctx, t, testConfig{scheduler: NewPriorityScheduler(1)})
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(2)
+
+	td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.OutgoingRequestHookActions) {
+		if _, found := requestData.Extension(td.extensionName1); found {
+			hookActions.OverridePriority(graphsync.Priority(10))
+		}
+		if _, found := requestData.Extension(td.extensionName2); found {
+			hookActions.OverridePriority(graphsync.Priority(20))
+		}
+	})
+
+	// occupy the only slot for the first peer
+	_, _ = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	blockingRequest := readNNetworkRequests(requestCtx, t, td, 1)[0]
+
+	dependencyID := graphsync.NewRequestID()
+	dependencyCtx := context.WithValue(requestCtx, graphsync.RequestIDContextKey{}, dependencyID)
+	_, _ = td.requestManager.NewRequest(dependencyCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	_, _ = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector(), td.extension1)
+
+	// a high priority request to another peer needs blocks from the low
+	// priority request
+	dependentCtx := graphsync.WithRequestDependencies(requestCtx, dependencyID)
+	_, _ = td.requestManager.NewRequest(dependentCtx, peers[1], td.blockChain.TipLink, td.blockChain.Selector(), td.extension2)
+	rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+	require.Equal(t, graphsync.Priority(20), rr.gsr.Priority())
+
+	// the low priority request is sent first, at the priority of the request
+	// that depends on it
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(blockingRequest.gsr.ID(), graphsync.RequestFailedUnknown, nil),
+	}, nil)
+	rr = readNNetworkRequests(requestCtx, t, td, 1)[0]
+	require.Equal(t, dependencyID, rr.gsr.ID())
+}
+
+func TestCustomScheduler(t *testing.T) {
+	ctx := context.Background()
+	var lk sync.Mutex
+	var seen [][]graphsync.PendingRequestInfo
+	// dispatch the most recently queued request first
+	lifo := func(pending []graphsync.PendingRequestInfo) int {
+		lk.Lock()
+		seen = append(seen, pending)
+		lk.Unlock()
+		return len(pending) - 1
+	}
+	td := newTestDataWithConfig(ctx, t, testConfig{scheduler: NewFuncScheduler(lifo)})
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	// occupy every request worker so the next requests wait in the queue
+	for i := 0; i < 6; i++ {
+		_, _ = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	}
+	blockingRequests := readNNetworkRequests(requestCtx, t, td, 6)
+
+	for i := 0; i < 3; i++ {
+		_, _ = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	}
+	require.Equal(t, uint64(3), td.taskqueue.Stats().Pending)
+
+	// each time a worker frees up, the newest waiting request is sent
+	for i, expected := range []int{8, 7, 6} {
+		td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+			gsmsg.NewResponse(blockingRequests[i].gsr.ID(), graphsync.RequestFailedUnknown, nil),
+		}, nil)
+		rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+		require.Equal(t, td.requestIds[expected], rr.gsr.ID())
+	}
+
+	lk.Lock()
+	defer lk.Unlock()
+	last := seen[len(seen)-1]
+	require.Len(t, last, 1)
+	require.Equal(t, td.requestIds[6], last[0].RequestID)
+	require.Equal(t, peers[0], last[0].Peer)
+	require.False(t, last[0].QueuedAt.IsZero())
+}
+
 func TestFailedRequest(t *testing.T) {
 	ctx := context.Background()
 	td := newTestData(ctx, t)
@@ -235,6 +636,156 @@ func TestFailedRequest(t *testing.T) {
 	td.tcm.RefuteProtected(t, peers[0])
 }
 
+func TestFailedRequestErrors(t *testing.T) {
+	testCases := map[graphsync.ResponseStatusCode]error{
+		graphsync.RequestRejected:              graphsync.RequestRejectedErr{},
+		graphsync.RequestFailedUnknown:         graphsync.RequestFailedUnknownErr{},
+		graphsync.RequestFailedLegal:           graphsync.RequestFailedLegalErr{},
+		graphsync.RequestFailedContentNotFound: graphsync.RequestFailedContentNotFoundErr{},
+		graphsync.RequestCancelled:             graphsync.RequestCancelledErr{},
+	}
+	for status, expectedErr := range testCases {
+		status, expectedErr := status, expectedErr
+		t.Run(status.String(), func(t *testing.T) {
+			ctx := context.Background()
+			td := newTestData(ctx, t)
+			requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+			defer cancel()
+			peers := testutil.GeneratePeers(1)
+
+			returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+			rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+			td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+				gsmsg.NewResponse(rr.gsr.ID(), status, nil),
+			}, nil)
+
+			testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan)
+			errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+			require.Len(t, errs, 1)
+			require.Equal(t, expectedErr, errs[0])
+			require.True(t, errors.Is(fmt.Errorf("wrapped: %w", errs[0]), expectedErr))
+		})
+	}
+
+	t.Run("unknown status code", func(t *testing.T) {
+		ctx := context.Background()
+		td := newTestData(ctx, t)
+		requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		peers := testutil.GeneratePeers(1)
+
+		// a status this implementation does not know ends the request
+		returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+		rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+		td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+			gsmsg.NewResponse(rr.gsr.ID(), graphsync.ResponseStatusCode(39), nil),
+		}, nil)
+		testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan)
+		errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+		require.Len(t, errs, 1)
+		var unknownStatusErr graphsync.UnknownResponseStatusErr
+		require.True(t, errors.As(errs[0], &unknownStatusErr))
+		require.Equal(t, graphsync.ResponseStatusCode(39), unknownStatusErr.Code)
+	})
+
+	t.Run("client cancelled", func(t *testing.T) {
+		ctx := context.Background()
+		td := newTestData(ctx, t)
+		requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		cancelledCtx, cancelRequest := context.WithCancel(requestCtx)
+		peers := testutil.GeneratePeers(1)
+
+		_, returnedErrorChan := td.requestManager.NewRequest(cancelledCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+		readNNetworkRequests(requestCtx, t, td, 1)
+		cancelRequest()
+
+		errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+		require.Len(t, errs, 1)
+		require.True(t, errors.Is(errs[0], graphsync.RequestClientCancelledErr{}))
+	})
+
+	t.Run("with failure reason", func(t *testing.T) {
+		ctx := context.Background()
+		td := newTestData(ctx, t)
+		requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		peers := testutil.GeneratePeers(1)
+
+		returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+		rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+		td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+			gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestFailedUnknown, nil, graphsync.ExtensionData{
+				Name: graphsync.ExtensionFailureReason,
+				Data: basicnode.NewString("hook failed"),
+			}),
+		}, nil)
+
+		testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan)
+		errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+		require.Len(t, errs, 1)
+		var reasonErr graphsync.FailureReasonErr
+		require.True(t, errors.As(errs[0], &reasonErr))
+		require.Equal(t, "hook failed", reasonErr.Reason)
+		require.True(t, errors.Is(errs[0], graphsync.RequestFailedUnknownErr{}))
+	})
+
+	t.Run("with remote error", func(t *testing.T) {
+		ctx := context.Background()
+		td := newTestData(ctx, t)
+		requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		peers := testutil.GeneratePeers(1)
+
+		returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+		rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+		payload := basicnode.NewString("retry in 30s")
+		td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+			gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestRejected, nil, graphsync.ExtensionData{
+				Name: graphsync.ExtensionFailureReason,
+				Data: basicnode.NewString("remote error 429: rate limited"),
+			}, graphsync.ExtensionData{
+				Name: graphsync.ExtensionRemoteError,
+				Data: remoteerror.EncodeRemoteError(graphsync.NewRemoteError(429, "rate limited").WithPayload(payload)),
+			}),
+		}, nil)
+
+		testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan)
+		errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+		require.Len(t, errs, 1)
+		var remoteErr graphsync.RemoteError
+		require.True(t, errors.As(errs[0], &remoteErr))
+		require.Equal(t, int64(429), remoteErr.Code())
+		require.Equal(t, "rate limited", remoteErr.Message())
+		require.True(t, ipld.DeepEqual(payload, remoteErr.Payload()))
+		require.True(t, errors.Is(errs[0], graphsync.RequestRejectedErr{}))
+	})
+
+	t.Run("with unknown remote error", func(t *testing.T) {
+		ctx := context.Background()
+		td := newTestData(ctx, t)
+		requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		peers := testutil.GeneratePeers(1)
+
+		returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+		rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+		td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+			gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestFailedUnknown, nil, graphsync.ExtensionData{
+				Name: graphsync.ExtensionRemoteError,
+				Data: basicnode.NewString("not a remote error"),
+			}),
+		}, nil)
+
+		testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan)
+		errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+		require.Len(t, errs, 1)
+		var remoteErr graphsync.RemoteError
+		require.False(t, errors.As(errs[0], &remoteErr))
+		require.Equal(t, graphsync.RequestFailedUnknownErr{}, errs[0])
+	})
+}
+
 /*
 TODO: Delete? These tests no longer seem relevant, or at minimum need a rearchitect
 - the new architecture will simply never fire a graphsync request if all of the data is
@@ -302,6 +853,47 @@ func TestLocallyFulfilledFirstRequestSucceedsLater(t *testing.T) {
 }
 */
 
+func TestResponseHookPanicFailsOnlyItsRequest(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	returnedResponseChan1, returnedErrorChan1 := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	returnedResponseChan2, returnedErrorChan2 := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	requestRecords := readNNetworkRequests(requestCtx, t, td, 2)
+
+	panicID := requestRecords[0].gsr.ID()
+	td.responseHooks.Register(func(p peer.ID, response graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
+		if response.RequestID() == panicID {
+			panic("something went wrong")
+		}
+	})
+
+	md := metadataForBlocks(td.blockChain.AllBlocks(), graphsync.LinkActionPresent)
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(requestRecords[0].gsr.ID(), graphsync.RequestCompletedFull, md),
+		gsmsg.NewResponse(requestRecords[1].gsr.ID(), graphsync.RequestCompletedFull, md),
+	}, td.blockChain.AllBlocks())
+
+	cancelRequest := readNNetworkRequests(requestCtx, t, td, 1)[0]
+	require.Equal(t, graphsync.RequestTypeCancel, cancelRequest.gsr.Type())
+	require.Equal(t, panicID, cancelRequest.gsr.ID())
+	td.blockChain.VerifyWholeChain(requestCtx, returnedResponseChan2)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan2)
+
+	// the failed request may still load blocks the other request stored
+	// before it notices it was cancelled
+	testutil.CollectResponses(requestCtx, t, returnedResponseChan1)
+	errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan1)
+	require.NotEmpty(t, errs)
+	var panicErr panics.RecoveredPanicErr
+	require.True(t, errors.As(errs[0], &panicErr))
+	require.Equal(t, "something went wrong", panicErr.PanicObj)
+}
+
 func TestRequestReturnsMissingBlocks(t *testing.T) {
 	ctx := context.Background()
 	td := newTestData(ctx, t)
@@ -322,6 +914,159 @@ func TestRequestReturnsMissingBlocks(t *testing.T) {
 	testutil.VerifyEmptyResponse(ctx, t, returnedResponseChan)
 	errs := testutil.CollectErrors(ctx, t, returnedErrorChan)
 	require.NotEqual(t, len(errs), 0, "did not send errors")
+	var missingBlockErr graphsync.RemoteMissingBlockErr
+	require.True(t, errors.As(errs[0], &missingBlockErr))
+	require.Equal(t, td.blockChain.TipLink, missingBlockErr.Link)
+}
+
+func TestRequestReportsMissingBlockWithoutFailing(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+
+	md := append(metadataForBlocks(td.blockChain.Blocks(0, 3), graphsync.LinkActionPresent), metadataForBlocks(td.blockChain.Blocks(3, 4), graphsync.LinkActionMissing)...)
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedPartial, md),
+	}, td.blockChain.Blocks(0, 3))
+
+	// the traversal proceeds as far as the selector allows, and the missing
+	// block is reported ahead of the partial completion
+	td.blockChain.VerifyResponseRange(requestCtx, returnedResponseChan, 0, 3)
+	errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+	require.Len(t, errs, 2)
+	var missingBlockErr graphsync.RemoteMissingBlockErr
+	require.True(t, errors.As(errs[0], &missingBlockErr))
+	require.Equal(t, td.blockChain.LinkTipIndex(3), missingBlockErr.Link)
+	require.ErrorIs(t, errs[1], graphsync.RequestCompletedPartialErr{})
+}
+
+func TestRequestReportsPartialCompletionBeforeFinalStatus(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+
+	// the block the traversal ends on is missing, and the final status is
+	// sent separately
+	md := append(metadataForBlocks(td.blockChain.Blocks(0, 3), graphsync.LinkActionPresent), metadataForBlocks(td.blockChain.Blocks(3, 4), graphsync.LinkActionMissing)...)
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.PartialResponse, md),
+	}, td.blockChain.Blocks(0, 3))
+
+	td.blockChain.VerifyResponseRange(requestCtx, returnedResponseChan, 0, 3)
+	errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+	require.Len(t, errs, 2)
+	var missingBlockErr graphsync.RemoteMissingBlockErr
+	require.True(t, errors.As(errs[0], &missingBlockErr))
+	require.ErrorIs(t, errs[1], graphsync.RequestCompletedPartialErr{})
+
+	// the final status arrives after the request ended
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedPartial, nil),
+	}, nil)
+	require.Equal(t, uint64(1), td.requestManager.TombstoneStats().LateMessagesAbsorbed)
+}
+
+func TestStrictVerification(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("wrong bytes for a cid", func(t *testing.T) {
+		td := newTestDataWithConfig(ctx, t, testConfig{strictVerification: true})
+		requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		peers := testutil.GeneratePeers(1)
+
+		returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+		rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+
+		blks := td.blockChain.AllBlocks()
+		forged, err := blocks.NewBlockWithCid(testutil.RandomBytes(100), blks[1].Cid())
+		require.NoError(t, err)
+		sentBlks := append([]blocks.Block{blks[0], forged}, blks[2:]...)
+		md := metadataForBlocks(blks, graphsync.LinkActionPresent)
+		td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+			gsmsg.NewResponse(rr.gsr.ID(), graphsync.PartialResponse, md),
+		}, sentBlks)
+
+		cancelRequest := readNNetworkRequests(requestCtx, t, td, 1)[0]
+		require.Equal(t, graphsync.RequestTypeCancel, cancelRequest.gsr.Type())
+		require.Equal(t, rr.gsr.ID(), cancelRequest.gsr.ID())
+		testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan)
+		errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+		require.NotEmpty(t, errs)
+		var invalidBlockErr graphsync.ErrInvalidBlock
+		require.True(t, errors.As(errs[0], &invalidBlockErr))
+		require.Equal(t, cidlink.Link{Cid: blks[1].Cid()}, invalidBlockErr.Link)
+		require.Empty(t, td.localBlockStore)
+	})
+
+	t.Run("oversized block", func(t *testing.T) {
+		td := newTestDataWithConfig(ctx, t, testConfig{strictVerification: true, maxBlockSize: 50})
+		requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		peers := testutil.GeneratePeers(1)
+
+		returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+		rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+
+		blks := td.blockChain.AllBlocks()
+		md := metadataForBlocks(blks, graphsync.LinkActionPresent)
+		td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+			gsmsg.NewResponse(rr.gsr.ID(), graphsync.PartialResponse, md),
+		}, blks)
+
+		cancelRequest := readNNetworkRequests(requestCtx, t, td, 1)[0]
+		require.Equal(t, graphsync.RequestTypeCancel, cancelRequest.gsr.Type())
+		testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan)
+		errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+		require.NotEmpty(t, errs)
+		var invalidBlockErr graphsync.ErrInvalidBlock
+		require.True(t, errors.As(errs[0], &invalidBlockErr))
+		require.Equal(t, td.blockChain.TipLink, invalidBlockErr.Link)
+		require.Contains(t, invalidBlockErr.Reason, "exceeds maximum")
+		require.Empty(t, td.localBlockStore)
+	})
+
+	t.Run("unrequested blocks are discarded", func(t *testing.T) {
+		transferStats := transferstats.New()
+		td := newTestDataWithConfig(ctx, t, testConfig{strictVerification: true, transferStats: transferStats})
+		requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		peers := testutil.GeneratePeers(1)
+
+		returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+		rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+
+		blks := td.blockChain.AllBlocks()
+		spam := testutil.GenerateBlocksOfSize(10, 100)
+		md := metadataForBlocks(blks, graphsync.LinkActionPresent)
+		td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+			gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, md),
+		}, append(append([]blocks.Block{}, blks...), spam...))
+
+		td.blockChain.VerifyWholeChain(requestCtx, returnedResponseChan)
+		testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
+		for _, blk := range spam {
+			_, stored := td.localBlockStore[cidlink.Link{Cid: blk.Cid()}]
+			require.False(t, stored)
+		}
+		require.Len(t, td.localBlockStore, len(blks))
+		total := transferStats.Total()
+		require.Equal(t, uint64(len(spam)), total.BlocksWasted)
+		require.Equal(t, uint64(len(spam)*100), total.BytesWasted)
+		require.Equal(t, total, transferStats.Peer(peers[0]))
+	})
 }
 
 func TestDisconnectNotification(t *testing.T) {
@@ -360,18 +1105,59 @@ func TestDisconnectNotification(t *testing.T) {
 	}
 }
 
-func TestEncodingExtensions(t *testing.T) {
+func TestDisconnectFailsRunningRequests(t *testing.T) {
 	ctx := context.Background()
 	td := newTestData(ctx, t)
-
 	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
 	defer cancel()
-	peers := testutil.GeneratePeers(1)
+	peers := testutil.GeneratePeers(2)
 
-	expectedError := make(chan error, 2)
-	receivedExtensionData := make(chan datamodel.Node, 2)
-	expectedUpdateChan := make(chan []graphsync.ExtensionData, 2)
-	hook := func(p peer.ID, responseData graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
+	returnedResponseChan1, returnedErrorChan1 := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	requestRecord1 := readNNetworkRequests(requestCtx, t, td, 1)[0]
+	returnedResponseChan2, returnedErrorChan2 := td.requestManager.NewRequest(requestCtx, peers[1], td.blockChain.TipLink, td.blockChain.Selector())
+	requestRecord2 := readNNetworkRequests(requestCtx, t, td, 1)[0]
+
+	firstBlocks := td.blockChain.Blocks(0, 3)
+	firstMetadata := metadataForBlocks(firstBlocks, graphsync.LinkActionPresent)
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(requestRecord1.gsr.ID(), graphsync.PartialResponse, firstMetadata),
+	}, firstBlocks)
+	td.requestManager.ProcessResponses(peers[1], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(requestRecord2.gsr.ID(), graphsync.PartialResponse, firstMetadata),
+	}, firstBlocks)
+	td.blockChain.VerifyResponseRange(requestCtx, returnedResponseChan1, 0, 3)
+	td.blockChain.VerifyResponseRange(requestCtx, returnedResponseChan2, 0, 3)
+
+	// the request to the disconnected peer fails rather than waiting on
+	// responses that will never come
+	td.requestManager.Disconnected(peers[0])
+	testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan1)
+	errors := testutil.CollectErrors(requestCtx, t, returnedErrorChan1)
+	require.Len(t, errors, 1)
+	require.Equal(t, graphsync.ErrPeerDisconnected{Peer: peers[0]}, errors[0])
+
+	// the request to the other peer is unaffected
+	moreBlocks := td.blockChain.RemainderBlocks(3)
+	moreMetadata := metadataForBlocks(moreBlocks, graphsync.LinkActionPresent)
+	td.requestManager.ProcessResponses(peers[1], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(requestRecord2.gsr.ID(), graphsync.RequestCompletedFull, moreMetadata),
+	}, moreBlocks)
+	td.blockChain.VerifyRemainder(requestCtx, returnedResponseChan2, 3)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan2)
+}
+
+func TestEncodingExtensions(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	expectedError := make(chan error, 2)
+	receivedExtensionData := make(chan datamodel.Node, 2)
+	expectedUpdateChan := make(chan []graphsync.ExtensionData, 2)
+	hook := func(p peer.ID, responseData graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
 		data, has := responseData.Extension(td.extensionName1)
 		require.True(t, has, "did not receive extension data in response")
 		receivedExtensionData <- data
@@ -470,6 +1256,40 @@ func TestEncodingExtensions(t *testing.T) {
 	})
 }
 
+func TestDeadlineExtension(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+	peers := testutil.GeneratePeers(1)
+
+	// a request with a deadline tells the responder how long is left
+	requestCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+	data, found := rr.gsr.Extension(graphsync.ExtensionDeadline)
+	require.True(t, found)
+	timeLeft, err := deadline.DecodeDeadline(data)
+	require.NoError(t, err)
+	require.LessOrEqual(t, timeLeft, 10*time.Second)
+	require.Greater(t, timeLeft, 9*time.Second)
+
+	// a deadline set by the caller is sent as is
+	callerDeadline := graphsync.ExtensionData{Name: graphsync.ExtensionDeadline, Data: deadline.EncodeDeadline(time.Second)}
+	td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector(), callerDeadline)
+	rr = readNNetworkRequests(requestCtx, t, td, 1)[0]
+	data, found = rr.gsr.Extension(graphsync.ExtensionDeadline)
+	require.True(t, found)
+	require.Equal(t, callerDeadline.Data, data)
+
+	// a request without a deadline does not send one
+	noDeadlineCtx, cancelNoDeadline := context.WithCancel(ctx)
+	defer cancelNoDeadline()
+	td.requestManager.NewRequest(noDeadlineCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr = readNNetworkRequests(requestCtx, t, td, 1)[0]
+	_, found = rr.gsr.Extension(graphsync.ExtensionDeadline)
+	require.False(t, found)
+}
+
 func TestBlockHooks(t *testing.T) {
 	ctx := context.Background()
 	td := newTestData(ctx, t)
@@ -646,11 +1466,13 @@ func TestOutgoingRequestHooks(t *testing.T) {
 			ha.UseLinkTargetNodePrototypeChooser(td.blockChain.Chooser)
 			ha.UsePersistenceOption("chainstore")
 		}
+		// replaces the extension passed to the request
+		ha.AddExtensionData(graphsync.ExtensionData{Name: td.extensionName2, Data: basicnode.NewString("from hook")})
 	}
 	td.requestHooks.Register(hook)
 
 	returnedResponseChan1, returnedErrorChan1 := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector(), td.extension1)
-	returnedResponseChan2, returnedErrorChan2 := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	returnedResponseChan2, returnedErrorChan2 := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector(), td.extension2)
 
 	requestRecords := readNNetworkRequests(requestCtx, t, td, 2)
 
@@ -659,6 +1481,11 @@ func TestOutgoingRequestHooks(t *testing.T) {
 	key, err := dedupkey.DecodeDedupKey(dedupData)
 	require.NoError(t, err)
 	require.Equal(t, "chainstore", key)
+	for _, rr := range requestRecords {
+		hookData, has := rr.gsr.Extension(td.extensionName2)
+		require.True(t, has)
+		require.Equal(t, basicnode.NewString("from hook"), hookData)
+	}
 
 	md := metadataForBlocks(td.blockChain.AllBlocks(), graphsync.LinkActionPresent)
 	responses := []gsmsg.GraphSyncResponse{
@@ -673,6 +1500,72 @@ func TestOutgoingRequestHooks(t *testing.T) {
 	testutil.VerifyEmptyErrors(ctx, t, returnedErrorChan2)
 }
 
+func TestNodePrototypeChooserPrecedence(t *testing.T) {
+	testCases := map[string]struct {
+		hookChooser    bool
+		requestChooser bool
+		expected       string
+	}{
+		"default chooser": {
+			expected: "default",
+		},
+		"hook chooser overrides default": {
+			hookChooser: true,
+			expected:    "hook",
+		},
+		"request chooser overrides hook": {
+			hookChooser:    true,
+			requestChooser: true,
+			expected:       "request",
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ctx := context.Background()
+			var usedLk sync.Mutex
+			used := make(map[string]int)
+			chooser := func(name string) traversal.LinkTargetNodePrototypeChooser {
+				return func(datamodel.Link, ipld.LinkContext) (datamodel.NodePrototype, error) {
+					usedLk.Lock()
+					used[name]++
+					usedLk.Unlock()
+					return basicnode.Prototype.Any, nil
+				}
+			}
+			td := newTestDataWithConfig(ctx, t, testConfig{defaultChooser: chooser("default")})
+
+			requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+			defer cancel()
+			peers := testutil.GeneratePeers(1)
+
+			if data.hookChooser {
+				td.requestHooks.Register(func(p peer.ID, r graphsync.RequestData, ha graphsync.OutgoingRequestHookActions) {
+					ha.UseLinkTargetNodePrototypeChooser(chooser("hook"))
+				})
+			}
+			if data.requestChooser {
+				requestCtx = graphsync.WithLinkTargetNodePrototypeChooser(requestCtx, chooser("request"))
+			}
+
+			returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+			requestRecords := readNNetworkRequests(requestCtx, t, td, 1)
+
+			md := metadataForBlocks(td.blockChain.AllBlocks(), graphsync.LinkActionPresent)
+			responses := []gsmsg.GraphSyncResponse{
+				gsmsg.NewResponse(requestRecords[0].gsr.ID(), graphsync.RequestCompletedFull, md),
+			}
+			td.requestManager.ProcessResponses(peers[0], responses, td.blockChain.AllBlocks())
+
+			td.blockChain.VerifyWholeChain(requestCtx, returnedResponseChan)
+			testutil.VerifyEmptyErrors(ctx, t, returnedErrorChan)
+			usedLk.Lock()
+			defer usedLk.Unlock()
+			require.Len(t, used, 1)
+			require.NotZero(t, used[data.expected])
+		})
+	}
+}
+
 type outgoingRequestProcessingEvent struct {
 	p                      peer.ID
 	request                graphsync.RequestData
@@ -718,9 +1611,102 @@ func TestOutgoingRequestListeners(t *testing.T) {
 	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan1)
 }
 
+func TestCompletedResponseHooks(t *testing.T) {
+	type completedEvent struct {
+		p               peer.ID
+		request         graphsync.RequestData
+		status          graphsync.ResponseStatusCode
+		extensions      []graphsync.ExtensionData
+		responsesClosed bool
+	}
+	testCases := map[string]struct {
+		expectedStatus graphsync.ResponseStatusCode
+		// finish ends the request once it has been sent
+		finish func(t *testing.T, td *testData, p peer.ID, requestID graphsync.RequestID, cancelRequest func())
+		// hasExtension is true if the final response carries td.extension1
+		hasExtension bool
+	}{
+		"completed full": {
+			expectedStatus: graphsync.RequestCompletedFull,
+			finish: func(t *testing.T, td *testData, p peer.ID, requestID graphsync.RequestID, cancelRequest func()) {
+				md := metadataForBlocks(td.blockChain.AllBlocks(), graphsync.LinkActionPresent)
+				td.requestManager.ProcessResponses(p, []gsmsg.GraphSyncResponse{
+					gsmsg.NewResponse(requestID, graphsync.RequestCompletedFull, md, td.extension1),
+				}, td.blockChain.AllBlocks())
+			},
+			hasExtension: true,
+		},
+		"failed remotely": {
+			expectedStatus: graphsync.RequestFailedContentNotFound,
+			finish: func(t *testing.T, td *testData, p peer.ID, requestID graphsync.RequestID, cancelRequest func()) {
+				td.requestManager.ProcessResponses(p, []gsmsg.GraphSyncResponse{
+					gsmsg.NewResponse(requestID, graphsync.RequestFailedContentNotFound, nil, td.extension1),
+				}, nil)
+			},
+			hasExtension: true,
+		},
+		"cancelled locally": {
+			expectedStatus: graphsync.RequestCancelled,
+			finish: func(t *testing.T, td *testData, p peer.ID, requestID graphsync.RequestID, cancelRequest func()) {
+				require.NoError(t, td.requestManager.CancelRequest(context.Background(), requestID))
+			},
+		},
+		"context expired": {
+			expectedStatus: graphsync.RequestCancelled,
+			finish: func(t *testing.T, td *testData, p peer.ID, requestID graphsync.RequestID, cancelRequest func()) {
+				cancelRequest()
+			},
+		},
+	}
+	for testCase, data := range testCases {
+		data := data
+		t.Run(testCase, func(t *testing.T) {
+			ctx := context.Background()
+			td := newTestData(ctx, t)
+
+			testCtx, cancel := context.WithTimeout(ctx, time.Second)
+			defer cancel()
+			requestCtx, cancelRequest := context.WithCancel(testCtx)
+			defer cancelRequest()
+			p := testutil.GeneratePeers(1)[0]
+
+			returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, p, td.blockChain.TipLink, td.blockChain.Selector())
+			completed := make(chan completedEvent, 2)
+			td.completedResponseHooks.Register(func(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode, extensions []graphsync.ExtensionData) {
+				var responsesClosed bool
+				select {
+				case _, ok := <-returnedResponseChan:
+					responsesClosed = !ok
+				default:
+				}
+				completed <- completedEvent{p, request, status, extensions, responsesClosed}
+			})
+			rr := readNNetworkRequests(testCtx, t, td, 1)[0]
+
+			data.finish(t, td, p, rr.gsr.ID(), cancelRequest)
+			_ = testutil.CollectResponses(testCtx, t, returnedResponseChan)
+			_ = testutil.CollectErrors(testCtx, t, returnedErrorChan)
+
+			var event completedEvent
+			testutil.AssertReceive(testCtx, t, completed, &event, "should run completed response hook")
+			require.Equal(t, p, event.p)
+			require.Equal(t, rr.gsr.ID(), event.request.ID())
+			require.Equal(t, data.expectedStatus, event.status)
+			require.True(t, event.responsesClosed, "should close the response channel before running hooks")
+			if data.hasExtension {
+				require.Equal(t, []graphsync.ExtensionData{td.extension1}, event.extensions)
+			} else {
+				require.Empty(t, event.extensions)
+			}
+			testutil.AssertChannelEmpty(t, completed, "should run completed response hook only once")
+		})
+	}
+}
+
 func TestPauseResume(t *testing.T) {
 	ctx := context.Background()
-	td := newTestData(ctx, t)
+	// the peer may acknowledge cancels until it reports otherwise
+	td := newTestDataWithConfig(ctx, t, testConfig{supportedExtensions: graphsync.KnownExtensions()})
 
 	requestCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -797,6 +1783,12 @@ func TestPauseResume(t *testing.T) {
 		require.Equal(t, td.extensionData2, ext2Data)
 	*/
 
+	// the responder acknowledging the cancel sent on pause after the request
+	// resumed does not end the request
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCancelled, nil, cancelAck),
+	}, nil)
+
 	// process responses
 	td.requestManager.ProcessResponses(peers[0], responses, td.blockChain.RemainderBlocks(pauseAt))
 	// verify the correct results are returned, picking up after where there request was paused
@@ -804,6 +1796,52 @@ func TestPauseResume(t *testing.T) {
 	testutil.VerifyEmptyErrors(ctx, t, returnedErrorChan)
 }
 
+func TestPauseResumeOlderResponder(t *testing.T) {
+	ctx := context.Background()
+	td := newTestDataWithConfig(ctx, t, testConfig{supportedExtensions: graphsync.KnownExtensions()})
+
+	requestCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	blocksReceived := 0
+	holdForPause := make(chan struct{})
+	pauseAt := 3
+	td.blockHooks.Register(func(p peer.ID, responseData graphsync.ResponseData, blockData graphsync.BlockData, hookActions graphsync.IncomingBlockHookActions) {
+		blocksReceived++
+		if blocksReceived == pauseAt {
+			hookActions.PauseRequest()
+			close(holdForPause)
+		}
+	})
+
+	returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+
+	// the responder never reports the extensions it supports, so it may be
+	// one that does not acknowledge cancels
+	md := metadataForBlocks(td.blockChain.AllBlocks(), graphsync.LinkActionPresent)
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.PartialResponse, md),
+	}, td.blockChain.AllBlocks())
+	td.blockChain.VerifyResponseRange(ctx, returnedResponseChan, 0, pauseAt)
+	<-holdForPause
+	pauseCancel := readNNetworkRequests(requestCtx, t, td, 1)[0]
+	require.Equal(t, graphsync.RequestTypeCancel, pauseCancel.gsr.Type())
+
+	err := td.requestManager.UnpauseRequest(ctx, rr.gsr.ID())
+	require.NoError(t, err)
+
+	// a cancel that is not an acknowledgement ends the request, even though
+	// no acknowledgement arrived for the cancel sent on pause
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCancelled, nil),
+	}, nil)
+	var receivedErr error
+	testutil.AssertReceive(ctx, t, returnedErrorChan, &receivedErr, "should receive an error")
+	require.EqualError(t, receivedErr, graphsync.RequestCancelledErr{}.Error())
+}
+
 func TestPauseResumeExternal(t *testing.T) {
 	ctx := context.Background()
 	td := newTestData(ctx, t)
@@ -851,8 +1889,12 @@ func TestPauseResumeExternal(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 	testutil.AssertChannelEmpty(t, returnedResponseChan, "no response should be sent request is paused")
 
+	// pausing again does nothing
+	err := td.requestManager.PauseRequest(ctx, rr.gsr.ID())
+	require.NoError(t, err)
+
 	// unpause
-	err := td.requestManager.UnpauseRequest(ctx, rr.gsr.ID(), td.extension1, td.extension2)
+	err = td.requestManager.UnpauseRequest(ctx, rr.gsr.ID(), td.extension1, td.extension2)
 	require.NoError(t, err)
 
 	// verify the correct new request with Do-no-send-cids & other extensions
@@ -880,6 +1922,382 @@ func TestPauseResumeExternal(t *testing.T) {
 	testutil.VerifyEmptyErrors(ctx, t, returnedErrorChan)
 }
 
+func TestUnpauseSkipsPerPeerLimit(t *testing.T) {
+	ctx := context.Background()
+	td := newTestDataWithConfig(ctx, t, testConfig{scheduler: NewPriorityScheduler(1)})
+
+	requestCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	blocksReceived := 0
+	holdForPause := make(chan struct{})
+	pauseAt := 3
+	hook := func(p peer.ID, responseData graphsync.ResponseData, blockData graphsync.BlockData, hookActions graphsync.IncomingBlockHookActions) {
+		blocksReceived++
+		if blocksReceived == pauseAt {
+			err := td.requestManager.PauseRequest(ctx, responseData.RequestID())
+			require.NoError(t, err)
+			close(holdForPause)
+		}
+	}
+	td.blockHooks.Register(hook)
+
+	returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+	md := metadataForBlocks(td.blockChain.AllBlocks(), graphsync.LinkActionPresent)
+	responses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, md),
+	}
+	td.requestManager.ProcessResponses(peers[0], responses, td.blockChain.AllBlocks())
+	td.blockChain.VerifyResponseRange(ctx, returnedResponseChan, 0, pauseAt)
+	<-holdForPause
+	pauseCancel := readNNetworkRequests(requestCtx, t, td, 1)[0]
+	require.Equal(t, pauseCancel.gsr.Type(), graphsync.RequestTypeCancel)
+
+	// while paused, the request gives up its slot to a new request, and a
+	// second new request waits
+	_, _ = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	_ = readNNetworkRequests(requestCtx, t, td, 1)[0]
+	_, _ = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	require.Eventually(t, func() bool { return td.taskqueue.Stats().Pending == 1 }, time.Second, 10*time.Millisecond)
+
+	// the unpaused request goes ahead of the waiting request, without
+	// waiting for the slot to free up
+	require.NoError(t, td.requestManager.UnpauseRequest(ctx, rr.gsr.ID()))
+	td.requestManager.ProcessResponses(peers[0], responses, td.blockChain.RemainderBlocks(pauseAt))
+	td.blockChain.VerifyRemainder(ctx, returnedResponseChan, pauseAt)
+	testutil.VerifyEmptyErrors(ctx, t, returnedErrorChan)
+	testutil.AssertChannelEmpty(t, td.requestRecordChan, "waiting request should not be sent")
+}
+
+func TestCancelWhilePausing(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	blocksReceived := 0
+	pauseAt := 3
+
+	// setup hook to pause at 3rd block, and cancel the request before the pause takes effect
+	hook := func(p peer.ID, responseData graphsync.ResponseData, blockData graphsync.BlockData, hookActions graphsync.IncomingBlockHookActions) {
+		blocksReceived++
+		if blocksReceived == pauseAt {
+			hookActions.PauseRequest()
+			cancel()
+			// wait for the request manager to process the cancel
+			cancelRequest := readNNetworkRequests(ctx, t, td, 1)[0]
+			require.Equal(t, graphsync.RequestTypeCancel, cancelRequest.gsr.Type())
+		}
+	}
+	td.blockHooks.Register(hook)
+
+	// Start request
+	returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+
+	rr := readNNetworkRequests(ctx, t, td, 1)[0]
+
+	// Start processing responses
+	md := metadataForBlocks(td.blockChain.AllBlocks(), graphsync.LinkActionPresent)
+	responses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, md),
+	}
+	td.requestManager.ProcessResponses(peers[0], responses, td.blockChain.AllBlocks())
+
+	// the request ends rather than waiting to be unpaused
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, time.Second)
+	defer timeoutCancel()
+	testutil.CollectResponses(timeoutCtx, t, returnedResponseChan)
+	errs := testutil.CollectErrors(timeoutCtx, t, returnedErrorChan)
+	require.Len(t, errs, 1)
+	require.IsType(t, graphsync.RequestClientCancelledErr{}, errs[0])
+	require.Empty(t, td.requestManager.PeerState(peers[0]).RequestStates)
+}
+
+func TestTapMessages(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(2)
+
+	returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+	requestID := rr.gsr.ID()
+
+	messages, detach := td.requestManager.TapMessages(requestID)
+	detachedMessages, detachEarly := td.requestManager.TapMessages(requestID)
+	detachEarly()
+	detachEarly()
+
+	toMessage := func(response gsmsg.GraphSyncResponse, blks []blocks.Block) gsmsg.GraphSyncMessage {
+		blkMap := make(map[cid.Cid]blocks.Block, len(blks))
+		for _, blk := range blks {
+			blkMap[blk.Cid()] = blk
+		}
+		return gsmsg.NewMessage(nil, map[graphsync.RequestID]gsmsg.GraphSyncResponse{requestID: response}, blkMap)
+	}
+	firstBlocks := td.blockChain.Blocks(0, 3)
+	firstMessage := toMessage(gsmsg.NewResponse(requestID, graphsync.PartialResponse, metadataForBlocks(firstBlocks, graphsync.LinkActionPresent)), firstBlocks)
+	remainderBlocks := td.blockChain.RemainderBlocks(3)
+	secondMessage := toMessage(gsmsg.NewResponse(requestID, graphsync.RequestCompletedFull, metadataForBlocks(remainderBlocks, graphsync.LinkActionPresent)), remainderBlocks)
+
+	// messages for the request from another peer are not tapped
+	td.requestManager.ProcessMessage(peers[1], firstMessage)
+	td.requestManager.ProcessMessage(peers[0], firstMessage)
+	td.requestManager.ProcessMessage(peers[0], secondMessage)
+
+	td.blockChain.VerifyWholeChain(requestCtx, returnedResponseChan)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
+
+	var message gsmsg.GraphSyncMessage
+	testutil.AssertReceive(requestCtx, t, messages, &message, "should receive first message")
+	require.Equal(t, firstMessage, message)
+	testutil.AssertReceive(requestCtx, t, messages, &message, "should receive second message")
+	require.Equal(t, secondMessage, message)
+
+	// the tap closes once the request completes
+	_, open := <-messages
+	require.False(t, open)
+	detach()
+
+	// a detached tap receives nothing
+	_, open = <-detachedMessages
+	require.False(t, open)
+
+	// tapping an unknown request gives a closed channel
+	unknownMessages, detachUnknown := td.requestManager.TapMessages(graphsync.NewRequestID())
+	defer detachUnknown()
+	_, open = <-unknownMessages
+	require.False(t, open)
+}
+
+func TestRequestEvents(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	// occupy every request worker so the request under test waits in the queue
+	// until we've subscribed
+	for i := 0; i < 6; i++ {
+		_, _ = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	}
+	blockingRequests := readNNetworkRequests(requestCtx, t, td, 6)
+
+	pauseAt := 3
+	blocksReceived := 0
+	var requestID graphsync.RequestID
+	td.blockHooks.Register(func(p peer.ID, responseData graphsync.ResponseData, blockData graphsync.BlockData, hookActions graphsync.IncomingBlockHookActions) {
+		if responseData.RequestID() != requestID {
+			return
+		}
+		blocksReceived++
+		if blocksReceived == pauseAt {
+			hookActions.PauseRequest()
+		}
+	})
+
+	returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	requestID = td.requestIds[6]
+	events, unsubscribe := td.requestManager.SubscribeToRequestEvents(requestID)
+
+	nextEvent := func(expected graphsync.RequestEventName) graphsync.RequestEvent {
+		var event graphsync.RequestEvent
+		testutil.AssertReceive(requestCtx, t, events, &event, fmt.Sprintf("should receive %s event", expected))
+		require.Equal(t, expected, event.Name)
+		require.Equal(t, requestID, event.RequestID)
+		require.False(t, event.Timestamp.IsZero())
+		require.NoError(t, event.Err)
+		if !expected.IsTerminal() {
+			require.Zero(t, event.Duration)
+			require.Zero(t, event.VerificationTime)
+		}
+		return event
+	}
+
+	// free up a worker, without storing any blocks locally
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(blockingRequests[0].gsr.ID(), graphsync.RequestFailedUnknown, nil),
+	}, nil)
+	nextEvent(graphsync.RequestEventStarted)
+
+	rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+	require.Equal(t, requestID, rr.gsr.ID())
+	md := metadataForBlocks(td.blockChain.AllBlocks(), graphsync.LinkActionPresent)
+	responses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(requestID, graphsync.RequestCompletedFull, md),
+	}
+	td.requestManager.ProcessResponses(peers[0], responses, td.blockChain.AllBlocks())
+	td.blockChain.VerifyResponseRange(requestCtx, returnedResponseChan, 0, pauseAt)
+	nextEvent(graphsync.RequestEventPaused)
+	// read the outgoing cancel request
+	pauseCancel := readNNetworkRequests(requestCtx, t, td, 1)[0]
+	require.Equal(t, graphsync.RequestTypeCancel, pauseCancel.gsr.Type())
+
+	require.NoError(t, td.requestManager.UnpauseRequest(requestCtx, requestID))
+	nextEvent(graphsync.RequestEventResumed)
+
+	td.requestManager.ProcessResponses(peers[0], responses, td.blockChain.RemainderBlocks(pauseAt))
+	td.blockChain.VerifyRemainder(requestCtx, returnedResponseChan, pauseAt)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
+	completed := nextEvent(graphsync.RequestEventCompleted)
+	// every block was verified and stored, which takes some, but not all, of
+	// the time the request was in progress
+	require.Greater(t, completed.VerificationTime, time.Duration(0))
+	require.Less(t, completed.VerificationTime, completed.Duration)
+	require.Equal(t, completed.VerificationTime, td.requestManager.VerificationTime())
+
+	// the channel closes after the terminal event, and unsubscribing is idempotent
+	_, open := <-events
+	require.False(t, open)
+	unsubscribe()
+	unsubscribe()
+
+	// late subscribers get the terminal event straight away
+	events, unsubscribe = td.requestManager.SubscribeToRequestEvents(requestID)
+	defer unsubscribe()
+	require.Equal(t, completed, nextEvent(graphsync.RequestEventCompleted))
+	_, open = <-events
+	require.False(t, open)
+
+	// unknown requests have nothing to report
+	events, _ = td.requestManager.SubscribeToRequestEvents(graphsync.NewRequestID())
+	_, open = <-events
+	require.False(t, open)
+}
+
+func TestRetryBusyRequests(t *testing.T) {
+	ctx := context.Background()
+	td := newTestDataWithConfig(ctx, t, testConfig{retryOptions: graphsync.RetryOptions{
+		MaxAttempts:  3,
+		InitialDelay: 10 * time.Millisecond,
+		Multiplier:   2,
+	}})
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	var responseStatuses []graphsync.ResponseStatusCode
+	td.responseHooks.Register(func(p peer.ID, response graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
+		responseStatuses = append(responseStatuses, response.Status())
+	})
+
+	returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+
+	// the request is sent again each time the responder is busy
+	for i := 0; i < 2; i++ {
+		td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+			gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestFailedBusy, nil),
+		}, nil)
+		retried := readNNetworkRequests(requestCtx, t, td, 1)[0]
+		require.Equal(t, rr.gsr.ID(), retried.gsr.ID())
+		require.Equal(t, graphsync.RequestTypeNew, retried.gsr.Type())
+		require.Equal(t, rr.gsr.Root(), retried.gsr.Root())
+	}
+
+	md := metadataForBlocks(td.blockChain.AllBlocks(), graphsync.LinkActionPresent)
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, md),
+	}, td.blockChain.AllBlocks())
+	td.blockChain.VerifyWholeChain(requestCtx, returnedResponseChan)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
+
+	// response hooks see every attempt
+	require.Equal(t, []graphsync.ResponseStatusCode{graphsync.RequestFailedBusy, graphsync.RequestFailedBusy, graphsync.RequestCompletedFull}, responseStatuses)
+}
+
+func TestRetryLimits(t *testing.T) {
+	testCases := map[string]struct {
+		status        graphsync.ResponseStatusCode
+		expectedErr   error
+		expectedSends int
+	}{
+		"busy, retries exhausted": {
+			status:        graphsync.RequestFailedBusy,
+			expectedErr:   graphsync.RequestFailedBusyErr{},
+			expectedSends: 2,
+		},
+		"content not found is not retried": {
+			status:        graphsync.RequestFailedContentNotFound,
+			expectedErr:   graphsync.RequestFailedContentNotFoundErr{},
+			expectedSends: 1,
+		},
+		"unknown failure is not retried": {
+			status:        graphsync.RequestFailedUnknown,
+			expectedErr:   graphsync.RequestFailedUnknownErr{},
+			expectedSends: 1,
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ctx := context.Background()
+			td := newTestDataWithConfig(ctx, t, testConfig{retryOptions: graphsync.RetryOptions{
+				MaxAttempts:  2,
+				InitialDelay: 10 * time.Millisecond,
+				Jitter:       true,
+			}})
+
+			requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+			defer cancel()
+			peers := testutil.GeneratePeers(1)
+
+			returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+			for i := 0; i < data.expectedSends; i++ {
+				rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+				require.Equal(t, graphsync.RequestTypeNew, rr.gsr.Type())
+				td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+					gsmsg.NewResponse(rr.gsr.ID(), data.status, nil),
+				}, nil)
+			}
+
+			testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan)
+			errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+			require.Len(t, errs, 1)
+			require.Equal(t, data.expectedErr, errs[0])
+		})
+	}
+}
+
+func TestRetryHookErrors(t *testing.T) {
+	ctx := context.Background()
+	td := newTestDataWithConfig(ctx, t, testConfig{retryOptions: graphsync.RetryOptions{
+		MaxAttempts:  3,
+		InitialDelay: 10 * time.Millisecond,
+	}})
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	hookErr := errors.New("something went wrong")
+	td.responseHooks.Register(func(p peer.ID, response graphsync.ResponseData, hookActions graphsync.IncomingResponseHookActions) {
+		hookActions.TerminateWithError(hookErr)
+	})
+
+	returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestFailedBusy, nil),
+	}, nil)
+
+	// the hook error cancels the request rather than retrying it
+	cancelRequest := readNNetworkRequests(requestCtx, t, td, 1)[0]
+	require.Equal(t, graphsync.RequestTypeCancel, cancelRequest.gsr.Type())
+	testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan)
+	errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+	require.Len(t, errs, 1)
+	require.Equal(t, hookErr, errs[0])
+}
+
 func TestUpdateRequest(t *testing.T) {
 	ctx := context.Background()
 	td := newTestData(ctx, t)
@@ -986,6 +2404,200 @@ func TestStats(t *testing.T) {
 	require.Contains(t, peerState.Active, requestRecords[0].gsr.ID())
 	require.Contains(t, peerState.Active, requestRecords[1].gsr.ID())
 	require.Len(t, peerState.Pending, 0)
+
+	inProgress := td.requestManager.InProgressRequests()
+	require.Len(t, inProgress, 3)
+	for _, rr := range requestRecords {
+		var info graphsync.InProgressRequestInfo
+		for _, candidate := range inProgress {
+			if candidate.RequestID == rr.gsr.ID() {
+				info = candidate
+			}
+		}
+		require.False(t, info.StartTime.IsZero())
+		require.Equal(t, graphsync.InProgressRequestInfo{
+			RequestID: rr.gsr.ID(),
+			Peer:      rr.p,
+			Root:      rr.gsr.Root(),
+			Selector:  rr.gsr.SelectorString(),
+			State:     graphsync.Running,
+			StartTime: info.StartTime,
+		}, info)
+	}
+}
+
+func TestDiagnosticsWithQueuedRequests(t *testing.T) {
+	ctx := context.Background()
+	td := newTestDataWithConfig(ctx, t, testConfig{scheduler: NewPriorityScheduler(1)})
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	for i := 0; i < 3; i++ {
+		_, _ = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	}
+	requestRecords := readNNetworkRequests(requestCtx, t, td, 1)
+
+	// the requests over the limit wait for the scheduler, and are reported as
+	// pending rather than missing from the queue
+	peerState := td.requestManager.PeerState(peers[0])
+	require.Len(t, peerState.RequestStates, 3)
+	require.Equal(t, []graphsync.RequestID{requestRecords[0].gsr.ID()}, peerState.Active)
+	require.Len(t, peerState.Pending, 2)
+	for _, id := range peerState.Pending {
+		require.Equal(t, graphsync.Queued, peerState.RequestStates[id])
+	}
+	require.Empty(t, peerState.Diagnostics())
+}
+
+func TestExportImportState(t *testing.T) {
+	ctx := context.Background()
+	managerCtx, managerCancel := context.WithCancel(ctx)
+	td := newTestData(managerCtx, t)
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	voucher := graphsync.ExtensionData{Name: "app/voucher", Data: basicnode.NewString("apples")}
+	returnedResponseChan, _ := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector(), voucher)
+	rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+
+	firstBlocks := td.blockChain.Blocks(0, 3)
+	firstResponses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.PartialResponse, metadataForBlocks(firstBlocks, graphsync.LinkActionPresent)),
+	}
+	td.requestManager.ProcessResponses(peers[0], firstResponses, firstBlocks)
+	td.blockChain.VerifyResponseRange(requestCtx, returnedResponseChan, 0, 3)
+
+	var checkpoints []graphsync.RequestCheckpoint
+	require.Eventually(t, func() bool {
+		var err error
+		checkpoints, err = td.requestManager.ExportState()
+		require.NoError(t, err)
+		return len(checkpoints) == 1 && checkpoints[0].Received.Len() == 3
+	}, time.Second, 10*time.Millisecond)
+	checkpoint := checkpoints[0]
+	require.Equal(t, peers[0], checkpoint.Peer)
+	require.Equal(t, td.blockChain.TipLink.(cidlink.Link).Cid, checkpoint.Root)
+	require.True(t, ipld.DeepEqual(td.blockChain.Selector(), checkpoint.Selector))
+	require.Equal(t, []graphsync.ExtensionData{voucher}, checkpoint.Extensions)
+	for _, blk := range firstBlocks {
+		require.True(t, checkpoint.Received.Has(blk.Cid()))
+	}
+
+	// the process restarts, keeping the blocks already stored
+	managerCancel()
+	_, err := td.requestManager.ExportState()
+	require.Error(t, err)
+	localBlockStore, blockChain := td.localBlockStore, td.blockChain
+	td = newTestData(ctx, t)
+	for k, v := range localBlockStore {
+		td.localBlockStore[k] = v
+	}
+
+	resumed := td.requestManager.ImportState(requestCtx, checkpoints)
+	require.Len(t, resumed, 1)
+	rr = readNNetworkRequests(requestCtx, t, td, 1)[0]
+	require.Equal(t, checkpoint.Root, rr.gsr.Root())
+	voucherData, has := rr.gsr.Extension(voucher.Name)
+	require.True(t, has)
+	require.Equal(t, voucher.Data, voucherData)
+	resumeData, has := rr.gsr.Extension(graphsync.ExtensionResume)
+	require.True(t, has)
+	received, err := cidset.DecodeCidSet(resumeData)
+	require.NoError(t, err)
+	require.ElementsMatch(t, checkpoint.Received.Keys(), received.Keys())
+
+	// the remote peer skips the blocks already received, which load locally
+	md := append(metadataForBlocks(firstBlocks, graphsync.LinkActionDuplicateNotSent), metadataForBlocks(blockChain.RemainderBlocks(3), graphsync.LinkActionPresent)...)
+	responses := []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, md),
+	}
+	td.requestManager.ProcessResponses(peers[0], responses, blockChain.RemainderBlocks(3))
+	blockChain.VerifyWholeChain(requestCtx, resumed[0].Responses)
+	testutil.VerifyEmptyErrors(requestCtx, t, resumed[0].Errors)
+}
+
+type fakeProgressStore struct {
+	lk     sync.Mutex
+	states map[graphsync.RequestID]graphsync.ProgressState
+}
+
+func (fps *fakeProgressStore) SaveProgress(requestID graphsync.RequestID, state graphsync.ProgressState) error {
+	fps.lk.Lock()
+	defer fps.lk.Unlock()
+	fps.states[requestID] = state
+	return nil
+}
+
+func (fps *fakeProgressStore) LoadProgress(requestID graphsync.RequestID) (graphsync.ProgressState, bool, error) {
+	fps.lk.Lock()
+	defer fps.lk.Unlock()
+	state, ok := fps.states[requestID]
+	return state, ok, nil
+}
+
+func (fps *fakeProgressStore) received(requestID graphsync.RequestID) int {
+	state, ok, _ := fps.LoadProgress(requestID)
+	if !ok {
+		return -1
+	}
+	return state.Received.Len()
+}
+
+func TestProgressStore(t *testing.T) {
+	testCases := map[string]struct {
+		interval time.Duration
+		// save ends the test once progress should have been saved
+		save func(t *testing.T, td *testData)
+	}{
+		"saves periodically": {
+			interval: 10 * time.Millisecond,
+			save:     func(t *testing.T, td *testData) {},
+		},
+		"saves on cancelling all requests": {
+			interval: time.Hour,
+			save: func(t *testing.T, td *testData) {
+				// wait for the traversal to record the last block loaded
+				require.Eventually(t, func() bool {
+					checkpoints, err := td.requestManager.ExportState()
+					require.NoError(t, err)
+					return checkpoints[0].Received.Len() == 3
+				}, time.Second, 10*time.Millisecond)
+				require.NoError(t, td.requestManager.CancelAllRequests(context.Background(), graphsync.ExchangeClosedErr{}))
+			},
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ctx := context.Background()
+			store := &fakeProgressStore{states: make(map[graphsync.RequestID]graphsync.ProgressState)}
+			td := newTestDataWithConfig(ctx, t, testConfig{progressStore: store, progressInterval: data.interval})
+			requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+			defer cancel()
+			peers := testutil.GeneratePeers(1)
+
+			returnedResponseChan, _ := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+			rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+
+			firstBlocks := td.blockChain.Blocks(0, 3)
+			firstResponses := []gsmsg.GraphSyncResponse{
+				gsmsg.NewResponse(rr.gsr.ID(), graphsync.PartialResponse, metadataForBlocks(firstBlocks, graphsync.LinkActionPresent)),
+			}
+			td.requestManager.ProcessResponses(peers[0], firstResponses, firstBlocks)
+			td.blockChain.VerifyResponseRange(requestCtx, returnedResponseChan, 0, 3)
+
+			data.save(t, td)
+			require.Eventually(t, func() bool {
+				return store.received(rr.gsr.ID()) == 3
+			}, time.Second, 10*time.Millisecond)
+			state, _, _ := store.LoadProgress(rr.gsr.ID())
+			for _, blk := range firstBlocks {
+				require.True(t, state.Received.Has(blk.Cid()))
+			}
+		})
+	}
 }
 
 func TestCaptureRequestIDFromContext(t *testing.T) {
@@ -1005,16 +2617,564 @@ func TestCaptureRequestIDFromContext(t *testing.T) {
 	require.Equal(t, expectedID, requestRecords[0].gsr.ID())
 }
 
+func TestRequestIDAllocator(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	// derive request ids from the root, so requests for the same root collide
+	var allocatedRoots []cid.Cid
+	td.requestManager.SetRequestIDAllocator(func(p peer.ID, root cid.Cid, selector ipld.Node) graphsync.RequestID {
+		require.Equal(t, peers[0], p)
+		allocatedRoots = append(allocatedRoots, root)
+		id := uuid.NewSHA1(uuid.NameSpaceOID, root.Bytes())
+		requestID, err := graphsync.ParseRequestID(id[:])
+		require.NoError(t, err)
+		return requestID
+	})
+	root := td.blockChain.TipLink.(cidlink.Link).Cid
+	id := uuid.NewSHA1(uuid.NameSpaceOID, root.Bytes())
+	expectedID, err := graphsync.ParseRequestID(id[:])
+	require.NoError(t, err)
+
+	returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	requestRecords := readNNetworkRequests(requestCtx, t, td, 1)
+	require.Equal(t, expectedID, requestRecords[0].gsr.ID())
+
+	// a request in progress has the id
+	_, errChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	errs := testutil.CollectErrors(requestCtx, t, errChan)
+	require.Equal(t, []error{graphsync.RequestIDInUseErr{RequestID: expectedID}}, errs)
+
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(expectedID, graphsync.RequestCompletedFull, metadataForBlocks(td.blockChain.AllBlocks(), graphsync.LinkActionPresent)),
+	}, td.blockChain.AllBlocks())
+	td.blockChain.VerifyWholeChain(requestCtx, returnedResponseChan)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
+
+	// once the request completes its id can be used again. Every block is
+	// now stored locally, so the new request completes without the network
+	returnedResponseChan, returnedErrorChan = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	td.blockChain.VerifyWholeChain(requestCtx, returnedResponseChan)
+	testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
+	require.Equal(t, []cid.Cid{root, root, root}, allocatedRoots)
+
+	// batches of requests route through the allocator too
+	blockChain2 := testutil.SetupBlockChain(ctx, t, td.persistence, 100, 5)
+	_, _ = td.requestManager.RequestMany(requestCtx, peers[0], []graphsync.RootSelector{
+		{Root: blockChain2.TipLink, Selector: blockChain2.Selector()},
+	})
+	requestRecords = readNNetworkRequests(requestCtx, t, td, 1)
+	root2 := blockChain2.TipLink.(cidlink.Link).Cid
+	id = uuid.NewSHA1(uuid.NameSpaceOID, root2.Bytes())
+	require.Equal(t, id[:], requestRecords[0].gsr.ID().Bytes())
+}
+
+func TestSelectorProposal(t *testing.T) {
+	testCases := map[string]struct {
+		accept bool
+	}{
+		"accepted":           {accept: true},
+		"declined (no hook)": {},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ctx := context.Background()
+			td := newTestData(ctx, t)
+
+			requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+			defer cancel()
+			peers := testutil.GeneratePeers(1)
+
+			proposal := graphsync.SelectorProposal{
+				Selector: selectorparse.CommonSelector_MatchPoint,
+				Reason:   "root only",
+			}
+			if data.accept {
+				td.selectorProposalHooks.Register(func(p peer.ID, requestData graphsync.RequestData, received graphsync.SelectorProposal, hookActions graphsync.SelectorProposalHookActions) {
+					if received.Reason == proposal.Reason {
+						hookActions.AcceptProposal()
+					}
+				})
+			}
+
+			returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+			rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+
+			td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+				gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestRejected, nil, graphsync.ExtensionData{
+					Name: graphsync.ExtensionSelectorProposal,
+					Data: selectorproposal.EncodeSelectorProposal(proposal),
+				}),
+			}, nil)
+
+			if !data.accept {
+				testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan)
+				errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+				require.Len(t, errs, 1)
+				var declinedErr graphsync.SelectorProposalDeclinedErr
+				require.True(t, errors.As(errs[0], &declinedErr))
+				require.Equal(t, proposal.Reason, declinedErr.Proposal.Reason)
+				testutil.AssertChannelEmpty(t, td.requestRecordChan, "should not re-issue a declined request")
+				return
+			}
+
+			// the request is re-issued under the same id with the proposed selector
+			reissued := readNNetworkRequests(requestCtx, t, td, 1)[0]
+			require.Equal(t, graphsync.RequestTypeNew, reissued.gsr.Type())
+			require.Equal(t, rr.gsr.ID(), reissued.gsr.ID())
+			require.True(t, ipld.DeepEqual(proposal.Selector, reissued.gsr.Selector()))
+			originalSelector, has := reissued.gsr.Extension(graphsync.ExtensionSelectorProposalAccepted)
+			require.True(t, has)
+			require.True(t, ipld.DeepEqual(td.blockChain.Selector(), originalSelector))
+
+			// responses are verified against the proposed selector
+			rootBlock := td.blockChain.Blocks(0, 1)
+			td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+				gsmsg.NewResponse(reissued.gsr.ID(), graphsync.RequestCompletedFull, metadataForBlocks(rootBlock, graphsync.LinkActionPresent)),
+			}, rootBlock)
+			responses := testutil.CollectResponses(requestCtx, t, returnedResponseChan)
+			require.Len(t, responses, 1)
+			require.Equal(t, "", responses[0].Path.String())
+			testutil.VerifyEmptyErrors(requestCtx, t, returnedErrorChan)
+		})
+	}
+}
+
+func TestSelectorProposalLimit(t *testing.T) {
+	testCases := map[string]struct {
+		maxSelectorProposals int
+		expectedReissues     int
+	}{
+		"default limit":    {expectedReissues: DefaultMaxSelectorProposals},
+		"configured limit": {maxSelectorProposals: 3, expectedReissues: 3},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ctx := context.Background()
+			td := newTestDataWithConfig(ctx, t, testConfig{maxSelectorProposals: data.maxSelectorProposals})
+
+			requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+			defer cancel()
+			peers := testutil.GeneratePeers(1)
+
+			proposal := graphsync.SelectorProposal{
+				Selector: selectorparse.CommonSelector_MatchPoint,
+				Reason:   "root only",
+			}
+			var accepted int32
+			td.selectorProposalHooks.Register(func(p peer.ID, requestData graphsync.RequestData, received graphsync.SelectorProposal, hookActions graphsync.SelectorProposalHookActions) {
+				atomic.AddInt32(&accepted, 1)
+				hookActions.AcceptProposal()
+			})
+			reject := func(requestID graphsync.RequestID) {
+				td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+					gsmsg.NewResponse(requestID, graphsync.RequestRejected, nil, graphsync.ExtensionData{
+						Name: graphsync.ExtensionSelectorProposal,
+						Data: selectorproposal.EncodeSelectorProposal(proposal),
+					}),
+				}, nil)
+			}
+
+			returnedResponseChan, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+			rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+
+			// the responder keeps proposing the same selector
+			for i := 0; i < data.expectedReissues; i++ {
+				reject(rr.gsr.ID())
+				reissued := readNNetworkRequests(requestCtx, t, td, 1)[0]
+				require.Equal(t, rr.gsr.ID(), reissued.gsr.ID())
+			}
+			reject(rr.gsr.ID())
+
+			testutil.VerifyEmptyResponse(requestCtx, t, returnedResponseChan)
+			errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+			require.Len(t, errs, 1)
+			var limitErr graphsync.SelectorProposalLimitErr
+			require.True(t, errors.As(errs[0], &limitErr))
+			require.Equal(t, proposal.Reason, limitErr.Proposal.Reason)
+			require.Equal(t, data.expectedReissues, limitErr.Reissued)
+			require.Equal(t, int32(data.expectedReissues), atomic.LoadInt32(&accepted))
+			testutil.AssertChannelEmpty(t, td.requestRecordChan, "should not re-issue the request again")
+		})
+	}
+}
+
+func TestRequestBatching(t *testing.T) {
+	ctx := context.Background()
+	window := 300 * time.Millisecond
+	batchClock := clock.NewMock()
+	sentRequests := make(chan gsmsg.GraphSyncRequest, 10)
+	td := newTestDataWithConfig(ctx, t, testConfig{requestBatchWindow: window, batchClock: batchClock, sentRequests: sentRequests})
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	burstSize := 5
+	for i := 0; i < burstSize-1; i++ {
+		_, _ = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	}
+	_, cancelledErrChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+
+	// wait for every request to reach the batch. The batch window has not
+	// ended, so none of them have gone out
+	for i := 0; i < burstSize; i++ {
+		var request gsmsg.GraphSyncRequest
+		testutil.AssertReceive(requestCtx, t, sentRequests, &request, "should send request")
+		require.Equal(t, graphsync.RequestTypeNew, request.Type())
+	}
+	testutil.AssertChannelEmpty(t, td.requestRecordChan, "should not send requests before the batch window ends")
+
+	// cancel one request while it's still waiting in the batch
+	cancelledID := td.requestIds[burstSize-1]
+	require.NoError(t, td.requestManager.CancelRequest(requestCtx, cancelledID))
+	errs := testutil.CollectErrors(requestCtx, t, cancelledErrChan)
+	require.Len(t, errs, 1)
+	require.IsType(t, graphsync.RequestClientCancelledErr{}, errs[0])
+
+	// the batch is sent from the timer, which waits for its requests to be read
+	go batchClock.Add(window)
+	requestRecords := readNNetworkRequests(requestCtx, t, td, burstSize-1)
+	require.Len(t, requestRecords, burstSize-1)
+	for _, rr := range requestRecords {
+		require.Equal(t, peers[0], rr.p)
+		require.Equal(t, graphsync.RequestTypeNew, rr.gsr.Type())
+		require.Equal(t, burstSize-1, rr.batchSize, "requests should be sent in a single message")
+		require.NotEqual(t, cancelledID, rr.gsr.ID())
+	}
+
+	// the cancelled request never went out, so no cancel should follow it
+	testutil.AssertChannelEmpty(t, td.requestRecordChan, "should not send cancel for a request that was never sent")
+}
+
+func TestRequestMany(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	blockChain2 := testutil.SetupBlockChain(ctx, t, td.persistence, 100, 5)
+	blockChain3 := testutil.SetupBlockChain(ctx, t, td.persistence, 100, 5)
+	roots := []graphsync.RootSelector{
+		{Root: td.blockChain.TipLink, Selector: td.blockChain.Selector()},
+		{Root: blockChain2.TipLink, Selector: blockChain2.Selector()},
+		{Root: blockChain3.TipLink, Selector: blockChain3.Selector()},
+	}
+	returnedResponseChan, returnedErrorChan := td.requestManager.RequestMany(requestCtx, peers[0], roots)
+
+	requestRecords := readNNetworkRequests(requestCtx, t, td, 3)
+	requestIndexes := make(map[graphsync.RequestID]int)
+	for _, rr := range requestRecords {
+		require.Equal(t, peers[0], rr.p)
+		for i, root := range roots {
+			if rr.gsr.Root().String() == root.Root.String() {
+				requestIndexes[rr.gsr.ID()] = i
+			}
+		}
+	}
+	require.Len(t, requestIndexes, 3, "should send a distinct request for each root")
+
+	var responses []gsmsg.GraphSyncResponse
+	var blks []blocks.Block
+	var failedID graphsync.RequestID
+	for _, rr := range requestRecords {
+		switch requestIndexes[rr.gsr.ID()] {
+		case 0:
+			responses = append(responses, gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, metadataForBlocks(td.blockChain.AllBlocks(), graphsync.LinkActionPresent)))
+			blks = append(blks, td.blockChain.AllBlocks()...)
+		case 1:
+			failedID = rr.gsr.ID()
+			responses = append(responses, gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestFailedContentNotFound, nil))
+		case 2:
+			responses = append(responses, gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, metadataForBlocks(blockChain3.AllBlocks(), graphsync.LinkActionPresent)))
+			blks = append(blks, blockChain3.AllBlocks()...)
+		}
+	}
+	td.requestManager.ProcessResponses(peers[0], responses, blks)
+
+	responsesByIndex := make(map[int][]graphsync.ResponseProgress)
+	for response := range returnedResponseChan {
+		require.Equal(t, requestIndexes[response.RequestID], response.Index)
+		responsesByIndex[response.Index] = append(responsesByIndex[response.Index], response.ResponseProgress)
+	}
+	require.Len(t, responsesByIndex, 2, "a failed request should not affect the others")
+	td.blockChain.VerifyWholeChainSync(responsesByIndex[0])
+	blockChain3.VerifyWholeChainSync(responsesByIndex[2])
+
+	errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+	require.Len(t, errs, 1)
+	var subRequestErr graphsync.SubRequestError
+	require.ErrorAs(t, errs[0], &subRequestErr)
+	require.Equal(t, 1, subRequestErr.Index)
+	require.Equal(t, failedID, subRequestErr.RequestID)
+	require.IsType(t, graphsync.RequestFailedContentNotFoundErr{}, subRequestErr.Err)
+}
+
+func TestRequestCids(t *testing.T) {
+	ctx := context.Background()
+	td := newTestData(ctx, t)
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	returnedCids, returnedErrorChan := td.requestManager.RequestCids(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+	_, has := rr.gsr.Extension(graphsync.ExtensionMetadataOnly)
+	require.True(t, has, "should ask for metadata only")
+
+	// the responder sends metadata, but no blocks
+	md := append(metadataForBlocks(td.blockChain.Blocks(0, 3), graphsync.LinkActionPresent), metadataForBlocks(td.blockChain.Blocks(3, 4), graphsync.LinkActionMissing)...)
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedPartial, md),
+	}, nil)
+
+	var cids []cid.Cid
+	for c := range returnedCids {
+		cids = append(cids, c)
+	}
+	var expectedCids []cid.Cid
+	for _, blk := range td.blockChain.Blocks(0, 3) {
+		expectedCids = append(expectedCids, blk.Cid())
+	}
+	require.Equal(t, expectedCids, cids)
+
+	errs := testutil.CollectErrors(requestCtx, t, returnedErrorChan)
+	require.Len(t, errs, 2)
+	var missingBlockErr graphsync.RemoteMissingBlockErr
+	require.True(t, errors.As(errs[0], &missingBlockErr))
+	require.Equal(t, td.blockChain.LinkTipIndex(3), missingBlockErr.Link)
+	require.ErrorIs(t, errs[1], graphsync.RequestCompletedPartialErr{})
+}
+
+func TestExtensionNegotiation(t *testing.T) {
+	ctx := context.Background()
+	supported := []graphsync.ExtensionName{graphsync.ExtensionDoNotSendCIDs, graphsync.ExtensionDeDupByKey}
+	td := newTestDataWithConfig(ctx, t, testConfig{supportedExtensions: supported})
+	negotiated := make(chan []graphsync.ExtensionName, 1)
+	td.negotiationCompleteListeners.Register(func(p peer.ID, supported []graphsync.ExtensionName) {
+		negotiated <- supported
+	})
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	doNotSendCids := graphsync.ExtensionData{Name: graphsync.ExtensionDoNotSendCIDs, Data: cidset.EncodeCidSet(cid.NewSet())}
+	dedupData, err := dedupkey.EncodeDedupKey("applesauce")
+	require.NoError(t, err)
+	dedup := graphsync.ExtensionData{Name: graphsync.ExtensionDeDupByKey, Data: dedupData}
+
+	// only the first request to the peer lists the supported extensions
+	_, _ = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector(), doNotSendCids, dedup)
+	_, _ = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector(), doNotSendCids, dedup)
+	rrs := readNNetworkRequests(requestCtx, t, td, 2)
+	data, has := rrs[0].gsr.Extension(graphsync.ExtensionSupportedExtensions)
+	require.True(t, has, "first request should list supported extensions")
+	names, err := supportedextensions.DecodeSupportedExtensions(data)
+	require.NoError(t, err)
+	require.Equal(t, supported, names)
+	_, has = rrs[1].gsr.Extension(graphsync.ExtensionSupportedExtensions)
+	require.False(t, has, "request made while negotiating should not list supported extensions")
+	_, has = rrs[1].gsr.Extension(graphsync.ExtensionDeDupByKey)
+	require.True(t, has, "request made while negotiating should send every extension")
+
+	// the responder only supports one of the extensions
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rrs[0].gsr.ID(), graphsync.PartialResponse, nil, graphsync.ExtensionData{
+			Name: graphsync.ExtensionSupportedExtensions,
+			Data: supportedextensions.EncodeSupportedExtensions([]graphsync.ExtensionName{graphsync.ExtensionDoNotSendCIDs, td.extensionName1}),
+		}),
+	}, nil)
+	var negotiatedExtensions []graphsync.ExtensionName
+	testutil.AssertReceive(requestCtx, t, negotiated, &negotiatedExtensions, "should complete negotiation")
+	require.Equal(t, []graphsync.ExtensionName{graphsync.ExtensionDoNotSendCIDs}, negotiatedExtensions)
+
+	// later requests leave out supported extensions the peer does not support,
+	// but send extensions that are not negotiated
+	_, _ = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector(), doNotSendCids, dedup, td.extension1)
+	rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+	_, has = rr.gsr.Extension(graphsync.ExtensionSupportedExtensions)
+	require.False(t, has, "should not negotiate again")
+	_, has = rr.gsr.Extension(graphsync.ExtensionDoNotSendCIDs)
+	require.True(t, has, "should send extension peer supports")
+	_, has = rr.gsr.Extension(graphsync.ExtensionDeDupByKey)
+	require.False(t, has, "should not send extension peer does not support")
+	_, has = rr.gsr.Extension(td.extensionName1)
+	require.True(t, has, "should send extension that is not negotiated")
+
+	// the responder forgets the extensions it was sent when the peer
+	// disconnects, so the first request after reconnecting negotiates again
+	td.requestManager.Disconnected(peers[0])
+	_, _ = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector(), doNotSendCids, dedup)
+	rr = readNNetworkRequests(requestCtx, t, td, 1)[0]
+	data, has = rr.gsr.Extension(graphsync.ExtensionSupportedExtensions)
+	require.True(t, has, "first request after reconnecting should list supported extensions")
+	names, err = supportedextensions.DecodeSupportedExtensions(data)
+	require.NoError(t, err)
+	require.Equal(t, supported, names)
+	_, has = rr.gsr.Extension(graphsync.ExtensionDeDupByKey)
+	require.True(t, has, "first request after reconnecting should send every extension")
+
+	// evicting the state kept for an idle peer also negotiates again
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.PartialResponse, nil, graphsync.ExtensionData{
+			Name: graphsync.ExtensionSupportedExtensions,
+			Data: supportedextensions.EncodeSupportedExtensions([]graphsync.ExtensionName{graphsync.ExtensionDoNotSendCIDs}),
+		}),
+	}, nil)
+	testutil.AssertReceive(requestCtx, t, negotiated, &negotiatedExtensions, "should complete negotiation")
+	td.requestManager.PeerEvicted(peers[0])
+	_, _ = td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector(), doNotSendCids, dedup)
+	rr = readNNetworkRequests(requestCtx, t, td, 1)[0]
+	_, has = rr.gsr.Extension(graphsync.ExtensionSupportedExtensions)
+	require.True(t, has, "first request after evicting peer state should list supported extensions")
+	_, has = rr.gsr.Extension(graphsync.ExtensionDeDupByKey)
+	require.True(t, has, "first request after evicting peer state should send every extension")
+}
+
+func TestTombstoneLimits(t *testing.T) {
+	ctx := context.Background()
+	limitRecorder := limits.NewRecorder(time.Minute, nil)
+	td := newTestDataWithConfig(ctx, t, testConfig{tombstoneOptions: graphsync.TombstoneOptions{
+		MaxCount:               10,
+		MaxLateMessagesPerPeer: 50,
+	}, limitRecorder: limitRecorder})
+
+	requestCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	// churn through many more requests than are remembered
+	var completedIDs []graphsync.RequestID
+	for i := 0; i < 50; i++ {
+		_, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+		rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+		td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+			gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestFailedContentNotFound, nil),
+		}, nil)
+		testutil.VerifySingleTerminalError(requestCtx, t, returnedErrorChan)
+		completedIDs = append(completedIDs, rr.gsr.ID())
+	}
+
+	verifyRemembered := func() {
+		completed := td.requestManager.CompletedRequests()
+		require.Len(t, completed, 10)
+		for i, tombstone := range completed {
+			require.Equal(t, completedIDs[40+i], tombstone.RequestID)
+			require.Equal(t, peers[0], tombstone.Peer)
+			require.Equal(t, graphsync.RequestEventErrored, tombstone.Event.Name)
+		}
+	}
+	verifyRemembered()
+
+	// a forgotten request has nothing to report to late subscribers
+	events, _ := td.requestManager.SubscribeToRequestEvents(completedIDs[0])
+	_, ok := <-events
+	require.False(t, ok)
+	events, _ = td.requestManager.SubscribeToRequestEvents(completedIDs[49])
+	event := <-events
+	require.Equal(t, graphsync.RequestEventErrored, event.Name)
+
+	// replay terminal responses for every old request, plus one more than the
+	// peer is allowed
+	var replayed []gsmsg.GraphSyncResponse
+	for _, requestID := range completedIDs {
+		replayed = append(replayed, gsmsg.NewResponse(requestID, graphsync.RequestFailedContentNotFound, nil))
+	}
+	replayed = append(replayed, gsmsg.NewResponse(graphsync.NewRequestID(), graphsync.RequestFailedContentNotFound, nil))
+	td.requestManager.ProcessResponses(peers[0], replayed, nil)
+
+	require.Equal(t, graphsync.TombstoneStats{
+		Count:                  10,
+		LateMessagesAbsorbed:   10,
+		UnknownMessagesDropped: 40,
+		RateLimitedMessages:    1,
+	}, td.requestManager.TombstoneStats())
+	hits, _ := limitRecorder.Hits(graphsync.LimitMaxRequestTombstones)
+	require.Equal(t, uint64(40), hits)
+	hits, _ = limitRecorder.Hits(graphsync.LimitMaxLateMessagesPerPeer)
+	require.Equal(t, uint64(1), hits)
+	// replays in completion order neither grow nor reorder the remembered
+	// requests
+	verifyRemembered()
+	testutil.AssertChannelEmpty(t, td.requestRecordChan, "should not send anything in response to late messages")
+
+	// using the oldest remembered request keeps it when the next request
+	// completes, and the least recently used is forgotten instead
+	events, _ = td.requestManager.SubscribeToRequestEvents(completedIDs[40])
+	event = <-events
+	require.Equal(t, graphsync.RequestEventErrored, event.Name)
+	_, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestFailedContentNotFound, nil),
+	}, nil)
+	testutil.VerifySingleTerminalError(requestCtx, t, returnedErrorChan)
+	var rememberedIDs []graphsync.RequestID
+	for _, tombstone := range td.requestManager.CompletedRequests() {
+		rememberedIDs = append(rememberedIDs, tombstone.RequestID)
+	}
+	expectedIDs := append([]graphsync.RequestID{}, completedIDs[42:]...)
+	expectedIDs = append(expectedIDs, completedIDs[40], rr.gsr.ID())
+	require.Equal(t, expectedIDs, rememberedIDs)
+}
+
+func TestTombstoneExpiry(t *testing.T) {
+	ctx := context.Background()
+	tombstoneClock := clock.NewMock()
+	td := newTestDataWithConfig(ctx, t, testConfig{tombstoneOptions: graphsync.TombstoneOptions{
+		MaxAge: 100 * time.Millisecond,
+	}, tombstoneClock: tombstoneClock})
+
+	requestCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	peers := testutil.GeneratePeers(1)
+
+	_, returnedErrorChan := td.requestManager.NewRequest(requestCtx, peers[0], td.blockChain.TipLink, td.blockChain.Selector())
+	rr := readNNetworkRequests(requestCtx, t, td, 1)[0]
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestFailedContentNotFound, nil),
+	}, nil)
+	testutil.VerifySingleTerminalError(requestCtx, t, returnedErrorChan)
+	require.Len(t, td.requestManager.CompletedRequests(), 1)
+
+	// looking up how the request ended keeps it for another MaxAge
+	tombstoneClock.Add(80 * time.Millisecond)
+	events, _ := td.requestManager.SubscribeToRequestEvents(rr.gsr.ID())
+	event := <-events
+	require.Equal(t, graphsync.RequestEventErrored, event.Name)
+	tombstoneClock.Add(80 * time.Millisecond)
+	require.Len(t, td.requestManager.CompletedRequests(), 1)
+
+	tombstoneClock.Add(21 * time.Millisecond)
+	require.Empty(t, td.requestManager.CompletedRequests())
+
+	// once forgotten, a late response counts as unknown
+	td.requestManager.ProcessResponses(peers[0], []gsmsg.GraphSyncResponse{
+		gsmsg.NewResponse(rr.gsr.ID(), graphsync.RequestCompletedFull, nil),
+	}, nil)
+	require.Equal(t, graphsync.TombstoneStats{UnknownMessagesDropped: 1}, td.requestManager.TombstoneStats())
+}
+
 type requestRecord struct {
 	gsr gsmsg.GraphSyncRequest
 	p   peer.ID
+	// number of requests sent in the same message
+	batchSize int
 }
 
 type fakePeerHandler struct {
 	requestRecordChan chan requestRecord
 }
 
-func (fph *fakePeerHandler) AllocateAndBuildMessage(p peer.ID, blkSize uint64,
+func (fph *fakePeerHandler) BuildRequestMessage(p peer.ID,
 	requestBuilder func(b *messagequeue.Builder)) {
 	builder := messagequeue.NewBuilder(context.TODO(), messagequeue.Topic(0))
 	requestBuilder(builder)
@@ -1022,9 +3182,13 @@ func (fph *fakePeerHandler) AllocateAndBuildMessage(p peer.ID, blkSize uint64,
 	if err != nil {
 		panic(err)
 	}
-	fph.requestRecordChan <- requestRecord{
-		gsr: message.Requests()[0],
-		p:   p,
+	requests := message.Requests()
+	for _, gsr := range requests {
+		fph.requestRecordChan <- requestRecord{
+			gsr:       gsr,
+			p:         p,
+			batchSize: len(requests),
+		}
 	}
 }
 
@@ -1046,6 +3210,9 @@ func readNNetworkRequests(ctx context.Context, t *testing.T, td *testData, count
 	return sorted
 }
 
+// cancelAck marks a RequestCancelled response as the reply to a cancel
+var cancelAck = graphsync.ExtensionData{Name: graphsync.ExtensionCancelAck, Data: basicnode.NewBool(true)}
+
 func metadataForBlocks(blks []blocks.Block, action graphsync.LinkAction) []gsmsg.GraphSyncLinkMetadatum {
 	md := make([]gsmsg.GraphSyncLinkMetadatum, 0, len(blks))
 	for _, block := range blks {
@@ -1064,6 +3231,7 @@ type testData struct {
 	tcm                                *testutil.TestConnManager
 	requestHooks                       *hooks.OutgoingRequestHooks
 	responseHooks                      *hooks.IncomingResponseHooks
+	selectorProposalHooks              *hooks.SelectorProposalHooks
 	blockHooks                         *hooks.IncomingBlockHooks
 	requestManager                     *RequestManager
 	blockStore                         map[ipld.Link][]byte
@@ -1079,12 +3247,51 @@ type testData struct {
 	extension2                         graphsync.ExtensionData
 	networkErrorListeners              *listeners.NetworkErrorListeners
 	outgoingRequestProcessingListeners *listeners.RequestProcessingListeners
+	completedResponseHooks             *listeners.CompletedResponseHooks
+	negotiationCompleteListeners       *listeners.NegotiationCompleteListeners
 	taskqueue                          *taskqueue.WorkerTaskQueue
 	executor                           *executor.Executor
 	requestIds                         []graphsync.RequestID
 }
 
+type testConfig struct {
+	requestBatchWindow   time.Duration
+	batchClock           clock.Clock
+	tombstoneClock       clock.Clock
+	sentRequests         chan<- gsmsg.GraphSyncRequest
+	retryOptions         graphsync.RetryOptions
+	tombstoneOptions     graphsync.TombstoneOptions
+	limitRecorder        *limits.Recorder
+	scheduler            graphsync.RequestScheduler
+	supportedExtensions  []graphsync.ExtensionName
+	defaultChooser       traversal.LinkTargetNodePrototypeChooser
+	progressStore        graphsync.PersistenceStore
+	progressInterval     time.Duration
+	maxInProgressPerPeer int
+	strictVerification   bool
+	maxBlockSize         uint64
+	transferStats        *transferstats.Tracker
+	maxSelectorProposals int
+}
+
+// sendRecordingManager reports each request the executor sends once the
+// request manager has taken it
+type sendRecordingManager struct {
+	*RequestManager
+	sentRequests chan<- gsmsg.GraphSyncRequest
+}
+
+func (srm *sendRecordingManager) SendRequest(p peer.ID, request gsmsg.GraphSyncRequest) {
+	srm.RequestManager.SendRequest(p, request)
+	srm.sentRequests <- request
+}
+
 func newTestData(ctx context.Context, t *testing.T) *testData {
+	t.Helper()
+	return newTestDataWithConfig(ctx, t, testConfig{})
+}
+
+func newTestDataWithConfig(ctx context.Context, t *testing.T, config testConfig) *testData {
 	t.Helper()
 	td := &testData{}
 	td.requestRecordChan = make(chan requestRecord, 3)
@@ -1093,15 +3300,53 @@ func newTestData(ctx context.Context, t *testing.T) *testData {
 	td.tcm = testutil.NewTestConnManager()
 	td.requestHooks = hooks.NewRequestHooks()
 	td.responseHooks = hooks.NewResponseHooks()
+	td.selectorProposalHooks = hooks.NewSelectorProposalHooks()
 	td.blockHooks = hooks.NewBlockHooks()
 	td.networkErrorListeners = listeners.NewNetworkErrorListeners()
 	td.outgoingRequestProcessingListeners = listeners.NewRequestProcessingListeners()
-	td.taskqueue = taskqueue.NewTaskQueue(ctx)
+	td.completedResponseHooks = listeners.NewCompletedResponseHooks()
+	td.negotiationCompleteListeners = listeners.NewNegotiationCompleteListeners()
+	var ptqopts []peertaskqueue.Option
+	if config.maxInProgressPerPeer > 0 {
+		ptqopts = append(ptqopts, peertaskqueue.MaxOutstandingWorkPerPeer(config.maxInProgressPerPeer))
+	}
+	td.taskqueue = taskqueue.NewTaskQueue(ctx, ptqopts...)
+	if config.scheduler != nil {
+		td.taskqueue.SetScheduler(config.scheduler)
+	}
 	td.localBlockStore = make(map[ipld.Link][]byte)
 	td.localPersistence = testutil.NewTestStore(td.localBlockStore)
-	td.requestManager = New(ctx, td.persistenceOptions, td.localPersistence, td.requestHooks, td.responseHooks, td.networkErrorListeners, td.outgoingRequestProcessingListeners, td.taskqueue, td.tcm, 0, nil)
-	td.executor = executor.NewExecutor(td.requestManager, td.blockHooks)
+	td.requestManager = New(ctx, td.persistenceOptions, td.localPersistence, td.requestHooks, td.responseHooks, td.selectorProposalHooks, td.networkErrorListeners, td.outgoingRequestProcessingListeners, td.completedResponseHooks, td.taskqueue, td.tcm, 0, nil, config.requestBatchWindow, config.retryOptions, config.tombstoneOptions, config.limitRecorder, 0)
+	if config.batchClock != nil {
+		td.requestManager.batcher.clock = config.batchClock
+	}
+	if config.tombstoneClock != nil {
+		td.requestManager.tombstones.clock = config.tombstoneClock
+	}
+	var executorManager executor.Manager = td.requestManager
+	if config.sentRequests != nil {
+		executorManager = &sendRecordingManager{td.requestManager, config.sentRequests}
+	}
+	td.executor = executor.NewExecutor(executorManager, td.blockHooks, nil)
 	td.requestManager.SetDelegate(td.fph)
+	if config.supportedExtensions != nil {
+		td.requestManager.SetSupportedExtensions(config.supportedExtensions, td.negotiationCompleteListeners)
+	}
+	if config.defaultChooser != nil {
+		td.requestManager.SetDefaultChooser(config.defaultChooser)
+	}
+	if config.progressStore != nil {
+		td.requestManager.SetProgressStore(config.progressStore, config.progressInterval)
+	}
+	if config.strictVerification {
+		td.requestManager.SetStrictVerification(config.maxBlockSize)
+	}
+	if config.transferStats != nil {
+		td.requestManager.SetTransferStats(config.transferStats)
+	}
+	if config.maxSelectorProposals != 0 {
+		td.requestManager.SetMaxSelectorProposals(config.maxSelectorProposals)
+	}
 	td.requestManager.Startup()
 	td.taskqueue.Startup(6, td.executor)
 	td.blockStore = make(map[ipld.Link][]byte)
@@ -2,16 +2,39 @@ package requestmanager
 
 import (
 	"context"
+	"sync/atomic"
+
+	blocks "github.com/ipfs/go-block-format"
 
 	"github.com/ipfs/go-graphsync"
 )
 
+// responseCollector buffers responses and errors for a request between the
+// traversal and the caller, so a caller that reads in bursts does not stall the
+// traversal. Responses are always delivered in traversal order. Once
+// maxBuffer responses are waiting to be read, the traversal waits for the
+// caller rather than dropping responses
 type responseCollector struct {
 	ctx context.Context
+	// maximum number of responses buffered per request. A value of zero = infinity, or no limit
+	maxBuffer int
+	// error for requests still in progress when the request manager stops
+	closedErr atomic.Value
+}
+
+func newResponseCollector(ctx context.Context, maxBuffer int) *responseCollector {
+	return &responseCollector{ctx: ctx, maxBuffer: maxBuffer}
+}
+
+// setClosedErr sets the error returned for requests that are still in
+// progress when the request manager stops. Otherwise their channels are
+// simply closed
+func (rc *responseCollector) setClosedErr(err error) {
+	rc.closedErr.Store(closedErr{err})
 }
 
-func newResponseCollector(ctx context.Context) *responseCollector {
-	return &responseCollector{ctx}
+type closedErr struct {
+	err error
 }
 
 func (rc *responseCollector) collectResponses(
@@ -27,8 +50,9 @@ func (rc *responseCollector) collectResponses(
 
 	go func() {
 		var receivedResponses []graphsync.ResponseProgress
-		defer close(returnedResponses)
+		// onComplete runs after the caller sees the response channel close
 		defer onComplete()
+		defer close(returnedResponses)
 		outgoingResponses := func() chan<- graphsync.ResponseProgress {
 			if len(receivedResponses) == 0 {
 				return nil
@@ -41,18 +65,29 @@ func (rc *responseCollector) collectResponses(
 			}
 			return receivedResponses[0]
 		}
+		// stop reading new responses while the buffer is full
+		bufferedResponses := func() <-chan graphsync.ResponseProgress {
+			if rc.maxBuffer > 0 && len(receivedResponses) >= rc.maxBuffer {
+				return nil
+			}
+			return incomingResponses
+		}
+		// once the request has terminated, responses already received are still
+		// delivered even if the request manager shuts down
+		managerDone := rc.ctx.Done()
 		for len(receivedResponses) > 0 || incomingResponses != nil {
 			select {
-			case <-rc.ctx.Done():
+			case <-managerDone:
 				return
 			case <-requestCtx.Done():
 				if incomingResponses != nil {
 					cancelRequest()
 				}
 				return
-			case response, ok := <-incomingResponses:
+			case response, ok := <-bufferedResponses():
 				if !ok {
 					incomingResponses = nil
+					managerDone = nil
 				} else {
 					receivedResponses = append(receivedResponses, response)
 				}
@@ -78,9 +113,16 @@ func (rc *responseCollector) collectResponses(
 			return receivedErrors[0]
 		}
 
+		managerDone := rc.ctx.Done()
 		for len(receivedErrors) > 0 || incomingErrors != nil {
 			select {
-			case <-rc.ctx.Done():
+			case <-managerDone:
+				if closed, ok := rc.closedErr.Load().(closedErr); ok && closed.err != nil {
+					select {
+					case <-requestCtx.Done():
+					case returnedErrors <- closed.err:
+					}
+				}
 				return
 			case <-requestCtx.Done():
 				select {
@@ -91,6 +133,7 @@ func (rc *responseCollector) collectResponses(
 			case err, ok := <-incomingErrors:
 				if !ok {
 					incomingErrors = nil
+					managerDone = nil
 					// even if the `incomingErrors` channel is closed without any error,
 					// the context could still have timed out in which case we need to inform the caller of the same.
 					select {
@@ -111,3 +154,53 @@ func (rc *responseCollector) collectResponses(
 	}()
 	return returnedResponses, returnedErrors
 }
+
+// collectBlocks buffers the raw blocks for a request between the traversal and
+// the caller, in the same way as responses
+func (rc *responseCollector) collectBlocks(requestCtx context.Context, incomingBlocks <-chan blocks.Block) <-chan blocks.Block {
+	returnedBlocks := make(chan blocks.Block)
+
+	go func() {
+		var receivedBlocks []blocks.Block
+		defer close(returnedBlocks)
+		outgoingBlocks := func() chan<- blocks.Block {
+			if len(receivedBlocks) == 0 {
+				return nil
+			}
+			return returnedBlocks
+		}
+		nextBlock := func() blocks.Block {
+			if len(receivedBlocks) == 0 {
+				return nil
+			}
+			return receivedBlocks[0]
+		}
+		// stop reading new blocks while the buffer is full
+		bufferedBlocks := func() <-chan blocks.Block {
+			if rc.maxBuffer > 0 && len(receivedBlocks) >= rc.maxBuffer {
+				return nil
+			}
+			return incomingBlocks
+		}
+		managerDone := rc.ctx.Done()
+		for len(receivedBlocks) > 0 || incomingBlocks != nil {
+			select {
+			case <-managerDone:
+				return
+			// the response collector cancels the request
+			case <-requestCtx.Done():
+				return
+			case blk, ok := <-bufferedBlocks():
+				if !ok {
+					incomingBlocks = nil
+					managerDone = nil
+				} else {
+					receivedBlocks = append(receivedBlocks, blk)
+				}
+			case outgoingBlocks() <- nextBlock():
+				receivedBlocks = receivedBlocks[1:]
+			}
+		}
+	}()
+	return returnedBlocks
+}
@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	blocks "github.com/ipfs/go-block-format"
 	ipld "github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/stretchr/testify/require"
@@ -18,7 +19,7 @@ func TestBufferingResponseProgress(t *testing.T) {
 	backgroundCtx := context.Background()
 	ctx, cancel := context.WithTimeout(backgroundCtx, time.Second)
 	defer cancel()
-	rc := newResponseCollector(ctx)
+	rc := newResponseCollector(ctx, 0)
 	requestCtx, requestCancel := context.WithCancel(backgroundCtx)
 	defer requestCancel()
 	incomingResponses := make(chan graphsync.ResponseProgress)
@@ -64,3 +65,91 @@ func TestBufferingResponseProgress(t *testing.T) {
 		}
 	}
 }
+
+func TestBufferingResponseProgressLimit(t *testing.T) {
+	backgroundCtx := context.Background()
+	ctx, cancel := context.WithTimeout(backgroundCtx, time.Second)
+	defer cancel()
+	rc := newResponseCollector(ctx, 2)
+	requestCtx, requestCancel := context.WithCancel(backgroundCtx)
+	defer requestCancel()
+	incomingResponses := make(chan graphsync.ResponseProgress)
+	incomingErrors := make(chan error)
+	cancelRequest := func() {}
+
+	outgoingResponses, _ := rc.collectResponses(
+		requestCtx, incomingResponses, incomingErrors, cancelRequest, func() {})
+
+	blockStore := make(map[ipld.Link][]byte)
+	persistence := testutil.NewTestStore(blockStore)
+	blockChain := testutil.SetupBlockChain(ctx, t, persistence, 100, 3)
+	blocks := blockChain.AllBlocks()
+	responseForBlock := func(i int) graphsync.ResponseProgress {
+		return graphsync.ResponseProgress{
+			Node: blockChain.NodeTipIndex(i),
+			LastBlock: struct {
+				Path ipld.Path
+				Link ipld.Link
+			}{ipld.Path{}, cidlink.Link{Cid: blocks[i].Cid()}},
+		}
+	}
+
+	testutil.AssertSends(ctx, t, incomingResponses, responseForBlock(0), "did not write block to channel")
+	testutil.AssertSends(ctx, t, incomingResponses, responseForBlock(1), "did not write block to channel")
+
+	// the buffer is full, so the next response waits for the caller
+	select {
+	case incomingResponses <- responseForBlock(2):
+		t.Fatal("should not buffer more responses than the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	var testResponse graphsync.ResponseProgress
+	testutil.AssertReceive(ctx, t, outgoingResponses, &testResponse, "should read from outgoing responses")
+	require.Equal(t, blocks[0].Cid(), testResponse.LastBlock.Link.(cidlink.Link).Cid)
+	testutil.AssertSends(ctx, t, incomingResponses, responseForBlock(2), "did not write block to channel")
+	close(incomingResponses)
+
+	for _, block := range blocks[1:] {
+		testutil.AssertReceive(ctx, t, outgoingResponses, &testResponse, "should read from outgoing responses")
+		require.Equal(t, block.Cid(), testResponse.LastBlock.Link.(cidlink.Link).Cid, "should deliver responses in order")
+	}
+}
+
+func TestBufferingRawBlocksLimit(t *testing.T) {
+	backgroundCtx := context.Background()
+	ctx, cancel := context.WithTimeout(backgroundCtx, time.Second)
+	defer cancel()
+	rc := newResponseCollector(ctx, 2)
+	requestCtx, requestCancel := context.WithCancel(backgroundCtx)
+	defer requestCancel()
+	incomingBlocks := make(chan blocks.Block)
+
+	outgoingBlocks := rc.collectBlocks(requestCtx, incomingBlocks)
+
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	testutil.AssertSends(ctx, t, incomingBlocks, blks[0], "did not write block to channel")
+	testutil.AssertSends(ctx, t, incomingBlocks, blks[1], "did not write block to channel")
+
+	// the buffer is full, so the next block waits for the caller
+	select {
+	case incomingBlocks <- blks[2]:
+		t.Fatal("should not buffer more blocks than the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	var blk blocks.Block
+	testutil.AssertReceive(ctx, t, outgoingBlocks, &blk, "should read from outgoing blocks")
+	require.Equal(t, blks[0].Cid(), blk.Cid())
+	testutil.AssertSends(ctx, t, incomingBlocks, blks[2], "did not write block to channel")
+	close(incomingBlocks)
+
+	// buffered blocks are still delivered before the channel closes
+	for _, expected := range blks[1:] {
+		testutil.AssertReceive(ctx, t, outgoingBlocks, &blk, "should read from outgoing blocks")
+		require.Equal(t, expected.Cid(), blk.Cid(), "should deliver blocks in order")
+		require.Equal(t, expected.RawData(), blk.RawData())
+	}
+	_, ok := <-outgoingBlocks
+	require.False(t, ok, "should close once every block is delivered")
+}
@@ -0,0 +1,267 @@
+package requestmanager
+
+import (
+	"container/heap"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+// priorityScheduler dispatches the waiting request with the highest effective
+// priority, oldest first among equal priorities. A request's effective
+// priority is the highest of its own priority and the effective priorities of
+// the queued or in progress requests that depend on it, so a low priority
+// request that a high priority request needs blocks from is raised until the
+// high priority request finishes.
+//
+// Waiting requests are kept in a heap. A request popped for a peer that is at
+// its in progress limit is set aside in a heap for that peer, and goes back
+// to the main heap when one of the peer's requests finishes, so each push,
+// dispatch and finish takes logarithmic time
+type priorityScheduler struct {
+	maxInProgressPerPeer uint64
+
+	requests map[graphsync.RequestID]*scheduledRequest
+	// dependents holds, for each request ID, the queued or in progress
+	// requests that depend on it. A request may be depended on before it is
+	// queued
+	dependents map[graphsync.RequestID]map[graphsync.RequestID]struct{}
+	waiting    requestHeap
+	blocked    map[peer.ID]*requestHeap
+	inProgress map[peer.ID]uint64
+	pushes     uint64
+}
+
+type scheduledRequest struct {
+	info      graphsync.PendingRequestInfo
+	effective graphsync.Priority
+	// order breaks ties between equal priorities, oldest first
+	order      uint64
+	dispatched bool
+	// the heap the request waits in, and its index there
+	heap  *requestHeap
+	index int
+}
+
+// NewPriorityScheduler returns the default graphsync.RequestScheduler, which
+// dispatches requests in order of priority, raising requests to the priority
+// of the requests that depend on them. Requests to a peer that already has
+// maxInProgressPerPeer requests in progress wait, unless maxInProgressPerPeer
+// is zero or the request is resumed
+func NewPriorityScheduler(maxInProgressPerPeer uint64) graphsync.RequestScheduler {
+	return &priorityScheduler{
+		maxInProgressPerPeer: maxInProgressPerPeer,
+		requests:             make(map[graphsync.RequestID]*scheduledRequest),
+		dependents:           make(map[graphsync.RequestID]map[graphsync.RequestID]struct{}),
+		blocked:              make(map[peer.ID]*requestHeap),
+		inProgress:           make(map[peer.ID]uint64),
+	}
+}
+
+func (ps *priorityScheduler) Push(info graphsync.PendingRequestInfo) {
+	if _, ok := ps.requests[info.RequestID]; ok {
+		ps.Done(info.RequestID)
+	}
+	ps.pushes++
+	sr := &scheduledRequest{info: info, order: ps.pushes}
+	ps.requests[info.RequestID] = sr
+	sr.effective = ps.effectivePriority(sr)
+	heap.Push(&ps.waiting, sr)
+	ps.setDependencies(sr, true)
+}
+
+func (ps *priorityScheduler) Next() (graphsync.RequestID, bool) {
+	for ps.waiting.Len() > 0 {
+		sr := heap.Pop(&ps.waiting).(*scheduledRequest)
+		p := sr.info.Peer
+		// a resumed request already held a slot, so it does not wait for one
+		if !sr.info.Resumed && ps.atLimit(p) {
+			blocked, ok := ps.blocked[p]
+			if !ok {
+				blocked = &requestHeap{}
+				ps.blocked[p] = blocked
+			}
+			heap.Push(blocked, sr)
+			continue
+		}
+		sr.dispatched = true
+		ps.inProgress[p]++
+		return sr.info.RequestID, true
+	}
+	return graphsync.RequestID{}, false
+}
+
+func (ps *priorityScheduler) Done(requestID graphsync.RequestID) {
+	sr, ok := ps.requests[requestID]
+	if !ok {
+		return
+	}
+	delete(ps.requests, requestID)
+	p := sr.info.Peer
+	if sr.dispatched {
+		ps.inProgress[p]--
+		if ps.inProgress[p] == 0 {
+			delete(ps.inProgress, p)
+		}
+	} else {
+		heap.Remove(sr.heap, sr.index)
+		ps.dropBlockedHeap(p)
+	}
+	// the request may have been the one to take a free slot for the peer
+	ps.unblock(p)
+	ps.setDependencies(sr, false)
+}
+
+func (ps *priorityScheduler) atLimit(p peer.ID) bool {
+	return ps.maxInProgressPerPeer > 0 && ps.inProgress[p] >= ps.maxInProgressPerPeer
+}
+
+// unblock moves the highest priority request set aside for a peer back to
+// the main heap, once the peer has room for another request
+func (ps *priorityScheduler) unblock(p peer.ID) {
+	blocked, ok := ps.blocked[p]
+	if !ok || ps.atLimit(p) {
+		return
+	}
+	heap.Push(&ps.waiting, heap.Pop(blocked))
+	ps.dropBlockedHeap(p)
+}
+
+func (ps *priorityScheduler) dropBlockedHeap(p peer.ID) {
+	if blocked, ok := ps.blocked[p]; ok && blocked.Len() == 0 {
+		delete(ps.blocked, p)
+	}
+}
+
+// setDependencies adds or removes a request as a dependent of the requests
+// it depends on, updating their effective priorities
+func (ps *priorityScheduler) setDependencies(sr *scheduledRequest, add bool) {
+	for _, dependency := range sr.info.DependsOn {
+		dependents, ok := ps.dependents[dependency]
+		if add {
+			if !ok {
+				dependents = make(map[graphsync.RequestID]struct{})
+				ps.dependents[dependency] = dependents
+			}
+			dependents[sr.info.RequestID] = struct{}{}
+		} else if ok {
+			delete(dependents, sr.info.RequestID)
+			if len(dependents) == 0 {
+				delete(ps.dependents, dependency)
+			}
+		}
+		ps.updatePriority(dependency, make(map[graphsync.RequestID]struct{}))
+	}
+}
+
+// updatePriority recalculates the effective priority of a request, and if it
+// changed, of the requests it depends on. visited guards against dependency
+// cycles
+func (ps *priorityScheduler) updatePriority(requestID graphsync.RequestID, visited map[graphsync.RequestID]struct{}) {
+	if _, ok := visited[requestID]; ok {
+		return
+	}
+	visited[requestID] = struct{}{}
+	sr, ok := ps.requests[requestID]
+	if !ok {
+		return
+	}
+	effective := ps.effectivePriority(sr)
+	if effective == sr.effective {
+		return
+	}
+	sr.effective = effective
+	if !sr.dispatched {
+		heap.Fix(sr.heap, sr.index)
+	}
+	for _, dependency := range sr.info.DependsOn {
+		ps.updatePriority(dependency, visited)
+	}
+}
+
+func (ps *priorityScheduler) effectivePriority(sr *scheduledRequest) graphsync.Priority {
+	effective := sr.info.Priority
+	for dependent := range ps.dependents[sr.info.RequestID] {
+		if dsr, ok := ps.requests[dependent]; ok && dsr.effective > effective {
+			effective = dsr.effective
+		}
+	}
+	return effective
+}
+
+// requestHeap orders waiting requests by effective priority, highest first,
+// then by the order they were queued
+type requestHeap []*scheduledRequest
+
+func (rh requestHeap) Len() int { return len(rh) }
+
+func (rh requestHeap) Less(i, j int) bool {
+	if rh[i].effective != rh[j].effective {
+		return rh[i].effective > rh[j].effective
+	}
+	return rh[i].order < rh[j].order
+}
+
+func (rh requestHeap) Swap(i, j int) {
+	rh[i], rh[j] = rh[j], rh[i]
+	rh[i].index = i
+	rh[j].index = j
+}
+
+func (rh *requestHeap) Push(x interface{}) {
+	sr := x.(*scheduledRequest)
+	sr.heap = rh
+	sr.index = len(*rh)
+	*rh = append(*rh, sr)
+}
+
+func (rh *requestHeap) Pop() interface{} {
+	old := *rh
+	n := len(old)
+	sr := old[n-1]
+	old[n-1] = nil
+	*rh = old[:n-1]
+	sr.heap = nil
+	return sr
+}
+
+// funcScheduler adapts a graphsync.RequestSchedulerFunc, which picks from the
+// full list of waiting requests each time, to a graphsync.RequestScheduler
+type funcScheduler struct {
+	pick    graphsync.RequestSchedulerFunc
+	waiting []graphsync.PendingRequestInfo
+}
+
+// NewFuncScheduler returns a graphsync.RequestScheduler that asks the given
+// function which waiting request to dispatch next
+func NewFuncScheduler(pick graphsync.RequestSchedulerFunc) graphsync.RequestScheduler {
+	return &funcScheduler{pick: pick}
+}
+
+func (fs *funcScheduler) Push(info graphsync.PendingRequestInfo) {
+	fs.Done(info.RequestID)
+	fs.waiting = append(fs.waiting, info)
+}
+
+func (fs *funcScheduler) Next() (graphsync.RequestID, bool) {
+	if len(fs.waiting) == 0 {
+		return graphsync.RequestID{}, false
+	}
+	next := fs.pick(append([]graphsync.PendingRequestInfo(nil), fs.waiting...))
+	if next < 0 || next >= len(fs.waiting) {
+		return graphsync.RequestID{}, false
+	}
+	requestID := fs.waiting[next].RequestID
+	fs.waiting = append(fs.waiting[:next], fs.waiting[next+1:]...)
+	return requestID, true
+}
+
+func (fs *funcScheduler) Done(requestID graphsync.RequestID) {
+	for i, info := range fs.waiting {
+		if info.RequestID == requestID {
+			fs.waiting = append(fs.waiting[:i], fs.waiting[i+1:]...)
+			return
+		}
+	}
+}
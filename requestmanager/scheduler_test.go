@@ -0,0 +1,147 @@
+package requestmanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestPriorityScheduler(t *testing.T) {
+	peers := testutil.GeneratePeers(2)
+	requestIDs := make([]graphsync.RequestID, 6)
+	for i := range requestIDs {
+		requestIDs[i] = graphsync.NewRequestID()
+	}
+
+	type step struct {
+		// push queues request, or when done is set, finishes it
+		push     int
+		peer     int
+		priority graphsync.Priority
+		deps     []int
+		resumed  bool
+		done     bool
+		// next dispatches the expected requests, then expects nothing else
+		// unless more is set
+		next []int
+		more bool
+	}
+	push := func(request, peer int, priority graphsync.Priority, deps ...int) step {
+		return step{push: request, peer: peer, priority: priority, deps: deps}
+	}
+	pushResumed := func(request, peer int, priority graphsync.Priority) step {
+		return step{push: request, peer: peer, priority: priority, resumed: true}
+	}
+	done := func(request int) step { return step{push: request, done: true} }
+	next := func(requests ...int) step { return step{push: -1, next: requests} }
+	nextSome := func(requests ...int) step { return step{push: -1, next: requests, more: true} }
+
+	testCases := map[string]struct {
+		maxInProgressPerPeer uint64
+		steps                []step
+	}{
+		"nothing pending": {
+			steps: []step{next()},
+		},
+		"highest priority first": {
+			steps: []step{push(0, 0, 1), push(1, 0, 5), push(2, 0, 3), next(1, 2, 0)},
+		},
+		"oldest first among equal priorities": {
+			steps: []step{push(0, 0, 1), push(1, 1, 1), push(2, 0, 1), next(0, 1, 2)},
+		},
+		"inherits priority of a queued dependent": {
+			steps: []step{push(0, 0, 1), push(1, 0, 3), push(2, 1, 5, 0), nextSome(0, 2), next(1)},
+		},
+		"inherits priority transitively": {
+			steps: []step{push(0, 0, 1), push(1, 0, 2, 0), push(2, 0, 3), push(3, 1, 5, 1), nextSome(0, 1, 3), next(2)},
+		},
+		"inherits priority of an in progress dependent": {
+			steps: []step{push(2, 1, 5, 0), nextSome(2), push(1, 0, 3), push(0, 0, 1), next(0, 1)},
+		},
+		"stops inheriting once the dependent is done": {
+			steps: []step{push(2, 1, 5, 0), nextSome(2), done(2), push(1, 0, 3), push(0, 0, 1), next(1, 0)},
+		},
+		"dependency cycles do not recurse forever": {
+			steps: []step{push(0, 0, 1, 1), push(1, 0, 2, 0), push(2, 0, 3), next(2, 0, 1)},
+		},
+		"skips peers at the in progress limit": {
+			maxInProgressPerPeer: 1,
+			steps:                []step{push(0, 0, 5), push(1, 0, 4), push(2, 1, 1), next(0, 2)},
+		},
+		"dispatches a waiting request once a slot frees up": {
+			maxInProgressPerPeer: 1,
+			steps:                []step{push(0, 0, 1), push(1, 0, 3), push(2, 0, 2), next(1), done(1), next(2), done(2), next(0)},
+		},
+		"a request finished while waiting frees nothing": {
+			maxInProgressPerPeer: 1,
+			steps:                []step{push(0, 0, 3), push(1, 0, 2), push(2, 0, 1), next(0), done(1), next(), done(0), next(2)},
+		},
+		"resumed requests skip the in progress limit": {
+			maxInProgressPerPeer: 1,
+			steps:                []step{push(0, 0, 1), next(0), push(1, 0, 2), pushResumed(2, 0, 1), next(2), done(0), next(), done(2), next(1)},
+		},
+		"a request pushed again is queued again": {
+			maxInProgressPerPeer: 1,
+			steps:                []step{push(0, 0, 1), next(0), push(0, 0, 1), push(1, 0, 2), next(1), done(1), next(0)},
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			scheduler := NewPriorityScheduler(data.maxInProgressPerPeer)
+			for i, s := range data.steps {
+				switch {
+				case s.done:
+					scheduler.Done(requestIDs[s.push])
+				case s.push >= 0:
+					var deps []graphsync.RequestID
+					for _, dep := range s.deps {
+						deps = append(deps, requestIDs[dep])
+					}
+					scheduler.Push(graphsync.PendingRequestInfo{
+						RequestID: requestIDs[s.push],
+						Peer:      peers[s.peer],
+						Priority:  s.priority,
+						DependsOn: deps,
+						Resumed:   s.resumed,
+					})
+				default:
+					for _, expected := range s.next {
+						requestID, ok := scheduler.Next()
+						require.True(t, ok, "step %d: expected request %d", i, expected)
+						require.Equal(t, requestIDs[expected], requestID, "step %d", i)
+					}
+					if !s.more {
+						_, ok := scheduler.Next()
+						require.False(t, ok, "step %d: expected no more requests", i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFuncScheduler(t *testing.T) {
+	peers := testutil.GeneratePeers(1)
+	requestIDs := []graphsync.RequestID{graphsync.NewRequestID(), graphsync.NewRequestID(), graphsync.NewRequestID()}
+	var seen []int
+	// dispatch the most recently queued request first
+	scheduler := NewFuncScheduler(func(pending []graphsync.PendingRequestInfo) int {
+		seen = append(seen, len(pending))
+		return len(pending) - 1
+	})
+	for _, requestID := range requestIDs {
+		scheduler.Push(graphsync.PendingRequestInfo{RequestID: requestID, Peer: peers[0]})
+	}
+	scheduler.Done(requestIDs[1])
+	for _, expected := range []graphsync.RequestID{requestIDs[2], requestIDs[0]} {
+		requestID, ok := scheduler.Next()
+		require.True(t, ok)
+		require.Equal(t, expected, requestID)
+	}
+	_, ok := scheduler.Next()
+	require.False(t, ok)
+	require.Equal(t, []int{2, 1}, seen)
+}
@@ -7,6 +7,8 @@ import (
 	"io"
 	"io/ioutil"
 	"math"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	blocks "github.com/ipfs/go-block-format"
@@ -27,14 +29,21 @@ import (
 	"go.opentelemetry.io/otel/trace"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/cidset"
+	"github.com/ipfs/go-graphsync/compression"
 	"github.com/ipfs/go-graphsync/dedupkey"
 	"github.com/ipfs/go-graphsync/donotsendfirstblocks"
 	"github.com/ipfs/go-graphsync/ipldutil"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/peerstate"
+	"github.com/ipfs/go-graphsync/remoteerror"
 	"github.com/ipfs/go-graphsync/requestmanager/executor"
 	"github.com/ipfs/go-graphsync/requestmanager/hooks"
 	"github.com/ipfs/go-graphsync/requestmanager/reconciledloader"
+	"github.com/ipfs/go-graphsync/requestmanager/types"
+	"github.com/ipfs/go-graphsync/selectorbudget"
+	"github.com/ipfs/go-graphsync/selectorproposal"
+	"github.com/ipfs/go-graphsync/taskqueue"
 )
 
 // The code in this file implements the internal thread for the request manager.
@@ -43,7 +52,11 @@ import (
 func (rm *RequestManager) run() {
 	// NOTE: Do not open any streams or connections from anywhere in this
 	// event loop. Really, just don't do anything likely to block.
+	defer close(rm.stopped)
 	defer rm.cleanupInProcessRequests()
+	if rm.batcher != nil {
+		defer rm.batcher.shutdown()
+	}
 
 	for {
 		select {
@@ -61,7 +74,27 @@ func (rm *RequestManager) cleanupInProcessRequests() {
 	}
 }
 
-func (rm *RequestManager) newRequest(requestID graphsync.RequestID, parentSpan trace.Span, p peer.ID, root ipld.Link, selector ipld.Node, extensions []graphsync.ExtensionData) (gsmsg.GraphSyncRequest, chan graphsync.ResponseProgress, chan error) {
+// chooser picks the node prototype chooser for a request's traversal: the one
+// set for the request, then the one set by hooks, then the default
+func (rm *RequestManager) chooser(requestChooser traversal.LinkTargetNodePrototypeChooser, hooksChooser traversal.LinkTargetNodePrototypeChooser) traversal.LinkTargetNodePrototypeChooser {
+	if requestChooser != nil {
+		return requestChooser
+	}
+	if hooksChooser != nil {
+		return hooksChooser
+	}
+	return rm.defaultChooser
+}
+
+// requestIDInUse returns true if the given ID belongs to a request that is in
+// progress. The ID of a completed request can be used again, so a request can
+// be resumed or reissued with the same ID
+func (rm *RequestManager) requestIDInUse(requestID graphsync.RequestID) bool {
+	_, ok := rm.inProgressRequestStatuses[requestID]
+	return ok
+}
+
+func (rm *RequestManager) newRequest(requestID graphsync.RequestID, parentSpan trace.Span, p peer.ID, root ipld.Link, selector ipld.Node, extensions []graphsync.ExtensionData, maxLinks uint64, chooser traversal.LinkTargetNodePrototypeChooser, dependsOn []graphsync.RequestID) (gsmsg.GraphSyncRequest, chan graphsync.ResponseProgress, chan error) {
 
 	parentSpan.SetAttributes(attribute.String("requestID", requestID.String()))
 	ctx, span := otel.Tracer("graphsync").Start(trace.ContextWithSpan(rm.ctx, parentSpan), "newRequest")
@@ -69,6 +102,30 @@ func (rm *RequestManager) newRequest(requestID graphsync.RequestID, parentSpan t
 
 	log.Infow("graphsync request initiated", "request id", requestID.String(), "peer", p, "root", root)
 
+	if rm.closedErr != nil {
+		span.RecordError(rm.closedErr)
+		span.SetStatus(codes.Error, rm.closedErr.Error())
+		defer parentSpan.End()
+		rp, err := rm.singleErrorResponse(rm.closedErr)
+		return gsmsg.GraphSyncRequest{}, rp, err
+	}
+
+	if rm.requestIDInUse(requestID) {
+		err := graphsync.RequestIDInUseErr{RequestID: requestID}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		defer parentSpan.End()
+		rp, errChan := rm.singleErrorResponse(err)
+		return gsmsg.GraphSyncRequest{}, rp, errChan
+	}
+
+	if rm.blockCompression != nil {
+		// copy so the caller's extensions are not modified
+		extensions = append(extensions[:len(extensions):len(extensions)], graphsync.ExtensionData{
+			Name: graphsync.ExtensionBlockCompression,
+			Data: compression.EncodeCodecNames([]string{rm.blockCompression.Name()}),
+		})
+	}
 	request, hooksResult, lsys, err := rm.validateRequest(requestID, p, root, selector, extensions)
 	if err != nil {
 		span.RecordError(err)
@@ -77,6 +134,9 @@ func (rm *RequestManager) newRequest(requestID graphsync.RequestID, parentSpan t
 		rp, err := rm.singleErrorResponse(err)
 		return request, rp, err
 	}
+	if rm.negotiation != nil {
+		request = rm.negotiation.prepareRequest(p, request)
+	}
 	doNotSendFirstBlocksData, has := request.Extension(graphsync.ExtensionsDoNotSendFirstBlocks)
 	var doNotSendFirstBlocks int64
 	if has {
@@ -89,7 +149,8 @@ func (rm *RequestManager) newRequest(requestID graphsync.RequestID, parentSpan t
 			return request, rp, err
 		}
 	}
-	ctx, cancel := context.WithCancel(ctx)
+	_, metadataOnly := request.Extension(graphsync.ExtensionMetadataOnly)
+	ctx, cancel := context.WithCancel(graphsync.ContextWithRequestInfo(ctx, requestID, p))
 	requestStatus := &inProgressRequestStatus{
 		ctx:                  ctx,
 		span:                 parentSpan,
@@ -98,18 +159,29 @@ func (rm *RequestManager) newRequest(requestID graphsync.RequestID, parentSpan t
 		p:                    p,
 		pauseMessages:        make(chan struct{}, 1),
 		doNotSendFirstBlocks: doNotSendFirstBlocks,
+		persistenceOption:    hooksResult.PersistenceOption,
+		maxLinks:             maxLinks,
+		dependsOn:            dependsOn,
+		metadataOnly:         metadataOnly,
 		request:              request,
 		state:                graphsync.Queued,
-		nodeStyleChooser:     hooksResult.CustomChooser,
+		nodeStyleChooser:     rm.chooser(chooser, hooksResult.CustomChooser),
 		inProgressChan:       make(chan graphsync.ResponseProgress),
 		inProgressErr:        make(chan error),
+		completed:            make(chan completedResponse, 1),
 		lsys:                 lsys,
+		receivedCids:         types.NewReceivedCids(),
 	}
 	requestStatus.lastResponse.Store(gsmsg.NewResponse(request.ID(), graphsync.RequestAcknowledged, nil))
 	rm.inProgressRequestStatuses[request.ID()] = requestStatus
+	// responses for the ID belong to the new request from now on
+	rm.tombstones.remove(request.ID())
+	rm.transferStats.StartRequest(request.ID())
+	rm.requestCounts.Add(p, graphsync.Queued)
 
 	rm.connManager.Protect(p, requestID.Tag())
-	rm.requestQueue.PushTask(p, peertask.Task{Topic: requestID, Priority: math.MaxInt32, Work: 1})
+	rm.requestQueue.PushTask(p, peertask.Task{Topic: requestID, Priority: int(request.Priority()), Work: 1, Data: taskqueue.RequestTaskData{DependsOn: dependsOn}})
+	rm.metrics.RecordOutgoingRequestQueued()
 	return request, requestStatus.inProgressChan, requestStatus.inProgressErr
 }
 
@@ -120,18 +192,18 @@ func (rm *RequestManager) requestTask(requestID graphsync.RequestID) executor.Re
 	}
 	log.Infow("graphsync request processing begins", "request id", requestID.String(), "peer", ipr.p, "total time", time.Since(ipr.startTime))
 
-	if ipr.traverser == nil {
+	if ipr.reconciledLoader == nil && !ipr.metadataOnly {
 		var budget *traversal.Budget
-		if rm.maxLinksPerRequest > 0 {
+		if ipr.maxLinks > 0 {
 			budget = &traversal.Budget{
 				NodeBudget: math.MaxInt64,
-				LinkBudget: int64(rm.maxLinksPerRequest),
+				LinkBudget: int64(ipr.maxLinks),
 			}
 		}
 		// the traverser has its own context because we want to fail on block boundaries, in the executor,
 		// and make sure all blocks included up to the termination message
 		// are processed and passed in the response channel
-		ctx, cancel := context.WithCancel(trace.ContextWithSpan(rm.ctx, ipr.span))
+		ctx, cancel := context.WithCancel(graphsync.ContextWithRequestInfo(trace.ContextWithSpan(rm.ctx, ipr.span), requestID, ipr.p))
 		ipr.traverserCancel = cancel
 		ipr.traverser = ipldutil.TraversalBuilder{
 			Root:     cidlink.Link{Cid: ipr.request.Root()},
@@ -152,7 +224,9 @@ func (rm *RequestManager) requestTask(requestID graphsync.RequestID) executor.Re
 				case ipr.inProgressChan <- graphsync.ResponseProgress{
 					Node:      node,
 					Path:      tp.Path,
+					Matched:   tr == traversal.VisitReason_SelectionMatch,
 					LastBlock: tp.LastBlock,
+					Stat:      graphsync.ResponseStat{BytesReceived: atomic.LoadUint64(&ipr.bytesReceived)},
 				}:
 				}
 				return nil
@@ -162,13 +236,17 @@ func (rm *RequestManager) requestTask(requestID graphsync.RequestID) executor.Re
 			Budget:        budget,
 			PanicCallback: rm.panicCallback,
 		}.Start(ctx)
+	}
 
+	if ipr.reconciledLoader == nil {
 		ipr.reconciledLoader = reconciledloader.NewReconciledLoader(ipr.request.ID(), ipr.lsys)
 		inProgressCount := len(rm.inProgressRequestStatuses)
 		rm.outgoingRequestProcessingListeners.NotifyRequestProcessingListeners(ipr.p, ipr.request, inProgressCount)
+		rm.metrics.RecordOutgoingRequestStarted()
+		rm.publishRequestEvent(ipr, graphsync.RequestEventStarted, nil)
 	}
 
-	ipr.state = graphsync.Running
+	rm.setState(ipr, graphsync.Running)
 	return executor.RequestTask{
 		Ctx:                  ipr.ctx,
 		Span:                 ipr.span,
@@ -177,13 +255,24 @@ func (rm *RequestManager) requestTask(requestID graphsync.RequestID) executor.Re
 		DoNotSendFirstBlocks: ipr.doNotSendFirstBlocks,
 		PauseMessages:        ipr.pauseMessages,
 		Traverser:            ipr.traverser,
+		MetadataOnly:         ipr.metadataOnly,
+		InProgressChan:       ipr.inProgressChan,
 		P:                    ipr.p,
 		InProgressErr:        ipr.inProgressErr,
+		RawBlocks:            ipr.rawBlocks,
 		ReconciledLoader:     ipr.reconciledLoader,
+		BytesReceived:        &ipr.bytesReceived,
+		ReceivedCids:         ipr.receivedCids,
 		Empty:                false,
 	}
 }
 
+// setState moves a request to a new state, keeping the request counts current
+func (rm *RequestManager) setState(ipr *inProgressRequestStatus, state graphsync.RequestState) {
+	rm.requestCounts.Move(ipr.p, ipr.state, state)
+	ipr.state = state
+}
+
 func (rm *RequestManager) getRequestTask(p peer.ID, task *peertask.Task) executor.RequestTask {
 	requestID := task.Topic.(graphsync.RequestID)
 	requestExecution := rm.requestTask(requestID)
@@ -198,14 +287,52 @@ func (rm *RequestManager) terminateRequest(requestID graphsync.RequestID, ipr *i
 	defer span.End()
 	defer ipr.span.End() // parent span for this whole request
 
+	completedStatus := ipr.completedStatus
+	// the traversal may end on a block the remote peer is missing before the
+	// remote peer's final status arrives
+	if completedStatus == 0 && ipr.remoteMissingBlocks {
+		completedStatus = graphsync.RequestCompletedPartial
+	}
 	if ipr.terminalError != nil {
 		select {
 		case ipr.inProgressErr <- ipr.terminalError:
 		case <-rm.ctx.Done():
 		}
+	} else if ipr.traversalError == nil && completedStatus.IsSuccess() {
+		// a partial completion is reported last, without failing the request
+		if err := completedStatus.AsError(); err != nil {
+			select {
+			case ipr.inProgressErr <- err:
+			case <-rm.ctx.Done():
+			}
+		}
 	}
 	rm.connManager.Unprotect(ipr.p, requestID.Tag())
 	delete(rm.inProgressRequestStatuses, requestID)
+	if rm.negotiation != nil {
+		rm.negotiation.requestEnded(ipr.p, requestID)
+	}
+	if len(rm.inProgressRequestStatuses) == 0 {
+		for _, drained := range rm.drainedWaiters {
+			close(drained)
+		}
+		rm.drainedWaiters = nil
+	}
+	terminalError := ipr.terminalError
+	if terminalError == nil {
+		terminalError = ipr.traversalError
+	}
+	rm.metrics.RecordOutgoingRequestCompleted(time.Since(ipr.startTime), terminalError == nil)
+	rm.requestCounts.Remove(ipr.p, ipr.state, terminalError)
+	if terminalError != nil {
+		rm.publishRequestEvent(ipr, graphsync.RequestEventErrored, terminalError)
+	} else {
+		rm.publishRequestEvent(ipr, graphsync.RequestEventCompleted, nil)
+	}
+	select {
+	case ipr.completed <- completedResponseFor(ipr, terminalError):
+	default:
+	}
 	ipr.cancelFn()
 	if ipr.reconciledLoader != nil {
 		ipr.reconciledLoader.Cleanup(rm.ctx)
@@ -223,6 +350,10 @@ func (rm *RequestManager) terminateRequest(requestID graphsync.RequestID, ipr *i
 	}
 	close(ipr.inProgressChan)
 	close(ipr.inProgressErr)
+	if ipr.rawBlocks != nil {
+		close(ipr.rawBlocks)
+	}
+	closeMessageTaps(ipr)
 	for _, onTerminated := range ipr.onTerminated {
 		select {
 		case <-rm.ctx.Done():
@@ -231,6 +362,29 @@ func (rm *RequestManager) terminateRequest(requestID graphsync.RequestID, ipr *i
 	}
 }
 
+// completedResponseFor works out the final status of a terminated request from
+// the last response received and the error it ended with, if any
+func completedResponseFor(ipr *inProgressRequestStatus, terminalError error) completedResponse {
+	lastResponse := ipr.lastResponse.Load().(gsmsg.GraphSyncResponse)
+	var extensions []graphsync.ExtensionData
+	for _, name := range lastResponse.ExtensionNames() {
+		data, _ := lastResponse.Extension(name)
+		extensions = append(extensions, graphsync.ExtensionData{Name: name, Data: data})
+	}
+	status := lastResponse.Status()
+	switch {
+	case responseFailed(status):
+	case errors.Is(terminalError, graphsync.RequestClientCancelledErr{}):
+		status = graphsync.RequestCancelled
+	case terminalError != nil:
+		status = graphsync.RequestFailedUnknown
+	case !responseEnded(status):
+		// the traversal finished without a final status from the responder
+		status = graphsync.RequestCompletedFull
+	}
+	return completedResponse{status, extensions}
+}
+
 func (rm *RequestManager) releaseRequestTask(p peer.ID, task *peertask.Task, err error) {
 	requestID := task.Topic.(graphsync.RequestID)
 	rm.requestQueue.TaskDone(p, task)
@@ -240,9 +394,30 @@ func (rm *RequestManager) releaseRequestTask(p peer.ID, task *peertask.Task, err
 		return
 	}
 	if _, ok := err.(hooks.ErrPaused); ok {
-		ipr.state = graphsync.Paused
+		if ipr.ctx.Err() == nil {
+			rm.setState(ipr, graphsync.Paused)
+			// the remote request was cancelled as the request paused, and a
+			// peer that acknowledges cancels will reply
+			if rm.negotiation != nil && rm.negotiation.mayUse(ipr.p, graphsync.ExtensionCancelAck) {
+				ipr.cancelAcksExpected++
+			}
+			rm.publishRequestEvent(ipr, graphsync.RequestEventPaused, nil)
+			return
+		}
+		// the request was cancelled as it paused, so there is nothing to resume
+		err = ipldutil.ContextCancelError{}
+	}
+	if ipr.reissueRequest != nil && ipr.terminalError == nil {
+		rm.reissueRequest(requestID, ipr)
 		return
 	}
+	if err != nil && !ipldutil.IsContextCancelErr(err) {
+		ipr.traversalError = err
+	}
+	var budgetErr *traversal.ErrBudgetExceeded
+	if errors.As(err, &budgetErr) && budgetErr.BudgetKind == "link" {
+		rm.limitRecorder.Hit(graphsync.LimitMaxLinksPerOutgoingRequests, graphsync.LimitScopeRequest)
+	}
 	log.Infow("graphsync request complete", "request id", requestID.String(), "peer", ipr.p, "total time", time.Since(ipr.startTime))
 	rm.terminateRequest(requestID, ipr)
 }
@@ -262,15 +437,70 @@ func (rm *RequestManager) cancelRequest(requestID graphsync.RequestID, onTermina
 	if onTerminated != nil {
 		inProgressRequestStatus.onTerminated = append(inProgressRequestStatus.onTerminated, onTerminated)
 	}
-	rm.SendRequest(inProgressRequestStatus.p, gsmsg.NewCancelRequest(requestID))
+	// a queued request has no outstanding request on the remote peer, so there
+	// is nothing to cancel over the network
+	if inProgressRequestStatus.state != graphsync.Queued {
+		rm.SendRequest(inProgressRequestStatus.p, gsmsg.NewCancelRequest(requestID))
+	}
 	rm.cancelOnError(requestID, inProgressRequestStatus, terminalError)
 }
 
+func (rm *RequestManager) drainRequests(terminalError error, drained chan struct{}) {
+	rm.closedErr = terminalError
+	rm.drainedWaiters = append(rm.drainedWaiters, drained)
+	if len(rm.inProgressRequestStatuses) == 0 {
+		for _, drained := range rm.drainedWaiters {
+			close(drained)
+		}
+		rm.drainedWaiters = nil
+	}
+}
+
+func (rm *RequestManager) cancelAllRequests(terminalError error, drained chan struct{}) {
+	rm.drainRequests(terminalError, drained)
+	for requestID := range rm.inProgressRequestStatuses {
+		rm.cancelRequest(requestID, nil, terminalError)
+	}
+}
+
+// disconnected fails the requests running with a peer that disconnected, as
+// no more responses will arrive for them. Queued and paused requests have no
+// outstanding request on the peer, so they are left to send it again if the
+// peer reconnects
+func (rm *RequestManager) disconnected(p peer.ID) {
+	if rm.negotiation != nil {
+		rm.negotiation.forgetPeer(p)
+	}
+	for requestID, ipr := range rm.inProgressRequestStatuses {
+		if ipr.p == p && ipr.state == graphsync.Running {
+			rm.cancelOnError(requestID, ipr, graphsync.ErrPeerDisconnected{Peer: p})
+		}
+	}
+}
+
+func (rm *RequestManager) peerEvicted(p peer.ID) {
+	if rm.negotiation != nil {
+		rm.negotiation.forgetPeer(p)
+	}
+}
+
+func (rm *RequestManager) malformedMessage(p peer.ID, err error) {
+	for requestID, ipr := range rm.inProgressRequestStatuses {
+		if ipr.p == p && ipr.state == graphsync.Running {
+			rm.SendRequest(p, gsmsg.NewCancelRequest(requestID))
+			rm.cancelOnError(requestID, ipr, graphsync.MalformedResponseErr{Peer: p, Err: err})
+		}
+	}
+}
+
 func (rm *RequestManager) cancelOnError(requestID graphsync.RequestID, ipr *inProgressRequestStatus, terminalError error) {
 	if ipr.terminalError == nil {
 		ipr.terminalError = terminalError
 	}
 	if ipr.state != graphsync.Running {
+		if ipr.state == graphsync.Queued {
+			rm.requestQueue.Remove(requestID, ipr.p)
+		}
 		rm.terminateRequest(requestID, ipr)
 	} else {
 		ipr.cancelFn()
@@ -298,11 +528,21 @@ func (rm *RequestManager) processResponses(p peer.ID,
 	blkMap := make(map[cid.Cid][]byte, len(blks))
 	for _, blk := range blks {
 		blkMap[blk.Cid()] = blk.RawData()
+		rm.metrics.RecordBlockReceived(uint64(len(blk.RawData())))
 	}
+	rm.discardUnreferencedBlocks(p, filteredResponses, blkMap)
+	filteredResponses = rm.filterInvalidBlocks(p, filteredResponses, blkMap)
 	for _, response := range filteredResponses {
-		reconciledLoader := rm.inProgressRequestStatuses[response.RequestID()].reconciledLoader
-		if reconciledLoader != nil {
-			reconciledLoader.IngestResponse(response.Metadata(), trace.LinkFromContext(ctx), blkMap)
+		ipr := rm.inProgressRequestStatuses[response.RequestID()]
+		if !ipr.remoteMissingBlocks {
+			response.Metadata().Iterate(func(_ cid.Cid, action graphsync.LinkAction) {
+				if action == graphsync.LinkActionMissing {
+					ipr.remoteMissingBlocks = true
+				}
+			})
+		}
+		if ipr.reconciledLoader != nil {
+			ipr.reconciledLoader.IngestResponse(response.Metadata(), trace.LinkFromContext(ctx), blkMap)
 		}
 	}
 	rm.updateLastResponses(filteredResponses)
@@ -315,6 +555,13 @@ func (rm *RequestManager) filterResponsesForPeer(responses []gsmsg.GraphSyncResp
 	for _, response := range responses {
 		requestStatus, ok := rm.inProgressRequestStatuses[response.RequestID()]
 		if !ok || requestStatus.p != p {
+			rm.tombstones.absorb(p, response.RequestID())
+			continue
+		}
+		// the remote peer acknowledging a cancel sent when the request paused
+		// does not end the request, which may have resumed already
+		if isCancelAck(response) && requestStatus.cancelAcksExpected > 0 {
+			requestStatus.cancelAcksExpected--
 			continue
 		}
 		responsesForPeer = append(responsesForPeer, response)
@@ -322,6 +569,36 @@ func (rm *RequestManager) filterResponsesForPeer(responses []gsmsg.GraphSyncResp
 	return responsesForPeer
 }
 
+// isCancelAck returns true if the response is the remote peer's reply to a
+// cancel request, rather than the remote peer cancelling the request itself
+func isCancelAck(response gsmsg.GraphSyncResponse) bool {
+	if response.Status() != graphsync.RequestCancelled {
+		return false
+	}
+	_, ok := response.Extension(graphsync.ExtensionCancelAck)
+	return ok
+}
+
+// filterInvalidBlocks cancels requests whose responses carry blocks that fail
+// strict verification, so the blocks are never ingested
+func (rm *RequestManager) filterInvalidBlocks(p peer.ID, responses []gsmsg.GraphSyncResponse, blkMap map[cid.Cid][]byte) []gsmsg.GraphSyncResponse {
+	validResponses := make([]gsmsg.GraphSyncResponse, 0, len(responses))
+	for _, response := range responses {
+		err := rm.verifyResponseBlocks(response, blkMap)
+		if err == nil {
+			validResponses = append(validResponses, response)
+			continue
+		}
+		log.Warnw("received invalid block", "request id", response.RequestID().String(), "peer", p, "error", err)
+		requestStatus := rm.inProgressRequestStatuses[response.RequestID()]
+		if !responseEnded(response.Status()) {
+			rm.SendRequest(p, gsmsg.NewCancelRequest(response.RequestID()))
+		}
+		rm.cancelOnError(response.RequestID(), requestStatus, err)
+	}
+	return validResponses
+}
+
 func (rm *RequestManager) processExtensions(responses []gsmsg.GraphSyncResponse, p peer.ID) []gsmsg.GraphSyncResponse {
 	remainingResponses := make([]gsmsg.GraphSyncResponse, 0, len(responses))
 	for _, response := range responses {
@@ -340,6 +617,9 @@ func (rm *RequestManager) updateLastResponses(responses []gsmsg.GraphSyncRespons
 }
 
 func (rm *RequestManager) processExtensionsForResponse(p peer.ID, response gsmsg.GraphSyncResponse) bool {
+	if rm.negotiation != nil {
+		rm.negotiation.processResponse(p, response)
+	}
 	result := rm.responseHooks.ProcessResponseHooks(p, response)
 	if len(result.Extensions) > 0 {
 		updateRequest := gsmsg.NewUpdateRequest(response.RequestID(), result.Extensions...)
@@ -359,11 +639,26 @@ func (rm *RequestManager) processExtensionsForResponse(p peer.ID, response gsmsg
 
 func (rm *RequestManager) processTerminations(responses []gsmsg.GraphSyncResponse) {
 	for _, response := range responses {
-		if response.Status().IsTerminal() {
-			if response.Status().IsFailure() {
-				rm.cancelOnError(response.RequestID(), rm.inProgressRequestStatuses[response.RequestID()], response.Status().AsError())
+		if responseEnded(response.Status()) {
+			// a busy responder may be able to handle the request later
+			if ipr, ok := rm.inProgressRequestStatuses[response.RequestID()]; ok && response.Status() == graphsync.RequestFailedBusy {
+				if rm.scheduleRetry(response.RequestID(), ipr) {
+					continue
+				}
+			}
+			// a responder may reject a request but offer to serve another selector
+			if ipr, ok := rm.inProgressRequestStatuses[response.RequestID()]; ok && response.Status() == graphsync.RequestRejected {
+				if rm.processSelectorProposal(response, ipr) {
+					continue
+				}
+			}
+			if responseFailed(response.Status()) {
+				rm.cancelOnError(response.RequestID(), rm.inProgressRequestStatuses[response.RequestID()], terminalResponseError(response))
 			}
 			ipr, ok := rm.inProgressRequestStatuses[response.RequestID()]
+			if ok && response.Status().IsSuccess() {
+				ipr.completedStatus = response.Status()
+			}
 			if ok && ipr.reconciledLoader != nil {
 				ipr.reconciledLoader.SetRemoteOnline(false)
 			}
@@ -371,6 +666,175 @@ func (rm *RequestManager) processTerminations(responses []gsmsg.GraphSyncRespons
 	}
 }
 
+// responseEnded returns true if a response with the given status ends its
+// request. A status this implementation does not know ends the request, since
+// the responder may send nothing after it
+func responseEnded(status graphsync.ResponseStatusCode) bool {
+	return status.IsTerminal() || !knownStatus(status)
+}
+
+// responseFailed returns true if a response with the given status ends its
+// request in failure, which includes statuses this implementation does not
+// know
+func responseFailed(status graphsync.ResponseStatusCode) bool {
+	return status.IsFailure() || !knownStatus(status)
+}
+
+func knownStatus(status graphsync.ResponseStatusCode) bool {
+	_, ok := graphsync.ResponseCodeToName[status]
+	return ok
+}
+
+// terminalResponseError generates an error for a failed response, using any
+// extensions the responder sent to explain the failure
+func terminalResponseError(response gsmsg.GraphSyncResponse) error {
+	if data, ok := response.Extension(graphsync.ExtensionSelectorBudgetExceeded); ok {
+		if kind, err := selectorbudget.DecodeBudgetExceeded(data); err == nil {
+			return graphsync.SelectorBudgetExceededErr{Kind: kind}
+		}
+	}
+	if data, ok := response.Extension(graphsync.ExtensionSelectorProposal); ok {
+		if proposal, err := selectorproposal.DecodeSelectorProposal(data); err == nil {
+			return graphsync.SelectorProposalDeclinedErr{Proposal: proposal}
+		}
+	}
+	if data, ok := response.Extension(graphsync.ExtensionRemoteError); ok {
+		if remoteErr, err := remoteerror.DecodeRemoteError(data); err == nil {
+			remoteErr.Err = response.Status().AsError()
+			return remoteErr
+		}
+	}
+	if data, ok := response.Extension(graphsync.ExtensionFailureReason); ok {
+		if reason, err := data.AsString(); err == nil {
+			return graphsync.FailureReasonErr{Err: response.Status().AsError(), Reason: reason}
+		}
+	}
+	return response.Status().AsError()
+}
+
+// scheduleRetry sends the request again after a backoff delay if the request
+// is still running and has retries left, returning true if it did so
+func (rm *RequestManager) scheduleRetry(requestID graphsync.RequestID, ipr *inProgressRequestStatus) bool {
+	if ipr.retries+1 >= rm.retryOptions.MaxAttempts {
+		return false
+	}
+	if ipr.state != graphsync.Running || ipr.reconciledLoader == nil {
+		return false
+	}
+	ipr.retries++
+	retry := ipr.retries
+	delay := rm.retryOptions.Delay(retry)
+	log.Infow("retrying graphsync request", "request id", requestID.String(), "peer", ipr.p, "retry", retry, "delay", delay)
+	// the request context is cancelled when the request terminates, for any
+	// reason, so a retry never outlives the request
+	time.AfterFunc(delay, func() {
+		rm.send(&retryRequestMessage{requestID, retry}, ipr.ctx.Done())
+	})
+	return true
+}
+
+func (rm *RequestManager) retryRequest(requestID graphsync.RequestID, retry int) {
+	ipr, ok := rm.inProgressRequestStatuses[requestID]
+	if !ok || ipr.retries != retry || ipr.state != graphsync.Running {
+		return
+	}
+	rm.SendRequest(ipr.p, ipr.request)
+}
+
+// processSelectorProposal runs selector proposal hooks when a rejection carries
+// an alternate selector, and if a hook accepts, stops the current execution so
+// the request can be re-issued with the proposed selector. A request already
+// re-issued the most times allowed fails instead. It returns true if the
+// rejection was handled here
+func (rm *RequestManager) processSelectorProposal(response gsmsg.GraphSyncResponse, ipr *inProgressRequestStatus) bool {
+	data, ok := response.Extension(graphsync.ExtensionSelectorProposal)
+	if !ok {
+		return false
+	}
+	if ipr.state != graphsync.Running || ipr.reconciledLoader == nil {
+		return false
+	}
+	proposal, err := selectorproposal.DecodeSelectorProposal(data)
+	if err != nil {
+		log.Warnw("received invalid selector proposal", "request id", response.RequestID().String(), "peer", ipr.p, "error", err)
+		return false
+	}
+	if _, err := selector.ParseSelector(proposal.Selector); err != nil {
+		log.Warnw("received invalid selector proposal", "request id", response.RequestID().String(), "peer", ipr.p, "error", err)
+		return false
+	}
+	if ipr.selectorProposals >= rm.maxSelectorProposals {
+		log.Infow("remote peer proposed too many selectors", "request id", response.RequestID().String(), "peer", ipr.p, "reason", proposal.Reason)
+		rm.cancelOnError(response.RequestID(), ipr, graphsync.SelectorProposalLimitErr{Proposal: proposal, Reissued: ipr.selectorProposals})
+		return true
+	}
+	if !rm.selectorProposalHooks.ProcessSelectorProposalHooks(ipr.p, ipr.request, proposal) {
+		return false
+	}
+	ipr.selectorProposals++
+	log.Infow("re-issuing graphsync request with proposed selector", "request id", response.RequestID().String(), "peer", ipr.p, "reason", proposal.Reason)
+
+	// always tell the responder what was originally asked for, even if this
+	// is not the first proposal accepted
+	originalSelector := ipr.request.Selector()
+	if data, ok := ipr.request.Extension(graphsync.ExtensionSelectorProposalAccepted); ok {
+		originalSelector = data
+	}
+	extensions := make([]graphsync.ExtensionData, 0, len(ipr.request.ExtensionNames())+1)
+	for _, name := range ipr.request.ExtensionNames() {
+		if name == graphsync.ExtensionSelectorProposalAccepted {
+			continue
+		}
+		data, _ := ipr.request.Extension(name)
+		extensions = append(extensions, graphsync.ExtensionData{Name: name, Data: data})
+	}
+	extensions = append(extensions, graphsync.ExtensionData{Name: graphsync.ExtensionSelectorProposalAccepted, Data: originalSelector})
+	request := gsmsg.NewRequest(ipr.request.ID(), ipr.request.Root(), proposal.Selector, ipr.request.Priority(), extensions...)
+	ipr.reissueRequest = &request
+
+	// stop the current execution quietly -- the request is re-issued when the
+	// executor releases it
+	ipr.cancelFn()
+	ipr.reconciledLoader.SetRemoteOnline(false)
+	return true
+}
+
+// verificationTime returns the total time the request has spent verifying
+// responses, across all of its executions
+func (ipr *inProgressRequestStatus) verificationTime() time.Duration {
+	if ipr.reconciledLoader == nil {
+		return ipr.priorVerificationTime
+	}
+	return ipr.priorVerificationTime + ipr.reconciledLoader.VerificationTime()
+}
+
+// reissueRequest discards the traversal for a request and queues it again
+// with the request it is to be re-issued as
+func (rm *RequestManager) reissueRequest(requestID graphsync.RequestID, ipr *inProgressRequestStatus) {
+	if ipr.traverser != nil {
+		ipr.traverserCancel()
+		ipr.traverser.Shutdown(rm.ctx)
+		ipr.traverser = nil
+	}
+	ipr.priorVerificationTime += ipr.reconciledLoader.VerificationTime()
+	ipr.reconciledLoader.Cleanup(rm.ctx)
+	ipr.reconciledLoader = nil
+	ipr.traversalError = nil
+	ipr.remoteMissingBlocks = false
+	ipr.retries = 0
+	// the reissued request is new to the remote peer, so replies to cancels
+	// of the old one are never sent
+	ipr.cancelAcksExpected = 0
+	ipr.request = *ipr.reissueRequest
+	ipr.reissueRequest = nil
+	ipr.lastResponse.Store(gsmsg.NewResponse(requestID, graphsync.RequestAcknowledged, nil))
+	ipr.ctx, ipr.cancelFn = context.WithCancel(graphsync.ContextWithRequestInfo(trace.ContextWithSpan(rm.ctx, ipr.span), requestID, ipr.p))
+	rm.setState(ipr, graphsync.Queued)
+	// the reissued request continues a request that already held a slot, so
+	// it goes ahead of new requests
+	rm.requestQueue.PushTask(ipr.p, peertask.Task{Topic: requestID, Priority: math.MaxInt32, Work: 1, Data: taskqueue.RequestTaskData{DependsOn: ipr.dependsOn, Resumed: true}})
+}
+
 func (rm *RequestManager) validateRequest(requestID graphsync.RequestID, p peer.ID, root ipld.Link, selectorSpec ipld.Node, extensions []graphsync.ExtensionData) (gsmsg.GraphSyncRequest, hooks.RequestResult, *linking.LinkSystem, error) {
 	_, err := selector.ParseSelector(selectorSpec)
 	if err != nil {
@@ -386,6 +850,15 @@ func (rm *RequestManager) validateRequest(requestID graphsync.RequestID, p peer.
 	}
 	request := gsmsg.NewRequest(requestID, asCidLink.Cid, selectorSpec, defaultPriority, extensions...)
 	hooksResult := rm.requestHooks.ProcessRequestHooks(p, request)
+	if hooksResult.Err != nil {
+		return gsmsg.GraphSyncRequest{}, hooks.RequestResult{}, nil, hooksResult.Err
+	}
+	if hooksResult.Priority != request.Priority() {
+		request = request.ReplacePriority(hooksResult.Priority)
+	}
+	if len(hooksResult.Extensions) > 0 {
+		request = request.ReplaceExtensions(hooksResult.Extensions)
+	}
 	if hooksResult.PersistenceOption != "" {
 		dedupData, err := dedupkey.EncodeDedupKey(hooksResult.PersistenceOption)
 		if err != nil {
@@ -398,6 +871,14 @@ func (rm *RequestManager) validateRequest(requestID graphsync.RequestID, p peer.
 			},
 		})
 	}
+	if received := hooksResult.ResumeState.Received; received != nil && received.Len() > 0 {
+		request = request.ReplaceExtensions([]graphsync.ExtensionData{
+			{
+				Name: graphsync.ExtensionResume,
+				Data: cidset.EncodeCidSet(received),
+			},
+		})
+	}
 	lsys := rm.linkSystem
 	if hooksResult.PersistenceOption != "" {
 		var has bool
@@ -417,9 +898,12 @@ func (rm *RequestManager) unpause(id graphsync.RequestID, extensions []graphsync
 	if inProgressRequestStatus.state != graphsync.Paused {
 		return errors.New("request is not paused")
 	}
-	inProgressRequestStatus.state = graphsync.Queued
+	rm.setState(inProgressRequestStatus, graphsync.Queued)
 	inProgressRequestStatus.request = inProgressRequestStatus.request.ReplaceExtensions(extensions)
-	rm.requestQueue.PushTask(inProgressRequestStatus.p, peertask.Task{Topic: id, Priority: math.MaxInt32, Work: 1})
+	// the unpaused request already held a slot, so it goes ahead of new
+	// requests
+	rm.requestQueue.PushTask(inProgressRequestStatus.p, peertask.Task{Topic: id, Priority: math.MaxInt32, Work: 1, Data: taskqueue.RequestTaskData{DependsOn: inProgressRequestStatus.dependsOn, Resumed: true}})
+	rm.publishRequestEvent(inProgressRequestStatus, graphsync.RequestEventResumed, nil)
 	return nil
 }
 
@@ -428,8 +912,9 @@ func (rm *RequestManager) pause(id graphsync.RequestID) error {
 	if !ok {
 		return graphsync.RequestNotFoundErr{}
 	}
+	// pausing a paused request does nothing
 	if inProgressRequestStatus.state == graphsync.Paused {
-		return errors.New("request is already paused")
+		return nil
 	}
 	select {
 	case inProgressRequestStatus.pauseMessages <- struct{}{}:
@@ -448,6 +933,29 @@ func (rm *RequestManager) update(id graphsync.RequestID, extensions []graphsync.
 	return nil
 }
 
+// exportState takes a checkpoint of each request in progress, in the order
+// they started
+func (rm *RequestManager) exportState() []graphsync.RequestCheckpoint {
+	requests := make([]*inProgressRequestStatus, 0, len(rm.inProgressRequestStatuses))
+	for _, ipr := range rm.inProgressRequestStatuses {
+		requests = append(requests, ipr)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].startTime.Before(requests[j].startTime)
+	})
+	checkpoints := make([]graphsync.RequestCheckpoint, 0, len(requests))
+	for _, ipr := range requests {
+		checkpoints = append(checkpoints, graphsync.RequestCheckpoint{
+			Peer:       ipr.p,
+			Root:       ipr.request.Root(),
+			Selector:   ipr.request.Selector(),
+			Extensions: ipr.request.ApplicationExtensions(),
+			Received:   ipr.receivedCids.Snapshot(),
+		})
+	}
+	return checkpoints
+}
+
 func (rm *RequestManager) peerStats(p peer.ID) peerstate.PeerState {
 	var peerState peerstate.PeerState
 	rm.requestQueue.WithPeerTopics(p, func(peerTopics *peertracker.PeerTrackerTopics) {
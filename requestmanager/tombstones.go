@@ -0,0 +1,188 @@
+package requestmanager
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/limits"
+)
+
+// DefaultMaxTombstones is the number of completed requests remembered when
+// no limit is configured
+const DefaultMaxTombstones = 1024
+
+// lateMessageWindow is the period over which late messages from a peer are
+// counted against MaxLateMessagesPerPeer
+const lateMessageWindow = time.Second
+
+// tombstones remembers recently completed requests, so that responses that
+// arrive after a request ends can be told apart from responses for requests
+// that were never made, and so late subscribers can learn how a request ended.
+// Tombstones are forgotten least recently used first. A tombstone is used
+// when it absorbs a late message or is looked up for a subscriber. Late
+// messages from each peer are rate limited before they are looked up, so
+// replaying messages for old requests cannot churn the set.
+// Only accessed from the request manager's run loop
+type tombstones struct {
+	options graphsync.TombstoneOptions
+	clock   clock.Clock
+	entries map[graphsync.RequestID]*list.Element
+	// tombstones ordered from least to most recently used
+	order *list.List
+
+	// late messages received from each peer in the current window
+	windowStart  time.Time
+	lateMessages map[peer.ID]int
+
+	lateMessagesAbsorbed   uint64
+	unknownMessagesDropped uint64
+	rateLimitedMessages    uint64
+
+	limitRecorder *limits.Recorder
+}
+
+// tombstoneEntry is a tombstone and when it was last used
+type tombstoneEntry struct {
+	tombstone graphsync.RequestTombstone
+	lastUsed  time.Time
+}
+
+func newTombstones(options graphsync.TombstoneOptions, clock clock.Clock, limitRecorder *limits.Recorder) *tombstones {
+	if options.MaxCount <= 0 {
+		options.MaxCount = DefaultMaxTombstones
+	}
+	return &tombstones{
+		options:       options,
+		clock:         clock,
+		entries:       make(map[graphsync.RequestID]*list.Element),
+		order:         list.New(),
+		lateMessages:  make(map[peer.ID]int),
+		limitRecorder: limitRecorder,
+	}
+}
+
+// record adds a tombstone for a request that has just ended, evicting the
+// least recently used tombstones as needed to stay within limits
+func (ts *tombstones) record(p peer.ID, event graphsync.RequestEvent) {
+	if elem, ok := ts.entries[event.RequestID]; ok {
+		ts.order.Remove(elem)
+	}
+	ts.entries[event.RequestID] = ts.order.PushBack(&tombstoneEntry{
+		tombstone: graphsync.RequestTombstone{
+			RequestID: event.RequestID,
+			Peer:      p,
+			Event:     event,
+		},
+		lastUsed: ts.clock.Now(),
+	})
+	ts.evictExpired()
+	for ts.order.Len() > ts.options.MaxCount {
+		ts.limitRecorder.Hit(graphsync.LimitMaxRequestTombstones, graphsync.LimitScopeGlobal)
+		ts.evict(ts.order.Front())
+	}
+}
+
+// get returns the tombstone for the given request, if it is still remembered,
+// without using it
+func (ts *tombstones) get(requestID graphsync.RequestID) (graphsync.RequestTombstone, bool) {
+	ts.evictExpired()
+	elem, ok := ts.entries[requestID]
+	if !ok {
+		return graphsync.RequestTombstone{}, false
+	}
+	return elem.Value.(*tombstoneEntry).tombstone, true
+}
+
+// use returns the tombstone for the given request, if it is still remembered,
+// and marks it as the most recently used
+func (ts *tombstones) use(requestID graphsync.RequestID) (graphsync.RequestTombstone, bool) {
+	ts.evictExpired()
+	elem, ok := ts.entries[requestID]
+	if !ok {
+		return graphsync.RequestTombstone{}, false
+	}
+	entry := elem.Value.(*tombstoneEntry)
+	entry.lastUsed = ts.clock.Now()
+	ts.order.MoveToBack(elem)
+	return entry.tombstone, true
+}
+
+// remove forgets the tombstone for the given request, if any, when a new
+// request is made with the same ID
+func (ts *tombstones) remove(requestID graphsync.RequestID) {
+	if elem, ok := ts.entries[requestID]; ok {
+		ts.evict(elem)
+	}
+}
+
+// absorb accounts for a response from the given peer for a request that is
+// not in progress. Once a peer exceeds its limit on late messages, further
+// responses are counted without being looked up
+func (ts *tombstones) absorb(p peer.ID, requestID graphsync.RequestID) {
+	if ts.options.MaxLateMessagesPerPeer > 0 {
+		now := ts.clock.Now()
+		if now.Sub(ts.windowStart) >= lateMessageWindow {
+			ts.windowStart = now
+			ts.lateMessages = make(map[peer.ID]int)
+		}
+		ts.lateMessages[p]++
+		if ts.lateMessages[p] > ts.options.MaxLateMessagesPerPeer {
+			if ts.lateMessages[p] == ts.options.MaxLateMessagesPerPeer+1 {
+				log.Warnw("peer exceeded limit on responses for requests no longer in progress", "peer", p, "limit", ts.options.MaxLateMessagesPerPeer)
+			}
+			ts.rateLimitedMessages++
+			ts.limitRecorder.Hit(graphsync.LimitMaxLateMessagesPerPeer, graphsync.LimitScopePeer)
+			return
+		}
+	}
+	if tombstone, ok := ts.get(requestID); ok && tombstone.Peer == p {
+		ts.use(requestID)
+		ts.lateMessagesAbsorbed++
+		return
+	}
+	ts.unknownMessagesDropped++
+}
+
+// list returns all remembered tombstones, least recently used first
+func (ts *tombstones) list() []graphsync.RequestTombstone {
+	ts.evictExpired()
+	tombstones := make([]graphsync.RequestTombstone, 0, ts.order.Len())
+	for elem := ts.order.Front(); elem != nil; elem = elem.Next() {
+		tombstones = append(tombstones, elem.Value.(*tombstoneEntry).tombstone)
+	}
+	return tombstones
+}
+
+func (ts *tombstones) stats() graphsync.TombstoneStats {
+	ts.evictExpired()
+	return graphsync.TombstoneStats{
+		Count:                  uint64(ts.order.Len()),
+		LateMessagesAbsorbed:   ts.lateMessagesAbsorbed,
+		UnknownMessagesDropped: ts.unknownMessagesDropped,
+		RateLimitedMessages:    ts.rateLimitedMessages,
+	}
+}
+
+// evictExpired forgets tombstones that have not been used for MaxAge. The
+// least recently used are at the front, so it stops at the first that has
+func (ts *tombstones) evictExpired() {
+	if ts.options.MaxAge <= 0 {
+		return
+	}
+	now := ts.clock.Now()
+	for elem := ts.order.Front(); elem != nil; elem = ts.order.Front() {
+		if now.Sub(elem.Value.(*tombstoneEntry).lastUsed) <= ts.options.MaxAge {
+			return
+		}
+		ts.evict(elem)
+	}
+}
+
+func (ts *tombstones) evict(elem *list.Element) {
+	ts.order.Remove(elem)
+	delete(ts.entries, elem.Value.(*tombstoneEntry).tombstone.RequestID)
+}
@@ -1,8 +1,45 @@
 package types
 
+import (
+	"sync"
+
+	"github.com/ipfs/go-cid"
+)
+
 // AsyncLoadResult is sent once over the channel returned by an async load.
 type AsyncLoadResult struct {
 	Data  []byte
 	Local bool
 	Err   error
 }
+
+// ReceivedCids is the set of blocks a request has loaded and verified. It is
+// safe to use from multiple goroutines
+type ReceivedCids struct {
+	lk   sync.Mutex
+	cids *cid.Set
+}
+
+// NewReceivedCids returns an empty set of received blocks
+func NewReceivedCids() *ReceivedCids {
+	return &ReceivedCids{cids: cid.NewSet()}
+}
+
+// Add records a block as received
+func (rc *ReceivedCids) Add(c cid.Cid) {
+	rc.lk.Lock()
+	defer rc.lk.Unlock()
+	rc.cids.Add(c)
+}
+
+// Snapshot returns a copy of the blocks received so far
+func (rc *ReceivedCids) Snapshot() *cid.Set {
+	rc.lk.Lock()
+	defer rc.lk.Unlock()
+	snapshot := cid.NewSet()
+	_ = rc.cids.ForEach(func(c cid.Cid) error {
+		snapshot.Add(c)
+		return nil
+	})
+	return snapshot
+}
@@ -0,0 +1,67 @@
+package requestmanager
+
+import (
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+)
+
+// discardUnreferencedBlocks removes blocks that no response in the message
+// referenced from blkMap, counting them as wasted, so they are not held for
+// any request
+func (rm *RequestManager) discardUnreferencedBlocks(p peer.ID, responses []gsmsg.GraphSyncResponse, blkMap map[cid.Cid][]byte) {
+	referenced := make(map[cid.Cid]struct{}, len(blkMap))
+	for _, response := range responses {
+		response.Metadata().Iterate(func(link cid.Cid, action graphsync.LinkAction) {
+			if action == graphsync.LinkActionPresent {
+				referenced[link] = struct{}{}
+			}
+		})
+	}
+	for c, data := range blkMap {
+		if _, ok := referenced[c]; !ok {
+			log.Debugw("discarding unreferenced block", "peer", p, "cid", c.String(), "size", len(data))
+			rm.transferStats.RecordWasted(p, uint64(len(data)))
+			delete(blkMap, c)
+		}
+	}
+}
+
+// verifyResponseBlocks checks the blocks a response references in blkMap, if
+// strict verification is enabled, returning graphsync.ErrInvalidBlock for the
+// first that does not hash to its link or is too large
+func (rm *RequestManager) verifyResponseBlocks(response gsmsg.GraphSyncResponse, blkMap map[cid.Cid][]byte) error {
+	if !rm.strictVerification {
+		return nil
+	}
+	var err error
+	response.Metadata().Iterate(func(link cid.Cid, action graphsync.LinkAction) {
+		if err != nil || action != graphsync.LinkActionPresent {
+			return
+		}
+		data, ok := blkMap[link]
+		if !ok {
+			return
+		}
+		if rm.maxBlockSize > 0 && uint64(len(data)) > rm.maxBlockSize {
+			err = graphsync.ErrInvalidBlock{
+				Link:   cidlink.Link{Cid: link},
+				Reason: fmt.Sprintf("block size %d exceeds maximum of %d", len(data), rm.maxBlockSize),
+			}
+			return
+		}
+		c, hashErr := link.Prefix().Sum(data)
+		if hashErr != nil || !c.Equals(link) {
+			err = graphsync.ErrInvalidBlock{
+				Link:   cidlink.Link{Cid: link},
+				Reason: "block data does not match its cid",
+			}
+		}
+	})
+	return err
+}
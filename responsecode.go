@@ -51,6 +51,13 @@ const (
 	RequestFailedContentNotFound = ResponseStatusCode(34)
 	// RequestCancelled means the responder was processing the request but decided to top, for whatever reason
 	RequestCancelled = ResponseStatusCode(35)
+	// RequestFailedBudgetExceeded means the responder stopped traversing the
+	// request because it exceeded the responder's link or depth budget. The kind
+	// of budget may be contained in extra. It is only sent to requestors that
+	// list ExtensionSelectorBudgetExceeded in their supported extensions, since
+	// older peers fail to decode a message with a status they do not know.
+	// Other requestors are sent RequestFailedUnknown with the same extension
+	RequestFailedBudgetExceeded = ResponseStatusCode(36)
 )
 
 func (c ResponseStatusCode) String() string {
@@ -76,14 +83,17 @@ var ResponseCodeToName = map[ResponseStatusCode]string{
 	RequestFailedLegal:           "RequestFailedLegal",
 	RequestFailedContentNotFound: "RequestFailedContentNotFound",
 	RequestCancelled:             "RequestCancelled",
+	RequestFailedBudgetExceeded:  "RequestFailedBudgetExceeded",
 }
 
-// AsError generates an error from the status code for a failing status
+// AsError generates the error a requestor reports for a terminal status code.
+// Only RequestCompletedFull has no error
 func (c ResponseStatusCode) AsError() error {
-	if c.IsSuccess() {
-		return nil
-	}
 	switch c {
+	case RequestCompletedFull:
+		return nil
+	case RequestCompletedPartial:
+		return RequestCompletedPartialErr{}
 	case RequestFailedBusy:
 		return RequestFailedBusyErr{}
 	case RequestFailedContentNotFound:
@@ -94,8 +104,12 @@ func (c ResponseStatusCode) AsError() error {
 		return RequestFailedUnknownErr{}
 	case RequestCancelled:
 		return RequestCancelledErr{}
+	case RequestRejected:
+		return RequestRejectedErr{}
+	case RequestFailedBudgetExceeded:
+		return SelectorBudgetExceededErr{}
 	default:
-		return fmt.Errorf("unknown response status code: %d", c)
+		return UnknownResponseStatusErr{Code: c}
 	}
 }
 
@@ -113,7 +127,8 @@ func (c ResponseStatusCode) IsFailure() bool {
 		c == RequestFailedLegal ||
 		c == RequestFailedUnknown ||
 		c == RequestCancelled ||
-		c == RequestRejected
+		c == RequestRejected ||
+		c == RequestFailedBudgetExceeded
 }
 
 // IsTerminal returns true if the response code signals
@@ -0,0 +1,53 @@
+package graphsync_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+func TestResponseStatusCodeAsError(t *testing.T) {
+	// every defined status code must appear here, so a new code cannot be
+	// added without deciding the error a requestor sees for it
+	testCases := map[graphsync.ResponseStatusCode]error{
+		graphsync.RequestAcknowledged:          graphsync.UnknownResponseStatusErr{Code: graphsync.RequestAcknowledged},
+		graphsync.AdditionalPeers:              graphsync.UnknownResponseStatusErr{Code: graphsync.AdditionalPeers},
+		graphsync.NotEnoughGas:                 graphsync.UnknownResponseStatusErr{Code: graphsync.NotEnoughGas},
+		graphsync.OtherProtocol:                graphsync.UnknownResponseStatusErr{Code: graphsync.OtherProtocol},
+		graphsync.PartialResponse:              graphsync.UnknownResponseStatusErr{Code: graphsync.PartialResponse},
+		graphsync.RequestPaused:                graphsync.UnknownResponseStatusErr{Code: graphsync.RequestPaused},
+		graphsync.RequestCompletedFull:         nil,
+		graphsync.RequestCompletedPartial:      graphsync.RequestCompletedPartialErr{},
+		graphsync.RequestRejected:              graphsync.RequestRejectedErr{},
+		graphsync.RequestFailedBusy:            graphsync.RequestFailedBusyErr{},
+		graphsync.RequestFailedUnknown:         graphsync.RequestFailedUnknownErr{},
+		graphsync.RequestFailedLegal:           graphsync.RequestFailedLegalErr{},
+		graphsync.RequestFailedContentNotFound: graphsync.RequestFailedContentNotFoundErr{},
+		graphsync.RequestCancelled:             graphsync.RequestCancelledErr{},
+		graphsync.RequestFailedBudgetExceeded:  graphsync.SelectorBudgetExceededErr{},
+	}
+	for code, name := range graphsync.ResponseCodeToName {
+		expected, ok := testCases[code]
+		require.True(t, ok, "no expected error for status %s", name)
+		t.Run(name, func(t *testing.T) {
+			err := code.AsError()
+			if expected == nil {
+				require.NoError(t, err)
+				return
+			}
+			require.IsType(t, expected, err)
+			require.Equal(t, expected, err)
+			// only terminal codes have errors of their own
+			_, unknown := err.(graphsync.UnknownResponseStatusErr)
+			require.Equal(t, !code.IsTerminal(), unknown)
+		})
+	}
+	require.Len(t, testCases, len(graphsync.ResponseCodeToName))
+
+	t.Run("undefined status", func(t *testing.T) {
+		code := graphsync.ResponseStatusCode(39)
+		require.Equal(t, graphsync.UnknownResponseStatusErr{Code: code}, code.AsError())
+	})
+}
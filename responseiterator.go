@@ -0,0 +1,99 @@
+package graphsync
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// ResponseIterator reads the results of a request one at a time, as an
+// alternative to reading the two channels returned by GraphExchange.Request
+// at once
+type ResponseIterator struct {
+	cancel    context.CancelFunc
+	responses <-chan ResponseProgress
+	errors    <-chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// only touched by Next
+	responsesDone bool
+	errorsDone    bool
+}
+
+// NewResponseIterator sends a request to the given peer and returns an
+// iterator over its results. The request runs until it completes, ctx is
+// cancelled, or the iterator is closed
+func NewResponseIterator(ctx context.Context, gs GraphExchange, p peer.ID, root cid.Cid, sel ipld.Node, exts ...ExtensionData) *ResponseIterator {
+	ctx, cancel := context.WithCancel(ctx)
+	responses, errors := gs.Request(ctx, p, cidlink.Link{Cid: root}, sel, exts...)
+	return &ResponseIterator{
+		cancel:    cancel,
+		responses: responses,
+		errors:    errors,
+		closed:    make(chan struct{}),
+	}
+}
+
+// Next blocks until the next node in the traversal or the next error is
+// available. An error does not necessarily end the request, so callers that
+// want every result keep calling Next until it returns io.EOF, which it does
+// once the request has finished or the iterator is closed.
+// Next must not be called from more than one goroutine at a time
+func (ri *ResponseIterator) Next() (ResponseProgress, error) {
+	select {
+	case <-ri.closed:
+		return ResponseProgress{}, io.EOF
+	default:
+	}
+	for !ri.responsesDone || !ri.errorsDone {
+		responses, errors := ri.responses, ri.errors
+		if ri.responsesDone {
+			responses = nil
+		}
+		if ri.errorsDone {
+			errors = nil
+		}
+		select {
+		case <-ri.closed:
+			return ResponseProgress{}, io.EOF
+		case progress, ok := <-responses:
+			if !ok {
+				ri.responsesDone = true
+				continue
+			}
+			return progress, nil
+		case err, ok := <-errors:
+			if !ok {
+				ri.errorsDone = true
+				continue
+			}
+			return ResponseProgress{}, err
+		}
+	}
+	return ResponseProgress{}, io.EOF
+}
+
+// Close cancels the request if it is still in progress. Results that arrive
+// afterward are discarded. Close may be called from any goroutine, and more
+// than once
+func (ri *ResponseIterator) Close() error {
+	ri.closeOnce.Do(func() {
+		close(ri.closed)
+		ri.cancel()
+		go func() {
+			for range ri.responses {
+			}
+		}()
+		go func() {
+			for range ri.errors {
+			}
+		}()
+	})
+	return nil
+}
@@ -3,6 +3,7 @@ package responsemanager
 import (
 	"context"
 	"errors"
+	"sort"
 	"time"
 
 	logging "github.com/ipfs/go-log/v2"
@@ -19,10 +20,13 @@ import (
 	"github.com/ipfs/go-graphsync/notifications"
 	"github.com/ipfs/go-graphsync/panics"
 	"github.com/ipfs/go-graphsync/peerstate"
+	"github.com/ipfs/go-graphsync/requestcounts"
 	"github.com/ipfs/go-graphsync/responsemanager/hooks"
 	"github.com/ipfs/go-graphsync/responsemanager/queryexecutor"
 	"github.com/ipfs/go-graphsync/responsemanager/responseassembler"
+	"github.com/ipfs/go-graphsync/selectorcache"
 	"github.com/ipfs/go-graphsync/taskqueue"
+	"github.com/ipfs/go-graphsync/transferstats"
 )
 
 // The code in this file implements the public interface of the response manager.
@@ -32,24 +36,60 @@ import (
 var log = logging.Logger("graphsync")
 
 type inProgressResponseStatus struct {
-	ctx            context.Context
-	span           trace.Span
-	cancelFn       func()
-	peer           peer.ID
-	request        gsmsg.GraphSyncRequest
-	linkSystem     ipld.LinkSystem
-	customChooser  traversal.LinkTargetNodePrototypeChooser
-	traverser      ipldutil.Traverser
-	signals        queryexecutor.ResponseSignals
-	updates        []gsmsg.GraphSyncRequest
-	state          graphsync.RequestState
-	startTime      time.Time
-	responseStream responseassembler.ResponseStream
+	ctx      context.Context
+	span     trace.Span
+	cancelFn func()
+	peer     peer.ID
+	request  gsmsg.GraphSyncRequest
+	// the selector the response traverses, which a hook may have substituted
+	// for the request's selector
+	selector   ipld.Node
+	linkSystem ipld.LinkSystem
+	// the persistence option linkSystem came from, empty for the default
+	persistenceOption string
+	customChooser     traversal.LinkTargetNodePrototypeChooser
+	traverser         ipldutil.Traverser
+	loader            ipld.BlockReadOpener
+	signals           queryexecutor.ResponseSignals
+	updates           []gsmsg.GraphSyncRequest
+	state             graphsync.RequestState
+	startTime         time.Time
+	responseStream    responseassembler.ResponseStream
+	subscriber        *subscriber
+	// cancels the context blocks are loaded with while the response is
+	// running, so a slow load stops when the response is paused or aborted
+	interruptLoad context.CancelFunc
+	// the task the response is running in, nil if it is not running
+	task *peertask.Task
+	// ends the response once the requestor's deadline passes, nil if the
+	// requestor did not set one
+	deadline *time.Timer
+	// the reason the response ended early, nil if it has not
+	err error
+	// set while async validators decide whether to accept the request. The
+	// response is not queued for processing until they do
+	validating bool
+	// the extensions the requestor reported it supports, nil if it has not
+	peerExtensions []graphsync.ExtensionName
+	// the total size of the blocks sent over the network for the response,
+	// only accessed by the task running the response
+	bytesSent uint64
+}
+
+// peerSupports returns true if the requestor reported it supports the given
+// extension
+func (ipr *inProgressResponseStatus) peerSupports(name graphsync.ExtensionName) bool {
+	for _, peerExtension := range ipr.peerExtensions {
+		if peerExtension == name {
+			return true
+		}
+	}
+	return false
 }
 
 // RequestHooks is an interface for processing request hooks
 type RequestHooks interface {
-	ProcessRequestHooks(p peer.ID, request graphsync.RequestData, ctx context.Context) hooks.RequestResult
+	ProcessRequestHooks(p peer.ID, request graphsync.RequestData, peerExtensions []graphsync.ExtensionName, ctx context.Context) hooks.RequestResult
 }
 
 // UpdateHooks is an interface for processing update hooks
@@ -57,6 +97,17 @@ type UpdateHooks interface {
 	ProcessUpdateHooks(p peer.ID, request graphsync.RequestData, update graphsync.RequestData) hooks.UpdateResult
 }
 
+// AsyncValidators is an interface for running async validators on requests
+type AsyncValidators interface {
+	HasValidators() bool
+	Validate(ctx context.Context, p peer.ID, request graphsync.RequestData) hooks.ValidationResult
+}
+
+// CompletingHooks is an interface for processing hooks for responses that are ending
+type CompletingHooks interface {
+	ProcessCompletingResponseHooks(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode) []graphsync.ExtensionData
+}
+
 // CompletedListeners is an interface for notifying listeners that responses are complete
 type CompletedListeners interface {
 	NotifyCompletedListeners(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode)
@@ -77,6 +128,11 @@ type RequestProcessingListeners interface {
 	NotifyRequestProcessingListeners(p peer.ID, request graphsync.RequestData, inProgressRequestCount int)
 }
 
+// RequestQueuedHooks is an interface for notifying hooks a request has been queued
+type RequestQueuedHooks interface {
+	ProcessRequestQueuedHooks(p peer.ID, request graphsync.RequestData)
+}
+
 // NetworkErrorListeners is an interface for notifying listeners that an error occurred sending a data on the wire
 type NetworkErrorListeners interface {
 	NotifyNetworkErrorListeners(p peer.ID, request graphsync.RequestData, err error)
@@ -85,6 +141,7 @@ type NetworkErrorListeners interface {
 // ResponseAssembler is an interface that returns sender interfaces for peer responses.
 type ResponseAssembler interface {
 	NewStream(ctx context.Context, p peer.ID, requestID graphsync.RequestID, subscriber notifications.Subscriber) responseassembler.ResponseStream
+	RejectDuplicate(p peer.ID, requestID graphsync.RequestID)
 }
 
 type responseManagerMessage interface {
@@ -100,7 +157,9 @@ type ResponseManager struct {
 	requestHooks               RequestHooks
 	linkSystem                 ipld.LinkSystem
 	requestProcessingListeners RequestProcessingListeners
+	requestQueuedHooks         RequestQueuedHooks
 	updateHooks                UpdateHooks
+	completingHooks            CompletingHooks
 	cancelledListeners         CancelledListeners
 	completedListeners         CompletedListeners
 	blockSentListeners         BlockSentListeners
@@ -110,8 +169,45 @@ type ResponseManager struct {
 	connManager                network.ConnManager
 	// maximum number of links to traverse per request. A value of zero = infinity, or no limit
 	maxLinksPerRequest uint64
-	panicCallback      panics.CallBackFn
-	responseQueue      taskqueue.TaskQueue
+	// maximum number of links deep to traverse per request. A value of zero = infinity, or no limit
+	maxRecursionDepth int64
+	panicCallback     panics.CallBackFn
+	responseQueue     taskqueue.TaskQueue
+	// compiles selectors for traversals, nil if compiled selectors are not cached
+	selectorCache *selectorcache.SelectorCache
+	metrics       graphsync.MetricsRecorder
+	transferStats *transferstats.Tracker
+	// counts responses in each state, may be nil
+	requestCounts *requestcounts.Tracker
+	// extensions reported to requestors that negotiate them, nil if
+	// negotiation is disabled
+	supportedExtensions []graphsync.ExtensionName
+	blockCompression    graphsync.CompressionCodec
+	// chooses node prototypes for traversals when hooks do not set a chooser,
+	// nil for the built in default
+	defaultChooser traversal.LinkTargetNodePrototypeChooser
+	// blocks read from storage at once for each response, blocks are read
+	// one at a time if 1 or less
+	loadConcurrency int
+	// new requests from a peer with this many responses in progress are
+	// rejected, zero for no limit
+	maxInProgressPerPeer uint64
+	// responses in progress for each peer
+	inProgressPerPeer map[peer.ID]uint64
+	// the extensions each requestor reported it supports, with the first
+	// request it sent since it connected
+	peerExtensions map[peer.ID][]graphsync.ExtensionName
+	// decide whether to accept requests after request hooks, may be nil
+	asyncValidators AsyncValidators
+	// how long async validators have to decide, zero for no limit
+	asyncValidationTimeout time.Duration
+	// once set, new incoming requests are rejected
+	closing bool
+	// closed once there are no responses in progress
+	drainedWaiters []chan struct{}
+
+	// closed when the internal thread exits
+	stopped chan struct{}
 }
 
 // New creates a new response manager for responding to requests
@@ -119,16 +215,20 @@ func New(ctx context.Context,
 	linkSystem ipld.LinkSystem,
 	responseAssembler ResponseAssembler,
 	requestProcessingListeners RequestProcessingListeners,
+	requestQueuedHooks RequestQueuedHooks,
 	requestHooks RequestHooks,
 	updateHooks UpdateHooks,
+	completingHooks CompletingHooks,
 	completedListeners CompletedListeners,
 	cancelledListeners CancelledListeners,
 	blockSentListeners BlockSentListeners,
 	networkErrorListeners NetworkErrorListeners,
 	connManager network.ConnManager,
 	maxLinksPerRequest uint64,
+	maxRecursionDepth int64,
 	panicCallback panics.CallBackFn,
 	responseQueue taskqueue.TaskQueue,
+	selectorCache *selectorcache.SelectorCache,
 ) *ResponseManager {
 	ctx, cancelFn := context.WithCancel(ctx)
 	messages := make(chan responseManagerMessage, 16)
@@ -139,24 +239,104 @@ func New(ctx context.Context,
 		linkSystem:                 linkSystem,
 		responseAssembler:          responseAssembler,
 		requestProcessingListeners: requestProcessingListeners,
+		requestQueuedHooks:         requestQueuedHooks,
 		updateHooks:                updateHooks,
+		completingHooks:            completingHooks,
 		cancelledListeners:         cancelledListeners,
 		completedListeners:         completedListeners,
 		blockSentListeners:         blockSentListeners,
 		networkErrorListeners:      networkErrorListeners,
 		messages:                   messages,
 		inProgressResponses:        make(map[graphsync.RequestID]*inProgressResponseStatus),
+		inProgressPerPeer:          make(map[peer.ID]uint64),
+		peerExtensions:             make(map[peer.ID][]graphsync.ExtensionName),
 		connManager:                connManager,
 		maxLinksPerRequest:         maxLinksPerRequest,
+		maxRecursionDepth:          maxRecursionDepth,
 		responseQueue:              responseQueue,
 		panicCallback:              panicCallback,
+		selectorCache:              selectorCache,
+		metrics:                    &graphsync.NoopMetricsRecorder{},
+		stopped:                    make(chan struct{}),
 	}
 	return rm
 }
 
+// SetMetricsRecorder sets where the response manager reports request and
+// block metrics. It must be called before Startup
+func (rm *ResponseManager) SetMetricsRecorder(metrics graphsync.MetricsRecorder) {
+	rm.metrics = metrics
+}
+
+// SetTransferStats sets where blocks transferred for each response are
+// counted. The response manager tracks each response from when the request
+// arrives until the response is no longer in progress. It must be called
+// before Startup
+func (rm *ResponseManager) SetTransferStats(transferStats *transferstats.Tracker) {
+	rm.transferStats = transferStats
+}
+
+// SetRequestCounts sets where responses are counted in each state as they
+// move between states. It must be called before Startup
+func (rm *ResponseManager) SetRequestCounts(requestCounts *requestcounts.Tracker) {
+	rm.requestCounts = requestCounts
+}
+
+// SetMaxInProgressPerPeer sets how many responses may be in progress for a
+// single peer, in any state. New requests from a peer at the limit are
+// rejected without running request hooks. Zero means no limit. It must be
+// called before Startup
+func (rm *ResponseManager) SetMaxInProgressPerPeer(maxInProgressPerPeer uint64) {
+	rm.maxInProgressPerPeer = maxInProgressPerPeer
+}
+
+// SetAsyncValidators sets the validators that decide whether to accept
+// requests once request hooks accept them, and how long they have to decide.
+// A timeout of zero means validators may take as long as the response is in
+// progress. It must be called before Startup
+func (rm *ResponseManager) SetAsyncValidators(asyncValidators AsyncValidators, timeout time.Duration) {
+	rm.asyncValidators = asyncValidators
+	rm.asyncValidationTimeout = timeout
+}
+
+// SetLoadConcurrency sets how many blocks may be read from storage at once
+// for each response. With more than one, blocks linked from each block loaded
+// are read ahead of the traversal. It must be called before Startup
+func (rm *ResponseManager) SetLoadConcurrency(loadConcurrency int) {
+	rm.loadConcurrency = loadConcurrency
+}
+
+// SetSupportedExtensions sets the extensions reported to requestors that send
+// a supported-extensions extension. If it is not called, the extension is
+// ignored. It must be called before Startup
+func (rm *ResponseManager) SetSupportedExtensions(supportedExtensions []graphsync.ExtensionName) {
+	rm.supportedExtensions = supportedExtensions
+}
+
+// SetBlockCompression compresses the blocks sent in response to requests that
+// ask for blocks compressed with the given codec. It must be called before
+// Startup
+func (rm *ResponseManager) SetBlockCompression(codec graphsync.CompressionCodec) {
+	rm.blockCompression = codec
+}
+
+// SetDefaultChooser sets the node prototype chooser for the traversals of
+// responses that hooks do not set a chooser for. It must be called before
+// Startup
+func (rm *ResponseManager) SetDefaultChooser(chooser traversal.LinkTargetNodePrototypeChooser) {
+	rm.defaultChooser = chooser
+}
+
 // ProcessRequests processes incoming requests for the given peer
 func (rm *ResponseManager) ProcessRequests(ctx context.Context, p peer.ID, requests []gsmsg.GraphSyncRequest) {
-	rm.send(&processRequestsMessage{p, requests}, ctx.Done())
+	rm.send(&processRequestsMessage{p, requests, false}, ctx.Done())
+}
+
+// RejectRequests processes incoming requests for the given peer like
+// ProcessRequests, except that new requests are rejected without running
+// hooks or starting a traversal
+func (rm *ResponseManager) RejectRequests(ctx context.Context, p peer.ID, requests []gsmsg.GraphSyncRequest) {
+	rm.send(&processRequestsMessage{p, requests, true}, ctx.Done())
 }
 
 // UnpauseResponse unpauses a response that was previously paused
@@ -247,6 +427,11 @@ func (rm *ResponseManager) CloseWithNetworkError(requestID graphsync.RequestID)
 	}
 }
 
+// Disconnected ends every response to a peer that disconnected
+func (rm *ResponseManager) Disconnected(p peer.ID) {
+	rm.send(&disconnectedMessage{p}, nil)
+}
+
 // TerminateRequest indicates a request has finished sending data and should no longer be tracked
 func (rm *ResponseManager) TerminateRequest(requestID graphsync.RequestID) {
 	done := make(chan struct{}, 1)
@@ -257,6 +442,71 @@ func (rm *ResponseManager) TerminateRequest(requestID graphsync.RequestID) {
 	}
 }
 
+// Drain rejects any new requests, and lets responses already in progress
+// carry on. It returns once no responses are in progress, or ctx is cancelled
+func (rm *ResponseManager) Drain(ctx context.Context) error {
+	drained := make(chan struct{})
+	rm.send(&drainResponsesMessage{drained}, ctx.Done())
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-rm.ctx.Done():
+		return errors.New("context cancelled")
+	case <-drained:
+		return nil
+	}
+}
+
+// CancelAllResponses cancels every in progress response, sending a
+// cancellation status to each requestor, and rejects any new requests. It
+// returns once all responses have finished sending, or ctx is cancelled
+func (rm *ResponseManager) CancelAllResponses(ctx context.Context) error {
+	drained := make(chan struct{})
+	rm.send(&cancelAllResponsesMessage{drained}, ctx.Done())
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-rm.ctx.Done():
+		return errors.New("context cancelled")
+	case <-drained:
+		return nil
+	}
+}
+
+// InProgressResponses lists the incoming requests that are still being
+// responded to, in the order they arrived. Only a snapshot is taken on the
+// internal thread, so calling this does not hold up in progress responses
+func (rm *ResponseManager) InProgressResponses() []graphsync.InProgressResponseInfo {
+	response := make(chan []responseSnapshot, 1)
+	rm.send(&inProgressResponsesMessage{response}, nil)
+	var snapshots []responseSnapshot
+	select {
+	case <-rm.ctx.Done():
+		return nil
+	case snapshots = <-response:
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].startTime.Before(snapshots[j].startTime)
+	})
+	responses := make([]graphsync.InProgressResponseInfo, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		stats, _ := rm.transferStats.Request(snapshot.request.ID())
+		responses = append(responses, graphsync.InProgressResponseInfo{
+			RequestID:         snapshot.request.ID(),
+			Peer:              snapshot.p,
+			Root:              snapshot.request.Root(),
+			Selector:          snapshot.request.SelectorString(),
+			State:             snapshot.state,
+			BlocksProcessed:   stats.BlocksQueued,
+			BytesProcessed:    stats.BytesQueued,
+			StartTime:         snapshot.startTime,
+			PersistenceOption: snapshot.persistenceOption,
+			Extensions:        snapshot.request.ApplicationExtensions(),
+		})
+	}
+	return responses
+}
+
 // PeerState gets current state of the outgoing responses for a given peer
 func (rm *ResponseManager) PeerState(p peer.ID) peerstate.PeerState {
 	response := make(chan peerstate.PeerState)
@@ -269,6 +519,28 @@ func (rm *ResponseManager) PeerState(p peer.ID) peerstate.PeerState {
 	}
 }
 
+// validateRequest runs async validators on a response's request, then hands
+// the result to the internal thread. It runs on its own goroutine, and the
+// context validators get is cancelled if the response ends before they decide
+func (rm *ResponseManager) validateRequest(response *inProgressResponseStatus) {
+	ctx := response.ctx
+	if rm.asyncValidationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rm.asyncValidationTimeout)
+		defer cancel()
+	}
+	result := func() (result hooks.ValidationResult) {
+		panicHandler := panics.MakeHandler(rm.panicCallback)
+		defer func() {
+			if err := panicHandler(recover()); err != nil {
+				result = hooks.ValidationResult{Err: err}
+			}
+		}()
+		return rm.asyncValidators.Validate(ctx, response.peer, response.request)
+	}()
+	rm.send(&validationCompleteMessage{response, result}, nil)
+}
+
 func (rm *ResponseManager) send(message responseManagerMessage, done <-chan struct{}) {
 	select {
 	case <-rm.ctx.Done():
@@ -282,6 +554,12 @@ func (rm *ResponseManager) Startup() {
 	go rm.run()
 }
 
+// Stopped returns a channel that is closed once the response manager has
+// completely stopped after Shutdown
+func (rm *ResponseManager) Stopped() <-chan struct{} {
+	return rm.stopped
+}
+
 // Shutdown ends processing for the want manager.
 func (rm *ResponseManager) Shutdown() {
 	rm.cancelFn()
@@ -0,0 +1,89 @@
+package hooks
+
+import (
+	"context"
+
+	"github.com/hannahhoward/go-pubsub"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/hookset"
+	"github.com/ipfs/go-graphsync/panics"
+)
+
+// AsyncRequestValidators manages and runs validators that decide whether to
+// accept incoming requests off the message processing path
+type AsyncRequestValidators struct {
+	validators *hookset.HookSet
+}
+
+// ValidationResult is the outcome of running async validators on a request
+type ValidationResult struct {
+	Accepted   bool
+	Extensions []graphsync.ExtensionData
+	Err        error
+}
+
+type internalValidationEvent struct {
+	ctx     context.Context
+	p       peer.ID
+	request graphsync.RequestData
+	result  *ValidationResult
+}
+
+type errRejected struct{}
+
+func (errRejected) Error() string { return "request rejected" }
+
+func validatorDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+	ie := event.(internalValidationEvent)
+	validator := subscriberFn.(graphsync.AsyncRequestValidator)
+	accepted, extensions, err := validator(ie.ctx, ie.p, ie.request)
+	ie.result.Extensions = append(ie.result.Extensions, extensions...)
+	if err == nil && ie.ctx.Err() != nil {
+		err = ie.ctx.Err()
+	}
+	if err != nil {
+		ie.result.Err = err
+		return err
+	}
+	if !accepted {
+		return errRejected{}
+	}
+	return nil
+}
+
+// NewAsyncRequestValidators returns a new list of async request validators
+func NewAsyncRequestValidators(options ...hookset.Option) *AsyncRequestValidators {
+	options = append([]hookset.Option{hookset.WithHookType("async-request-validator")}, options...)
+	return &AsyncRequestValidators{validators: hookset.New(validatorDispatcher, options...)}
+}
+
+// Register registers a validator for incoming requests
+func (arv *AsyncRequestValidators) Register(validator graphsync.AsyncRequestValidator) graphsync.UnregisterHookFunc {
+	return arv.validators.Register(validator)
+}
+
+// UnregisterAll removes all registered validators
+func (arv *AsyncRequestValidators) UnregisterAll() {
+	arv.validators.UnregisterAll()
+}
+
+// HasValidators returns true if any validators are registered
+func (arv *AsyncRequestValidators) HasValidators() bool {
+	return len(arv.validators.Hooks()) > 0
+}
+
+// Validate runs validators on a request in the order they were registered,
+// stopping at the first that does not accept it. The request is accepted only
+// if every validator accepts it before ctx is done
+func (arv *AsyncRequestValidators) Validate(ctx context.Context, p peer.ID, request graphsync.RequestData) ValidationResult {
+	result := ValidationResult{}
+	err := arv.validators.Publish(internalValidationEvent{ctx, p, request, &result})
+	if err == nil {
+		result.Accepted = true
+	} else if _, panicked := err.(panics.RecoveredPanicErr); panicked {
+		result.Err = err
+	}
+	return result
+}
@@ -5,6 +5,7 @@ import (
 	peer "github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/hookset"
 )
 
 // ErrPaused indicates a request should stop processing, but only cause it's paused
@@ -14,7 +15,7 @@ func (e ErrPaused) Error() string { return "request has been paused" }
 
 // OutgoingBlockHooks is a set of outgoing block hooks that can be processed
 type OutgoingBlockHooks struct {
-	pubSub *pubsub.PubSub
+	hooks *hookset.HookSet
 }
 
 type internalBlockHookEvent struct {
@@ -32,35 +33,52 @@ func blockHookDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) e
 }
 
 // NewBlockHooks returns a new list of outgoing block hooks
-func NewBlockHooks() *OutgoingBlockHooks {
-	return &OutgoingBlockHooks{pubSub: pubsub.New(blockHookDispatcher)}
+func NewBlockHooks(options ...hookset.Option) *OutgoingBlockHooks {
+	options = append([]hookset.Option{hookset.WithHookType("outgoing-block")}, options...)
+	return &OutgoingBlockHooks{hooks: hookset.New(blockHookDispatcher, options...)}
 }
 
 // Register registers an hook to process outgoing blocks in a response
 func (obh *OutgoingBlockHooks) Register(hook graphsync.OnOutgoingBlockHook) graphsync.UnregisterHookFunc {
-	return graphsync.UnregisterHookFunc(obh.pubSub.Subscribe(hook))
+	return obh.hooks.Register(hook)
+}
+
+// UnregisterAll removes all registered hooks
+func (obh *OutgoingBlockHooks) UnregisterAll() {
+	obh.hooks.UnregisterAll()
 }
 
 // BlockResult is the result of processing block hooks
 type BlockResult struct {
 	Err        error
 	Extensions []graphsync.ExtensionData
+	// BytesSent is the total size of the blocks sent over the network for the
+	// request, including this block
+	BytesSent uint64
 }
 
-// ProcessBlockHooks runs block hooks against a request and block data
-func (obh *OutgoingBlockHooks) ProcessBlockHooks(p peer.ID, request graphsync.RequestData, blockData graphsync.BlockData) BlockResult {
-	bha := &blockHookActions{}
-	_ = obh.pubSub.Publish(internalBlockHookEvent{p, request, blockData, bha})
+// ProcessBlockHooks runs block hooks against a request and block data.
+// bytesSent is the total size of the blocks already sent for the request
+func (obh *OutgoingBlockHooks) ProcessBlockHooks(p peer.ID, request graphsync.RequestData, blockData graphsync.BlockData, bytesSent uint64) BlockResult {
+	bha := &blockHookActions{bytesSent: bytesSent + blockData.BlockSizeOnWire()}
+	if err := obh.hooks.Publish(internalBlockHookEvent{p, request, blockData, bha}); err != nil {
+		bha.err = err
+	}
 	return bha.result()
 }
 
 type blockHookActions struct {
 	err        error
 	extensions []graphsync.ExtensionData
+	bytesSent  uint64
 }
 
 func (bha *blockHookActions) result() BlockResult {
-	return BlockResult{bha.err, bha.extensions}
+	return BlockResult{Err: bha.err, Extensions: bha.extensions, BytesSent: bha.bytesSent}
+}
+
+func (bha *blockHookActions) BytesSent() uint64 {
+	return bha.bytesSent
 }
 
 func (bha *blockHookActions) SendExtensionData(data graphsync.ExtensionData) {
@@ -0,0 +1,62 @@
+package hooks
+
+import (
+	"github.com/hannahhoward/go-pubsub"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/hookset"
+)
+
+// CompletingResponseHooks manages and runs hooks for responses that are ending
+type CompletingResponseHooks struct {
+	hooks *hookset.HookSet
+}
+
+type internalCompletingResponseEvent struct {
+	p       peer.ID
+	request graphsync.RequestData
+	status  graphsync.ResponseStatusCode
+	cha     *completingHookActions
+}
+
+func completingHookDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn) error {
+	ie := event.(internalCompletingResponseEvent)
+	hook := subscriberFn.(graphsync.OnCompletingResponseHook)
+	hook(ie.p, ie.request, ie.status, ie.cha)
+	return nil
+}
+
+// NewCompletingResponseHooks returns a new list of completing response hooks
+func NewCompletingResponseHooks(options ...hookset.Option) *CompletingResponseHooks {
+	options = append([]hookset.Option{hookset.WithHookType("completing-response")}, options...)
+	return &CompletingResponseHooks{hooks: hookset.New(completingHookDispatcher, options...)}
+}
+
+// Register registers an hook to process responses that are ending
+func (crh *CompletingResponseHooks) Register(hook graphsync.OnCompletingResponseHook) graphsync.UnregisterHookFunc {
+	return crh.hooks.Register(hook)
+}
+
+// UnregisterAll removes all registered hooks
+func (crh *CompletingResponseHooks) UnregisterAll() {
+	crh.hooks.UnregisterAll()
+}
+
+// ProcessCompletingResponseHooks runs completing response hooks for a response
+// ending with the given status, returning the extensions to send with the
+// final status. The response is already ending, so a hook that panics only
+// stops the hooks after it from running
+func (crh *CompletingResponseHooks) ProcessCompletingResponseHooks(p peer.ID, request graphsync.RequestData, status graphsync.ResponseStatusCode) []graphsync.ExtensionData {
+	ha := &completingHookActions{}
+	_ = crh.hooks.Publish(internalCompletingResponseEvent{p, request, status, ha})
+	return ha.extensions
+}
+
+type completingHookActions struct {
+	extensions []graphsync.ExtensionData
+}
+
+func (cha *completingHookActions) SendExtensionData(data graphsync.ExtensionData) {
+	cha.extensions = append(cha.extensions, data)
+}
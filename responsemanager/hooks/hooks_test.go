@@ -4,17 +4,20 @@ import (
 	"context"
 	"errors"
 	"io"
+	"sync"
 	"testing"
 
 	"github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
 	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	peer "github.com/libp2p/go-libp2p-core/peer"
 	"github.com/stretchr/testify/require"
 
 	"github.com/ipfs/go-graphsync"
 	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/panics"
 	"github.com/ipfs/go-graphsync/responsemanager/hooks"
 	"github.com/ipfs/go-graphsync/testutil"
 )
@@ -71,6 +74,7 @@ func TestRequestHookProcessing(t *testing.T) {
 				require.Empty(t, result.Extensions)
 				require.Nil(t, result.CustomChooser)
 				require.Nil(t, result.CustomLinkSystem.StorageReadOpener)
+				require.Equal(t, request.Priority(), result.Priority)
 				require.NoError(t, result.Err)
 			},
 		},
@@ -139,6 +143,24 @@ func TestRequestHookProcessing(t *testing.T) {
 				require.NoError(t, result.Err)
 			},
 		},
+		"all hooks unregistered": {
+			configure: func(t *testing.T, requestHooks *hooks.IncomingRequestHooks) {
+				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+					hookActions.ValidateRequest()
+				})
+				unregister := requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+					hookActions.SendExtensionData(extensionResponse)
+				})
+				requestHooks.UnregisterAll()
+				// unregistering a hook already removed by UnregisterAll does nothing
+				unregister()
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.False(t, result.IsValidated)
+				require.Empty(t, result.Extensions)
+				require.NoError(t, result.Err)
+			},
+		},
 		"hooks alter the loader": {
 			configure: func(t *testing.T, requestHooks *hooks.IncomingRequestHooks) {
 				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
@@ -172,7 +194,7 @@ func TestRequestHookProcessing(t *testing.T) {
 				require.Contains(t, result.Extensions, extensionResponse)
 				require.Nil(t, result.CustomChooser)
 				require.Nil(t, result.CustomLinkSystem.StorageReadOpener)
-				require.EqualError(t, result.Err, "unknown loader option")
+				require.EqualError(t, result.Err, "unknown loader option: applesauce")
 			},
 		},
 		"hooks alter the node builder chooser": {
@@ -206,6 +228,51 @@ func TestRequestHookProcessing(t *testing.T) {
 				require.NoError(t, result.Err)
 			},
 		},
+		"proposing an alternate selector": {
+			configure: func(t *testing.T, requestHooks *hooks.IncomingRequestHooks) {
+				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+					hookActions.ProposeAlternateSelector(ssb.ExploreAll(ssb.Matcher()).Node(), "cheaper")
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.False(t, result.IsValidated)
+				require.NotNil(t, result.Proposal)
+				require.Equal(t, "cheaper", result.Proposal.Reason)
+				require.True(t, ipld.DeepEqual(ssb.ExploreAll(ssb.Matcher()).Node(), result.Proposal.Selector))
+				require.NoError(t, result.Err)
+			},
+		},
+		"substituting a selector": {
+			configure: func(t *testing.T, requestHooks *hooks.IncomingRequestHooks) {
+				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+					hookActions.ValidateSelector(ssb.ExploreAll(ssb.Matcher()).Node())
+				})
+				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+					// later hooks still see the original selector
+					if ipld.DeepEqual(ssb.Matcher().Node(), requestData.Selector()) {
+						hookActions.ValidateRequest()
+					}
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.True(t, result.IsValidated)
+				require.True(t, ipld.DeepEqual(ssb.ExploreAll(ssb.Matcher()).Node(), result.Selector))
+				require.NoError(t, result.Err)
+			},
+		},
+		"overriding priority": {
+			configure: func(t *testing.T, requestHooks *hooks.IncomingRequestHooks) {
+				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+					hookActions.ValidateRequest()
+					hookActions.OverridePriority(graphsync.Priority(7))
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.True(t, result.IsValidated)
+				require.Equal(t, graphsync.Priority(7), result.Priority)
+				require.NoError(t, result.Err)
+			},
+		},
 		"altering context": {
 			configure: func(t *testing.T, requestHooks *hooks.IncomingRequestHooks) {
 				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
@@ -218,6 +285,26 @@ func TestRequestHookProcessing(t *testing.T) {
 				require.Equal(t, "apples", result.Ctx.Value(contextKey{}))
 			},
 		},
+		"hook panics": {
+			configure: func(t *testing.T, requestHooks *hooks.IncomingRequestHooks) {
+				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+					hookActions.ValidateRequest()
+				})
+				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+					panic("something went wrong")
+				})
+				requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+					hookActions.SendExtensionData(extensionResponse)
+				})
+			},
+			assert: func(t *testing.T, result hooks.RequestResult) {
+				require.Empty(t, result.Extensions)
+				var panicErr panics.RecoveredPanicErr
+				require.True(t, errors.As(result.Err, &panicErr))
+				require.Equal(t, "something went wrong", panicErr.PanicObj)
+				require.Contains(t, panicErr.DebugStackTrace, "hooks_test.go")
+			},
+		},
 	}
 	for testCase, data := range testCases {
 		t.Run(testCase, func(t *testing.T) {
@@ -225,7 +312,17 @@ func TestRequestHookProcessing(t *testing.T) {
 			if data.configure != nil {
 				data.configure(t, requestHooks)
 			}
-			result := requestHooks.ProcessRequestHooks(p, request, ctx)
+			result := requestHooks.ProcessRequestHooks(p, request, nil, ctx)
+			if data.assert != nil {
+				data.assert(t, result)
+			}
+		})
+		t.Run(testCase+" (concurrent)", func(t *testing.T) {
+			requestHooks := hooks.NewRequestHooks(fpo, hooks.WithConcurrentExecution())
+			if data.configure != nil {
+				data.configure(t, requestHooks)
+			}
+			result := requestHooks.ProcessRequestHooks(p, request, nil, ctx)
 			if data.assert != nil {
 				data.assert(t, result)
 			}
@@ -233,6 +330,158 @@ func TestRequestHookProcessing(t *testing.T) {
 	}
 }
 
+func TestConcurrentRequestHooks(t *testing.T) {
+	fakeSystem := func(name string) ipld.LinkSystem {
+		lsys := cidlink.DefaultLinkSystem()
+		lsys.StorageReadOpener = func(ipld.LinkContext, ipld.Link) (io.Reader, error) {
+			return nil, errors.New(name)
+		}
+		return lsys
+	}
+	fpo := &fakePersistenceOptions{
+		po: map[string]ipld.LinkSystem{
+			"first":  fakeSystem("first"),
+			"second": fakeSystem("second"),
+		},
+	}
+	root := testutil.GenerateCids(1)[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	request := gsmsg.NewRequest(graphsync.NewRequestID(), root, ssb.Matcher().Node(), graphsync.Priority(0))
+	p := testutil.GeneratePeers(1)[0]
+	extension := func(n int64) graphsync.ExtensionData {
+		return graphsync.ExtensionData{Name: "test", Data: basicnode.NewInt(n)}
+	}
+
+	t.Run("actions merge in hook order", func(t *testing.T) {
+		requestHooks := hooks.NewRequestHooks(fpo, hooks.WithConcurrentExecution())
+		// every hook waits for the others to start, so they must run at once
+		var started sync.WaitGroup
+		started.Add(3)
+		requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			started.Done()
+			started.Wait()
+			hookActions.UsePersistenceOption("first")
+			hookActions.OverridePriority(graphsync.Priority(1))
+			hookActions.SendExtensionData(extension(1))
+			hookActions.AugmentContext(func(ctx context.Context) context.Context {
+				return context.WithValue(ctx, contextKey{}, []string{"first"})
+			})
+		})
+		requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			started.Done()
+			started.Wait()
+			hookActions.ValidateRequest()
+			hookActions.SendExtensionData(extension(2))
+			hookActions.SendExtensionData(extension(3))
+		})
+		requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			started.Done()
+			started.Wait()
+			hookActions.UsePersistenceOption("second")
+			hookActions.SendExtensionData(extension(4))
+			hookActions.AugmentContext(func(ctx context.Context) context.Context {
+				previous, _ := ctx.Value(contextKey{}).([]string)
+				return context.WithValue(ctx, contextKey{}, append(previous, "second"))
+			})
+		})
+
+		for i := 0; i < 10; i++ {
+			result := requestHooks.ProcessRequestHooks(p, request, nil, context.Background())
+			require.NoError(t, result.Err)
+			require.True(t, result.IsValidated)
+			require.Equal(t, []graphsync.ExtensionData{extension(1), extension(2), extension(3), extension(4)}, result.Extensions)
+			require.Equal(t, graphsync.Priority(1), result.Priority)
+			_, err := result.CustomLinkSystem.StorageReadOpener(ipld.LinkContext{}, nil)
+			require.EqualError(t, err, "second")
+			require.Equal(t, []string{"first", "second"}, result.Ctx.Value(contextKey{}))
+			started.Add(3)
+		}
+	})
+
+	t.Run("first error discards later hooks", func(t *testing.T) {
+		requestHooks := hooks.NewRequestHooks(fpo, hooks.WithConcurrentExecution())
+		requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.SendExtensionData(extension(1))
+		})
+		requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.SendExtensionData(extension(2))
+			hookActions.TerminateWithError(errors.New("first"))
+		})
+		requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+			hookActions.SendExtensionData(extension(3))
+			hookActions.TerminateWithError(errors.New("second"))
+		})
+		result := requestHooks.ProcessRequestHooks(p, request, nil, context.Background())
+		require.EqualError(t, result.Err, "first")
+		require.False(t, result.IsValidated)
+		require.Equal(t, []graphsync.ExtensionData{extension(1), extension(2)}, result.Extensions)
+	})
+}
+
+func TestSelectorValidator(t *testing.T) {
+	root := testutil.GenerateCids(1)[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	shallow := ssb.ExploreRecursive(selector.RecursionLimitDepth(1), ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	deep := ssb.ExploreRecursive(selector.RecursionLimitDepth(100), ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	p := testutil.GeneratePeers(1)[0]
+	validator := func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+		if ipld.DeepEqual(shallow, requestData.Selector()) {
+			hookActions.ValidateRequest()
+		}
+	}
+	testCases := map[string]struct {
+		requestSelector ipld.Node
+		hook            graphsync.OnIncomingRequestHook
+		expectValidated bool
+	}{
+		"validates the request's selector": {
+			requestSelector: shallow,
+			expectValidated: true,
+		},
+		"validates a substituted selector": {
+			requestSelector: deep,
+			hook: func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+				hookActions.ValidateSelector(shallow)
+			},
+			expectValidated: true,
+		},
+		"rejects a substituted selector": {
+			requestSelector: shallow,
+			hook: func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+				hookActions.ValidateSelector(deep)
+			},
+			expectValidated: false,
+		},
+		"does not run once a hook terminates the request": {
+			requestSelector: shallow,
+			hook: func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+				hookActions.TerminateWithError(errors.New("policy"))
+			},
+			expectValidated: false,
+		},
+	}
+	for testCase, data := range testCases {
+		for _, concurrent := range []bool{false, true} {
+			name := testCase
+			options := []hooks.Option{hooks.WithSelectorValidator(validator)}
+			if concurrent {
+				name += " (concurrent)"
+				options = append(options, hooks.WithConcurrentExecution())
+			}
+			t.Run(name, func(t *testing.T) {
+				requestHooks := hooks.NewRequestHooks(&fakePersistenceOptions{}, options...)
+				if data.hook != nil {
+					requestHooks.Register(data.hook)
+				}
+				request := gsmsg.NewRequest(graphsync.NewRequestID(), root, data.requestSelector, graphsync.Priority(0))
+				result := requestHooks.ProcessRequestHooks(p, request, nil, context.Background())
+				require.Equal(t, data.expectValidated, result.IsValidated)
+			})
+		}
+	}
+}
+
 func TestBlockHookProcessing(t *testing.T) {
 	extensionData := basicnode.NewBytes(testutil.RandomBytes(100))
 	extensionName := graphsync.ExtensionName("AppleSauce/McGee")
@@ -260,6 +509,7 @@ func TestBlockHookProcessing(t *testing.T) {
 			assert: func(t *testing.T, result hooks.BlockResult) {
 				require.Empty(t, result.Extensions)
 				require.NoError(t, result.Err)
+				require.Equal(t, 100+blockData.BlockSizeOnWire(), result.BytesSent)
 			},
 		},
 		"send extension data": {
@@ -274,6 +524,18 @@ func TestBlockHookProcessing(t *testing.T) {
 				require.NoError(t, result.Err)
 			},
 		},
+		"read bytes sent": {
+			configure: func(t *testing.T, blockHooks *hooks.OutgoingBlockHooks) {
+				blockHooks.Register(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+					if hookActions.BytesSent() != 100+blockData.BlockSizeOnWire() {
+						hookActions.TerminateWithError(errors.New("wrong bytes sent"))
+					}
+				})
+			},
+			assert: func(t *testing.T, result hooks.BlockResult) {
+				require.NoError(t, result.Err)
+			},
+		},
 		"terminate with error": {
 			configure: func(t *testing.T, blockHooks *hooks.OutgoingBlockHooks) {
 				blockHooks.Register(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
@@ -296,6 +558,19 @@ func TestBlockHookProcessing(t *testing.T) {
 				require.EqualError(t, result.Err, hooks.ErrPaused{}.Error())
 			},
 		},
+		"hook panics": {
+			configure: func(t *testing.T, blockHooks *hooks.OutgoingBlockHooks) {
+				blockHooks.Register(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+					panic("something went wrong")
+				})
+			},
+			assert: func(t *testing.T, result hooks.BlockResult) {
+				var panicErr panics.RecoveredPanicErr
+				require.True(t, errors.As(result.Err, &panicErr))
+				require.Equal(t, "something went wrong", panicErr.PanicObj)
+				require.Contains(t, panicErr.DebugStackTrace, "hooks_test.go")
+			},
+		},
 	}
 	for testCase, data := range testCases {
 		t.Run(testCase, func(t *testing.T) {
@@ -303,7 +578,7 @@ func TestBlockHookProcessing(t *testing.T) {
 			if data.configure != nil {
 				data.configure(t, blockHooks)
 			}
-			result := blockHooks.ProcessBlockHooks(p, request, blockData)
+			result := blockHooks.ProcessBlockHooks(p, request, blockData, 100)
 			if data.assert != nil {
 				data.assert(t, result)
 			}
@@ -389,6 +664,23 @@ func TestUpdateHookProcessing(t *testing.T) {
 				require.True(t, result.Unpause)
 			},
 		},
+		"hook panics": {
+			configure: func(t *testing.T, updateHooks *hooks.RequestUpdatedHooks) {
+				updateHooks.Register(func(p peer.ID, requestData graphsync.RequestData, updateData graphsync.RequestData, hookActions graphsync.RequestUpdatedHookActions) {
+					panic("something went wrong")
+				})
+				updateHooks.Register(func(p peer.ID, requestData graphsync.RequestData, updateData graphsync.RequestData, hookActions graphsync.RequestUpdatedHookActions) {
+					hookActions.UnpauseResponse()
+				})
+			},
+			assert: func(t *testing.T, result hooks.UpdateResult) {
+				require.False(t, result.Unpause)
+				var panicErr panics.RecoveredPanicErr
+				require.True(t, errors.As(result.Err, &panicErr))
+				require.Equal(t, "something went wrong", panicErr.PanicObj)
+				require.Contains(t, panicErr.DebugStackTrace, "hooks_test.go")
+			},
+		},
 	}
 	for testCase, data := range testCases {
 		t.Run(testCase, func(t *testing.T) {
@@ -403,3 +695,201 @@ func TestUpdateHookProcessing(t *testing.T) {
 		})
 	}
 }
+
+func TestCompletingResponseHookProcessing(t *testing.T) {
+	extensionData := basicnode.NewBytes(testutil.RandomBytes(100))
+	extensionName := graphsync.ExtensionName("AppleSauce/McGee")
+	extension := graphsync.ExtensionData{
+		Name: extensionName,
+		Data: extensionData,
+	}
+	extensionResponseData := basicnode.NewBytes(testutil.RandomBytes(100))
+	extensionResponse := graphsync.ExtensionData{
+		Name: extensionName,
+		Data: extensionResponseData,
+	}
+
+	root := testutil.GenerateCids(1)[0]
+	requestID := graphsync.NewRequestID()
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	request := gsmsg.NewRequest(requestID, root, ssb.Matcher().Node(), graphsync.Priority(0), extension)
+	p := testutil.GeneratePeers(1)[0]
+	testCases := map[string]struct {
+		configure  func(t *testing.T, completingHooks *hooks.CompletingResponseHooks)
+		status     graphsync.ResponseStatusCode
+		extensions []graphsync.ExtensionData
+	}{
+		"no hooks": {
+			status: graphsync.RequestCompletedFull,
+		},
+		"send extension data": {
+			configure: func(t *testing.T, completingHooks *hooks.CompletingResponseHooks) {
+				completingHooks.Register(func(p peer.ID, requestData graphsync.RequestData, status graphsync.ResponseStatusCode, hookActions graphsync.CompletingResponseHookActions) {
+					if status == graphsync.RequestCompletedFull {
+						hookActions.SendExtensionData(extensionResponse)
+					}
+				})
+			},
+			status:     graphsync.RequestCompletedFull,
+			extensions: []graphsync.ExtensionData{extensionResponse},
+		},
+		"hooks see the final status": {
+			configure: func(t *testing.T, completingHooks *hooks.CompletingResponseHooks) {
+				completingHooks.Register(func(p peer.ID, requestData graphsync.RequestData, status graphsync.ResponseStatusCode, hookActions graphsync.CompletingResponseHookActions) {
+					if status == graphsync.RequestCompletedFull {
+						hookActions.SendExtensionData(extensionResponse)
+					}
+				})
+			},
+			status: graphsync.RequestFailedUnknown,
+		},
+		"hook panics": {
+			configure: func(t *testing.T, completingHooks *hooks.CompletingResponseHooks) {
+				completingHooks.Register(func(p peer.ID, requestData graphsync.RequestData, status graphsync.ResponseStatusCode, hookActions graphsync.CompletingResponseHookActions) {
+					hookActions.SendExtensionData(extensionResponse)
+				})
+				completingHooks.Register(func(p peer.ID, requestData graphsync.RequestData, status graphsync.ResponseStatusCode, hookActions graphsync.CompletingResponseHookActions) {
+					panic("something went wrong")
+				})
+			},
+			status:     graphsync.RequestCompletedFull,
+			extensions: []graphsync.ExtensionData{extensionResponse},
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			completingHooks := hooks.NewCompletingResponseHooks()
+			if data.configure != nil {
+				data.configure(t, completingHooks)
+			}
+			extensions := completingHooks.ProcessCompletingResponseHooks(p, request, data.status)
+			require.Equal(t, data.extensions, extensions)
+		})
+	}
+}
+
+func TestAsyncRequestValidatorProcessing(t *testing.T) {
+	extensionResponse := graphsync.ExtensionData{
+		Name: graphsync.ExtensionName("AppleSauce/McGee"),
+		Data: basicnode.NewBytes(testutil.RandomBytes(100)),
+	}
+	root := testutil.GenerateCids(1)[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	request := gsmsg.NewRequest(graphsync.NewRequestID(), root, ssb.Matcher().Node(), graphsync.Priority(0))
+	p := testutil.GeneratePeers(1)[0]
+	accept := func(ctx context.Context, p peer.ID, request graphsync.RequestData) (bool, []graphsync.ExtensionData, error) {
+		return true, []graphsync.ExtensionData{extensionResponse}, nil
+	}
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	testCases := map[string]struct {
+		configure func(validators *hooks.AsyncRequestValidators)
+		ctx       context.Context
+		expected  hooks.ValidationResult
+	}{
+		"no validators": {
+			expected: hooks.ValidationResult{Accepted: true},
+		},
+		"all validators accept": {
+			configure: func(validators *hooks.AsyncRequestValidators) {
+				validators.Register(accept)
+				validators.Register(accept)
+			},
+			expected: hooks.ValidationResult{Accepted: true, Extensions: []graphsync.ExtensionData{extensionResponse, extensionResponse}},
+		},
+		"a validator rejects": {
+			configure: func(validators *hooks.AsyncRequestValidators) {
+				validators.Register(func(ctx context.Context, p peer.ID, request graphsync.RequestData) (bool, []graphsync.ExtensionData, error) {
+					return false, []graphsync.ExtensionData{extensionResponse}, nil
+				})
+				validators.Register(accept)
+			},
+			expected: hooks.ValidationResult{Extensions: []graphsync.ExtensionData{extensionResponse}},
+		},
+		"a validator errors": {
+			configure: func(validators *hooks.AsyncRequestValidators) {
+				validators.Register(func(ctx context.Context, p peer.ID, request graphsync.RequestData) (bool, []graphsync.ExtensionData, error) {
+					return true, nil, errors.New("something went wrong")
+				})
+			},
+			expected: hooks.ValidationResult{Err: errors.New("something went wrong")},
+		},
+		"context done before validator returns": {
+			configure: func(validators *hooks.AsyncRequestValidators) {
+				validators.Register(accept)
+			},
+			ctx:      cancelledCtx,
+			expected: hooks.ValidationResult{Extensions: []graphsync.ExtensionData{extensionResponse}, Err: context.Canceled},
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			validators := hooks.NewAsyncRequestValidators()
+			if data.configure != nil {
+				data.configure(validators)
+			}
+			require.Equal(t, data.configure != nil, validators.HasValidators())
+			ctx := data.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			result := validators.Validate(ctx, p, request)
+			require.Equal(t, data.expected, result)
+		})
+	}
+
+	t.Run("a validator panics", func(t *testing.T) {
+		validators := hooks.NewAsyncRequestValidators()
+		validators.Register(func(ctx context.Context, p peer.ID, request graphsync.RequestData) (bool, []graphsync.ExtensionData, error) {
+			panic("something went wrong")
+		})
+		result := validators.Validate(context.Background(), p, request)
+		require.False(t, result.Accepted)
+		var panicErr panics.RecoveredPanicErr
+		require.True(t, errors.As(result.Err, &panicErr))
+		require.Equal(t, "something went wrong", panicErr.PanicObj)
+	})
+}
+
+func TestRegisterWhileProcessing(t *testing.T) {
+	root := testutil.GenerateCids(1)[0]
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	request := gsmsg.NewRequest(graphsync.NewRequestID(), root, ssb.Matcher().Node(), graphsync.Priority(0))
+	p := testutil.GeneratePeers(1)[0]
+	for name, options := range map[string][]hooks.Option{
+		"sequential": nil,
+		"concurrent": {hooks.WithConcurrentExecution()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			requestHooks := hooks.NewRequestHooks(&fakePersistenceOptions{}, options...)
+			requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+				hookActions.ValidateRequest()
+			})
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 200; j++ {
+						// hooks may register and unregister hooks themselves
+						unregister := requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+							requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {})()
+						})
+						unregister()
+					}
+				}()
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 200; j++ {
+						result := requestHooks.ProcessRequestHooks(p, request, nil, context.Background())
+						if !result.IsValidated || result.Err != nil {
+							t.Errorf("unexpected result: %+v", result)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
@@ -2,7 +2,8 @@ package hooks
 
 import (
 	"context"
-	"errors"
+	"fmt"
+	"sync"
 
 	"github.com/hannahhoward/go-pubsub"
 	"github.com/ipld/go-ipld-prime"
@@ -10,6 +11,8 @@ import (
 	peer "github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/hookset"
+	"github.com/ipfs/go-graphsync/panics"
 )
 
 // PersistenceOptions is an interface for getting loaders by name
@@ -20,7 +23,56 @@ type PersistenceOptions interface {
 // IncomingRequestHooks is a set of incoming request hooks that can be processed
 type IncomingRequestHooks struct {
 	persistenceOptions PersistenceOptions
-	pubSub             *pubsub.PubSub
+	hooks              *hookset.HookSet
+	concurrent         bool
+	selectorValidator  graphsync.OnIncomingRequestHook
+	observer           hookset.HookExecutionObserver
+	panicCallback      panics.CallBackFn
+}
+
+// Option configures a set of incoming request hooks
+type Option func(*IncomingRequestHooks)
+
+// WithConcurrentExecution runs the hooks for each request at the same time,
+// each in its own goroutine, rather than one after another. Each hook acts on
+// its own copy of the request's actions, and once all hooks return the actions
+// are combined in the order the hooks would run sequentially: extensions are
+// concatenated, later hooks win when choosing a persistence option, node
+// prototype chooser, selector, selector proposal or priority, and context augmentations
+// are applied in turn. If a hook terminates the request with an error, the
+// actions of hooks after it are discarded and the earliest error is reported,
+// as if the hooks had stopped there. Hooks must be safe to run concurrently
+// with each other
+func WithConcurrentExecution() Option {
+	return func(irh *IncomingRequestHooks) {
+		irh.concurrent = true
+	}
+}
+
+// WithSelectorValidator runs the given hook after all registered hooks, as
+// long as none of them terminated the request. It sees the request with the
+// selector the response will traverse, so if a hook substituted a selector with
+// ValidateSelector, it is the substituted selector that is validated
+func WithSelectorValidator(validator graphsync.OnIncomingRequestHook) Option {
+	return func(irh *IncomingRequestHooks) {
+		irh.selectorValidator = validator
+	}
+}
+
+// WithExecutionObserver tells the given observer when each hook starts and
+// finishes running
+func WithExecutionObserver(observer hookset.HookExecutionObserver) Option {
+	return func(irh *IncomingRequestHooks) {
+		irh.observer = observer
+	}
+}
+
+// WithPanicCallback calls the given function with each panic recovered from a
+// hook, in addition to failing the request
+func WithPanicCallback(callback panics.CallBackFn) Option {
+	return func(irh *IncomingRequestHooks) {
+		irh.panicCallback = callback
+	}
 }
 
 type internalRequestHookEvent struct {
@@ -37,16 +89,28 @@ func requestHookDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn)
 }
 
 // NewRequestHooks returns a new list of incoming request hooks
-func NewRequestHooks(persistenceOptions PersistenceOptions) *IncomingRequestHooks {
-	return &IncomingRequestHooks{
+func NewRequestHooks(persistenceOptions PersistenceOptions, options ...Option) *IncomingRequestHooks {
+	irh := &IncomingRequestHooks{
 		persistenceOptions: persistenceOptions,
-		pubSub:             pubsub.New(requestHookDispatcher),
 	}
+	for _, option := range options {
+		option(irh)
+	}
+	irh.hooks = hookset.New(requestHookDispatcher,
+		hookset.WithHookType("incoming-request"),
+		hookset.WithExecutionObserver(irh.observer),
+		hookset.WithPanicCallback(irh.panicCallback))
+	return irh
 }
 
 // Register registers an extension to process new incoming requests
 func (irh *IncomingRequestHooks) Register(hook graphsync.OnIncomingRequestHook) graphsync.UnregisterHookFunc {
-	return graphsync.UnregisterHookFunc(irh.pubSub.Subscribe(hook))
+	return irh.hooks.Register(hook)
+}
+
+// UnregisterAll removes all registered hooks
+func (irh *IncomingRequestHooks) UnregisterAll() {
+	irh.hooks.UnregisterAll()
 }
 
 // RequestResult is the outcome of running requesthooks
@@ -54,42 +118,167 @@ type RequestResult struct {
 	IsValidated      bool
 	IsPaused         bool
 	CustomLinkSystem ipld.LinkSystem
-	CustomChooser    traversal.LinkTargetNodePrototypeChooser
-	Err              error
-	Extensions       []graphsync.ExtensionData
-	Ctx              context.Context
+	// the name of the persistence option CustomLinkSystem came from
+	PersistenceOption string
+	CustomChooser     traversal.LinkTargetNodePrototypeChooser
+	Err               error
+	Extensions        []graphsync.ExtensionData
+	Ctx               context.Context
+	Proposal          *graphsync.SelectorProposal
+	Priority          graphsync.Priority
+	// the selector a hook substituted for the request's selector, nil if the
+	// request's selector is used as is
+	Selector ipld.Node
+}
+
+// ProcessRequestHooks runs request hooks against an incoming request.
+// peerExtensions are the extensions the requestor reported it supports, nil if
+// it has not. reqCtx is handed to hooks as the response context, and should be
+// cancelled when the response ends
+func (irh *IncomingRequestHooks) ProcessRequestHooks(p peer.ID, request graphsync.RequestData, peerExtensions []graphsync.ExtensionName, reqCtx context.Context) RequestResult {
+	if irh.concurrent {
+		return irh.processConcurrently(p, request, peerExtensions, reqCtx)
+	}
+	ha := irh.newActions(request, peerExtensions, reqCtx)
+	if err := irh.hooks.Publish(internalRequestHookEvent{p, request, ha}); err != nil {
+		ha.err = err
+	}
+	irh.validateSelector(p, request, ha)
+	return ha.result()
+}
+
+// validateSelector runs the selector validator, if there is one, against the
+// selector the response will traverse
+func (irh *IncomingRequestHooks) validateSelector(p peer.ID, request graphsync.RequestData, ha *requestHookActions) {
+	if irh.selectorValidator == nil || ha.err != nil {
+		return
+	}
+	if ha.selector != nil {
+		request = substitutedSelectorRequest{request, ha.selector}
+	}
+	irh.selectorValidator(p, request, ha)
+}
+
+// substitutedSelectorRequest is a request with its selector replaced
+type substitutedSelectorRequest struct {
+	graphsync.RequestData
+	selector ipld.Node
+}
+
+func (r substitutedSelectorRequest) Selector() ipld.Node {
+	return r.selector
 }
 
-// ProcessRequestHooks runs request hooks against an incoming request
-func (irh *IncomingRequestHooks) ProcessRequestHooks(p peer.ID, request graphsync.RequestData, reqCtx context.Context) RequestResult {
-	ha := &requestHookActions{
+func (irh *IncomingRequestHooks) newActions(request graphsync.RequestData, peerExtensions []graphsync.ExtensionName, reqCtx context.Context) *requestHookActions {
+	return &requestHookActions{
 		persistenceOptions: irh.persistenceOptions,
+		peerExtensions:     peerExtensions,
 		ctx:                reqCtx,
+		responseCtx:        reqCtx,
+		priority:           request.Priority(),
 	}
-	_ = irh.pubSub.Publish(internalRequestHookEvent{p, request, ha})
-	return ha.result()
+}
+
+// processConcurrently runs every hook at once with its own actions, then
+// merges the actions in hook order
+func (irh *IncomingRequestHooks) processConcurrently(p peer.ID, request graphsync.RequestData, peerExtensions []graphsync.ExtensionName, reqCtx context.Context) RequestResult {
+	registered := irh.hooks.Hooks()
+	actions := make([]*requestHookActions, 0, len(registered))
+	var wg sync.WaitGroup
+	for i, hook := range registered {
+		ha := irh.newActions(request, peerExtensions, reqCtx)
+		ha.deferAugments = true
+		actions = append(actions, ha)
+		wg.Add(1)
+		go func(hookIndex int, hook graphsync.OnIncomingRequestHook) {
+			defer wg.Done()
+			if err := irh.hooks.Run(hookIndex, func() error {
+				hook(p, request, ha)
+				return ha.err
+			}); err != nil {
+				ha.err = err
+			}
+		}(i, hook.(graphsync.OnIncomingRequestHook))
+	}
+	wg.Wait()
+
+	merged := irh.newActions(request, peerExtensions, reqCtx)
+	for _, ha := range actions {
+		merged.merge(ha)
+		if ha.err != nil {
+			break
+		}
+	}
+	irh.validateSelector(p, request, merged)
+	return merged.result()
 }
 
 type requestHookActions struct {
 	persistenceOptions PersistenceOptions
+	peerExtensions     []graphsync.ExtensionName
 	isValidated        bool
 	isPaused           bool
 	err                error
 	linkSystem         ipld.LinkSystem
+	persistenceOption  string
 	chooser            traversal.LinkTargetNodePrototypeChooser
 	extensions         []graphsync.ExtensionData
 	ctx                context.Context
+	responseCtx        context.Context
+	proposal           *graphsync.SelectorProposal
+	priority           graphsync.Priority
+	priorityOverridden bool
+	selector           ipld.Node
+	// when set, context augmentations are recorded to apply on merge rather
+	// than applied straight away
+	deferAugments bool
+	augments      []func(reqCtx context.Context) context.Context
+}
+
+// merge applies the actions taken by a hook that ran on its own, as if it
+// had run after the hooks already merged
+func (ha *requestHookActions) merge(other *requestHookActions) {
+	ha.isValidated = ha.isValidated || other.isValidated
+	ha.isPaused = ha.isPaused || other.isPaused
+	if other.err != nil {
+		ha.err = other.err
+	}
+	if other.linkSystem.StorageReadOpener != nil {
+		ha.linkSystem = other.linkSystem
+		ha.persistenceOption = other.persistenceOption
+	}
+	if other.chooser != nil {
+		ha.chooser = other.chooser
+	}
+	ha.extensions = append(ha.extensions, other.extensions...)
+	for _, augment := range other.augments {
+		ha.ctx = augment(ha.ctx)
+	}
+	if other.proposal != nil {
+		ha.proposal = other.proposal
+	}
+	if other.priorityOverridden {
+		ha.priority = other.priority
+		ha.priorityOverridden = true
+	}
+	if other.selector != nil {
+		ha.selector = other.selector
+	}
 }
 
 func (ha *requestHookActions) result() RequestResult {
 	return RequestResult{
-		IsValidated:      ha.isValidated,
-		IsPaused:         ha.isPaused,
-		CustomLinkSystem: ha.linkSystem,
-		CustomChooser:    ha.chooser,
-		Err:              ha.err,
-		Extensions:       ha.extensions,
-		Ctx:              ha.ctx,
+		IsValidated:       ha.isValidated,
+		IsPaused:          ha.isPaused,
+		CustomLinkSystem:  ha.linkSystem,
+		PersistenceOption: ha.persistenceOption,
+		CustomChooser:     ha.chooser,
+		Err:               ha.err,
+		Extensions:        ha.extensions,
+		Ctx:               ha.ctx,
+		Proposal:          ha.proposal,
+		Priority:          ha.priority,
+		Selector:          ha.selector,
 	}
 }
 
@@ -108,10 +297,11 @@ func (ha *requestHookActions) ValidateRequest() {
 func (ha *requestHookActions) UsePersistenceOption(name string) {
 	linkSystem, ok := ha.persistenceOptions.GetLinkSystem(name)
 	if !ok {
-		ha.TerminateWithError(errors.New("unknown loader option"))
+		ha.TerminateWithError(fmt.Errorf("unknown loader option: %s", name))
 		return
 	}
 	ha.linkSystem = linkSystem
+	ha.persistenceOption = name
 }
 
 func (ha *requestHookActions) UseLinkTargetNodePrototypeChooser(chooser traversal.LinkTargetNodePrototypeChooser) {
@@ -123,5 +313,33 @@ func (ha *requestHookActions) PauseResponse() {
 }
 
 func (ha *requestHookActions) AugmentContext(augment func(reqCtx context.Context) context.Context) {
+	if ha.deferAugments {
+		ha.augments = append(ha.augments, augment)
+		return
+	}
 	ha.ctx = augment(ha.ctx)
 }
+
+func (ha *requestHookActions) ResponseContext() context.Context {
+	return ha.responseCtx
+}
+
+func (ha *requestHookActions) PeerExtensions() ([]graphsync.ExtensionName, bool) {
+	if ha.peerExtensions == nil {
+		return nil, false
+	}
+	return append([]graphsync.ExtensionName(nil), ha.peerExtensions...), true
+}
+
+func (ha *requestHookActions) ProposeAlternateSelector(selector ipld.Node, reason string) {
+	ha.proposal = &graphsync.SelectorProposal{Selector: selector, Reason: reason}
+}
+
+func (ha *requestHookActions) OverridePriority(priority graphsync.Priority) {
+	ha.priority = priority
+	ha.priorityOverridden = true
+}
+
+func (ha *requestHookActions) ValidateSelector(validated ipld.Node) {
+	ha.selector = validated
+}
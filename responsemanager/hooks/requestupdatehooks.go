@@ -5,11 +5,12 @@ import (
 	peer "github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/hookset"
 )
 
 // RequestUpdatedHooks manages and runs hooks for request updates
 type RequestUpdatedHooks struct {
-	pubSub *pubsub.PubSub
+	hooks *hookset.HookSet
 }
 
 type internalRequestUpdateEvent struct {
@@ -27,13 +28,19 @@ func updateHookDispatcher(event pubsub.Event, subscriberFn pubsub.SubscriberFn)
 }
 
 // NewUpdateHooks returns a new list of request updated hooks
-func NewUpdateHooks() *RequestUpdatedHooks {
-	return &RequestUpdatedHooks{pubSub: pubsub.New(updateHookDispatcher)}
+func NewUpdateHooks(options ...hookset.Option) *RequestUpdatedHooks {
+	options = append([]hookset.Option{hookset.WithHookType("request-updated")}, options...)
+	return &RequestUpdatedHooks{hooks: hookset.New(updateHookDispatcher, options...)}
 }
 
 // Register registers an hook to process updates to requests
 func (ruh *RequestUpdatedHooks) Register(hook graphsync.OnRequestUpdatedHook) graphsync.UnregisterHookFunc {
-	return graphsync.UnregisterHookFunc(ruh.pubSub.Subscribe(hook))
+	return ruh.hooks.Register(hook)
+}
+
+// UnregisterAll removes all registered hooks
+func (ruh *RequestUpdatedHooks) UnregisterAll() {
+	ruh.hooks.UnregisterAll()
 }
 
 // UpdateResult is the result of running update hooks
@@ -46,7 +53,9 @@ type UpdateResult struct {
 // ProcessUpdateHooks runs request hooks against an incoming request
 func (ruh *RequestUpdatedHooks) ProcessUpdateHooks(p peer.ID, request graphsync.RequestData, update graphsync.RequestData) UpdateResult {
 	ha := &updateHookActions{}
-	_ = ruh.pubSub.Publish(internalRequestUpdateEvent{p, request, update, ha})
+	if err := ruh.hooks.Publish(internalRequestUpdateEvent{p, request, update, ha}); err != nil {
+		ha.err = err
+	}
 	return ha.result()
 }
 
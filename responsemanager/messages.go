@@ -1,22 +1,26 @@
 package responsemanager
 
 import (
+	"time"
+
 	"github.com/ipfs/go-peertaskqueue/peertask"
 	"github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/peerstate"
+	"github.com/ipfs/go-graphsync/responsemanager/hooks"
 	"github.com/ipfs/go-graphsync/responsemanager/queryexecutor"
 )
 
 type processRequestsMessage struct {
-	p        peer.ID
-	requests []gsmsg.GraphSyncRequest
+	p         peer.ID
+	requests  []gsmsg.GraphSyncRequest
+	rejectNew bool
 }
 
 func (prm *processRequestsMessage) handle(rm *ResponseManager) {
-	rm.processRequests(prm.p, prm.requests)
+	rm.processRequests(prm.p, prm.requests, prm.rejectNew)
 }
 
 type updateRequestMessage struct {
@@ -60,6 +64,30 @@ func (erm *errorRequestMessage) handle(rm *ResponseManager) {
 	}
 }
 
+type deadlineExceededMessage struct {
+	response *inProgressResponseStatus
+}
+
+func (dem *deadlineExceededMessage) handle(rm *ResponseManager) {
+	rm.deadlineExceeded(dem.response)
+}
+
+type drainResponsesMessage struct {
+	drained chan struct{}
+}
+
+func (drm *drainResponsesMessage) handle(rm *ResponseManager) {
+	rm.drainResponses(drm.drained)
+}
+
+type cancelAllResponsesMessage struct {
+	drained chan struct{}
+}
+
+func (carm *cancelAllResponsesMessage) handle(rm *ResponseManager) {
+	rm.cancelAllResponses(carm.drained)
+}
+
 type synchronizeMessage struct {
 	sync chan error
 }
@@ -141,6 +169,31 @@ func (psm *peerStateMessage) handle(rm *ResponseManager) {
 	}
 }
 
+// responseSnapshot is the state of an in progress response at one moment
+type responseSnapshot struct {
+	p         peer.ID
+	request   gsmsg.GraphSyncRequest
+	state     graphsync.RequestState
+	startTime time.Time
+	// the persistence option the response loads blocks from
+	persistenceOption string
+}
+
+type inProgressResponsesMessage struct {
+	response chan<- []responseSnapshot
+}
+
+func (iprm *inProgressResponsesMessage) handle(rm *ResponseManager) {
+	snapshots := make([]responseSnapshot, 0, len(rm.inProgressResponses))
+	for _, response := range rm.inProgressResponses {
+		snapshots = append(snapshots, responseSnapshot{response.peer, response.request, response.state, response.startTime, response.persistenceOption})
+	}
+	select {
+	case iprm.response <- snapshots:
+	case <-rm.ctx.Done():
+	}
+}
+
 type terminateRequestMessage struct {
 	requestID graphsync.RequestID
 	done      chan<- struct{}
@@ -153,3 +206,20 @@ func (trm *terminateRequestMessage) handle(rm *ResponseManager) {
 	case trm.done <- struct{}{}:
 	}
 }
+
+type disconnectedMessage struct {
+	p peer.ID
+}
+
+func (dm *disconnectedMessage) handle(rm *ResponseManager) {
+	rm.disconnected(dm.p)
+}
+
+type validationCompleteMessage struct {
+	response *inProgressResponseStatus
+	result   hooks.ValidationResult
+}
+
+func (vcm *validationCompleteMessage) handle(rm *ResponseManager) {
+	rm.completeValidation(vcm.response, vcm.result)
+}
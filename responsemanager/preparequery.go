@@ -2,19 +2,25 @@ package responsemanager
 
 import (
 	"context"
+	"errors"
 
 	"github.com/ipfs/go-cid"
 	ipld "github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
 	"github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
 	"github.com/ipfs/go-graphsync/cidset"
+	"github.com/ipfs/go-graphsync/compression"
 	"github.com/ipfs/go-graphsync/dedupkey"
 	"github.com/ipfs/go-graphsync/donotsendfirstblocks"
 	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/remoteerror"
 	"github.com/ipfs/go-graphsync/responsemanager/hooks"
 	"github.com/ipfs/go-graphsync/responsemanager/responseassembler"
+	"github.com/ipfs/go-graphsync/selectorproposal"
+	"github.com/ipfs/go-graphsync/supportedextensions"
 )
 
 type errorString string
@@ -25,25 +31,49 @@ func (e errorString) Error() string {
 
 const errInvalidRequest = errorString("request not valid")
 
+const errSelectorProposed = errorString("alternate selector proposed")
+
 func prepareQuery(
 	ctx context.Context,
 	p peer.ID,
 	request gsmsg.GraphSyncRequest,
 	result hooks.RequestResult,
+	supportedExtensions []graphsync.ExtensionName,
+	blockCompression graphsync.CompressionCodec,
 	responseStream responseassembler.ResponseStream) error {
+	responseStream.SetPriority(result.Priority)
+	codec := negotiateBlockCompression(request, blockCompression)
+	if codec != nil {
+		responseStream.SetBlockCompression(codec)
+	}
 	err := responseStream.Transaction(func(rb responseassembler.ResponseBuilder) error {
+		processSupportedExtensions(request, supportedExtensions, rb)
 		for _, extension := range result.Extensions {
 			rb.SendExtensionData(extension)
 		}
 		if result.Err != nil {
+			sendFailureReason(rb, result.Err)
 			rb.FinishWithError(graphsync.RequestFailedUnknown)
 			return result.Err
+		} else if result.Proposal != nil {
+			rb.SendExtensionData(graphsync.ExtensionData{
+				Name: graphsync.ExtensionSelectorProposal,
+				Data: selectorproposal.EncodeSelectorProposal(*result.Proposal),
+			})
+			rb.FinishWithError(graphsync.RequestRejected)
+			return errSelectorProposed
 		} else if !result.IsValidated {
 			rb.FinishWithError(graphsync.RequestRejected)
 			return errInvalidRequest
 		} else if result.IsPaused {
 			rb.PauseRequest()
 		}
+		if codec != nil {
+			rb.SendExtensionData(graphsync.ExtensionData{
+				Name: graphsync.ExtensionBlockCompression,
+				Data: compression.EncodeCodecName(codec.Name()),
+			})
+		}
 		return nil
 	})
 	if err != nil {
@@ -58,6 +88,71 @@ func prepareQuery(
 	if err := processDoNotSendFirstBlocks(request, responseStream); err != nil {
 		return err
 	}
+	if err := processResume(request, responseStream); err != nil {
+		return err
+	}
+	processMetadataOnly(request, responseStream)
+	return nil
+}
+
+// processSupportedExtensions tells a requestor that lists the extensions it
+// supports which of them are also supported here, whatever happens to the
+// request
+// sendFailureReason tells the requestor why a hook ended the request, with
+// the code and message of the error as well if it is a RemoteError
+func sendFailureReason(rb responseassembler.ResponseBuilder, err error) {
+	rb.SendExtensionData(graphsync.ExtensionData{
+		Name: graphsync.ExtensionFailureReason,
+		Data: basicnode.NewString(err.Error()),
+	})
+	var remoteErr graphsync.RemoteError
+	if errors.As(err, &remoteErr) {
+		rb.SendExtensionData(graphsync.ExtensionData{
+			Name: graphsync.ExtensionRemoteError,
+			Data: remoteerror.EncodeRemoteError(remoteErr),
+		})
+	}
+}
+
+func processSupportedExtensions(request gsmsg.GraphSyncRequest, supportedExtensions []graphsync.ExtensionName, rb responseassembler.ResponseBuilder) {
+	if supportedExtensions == nil {
+		return
+	}
+	data, has := request.Extension(graphsync.ExtensionSupportedExtensions)
+	if !has {
+		return
+	}
+	names, err := supportedextensions.DecodeSupportedExtensions(data)
+	if err != nil {
+		return
+	}
+	rb.SendExtensionData(graphsync.ExtensionData{
+		Name: graphsync.ExtensionSupportedExtensions,
+		Data: supportedextensions.EncodeSupportedExtensions(supportedextensions.Intersect(names, supportedExtensions)),
+	})
+}
+
+// negotiateBlockCompression returns the codec to compress blocks sent for the
+// request with, which is the configured codec if the requestor can decompress
+// it, or nil to send blocks uncompressed
+func negotiateBlockCompression(request gsmsg.GraphSyncRequest, blockCompression graphsync.CompressionCodec) graphsync.CompressionCodec {
+	if blockCompression == nil {
+		return nil
+	}
+	data, has := request.Extension(graphsync.ExtensionBlockCompression)
+	if !has {
+		return nil
+	}
+	names, err := compression.DecodeCodecNames(data)
+	if err != nil {
+		log.Warnw("requestor sent invalid block compression codecs", "request id", request.ID().String(), "error", err)
+		return nil
+	}
+	for _, name := range names {
+		if name == blockCompression.Name() {
+			return blockCompression
+		}
+	}
 	return nil
 }
 
@@ -79,11 +174,21 @@ func processDedupByKey(request gsmsg.GraphSyncRequest, responseStream responseas
 }
 
 func processDoNoSendCids(request gsmsg.GraphSyncRequest, responseStream responseassembler.ResponseStream) error {
-	doNotSendCidsData, has := request.Extension(graphsync.ExtensionDoNotSendCIDs)
+	return processIgnoredCids(request, graphsync.ExtensionDoNotSendCIDs, responseStream)
+}
+
+// processResume skips sending the blocks the requestor already received in
+// an earlier attempt at the request
+func processResume(request gsmsg.GraphSyncRequest, responseStream responseassembler.ResponseStream) error {
+	return processIgnoredCids(request, graphsync.ExtensionResume, responseStream)
+}
+
+func processIgnoredCids(request gsmsg.GraphSyncRequest, name graphsync.ExtensionName, responseStream responseassembler.ResponseStream) error {
+	cidsData, has := request.Extension(name)
 	if !has {
 		return nil
 	}
-	cidSet, err := cidset.DecodeCidSet(doNotSendCidsData)
+	cidSet, err := cidset.DecodeCidSet(cidsData)
 	if err != nil {
 		_ = responseStream.Transaction(func(rb responseassembler.ResponseBuilder) error {
 			rb.FinishWithError(graphsync.RequestFailedUnknown)
@@ -103,6 +208,14 @@ func processDoNoSendCids(request gsmsg.GraphSyncRequest, responseStream response
 	return nil
 }
 
+// processMetadataOnly stops blocks being sent for requests that only want
+// the metadata for the traversal
+func processMetadataOnly(request gsmsg.GraphSyncRequest, responseStream responseassembler.ResponseStream) {
+	if _, has := request.Extension(graphsync.ExtensionMetadataOnly); has {
+		responseStream.MetadataOnly()
+	}
+}
+
 func processDoNotSendFirstBlocks(request gsmsg.GraphSyncRequest, responseStream responseassembler.ResponseStream) error {
 	doNotSendFirstBlocksData, has := request.Extension(graphsync.ExtensionsDoNotSendFirstBlocks)
 	if !has {
@@ -3,11 +3,16 @@ package queryexecutor
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
+	"time"
 
+	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipfs/go-peertaskqueue/peertask"
 	ipld "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
 	"github.com/ipld/go-ipld-prime/traversal"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"go.opentelemetry.io/otel"
@@ -17,9 +22,13 @@ import (
 
 	"github.com/ipfs/go-graphsync"
 	"github.com/ipfs/go-graphsync/ipldutil"
+	"github.com/ipfs/go-graphsync/limits"
 	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/ratelimiter"
+	"github.com/ipfs/go-graphsync/remoteerror"
 	"github.com/ipfs/go-graphsync/responsemanager/hooks"
 	"github.com/ipfs/go-graphsync/responsemanager/responseassembler"
+	"github.com/ipfs/go-graphsync/selectorbudget"
 )
 
 var log = logging.Logger("gs-queryexecutor")
@@ -32,6 +41,12 @@ func (e errorString) Error() string {
 
 const ErrNetworkError = errorString("network error")
 const ErrCancelledByCommand = errorString("response cancelled by responder")
+const ErrCancelledByRequestor = errorString("response cancelled by requestor")
+const ErrDeadlineExceeded = errorString("response deadline set by requestor exceeded")
+
+// errLoadInterrupted indicates a block load failed because the response was
+// paused or aborted while loading it
+const errLoadInterrupted = errorString("block load interrupted")
 
 // ErrFirstBlockLoad indicates the traversal was unable to load the very first block in the traversal
 const ErrFirstBlockLoad = errorString("Unable to load first block")
@@ -46,6 +61,28 @@ type ResponseTask struct {
 	Traverser      ipldutil.Traverser
 	Signals        ResponseSignals
 	ResponseStream ResponseStream
+	// LoadCtx is set on the LinkContext blocks are loaded with. It is
+	// cancelled when the response is paused or aborted while loading
+	LoadCtx context.Context
+	// CancelAck is true if the requestor expects a final RequestCancelled
+	// status in reply to its cancel
+	CancelAck bool
+	// BudgetStatus is true if the requestor understands the
+	// RequestFailedBudgetExceeded status. Older requestors fail to decode a
+	// message with a status they do not know, so they are sent
+	// RequestFailedUnknown instead, with the same extension naming the budget
+	BudgetStatus bool
+	// BytesSent holds the total size of the blocks sent over the network for
+	// the request. It is kept across tasks when the response is paused and
+	// resumed, and is not counted if nil
+	BytesSent *uint64
+}
+
+// CancelAckExtension is sent with the final status that replies to a
+// requestor's cancel
+var CancelAckExtension = graphsync.ExtensionData{
+	Name: graphsync.ExtensionCancelAck,
+	Data: basicnode.NewBool(true),
 }
 
 // ResponseSignals are message channels to communicate between the manager and the QueryExecutor
@@ -61,19 +98,32 @@ type QueryExecutor struct {
 	manager     Manager
 	blockHooks  BlockHooks
 	updateHooks UpdateHooks
+	denylist    func(cid.Cid) bool
+	// records traversals stopped by a budget, may be nil
+	limitRecorder *limits.Recorder
+	// limits the rate blocks are sent, may be nil
+	rateLimiter *ratelimiter.RateLimiter
 }
 
-// New creates a new QueryExecutor
+// New creates a new QueryExecutor. If denylist is not nil, any link whose CID
+// it returns true for is treated as missing and is not loaded or traversed.
+// If rateLimiter is not nil, each block waits for bandwidth before it is sent
 func New(ctx context.Context,
 	manager Manager,
 	blockHooks BlockHooks,
 	updateHooks UpdateHooks,
+	denylist func(cid.Cid) bool,
+	limitRecorder *limits.Recorder,
+	rateLimiter *ratelimiter.RateLimiter,
 ) *QueryExecutor {
 	qm := &QueryExecutor{
-		blockHooks:  blockHooks,
-		updateHooks: updateHooks,
-		manager:     manager,
-		ctx:         ctx,
+		blockHooks:    blockHooks,
+		updateHooks:   updateHooks,
+		denylist:      denylist,
+		manager:       manager,
+		ctx:           ctx,
+		limitRecorder: limitRecorder,
+		rateLimiter:   rateLimiter,
 	}
 	return qm
 }
@@ -130,16 +180,56 @@ func (qe *QueryExecutor) executeQuery(
 		return err
 	}
 
+	// the requestor has no use for anything still waiting to go out
+	if err == ErrCancelledByRequestor {
+		rt.ResponseStream.DiscardQueued()
+		if !rt.CancelAck {
+			rt.ResponseStream.ClearRequest()
+			return err
+		}
+	}
+
 	// Close out the response, either temporarily (pause) or permanently (cancel, fail, complete)
 	return rt.ResponseStream.Transaction(func(rb responseassembler.ResponseBuilder) error {
+		var budgetErr *traversal.ErrBudgetExceeded
+		if errors.As(err, &budgetErr) {
+			switch budgetErr.BudgetKind {
+			case "link":
+				qe.limitRecorder.Hit(graphsync.LimitMaxLinksPerIncomingRequests, graphsync.LimitScopeRequest)
+			case "depth":
+				qe.limitRecorder.Hit(graphsync.LimitMaxRecursionDepth, graphsync.LimitScopeRequest)
+			}
+			// let the requestor know why the traversal stopped short
+			rb.SendExtensionData(graphsync.ExtensionData{
+				Name: graphsync.ExtensionSelectorBudgetExceeded,
+				Data: selectorbudget.EncodeBudgetExceeded(budgetErr.BudgetKind),
+			})
+			if rt.BudgetStatus {
+				rb.FinishWithError(graphsync.RequestFailedBudgetExceeded)
+			} else {
+				rb.FinishWithError(graphsync.RequestFailedUnknown)
+			}
+			return err
+		}
 		switch err {
 		case nil:
 			rb.FinishRequest()
 		case ErrFirstBlockLoad:
 			rb.FinishWithError(graphsync.RequestFailedContentNotFound)
-		case ErrCancelledByCommand:
+		case ErrCancelledByRequestor:
+			rb.SendExtensionData(CancelAckExtension)
+			rb.FinishWithError(graphsync.RequestCancelled)
+		case ErrCancelledByCommand, ErrDeadlineExceeded:
 			rb.FinishWithError(graphsync.RequestCancelled)
 		default:
+			// let the requestor know why a hook ended the request
+			var remoteErr graphsync.RemoteError
+			if errors.As(err, &remoteErr) {
+				rb.SendExtensionData(graphsync.ExtensionData{
+					Name: graphsync.ExtensionRemoteError,
+					Data: remoteerror.EncodeRemoteError(remoteErr),
+				})
+			}
 			rb.FinishWithError(graphsync.RequestFailedUnknown)
 		}
 		return err
@@ -201,6 +291,15 @@ func (qe *QueryExecutor) runTraversal(ctx context.Context, p peer.ID, taskData R
 			attribute.String("cid", lnk.String()),
 		))
 		data, err := qe.loadBlock(ctx, taskData, lnk, lnkCtx)
+		if err == errLoadInterrupted {
+			span.End()
+			return qe.interruptedLoad(p, taskData)
+		}
+		if err != nil {
+			span.End()
+			return err
+		}
+		err = qe.waitForBandwidth(ctx, p, taskData, uint64(len(data)))
 		if err != nil {
 			span.End()
 			return err
@@ -218,9 +317,23 @@ func (qe *QueryExecutor) loadBlock(ctx context.Context, taskData ResponseTask, l
 	_, span := otel.Tracer("graphsync").Start(ctx, "loadBlock")
 	defer span.End()
 
+	if qe.isDenylisted(lnk) {
+		log.Warnf("refusing to load denylisted link=%s, nBlocksRead=%d", lnk, taskData.Traverser.NBlocksTraversed())
+		taskData.Traverser.Error(traversal.SkipMe{})
+		return nil, nil
+	}
+
 	log.Debugf("will load link=%s", lnk)
+	if taskData.LoadCtx != nil {
+		lnkCtx.Ctx = taskData.LoadCtx
+	}
 	result, err := taskData.Loader(lnkCtx, lnk)
 
+	// leave the traversal on this link, so it is loaded again if the response
+	// resumes
+	if err != nil && taskData.LoadCtx != nil && taskData.LoadCtx.Err() != nil {
+		return nil, errLoadInterrupted
+	}
 	if err != nil {
 		log.Errorf("failed to load link=%s, nBlocksRead=%d, err=%s", lnk, taskData.Traverser.NBlocksTraversed(), err)
 		taskData.Traverser.Error(traversal.SkipMe{})
@@ -247,6 +360,65 @@ func (qe *QueryExecutor) loadBlock(ctx context.Context, taskData ResponseTask, l
 	return data, nil
 }
 
+// interruptedLoad ends the traversal after a load was interrupted, handling
+// the pause or abort that interrupted it
+func (qe *QueryExecutor) interruptedLoad(p peer.ID, taskData ResponseTask) error {
+	if taskData.Ctx.Err() != nil {
+		return ipldutil.ContextCancelError{}
+	}
+	return taskData.ResponseStream.Transaction(func(rb responseassembler.ResponseBuilder) error {
+		err := qe.checkForUpdates(p, taskData, rb)
+		if err == nil {
+			err = ipldutil.ContextCancelError{}
+		}
+		return err
+	})
+}
+
+// waitForBandwidth waits until the rate limiter allows size more bytes to be
+// sent to the given peer. If the response is paused or cancelled while
+// waiting, the reserved bandwidth is released. A pause is left for
+// checkForUpdates to handle, so the block that was already traversed is still
+// sent before the response pauses
+func (qe *QueryExecutor) waitForBandwidth(ctx context.Context, p peer.ID, taskData ResponseTask, size uint64) error {
+	if qe.rateLimiter == nil || size == 0 {
+		return nil
+	}
+	reservation := qe.rateLimiter.Reserve(p, size)
+	if reservation.Delay() <= 0 {
+		return nil
+	}
+	_, span := otel.Tracer("graphsync").Start(ctx, "waitForBandwidth")
+	defer span.End()
+	timer := time.NewTimer(reservation.Delay())
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-taskData.Signals.PauseSignal:
+		reservation.Cancel()
+		select {
+		case taskData.Signals.PauseSignal <- struct{}{}:
+		default:
+		}
+		return nil
+	case err := <-taskData.Signals.ErrSignal:
+		reservation.Cancel()
+		return err
+	case <-taskData.Ctx.Done():
+		reservation.Cancel()
+		return taskData.Ctx.Err()
+	}
+}
+
+func (qe *QueryExecutor) isDenylisted(lnk ipld.Link) bool {
+	if qe.denylist == nil {
+		return false
+	}
+	asCidLink, ok := lnk.(cidlink.Link)
+	return ok && qe.denylist(asCidLink.Cid)
+}
+
 func (qe *QueryExecutor) sendResponse(ctx context.Context, p peer.ID, taskData ResponseTask, link ipld.Link, data []byte) error {
 	// Execute a transaction for this block, including any other queued operations
 	return taskData.ResponseStream.Transaction(func(rb responseassembler.ResponseBuilder) error {
@@ -261,8 +433,15 @@ func (qe *QueryExecutor) sendResponse(ctx context.Context, p peer.ID, taskData R
 		blockData := rb.SendResponse(link, data)
 		if blockData.BlockSize() > 0 {
 			_, span := otel.Tracer("graphsync").Start(ctx, "processBlockHooks")
-			result := qe.blockHooks.ProcessBlockHooks(p, taskData.Request, blockData)
+			var bytesSent uint64
+			if taskData.BytesSent != nil {
+				bytesSent = *taskData.BytesSent
+			}
+			result := qe.blockHooks.ProcessBlockHooks(p, taskData.Request, blockData, bytesSent)
 			span.End()
+			if taskData.BytesSent != nil {
+				*taskData.BytesSent = result.BytesSent
+			}
 			for _, extension := range result.Extensions {
 				rb.SendExtensionData(extension)
 			}
@@ -286,7 +465,7 @@ type Manager interface {
 
 // BlockHooks is an interface for processing block hooks
 type BlockHooks interface {
-	ProcessBlockHooks(p peer.ID, request graphsync.RequestData, blockData graphsync.BlockData) hooks.BlockResult
+	ProcessBlockHooks(p peer.ID, request graphsync.RequestData, blockData graphsync.BlockData, bytesSent uint64) hooks.BlockResult
 }
 
 // UpdateHooks is an interface for processing update hooks
@@ -297,5 +476,6 @@ type UpdateHooks interface {
 // ResponseStream is an interface that returns sender interfaces for peer responses.
 type ResponseStream interface {
 	ClearRequest()
+	DiscardQueued()
 	Transaction(transaction responseassembler.Transaction) error
 }
@@ -23,7 +23,9 @@ import (
 
 	"github.com/ipfs/go-graphsync"
 	"github.com/ipfs/go-graphsync/ipldutil"
+	"github.com/ipfs/go-graphsync/limits"
 	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/ratelimiter"
 	"github.com/ipfs/go-graphsync/responsemanager/hooks"
 	"github.com/ipfs/go-graphsync/responsemanager/responseassembler"
 	"github.com/ipfs/go-graphsync/testutil"
@@ -76,8 +78,15 @@ func TestSmallGraphTask(t *testing.T) {
 	t.Run("full graph", func(t *testing.T) {
 		td, qe := newTestData(t, 10, 10)
 		defer td.cancel()
+		var bytesSent uint64
+		td.manager.responseTask.BytesSent = &bytesSent
 		require.Equal(t, false, qe.ExecuteTask(td.ctx, td.peer, td.task))
 		require.Equal(t, 0, td.clearRequestCalls)
+		var expectedBytes uint64
+		for _, blk := range td.expectedBlocks {
+			expectedBytes += blk.BlockSizeOnWire()
+		}
+		require.Equal(t, expectedBytes, bytesSent)
 	})
 
 	t.Run("paused by hook", func(t *testing.T) {
@@ -142,6 +151,43 @@ func TestSmallGraphTask(t *testing.T) {
 		// ErrCancelledByCommand is treated differently to a context cancellation error
 	})
 
+	t.Run("cancelled by requestor", func(t *testing.T) {
+		td, qe := newTestData(t, 10, 7)
+		defer td.cancel()
+		td.manager.responseTask.CancelAck = true
+		blockHookExpect(t, td, 5, func(hookActions graphsync.OutgoingBlockHookActions) {
+			select {
+			case td.signals.ErrSignal <- ErrCancelledByRequestor:
+			default:
+				require.Fail(t, "failed to send error signal")
+			}
+		}, 6)
+		transactionExpect(t, td, []int{6, 7}, ErrCancelledByRequestor.Error())
+
+		require.Equal(t, false, qe.ExecuteTask(td.ctx, td.peer, td.task))
+		require.Equal(t, 0, td.clearRequestCalls)
+		// responses still waiting to be sent are dropped before the final status
+		require.Equal(t, 1, td.discardQueuedCalls)
+	})
+
+	t.Run("cancelled by requestor that expects no reply", func(t *testing.T) {
+		td, qe := newTestData(t, 10, 7)
+		defer td.cancel()
+		blockHookExpect(t, td, 5, func(hookActions graphsync.OutgoingBlockHookActions) {
+			select {
+			case td.signals.ErrSignal <- ErrCancelledByRequestor:
+			default:
+				require.Fail(t, "failed to send error signal")
+			}
+		}, 6)
+		// no final status is sent
+		transactionExpect(t, td, []int{6}, ErrCancelledByRequestor.Error())
+
+		require.Equal(t, false, qe.ExecuteTask(td.ctx, td.peer, td.task))
+		require.Equal(t, 1, td.clearRequestCalls)
+		require.Equal(t, 1, td.discardQueuedCalls)
+	})
+
 	t.Run("unknown error by hook", func(t *testing.T) {
 		td, qe := newTestData(t, 10, 7)
 		defer td.cancel()
@@ -206,6 +252,62 @@ func TestSmallGraphTask(t *testing.T) {
 		require.Equal(t, 1, td.clearRequestCalls)
 	})
 
+	t.Run("budget exceeded", func(t *testing.T) {
+		for kind, limit := range map[string]graphsync.LimitName{
+			"link":  graphsync.LimitMaxLinksPerIncomingRequests,
+			"depth": graphsync.LimitMaxRecursionDepth,
+		} {
+			td, _ := newTestData(t, 10, 7)
+			defer td.cancel()
+			limitRecorder := limits.NewRecorder(time.Minute, nil)
+			qe := New(td.ctx, td.manager, td.blockHooks, td.updateHooks, nil, limitRecorder, nil)
+			td.manager.responseTask.Traverser = &budgetExceededTraverser{kind: kind}
+			td.manager.responseTask.BudgetStatus = true
+			var status graphsync.ResponseStatusCode
+			td.responseStream.responseBuilder.finishWithErr = func(s graphsync.ResponseStatusCode) { status = s }
+			transactionExpect(t, td, []int{0}, (&traversal.ErrBudgetExceeded{BudgetKind: kind}).Error())
+
+			require.Equal(t, false, qe.ExecuteTask(td.ctx, td.peer, td.task))
+			hits, _ := limitRecorder.Hits(limit)
+			require.Equal(t, uint64(1), hits, "should record a hit on %s", limit)
+			require.Equal(t, graphsync.RequestFailedBudgetExceeded, status)
+		}
+	})
+
+	t.Run("budget exceeded for requestor without budget status", func(t *testing.T) {
+		td, qe := newTestData(t, 10, 7)
+		defer td.cancel()
+		td.manager.responseTask.Traverser = &budgetExceededTraverser{kind: "link"}
+		var status graphsync.ResponseStatusCode
+		td.responseStream.responseBuilder.finishWithErr = func(s graphsync.ResponseStatusCode) { status = s }
+		transactionExpect(t, td, []int{0}, (&traversal.ErrBudgetExceeded{BudgetKind: "link"}).Error())
+
+		require.Equal(t, false, qe.ExecuteTask(td.ctx, td.peer, td.task))
+		// older requestors cannot decode the newer status code
+		require.Equal(t, graphsync.RequestFailedUnknown, status)
+	})
+
+	t.Run("cancelled while rate limited", func(t *testing.T) {
+		// the first block waits for bandwidth, and is never sent
+		td, _ := newTestData(t, 10, 1)
+		defer td.cancel()
+		rateLimiter := ratelimiter.New(1, 0)
+		// use up the available bandwidth
+		rateLimiter.Reserve(td.peer, 1)
+		qe := New(td.ctx, td.manager, td.blockHooks, td.updateHooks, nil, nil, rateLimiter)
+		td.manager.responseTask.Ctx = td.ctx
+		blockHookExpect(t, td, 0, func(hookActions graphsync.OutgoingBlockHookActions) {}, 0)
+		transactionExpect(t, td, []int{0}, ErrCancelledByCommand.Error())
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			td.signals.ErrSignal <- ErrCancelledByCommand
+		}()
+
+		require.Equal(t, false, qe.ExecuteTask(td.ctx, td.peer, td.task))
+		// bandwidth reserved for the unsent block is released
+		require.Less(t, rateLimiter.Reserve(td.peer, 1).Delay(), time.Second)
+	})
+
 	t.Run("first block wont load", func(t *testing.T) {
 		td, qe := newTestData(t, 10, 7)
 		defer td.cancel()
@@ -236,30 +338,31 @@ func newRandomBlock(index int64) *blockData {
 }
 
 type testData struct {
-	ctx               context.Context
-	t                 *testing.T
-	cancel            func()
-	task              *peertask.Task
-	blockStore        map[ipld.Link][]byte
-	persistence       ipld.LinkSystem
-	manager           *fauxManager
-	responseStream    *fauxResponseStream
-	responseBuilder   *fauxResponseBuilder
-	blockHooks        *hooks.OutgoingBlockHooks
-	updateHooks       *hooks.RequestUpdatedHooks
-	extensionData     datamodel.Node
-	extensionName     graphsync.ExtensionName
-	extension         graphsync.ExtensionData
-	requestID         graphsync.RequestID
-	requestCid        cid.Cid
-	requestSelector   datamodel.Node
-	requests          []gsmsg.GraphSyncRequest
-	signals           *ResponseSignals
-	pauseCalls        int
-	clearRequestCalls int
-	expectedBlocks    []*blockData
-	responseCode      graphsync.ResponseStatusCode
-	peer              peer.ID
+	ctx                context.Context
+	t                  *testing.T
+	cancel             func()
+	task               *peertask.Task
+	blockStore         map[ipld.Link][]byte
+	persistence        ipld.LinkSystem
+	manager            *fauxManager
+	responseStream     *fauxResponseStream
+	responseBuilder    *fauxResponseBuilder
+	blockHooks         *hooks.OutgoingBlockHooks
+	updateHooks        *hooks.RequestUpdatedHooks
+	extensionData      datamodel.Node
+	extensionName      graphsync.ExtensionName
+	extension          graphsync.ExtensionData
+	requestID          graphsync.RequestID
+	requestCid         cid.Cid
+	requestSelector    datamodel.Node
+	requests           []gsmsg.GraphSyncRequest
+	signals            *ResponseSignals
+	pauseCalls         int
+	clearRequestCalls  int
+	discardQueuedCalls int
+	expectedBlocks     []*blockData
+	responseCode       graphsync.ResponseStatusCode
+	peer               peer.ID
 }
 
 func newTestData(t *testing.T, blockCount int, expectedTraverse int) (*testData, *QueryExecutor) {
@@ -323,6 +426,9 @@ func newTestData(t *testing.T, blockCount int, expectedTraverse int) (*testData,
 		clearRequestCb: func() {
 			td.clearRequestCalls++
 		},
+		discardQueuedCb: func() {
+			td.discardQueuedCalls++
+		},
 		responseBuilder: td.responseBuilder,
 	}
 
@@ -358,6 +464,9 @@ func newTestData(t *testing.T, blockCount int, expectedTraverse int) (*testData,
 		td.manager,
 		td.blockHooks,
 		td.updateHooks,
+		nil,
+		nil,
+		nil,
 	)
 	return td, qe
 }
@@ -393,6 +502,7 @@ type fauxResponseStream struct {
 	responseBuilder *fauxResponseBuilder
 	transactionCb   func(error)
 	clearRequestCb  func()
+	discardQueuedCb func()
 }
 
 func (fra *fauxResponseStream) ClearRequest() {
@@ -400,6 +510,11 @@ func (fra *fauxResponseStream) ClearRequest() {
 		fra.clearRequestCb()
 	}
 }
+func (fra *fauxResponseStream) DiscardQueued() {
+	if fra.discardQueuedCb != nil {
+		fra.discardQueuedCb()
+	}
+}
 func (fra *fauxResponseStream) Transaction(transaction responseassembler.Transaction) error {
 	var err error
 	if fra.responseBuilder != nil {
@@ -418,6 +533,7 @@ type fauxResponseBuilder struct {
 	sendResponseCb func(ipld.Link, []byte) graphsync.BlockData
 	finishRequest  graphsync.ResponseStatusCode
 	pauseCb        func()
+	finishWithErr  func(graphsync.ResponseStatusCode)
 }
 
 func (rb fauxResponseBuilder) SendResponse(link ipld.Link, data []byte) graphsync.BlockData {
@@ -435,6 +551,9 @@ func (rb fauxResponseBuilder) FinishRequest() graphsync.ResponseStatusCode {
 }
 
 func (rb fauxResponseBuilder) FinishWithError(status graphsync.ResponseStatusCode) {
+	if rb.finishWithErr != nil {
+		rb.finishWithErr(status)
+	}
 }
 
 func (rb fauxResponseBuilder) PauseRequest() {
@@ -518,6 +637,15 @@ func (t fauxTraverser) NBlocksTraversed() int {
 	return t.curLink
 }
 
+type budgetExceededTraverser struct {
+	fauxTraverser
+	kind string
+}
+
+func (t budgetExceededTraverser) IsComplete() (bool, error) {
+	return true, &traversal.ErrBudgetExceeded{BudgetKind: t.kind}
+}
+
 type skipMeTraverser struct {
 	fauxTraverser
 }
@@ -16,6 +16,7 @@ type peerLinkTracker struct {
 	dedupKeys       map[graphsync.RequestID]string
 	blockSentCount  map[graphsync.RequestID]int64
 	skipFirstBlocks map[graphsync.RequestID]int64
+	metadataOnly    map[graphsync.RequestID]struct{}
 }
 
 func newTracker() *peerLinkTracker {
@@ -25,6 +26,7 @@ func newTracker() *peerLinkTracker {
 		altTrackers:     make(map[string]*linktracker.LinkTracker),
 		blockSentCount:  make(map[graphsync.RequestID]int64),
 		skipFirstBlocks: make(map[graphsync.RequestID]int64),
+		metadataOnly:    make(map[graphsync.RequestID]struct{}),
 	}
 }
 
@@ -64,6 +66,15 @@ func (prs *peerLinkTracker) SkipFirstBlocks(requestID graphsync.RequestID, block
 	prs.linkTrackerLk.Unlock()
 }
 
+// MetadataOnly indicates that no blocks should be sent for a request. Blocks
+// traversed by the request are not recorded as sent, so they are still sent to
+// other requests
+func (prs *peerLinkTracker) MetadataOnly(requestID graphsync.RequestID) {
+	prs.linkTrackerLk.Lock()
+	prs.metadataOnly[requestID] = struct{}{}
+	prs.linkTrackerLk.Unlock()
+}
+
 // FinishTracking clears link tracking data for the request.
 func (prs *peerLinkTracker) FinishTracking(requestID graphsync.RequestID) bool {
 	prs.linkTrackerLk.Lock()
@@ -86,6 +97,7 @@ func (prs *peerLinkTracker) FinishTracking(requestID graphsync.RequestID) bool {
 	}
 	delete(prs.blockSentCount, requestID)
 	delete(prs.skipFirstBlocks, requestID)
+	delete(prs.metadataOnly, requestID)
 	return allBlocks
 }
 
@@ -95,8 +107,16 @@ func (prs *peerLinkTracker) RecordLinkTraversal(requestID graphsync.RequestID,
 	prs.linkTrackerLk.Lock()
 	defer prs.linkTrackerLk.Unlock()
 	prs.blockSentCount[requestID]++
-	notSkipped := prs.skipFirstBlocks[requestID] < prs.blockSentCount[requestID]
 	linkTracker := prs.getLinkTracker(requestID)
+	if _, ok := prs.metadataOnly[requestID]; ok {
+		// only missing blocks are tracked, so the request still completes partially
+		// if it is missing any
+		if !hasBlock {
+			linkTracker.RecordLinkTraversal(requestID, link, false)
+		}
+		return false, prs.blockSentCount[requestID]
+	}
+	notSkipped := prs.skipFirstBlocks[requestID] < prs.blockSentCount[requestID]
 	isUnique := linkTracker.BlockRefCount(link) == 0
 	linkTracker.RecordLinkTraversal(requestID, link, hasBlock)
 	return hasBlock && notSkipped && isUnique, prs.blockSentCount[requestID]
@@ -21,10 +21,11 @@ type responseOperation interface {
 }
 
 type responseBuilder struct {
-	ctx         context.Context
-	requestID   graphsync.RequestID
-	operations  []responseOperation
-	linkTracker *peerLinkTracker
+	ctx            context.Context
+	requestID      graphsync.RequestID
+	operations     []responseOperation
+	linkTracker    *peerLinkTracker
+	completingHook CompletingHook
 }
 
 func (rb *responseBuilder) SendResponse(link ipld.Link, data []byte) graphsync.BlockData {
@@ -39,12 +40,26 @@ func (rb *responseBuilder) SendExtensionData(extension graphsync.ExtensionData)
 
 func (rb *responseBuilder) FinishRequest() graphsync.ResponseStatusCode {
 	op := rb.setupFinishOperation()
+	rb.runCompletingHook(op.status)
 	rb.operations = append(rb.operations, op)
 	return op.status
 }
 
 func (rb *responseBuilder) FinishWithError(status graphsync.ResponseStatusCode) {
-	rb.operations = append(rb.operations, rb.setupFinishWithErrOperation(status))
+	op := rb.setupFinishWithErrOperation(status)
+	rb.runCompletingHook(op.status)
+	rb.operations = append(rb.operations, op)
+}
+
+// runCompletingHook adds the extensions from the completing hook, if any, so
+// they are sent with the final status
+func (rb *responseBuilder) runCompletingHook(status graphsync.ResponseStatusCode) {
+	if rb.completingHook == nil {
+		return
+	}
+	for _, extension := range rb.completingHook(status) {
+		rb.SendExtensionData(extension)
+	}
 }
 
 func (rb *responseBuilder) PauseRequest() {
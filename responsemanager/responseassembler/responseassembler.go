@@ -10,6 +10,7 @@ package responseassembler
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 
 	"github.com/ipld/go-ipld-prime"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -53,10 +54,16 @@ type ResponseBuilder interface {
 	Context() context.Context
 }
 
+// CompletingHook runs when a response finishes with the given status, returning
+// extension data to send in the same response as the final status
+type CompletingHook func(status graphsync.ResponseStatusCode) []graphsync.ExtensionData
+
 // PeerMessageHandler is an interface that can queue a response for a given peer to go out over the network
-// If blkSize > 0, message building may block until enough memory has been freed from the queues to allocate the message.
+// If blkSize > 0, message building may block until enough memory has been freed from the queues to allocate the message,
+// with higher priority messages allocated first, or until ctx is cancelled, in which case the message is not built.
 type PeerMessageHandler interface {
-	AllocateAndBuildMessage(p peer.ID, blkSize uint64, buildResponseFn func(*messagequeue.Builder))
+	AllocateAndBuildMessage(ctx context.Context, p peer.ID, blkSize uint64, priority graphsync.Priority, buildResponseFn func(*messagequeue.Builder))
+	ScrubResponses(p peer.ID, requestIDs []graphsync.RequestID)
 }
 
 // ResponseAssembler manages assembling responses to go out over the network
@@ -71,30 +78,45 @@ func New(ctx context.Context, peerHandler PeerMessageHandler) *ResponseAssembler
 	return &ResponseAssembler{
 		PeerManager: peermanager.New(ctx, func(ctx context.Context, p peer.ID) peermanager.PeerHandler {
 			return newTracker()
-		}),
+		}, 0),
 		peerHandler: peerHandler,
 	}
 }
 
 func (ra *ResponseAssembler) NewStream(ctx context.Context, p peer.ID, requestID graphsync.RequestID, subscriber notifications.Subscriber) ResponseStream {
+	// the stream keeps the link tracker the peer had when it opened, so once
+	// the peer disconnects and its tracker is dropped, the stream cannot touch
+	// the tracking of a new request that reuses its ID
 	return &responseStream{
 		ctx:            ctx,
 		requestID:      requestID,
 		p:              p,
 		messageSenders: ra.peerHandler,
-		linkTrackers:   ra.PeerManager,
+		linkTracker:    ra.GetProcess(p).(*peerLinkTracker),
 		subscriber:     subscriber,
 	}
 }
 
+// RejectDuplicate sends a RequestRejected status for a request that reuses the
+// ID of a response still in progress to the peer. Unlike finishing a stream,
+// it leaves the link tracking and subscriber of that response alone
+func (ra *ResponseAssembler) RejectDuplicate(p peer.ID, requestID graphsync.RequestID) {
+	ra.peerHandler.AllocateAndBuildMessage(context.Background(), p, 0, 0, func(builder *messagequeue.Builder) {
+		builder.AddResponseCode(requestID, graphsync.RequestRejected)
+	})
+}
+
 type responseStream struct {
 	ctx            context.Context
 	requestID      graphsync.RequestID
 	p              peer.ID
 	closed         bool
 	closedLk       sync.RWMutex
+	priority       int32
+	completingHook CompletingHook
+	compression    graphsync.CompressionCodec
 	messageSenders PeerMessageHandler
-	linkTrackers   *peermanager.PeerManager
+	linkTracker    *peerLinkTracker
 	subscriber     notifications.Subscriber
 }
 
@@ -116,38 +138,84 @@ type ResponseStream interface {
 	DedupKey(key string)
 	IgnoreBlocks(links []ipld.Link)
 	SkipFirstBlocks(skipFirstBlocks int64)
+	// MetadataOnly stops the assembler sending any blocks for this request,
+	// while still sending metadata for every link traversed
+	MetadataOnly()
+	// SetPriority sets the priority blocks for this request are queued with,
+	// relative to other requests from the same peer
+	SetPriority(priority graphsync.Priority)
+	// SetCompletingHook sets a hook that runs when the response finishes. It
+	// must be called before the first transaction
+	SetCompletingHook(hook CompletingHook)
+	// SetBlockCompression compresses the blocks in messages carrying responses
+	// for this request with the given codec. It must be called before the
+	// first transaction
+	SetBlockCompression(codec graphsync.CompressionCodec)
 	// ClearRequest removes all tracking for this request.
 	ClearRequest()
+	// DiscardQueued removes any responses for this request that are queued
+	// but not yet sent.
+	DiscardQueued()
+	// Close stops any further messages being sent for this request
+	Close() error
 }
 
 // DedupKey indicates that outgoing blocks should be deduplicated in a seperate bucket (only with requests that share
 // supplied key string)
 func (rs *responseStream) DedupKey(key string) {
-	rs.linkTrackers.GetProcess(rs.p).(*peerLinkTracker).DedupKey(rs.requestID, key)
+	rs.linkTracker.DedupKey(rs.requestID, key)
 }
 
 // IgnoreBlocks indicates that a list of keys should be ignored when sending blocks
 func (rs *responseStream) IgnoreBlocks(links []ipld.Link) {
-	rs.linkTrackers.GetProcess(rs.p).(*peerLinkTracker).IgnoreBlocks(rs.requestID, links)
+	rs.linkTracker.IgnoreBlocks(rs.requestID, links)
 }
 
 // SkipFirstBlocks tells the assembler for the given request to not send the first N blocks
 func (rs *responseStream) SkipFirstBlocks(skipFirstBlocks int64) {
-	rs.linkTrackers.GetProcess(rs.p).(*peerLinkTracker).SkipFirstBlocks(rs.requestID, skipFirstBlocks)
+	rs.linkTracker.SkipFirstBlocks(rs.requestID, skipFirstBlocks)
+}
+
+// MetadataOnly tells the assembler for the given request to send no blocks
+func (rs *responseStream) MetadataOnly() {
+	rs.linkTracker.MetadataOnly(rs.requestID)
+}
+
+// SetPriority sets the priority blocks for this request are queued with
+func (rs *responseStream) SetPriority(priority graphsync.Priority) {
+	atomic.StoreInt32(&rs.priority, int32(priority))
+}
+
+// SetCompletingHook sets a hook that runs when the response finishes
+func (rs *responseStream) SetCompletingHook(hook CompletingHook) {
+	rs.completingHook = hook
+}
+
+// SetBlockCompression sets the codec blocks for this request are compressed
+// with. Other requests from the same peer may share messages with this one,
+// and their blocks are compressed too, which is safe since the peer can
+// decompress them
+func (rs *responseStream) SetBlockCompression(codec graphsync.CompressionCodec) {
+	rs.compression = codec
 }
 
 // ClearRequest removes all tracking for this request.
 func (rs *responseStream) ClearRequest() {
-	_ = rs.linkTrackers.GetProcess(rs.p).(*peerLinkTracker).FinishTracking(rs.requestID)
+	_ = rs.linkTracker.FinishTracking(rs.requestID)
+}
+
+func (rs *responseStream) DiscardQueued() {
+	rs.messageSenders.ScrubResponses(rs.p, []graphsync.RequestID{rs.requestID})
 }
 
 func (rs *responseStream) Transaction(transaction Transaction) error {
 	ctx, span := otel.Tracer("graphsync").Start(rs.ctx, "transaction")
 	defer span.End()
 	rb := &responseBuilder{
-		ctx:         ctx,
-		requestID:   rs.requestID,
-		linkTracker: rs.linkTrackers.GetProcess(rs.p).(*peerLinkTracker),
+		ctx:            ctx,
+		requestID:      rs.requestID,
+		linkTracker:    rs.linkTracker,
+		completingHook: rs.completingHook,
 	}
 	err := transaction(rb)
 	rs.execute(ctx, rb.operations)
@@ -165,7 +233,8 @@ func (rs *responseStream) execute(ctx context.Context, operations []responseOper
 	for _, op := range operations {
 		size += op.size()
 	}
-	rs.messageSenders.AllocateAndBuildMessage(rs.p, size, func(builder *messagequeue.Builder) {
+	priority := graphsync.Priority(atomic.LoadInt32(&rs.priority))
+	rs.messageSenders.AllocateAndBuildMessage(rs.ctx, rs.p, size, priority, func(builder *messagequeue.Builder) {
 		_, span = otel.Tracer("graphsync").Start(ctx, "buildMessage", trace.WithLinks(trace.LinkFromContext(builder.Context())))
 		defer span.End()
 
@@ -175,6 +244,9 @@ func (rs *responseStream) execute(ctx context.Context, operations []responseOper
 		for _, op := range operations {
 			op.build(builder)
 		}
+		if rs.compression != nil {
+			builder.SetBlockCompression(rs.compression)
+		}
 		builder.SetResponseStream(rs.requestID, rs)
 		builder.SetSubscriber(rs.requestID, rs.subscriber)
 	})
@@ -134,6 +134,31 @@ func TestResponseAssemblerSendsResponses(t *testing.T) {
 	}, tracing.TracesToStrings())
 }
 
+func TestResponseAssemblerPriority(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	p := testutil.GeneratePeers(1)[0]
+	blks := testutil.GenerateBlocksOfSize(2, 100)
+	fph := newFakePeerHandler(ctx, t)
+	responseAssembler := New(ctx, fph)
+
+	stream := responseAssembler.NewStream(ctx, p, graphsync.NewRequestID(), nil)
+	require.NoError(t, stream.Transaction(func(b ResponseBuilder) error {
+		b.SendResponse(cidlink.Link{Cid: blks[0].Cid()}, blks[0].RawData())
+		return nil
+	}))
+	require.Equal(t, graphsync.Priority(0), fph.lastPriority)
+
+	// messages are allocated with the priority set for the stream
+	stream.SetPriority(graphsync.Priority(10))
+	require.NoError(t, stream.Transaction(func(b ResponseBuilder) error {
+		b.SendResponse(cidlink.Link{Cid: blks[1].Cid()}, blks[1].RawData())
+		return nil
+	}))
+	require.Equal(t, graphsync.Priority(10), fph.lastPriority)
+}
+
 func TestResponseAssemblerCloseStream(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
@@ -217,6 +242,54 @@ func TestResponseAssemblerSendsExtensionData(t *testing.T) {
 	fph.AssertExtensions([][]graphsync.ExtensionData{{extension1, extension2}})
 }
 
+func TestResponseAssemblerCompletingHook(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.NewRequestID()
+	requestID2 := graphsync.NewRequestID()
+	blks := testutil.GenerateBlocksOfSize(1, 100)
+	fph := newFakePeerHandler(ctx, t)
+	responseAssembler := New(ctx, fph)
+
+	extension := graphsync.ExtensionData{
+		Name: graphsync.ExtensionName("AppleSauce/McGee"),
+		Data: basicnode.NewBytes(testutil.RandomBytes(100)),
+	}
+	var statuses []graphsync.ResponseStatusCode
+	completingHook := func(status graphsync.ResponseStatusCode) []graphsync.ExtensionData {
+		statuses = append(statuses, status)
+		return []graphsync.ExtensionData{extension}
+	}
+
+	// the hook does not run until the response finishes, and its extensions go
+	// out with the final status
+	stream1 := responseAssembler.NewStream(ctx, p, requestID1, nil)
+	stream1.SetCompletingHook(completingHook)
+	require.NoError(t, stream1.Transaction(func(b ResponseBuilder) error {
+		b.SendResponse(cidlink.Link{Cid: blks[0].Cid()}, blks[0].RawData())
+		return nil
+	}))
+	require.Empty(t, statuses)
+	require.NoError(t, stream1.Transaction(func(b ResponseBuilder) error {
+		b.FinishRequest()
+		return nil
+	}))
+	fph.AssertResponses(expectedResponses{requestID1: graphsync.RequestCompletedFull})
+	fph.AssertExtensions([][]graphsync.ExtensionData{{extension}})
+
+	stream2 := responseAssembler.NewStream(ctx, p, requestID2, nil)
+	stream2.SetCompletingHook(completingHook)
+	require.NoError(t, stream2.Transaction(func(b ResponseBuilder) error {
+		b.FinishWithError(graphsync.RequestFailedUnknown)
+		return nil
+	}))
+	fph.AssertResponses(expectedResponses{requestID2: graphsync.RequestFailedUnknown})
+	fph.AssertExtensions([][]graphsync.ExtensionData{{extension}})
+	require.Equal(t, []graphsync.ResponseStatusCode{graphsync.RequestCompletedFull, graphsync.RequestFailedUnknown}, statuses)
+}
+
 func TestResponseAssemblerSendsResponsesInTransaction(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
@@ -422,6 +495,62 @@ func TestResponseAssemblerSkipFirstBlocks(t *testing.T) {
 
 }
 
+func TestResponseAssemblerMetadataOnly(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	p := testutil.GeneratePeers(1)[0]
+	requestID1 := graphsync.NewRequestID()
+	requestID2 := graphsync.NewRequestID()
+	blks := testutil.GenerateBlocksOfSize(5, 100)
+	links := make([]ipld.Link, 0, len(blks))
+	for _, block := range blks {
+		links = append(links, cidlink.Link{Cid: block.Cid()})
+	}
+	fph := newFakePeerHandler(ctx, t)
+	responseAssembler := New(ctx, fph)
+
+	sub1 := testutil.NewTestSubscriber(10)
+	stream1 := responseAssembler.NewStream(ctx, p, requestID1, sub1)
+	sub2 := testutil.NewTestSubscriber(10)
+	stream2 := responseAssembler.NewStream(ctx, p, requestID2, sub2)
+
+	stream1.MetadataOnly()
+
+	var bd1, bd2, bd3 graphsync.BlockData
+	err := stream1.Transaction(func(b ResponseBuilder) error {
+		bd1 = b.SendResponse(links[0], blks[0].RawData())
+		bd2 = b.SendResponse(links[1], blks[1].RawData())
+		bd3 = b.SendResponse(links[2], nil)
+		b.FinishRequest()
+		return nil
+	})
+	require.NoError(t, err)
+
+	assertSentNotOnWire(t, bd1, blks[0])
+	assertSentNotOnWire(t, bd2, blks[1])
+	assertNotSent(t, bd3, blks[2])
+	fph.RefuteBlocks()
+	// a missing block still makes the response partial
+	fph.AssertResponses(expectedResponses{requestID1: graphsync.RequestCompletedPartial})
+	fph.AssertBlockData(requestID1, bd1)
+	fph.AssertBlockData(requestID1, bd2)
+	fph.AssertBlockData(requestID1, bd3)
+
+	// blocks traversed by a metadata only request were never sent, so other
+	// requests still send them
+	err = stream2.Transaction(func(b ResponseBuilder) error {
+		bd1 = b.SendResponse(links[0], blks[0].RawData())
+		b.FinishRequest()
+		return nil
+	})
+	require.NoError(t, err)
+
+	assertSentOnWire(t, bd1, blks[0])
+	fph.AssertBlocks(blks[0])
+	fph.AssertResponses(expectedResponses{requestID2: graphsync.RequestCompletedFull})
+}
+
 func TestResponseAssemblerDupKeys(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
@@ -548,6 +677,8 @@ type fakePeerHandler struct {
 	lastResponses       []gsmsg.GraphSyncResponse
 	lastSubscribers     map[graphsync.RequestID]notifications.Subscriber
 	lastBlockData       map[graphsync.RequestID][]graphsync.BlockData
+	scrubbed            []graphsync.RequestID
+	lastPriority        graphsync.Priority
 	sent                chan struct{}
 }
 
@@ -629,7 +760,8 @@ func (fph *fakePeerHandler) RefuteResponses() {
 	require.Empty(fph.t, fph.lastResponses)
 }
 
-func (fph *fakePeerHandler) AllocateAndBuildMessage(p peer.ID, blkSize uint64, buildMessageFn func(*messagequeue.Builder)) {
+func (fph *fakePeerHandler) AllocateAndBuildMessage(ctx context.Context, p peer.ID, blkSize uint64, priority graphsync.Priority, buildMessageFn func(*messagequeue.Builder)) {
+	fph.lastPriority = priority
 	builder := messagequeue.NewBuilder(context.TODO(), messagequeue.Topic(0))
 	buildMessageFn(builder)
 
@@ -639,6 +771,10 @@ func (fph *fakePeerHandler) AllocateAndBuildMessage(p peer.ID, blkSize uint64, b
 	fph.sendResponse(p, msg.Responses(), msg.Blocks(), builder.ResponseStreams(), builder.Subscribers(), builder.BlockData())
 }
 
+func (fph *fakePeerHandler) ScrubResponses(p peer.ID, requestIDs []graphsync.RequestID) {
+	fph.scrubbed = append(fph.scrubbed, requestIDs...)
+}
+
 func (fph *fakePeerHandler) sendResponse(p peer.ID,
 	responses []gsmsg.GraphSyncResponse,
 	blks []blocks.Block,
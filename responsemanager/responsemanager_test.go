@@ -3,8 +3,10 @@ package responsemanager
 import (
 	"context"
 	"errors"
+	"io"
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -16,6 +18,7 @@ import (
 	"github.com/ipld/go-ipld-prime/datamodel"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/ipld/go-ipld-prime/node/basicnode"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/stretchr/testify/require"
 	"go.opentelemetry.io/otel"
@@ -23,6 +26,8 @@ import (
 
 	"github.com/ipfs/go-graphsync"
 	"github.com/ipfs/go-graphsync/cidset"
+	"github.com/ipfs/go-graphsync/compression"
+	"github.com/ipfs/go-graphsync/deadline"
 	"github.com/ipfs/go-graphsync/dedupkey"
 	"github.com/ipfs/go-graphsync/donotsendfirstblocks"
 	"github.com/ipfs/go-graphsync/listeners"
@@ -34,6 +39,7 @@ import (
 	"github.com/ipfs/go-graphsync/responsemanager/queryexecutor"
 	"github.com/ipfs/go-graphsync/responsemanager/responseassembler"
 	"github.com/ipfs/go-graphsync/selectorvalidator"
+	"github.com/ipfs/go-graphsync/supportedextensions"
 	"github.com/ipfs/go-graphsync/taskqueue"
 	"github.com/ipfs/go-graphsync/testutil"
 )
@@ -118,6 +124,37 @@ func TestIncomingQuery(t *testing.T) {
 	require.Equal(t, responseSpan.Links[0].SpanContext.SpanID(), messageSpan.SpanContext.SpanID())
 }
 
+func TestResponseContext(t *testing.T) {
+	td := newTestData(t)
+	defer td.cancel()
+	responseManager := td.newResponseManager()
+
+	responseCtxs := make(chan context.Context, 1)
+	td.requestHooks.Register(func(p peer.ID, request graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+		responseCtxs <- hookActions.ResponseContext()
+	})
+	td.requestHooks.Register(selectorvalidator.SelectorValidator(100))
+	// hold the response on its first block, to check the context outlives the hook
+	waitForCheck := make(chan struct{})
+	td.blockHooks.Register(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		<-waitForCheck
+	})
+	responseManager.Startup()
+
+	responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+	var responseCtx context.Context
+	testutil.AssertReceive(td.ctx, t, responseCtxs, &responseCtx, "should run request hook")
+	td.assertSendBlock()
+	require.NoError(t, responseCtx.Err(), "should not cancel the context while the response is in progress")
+
+	close(waitForCheck)
+	for i := 1; i < td.blockChainLength; i++ {
+		td.assertSendBlock()
+	}
+	td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
+	testutil.AssertDoesReceive(td.ctx, t, responseCtx.Done(), "should cancel the context when the response completes")
+}
+
 func TestCancellationQueryInProgress(t *testing.T) {
 	td := newTestData(t)
 	defer td.cancel()
@@ -150,11 +187,16 @@ func TestCancellationQueryInProgress(t *testing.T) {
 	responseManager.synchronize()
 	close(waitForCancel)
 
+	// responses still waiting to go out are dropped, and the requestor is told
+	// the response was cancelled
+	td.assertQueuedResponsesDiscarded(td.requestID)
+	td.assertOnlyCompleteProcessingWith(graphsync.RequestCancelled)
+	// listeners hear of the cancel once the final status is sent
+	testutil.AssertChannelEmpty(t, cancelledListenerCalled, "should not call cancelled listener before the final status is sent")
+	td.notifyStatusMessagesSent()
 	testutil.AssertDoesReceive(td.ctx, t, cancelledListenerCalled, "should call cancelled listener")
 	td.connManager.RefuteProtected(t, td.p)
 
-	td.assertRequestCleared()
-
 	tracing := td.collectTracing(t)
 	traceStrings := tracing.TracesToStrings()
 	require.Contains(t, traceStrings, "processRequests(0)")
@@ -172,6 +214,43 @@ func TestCancellationQueryInProgress(t *testing.T) {
 	require.Equal(t, abortRequestSpan.Links[0].SpanContext.SpanID(), message1Span.SpanContext.SpanID())
 }
 
+func TestCancellationFromRequestorWithoutAck(t *testing.T) {
+	td := newTestData(t)
+	defer td.cancel()
+	responseManager := td.newResponseManager()
+	td.requestHooks.Register(selectorvalidator.SelectorValidator(100))
+	blkCount := 0
+	waitForCancel := make(chan struct{})
+	td.blockHooks.Register(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+		if blkCount == 1 {
+			<-waitForCancel
+		}
+		blkCount++
+	})
+	cancelledListenerCalled := make(chan struct{}, 1)
+	td.cancelledListeners.Register(func(p peer.ID, request graphsync.RequestData) {
+		cancelledListenerCalled <- struct{}{}
+	})
+	responseManager.Startup()
+	// older requestors pause by cancelling, and do not list any extensions
+	responseManager.ProcessRequests(td.ctx, td.p, []gsmsg.GraphSyncRequest{
+		gsmsg.NewRequest(td.requestID, td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(0)),
+	})
+	td.assertSendBlock()
+
+	responseManager.ProcessRequests(td.ctx, td.p, []gsmsg.GraphSyncRequest{gsmsg.NewCancelRequest(td.requestID)})
+	responseManager.synchronize()
+	close(waitForCancel)
+
+	// the response ends without a final status
+	td.assertQueuedResponsesDiscarded(td.requestID)
+	td.assertRequestCleared()
+	testutil.AssertDoesReceive(td.ctx, t, cancelledListenerCalled, "should call cancelled listener")
+	td.taskqueue.WaitForNoActiveTasks()
+	testutil.AssertChannelEmpty(t, td.completedRequestChan, "should not send a final status")
+	td.connManager.RefuteProtected(t, td.p)
+}
+
 func TestCancellationViaCommand(t *testing.T) {
 	td := newTestData(t)
 	defer td.cancel()
@@ -201,6 +280,136 @@ func TestCancellationViaCommand(t *testing.T) {
 	td.connManager.RefuteProtected(t, td.p)
 }
 
+func TestLoadContext(t *testing.T) {
+	// blocks the second load until its context is cancelled, the first time it
+	// is attempted
+	newBlockingLoadResponseManager := func(td *testData, loadCtxs chan<- context.Context) *ResponseManager {
+		var loads int32
+		lsys := td.persistence
+		readOpener := lsys.StorageReadOpener
+		lsys.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+			if atomic.AddInt32(&loads, 1) == 2 {
+				loadCtxs <- lctx.Ctx
+				<-lctx.Ctx.Done()
+				return nil, lctx.Ctx.Err()
+			}
+			return readOpener(lctx, lnk)
+		}
+		rm := New(td.ctx, lsys, td.responseAssembler, td.requestProcessingListeners, td.requestQueuedHooks, td.requestHooks, td.updateHooks, td.completingHooks, td.completedListeners, td.cancelledListeners, td.blockSentListeners, td.networkErrorListeners, td.connManager, 0, 0, nil, td.taskqueue, nil)
+		td.taskqueue.Startup(6, td.newQueryExecutor(rm))
+		return rm
+	}
+
+	t.Run("cancelling the request interrupts a load", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		loadCtxs := make(chan context.Context, 1)
+		responseManager := newBlockingLoadResponseManager(&td, loadCtxs)
+		td.requestHooks.Register(selectorvalidator.SelectorValidator(100))
+		responseManager.Startup()
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+
+		var loadCtx context.Context
+		testutil.AssertReceive(td.ctx, t, loadCtxs, &loadCtx, "should load second block")
+		requestID, ok := graphsync.RequestIDFromContext(loadCtx)
+		require.True(t, ok)
+		require.Equal(t, td.requestID, requestID)
+		p, ok := graphsync.PeerFromContext(loadCtx)
+		require.True(t, ok)
+		require.Equal(t, td.p, p)
+
+		responseManager.ProcessRequests(td.ctx, td.p, []gsmsg.GraphSyncRequest{
+			gsmsg.NewCancelRequest(td.requestID),
+		})
+		testutil.AssertDoesReceive(td.ctx, t, loadCtx.Done(), "should cancel the load context")
+		td.assertSendBlock()
+		td.assertCompleteRequestWith(graphsync.RequestCancelled)
+	})
+
+	t.Run("pausing the response interrupts a load, which is retried on unpause", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		loadCtxs := make(chan context.Context, 1)
+		responseManager := newBlockingLoadResponseManager(&td, loadCtxs)
+		td.requestHooks.Register(selectorvalidator.SelectorValidator(100))
+		responseManager.Startup()
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+
+		var loadCtx context.Context
+		testutil.AssertReceive(td.ctx, t, loadCtxs, &loadCtx, "should load second block")
+		err := responseManager.PauseResponse(td.ctx, td.requestID)
+		require.NoError(t, err)
+		testutil.AssertDoesReceive(td.ctx, t, loadCtx.Done(), "should cancel the load context")
+		td.assertPausedRequest()
+		td.verifyNResponses(1)
+
+		err = responseManager.UnpauseResponse(td.ctx, td.requestID)
+		require.NoError(t, err)
+		td.verifyNResponses(td.blockChainLength - 1)
+		td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
+	})
+}
+
+func TestDeadline(t *testing.T) {
+	newDeadlineRequest := func(td *testData, timeLeft time.Duration) []gsmsg.GraphSyncRequest {
+		return []gsmsg.GraphSyncRequest{
+			gsmsg.NewRequest(td.requestID, td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(0),
+				graphsync.ExtensionData{
+					Name: graphsync.ExtensionDeadline,
+					Data: deadline.EncodeDeadline(timeLeft),
+				}),
+		}
+	}
+
+	t.Run("cancels response in progress once deadline passes", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		td.requestHooks.Register(selectorvalidator.SelectorValidator(100))
+		// hold up the traversal after the first block until the deadline passes
+		blkCount := 0
+		deadlinePassed := make(chan struct{})
+		td.blockHooks.Register(func(p peer.ID, requestData graphsync.RequestData, blockData graphsync.BlockData, hookActions graphsync.OutgoingBlockHookActions) {
+			if blkCount == 1 {
+				<-deadlinePassed
+			}
+			blkCount++
+		})
+		responseManager.Startup()
+		responseManager.ProcessRequests(td.ctx, td.p, newDeadlineRequest(&td, 50*time.Millisecond))
+		td.assertSendBlock()
+		time.Sleep(100 * time.Millisecond)
+		responseManager.synchronize()
+		close(deadlinePassed)
+		td.assertCompleteRequestWith(graphsync.RequestCancelled)
+	})
+
+	t.Run("cancels queued response once deadline passes", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.nullTaskQueueResponseManager()
+		td.requestHooks.Register(selectorvalidator.SelectorValidator(100))
+		responseManager.Startup()
+		responseManager.ProcessRequests(td.ctx, td.p, newDeadlineRequest(&td, 50*time.Millisecond))
+		td.assertOnlyCompleteProcessingWith(graphsync.RequestCancelled)
+		td.notifyStatusMessagesSent()
+		responseManager.synchronize()
+		require.Empty(t, responseManager.InProgressResponses())
+	})
+
+	t.Run("response that finishes before the deadline is not cancelled", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		td.requestHooks.Register(selectorvalidator.SelectorValidator(100))
+		responseManager.Startup()
+		responseManager.ProcessRequests(td.ctx, td.p, newDeadlineRequest(&td, time.Minute))
+		td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
+		responseManager.synchronize()
+		require.Empty(t, responseManager.InProgressResponses())
+	})
+}
+
 func TestEarlyCancellation(t *testing.T) {
 	td := newTestData(t)
 	defer td.cancel()
@@ -223,10 +432,190 @@ func TestEarlyCancellation(t *testing.T) {
 
 	responseManager.synchronize()
 
+	td.assertQueuedResponsesDiscarded(td.requestID)
+	td.assertCompleteRequestWith(graphsync.RequestCancelled)
 	td.assertNoResponses()
 	td.connManager.RefuteProtected(t, td.p)
 }
 
+func TestQueuedRequests(t *testing.T) {
+	td := newTestData(t)
+	defer td.cancel()
+	// hold the first request as it loads its second block until the others
+	// are queued. Holding it in a block hook instead would hold the response
+	// assembler, which new requests need in order to be queued
+	waitForQueued := make(chan struct{})
+	var loads int32
+	lsys := td.persistence
+	readOpener := lsys.StorageReadOpener
+	lsys.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		if atomic.AddInt32(&loads, 1) == 2 {
+			<-waitForQueued
+		}
+		return readOpener(lctx, lnk)
+	}
+	// only a single request may be in progress at once
+	responseManager := New(td.ctx, lsys, td.responseAssembler, td.requestProcessingListeners, td.requestQueuedHooks, td.requestHooks, td.updateHooks, td.completingHooks, td.completedListeners, td.cancelledListeners, td.blockSentListeners, td.networkErrorListeners, td.connManager, 0, 0, nil, td.taskqueue, nil)
+	td.taskqueue.Startup(1, td.newQueryExecutor(responseManager))
+	td.requestHooks.Register(selectorvalidator.SelectorValidator(100))
+	queued := make(chan graphsync.RequestID, 3)
+	td.requestQueuedHooks.Register(func(p peer.ID, request graphsync.RequestData) {
+		queued <- request.ID()
+	})
+	processing := make(chan graphsync.RequestID, 3)
+	td.requestProcessingListeners.Register(func(p peer.ID, request graphsync.RequestData, inProgressRequestCount int) {
+		processing <- request.ID()
+	})
+	cancelled := make(chan graphsync.RequestID, 1)
+	td.cancelledListeners.Register(func(p peer.ID, request graphsync.RequestData) {
+		cancelled <- request.ID()
+	})
+	responseManager.Startup()
+
+	var requestID graphsync.RequestID
+	responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+	testutil.AssertReceive(td.ctx, t, queued, &requestID, "should queue request")
+	require.Equal(t, td.requestID, requestID)
+	testutil.AssertReceive(td.ctx, t, processing, &requestID, "should process request")
+	require.Equal(t, td.requestID, requestID)
+
+	lowPriorityID := graphsync.NewRequestID()
+	highPriorityID := graphsync.NewRequestID()
+	responseManager.ProcessRequests(td.ctx, td.p, []gsmsg.GraphSyncRequest{
+		gsmsg.NewRequest(lowPriorityID, td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(1)),
+		gsmsg.NewRequest(highPriorityID, td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(10)),
+	})
+	testutil.AssertReceive(td.ctx, t, queued, &requestID, "should queue request")
+	require.Equal(t, lowPriorityID, requestID)
+	testutil.AssertReceive(td.ctx, t, queued, &requestID, "should queue request")
+	require.Equal(t, highPriorityID, requestID)
+	responseManager.synchronize()
+	testutil.AssertChannelEmpty(t, processing, "should not process requests beyond the limit")
+
+	// cancelling a queued request removes it from the queue without processing it
+	responseManager.ProcessRequests(td.ctx, td.p, []gsmsg.GraphSyncRequest{
+		gsmsg.NewCancelRequest(lowPriorityID),
+	})
+	td.assertQueuedResponsesDiscarded(lowPriorityID)
+
+	// once the first request completes, the remaining request gets the free
+	// slot
+	close(waitForQueued)
+	completions := make(map[graphsync.RequestID]graphsync.ResponseStatusCode)
+	for i := 0; i < 3; i++ {
+		var completed completedRequest
+		testutil.AssertReceive(td.ctx, t, td.completedRequestChan, &completed, "should complete request")
+		completions[completed.requestID] = completed.result
+	}
+	require.Equal(t, map[graphsync.RequestID]graphsync.ResponseStatusCode{
+		td.requestID:   graphsync.RequestCompletedFull,
+		lowPriorityID:  graphsync.RequestCancelled,
+		highPriorityID: graphsync.RequestCompletedFull,
+	}, completions)
+	td.notifyStatusMessagesSent()
+	testutil.AssertReceive(td.ctx, t, cancelled, &requestID, "should cancel request")
+	require.Equal(t, lowPriorityID, requestID)
+	testutil.AssertReceive(td.ctx, t, processing, &requestID, "should process request")
+	require.Equal(t, highPriorityID, requestID)
+	testutil.AssertChannelEmpty(t, processing, "should not process cancelled request")
+}
+
+func TestMaxInProgressPerPeer(t *testing.T) {
+	td := newTestData(t)
+	defer td.cancel()
+	// requests stay queued, so they count towards the limit until they end
+	responseManager := td.nullTaskQueueResponseManager()
+	responseManager.SetMaxInProgressPerPeer(2)
+	td.requestHooks.Register(selectorvalidator.SelectorValidator(100))
+	responseManager.Startup()
+
+	newRequest := func(extensions ...graphsync.ExtensionData) gsmsg.GraphSyncRequest {
+		return gsmsg.NewRequest(graphsync.NewRequestID(), td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(0), extensions...)
+	}
+	requests := []gsmsg.GraphSyncRequest{newRequest(td.supportedExtensions), newRequest(), newRequest()}
+	responseManager.ProcessRequests(td.ctx, td.p, requests)
+	td.assertCompleteRequestWith(graphsync.RequestRejected)
+	require.Len(t, responseManager.InProgressResponses(), 2)
+
+	// other peers have their own limit
+	otherPeer := testutil.GeneratePeers(1)[0]
+	responseManager.ProcessRequests(td.ctx, otherPeer, []gsmsg.GraphSyncRequest{newRequest()})
+	responseManager.synchronize()
+	require.Len(t, responseManager.InProgressResponses(), 3)
+	testutil.AssertChannelEmpty(t, td.completedRequestChan, "should not reject requests from another peer")
+
+	// cancelling a request that never started frees up a slot
+	responseManager.ProcessRequests(td.ctx, td.p, []gsmsg.GraphSyncRequest{gsmsg.NewCancelRequest(requests[0].ID())})
+	td.assertCompleteRequestWith(graphsync.RequestCancelled)
+	lastRequest := newRequest()
+	responseManager.ProcessRequests(td.ctx, td.p, []gsmsg.GraphSyncRequest{lastRequest})
+	responseManager.synchronize()
+	testutil.AssertChannelEmpty(t, td.completedRequestChan, "should accept request once under the limit")
+	inProgress := responseManager.InProgressResponses()
+	require.Len(t, inProgress, 3)
+	require.Contains(t, []graphsync.RequestID{inProgress[0].RequestID, inProgress[1].RequestID, inProgress[2].RequestID}, lastRequest.ID())
+}
+
+func TestDuplicateRequests(t *testing.T) {
+	t.Run("rejects request using the id of a response in progress", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.nullTaskQueueResponseManager()
+		td.requestHooks.Register(selectorvalidator.SelectorValidator(100))
+		responseManager.Startup()
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		responseManager.synchronize()
+		inProgress := responseManager.InProgressResponses()
+		require.Len(t, inProgress, 1)
+		require.Equal(t, graphsync.Queued, inProgress[0].State)
+
+		// from the same peer
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		var rejected graphsync.RequestID
+		testutil.AssertReceive(td.ctx, t, td.rejectedDuplicates, &rejected, "should reject duplicate request")
+		require.Equal(t, td.requestID, rejected)
+
+		// from another peer
+		otherPeer := testutil.GeneratePeers(1)[0]
+		responseManager.ProcessRequests(td.ctx, otherPeer, td.requests)
+		testutil.AssertReceive(td.ctx, t, td.rejectedDuplicates, &rejected, "should reject duplicate request")
+		require.Equal(t, td.requestID, rejected)
+
+		// the original response is untouched
+		inProgress = responseManager.InProgressResponses()
+		require.Len(t, inProgress, 1)
+		require.Equal(t, td.p, inProgress[0].Peer)
+		require.Equal(t, graphsync.Queued, inProgress[0].State)
+		testutil.AssertChannelEmpty(t, td.discardedRequests, "should not discard original response")
+		td.assertNoResponses()
+	})
+
+	t.Run("replaces response that has sent its final status", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		td.requestHooks.Register(selectorvalidator.SelectorValidator(100))
+		responseManager.Startup()
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		// the final status is never reported sent, so the response is not cleaned up
+		td.assertOnlyCompleteProcessingWith(graphsync.RequestCompletedFull)
+		td.taskqueue.WaitForNoActiveTasks()
+		responseManager.synchronize()
+		inProgress := responseManager.InProgressResponses()
+		require.Len(t, inProgress, 1)
+		require.Equal(t, graphsync.CompletingSend, inProgress[0].State)
+
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		var discarded clearedRequest
+		testutil.AssertReceive(td.ctx, t, td.discardedRequests, &discarded, "should discard the final status of the old response")
+		require.Equal(t, td.requestID, discarded.requestID)
+		testutil.AssertChannelEmpty(t, td.rejectedDuplicates, "should not reject request")
+		td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
+		responseManager.synchronize()
+		require.Empty(t, responseManager.InProgressResponses())
+	})
+}
+
 func TestStats(t *testing.T) {
 	td := newTestData(t)
 	defer td.cancel()
@@ -236,6 +625,7 @@ func TestStats(t *testing.T) {
 	// cancellation
 	responseManager := td.nullTaskQueueResponseManager()
 	td.requestHooks.Register(selectorvalidator.SelectorValidator(100))
+	require.NoError(t, td.peristenceOptions.Register("chainstore", td.persistence))
 	responseManager.Startup()
 
 	p1 := td.p
@@ -247,6 +637,11 @@ func TestStats(t *testing.T) {
 	req2 := []gsmsg.GraphSyncRequest{
 		gsmsg.NewRequest(reqid2, td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(0), td.extension),
 	}
+	td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+		if p == p2 {
+			hookActions.UsePersistenceOption("chainstore")
+		}
+	})
 
 	responseManager.ProcessRequests(td.ctx, p1, req1)
 	responseManager.ProcessRequests(td.ctx, p2, req2)
@@ -268,6 +663,25 @@ func TestStats(t *testing.T) {
 	// no inconsistencies
 	require.Len(t, peerState.Diagnostics(), 0)
 
+	inProgress := responseManager.InProgressResponses()
+	require.Len(t, inProgress, 2)
+	for i, expected := range []struct {
+		p                 peer.ID
+		request           gsmsg.GraphSyncRequest
+		persistenceOption string
+	}{{p1, req1[0], ""}, {p2, req2[0], "chainstore"}} {
+		require.False(t, inProgress[i].StartTime.IsZero())
+		require.Equal(t, graphsync.InProgressResponseInfo{
+			RequestID:         expected.request.ID(),
+			Peer:              expected.p,
+			Root:              expected.request.Root(),
+			Selector:          expected.request.SelectorString(),
+			State:             graphsync.Queued,
+			StartTime:         inProgress[i].StartTime,
+			PersistenceOption: expected.persistenceOption,
+			Extensions:        []graphsync.ExtensionData{td.extension},
+		}, inProgress[i])
+	}
 }
 func TestMissingContent(t *testing.T) {
 	t.Run("missing root block", func(t *testing.T) {
@@ -361,142 +775,452 @@ func TestValidationAndExtensions(t *testing.T) {
 		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
 		td.assertCompleteRequestWith(graphsync.RequestFailedUnknown)
 		td.assertReceiveExtensionResponse()
+		var failureReason sentExtension
+		testutil.AssertReceive(td.ctx, td.t, td.sentExtensions, &failureReason, "should send failure reason")
+		require.Equal(t, graphsync.ExtensionFailureReason, failureReason.extension.Name)
+		reason, err := failureReason.extension.Data.AsString()
+		require.NoError(t, err)
+		require.Equal(t, "everything went to crap", reason)
+	})
+
+	t.Run("hooks can override the response priority", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		responseManager.Startup()
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+			hookActions.OverridePriority(graphsync.Priority(-5))
+		})
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
+		td.transactionLk.Lock()
+		defer td.transactionLk.Unlock()
+		require.Equal(t, graphsync.Priority(-5), td.responseAssembler.priorities[td.requests[0].ID()])
+	})
+
+	t.Run("rejected requests do not run hooks", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		responseManager.Startup()
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			t.Fatal("request hook should not run for a rejected request")
+		})
+		responseManager.RejectRequests(td.ctx, td.p, td.requests)
+		td.assertCompleteRequestWith(graphsync.RequestRejected)
+	})
+
+	t.Run("hooks can be unregistered", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		responseManager.Startup()
+		unregister := td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+			hookActions.SendExtensionData(td.extensionResponse)
+		})
+
+		// hook validates request
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
+		td.assertReceiveExtensionResponse()
+
+		// unregister
+		unregister()
+
+		// now same request should fail
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.assertCompleteRequestWith(graphsync.RequestRejected)
+	})
+
+	t.Run("hooks can alter the loader", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.alternateLoaderResponseManager()
+		responseManager.Startup()
+		// add validating hook -- so the request SHOULD succeed
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+		})
+
+		// request fails with base loader reading from block store that's missing data
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.assertCompleteRequestWith(graphsync.RequestFailedContentNotFound)
+
+		err := td.peristenceOptions.Register("chainstore", td.persistence)
+		require.NoError(t, err)
+		// register hook to use different loader
+		_ = td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			if _, found := requestData.Extension(td.extensionName); found {
+				hookActions.UsePersistenceOption("chainstore")
+				hookActions.SendExtensionData(td.extensionResponse)
+			}
+		})
+		// hook uses different loader that should make request succeed
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
+		td.assertReceiveExtensionResponse()
+	})
+
+	t.Run("hooks choose the loader from request extensions", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.alternateLoaderResponseManager()
+		responseManager.Startup()
+
+		// two stores hold the same blocks, each counting its reads
+		loads := map[string]*int32{"deal-1": new(int32), "deal-2": new(int32)}
+		for name, count := range loads {
+			count := count
+			lsys := td.persistence
+			readOpener := lsys.StorageReadOpener
+			lsys.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+				atomic.AddInt32(count, 1)
+				return readOpener(lctx, lnk)
+			}
+			require.NoError(t, td.peristenceOptions.Register(name, lsys))
+		}
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+			if data, found := requestData.Extension(td.extensionName); found {
+				name, err := data.AsString()
+				require.NoError(t, err)
+				hookActions.UsePersistenceOption(name)
+			}
+		})
+		requestForDeal := func(name string) []gsmsg.GraphSyncRequest {
+			extension := graphsync.ExtensionData{Name: td.extensionName, Data: basicnode.NewString(name)}
+			return []gsmsg.GraphSyncRequest{
+				gsmsg.NewRequest(graphsync.NewRequestID(), td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(0), extension),
+			}
+		}
+
+		responseManager.ProcessRequests(td.ctx, td.p, requestForDeal("deal-1"))
+		td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
+		require.Equal(t, int32(td.blockChainLength), atomic.LoadInt32(loads["deal-1"]))
+		require.Zero(t, atomic.LoadInt32(loads["deal-2"]))
+
+		responseManager.ProcessRequests(td.ctx, td.p, requestForDeal("deal-2"))
+		td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
+		require.Equal(t, int32(td.blockChainLength), atomic.LoadInt32(loads["deal-1"]))
+		require.Equal(t, int32(td.blockChainLength), atomic.LoadInt32(loads["deal-2"]))
+
+		// unregistered names fail the request
+		responseManager.ProcessRequests(td.ctx, td.p, requestForDeal("deal-3"))
+		td.assertCompleteRequestWith(graphsync.RequestFailedUnknown)
+	})
+
+	t.Run("hooks can alter the node builder chooser", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		responseManager.Startup()
+
+		customChooserCallCount := 0
+		customChooser := func(ipld.Link, ipld.LinkContext) (ipld.NodePrototype, error) {
+			customChooserCallCount++
+			return basicnode.Prototype.Any, nil
+		}
+
+		// add validating hook -- so the request SHOULD succeed
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+		})
+
+		// with default chooser, customer chooser not called
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
+		require.Equal(t, 0, customChooserCallCount)
+
+		// register hook to use custom chooser
+		_ = td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			if _, found := requestData.Extension(td.extensionName); found {
+				hookActions.UseLinkTargetNodePrototypeChooser(customChooser)
+				hookActions.SendExtensionData(td.extensionResponse)
+			}
+		})
+
+		// verify now that request succeeds and uses custom chooser
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
+		td.assertReceiveExtensionResponse()
+		require.Equal(t, 5, customChooserCallCount)
+	})
+
+	t.Run("default node builder chooser is used unless a hook sets one", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+
+		defaultChooserCallCount := 0
+		responseManager.SetDefaultChooser(func(ipld.Link, ipld.LinkContext) (ipld.NodePrototype, error) {
+			defaultChooserCallCount++
+			return basicnode.Prototype.Any, nil
+		})
+		responseManager.Startup()
+
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+		})
+
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
+		require.Equal(t, 5, defaultChooserCallCount)
+
+		// a chooser set by a hook takes precedence over the default
+		customChooserCallCount := 0
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.UseLinkTargetNodePrototypeChooser(func(ipld.Link, ipld.LinkContext) (ipld.NodePrototype, error) {
+				customChooserCallCount++
+				return basicnode.Prototype.Any, nil
+			})
+		})
+
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
+		require.Equal(t, 5, customChooserCallCount)
+		require.Equal(t, 5, defaultChooserCallCount)
+	})
+
+	t.Run("hooks can substitute the selector", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		responseManager.Startup()
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+			// only the root block is traversed
+			hookActions.ValidateSelector(selectorparse.CommonSelector_MatchPoint)
+		})
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.assertOnlyCompleteProcessingWith(graphsync.RequestCompletedFull)
+		td.verifyNResponsesOnlyProcessing(1)
+	})
+
+	t.Run("do-not-send-cids extension", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		responseManager.Startup()
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+		})
+		set := cid.NewSet()
+		blks := td.blockChain.Blocks(0, 5)
+		for _, blk := range blks {
+			set.Add(blk.Cid())
+		}
+		data := cidset.EncodeCidSet(set)
+		requests := []gsmsg.GraphSyncRequest{
+			gsmsg.NewRequest(td.requestID, td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(0),
+				graphsync.ExtensionData{
+					Name: graphsync.ExtensionDoNotSendCIDs,
+					Data: data,
+				}),
+		}
+		responseManager.ProcessRequests(td.ctx, td.p, requests)
+		td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
+		td.assertIgnoredCids(set)
+	})
+
+	t.Run("resume extension", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		responseManager.Startup()
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+		})
+		set := cid.NewSet()
+		blks := td.blockChain.Blocks(0, 5)
+		for _, blk := range blks {
+			set.Add(blk.Cid())
+		}
+		data := cidset.EncodeCidSet(set)
+		requests := []gsmsg.GraphSyncRequest{
+			gsmsg.NewRequest(td.requestID, td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(0),
+				graphsync.ExtensionData{
+					Name: graphsync.ExtensionResume,
+					Data: data,
+				}),
+		}
+		responseManager.ProcessRequests(td.ctx, td.p, requests)
+		td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
+		td.assertIgnoredCids(set)
+	})
+
+	t.Run("do-not-send-first-blocks extension", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		responseManager.Startup()
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+		})
+		data := donotsendfirstblocks.EncodeDoNotSendFirstBlocks(4)
+		requests := []gsmsg.GraphSyncRequest{
+			gsmsg.NewRequest(td.requestID, td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(0),
+				graphsync.ExtensionData{
+					Name: graphsync.ExtensionsDoNotSendFirstBlocks,
+					Data: data,
+				}),
+		}
+		responseManager.ProcessRequests(td.ctx, td.p, requests)
+		td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
+		td.assertSkippedFirstBlocks(4)
 	})
 
-	t.Run("hooks can be unregistered", func(t *testing.T) {
+	t.Run("metadata-only extension", func(t *testing.T) {
 		td := newTestData(t)
 		defer td.cancel()
 		responseManager := td.newResponseManager()
 		responseManager.Startup()
-		unregister := td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
 			hookActions.ValidateRequest()
-			hookActions.SendExtensionData(td.extensionResponse)
 		})
-
-		// hook validates request
-		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		requests := []gsmsg.GraphSyncRequest{
+			gsmsg.NewRequest(td.requestID, td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(0),
+				graphsync.ExtensionData{
+					Name: graphsync.ExtensionMetadataOnly,
+					Data: basicnode.NewBool(true),
+				}),
+		}
+		responseManager.ProcessRequests(td.ctx, td.p, requests)
 		td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
-		td.assertReceiveExtensionResponse()
-
-		// unregister
-		unregister()
-
-		// now same request should fail
-		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
-		td.assertCompleteRequestWith(graphsync.RequestRejected)
+		var requestID graphsync.RequestID
+		testutil.AssertReceive(td.ctx, td.t, td.metadataOnly, &requestID, "should send metadata only")
+		require.Equal(t, td.requestID, requestID)
 	})
 
-	t.Run("hooks can alter the loader", func(t *testing.T) {
+	t.Run("supported-extensions extension", func(t *testing.T) {
 		td := newTestData(t)
 		defer td.cancel()
-		responseManager := td.alternateLoaderResponseManager()
+		responseManager := td.newResponseManager()
+		responseManager.SetSupportedExtensions([]graphsync.ExtensionName{graphsync.ExtensionDoNotSendCIDs, graphsync.ExtensionMetadataOnly})
 		responseManager.Startup()
-		// add validating hook -- so the request SHOULD succeed
 		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
 			hookActions.ValidateRequest()
 		})
-
-		// request fails with base loader reading from block store that's missing data
-		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
-		td.assertCompleteRequestWith(graphsync.RequestFailedContentNotFound)
-
-		err := td.peristenceOptions.Register("chainstore", td.persistence)
-		require.NoError(t, err)
-		// register hook to use different loader
-		_ = td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
-			if _, found := requestData.Extension(td.extensionName); found {
-				hookActions.UsePersistenceOption("chainstore")
-				hookActions.SendExtensionData(td.extensionResponse)
-			}
-		})
-		// hook uses different loader that should make request succeed
-		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		requests := []gsmsg.GraphSyncRequest{
+			gsmsg.NewRequest(td.requestID, td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(0),
+				graphsync.ExtensionData{
+					Name: graphsync.ExtensionSupportedExtensions,
+					Data: supportedextensions.EncodeSupportedExtensions([]graphsync.ExtensionName{graphsync.ExtensionDoNotSendCIDs, graphsync.ExtensionDeDupByKey}),
+				}),
+		}
+		responseManager.ProcessRequests(td.ctx, td.p, requests)
 		td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
-		td.assertReceiveExtensionResponse()
+		var receivedExtension sentExtension
+		testutil.AssertReceive(td.ctx, td.t, td.sentExtensions, &receivedExtension, "should send supported extensions")
+		require.Equal(t, graphsync.ExtensionSupportedExtensions, receivedExtension.extension.Name)
+		names, err := supportedextensions.DecodeSupportedExtensions(receivedExtension.extension.Data)
+		require.NoError(t, err)
+		require.Equal(t, []graphsync.ExtensionName{graphsync.ExtensionDoNotSendCIDs}, names)
 	})
 
-	t.Run("hooks can alter the node builder chooser", func(t *testing.T) {
+	t.Run("peer extensions seen by hooks", func(t *testing.T) {
 		td := newTestData(t)
 		defer td.cancel()
 		responseManager := td.newResponseManager()
 		responseManager.Startup()
-
-		customChooserCallCount := 0
-		customChooser := func(ipld.Link, ipld.LinkContext) (ipld.NodePrototype, error) {
-			customChooserCallCount++
-			return basicnode.Prototype.Any, nil
+		type peerExtensions struct {
+			names    []graphsync.ExtensionName
+			reported bool
 		}
-
-		// add validating hook -- so the request SHOULD succeed
+		seen := make(chan peerExtensions, 1)
 		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			names, reported := hookActions.PeerExtensions()
+			seen <- peerExtensions{names, reported}
 			hookActions.ValidateRequest()
 		})
+		advertised := []graphsync.ExtensionName{graphsync.ExtensionDoNotSendCIDs, graphsync.ExtensionDeDupByKey}
+		newRequest := func(extensions ...graphsync.ExtensionData) []gsmsg.GraphSyncRequest {
+			return []gsmsg.GraphSyncRequest{
+				gsmsg.NewRequest(graphsync.NewRequestID(), td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(0), extensions...),
+			}
+		}
+		assertSeen := func(expected peerExtensions) {
+			var received peerExtensions
+			testutil.AssertReceive(td.ctx, t, seen, &received, "should run hook")
+			require.Equal(t, expected, received)
+			td.verifyNResponses(td.blockChainLength)
+			td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
+		}
 
-		// with default chooser, customer chooser not called
-		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
-		td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
-		require.Equal(t, 0, customChooserCallCount)
+		responseManager.ProcessRequests(td.ctx, td.p, newRequest())
+		assertSeen(peerExtensions{})
 
-		// register hook to use custom chooser
-		_ = td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
-			if _, found := requestData.Extension(td.extensionName); found {
-				hookActions.UseLinkTargetNodePrototypeChooser(customChooser)
-				hookActions.SendExtensionData(td.extensionResponse)
-			}
-		})
+		responseManager.ProcessRequests(td.ctx, td.p, newRequest(graphsync.ExtensionData{
+			Name: graphsync.ExtensionSupportedExtensions,
+			Data: supportedextensions.EncodeSupportedExtensions(advertised),
+		}))
+		assertSeen(peerExtensions{advertised, true})
 
-		// verify now that request succeeds and uses custom chooser
-		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
-		td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
-		td.assertReceiveExtensionResponse()
-		require.Equal(t, 5, customChooserCallCount)
+		// later requests from the peer do not list its extensions again
+		responseManager.ProcessRequests(td.ctx, td.p, newRequest())
+		assertSeen(peerExtensions{advertised, true})
+
+		// other peers have not reported theirs
+		otherPeer := testutil.GeneratePeers(1)[0]
+		responseManager.ProcessRequests(td.ctx, otherPeer, newRequest())
+		assertSeen(peerExtensions{})
+
+		// the peer lists them again once it reconnects
+		responseManager.Disconnected(td.p)
+		responseManager.ProcessRequests(td.ctx, td.p, newRequest())
+		assertSeen(peerExtensions{})
 	})
 
-	t.Run("do-not-send-cids extension", func(t *testing.T) {
+	t.Run("block-compression extension", func(t *testing.T) {
 		td := newTestData(t)
 		defer td.cancel()
 		responseManager := td.newResponseManager()
+		responseManager.SetBlockCompression(compression.Gzip())
 		responseManager.Startup()
 		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
 			hookActions.ValidateRequest()
 		})
-		set := cid.NewSet()
-		blks := td.blockChain.Blocks(0, 5)
-		for _, blk := range blks {
-			set.Add(blk.Cid())
-		}
-		data := cidset.EncodeCidSet(set)
 		requests := []gsmsg.GraphSyncRequest{
 			gsmsg.NewRequest(td.requestID, td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(0),
 				graphsync.ExtensionData{
-					Name: graphsync.ExtensionDoNotSendCIDs,
-					Data: data,
+					Name: graphsync.ExtensionBlockCompression,
+					Data: compression.EncodeCodecNames([]string{"zstd", "gzip"}),
 				}),
 		}
 		responseManager.ProcessRequests(td.ctx, td.p, requests)
 		td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
-		td.assertIgnoredCids(set)
+		var codec string
+		testutil.AssertReceive(td.ctx, td.t, td.blockCompressions, &codec, "should compress blocks")
+		require.Equal(t, "gzip", codec)
+		var receivedExtension sentExtension
+		testutil.AssertReceive(td.ctx, td.t, td.sentExtensions, &receivedExtension, "should send block compression codec")
+		require.Equal(t, graphsync.ExtensionBlockCompression, receivedExtension.extension.Name)
+		name, err := compression.DecodeCodecName(receivedExtension.extension.Data)
+		require.NoError(t, err)
+		require.Equal(t, "gzip", name)
 	})
 
-	t.Run("do-not-send-first-blocks extension", func(t *testing.T) {
+	t.Run("block-compression extension, codec not supported by requestor", func(t *testing.T) {
 		td := newTestData(t)
 		defer td.cancel()
 		responseManager := td.newResponseManager()
+		responseManager.SetBlockCompression(compression.Gzip())
 		responseManager.Startup()
 		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
 			hookActions.ValidateRequest()
 		})
-		data := donotsendfirstblocks.EncodeDoNotSendFirstBlocks(4)
 		requests := []gsmsg.GraphSyncRequest{
 			gsmsg.NewRequest(td.requestID, td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(0),
 				graphsync.ExtensionData{
-					Name: graphsync.ExtensionsDoNotSendFirstBlocks,
-					Data: data,
+					Name: graphsync.ExtensionBlockCompression,
+					Data: compression.EncodeCodecNames([]string{"zstd"}),
 				}),
 		}
 		responseManager.ProcessRequests(td.ctx, td.p, requests)
 		td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
-		td.assertSkippedFirstBlocks(4)
+		testutil.AssertChannelEmpty(td.t, td.blockCompressions, "should not compress blocks")
+		testutil.AssertChannelEmpty(td.t, td.sentExtensions, "should not send block compression codec")
 	})
 
 	t.Run("dedup-by-key extension", func(t *testing.T) {
@@ -649,6 +1373,41 @@ func TestValidationAndExtensions(t *testing.T) {
 		})
 	})
 
+	t.Run("test completing hook processing", func(t *testing.T) {
+		t.Run("can send extension data with the final status", func(t *testing.T) {
+			td := newTestData(t)
+			defer td.cancel()
+			responseManager := td.newResponseManager()
+			responseManager.Startup()
+			td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+				hookActions.ValidateRequest()
+			})
+			td.completingHooks.Register(func(p peer.ID, requestData graphsync.RequestData, status graphsync.ResponseStatusCode, hookActions graphsync.CompletingResponseHookActions) {
+				if status == graphsync.RequestCompletedFull {
+					hookActions.SendExtensionData(td.extensionResponse)
+				}
+			})
+			responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+			td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
+			td.assertReceiveExtensionResponse()
+		})
+
+		t.Run("runs for rejected requests", func(t *testing.T) {
+			td := newTestData(t)
+			defer td.cancel()
+			responseManager := td.newResponseManager()
+			responseManager.Startup()
+			td.completingHooks.Register(func(p peer.ID, requestData graphsync.RequestData, status graphsync.ResponseStatusCode, hookActions graphsync.CompletingResponseHookActions) {
+				if status == graphsync.RequestRejected {
+					hookActions.SendExtensionData(td.extensionResponse)
+				}
+			})
+			responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+			td.assertCompleteRequestWith(graphsync.RequestRejected)
+			td.assertReceiveExtensionResponse()
+		})
+	})
+
 	t.Run("test update hook processing", func(t *testing.T) {
 		t.Run("can pause/unpause", func(t *testing.T) {
 			td := newTestData(t)
@@ -821,6 +1580,131 @@ func TestValidationAndExtensions(t *testing.T) {
 	})
 }
 
+func TestAsyncValidation(t *testing.T) {
+	validateSync := func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+		hookActions.ValidateRequest()
+	}
+
+	t.Run("holds the response until validators accept it", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		validators := hooks.NewAsyncRequestValidators()
+		responseManager.SetAsyncValidators(validators, 0)
+		responseManager.Startup()
+		td.requestHooks.Register(validateSync)
+		release := make(chan struct{})
+		validators.Register(func(ctx context.Context, p peer.ID, request graphsync.RequestData) (bool, []graphsync.ExtensionData, error) {
+			<-release
+			return true, []graphsync.ExtensionData{td.extensionResponse}, nil
+		})
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		responseManager.synchronize()
+		require.Len(t, responseManager.InProgressResponses(), 1)
+		td.assertNoResponses()
+		close(release)
+		td.assertReceiveExtensionResponse()
+		td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
+	})
+
+	t.Run("rejects requests validators do not accept", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		validators := hooks.NewAsyncRequestValidators()
+		responseManager.SetAsyncValidators(validators, 0)
+		responseManager.Startup()
+		td.requestHooks.Register(validateSync)
+		var calls int32
+		validators.Register(func(ctx context.Context, p peer.ID, request graphsync.RequestData) (bool, []graphsync.ExtensionData, error) {
+			atomic.AddInt32(&calls, 1)
+			return false, nil, nil
+		})
+		validators.Register(func(ctx context.Context, p peer.ID, request graphsync.RequestData) (bool, []graphsync.ExtensionData, error) {
+			atomic.AddInt32(&calls, 1)
+			return true, nil, nil
+		})
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.assertCompleteRequestWith(graphsync.RequestRejected)
+		require.Empty(t, td.sentResponses)
+		require.Equal(t, int32(1), atomic.LoadInt32(&calls), "should stop at first rejection")
+	})
+
+	t.Run("rejects requests with the validator error as the reason", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		validators := hooks.NewAsyncRequestValidators()
+		responseManager.SetAsyncValidators(validators, 0)
+		responseManager.Startup()
+		td.requestHooks.Register(validateSync)
+		validators.Register(func(ctx context.Context, p peer.ID, request graphsync.RequestData) (bool, []graphsync.ExtensionData, error) {
+			return true, nil, errors.New("policy service unavailable")
+		})
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.assertCompleteRequestWith(graphsync.RequestRejected)
+		var failureReason sentExtension
+		testutil.AssertReceive(td.ctx, td.t, td.sentExtensions, &failureReason, "should send failure reason")
+		require.Equal(t, graphsync.ExtensionFailureReason, failureReason.extension.Name)
+		reason, err := failureReason.extension.Data.AsString()
+		require.NoError(t, err)
+		require.Equal(t, "policy service unavailable", reason)
+	})
+
+	t.Run("rejects requests validators do not decide in time", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		validators := hooks.NewAsyncRequestValidators()
+		responseManager.SetAsyncValidators(validators, 10*time.Millisecond)
+		responseManager.Startup()
+		td.requestHooks.Register(validateSync)
+		validators.Register(func(ctx context.Context, p peer.ID, request graphsync.RequestData) (bool, []graphsync.ExtensionData, error) {
+			<-ctx.Done()
+			return true, nil, nil
+		})
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.assertCompleteRequestWith(graphsync.RequestRejected)
+		require.Empty(t, td.sentResponses)
+	})
+
+	t.Run("does not run validators for requests hooks reject", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		validators := hooks.NewAsyncRequestValidators()
+		responseManager.SetAsyncValidators(validators, 0)
+		responseManager.Startup()
+		var calls int32
+		validators.Register(func(ctx context.Context, p peer.ID, request graphsync.RequestData) (bool, []graphsync.ExtensionData, error) {
+			atomic.AddInt32(&calls, 1)
+			return true, nil, nil
+		})
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.assertCompleteRequestWith(graphsync.RequestRejected)
+		require.Equal(t, int32(0), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("cancelling a response stops validation", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		validators := hooks.NewAsyncRequestValidators()
+		responseManager.SetAsyncValidators(validators, 0)
+		responseManager.Startup()
+		td.requestHooks.Register(validateSync)
+		validators.Register(func(ctx context.Context, p peer.ID, request graphsync.RequestData) (bool, []graphsync.ExtensionData, error) {
+			<-ctx.Done()
+			return true, nil, nil
+		})
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		responseManager.synchronize()
+		responseManager.ProcessRequests(td.ctx, td.p, []gsmsg.GraphSyncRequest{gsmsg.NewCancelRequest(td.requestID)})
+		td.assertCompleteRequestWith(graphsync.RequestCancelled)
+		require.Empty(t, td.sentResponses)
+	})
+}
+
 func TestNetworkErrors(t *testing.T) {
 	t.Run("network error final status - success", func(t *testing.T) {
 		td := newTestData(t)
@@ -864,10 +1748,35 @@ func TestNetworkErrors(t *testing.T) {
 		td.assertSendBlock()
 		err := errors.New("something went wrong")
 		td.notifyBlockSendsNetworkError(err)
-		td.assertHasNetworkErrors(err)
+		var receivedErr error
+		testutil.AssertReceive(td.ctx, t, td.networkErrorChan, &receivedErr, "should receive network error")
+		require.ErrorIs(t, receivedErr, err)
+		// blocks that did not send are reported with the error, not as sent
+		var notSent graphsync.BlocksNotSentErr
+		require.ErrorAs(t, receivedErr, &notSent)
+		require.NotEmpty(t, notSent.Blocks)
+		testutil.AssertChannelEmpty(t, td.blockSends, "should not report blocks as sent")
 		td.assertNoCompletedResponseStatuses()
 	})
 
+	t.Run("network error after traversal completes", func(t *testing.T) {
+		td := newTestData(t)
+		defer td.cancel()
+		responseManager := td.newResponseManager()
+		responseManager.Startup()
+		td.requestHooks.Register(func(p peer.ID, requestData graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+			hookActions.ValidateRequest()
+		})
+		responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+		td.verifyNResponses(td.blockChainLength)
+		td.assertOnlyCompleteProcessingWith(graphsync.RequestCompletedFull)
+		// a message with blocks fails after the final status is queued
+		err := errors.New("something went wrong")
+		td.notifyBlockSendsNetworkError(err)
+		td.assertHasNetworkErrors(err)
+		require.Empty(t, responseManager.InProgressResponses())
+	})
+
 	t.Run("network error while paused", func(t *testing.T) {
 		td := newTestData(t)
 		defer td.cancel()
@@ -897,6 +1806,57 @@ func TestNetworkErrors(t *testing.T) {
 	})
 }
 
+func TestDisconnected(t *testing.T) {
+	td := newTestData(t)
+	defer td.cancel()
+	// holds the second load of the first response until released, so its
+	// task is still running when a new request reuses its ID
+	loadCtxs := make(chan context.Context, 1)
+	release := make(chan struct{})
+	var loads int32
+	lsys := td.persistence
+	readOpener := lsys.StorageReadOpener
+	lsys.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		if atomic.AddInt32(&loads, 1) == 2 {
+			loadCtxs <- lctx.Ctx
+			<-release
+			return nil, lctx.Ctx.Err()
+		}
+		return readOpener(lctx, lnk)
+	}
+	responseManager := New(td.ctx, lsys, td.responseAssembler, td.requestProcessingListeners, td.requestQueuedHooks, td.requestHooks, td.updateHooks, td.completingHooks, td.completedListeners, td.cancelledListeners, td.blockSentListeners, td.networkErrorListeners, td.connManager, 0, 0, nil, td.taskqueue, nil)
+	td.taskqueue.Startup(6, td.newQueryExecutor(responseManager))
+	td.requestHooks.Register(selectorvalidator.SelectorValidator(100))
+	responseManager.Startup()
+	responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+
+	var loadCtx context.Context
+	testutil.AssertReceive(td.ctx, t, loadCtxs, &loadCtx, "should load second block")
+	td.verifyNResponses(1)
+
+	// the response ends at once, without waiting for its task
+	responseManager.Disconnected(td.p)
+	td.assertHasNetworkErrors(graphsync.ErrPeerDisconnected{Peer: td.p})
+	td.assertRequestCleared()
+	testutil.AssertDoesReceive(td.ctx, t, loadCtx.Done(), "should cancel the load context")
+	responseManager.synchronize()
+	require.Empty(t, responseManager.InProgressResponses())
+
+	// after reconnecting, the peer reuses the request ID
+	responseManager.ProcessRequests(td.ctx, td.p, td.requests)
+	responseManager.synchronize()
+	testutil.AssertChannelEmpty(t, td.rejectedDuplicates, "should not reject request")
+	inProgress := responseManager.InProgressResponses()
+	require.Len(t, inProgress, 1)
+	require.Equal(t, graphsync.Queued, inProgress[0].State)
+
+	// the old task finishing leaves the new response to run in full
+	close(release)
+	td.assertRequestCleared()
+	td.verifyNResponses(td.blockChainLength)
+	td.assertCompleteRequestWith(graphsync.RequestCompletedFull)
+}
+
 func TestUpdateResponse(t *testing.T) {
 	t.Run("while unpaused", func(t *testing.T) {
 		td := newTestData(t)
@@ -968,30 +1928,52 @@ type fakeResponseAssembler struct {
 	lastCompletedRequest chan completedRequest
 	pausedRequests       chan pausedRequest
 	clearedRequests      chan clearedRequest
+	discardedRequests    chan clearedRequest
 	ignoredLinks         chan []ipld.Link
 	skippedFirstBlocks   chan int64
+	metadataOnly         chan graphsync.RequestID
 
 	completedNotifications map[graphsync.RequestID]graphsync.ResponseStatusCode
 	blkNotifications       map[graphsync.RequestID][]graphsync.BlockData
 	notifeePublisher       *testutil.MockPublisher
+	subscribers            map[graphsync.RequestID]notifications.Subscriber
 	dedupKeys              chan string
+	blockCompressions      chan string
+	rejectedDuplicates     chan graphsync.RequestID
+	priorities             map[graphsync.RequestID]graphsync.Priority
 	missingBlock           bool
 }
 
 func (fra *fakeResponseAssembler) NewStream(ctx context.Context, p peer.ID, requestID graphsync.RequestID, subscriber notifications.Subscriber) responseassembler.ResponseStream {
+	// nothing more is sent for a stream replaced by one with the same request
+	// ID, so its subscriber hears no more messages
+	fra.transactionLk.Lock()
+	if fra.subscribers == nil {
+		fra.subscribers = make(map[graphsync.RequestID]notifications.Subscriber)
+	}
+	if previous, ok := fra.subscribers[requestID]; ok {
+		fra.notifeePublisher.RemoveSubscriber(previous)
+	}
+	fra.subscribers[requestID] = subscriber
+	fra.transactionLk.Unlock()
 	fra.notifeePublisher.AddSubscriber(subscriber)
-	return &fakeResponseStream{fra, requestID}
+	return &fakeResponseStream{fra: fra, requestID: requestID}
+}
+
+func (fra *fakeResponseAssembler) RejectDuplicate(p peer.ID, requestID graphsync.RequestID) {
+	fra.rejectedDuplicates <- requestID
 }
 
 type fakeResponseStream struct {
-	fra       *fakeResponseAssembler
-	requestID graphsync.RequestID
+	fra            *fakeResponseAssembler
+	requestID      graphsync.RequestID
+	completingHook responseassembler.CompletingHook
 }
 
 func (frs *fakeResponseStream) Transaction(transaction responseassembler.Transaction) error {
 	frs.fra.transactionLk.Lock()
 	defer frs.fra.transactionLk.Unlock()
-	frb := &fakeResponseBuilder{frs.requestID, frs.fra}
+	frb := &fakeResponseBuilder{frs.requestID, frs.fra, frs.completingHook}
 	return transaction(frb)
 }
 
@@ -1002,14 +1984,39 @@ func (frs *fakeResponseStream) IgnoreBlocks(links []ipld.Link) {
 func (frs *fakeResponseStream) SkipFirstBlocks(skipCount int64) {
 	frs.fra.skippedFirstBlocks <- skipCount
 }
+func (frs *fakeResponseStream) MetadataOnly() {
+	frs.fra.metadataOnly <- frs.requestID
+}
 func (frs *fakeResponseStream) DedupKey(key string) {
 	frs.fra.dedupKeys <- key
 }
 
+func (frs *fakeResponseStream) SetBlockCompression(codec graphsync.CompressionCodec) {
+	frs.fra.blockCompressions <- codec.Name()
+}
+
+func (frs *fakeResponseStream) SetPriority(priority graphsync.Priority) {
+	frs.fra.transactionLk.Lock()
+	defer frs.fra.transactionLk.Unlock()
+	frs.fra.priorities[frs.requestID] = priority
+}
+
+func (frs *fakeResponseStream) SetCompletingHook(hook responseassembler.CompletingHook) {
+	frs.completingHook = hook
+}
+
 func (frs *fakeResponseStream) ClearRequest() {
 	frs.fra.clearRequest(frs.requestID)
 }
 
+func (frs *fakeResponseStream) DiscardQueued() {
+	frs.fra.discardedRequests <- clearedRequest{frs.requestID}
+}
+
+func (frs *fakeResponseStream) Close() error {
+	return nil
+}
+
 type sentResponse struct {
 	requestID graphsync.RequestID
 	link      ipld.Link
@@ -1104,8 +2111,9 @@ func (fra *fakeResponseAssembler) clearRequest(requestID graphsync.RequestID) {
 }
 
 type fakeResponseBuilder struct {
-	requestID graphsync.RequestID
-	fra       *fakeResponseAssembler
+	requestID      graphsync.RequestID
+	fra            *fakeResponseAssembler
+	completingHook responseassembler.CompletingHook
 }
 
 func (frb *fakeResponseBuilder) SendResponse(link ipld.Link, data []byte) graphsync.BlockData {
@@ -1123,13 +2131,28 @@ func (frb *fakeResponseBuilder) SendUpdates(extensions []graphsync.ExtensionData
 }
 
 func (frb *fakeResponseBuilder) FinishRequest() graphsync.ResponseStatusCode {
+	code := graphsync.RequestCompletedFull
+	if frb.fra.missingBlock {
+		code = graphsync.RequestCompletedPartial
+	}
+	frb.runCompletingHook(code)
 	return frb.fra.finishRequest(frb.requestID)
 }
 
 func (frb *fakeResponseBuilder) FinishWithError(status graphsync.ResponseStatusCode) {
+	frb.runCompletingHook(status)
 	frb.fra.finishWithError(frb.requestID, status)
 }
 
+func (frb *fakeResponseBuilder) runCompletingHook(status graphsync.ResponseStatusCode) {
+	if frb.completingHook == nil {
+		return
+	}
+	for _, extension := range frb.completingHook(status) {
+		frb.fra.sendExtensionData(frb.requestID, extension)
+	}
+}
+
 func (frb *fakeResponseBuilder) PauseRequest() {
 	frb.fra.pauseRequest(frb.requestID)
 }
@@ -1139,27 +2162,33 @@ func (frb *fakeResponseBuilder) Context() context.Context {
 }
 
 type testData struct {
-	ctx                        context.Context
-	t                          *testing.T
-	cancel                     context.CancelFunc
-	blockStore                 map[ipld.Link][]byte
-	persistence                ipld.LinkSystem
-	blockChainLength           int
-	blockChain                 *testutil.TestBlockChain
-	completedRequestChan       chan completedRequest
-	sentResponses              chan sentResponse
-	sentExtensions             chan sentExtension
-	pausedRequests             chan pausedRequest
-	clearedRequests            chan clearedRequest
-	completedNotifications     map[graphsync.RequestID]graphsync.ResponseStatusCode
-	blkNotifications           map[graphsync.RequestID][]graphsync.BlockData
-	ignoredLinks               chan []ipld.Link
-	skippedFirstBlocks         chan int64
-	dedupKeys                  chan string
-	responseAssembler          *fakeResponseAssembler
-	extensionData              datamodel.Node
-	extensionName              graphsync.ExtensionName
-	extension                  graphsync.ExtensionData
+	ctx                    context.Context
+	t                      *testing.T
+	cancel                 context.CancelFunc
+	blockStore             map[ipld.Link][]byte
+	persistence            ipld.LinkSystem
+	blockChainLength       int
+	blockChain             *testutil.TestBlockChain
+	completedRequestChan   chan completedRequest
+	sentResponses          chan sentResponse
+	sentExtensions         chan sentExtension
+	pausedRequests         chan pausedRequest
+	clearedRequests        chan clearedRequest
+	discardedRequests      chan clearedRequest
+	completedNotifications map[graphsync.RequestID]graphsync.ResponseStatusCode
+	blkNotifications       map[graphsync.RequestID][]graphsync.BlockData
+	ignoredLinks           chan []ipld.Link
+	skippedFirstBlocks     chan int64
+	metadataOnly           chan graphsync.RequestID
+	dedupKeys              chan string
+	blockCompressions      chan string
+	rejectedDuplicates     chan graphsync.RequestID
+	responseAssembler      *fakeResponseAssembler
+	extensionData          datamodel.Node
+	extensionName          graphsync.ExtensionName
+	extension              graphsync.ExtensionData
+	// lists the extensions the requestor supports
+	supportedExtensions        graphsync.ExtensionData
 	extensionResponseData      datamodel.Node
 	extensionResponse          graphsync.ExtensionData
 	extensionUpdateData        datamodel.Node
@@ -1170,9 +2199,11 @@ type testData struct {
 	p                          peer.ID
 	peristenceOptions          *persistenceoptions.PersistenceOptions
 	requestProcessingListeners *listeners.RequestProcessingListeners
+	requestQueuedHooks         *listeners.RequestQueuedHooks
 	requestHooks               *hooks.IncomingRequestHooks
 	blockHooks                 *hooks.OutgoingBlockHooks
 	updateHooks                *hooks.RequestUpdatedHooks
+	completingHooks            *hooks.CompletingResponseHooks
 	completedListeners         *listeners.CompletedResponseListeners
 	cancelledListeners         *listeners.RequestorCancelledListeners
 	blockSentListeners         *listeners.BlockSentListeners
@@ -1206,9 +2237,13 @@ func newTestData(t *testing.T) testData {
 	td.sentExtensions = make(chan sentExtension, td.blockChainLength*2)
 	td.pausedRequests = make(chan pausedRequest, 1)
 	td.clearedRequests = make(chan clearedRequest, 1)
+	td.discardedRequests = make(chan clearedRequest, 1)
 	td.ignoredLinks = make(chan []ipld.Link, 1)
 	td.skippedFirstBlocks = make(chan int64, 1)
+	td.metadataOnly = make(chan graphsync.RequestID, 1)
 	td.dedupKeys = make(chan string, 1)
+	td.blockCompressions = make(chan string, 1)
+	td.rejectedDuplicates = make(chan graphsync.RequestID, 1)
 	td.blockSends = make(chan graphsync.BlockData, td.blockChainLength*2)
 	td.completedResponseStatuses = make(chan graphsync.ResponseStatusCode, 1)
 	td.networkErrorChan = make(chan error, td.blockChainLength*2)
@@ -1223,9 +2258,14 @@ func newTestData(t *testing.T) testData {
 		sentExtensions:         td.sentExtensions,
 		pausedRequests:         td.pausedRequests,
 		clearedRequests:        td.clearedRequests,
+		discardedRequests:      td.discardedRequests,
 		ignoredLinks:           td.ignoredLinks,
 		skippedFirstBlocks:     td.skippedFirstBlocks,
+		metadataOnly:           td.metadataOnly,
 		dedupKeys:              td.dedupKeys,
+		blockCompressions:      td.blockCompressions,
+		rejectedDuplicates:     td.rejectedDuplicates,
+		priorities:             make(map[graphsync.RequestID]graphsync.Priority),
 		notifeePublisher:       td.notifeePublisher,
 		blkNotifications:       td.blkNotifications,
 		completedNotifications: td.completedNotifications,
@@ -1248,8 +2288,13 @@ func newTestData(t *testing.T) testData {
 		Data: td.extensionUpdateData,
 	}
 	td.requestID = graphsync.NewRequestID()
+	// the requestor expects a reply to its cancels
+	td.supportedExtensions = graphsync.ExtensionData{
+		Name: graphsync.ExtensionSupportedExtensions,
+		Data: supportedextensions.EncodeSupportedExtensions([]graphsync.ExtensionName{graphsync.ExtensionCancelAck}),
+	}
 	td.requests = []gsmsg.GraphSyncRequest{
-		gsmsg.NewRequest(td.requestID, td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(0), td.extension),
+		gsmsg.NewRequest(td.requestID, td.blockChain.TipLink.(cidlink.Link).Cid, td.blockChain.Selector(), graphsync.Priority(0), td.extension, td.supportedExtensions),
 	}
 	td.updateRequests = []gsmsg.GraphSyncRequest{
 		gsmsg.NewUpdateRequest(td.requestID, td.extensionUpdate),
@@ -1257,9 +2302,11 @@ func newTestData(t *testing.T) testData {
 	td.p = testutil.GeneratePeers(1)[0]
 	td.peristenceOptions = persistenceoptions.New()
 	td.requestProcessingListeners = listeners.NewRequestProcessingListeners()
+	td.requestQueuedHooks = listeners.NewRequestQueuedHooks()
 	td.requestHooks = hooks.NewRequestHooks(td.peristenceOptions)
 	td.blockHooks = hooks.NewBlockHooks()
 	td.updateHooks = hooks.NewUpdateHooks()
+	td.completingHooks = hooks.NewCompletingResponseHooks()
 	td.completedListeners = listeners.NewCompletedResponseListeners()
 	td.cancelledListeners = listeners.NewRequestorCancelledListeners()
 	td.blockSentListeners = listeners.NewBlockSentListeners()
@@ -1288,7 +2335,7 @@ func newTestData(t *testing.T) testData {
 }
 
 func (td *testData) newResponseManager() *ResponseManager {
-	rm := New(td.ctx, td.persistence, td.responseAssembler, td.requestProcessingListeners, td.requestHooks, td.updateHooks, td.completedListeners, td.cancelledListeners, td.blockSentListeners, td.networkErrorListeners, td.connManager, 0, nil, td.taskqueue)
+	rm := New(td.ctx, td.persistence, td.responseAssembler, td.requestProcessingListeners, td.requestQueuedHooks, td.requestHooks, td.updateHooks, td.completingHooks, td.completedListeners, td.cancelledListeners, td.blockSentListeners, td.networkErrorListeners, td.connManager, 0, 0, nil, td.taskqueue, nil)
 	queryExecutor := td.newQueryExecutor(rm)
 	td.taskqueue.Startup(6, queryExecutor)
 	return rm
@@ -1296,21 +2343,21 @@ func (td *testData) newResponseManager() *ResponseManager {
 
 func (td *testData) nullTaskQueueResponseManager() *ResponseManager {
 	ntq := nullTaskQueue{tasksQueued: make(map[peer.ID][]peertask.Topic)}
-	rm := New(td.ctx, td.persistence, td.responseAssembler, td.requestProcessingListeners, td.requestHooks, td.updateHooks, td.completedListeners, td.cancelledListeners, td.blockSentListeners, td.networkErrorListeners, td.connManager, 0, nil, ntq)
+	rm := New(td.ctx, td.persistence, td.responseAssembler, td.requestProcessingListeners, td.requestQueuedHooks, td.requestHooks, td.updateHooks, td.completingHooks, td.completedListeners, td.cancelledListeners, td.blockSentListeners, td.networkErrorListeners, td.connManager, 0, 0, nil, ntq, nil)
 	return rm
 }
 
 func (td *testData) alternateLoaderResponseManager() *ResponseManager {
 	obs := make(map[ipld.Link][]byte)
 	persistence := testutil.NewTestStore(obs)
-	rm := New(td.ctx, persistence, td.responseAssembler, td.requestProcessingListeners, td.requestHooks, td.updateHooks, td.completedListeners, td.cancelledListeners, td.blockSentListeners, td.networkErrorListeners, td.connManager, 0, nil, td.taskqueue)
+	rm := New(td.ctx, persistence, td.responseAssembler, td.requestProcessingListeners, td.requestQueuedHooks, td.requestHooks, td.updateHooks, td.completingHooks, td.completedListeners, td.cancelledListeners, td.blockSentListeners, td.networkErrorListeners, td.connManager, 0, 0, nil, td.taskqueue, nil)
 	queryExecutor := td.newQueryExecutor(rm)
 	td.taskqueue.Startup(6, queryExecutor)
 	return rm
 }
 
 func (td *testData) newQueryExecutor(manager queryexecutor.Manager) *queryexecutor.QueryExecutor {
-	return queryexecutor.New(td.ctx, manager, td.blockHooks, td.updateHooks)
+	return queryexecutor.New(td.ctx, manager, td.blockHooks, td.updateHooks, nil, nil, nil)
 }
 
 func (td *testData) assertPausedRequest() {
@@ -1366,6 +2413,12 @@ func (td *testData) assertRequestCleared() {
 	testutil.AssertDoesReceive(td.ctx, td.t, td.clearedRequests, "should clear request")
 }
 
+func (td *testData) assertQueuedResponsesDiscarded(requestID graphsync.RequestID) {
+	var discarded clearedRequest
+	testutil.AssertReceive(td.ctx, td.t, td.discardedRequests, &discarded, "should discard queued responses")
+	require.Equal(td.t, requestID, discarded.requestID)
+}
+
 func (td *testData) assertRequestDoesNotCompleteWhilePaused() {
 	timer := time.NewTimer(100 * time.Millisecond)
 	testutil.AssertDoesReceiveFirst(td.t, timer.C, "should not complete request while paused", td.completedRequestChan)
@@ -1468,7 +2521,7 @@ func (td *testData) assertNetworkErrors(err error, count int) {
 func (td *testData) assertHasNetworkErrors(err error) {
 	var receivedErr error
 	testutil.AssertReceive(td.ctx, td.t, td.networkErrorChan, &receivedErr, "should sent block")
-	require.EqualError(td.t, receivedErr, err.Error())
+	require.ErrorIs(td.t, receivedErr, err)
 }
 
 type nullTaskQueue struct {
@@ -11,8 +11,10 @@ import (
 	"github.com/ipfs/go-peertaskqueue/peertask"
 	"github.com/ipfs/go-peertaskqueue/peertracker"
 	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/linking"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
@@ -20,12 +22,14 @@ import (
 	"go.opentelemetry.io/otel/trace"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/deadline"
 	"github.com/ipfs/go-graphsync/ipldutil"
 	gsmsg "github.com/ipfs/go-graphsync/message"
 	"github.com/ipfs/go-graphsync/peerstate"
 	"github.com/ipfs/go-graphsync/responsemanager/hooks"
 	"github.com/ipfs/go-graphsync/responsemanager/queryexecutor"
 	"github.com/ipfs/go-graphsync/responsemanager/responseassembler"
+	"github.com/ipfs/go-graphsync/supportedextensions"
 )
 
 // The code in this file implements the internal thread for the response manager.
@@ -40,6 +44,7 @@ func (rm *ResponseManager) cleanupInProcessResponses() {
 
 // run runs the internal loop for the response manager
 func (rm *ResponseManager) run() {
+	defer close(rm.stopped)
 	defer rm.cleanupInProcessResponses()
 
 	for {
@@ -53,7 +58,7 @@ func (rm *ResponseManager) run() {
 }
 
 // processRequests is called to process new incoming requests from the network
-func (rm *ResponseManager) processRequests(p peer.ID, requests []gsmsg.GraphSyncRequest) {
+func (rm *ResponseManager) processRequests(p peer.ID, requests []gsmsg.GraphSyncRequest, rejectNew bool) {
 	ctx, messageSpan := otel.Tracer("graphsync").Start(
 		rm.ctx,
 		"processRequests",
@@ -64,10 +69,29 @@ func (rm *ResponseManager) processRequests(p peer.ID, requests []gsmsg.GraphSync
 	for _, request := range requests {
 		switch request.Type() {
 		case graphsync.RequestTypeCancel:
-			_ = rm.abortRequest(ctx, request.ID(), ipldutil.ContextCancelError{})
+			_ = rm.abortRequest(ctx, request.ID(), queryexecutor.ErrCancelledByRequestor)
 		case graphsync.RequestTypeUpdate:
 			rm.processUpdate(ctx, request.ID(), request)
 		case graphsync.RequestTypeNew:
+			rm.recordPeerExtensions(p, request)
+			if rm.rejectDuplicate(p, request) {
+				continue
+			}
+			if rejectNew {
+				log.Infow("rejecting request from blocked peer", "request id", request.ID().String(), "peer", p)
+				rm.rejectRequest(p, request)
+				continue
+			}
+			if rm.closing {
+				log.Infow("rejecting request received while shutting down", "request id", request.ID().String(), "peer", p)
+				rm.rejectRequest(p, request)
+				continue
+			}
+			if rm.maxInProgressPerPeer > 0 && rm.inProgressPerPeer[p] >= rm.maxInProgressPerPeer {
+				log.Infow("rejecting request from peer at its in progress limit", "request id", request.ID().String(), "peer", p)
+				rm.rejectRequest(p, request)
+				continue
+			}
 			rm.newRequest(ctx, p, request)
 		default:
 			log.Errorf("unrecognized request type: %s", request.Type())
@@ -115,12 +139,13 @@ func (rm *ResponseManager) processUpdate(ctx context.Context, requestID graphsyn
 			rb.SendExtensionData(extension)
 		}
 		if result.Err != nil {
+			sendFailureReason(rb, result.Err)
 			rb.FinishWithError(graphsync.RequestFailedUnknown)
 		}
 		return nil
 	})
 	if result.Err != nil {
-		response.state = graphsync.CompletingSend
+		rm.setState(response, graphsync.CompletingSend)
 		response.span.RecordError(result.Err)
 		response.span.SetStatus(codes.Error, result.Err.Error())
 		return
@@ -135,13 +160,28 @@ func (rm *ResponseManager) processUpdate(ctx context.Context, requestID graphsyn
 	}
 }
 
+// recordPeerExtensions remembers the extensions a requestor reported it
+// supports, if the request lists them
+func (rm *ResponseManager) recordPeerExtensions(p peer.ID, request gsmsg.GraphSyncRequest) {
+	names, has, err := supportedextensions.FromRequest(request)
+	if !has || err != nil {
+		return
+	}
+	rm.peerExtensions[p] = names
+}
+
 // abor request cancels an in progress request
 func (rm *ResponseManager) abortRequest(ctx context.Context, requestID graphsync.RequestID, err error) error {
 	response, ok := rm.inProgressResponses[requestID]
 	if ok {
 		rm.responseQueue.Remove(requestID, response.peer)
+		if response.err == nil {
+			response.err = err
+		}
 	}
-	if !ok || response.state == graphsync.CompletingSend {
+	// a network error closes the response stream, so a response that is
+	// completing will never send its final message and must end here
+	if !ok || (response.state == graphsync.CompletingSend && err != queryexecutor.ErrNetworkError) {
 		return graphsync.RequestNotFoundErr{}
 	}
 
@@ -156,19 +196,25 @@ func (rm *ResponseManager) abortRequest(ctx context.Context, requestID graphsync
 	response.span.SetStatus(codes.Error, err.Error())
 
 	if response.state != graphsync.Running {
-		if ipldutil.IsContextCancelErr(err) {
-			response.responseStream.ClearRequest()
-			rm.terminateRequest(requestID)
-			rm.cancelledListeners.NotifyCancelledListeners(response.peer, response.request)
-			return nil
+		if err == queryexecutor.ErrCancelledByRequestor {
+			response.responseStream.DiscardQueued()
+			if !response.peerSupports(graphsync.ExtensionCancelAck) {
+				// the requestor does not expect a reply to its cancel
+				response.responseStream.ClearRequest()
+				rm.terminateRequest(requestID)
+				return nil
+			}
 		}
 		if err == queryexecutor.ErrNetworkError {
 			response.responseStream.ClearRequest()
 			rm.terminateRequest(requestID)
 			return nil
 		}
-		response.state = graphsync.CompletingSend
+		rm.setState(response, graphsync.CompletingSend)
 		return response.responseStream.Transaction(func(rb responseassembler.ResponseBuilder) error {
+			if err == queryexecutor.ErrCancelledByRequestor {
+				rb.SendExtensionData(queryexecutor.CancelAckExtension)
+			}
 			rb.FinishWithError(graphsync.RequestCancelled)
 			return nil
 		})
@@ -177,19 +223,74 @@ func (rm *ResponseManager) abortRequest(ctx context.Context, requestID graphsync
 	case response.signals.ErrSignal <- err:
 	default:
 	}
+	response.interruptLoad()
 	return nil
 }
 
+// rejectDuplicate handles a new request that reuses the ID of a response that
+// has not been cleaned up. If the response is to the same peer and has already
+// sent its final status, it is replaced by the new request. Otherwise the new
+// request is rejected and the response left untouched. Returns true if the new
+// request was rejected
+func (rm *ResponseManager) rejectDuplicate(p peer.ID, request gsmsg.GraphSyncRequest) bool {
+	response, ok := rm.inProgressResponses[request.ID()]
+	if !ok {
+		return false
+	}
+	if response.peer == p && response.state == graphsync.CompletingSend {
+		log.Infow("replacing finished response with new request using its id", "request id", request.ID().String(), "peer", p)
+		// the final status of the old response must not end the new one
+		response.subscriber.detach()
+		response.responseStream.DiscardQueued()
+		rm.terminateRequest(request.ID())
+		return false
+	}
+	log.Warnw("rejecting request using the id of a response in progress", "request id", request.ID().String(), "peer", p)
+	rm.responseAssembler.RejectDuplicate(p, request.ID())
+	return true
+}
+
+// rejectRequest turns away a new request without running hooks or tracking
+// it as in progress
+func (rm *ResponseManager) rejectRequest(p peer.ID, request gsmsg.GraphSyncRequest) {
+	subscriber := &subscriber{
+		p:                     p,
+		request:               request,
+		requestCloser:         rm,
+		metrics:               rm.metrics,
+		blockSentListeners:    rm.blockSentListeners,
+		completedListeners:    rm.completedListeners,
+		networkErrorListeners: rm.networkErrorListeners,
+		connManager:           rm.connManager,
+	}
+	responseStream := rm.responseAssembler.NewStream(rm.ctx, p, request.ID(), subscriber)
+	responseStream.SetCompletingHook(rm.completingHook(p, request))
+	_ = responseStream.Transaction(func(rb responseassembler.ResponseBuilder) error {
+		rb.FinishWithError(graphsync.RequestRejected)
+		return nil
+	})
+}
+
+// completingHook runs completing response hooks for a response when it finishes
+func (rm *ResponseManager) completingHook(p peer.ID, request gsmsg.GraphSyncRequest) responseassembler.CompletingHook {
+	return func(status graphsync.ResponseStatusCode) []graphsync.ExtensionData {
+		return rm.completingHooks.ProcessCompletingResponseHooks(p, request, status)
+	}
+}
+
 // new request sets up a new request
 func (rm *ResponseManager) newRequest(ctx context.Context, p peer.ID, request gsmsg.GraphSyncRequest) {
 
 	// protect the connection
 	rm.connManager.Protect(p, request.ID().Tag())
+	rm.transferStats.StartRequest(request.ID())
 
 	// Run request hooks
 	// Don't use `ctx` which has the "message" trace, but rm.ctx for a fresh trace which allows
-	// for a request hook to join this particular response up to an existing external trace
-	result := rm.requestHooks.ProcessRequestHooks(p, request, rm.ctx)
+	// for a request hook to join this particular response up to an existing external trace.
+	// Hooks are given a context that is cancelled when the response ends
+	responseCtx, cancelResponse := context.WithCancel(rm.ctx)
+	result := rm.requestHooks.ProcessRequestHooks(p, request, rm.peerExtensions[p], responseCtx)
 
 	// setup request data
 
@@ -211,12 +312,18 @@ func (rm *ResponseManager) newRequest(ctx context.Context, p peer.ID, request gs
 			}()),
 		))
 
-	rctx, cancelFn := context.WithCancel(rctx)
+	// hooks may replace the context entirely, so cancel both
+	rctx, cancelRctx := context.WithCancel(graphsync.ContextWithRequestInfo(rctx, request.ID(), p))
+	cancelFn := func() {
+		cancelRctx()
+		cancelResponse()
+	}
 
 	subscriber := &subscriber{
 		p:                     p,
 		request:               request,
 		requestCloser:         rm,
+		metrics:               rm.metrics,
 		blockSentListeners:    rm.blockSentListeners,
 		completedListeners:    rm.completedListeners,
 		networkErrorListeners: rm.networkErrorListeners,
@@ -227,6 +334,14 @@ func (rm *ResponseManager) newRequest(ctx context.Context, p peer.ID, request gs
 	if linkSystem.StorageReadOpener == nil {
 		linkSystem = rm.linkSystem
 	}
+	chooser := result.CustomChooser
+	if chooser == nil {
+		chooser = rm.defaultChooser
+	}
+	selector := result.Selector
+	if selector == nil {
+		selector = request.Selector()
+	}
 
 	signals := queryexecutor.ResponseSignals{
 		PauseSignal:  make(chan struct{}, 1),
@@ -235,52 +350,149 @@ func (rm *ResponseManager) newRequest(ctx context.Context, p peer.ID, request gs
 	}
 
 	responseStream := rm.responseAssembler.NewStream(rctx, p, request.ID(), subscriber)
+	responseStream.SetCompletingHook(rm.completingHook(p, request))
 
 	response := &inProgressResponseStatus{
-		ctx:            rctx,
-		span:           responseSpan,
-		cancelFn:       cancelFn,
-		peer:           p,
-		request:        request,
-		linkSystem:     linkSystem,
-		customChooser:  result.CustomChooser,
-		signals:        signals,
-		startTime:      time.Now(),
-		responseStream: responseStream,
+		ctx:               rctx,
+		span:              responseSpan,
+		cancelFn:          cancelFn,
+		peer:              p,
+		request:           request,
+		selector:          selector,
+		linkSystem:        linkSystem,
+		persistenceOption: result.PersistenceOption,
+		customChooser:     chooser,
+		signals:           signals,
+		startTime:         time.Now(),
+		responseStream:    responseStream,
+		subscriber:        subscriber,
+		peerExtensions:    rm.peerExtensions[p],
 	}
 
 	// setup query for processing
-	err := prepareQuery(rctx, p, request, result, responseStream)
+	err := prepareQuery(rctx, p, request, result, rm.supportedExtensions, rm.blockCompression, responseStream)
 
 	// based on the results of previous hooks and preparing the query, we can now
 	// decide what to do. the request will either be a rejection, paused, or ready to be queued
 	// for processing
+	if result.Err != nil {
+		log.Warnw("request hooks failed incoming request", "request id", request.ID().String(), "peer", p, "error", result.Err)
+	}
 	if err != nil {
 		// error occurred in request hooks or setting up the query --
 		// now we're just waiting for the error response to finish sending
 		// termination will happen when the message subscriber sees the termination
 		// response has been sent (or had a network failure)
 		response.state = graphsync.CompletingSend
+		response.err = err
 		response.span.RecordError(err)
 		response.span.SetStatus(codes.Error, err.Error())
+	} else if rm.asyncValidators != nil && rm.asyncValidators.HasValidators() {
+		rm.startDeadline(response)
+		// hold the response until async validators accept the request, it is
+		// queued or left paused once they do
+		response.validating = true
+		response.state = graphsync.Queued
+		if result.IsPaused {
+			response.state = graphsync.Paused
+		}
+		go rm.validateRequest(response)
 	} else if result.IsPaused {
+		rm.startDeadline(response)
 		// if  the request is paused, don't queue it. just leave in place
 		response.state = graphsync.Paused
+		rm.metrics.RecordIncomingRequestQueued()
 	} else {
+		rm.startDeadline(response)
 		// no error and the request is not paused, queue for procesisng
 		response.state = graphsync.Queued
 		// TODO: Use a better work estimation metric.
 		rm.responseQueue.PushTask(p, peertask.Task{Topic: request.ID(), Priority: int(request.Priority()), Work: 1})
+		rm.requestQueuedHooks.ProcessRequestQueuedHooks(p, request)
+		rm.metrics.RecordIncomingRequestQueued()
 	}
 
 	// save request state
 	log.Infow("graphsync request initiated", "request id", request.ID().String(), "peer", p, "root", request.Root())
-	ipr, ok := rm.inProgressResponses[request.ID()]
-	if ok && ipr.state == graphsync.Running {
-		log.Warnf("there is an identical request already in progress", "request id", request.ID().String(), "peer", p)
+	rm.inProgressResponses[request.ID()] = response
+	rm.inProgressPerPeer[p]++
+	rm.requestCounts.Add(p, response.state)
+}
+
+// startDeadline arranges for a response to end once the deadline the requestor
+// sent with the request passes
+func (rm *ResponseManager) startDeadline(response *inProgressResponseStatus) {
+	data, has := response.request.Extension(graphsync.ExtensionDeadline)
+	if !has {
+		return
+	}
+	timeLeft, err := deadline.DecodeDeadline(data)
+	if err != nil {
+		log.Warnw("ignoring invalid deadline", "request id", response.request.ID().String(), "peer", response.peer, "error", err)
+		return
 	}
+	response.deadline = time.AfterFunc(timeLeft, func() {
+		rm.send(&deadlineExceededMessage{response}, nil)
+	})
+}
 
-	rm.inProgressResponses[request.ID()] = response
+// deadlineExceeded cancels a response once the requestor has stopped waiting
+// for it
+func (rm *ResponseManager) deadlineExceeded(response *inProgressResponseStatus) {
+	requestID := response.request.ID()
+	// the response may have ended, and another taken its ID, before the
+	// message arrived
+	if rm.inProgressResponses[requestID] != response {
+		return
+	}
+	log.Infow("cancelling response past the requestor's deadline", "request id", requestID.String(), "peer", response.peer)
+	_ = rm.abortRequest(rm.ctx, requestID, queryexecutor.ErrDeadlineExceeded)
+}
+
+// completeValidation acts on the decision of async validators for a response
+// held until they decided
+func (rm *ResponseManager) completeValidation(response *inProgressResponseStatus, result hooks.ValidationResult) {
+	requestID := response.request.ID()
+	// the response may have ended, and a new request with the same ID taken
+	// its place
+	if rm.inProgressResponses[requestID] != response || !response.validating {
+		return
+	}
+	response.validating = false
+	// the response may have been cancelled while validators decided
+	if response.state == graphsync.CompletingSend {
+		return
+	}
+	err := result.Err
+	if err == nil && !result.Accepted {
+		err = errInvalidRequest
+	}
+	_ = response.responseStream.Transaction(func(rb responseassembler.ResponseBuilder) error {
+		for _, extension := range result.Extensions {
+			rb.SendExtensionData(extension)
+		}
+		if result.Err != nil {
+			sendFailureReason(rb, result.Err)
+		}
+		if err != nil {
+			rb.FinishWithError(graphsync.RequestRejected)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Infow("async validation rejected request", "request id", requestID.String(), "peer", response.peer, "error", err)
+		rm.setState(response, graphsync.CompletingSend)
+		response.err = err
+		response.span.RecordError(err)
+		response.span.SetStatus(codes.Error, err.Error())
+		return
+	}
+	rm.metrics.RecordIncomingRequestQueued()
+	if response.state == graphsync.Paused {
+		return
+	}
+	rm.responseQueue.PushTask(response.peer, peertask.Task{Topic: requestID, Priority: int(response.request.Priority()), Work: 1})
+	rm.requestQueuedHooks.ProcessRequestQueuedHooks(response.peer, response.request)
 }
 
 func (rm *ResponseManager) taskDataForKey(requestID graphsync.RequestID) queryexecutor.ResponseTask {
@@ -294,6 +506,7 @@ func (rm *ResponseManager) taskDataForKey(requestID graphsync.RequestID) queryex
 		// this is the first time this request has started processing, so call request processing listerners
 		inProgressCount := len(rm.inProgressResponses)
 		rm.requestProcessingListeners.NotifyRequestProcessingListeners(response.peer, response.request, inProgressCount)
+		rm.metrics.RecordIncomingRequestStarted()
 
 		// setup traversal
 		rootLink := cidlink.Link{Cid: response.request.Root()}
@@ -305,13 +518,27 @@ func (rm *ResponseManager) taskDataForKey(requestID graphsync.RequestID) queryex
 				LinkBudget: int64(rm.maxLinksPerRequest),
 			}
 		}
+		var parseSelector func(datamodel.Node) (selector.Selector, error)
+		if rm.selectorCache != nil {
+			parseSelector = rm.selectorCache.ParseSelector
+		}
+		response.loader = response.linkSystem.StorageReadOpener
+		var blockDecoded func(linking.LinkContext, datamodel.Node)
+		if rm.loadConcurrency > 1 {
+			prefetcher := ipldutil.NewPrefetcher(response.ctx, response.linkSystem, rm.loadConcurrency)
+			response.loader = prefetcher.Load
+			blockDecoded = prefetcher.Prefetch
+		}
 		traverser := ipldutil.TraversalBuilder{
 			Root:          rootLink,
-			Selector:      response.request.Selector(),
+			Selector:      response.selector,
 			LinkSystem:    response.linkSystem,
 			Chooser:       response.customChooser,
 			Budget:        budget,
+			MaxLinkDepth:  rm.maxRecursionDepth,
 			PanicCallback: rm.panicCallback,
+			ParseSelector: parseSelector,
+			BlockDecoded:  blockDecoded,
 			Visitor: func(p traversal.Progress, n datamodel.Node, vr traversal.VisitReason) error {
 				if lbn, ok := n.(datamodel.LargeBytesNode); ok {
 					s, err := lbn.AsLargeBytes()
@@ -329,16 +556,22 @@ func (rm *ResponseManager) taskDataForKey(requestID graphsync.RequestID) queryex
 
 		response.traverser = traverser
 	}
-	response.state = graphsync.Running
+	var loadCtx context.Context
+	loadCtx, response.interruptLoad = context.WithCancel(response.ctx)
+	rm.setState(response, graphsync.Running)
 	return queryexecutor.ResponseTask{
 		Ctx:            response.ctx,
 		Span:           response.span,
 		Empty:          false,
 		Request:        response.request,
-		Loader:         response.linkSystem.StorageReadOpener,
+		Loader:         response.loader,
 		Traverser:      response.traverser,
 		Signals:        response.signals,
 		ResponseStream: response.responseStream,
+		LoadCtx:        loadCtx,
+		CancelAck:      response.peerSupports(graphsync.ExtensionCancelAck),
+		BudgetStatus:   response.peerSupports(graphsync.ExtensionSelectorBudgetExceeded),
+		BytesSent:      &response.bytesSent,
 	}
 }
 
@@ -349,6 +582,8 @@ func (rm *ResponseManager) startTask(task *peertask.Task, p peer.ID) queryexecut
 	taskData := rm.taskDataForKey(requestID)
 	if taskData.Empty {
 		rm.responseQueue.TaskDone(p, task)
+	} else {
+		rm.inProgressResponses[requestID].task = task
 	}
 
 	return taskData
@@ -360,9 +595,60 @@ func (rm *ResponseManager) terminateRequest(requestID graphsync.RequestID) {
 		return
 	}
 	rm.connManager.Unprotect(ipr.peer, requestID.Tag())
+	if ipr.deadline != nil {
+		ipr.deadline.Stop()
+	}
 	delete(rm.inProgressResponses, requestID)
+	rm.releasePeerResponse(ipr.peer)
+	rm.transferStats.FinishRequest(requestID)
 	ipr.cancelFn()
 	ipr.span.End()
+	rm.metrics.RecordIncomingRequestCompleted(time.Since(ipr.startTime), ipr.err == nil)
+	rm.requestCounts.Remove(ipr.peer, ipr.state, ipr.err)
+	// listeners hear of a requestor cancel once nothing more is sent for it
+	if ipr.err == queryexecutor.ErrCancelledByRequestor {
+		rm.cancelledListeners.NotifyCancelledListeners(ipr.peer, ipr.request)
+	}
+	if len(rm.inProgressResponses) == 0 {
+		for _, drained := range rm.drainedWaiters {
+			close(drained)
+		}
+		rm.drainedWaiters = nil
+	}
+}
+
+// releasePeerResponse stops counting a response towards its peer's in
+// progress limit
+func (rm *ResponseManager) releasePeerResponse(p peer.ID) {
+	if rm.inProgressPerPeer[p] <= 1 {
+		delete(rm.inProgressPerPeer, p)
+		return
+	}
+	rm.inProgressPerPeer[p]--
+}
+
+// setState moves a response to a new state, keeping the request counts current
+func (rm *ResponseManager) setState(response *inProgressResponseStatus, state graphsync.RequestState) {
+	rm.requestCounts.Move(response.peer, response.state, state)
+	response.state = state
+}
+
+func (rm *ResponseManager) drainResponses(drained chan struct{}) {
+	rm.closing = true
+	rm.drainedWaiters = append(rm.drainedWaiters, drained)
+	if len(rm.inProgressResponses) == 0 {
+		for _, drained := range rm.drainedWaiters {
+			close(drained)
+		}
+		rm.drainedWaiters = nil
+	}
+}
+
+func (rm *ResponseManager) cancelAllResponses(drained chan struct{}) {
+	rm.drainResponses(drained)
+	for requestID := range rm.inProgressResponses {
+		_ = rm.abortRequest(rm.ctx, requestID, queryexecutor.ErrCancelledByCommand)
+	}
 }
 
 func (rm *ResponseManager) finishTask(task *peertask.Task, p peer.ID, err error) {
@@ -372,10 +658,24 @@ func (rm *ResponseManager) finishTask(task *peertask.Task, p peer.ID, err error)
 	if !ok {
 		return
 	}
+	if response.task != task {
+		// the response the task ran ended on a disconnect, and a new request
+		// with the same ID took its place. The task queue drops tasks pushed
+		// while one with the same topic is active, so queue the new one again
+		if response.task == nil && response.state == graphsync.Queued && !response.validating {
+			rm.responseQueue.PushTask(response.peer, peertask.Task{Topic: requestID, Priority: int(response.request.Priority()), Work: 1})
+		}
+		return
+	}
+	response.task = nil
+	response.interruptLoad()
 	if _, ok := err.(hooks.ErrPaused); ok {
-		response.state = graphsync.Paused
+		rm.setState(response, graphsync.Paused)
 		return
 	}
+	if response.err == nil {
+		response.err = err
+	}
 	log.Infow("graphsync response processing complete (messages stil sending)", "request id", requestID.String(), "peer", p, "total time", time.Since(response.startTime))
 
 	if err != nil {
@@ -395,7 +695,50 @@ func (rm *ResponseManager) finishTask(task *peertask.Task, p peer.ID, err error)
 		return
 	}
 
-	response.state = graphsync.CompletingSend
+	// no final status is sent to requestors that do not expect a reply to
+	// their cancel
+	if err == queryexecutor.ErrCancelledByRequestor && !response.peerSupports(graphsync.ExtensionCancelAck) {
+		rm.terminateRequest(requestID)
+		return
+	}
+
+	rm.setState(response, graphsync.CompletingSend)
+}
+
+// disconnected ends every response to a peer that disconnected. Since no more
+// messages can reach the peer, responses end at once, without waiting for a
+// running traversal to stop, so a new request the peer sends with the same ID
+// after it reconnects is neither rejected as a duplicate nor mixed up with the
+// old response
+func (rm *ResponseManager) disconnected(p peer.ID) {
+	// the peer lists its extensions again with its first request once it
+	// reconnects
+	delete(rm.peerExtensions, p)
+	err := graphsync.ErrPeerDisconnected{Peer: p}
+	for requestID, response := range rm.inProgressResponses {
+		if response.peer != p {
+			continue
+		}
+		rm.responseQueue.Remove(requestID, p)
+		if response.err == nil {
+			response.err = err
+		}
+		response.span.RecordError(err)
+		response.span.SetStatus(codes.Error, err.Error())
+		// nothing more is sent for the old response, and messages sent for it
+		// before no longer affect the request ID
+		response.subscriber.detach()
+		_ = response.responseStream.Close()
+		response.responseStream.ClearRequest()
+		if response.state == graphsync.Running {
+			select {
+			case response.signals.ErrSignal <- queryexecutor.ErrNetworkError:
+			default:
+			}
+		}
+		rm.networkErrorListeners.NotifyNetworkErrorListeners(p, response.request, err)
+		rm.terminateRequest(requestID)
+	}
 }
 
 func (rm *ResponseManager) getUpdates(requestID graphsync.RequestID) []gsmsg.GraphSyncRequest {
@@ -420,6 +763,9 @@ func (rm *ResponseManager) pauseRequest(requestID graphsync.RequestID) error {
 	case inProgressResponse.signals.PauseSignal <- struct{}{}:
 	default:
 	}
+	if inProgressResponse.state == graphsync.Running {
+		inProgressResponse.interruptLoad()
+	}
 	return nil
 }
 
@@ -431,7 +777,7 @@ func (rm *ResponseManager) unpauseRequest(requestID graphsync.RequestID, extensi
 	if inProgressResponse.state != graphsync.Paused {
 		return errors.New("request is not paused")
 	}
-	inProgressResponse.state = graphsync.Queued
+	rm.setState(inProgressResponse, graphsync.Queued)
 	if len(extensions) > 0 {
 		_ = inProgressResponse.responseStream.Transaction(func(rb responseassembler.ResponseBuilder) error {
 			for _, extension := range extensions {
@@ -440,6 +786,10 @@ func (rm *ResponseManager) unpauseRequest(requestID graphsync.RequestID, extensi
 			return nil
 		})
 	}
+	// a response still being validated is queued once validators accept it
+	if inProgressResponse.validating {
+		return nil
+	}
 	rm.responseQueue.PushTask(inProgressResponse.peer, peertask.Task{Topic: requestID, Priority: math.MaxInt32, Work: 1})
 	return nil
 }
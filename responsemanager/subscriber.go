@@ -1,6 +1,8 @@
 package responsemanager
 
 import (
+	"sync/atomic"
+
 	"github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
@@ -24,6 +26,16 @@ type subscriber struct {
 	networkErrorListeners NetworkErrorListeners
 	completedListeners    CompletedListeners
 	connManager           network.ConnManager
+	metrics               graphsync.MetricsRecorder
+	// set once the response is replaced by a new request with the same ID,
+	// after which messages still being sent for it are ignored
+	detached int32
+}
+
+// detach stops the subscriber acting on messages sent for its response,
+// other than reporting the blocks they carried
+func (s *subscriber) detach() {
+	atomic.StoreInt32(&s.detached, 1)
 }
 
 func (s *subscriber) OnNext(_ notifications.Topic, event notifications.Event) {
@@ -31,18 +43,34 @@ func (s *subscriber) OnNext(_ notifications.Topic, event notifications.Event) {
 	if !ok {
 		return
 	}
+	// blocks sent for a detached response still went over the network, so
+	// they are reported, but nothing else affects the request ID any more
+	detached := atomic.LoadInt32(&s.detached) == 1
 	switch responseEvent.Name {
 	case messagequeue.Error:
+		if detached {
+			return
+		}
 		s.requestCloser.CloseWithNetworkError(s.request.ID())
 		responseCode := responseEvent.Metadata.ResponseCodes[s.request.ID()]
 		if responseCode.IsTerminal() {
 			s.requestCloser.TerminateRequest(s.request.ID())
 		}
-		s.networkErrorListeners.NotifyNetworkErrorListeners(s.p, s.request, responseEvent.Err)
+		err := responseEvent.Err
+		if blockDatas := responseEvent.Metadata.BlockData[s.request.ID()]; len(blockDatas) > 0 {
+			err = graphsync.BlocksNotSentErr{Blocks: blockDatas, Err: err}
+		}
+		s.networkErrorListeners.NotifyNetworkErrorListeners(s.p, s.request, err)
 	case messagequeue.Sent:
 		blockDatas := responseEvent.Metadata.BlockData[s.request.ID()]
 		for _, blockData := range blockDatas {
 			s.blockSentListeners.NotifyBlockSentListeners(s.p, s.request, blockData)
+			if blockData.BlockSizeOnWire() > 0 {
+				s.metrics.RecordBlockSent(blockData.BlockSizeOnWire())
+			}
+		}
+		if detached {
+			return
 		}
 		responseCode := responseEvent.Metadata.ResponseCodes[s.request.ID()]
 		if responseCode.IsTerminal() {
@@ -0,0 +1,59 @@
+package responsemanager
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/listeners"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/messagequeue"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+type fakeRequestCloser struct {
+	terminated []graphsync.RequestID
+}
+
+func (frc *fakeRequestCloser) TerminateRequest(requestID graphsync.RequestID) {
+	frc.terminated = append(frc.terminated, requestID)
+}
+
+func (frc *fakeRequestCloser) CloseWithNetworkError(requestID graphsync.RequestID) {}
+
+func TestSubscriberDetach(t *testing.T) {
+	requestID := graphsync.NewRequestID()
+	requestCloser := &fakeRequestCloser{}
+	blockSentListeners := listeners.NewBlockSentListeners()
+	var blocksSent []graphsync.BlockData
+	blockSentListeners.Register(func(p peer.ID, request graphsync.RequestData, blockData graphsync.BlockData) {
+		blocksSent = append(blocksSent, blockData)
+	})
+	s := &subscriber{
+		p:                  testutil.GeneratePeers(1)[0],
+		request:            gsmsg.NewCancelRequest(requestID),
+		requestCloser:      requestCloser,
+		blockSentListeners: blockSentListeners,
+		completedListeners: listeners.NewCompletedResponseListeners(),
+		metrics:            &graphsync.NoopMetricsRecorder{},
+	}
+	blockData := testutil.NewFakeBlockData()
+	sent := messagequeue.Event{Name: messagequeue.Sent, Metadata: messagequeue.Metadata{
+		ResponseCodes: map[graphsync.RequestID]graphsync.ResponseStatusCode{requestID: graphsync.RequestCompletedFull},
+		BlockData:     map[graphsync.RequestID][]graphsync.BlockData{requestID: {blockData}},
+	}}
+
+	s.OnNext(0, sent)
+	require.Equal(t, []graphsync.RequestID{requestID}, requestCloser.terminated)
+	require.Equal(t, []graphsync.BlockData{blockData}, blocksSent)
+
+	// once detached, a final status sent for the old response does not end
+	// the request that replaced it, but the blocks it carried are still
+	// reported as sent
+	s.detach()
+	s.OnNext(0, sent)
+	require.Equal(t, []graphsync.RequestID{requestID}, requestCloser.terminated)
+	require.Equal(t, []graphsync.BlockData{blockData, blockData}, blocksSent)
+}
@@ -0,0 +1,17 @@
+package selectorbudget
+
+import (
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+// EncodeBudgetExceeded returns encoded cbor data for the kind of budget
+// ("link" or "depth") that a traversal exceeded
+func EncodeBudgetExceeded(kind string) datamodel.Node {
+	return basicnode.NewString(kind)
+}
+
+// DecodeBudgetExceeded returns the kind of budget that a traversal exceeded
+func DecodeBudgetExceeded(data datamodel.Node) (string, error) {
+	return data.AsString()
+}
@@ -0,0 +1,207 @@
+package selectorcache
+
+import (
+	"container/list"
+	"encoding/binary"
+	"math"
+	"sync"
+
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+)
+
+// SelectorCache remembers compiled selectors, and the results of validating
+// them, keyed on their serialized form, so that selectors used by many
+// requests are only compiled and validated once. When full, the least recently
+// used selector is evicted. It is safe for concurrent use
+type SelectorCache struct {
+	maxEntries int
+	compile    func(datamodel.Node) (selector.Selector, error)
+
+	lk      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type cacheEntry struct {
+	key string
+	// nil until the selector is compiled successfully
+	selector    selector.Selector
+	validations map[string]error
+}
+
+// New returns a cache that holds up to maxEntries selectors
+func New(maxEntries int) *SelectorCache {
+	return &SelectorCache{
+		maxEntries: maxEntries,
+		compile:    selector.ParseSelector,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// ParseSelector compiles the given selector node, returning a cached result if
+// the same selector was compiled before. Selectors that fail to compile are
+// compiled again on every call
+func (sc *SelectorCache) ParseSelector(node datamodel.Node) (selector.Selector, error) {
+	entry, err := sc.entry(node)
+	if err != nil {
+		return nil, err
+	}
+	sc.lk.Lock()
+	sel := entry.selector
+	sc.lk.Unlock()
+	if sel != nil {
+		return sel, nil
+	}
+
+	// compile outside the lock, so a slow compile does not hold up other requests
+	sel, err = sc.compile(node)
+	if err != nil {
+		return nil, err
+	}
+	sc.lk.Lock()
+	entry.selector = sel
+	sc.lk.Unlock()
+	return sel, nil
+}
+
+// Validate runs the given validation on the selector node, returning a cached
+// result if a validation with the same name already ran on the same selector
+func (sc *SelectorCache) Validate(node datamodel.Node, name string, validate func(datamodel.Node) error) error {
+	entry, err := sc.entry(node)
+	if err != nil {
+		return err
+	}
+	sc.lk.Lock()
+	result, ok := entry.validations[name]
+	sc.lk.Unlock()
+	if ok {
+		return result
+	}
+
+	result = validate(node)
+	sc.lk.Lock()
+	entry.validations[name] = result
+	sc.lk.Unlock()
+	return result
+}
+
+// Len returns the number of selectors currently cached
+func (sc *SelectorCache) Len() int {
+	sc.lk.Lock()
+	defer sc.lk.Unlock()
+	return sc.order.Len()
+}
+
+// entry returns the cache entry for the given selector node, adding it and
+// evicting the least recently used entry if needed
+func (sc *SelectorCache) entry(node datamodel.Node) (*cacheEntry, error) {
+	keyBytes, err := appendKey(make([]byte, 0, 128), node)
+	if err != nil {
+		return nil, err
+	}
+	key := string(keyBytes)
+
+	sc.lk.Lock()
+	defer sc.lk.Unlock()
+	if elem, ok := sc.entries[key]; ok {
+		sc.order.MoveToFront(elem)
+		return elem.Value.(*cacheEntry), nil
+	}
+	entry := &cacheEntry{key: key, validations: make(map[string]error)}
+	sc.entries[key] = sc.order.PushFront(entry)
+	for sc.order.Len() > sc.maxEntries {
+		oldest := sc.order.Back()
+		sc.order.Remove(oldest)
+		delete(sc.entries, oldest.Value.(*cacheEntry).key)
+	}
+	return entry, nil
+}
+
+// appendKey appends a serialized form of the given node to buf. Selectors
+// arrive already decoded, and this is much cheaper than re-encoding them to
+// dag-cbor, while still identifying the same selector by the same bytes
+func appendKey(buf []byte, node datamodel.Node) ([]byte, error) {
+	buf = append(buf, byte(node.Kind()))
+	switch node.Kind() {
+	case datamodel.Kind_Map:
+		buf = appendUvarint(buf, uint64(node.Length()))
+		it := node.MapIterator()
+		for !it.Done() {
+			k, v, err := it.Next()
+			if err != nil {
+				return nil, err
+			}
+			if buf, err = appendKey(buf, k); err != nil {
+				return nil, err
+			}
+			if buf, err = appendKey(buf, v); err != nil {
+				return nil, err
+			}
+		}
+	case datamodel.Kind_List:
+		buf = appendUvarint(buf, uint64(node.Length()))
+		it := node.ListIterator()
+		for !it.Done() {
+			_, v, err := it.Next()
+			if err != nil {
+				return nil, err
+			}
+			if buf, err = appendKey(buf, v); err != nil {
+				return nil, err
+			}
+		}
+	case datamodel.Kind_Bool:
+		b, err := node.AsBool()
+		if err != nil {
+			return nil, err
+		}
+		if b {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+	case datamodel.Kind_Int:
+		i, err := node.AsInt()
+		if err != nil {
+			return nil, err
+		}
+		buf = appendUvarint(buf, uint64(i))
+	case datamodel.Kind_Float:
+		f, err := node.AsFloat()
+		if err != nil {
+			return nil, err
+		}
+		buf = appendUvarint(buf, math.Float64bits(f))
+	case datamodel.Kind_String:
+		str, err := node.AsString()
+		if err != nil {
+			return nil, err
+		}
+		buf = appendUvarint(buf, uint64(len(str)))
+		buf = append(buf, str...)
+	case datamodel.Kind_Bytes:
+		b, err := node.AsBytes()
+		if err != nil {
+			return nil, err
+		}
+		buf = appendUvarint(buf, uint64(len(b)))
+		buf = append(buf, b...)
+	case datamodel.Kind_Link:
+		lnk, err := node.AsLink()
+		if err != nil {
+			return nil, err
+		}
+		str := lnk.Binary()
+		buf = appendUvarint(buf, uint64(len(str)))
+		buf = append(buf, str...)
+	}
+	return buf, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], v)
+	return append(buf, scratch[:n]...)
+}
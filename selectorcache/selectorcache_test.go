@@ -0,0 +1,104 @@
+package selectorcache
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/stretchr/testify/require"
+)
+
+func testSelector(depth int64) datamodel.Node {
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	return ssb.ExploreRecursive(selector.RecursionLimitDepth(depth),
+		ssb.ExploreUnion(
+			ssb.Matcher(),
+			ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+				efsb.Insert("Links", ssb.ExploreIndex(0, ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+					efsb.Insert("Hash", ssb.ExploreRecursiveEdge())
+				})))
+				efsb.Insert("Parents", ssb.ExploreAll(ssb.ExploreRecursiveEdge()))
+			}),
+		)).Node()
+}
+
+func TestSelectorCache(t *testing.T) {
+	sc := New(2)
+	compiles := 0
+	sc.compile = func(node datamodel.Node) (selector.Selector, error) {
+		compiles++
+		return selector.ParseSelector(node)
+	}
+
+	first, err := sc.ParseSelector(testSelector(1))
+	require.NoError(t, err)
+	again, err := sc.ParseSelector(testSelector(1))
+	require.NoError(t, err)
+	require.Equal(t, first, again)
+	require.Equal(t, 1, compiles, "should return the cached selector")
+	require.Equal(t, 1, sc.Len())
+
+	_, err = sc.ParseSelector(testSelector(2))
+	require.NoError(t, err)
+	// use the first selector, so the second is least recently used
+	_, err = sc.ParseSelector(testSelector(1))
+	require.NoError(t, err)
+	_, err = sc.ParseSelector(testSelector(3))
+	require.NoError(t, err)
+	require.Equal(t, 2, sc.Len())
+
+	_, err = sc.ParseSelector(testSelector(1))
+	require.NoError(t, err)
+	require.Equal(t, 3, compiles, "should keep the recently used selector")
+	_, err = sc.ParseSelector(testSelector(2))
+	require.NoError(t, err)
+	require.Equal(t, 4, compiles, "should evict the least recently used selector")
+
+	// selectors that fail to compile are not remembered
+	_, err = sc.ParseSelector(basicnode.NewString("not a selector"))
+	require.Error(t, err)
+	_, err = sc.ParseSelector(basicnode.NewString("not a selector"))
+	require.Error(t, err)
+	require.Equal(t, 6, compiles)
+}
+
+func TestSelectorCacheValidate(t *testing.T) {
+	sc := New(2)
+	validations := 0
+	errInvalid := errors.New("invalid")
+	validate := func(node datamodel.Node) error {
+		validations++
+		return errInvalid
+	}
+
+	require.Equal(t, errInvalid, sc.Validate(testSelector(1), "first", validate))
+	require.Equal(t, errInvalid, sc.Validate(testSelector(1), "first", validate))
+	require.Equal(t, 1, validations, "should return the cached result")
+
+	require.Equal(t, errInvalid, sc.Validate(testSelector(1), "second", validate))
+	require.Equal(t, 2, validations, "should run validations with different names separately")
+
+	_, err := sc.ParseSelector(testSelector(1))
+	require.NoError(t, err)
+	require.Equal(t, errInvalid, sc.Validate(testSelector(1), "first", validate))
+	require.Equal(t, 2, validations, "should share an entry with the compiled selector")
+}
+
+func TestSelectorCacheConcurrentAccess(t *testing.T) {
+	sc := New(5)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := sc.ParseSelector(testSelector(int64(i%10 + 1)))
+			require.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(t, 5, sc.Len())
+}
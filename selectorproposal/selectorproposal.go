@@ -0,0 +1,41 @@
+package selectorproposal
+
+import (
+	"errors"
+
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+// EncodeSelectorProposal encodes an alternate selector proposal for the
+// selector-proposal extension
+func EncodeSelectorProposal(proposal graphsync.SelectorProposal) datamodel.Node {
+	return fluent.MustBuildMap(basicnode.Prototype.Map, 2, func(ma fluent.MapAssembler) {
+		ma.AssembleEntry("Selector").AssignNode(proposal.Selector)
+		ma.AssembleEntry("Reason").AssignString(proposal.Reason)
+	})
+}
+
+// DecodeSelectorProposal decodes an alternate selector proposal from data for
+// the selector-proposal extension
+func DecodeSelectorProposal(data datamodel.Node) (graphsync.SelectorProposal, error) {
+	if data.Kind() != datamodel.Kind_Map {
+		return graphsync.SelectorProposal{}, errors.New("did not receive a selector proposal map")
+	}
+	selector, err := data.LookupByString("Selector")
+	if err != nil {
+		return graphsync.SelectorProposal{}, err
+	}
+	reasonNode, err := data.LookupByString("Reason")
+	if err != nil {
+		return graphsync.SelectorProposal{}, err
+	}
+	reason, err := reasonNode.AsString()
+	if err != nil {
+		return graphsync.SelectorProposal{}, err
+	}
+	return graphsync.SelectorProposal{Selector: selector, Reason: reason}, nil
+}
@@ -0,0 +1,34 @@
+package selectorproposal
+
+import (
+	"testing"
+
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+func TestDecodeEncodeSelectorProposal(t *testing.T) {
+	proposal := graphsync.SelectorProposal{
+		Selector: selectorparse.CommonSelector_ExploreAllRecursively,
+		Reason:   "too expensive",
+	}
+	encoded := EncodeSelectorProposal(proposal)
+	// make sure the proposal survives a trip over the wire
+	data, err := ipld.Encode(encoded, dagcbor.Encode)
+	require.NoError(t, err)
+	wire, err := ipld.Decode(data, dagcbor.Decode)
+	require.NoError(t, err)
+
+	decoded, err := DecodeSelectorProposal(wire)
+	require.NoError(t, err, "decode errored")
+	require.Equal(t, proposal.Reason, decoded.Reason)
+	require.True(t, ipld.DeepEqual(proposal.Selector, decoded.Selector))
+
+	_, err = DecodeSelectorProposal(basicnode.NewString("not a proposal"))
+	require.Error(t, err)
+}
@@ -2,6 +2,7 @@ package selectorvalidator
 
 import (
 	"errors"
+	"strconv"
 
 	ipld "github.com/ipld/go-ipld-prime"
 	"github.com/ipld/go-ipld-prime/node/basicnode"
@@ -11,6 +12,7 @@ import (
 	"github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/selectorcache"
 )
 
 var (
@@ -63,6 +65,21 @@ func SelectorValidator(maxAcceptedDepth int64) graphsync.OnIncomingRequestHook {
 	}
 }
 
+// CachedSelectorValidator is a SelectorValidator that remembers the outcome of
+// validating each selector in the given cache
+func CachedSelectorValidator(maxAcceptedDepth int64, cache *selectorcache.SelectorCache) graphsync.OnIncomingRequestHook {
+	name := "max-recursion-depth/" + strconv.FormatInt(maxAcceptedDepth, 10)
+	validate := func(node ipld.Node) error {
+		return ValidateMaxRecursionDepth(node, maxAcceptedDepth)
+	}
+	return func(p peer.ID, request graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+		err := cache.Validate(request.Selector(), name, validate)
+		if err == nil {
+			hookActions.ValidateRequest()
+		}
+	}
+}
+
 // ValidateMaxRecursionDepth examines the given selector node and verifies
 // recursive selectors are limited to the given fixed depth
 func ValidateMaxRecursionDepth(node ipld.Node, maxAcceptedDepth int64) error {
@@ -1,6 +1,7 @@
 package selectorvalidator
 
 import (
+	"sync"
 	"testing"
 
 	ipld "github.com/ipld/go-ipld-prime"
@@ -8,6 +9,8 @@ import (
 	"github.com/ipld/go-ipld-prime/traversal/selector"
 	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync/selectorcache"
 )
 
 func TestValidateMaxRecusionDepth(t *testing.T) {
@@ -97,3 +100,58 @@ func TestValidateMaxRecusionDepth(t *testing.T) {
 		verifyOutcomes(t, success, fail, failNone)
 	})
 }
+
+func BenchmarkSelectorHandling(b *testing.B) {
+	benchmarkConcurrentRequests(b, func(node ipld.Node) error {
+		if err := ValidateMaxRecursionDepth(node, 100); err != nil {
+			return err
+		}
+		_, err := selector.ParseSelector(node)
+		return err
+	})
+}
+
+func BenchmarkSelectorHandlingCached(b *testing.B) {
+	cache := selectorcache.New(16)
+	validate := func(node ipld.Node) error {
+		return ValidateMaxRecursionDepth(node, 100)
+	}
+	benchmarkConcurrentRequests(b, func(node ipld.Node) error {
+		if err := cache.Validate(node, "max-recursion-depth/100", validate); err != nil {
+			return err
+		}
+		_, err := cache.ParseSelector(node)
+		return err
+	})
+}
+
+// benchmarkConcurrentRequests validates and compiles the same selector for 100
+// concurrent requests per iteration, as a responder does for a popular selector
+func benchmarkConcurrentRequests(b *testing.B, handleSelector func(ipld.Node) error) {
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	node := ssb.ExploreRecursive(selector.RecursionLimitDepth(100),
+		ssb.ExploreUnion(
+			ssb.Matcher(),
+			ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+				efsb.Insert("Links", ssb.ExploreIndex(0, ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+					efsb.Insert("Hash", ssb.ExploreRecursiveEdge())
+				})))
+				efsb.Insert("Parents", ssb.ExploreAll(ssb.ExploreRecursiveEdge()))
+			}),
+		)).Node()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := handleSelector(node); err != nil {
+					b.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
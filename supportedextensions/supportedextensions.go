@@ -0,0 +1,73 @@
+package supportedextensions
+
+import (
+	"errors"
+
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+// EncodeSupportedExtensions encodes extension names for the
+// supported-extensions extension
+func EncodeSupportedExtensions(names []graphsync.ExtensionName) datamodel.Node {
+	return fluent.MustBuildList(basicnode.Prototype.List, int64(len(names)), func(la fluent.ListAssembler) {
+		for _, name := range names {
+			la.AssembleValue().AssignString(string(name))
+		}
+	})
+}
+
+// DecodeSupportedExtensions decodes extension names from data for the
+// supported-extensions extension
+func DecodeSupportedExtensions(data datamodel.Node) ([]graphsync.ExtensionName, error) {
+	if data.Kind() != datamodel.Kind_List {
+		return nil, errors.New("did not receive a list of extension names")
+	}
+	names := make([]graphsync.ExtensionName, 0, data.Length())
+	iter := data.ListIterator()
+	for !iter.Done() {
+		_, next, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		name, err := next.AsString()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, graphsync.ExtensionName(name))
+	}
+	return names, nil
+}
+
+// FromRequest returns the extension names a requestor listed in the
+// supported-extensions extension of its request, for use in incoming request
+// hooks. has is false if the requestor did not send the extension. A requestor
+// only lists its extensions with its first request after it connects, so
+// hooks that need them for every request should use
+// IncomingRequestHookActions.PeerExtensions instead
+func FromRequest(request graphsync.RequestData) (names []graphsync.ExtensionName, has bool, err error) {
+	data, has := request.Extension(graphsync.ExtensionSupportedExtensions)
+	if !has {
+		return nil, false, nil
+	}
+	names, err = DecodeSupportedExtensions(data)
+	return names, true, err
+}
+
+// Intersect returns the names in names that are also in supported, in order
+func Intersect(names []graphsync.ExtensionName, supported []graphsync.ExtensionName) []graphsync.ExtensionName {
+	supportedSet := make(map[graphsync.ExtensionName]struct{}, len(supported))
+	for _, name := range supported {
+		supportedSet[name] = struct{}{}
+	}
+	intersection := make([]graphsync.ExtensionName, 0, len(names))
+	for _, name := range names {
+		if _, ok := supportedSet[name]; ok {
+			intersection = append(intersection, name)
+		}
+	}
+	return intersection
+}
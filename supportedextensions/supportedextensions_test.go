@@ -0,0 +1,47 @@
+package supportedextensions
+
+import (
+	"testing"
+
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestDecodeEncodeSupportedExtensions(t *testing.T) {
+	names := graphsync.KnownExtensions()
+	decoded, err := DecodeSupportedExtensions(EncodeSupportedExtensions(names))
+	require.NoError(t, err, "decode errored")
+	require.Equal(t, names, decoded)
+}
+
+func TestIntersect(t *testing.T) {
+	names := []graphsync.ExtensionName{graphsync.ExtensionDoNotSendCIDs, "custom/a", graphsync.ExtensionResume}
+	supported := []graphsync.ExtensionName{graphsync.ExtensionResume, "custom/b", graphsync.ExtensionDoNotSendCIDs}
+	require.Equal(t, []graphsync.ExtensionName{graphsync.ExtensionDoNotSendCIDs, graphsync.ExtensionResume}, Intersect(names, supported))
+	require.Empty(t, Intersect(names, nil))
+}
+
+func TestFromRequest(t *testing.T) {
+	root := testutil.GenerateCids(1)[0]
+	selector := selectorparse.CommonSelector_ExploreAllRecursively
+	names := []graphsync.ExtensionName{graphsync.ExtensionDoNotSendCIDs, "custom/a"}
+
+	request := gsmsg.NewRequest(graphsync.NewRequestID(), root, selector, graphsync.Priority(0), graphsync.ExtensionData{
+		Name: graphsync.ExtensionSupportedExtensions,
+		Data: EncodeSupportedExtensions(names),
+	})
+	decoded, has, err := FromRequest(request)
+	require.NoError(t, err)
+	require.True(t, has)
+	require.Equal(t, names, decoded)
+
+	request = gsmsg.NewRequest(graphsync.NewRequestID(), root, selector, graphsync.Priority(0))
+	decoded, has, err = FromRequest(request)
+	require.NoError(t, err)
+	require.False(t, has, "requestors that do not negotiate send no list")
+	require.Nil(t, decoded)
+}
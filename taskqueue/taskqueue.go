@@ -3,6 +3,7 @@ package taskqueue
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ipfs/go-peertaskqueue"
@@ -11,6 +12,7 @@ import (
 	peer "github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/limits"
 )
 
 const thawSpeed = time.Millisecond * 100
@@ -39,26 +41,149 @@ type WorkerTaskQueue struct {
 	noTaskCond  *sync.Cond
 	ticker      *time.Ticker
 	activeTasks int32
+	workerLimit uint64
+
+	// records tasks that wait because every worker is busy, may be nil
+	limitRecorder *limits.Recorder
+	limit         graphsync.LimitName
+
+	// when set, tasks wait in pending until the scheduler picks them, and
+	// are tracked in dispatched until they are done
+	scheduler  graphsync.RequestScheduler
+	pending    map[peertask.Topic]pendingTask
+	dispatched map[peertask.Topic]pendingTask
+
+	// when each peer with queued or active tasks was last given a task, so
+	// peers can be served round-robin
+	lastServed map[peer.ID]uint64
+	served     uint64
+}
+
+// RequestTaskData is the data of a task for an outgoing request, which the
+// scheduler sees in the request's graphsync.PendingRequestInfo
+type RequestTaskData struct {
+	DependsOn []graphsync.RequestID
+	Resumed   bool
+}
+
+type pendingTask struct {
+	p    peer.ID
+	task peertask.Task
 }
 
-// NewTaskQueue initializes a new queue
+func (pt pendingTask) info(queuedAt time.Time) graphsync.PendingRequestInfo {
+	requestID, _ := pt.task.Topic.(graphsync.RequestID)
+	data, _ := pt.task.Data.(RequestTaskData)
+	return graphsync.PendingRequestInfo{
+		RequestID: requestID,
+		Peer:      pt.p,
+		Priority:  graphsync.Priority(pt.task.Priority),
+		DependsOn: data.DependsOn,
+		Resumed:   data.Resumed,
+		QueuedAt:  queuedAt,
+	}
+}
+
+// NewTaskQueue initializes a new queue. Tasks are handed to workers
+// round-robin across peers, unless the given options set another peer
+// comparator
 func NewTaskQueue(ctx context.Context, ptqopts ...peertaskqueue.Option) *WorkerTaskQueue {
 	ctx, cancelFn := context.WithCancel(ctx)
-	return &WorkerTaskQueue{
-		ctx:           ctx,
-		cancelFn:      cancelFn,
-		PeerTaskQueue: peertaskqueue.New(ptqopts...),
-		workSignal:    make(chan struct{}, 1),
-		noTaskCond:    sync.NewCond(&sync.Mutex{}),
-		ticker:        time.NewTicker(thawSpeed),
+	tq := &WorkerTaskQueue{
+		ctx:        ctx,
+		cancelFn:   cancelFn,
+		workSignal: make(chan struct{}, 1),
+		noTaskCond: sync.NewCond(&sync.Mutex{}),
+		ticker:     time.NewTicker(thawSpeed),
+		lastServed: make(map[peer.ID]uint64),
+		pending:    make(map[peertask.Topic]pendingTask),
+		dispatched: make(map[peertask.Topic]pendingTask),
 	}
+	ptqopts = append([]peertaskqueue.Option{
+		peertaskqueue.PeerComparator(tq.comparePeers),
+		peertaskqueue.OnPeerRemovedHook(tq.peerRemoved),
+	}, ptqopts...)
+	tq.PeerTaskQueue = peertaskqueue.New(ptqopts...)
+	return tq
+}
+
+// comparePeers orders peers for the next task: peers with pending work that
+// are not frozen go first, then those with the fewest tasks in progress, then
+// the peer served least recently, so a peer with many queued tasks can't keep
+// every worker while other peers wait.
+// Only called by the peer task queue while lockTopics is held
+func (tq *WorkerTaskQueue) comparePeers(pa, pb *peertracker.PeerTracker) bool {
+	paStats := pa.Stats()
+	pbStats := pb.Stats()
+	if paStats.NumPending == 0 {
+		return false
+	}
+	if pbStats.NumPending == 0 {
+		return true
+	}
+	if pa.IsFrozen() != pb.IsFrozen() {
+		return pb.IsFrozen()
+	}
+	if paStats.NumActive != pbStats.NumActive {
+		return paStats.NumActive < pbStats.NumActive
+	}
+	paServed := tq.lastServed[pa.Target()]
+	pbServed := tq.lastServed[pb.Target()]
+	if paServed != pbServed {
+		return paServed < pbServed
+	}
+	return paStats.NumPending > pbStats.NumPending
+}
+
+// peerRemoved forgets when a peer was last served once it has no tasks.
+// Only called by the peer task queue while lockTopics is held
+func (tq *WorkerTaskQueue) peerRemoved(p peer.ID) {
+	delete(tq.lastServed, p)
 }
 
 // PushTask pushes a new task on to the queue
 func (tq *WorkerTaskQueue) PushTask(p peer.ID, task peertask.Task) {
 	tq.lockTopics.Lock()
-	tq.PeerTaskQueue.PushTasks(p, task)
+	if tq.scheduler != nil {
+		// a task queued again before its last run is done starts over with
+		// the scheduler
+		if _, ok := tq.dispatched[task.Topic]; ok {
+			delete(tq.dispatched, task.Topic)
+			tq.scheduler.Done(task.Topic.(graphsync.RequestID))
+		}
+		pt := pendingTask{p, task}
+		tq.pending[task.Topic] = pt
+		tq.scheduler.Push(pt.info(time.Now()))
+	} else {
+		tq.PeerTaskQueue.PushTasks(p, task)
+	}
 	tq.lockTopics.Unlock()
+	tq.noTaskCond.L.Lock()
+	busy := uint64(tq.activeTasks) >= atomic.LoadUint64(&tq.workerLimit)
+	tq.noTaskCond.L.Unlock()
+	if busy {
+		tq.limitRecorder.Hit(tq.limit, graphsync.LimitScopeGlobal)
+	}
+	tq.signalWork()
+}
+
+// SetLimitRecorder sets where to record tasks that wait because every worker
+// is busy, recorded as hits on the given limit. It must be called before
+// Startup
+func (tq *WorkerTaskQueue) SetLimitRecorder(limitRecorder *limits.Recorder, limit graphsync.LimitName) {
+	tq.limitRecorder = limitRecorder
+	tq.limit = limit
+}
+
+// SetScheduler sets a scheduler that picks which waiting task runs next, in
+// place of the peer task queue's ordering. Task topics must be request IDs,
+// and task data, if set, a RequestTaskData.
+// It must be called before Startup
+func (tq *WorkerTaskQueue) SetScheduler(scheduler graphsync.RequestScheduler) {
+	tq.scheduler = scheduler
+}
+
+func (tq *WorkerTaskQueue) signalWork() {
 	select {
 	case tq.workSignal <- struct{}{}:
 	default:
@@ -68,36 +193,81 @@ func (tq *WorkerTaskQueue) PushTask(p peer.ID, task peertask.Task) {
 // TaskDone marks a task as completed so further tasks can be executed
 func (tq *WorkerTaskQueue) TaskDone(p peer.ID, task *peertask.Task) {
 	tq.lockTopics.Lock()
+	if pt, ok := tq.dispatched[task.Topic]; ok && pt.p == p {
+		delete(tq.dispatched, task.Topic)
+		tq.scheduler.Done(task.Topic.(graphsync.RequestID))
+	}
 	tq.PeerTaskQueue.TasksDone(p, task)
 	tq.lockTopics.Unlock()
 }
 
+// Remove removes a task that has not yet been executed
+func (tq *WorkerTaskQueue) Remove(topic peertask.Topic, p peer.ID) {
+	tq.lockTopics.Lock()
+	defer tq.lockTopics.Unlock()
+	if pt, ok := tq.pending[topic]; ok && pt.p == p {
+		delete(tq.pending, topic)
+		tq.scheduler.Done(topic.(graphsync.RequestID))
+	}
+	if pt, ok := tq.dispatched[topic]; ok && pt.p == p {
+		delete(tq.dispatched, topic)
+		tq.scheduler.Done(topic.(graphsync.RequestID))
+	}
+	tq.PeerTaskQueue.Remove(topic, p)
+}
+
 // Stats returns statistics about a task queue
 func (tq *WorkerTaskQueue) Stats() graphsync.RequestStats {
 	tq.lockTopics.Lock()
 	ptqstats := tq.PeerTaskQueue.Stats()
+	pending := len(tq.pending)
 	tq.lockTopics.Unlock()
 	return graphsync.RequestStats{
 		TotalPeers: uint64(ptqstats.NumPeers),
 		Active:     uint64(ptqstats.NumActive),
-		Pending:    uint64(ptqstats.NumPending),
+		Pending:    uint64(ptqstats.NumPending + pending),
 	}
 }
 
+// WithPeerTopics calls the given function with the active and pending topics
+// for a peer, or nil if it has none. Pending topics include tasks waiting for
+// the scheduler to pick them
 func (tq *WorkerTaskQueue) WithPeerTopics(p peer.ID, withPeerTopics func(*peertracker.PeerTrackerTopics)) {
 	tq.lockTopics.Lock()
 	peerTopics := tq.PeerTaskQueue.PeerTopics(p)
+	for _, pt := range tq.pending {
+		if pt.p != p {
+			continue
+		}
+		if peerTopics == nil {
+			peerTopics = &peertracker.PeerTrackerTopics{}
+		}
+		peerTopics.Pending = append(peerTopics.Pending, pt.task.Topic)
+	}
 	withPeerTopics(peerTopics)
 	tq.lockTopics.Unlock()
 }
 
 // Startup runs the given number of task workers with the given executor
 func (tq *WorkerTaskQueue) Startup(workerCount uint64, executor Executor) {
+	atomic.StoreUint64(&tq.workerLimit, workerCount)
 	for i := uint64(0); i < workerCount; i++ {
-		go tq.worker(executor)
+		go tq.worker(i, executor)
 	}
 }
 
+// SetWorkerLimit changes how many of the started workers may pick up new tasks.
+// Tasks already executing are allowed to finish, so lowering the limit takes
+// effect as running tasks complete. The limit cannot exceed the number of
+// workers started
+func (tq *WorkerTaskQueue) SetWorkerLimit(limit uint64) {
+	atomic.StoreUint64(&tq.workerLimit, limit)
+}
+
+func (tq *WorkerTaskQueue) isIdleWorker(index uint64) bool {
+	return index >= atomic.LoadUint64(&tq.workerLimit)
+}
+
 // Shutdown shuts down all running workers
 func (tq *WorkerTaskQueue) Shutdown() {
 	tq.cancelFn()
@@ -111,26 +281,61 @@ func (tq *WorkerTaskQueue) WaitForNoActiveTasks() {
 	tq.noTaskCond.L.Unlock()
 }
 
-func (tq *WorkerTaskQueue) worker(executor Executor) {
+// popTasks pops the next tasks to execute, first asking the scheduler, if
+// there is one, to move a waiting task onto the peer task queue
+func (tq *WorkerTaskQueue) popTasks(targetWork int) (peer.ID, []*peertask.Task) {
+	tq.lockTopics.Lock()
+	defer tq.lockTopics.Unlock()
+	if tq.scheduler != nil && len(tq.pending) > 0 {
+		if next, ok := tq.scheduler.Next(); ok {
+			if pt, ok := tq.pending[next]; ok {
+				delete(tq.pending, next)
+				tq.dispatched[next] = pt
+				tq.PeerTaskQueue.PushTasks(pt.p, pt.task)
+			}
+		}
+	}
+	pid, tasks, _ := tq.PeerTaskQueue.PopTasks(targetWork)
+	if len(tasks) > 0 {
+		tq.served++
+		tq.lastServed[pid] = tq.served
+		// pushing no tasks moves the peer, which still has the popped tasks
+		// active, to its new place in the queue
+		tq.PeerTaskQueue.PushTasks(pid)
+	}
+	return pid, tasks
+}
+
+func (tq *WorkerTaskQueue) worker(index uint64, executor Executor) {
 	targetWork := 1
 	for {
-		tq.lockTopics.Lock()
-		pid, tasks, _ := tq.PeerTaskQueue.PopTasks(targetWork)
-		tq.lockTopics.Unlock()
+		// workers over the limit sit out without consuming work signals
+		if tq.isIdleWorker(index) {
+			select {
+			case <-tq.ctx.Done():
+				return
+			case <-time.After(thawSpeed):
+			}
+			continue
+		}
+		pid, tasks := tq.popTasks(targetWork)
 		for len(tasks) == 0 {
 			select {
 			case <-tq.ctx.Done():
 				return
 			case <-tq.workSignal:
-				tq.lockTopics.Lock()
-				pid, tasks, _ = tq.PeerTaskQueue.PopTasks(targetWork)
-				tq.lockTopics.Unlock()
 			case <-tq.ticker.C:
 				tq.lockTopics.Lock()
 				tq.PeerTaskQueue.ThawRound()
-				pid, tasks, _ = tq.PeerTaskQueue.PopTasks(targetWork)
 				tq.lockTopics.Unlock()
 			}
+			// if the limit was lowered while waiting, leave the work to a
+			// worker that's still under it
+			if tq.isIdleWorker(index) {
+				tq.signalWork()
+				break
+			}
+			pid, tasks = tq.popTasks(targetWork)
 		}
 		for _, task := range tasks {
 			tq.noTaskCond.L.Lock()
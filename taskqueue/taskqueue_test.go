@@ -0,0 +1,134 @@
+package taskqueue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-peertaskqueue/peertask"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestRoundRobinAcrossPeers(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	peers := testutil.GeneratePeers(2)
+	bulk, interactive := peers[0], peers[1]
+	tq := NewTaskQueue(ctx)
+	defer tq.Shutdown()
+
+	// the bulk peer queues far more work, and queues it first
+	const bulkTasks, interactiveTasks = 20, 5
+	for i := 0; i < bulkTasks; i++ {
+		tq.PushTask(bulk, peertask.Task{Topic: i, Priority: 0, Work: 1})
+	}
+	for i := 0; i < interactiveTasks; i++ {
+		tq.PushTask(interactive, peertask.Task{Topic: i, Priority: 0, Work: 1})
+	}
+	executor := &recordingExecutor{tq: tq, executed: make(chan peer.ID, bulkTasks+interactiveTasks)}
+	tq.Startup(1, executor)
+
+	var order []peer.ID
+	for i := 0; i < bulkTasks+interactiveTasks; i++ {
+		var p peer.ID
+		testutil.AssertReceive(ctx, t, executor.executed, &p, "did not execute task")
+		order = append(order, p)
+	}
+
+	// while both peers have work, neither waits more than one task for a turn
+	for i := 1; i < 2*interactiveTasks; i++ {
+		require.NotEqual(t, order[i-1], order[i], "peer served twice in a row at %d", i)
+	}
+	for _, p := range order[2*interactiveTasks:] {
+		require.Equal(t, bulk, p)
+	}
+}
+
+func TestSchedulerTracksTasks(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	peers := testutil.GeneratePeers(1)
+	requestIDs := []graphsync.RequestID{graphsync.NewRequestID(), graphsync.NewRequestID()}
+	scheduler := &recordingScheduler{events: make(chan string, 10)}
+	tq := NewTaskQueue(ctx)
+	defer tq.Shutdown()
+	tq.SetScheduler(scheduler)
+
+	// the scheduler is told each task and its dependencies as it is queued
+	tq.PushTask(peers[0], peertask.Task{Topic: requestIDs[0], Priority: 3, Work: 1})
+	tq.PushTask(peers[0], peertask.Task{Topic: requestIDs[1], Priority: 1, Work: 1, Data: RequestTaskData{DependsOn: []graphsync.RequestID{requestIDs[0]}}})
+	require.Len(t, scheduler.pushed, 2)
+	require.Equal(t, requestIDs[0], scheduler.pushed[0].RequestID)
+	require.Equal(t, peers[0], scheduler.pushed[0].Peer)
+	require.Equal(t, graphsync.Priority(3), scheduler.pushed[0].Priority)
+	require.Empty(t, scheduler.pushed[0].DependsOn)
+	require.Equal(t, []graphsync.RequestID{requestIDs[0]}, scheduler.pushed[1].DependsOn)
+
+	// a task removed before it is dispatched is done
+	tq.Remove(requestIDs[1], peers[0])
+	var event string
+	testutil.AssertReceive(ctx, t, scheduler.events, &event, "did not finish removed task")
+	require.Equal(t, "done "+requestIDs[1].String(), event)
+
+	// the dispatched task is done once it has run
+	executor := &recordingExecutor{tq: tq, executed: make(chan peer.ID, 1)}
+	tq.Startup(1, executor)
+	testutil.AssertReceive(ctx, t, scheduler.events, &event, "did not dispatch task")
+	require.Equal(t, "next "+requestIDs[0].String(), event)
+	var p peer.ID
+	testutil.AssertReceive(ctx, t, executor.executed, &p, "did not execute task")
+	testutil.AssertReceive(ctx, t, scheduler.events, &event, "did not finish task")
+	require.Equal(t, "done "+requestIDs[0].String(), event)
+}
+
+// recordingScheduler dispatches tasks in the order they were pushed, and
+// records what it is told
+type recordingScheduler struct {
+	pushed  []graphsync.PendingRequestInfo
+	waiting []graphsync.RequestID
+	events  chan string
+}
+
+func (rs *recordingScheduler) Push(info graphsync.PendingRequestInfo) {
+	rs.pushed = append(rs.pushed, info)
+	rs.waiting = append(rs.waiting, info.RequestID)
+}
+
+func (rs *recordingScheduler) Next() (graphsync.RequestID, bool) {
+	if len(rs.waiting) == 0 {
+		return graphsync.RequestID{}, false
+	}
+	next := rs.waiting[0]
+	rs.waiting = rs.waiting[1:]
+	rs.events <- "next " + next.String()
+	return next, true
+}
+
+func (rs *recordingScheduler) Done(requestID graphsync.RequestID) {
+	for i, waiting := range rs.waiting {
+		if waiting == requestID {
+			rs.waiting = append(rs.waiting[:i], rs.waiting[i+1:]...)
+			break
+		}
+	}
+	rs.events <- "done " + requestID.String()
+}
+
+type recordingExecutor struct {
+	tq       *WorkerTaskQueue
+	executed chan peer.ID
+}
+
+func (re *recordingExecutor) ExecuteTask(ctx context.Context, pid peer.ID, task *peertask.Task) bool {
+	re.tq.TaskDone(pid, task)
+	re.executed <- pid
+	return false
+}
@@ -0,0 +1,551 @@
+/*
+Package soak runs randomized operations against a network of graphsync
+instances, then checks invariants that should hold once the network is quiet.
+
+Targeted tests exercise one interaction at a time. A soak run mixes requests,
+cancels, pauses, updates, disconnects, store failures and throttle changes at
+random, to find bugs that only appear when these interleave. Every run is
+generated from a seed, and a failing run is shrunk to a smaller sequence of
+operations that still fails, so failures can be reproduced and investigated.
+*/
+package soak
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ipld "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/libp2p/go-libp2p-core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+
+	cid "github.com/ipfs/go-cid"
+
+	"github.com/ipfs/go-graphsync"
+	gsimpl "github.com/ipfs/go-graphsync/impl"
+	gsmsg "github.com/ipfs/go-graphsync/message"
+	gsnet "github.com/ipfs/go-graphsync/network"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+// OperationKind names an operation a soak run performs
+type OperationKind string
+
+const (
+	// OpRequest starts a request from Peer for the chain held by Target
+	OpRequest = OperationKind("request")
+	// OpCancel cancels the request numbered Target
+	OpCancel = OperationKind("cancel")
+	// OpPause pauses the request numbered Target
+	OpPause = OperationKind("pause")
+	// OpUnpause unpauses the request numbered Target
+	OpUnpause = OperationKind("unpause")
+	// OpUpdate sends an update for the request numbered Target
+	OpUpdate = OperationKind("update")
+	// OpDisconnect disconnects Peer from Target
+	OpDisconnect = OperationKind("disconnect")
+	// OpReconnect reconnects Peer to Target
+	OpReconnect = OperationKind("reconnect")
+	// OpStoreFailure toggles whether reads from Peer's block store fail
+	OpStoreFailure = OperationKind("store-failure")
+	// OpThrottle sets Peer's throttle level to Level
+	OpThrottle = OperationKind("throttle")
+)
+
+var operationKinds = []OperationKind{
+	OpRequest, OpRequest, OpRequest,
+	OpCancel, OpPause, OpUnpause, OpUpdate,
+	OpDisconnect, OpReconnect, OpStoreFailure, OpThrottle,
+}
+
+// Operation is a single step in a soak run. Operations refer to peers and to
+// earlier requests by number, so a sequence can be replayed on a new network.
+// Request numbers wrap around the requests started so far
+type Operation struct {
+	Kind   OperationKind
+	Peer   int
+	Target int
+	Level  float64
+}
+
+func (op Operation) String() string {
+	switch op.Kind {
+	case OpRequest, OpDisconnect, OpReconnect:
+		return fmt.Sprintf("%s peer=%d target=%d", op.Kind, op.Peer, op.Target)
+	case OpStoreFailure:
+		return fmt.Sprintf("%s peer=%d", op.Kind, op.Peer)
+	case OpThrottle:
+		return fmt.Sprintf("%s peer=%d level=%.2f", op.Kind, op.Peer, op.Level)
+	default:
+		return fmt.Sprintf("%s request=%d", op.Kind, op.Target)
+	}
+}
+
+// Config configures a soak run
+type Config struct {
+	// Seed determines the operations performed and the size of each peer's chain
+	Seed int64
+	// Peers is the number of simulated peers, default 4
+	Peers int
+	// Duration is roughly how long operations are performed for, default 1s
+	Duration time.Duration
+	// OperationInterval is the time between operations, default 5ms
+	OperationInterval time.Duration
+	// MaxChainLength is the longest chain a peer holds, default 50
+	MaxChainLength int
+	// SettleTimeout is how long to wait for in progress work to finish or be
+	// cleaned up once operations stop, default 5s
+	SettleTimeout time.Duration
+	// MaxShrinkRuns limits how many times a failing run is replayed while
+	// shrinking it, default 20. A value < 0 disables shrinking
+	MaxShrinkRuns int
+	// Options configures every graphsync instance
+	Options []gsimpl.Option
+}
+
+func (cfg Config) withDefaults() Config {
+	if cfg.Peers < 2 {
+		cfg.Peers = 4
+	}
+	if cfg.Duration <= 0 {
+		cfg.Duration = time.Second
+	}
+	if cfg.OperationInterval <= 0 {
+		cfg.OperationInterval = 5 * time.Millisecond
+	}
+	if cfg.MaxChainLength < 2 {
+		cfg.MaxChainLength = 50
+	}
+	if cfg.SettleTimeout <= 0 {
+		cfg.SettleTimeout = 5 * time.Second
+	}
+	if cfg.MaxShrinkRuns == 0 {
+		cfg.MaxShrinkRuns = 20
+	}
+	return cfg
+}
+
+// Failure reports invariants a soak run violated, along with the smallest
+// sequence of operations found that still violates them
+type Failure struct {
+	Seed       int64
+	Operations []Operation
+	Violations []string
+}
+
+func (f *Failure) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "soak run with seed %d violated invariants:\n", f.Seed)
+	for _, violation := range f.Violations {
+		fmt.Fprintf(&sb, "  - %s\n", violation)
+	}
+	fmt.Fprintf(&sb, "minimal failing sequence (%d operations):\n", len(f.Operations))
+	for i, op := range f.Operations {
+		fmt.Fprintf(&sb, "  %d: %s\n", i, op)
+	}
+	return sb.String()
+}
+
+// Generate returns the operations a run with the given config performs
+func Generate(cfg Config) []Operation {
+	cfg = cfg.withDefaults()
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	count := int(cfg.Duration / cfg.OperationInterval)
+	ops := make([]Operation, 0, count)
+	for i := 0; i < count; i++ {
+		op := Operation{
+			Kind:   operationKinds[rng.Intn(len(operationKinds))],
+			Peer:   rng.Intn(cfg.Peers),
+			Target: rng.Intn(cfg.Peers),
+		}
+		switch op.Kind {
+		case OpRequest, OpDisconnect, OpReconnect:
+			if op.Target == op.Peer {
+				op.Target = (op.Target + 1) % cfg.Peers
+			}
+		case OpCancel, OpPause, OpUnpause, OpUpdate:
+			op.Target = rng.Intn(1 << 16)
+		case OpThrottle:
+			op.Level = rng.Float64()
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+// Run performs the operations generated from cfg, then checks invariants. If
+// any are violated, the operations are shrunk to a smaller sequence that still
+// fails, which is returned in a *Failure
+func Run(ctx context.Context, t testing.TB, cfg Config) error {
+	t.Helper()
+	cfg = cfg.withDefaults()
+	ops := Generate(cfg)
+	violations := Replay(ctx, t, cfg, ops)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	t.Logf("soak run with seed %d failed after %d operations, shrinking: %s", cfg.Seed, len(ops), strings.Join(violations, "; "))
+	ops, violations = shrink(ctx, t, cfg, ops, violations)
+	return &Failure{Seed: cfg.Seed, Operations: ops, Violations: violations}
+}
+
+// shrink reduces a failing sequence by replaying smaller candidates
+func shrink(ctx context.Context, t testing.TB, cfg Config, ops []Operation, violations []string) ([]Operation, []string) {
+	return shrinkWith(ops, violations, cfg.MaxShrinkRuns, func(candidate []Operation) []string {
+		// a cancelled context fails every replay, which says nothing about
+		// the candidate. Instances stopped by the context close requests
+		// still in progress without an error, so a replay the context ended
+		// part way through is discarded as well
+		if ctx.Err() != nil {
+			return nil
+		}
+		violations := Replay(ctx, t, cfg, candidate)
+		if ctx.Err() != nil {
+			return nil
+		}
+		return violations
+	})
+}
+
+// shrinkWith removes chunks of operations from a failing sequence for as long
+// as the sequence keeps failing, halving the chunk size when no chunk can be
+// removed
+func shrinkWith(ops []Operation, violations []string, maxRuns int, replay func([]Operation) []string) ([]Operation, []string) {
+	runs := 0
+	for chunk := len(ops) / 2; chunk > 0 && runs < maxRuns; {
+		removed := false
+		for start := 0; start < len(ops) && runs < maxRuns; start += chunk {
+			end := start + chunk
+			if end > len(ops) {
+				end = len(ops)
+			}
+			candidate := append(append([]Operation{}, ops[:start]...), ops[end:]...)
+			runs++
+			if candidateViolations := replay(candidate); len(candidateViolations) > 0 {
+				ops, violations = candidate, candidateViolations
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			chunk /= 2
+		}
+	}
+	return ops, violations
+}
+
+type soakPeer struct {
+	id          peer.ID
+	gs          *gsimpl.GraphSync
+	lsys        ipld.LinkSystem
+	chain       *testutil.TestBlockChain
+	storeFailed int32
+	// the size of the blocks in messages the peer received, counting each
+	// block once per message. Accessed atomically
+	bytesReceived uint64
+}
+
+type soakRequest struct {
+	id        graphsync.RequestID
+	requestor int
+	responder int
+	cancel    context.CancelFunc
+	cancelled bool
+	done      chan struct{}
+	errs      []error
+}
+
+// Replay performs the given operations on a new network, then checks
+// invariants, returning a description of each one violated
+func Replay(ctx context.Context, t testing.TB, cfg Config, ops []Operation) []string {
+	t.Helper()
+	cfg = cfg.withDefaults()
+	baseline := runtime.NumGoroutine()
+	runCtx, cancelRun := context.WithCancel(ctx)
+
+	mn := mocknet.New()
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	peers := make([]*soakPeer, 0, cfg.Peers)
+	for i := 0; i < cfg.Peers; i++ {
+		host, err := mn.GenPeer()
+		if err != nil {
+			cancelRun()
+			return []string{fmt.Sprintf("generating host: %s", err)}
+		}
+		sp := &soakPeer{id: host.ID()}
+		sp.lsys = failingStore(testutil.NewTestStore(make(map[ipld.Link][]byte)), &sp.storeFailed)
+		sp.chain = testutil.SetupBlockChain(runCtx, t, sp.lsys, 100, 2+rng.Intn(cfg.MaxChainLength-1))
+		network := &countingNetwork{gsnet.NewFromLibp2pHost(host), &sp.bytesReceived}
+		sp.gs = gsimpl.New(runCtx, network, sp.lsys, cfg.Options...).(*gsimpl.GraphSync)
+		peers = append(peers, sp)
+	}
+	if err := mn.LinkAll(); err != nil {
+		cancelRun()
+		return []string{fmt.Sprintf("linking hosts: %s", err)}
+	}
+
+	var requests []*soakRequest
+	update := graphsync.ExtensionData{Name: "soak/update", Data: basicnode.NewString("update")}
+	for _, op := range ops {
+		switch op.Kind {
+		case OpRequest:
+			requests = append(requests, startRequest(runCtx, peers, op.Peer, op.Target))
+		case OpCancel, OpPause, OpUnpause, OpUpdate:
+			if len(requests) == 0 {
+				continue
+			}
+			request := requests[op.Target%len(requests)]
+			gs := peers[request.requestor].gs
+			switch op.Kind {
+			case OpCancel:
+				request.cancelled = true
+				request.cancel()
+			case OpPause:
+				_ = gs.Pause(runCtx, request.id)
+			case OpUnpause:
+				_ = gs.Unpause(runCtx, request.id)
+			case OpUpdate:
+				_ = gs.SendUpdate(runCtx, request.id, update)
+			}
+		case OpDisconnect:
+			_ = mn.DisconnectPeers(peers[op.Peer].id, peers[op.Target].id)
+		case OpReconnect:
+			_, _ = mn.ConnectPeers(peers[op.Peer].id, peers[op.Target].id)
+		case OpStoreFailure:
+			stored := atomic.LoadInt32(&peers[op.Peer].storeFailed)
+			atomic.StoreInt32(&peers[op.Peer].storeFailed, 1-stored)
+		case OpThrottle:
+			peers[op.Peer].gs.SetThrottle(op.Level)
+		}
+		time.Sleep(cfg.OperationInterval)
+	}
+
+	// let the network quiet down: restore stores and limits, resume paused
+	// requests, then cancel whatever does not finish in time
+	for _, sp := range peers {
+		atomic.StoreInt32(&sp.storeFailed, 0)
+		sp.gs.SetThrottle(1)
+	}
+	for _, request := range requests {
+		_ = peers[request.requestor].gs.Unpause(runCtx, request.id)
+	}
+	var violations []string
+	settled := time.After(cfg.SettleTimeout)
+	for _, request := range requests {
+		select {
+		case <-request.done:
+		case <-settled:
+			request.cancelled = true
+			request.cancel()
+		}
+	}
+	for i, request := range requests {
+		select {
+		case <-request.done:
+		case <-time.After(cfg.SettleTimeout):
+			requestorState := peers[request.requestor].gs.PeerState(peers[request.responder].id).OutgoingState
+			responderState := peers[request.responder].gs.PeerState(peers[request.requestor].id).IncomingState
+			violations = append(violations, fmt.Sprintf("request %d from peer %d never finished after it was cancelled (requestor state %s %v, responder state %s %v)", i, request.requestor,
+				requestorState.RequestStates[request.id], requestorState.Diagnostics()[request.id],
+				responderState.RequestStates[request.id], responderState.Diagnostics()[request.id]))
+		}
+	}
+
+	violations = append(violations, checkCompletedRequests(runCtx, peers, requests)...)
+	violations = append(violations, checkNoRequestState(peers, requests, cfg.SettleTimeout)...)
+	violations = append(violations, checkCounters(peers)...)
+
+	for i, sp := range peers {
+		closeCtx, cancelClose := context.WithTimeout(ctx, cfg.SettleTimeout)
+		if err := sp.gs.Close(closeCtx); err != nil {
+			violations = append(violations, fmt.Sprintf("peer %d failed to close: %s", i, err))
+		}
+		cancelClose()
+	}
+	cancelRun()
+	_ = mn.Close()
+	violations = append(violations, checkGoroutines(baseline, cfg.SettleTimeout)...)
+	return violations
+}
+
+func startRequest(ctx context.Context, peers []*soakPeer, requestor int, responder int) *soakRequest {
+	request := &soakRequest{
+		id:        graphsync.NewRequestID(),
+		requestor: requestor,
+		responder: responder,
+		done:      make(chan struct{}),
+	}
+	requestCtx, cancel := context.WithCancel(context.WithValue(ctx, graphsync.RequestIDContextKey{}, request.id))
+	request.cancel = cancel
+	chain := peers[responder].chain
+	responses, errs := peers[requestor].gs.Request(requestCtx, peers[responder].id, chain.TipLink, chain.Selector())
+	go func() {
+		defer close(request.done)
+		for range responses {
+		}
+		for err := range errs {
+			request.errs = append(request.errs, err)
+		}
+	}()
+	return request
+}
+
+// checkCompletedRequests verifies every request that finished without error
+// stored every block its selector reaches, with the right contents
+func checkCompletedRequests(ctx context.Context, peers []*soakPeer, requests []*soakRequest) []string {
+	var violations []string
+	for i, request := range requests {
+		select {
+		case <-request.done:
+		default:
+			continue
+		}
+		// cancelling a request closes its channels without an error
+		if request.cancelled || len(request.errs) > 0 {
+			continue
+		}
+		lsys := peers[request.requestor].lsys
+		for _, blk := range peers[request.responder].chain.AllBlocks() {
+			data, err := readBlock(ctx, lsys, blk.Cid())
+			if err != nil {
+				violations = append(violations, fmt.Sprintf("request %d completed, but peer %d is missing block %s", i, request.requestor, blk.Cid()))
+				break
+			}
+			if !bytes.Equal(data, blk.RawData()) {
+				violations = append(violations, fmt.Sprintf("request %d completed, but peer %d stored the wrong data for block %s", i, request.requestor, blk.Cid()))
+				break
+			}
+		}
+	}
+	return violations
+}
+
+// checkNoRequestState verifies no peer still holds state for any request
+func checkNoRequestState(peers []*soakPeer, requests []*soakRequest, timeout time.Duration) []string {
+	var violations []string
+	deadline := time.Now().Add(timeout)
+	for {
+		violations = violations[:0]
+		for i, sp := range peers {
+			stats := sp.gs.Stats()
+			if active := stats.OutgoingRequests.Active + stats.OutgoingRequests.Pending; active > 0 {
+				violations = append(violations, fmt.Sprintf("peer %d still has %d outgoing requests", i, active))
+			}
+			if active := stats.IncomingRequests.Active + stats.IncomingRequests.Pending; active > 0 {
+				violations = append(violations, fmt.Sprintf("peer %d still has %d incoming requests", i, active))
+			}
+			if allocated := stats.OutgoingResponses.TotalAllocatedAllPeers; allocated > 0 {
+				violations = append(violations, fmt.Sprintf("peer %d still has %d bytes allocated for responses", i, allocated))
+			}
+		}
+		for i, request := range requests {
+			for _, p := range []int{request.requestor, request.responder} {
+				if _, ok := peers[p].gs.RequestTransferStats(request.id); ok {
+					violations = append(violations, fmt.Sprintf("peer %d still tracks transfers for request %d", p, i))
+				}
+			}
+		}
+		if len(violations) == 0 || time.Now().After(deadline) {
+			return violations
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// checkCounters verifies transfer counters agree with each other, and that
+// peers never received more bytes than were sent. Bytes received are counted
+// as they arrive off the network rather than taken from the transfer
+// counters, since a block sent once in a message counts as received for every
+// request from the same peer that uses it. Blocks are counted uncompressed on
+// both sides, so the check holds with block compression too
+func checkCounters(peers []*soakPeer) []string {
+	var violations []string
+	var totalReceived, totalSent uint64
+	for i, sp := range peers {
+		transfers := sp.gs.Stats().Transfers
+		if transfers.BlocksSent > transfers.BlocksQueued || transfers.BytesSent > transfers.BytesQueued {
+			violations = append(violations, fmt.Sprintf("peer %d sent more than it queued: %+v", i, transfers))
+		}
+		totalReceived += atomic.LoadUint64(&sp.bytesReceived)
+		totalSent += transfers.BytesSent
+	}
+	if totalReceived > totalSent {
+		violations = append(violations, fmt.Sprintf("peers received %d bytes, but only %d bytes were sent", totalReceived, totalSent))
+	}
+	return violations
+}
+
+// countingNetwork counts the size of the blocks in each message received
+type countingNetwork struct {
+	gsnet.GraphSyncNetwork
+	bytesReceived *uint64
+}
+
+func (cn *countingNetwork) SetDelegate(receiver gsnet.Receiver) {
+	cn.GraphSyncNetwork.SetDelegate(&countingReceiver{receiver, cn.bytesReceived})
+}
+
+type countingReceiver struct {
+	gsnet.Receiver
+	bytesReceived *uint64
+}
+
+func (cr *countingReceiver) ReceiveMessage(ctx context.Context, sender peer.ID, incoming gsmsg.GraphSyncMessage) {
+	for _, block := range incoming.Blocks() {
+		atomic.AddUint64(cr.bytesReceived, uint64(len(block.RawData())))
+	}
+	cr.Receiver.ReceiveMessage(ctx, sender, incoming)
+}
+
+// checkGoroutines verifies the run left no goroutines behind, allowing a few
+// for runtime and network internals that exit lazily
+func checkGoroutines(baseline int, timeout time.Duration) []string {
+	const slack = 10
+	deadline := time.Now().Add(timeout)
+	for {
+		count := runtime.NumGoroutine()
+		if count <= baseline+slack {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return []string{fmt.Sprintf("goroutines grew from %d to %d", baseline, count)}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+var errStoreFailed = errors.New("soak: store failure")
+
+// failingStore wraps a link system so reads fail while failed is set
+func failingStore(lsys ipld.LinkSystem, failed *int32) ipld.LinkSystem {
+	readOpener := lsys.StorageReadOpener
+	lsys.StorageReadOpener = func(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		if atomic.LoadInt32(failed) == 1 {
+			return nil, errStoreFailed
+		}
+		return readOpener(lnkCtx, lnk)
+	}
+	return lsys
+}
+
+func readBlock(ctx context.Context, lsys ipld.LinkSystem, c cid.Cid) ([]byte, error) {
+	reader, err := lsys.StorageReadOpener(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c})
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
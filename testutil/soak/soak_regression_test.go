@@ -0,0 +1,42 @@
+//go:build soak
+// +build soak
+
+package soak
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// regressionSeeds are seeds whose runs once violated invariants. Runs are
+// timing dependent, so a seed does not fail every time, but each found a bug
+// often enough to be worth replaying
+var regressionSeeds = []int64{
+	// a block put back to retry a load was released while still queued,
+	// corrupting the queue and completing requests with blocks missing
+	9, 21, 124,
+}
+
+// TestSoakRegressions replays each regression seed. Since the runs are not
+// deterministic, it only builds with the soak tag:
+//
+//	go test -tags soak ./testutil/soak
+func TestSoakRegressions(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping soak test in short mode")
+	}
+	for _, seed := range regressionSeeds {
+		seed := seed
+		t.Run(fmt.Sprintf("seed %d", seed), func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+			defer cancel()
+			err := Run(ctx, t, Config{Seed: seed, Duration: 2 * time.Second})
+			require.NoError(t, err)
+		})
+	}
+}
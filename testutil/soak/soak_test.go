@@ -0,0 +1,62 @@
+package soak
+
+import (
+	"context"
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	soakDuration = flag.Duration("soak.duration", time.Second, "how long to perform random operations for")
+	soakSeed     = flag.Int64("soak.seed", 1, "seed for the soak run, 0 picks one at random")
+)
+
+func TestSoak(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping soak test in short mode")
+	}
+	seed := *soakSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	t.Logf("soak seed: %d", seed)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *soakDuration+2*time.Minute)
+	defer cancel()
+	err := Run(ctx, t, Config{Seed: seed, Duration: *soakDuration})
+	require.NoError(t, err)
+}
+
+func TestGenerateIsDeterministic(t *testing.T) {
+	cfg := Config{Seed: 42, Duration: 100 * time.Millisecond}
+	ops := Generate(cfg)
+	require.Len(t, ops, 20)
+	require.Equal(t, ops, Generate(cfg))
+	for _, op := range ops {
+		switch op.Kind {
+		case OpRequest, OpDisconnect, OpReconnect:
+			require.NotEqual(t, op.Peer, op.Target)
+		}
+	}
+}
+
+func TestShrinkFindsMinimalSequence(t *testing.T) {
+	ops := Generate(Config{Seed: 7, Duration: 200 * time.Millisecond})
+	// a stand in for Replay that fails whenever a throttle operation remains
+	failing := func(ops []Operation) []string {
+		for _, op := range ops {
+			if op.Kind == OpThrottle {
+				return []string{"throttled"}
+			}
+		}
+		return nil
+	}
+	require.NotEmpty(t, failing(ops))
+	shrunk, violations := shrinkWith(ops, []string{"throttled"}, 100, failing)
+	require.Equal(t, []string{"throttled"}, violations)
+	require.Len(t, shrunk, 1)
+	require.Equal(t, OpThrottle, shrunk[0].Kind)
+}
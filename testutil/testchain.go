@@ -267,7 +267,7 @@ func (tbc *TestBlockChain) RemainderBlocks(from int) []blocks.Block {
 	return tbc.Blocks(from, tbc.blockChainLength)
 }
 
-// Chooser is a NodeBuilderChooser function that always returns the block chain
+// Chooser is a LinkTargetNodePrototypeChooser function that always returns the block chain
 func (tbc *TestBlockChain) Chooser(ipld.Link, ipld.LinkContext) (ipld.NodePrototype, error) {
 	return chaintypes.Type.Block, nil
 }
@@ -97,6 +97,17 @@ func (mp *MockPublisher) AddSubscriber(subscriber notifications.Subscriber) {
 	mp.subscribersLk.Unlock()
 }
 
+func (mp *MockPublisher) RemoveSubscriber(subscriber notifications.Subscriber) {
+	mp.subscribersLk.Lock()
+	for i, existing := range mp.subscribers {
+		if existing == subscriber {
+			mp.subscribers = append(mp.subscribers[:i], mp.subscribers[i+1:]...)
+			break
+		}
+	}
+	mp.subscribersLk.Unlock()
+}
+
 func (mp *MockPublisher) PublishEvents(topic notifications.Topic, events []notifications.Event) {
 	mp.subscribersLk.Lock()
 	for _, subscriber := range mp.subscribers {
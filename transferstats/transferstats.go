@@ -0,0 +1,205 @@
+package transferstats
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-graphsync"
+)
+
+// Tracker counts blocks and bytes transferred for each request in progress,
+// for each peer, and in total. Requests are tracked from StartRequest until
+// FinishRequest, so blocks recorded for a request that already finished only
+// count for the peer and in total. It is safe for concurrent use, so counts
+// can be read while transfers run. A nil Tracker ignores everything recorded
+type Tracker struct {
+	lk       sync.RWMutex
+	requests map[graphsync.RequestID]*counters
+	peers    map[peer.ID]*counters
+	total    counters
+}
+
+// counters are accessed atomically
+type counters struct {
+	blocksReceived uint64
+	bytesReceived  uint64
+	blocksLocal    uint64
+	bytesLocal     uint64
+	blocksWasted   uint64
+	bytesWasted    uint64
+	blocksQueued   uint64
+	bytesQueued    uint64
+	blocksSent     uint64
+	bytesSent      uint64
+}
+
+func (c *counters) stats() graphsync.TransferStats {
+	return graphsync.TransferStats{
+		BlocksReceived: atomic.LoadUint64(&c.blocksReceived),
+		BytesReceived:  atomic.LoadUint64(&c.bytesReceived),
+		BlocksLocal:    atomic.LoadUint64(&c.blocksLocal),
+		BytesLocal:     atomic.LoadUint64(&c.bytesLocal),
+		BlocksWasted:   atomic.LoadUint64(&c.blocksWasted),
+		BytesWasted:    atomic.LoadUint64(&c.bytesWasted),
+		BlocksQueued:   atomic.LoadUint64(&c.blocksQueued),
+		BytesQueued:    atomic.LoadUint64(&c.bytesQueued),
+		BlocksSent:     atomic.LoadUint64(&c.blocksSent),
+		BytesSent:      atomic.LoadUint64(&c.bytesSent),
+	}
+}
+
+// New returns a tracker with nothing recorded
+func New() *Tracker {
+	return &Tracker{
+		requests: make(map[graphsync.RequestID]*counters),
+		peers:    make(map[peer.ID]*counters),
+	}
+}
+
+// StartRequest begins tracking the given request
+func (t *Tracker) StartRequest(requestID graphsync.RequestID) {
+	if t == nil {
+		return
+	}
+	t.lk.Lock()
+	if _, ok := t.requests[requestID]; !ok {
+		t.requests[requestID] = &counters{}
+	}
+	t.lk.Unlock()
+}
+
+// RecordReceived records a block received from the network for an outgoing request
+func (t *Tracker) RecordReceived(p peer.ID, requestID graphsync.RequestID, size uint64) {
+	t.record(p, &requestID, func(c *counters) {
+		atomic.AddUint64(&c.blocksReceived, 1)
+		atomic.AddUint64(&c.bytesReceived, size)
+	})
+}
+
+// RecordLocal records a block an outgoing request loaded from the local store
+// because the responder did not send it
+func (t *Tracker) RecordLocal(p peer.ID, requestID graphsync.RequestID, size uint64) {
+	t.record(p, &requestID, func(c *counters) {
+		atomic.AddUint64(&c.blocksLocal, 1)
+		atomic.AddUint64(&c.bytesLocal, size)
+	})
+}
+
+// RecordWasted records a block received from the network that no outgoing
+// request asked for. It only counts for the peer and in total
+func (t *Tracker) RecordWasted(p peer.ID, size uint64) {
+	t.record(p, nil, func(c *counters) {
+		atomic.AddUint64(&c.blocksWasted, 1)
+		atomic.AddUint64(&c.bytesWasted, size)
+	})
+}
+
+// RecordQueued records a block queued to send in a response
+func (t *Tracker) RecordQueued(p peer.ID, requestID graphsync.RequestID, size uint64) {
+	t.record(p, &requestID, func(c *counters) {
+		atomic.AddUint64(&c.blocksQueued, 1)
+		atomic.AddUint64(&c.bytesQueued, size)
+	})
+}
+
+// RecordSent records a block in a response that was sent over the network
+func (t *Tracker) RecordSent(p peer.ID, requestID graphsync.RequestID, size uint64) {
+	t.record(p, &requestID, func(c *counters) {
+		atomic.AddUint64(&c.blocksSent, 1)
+		atomic.AddUint64(&c.bytesSent, size)
+	})
+}
+
+// record adds to the counts for the given peer and in total, and for the
+// given request if it is not nil and is being tracked
+func (t *Tracker) record(p peer.ID, requestID *graphsync.RequestID, add func(*counters)) {
+	if t == nil {
+		return
+	}
+	t.lk.RLock()
+	var requestCounters *counters
+	var hasRequest bool
+	if requestID != nil {
+		requestCounters, hasRequest = t.requests[*requestID]
+	}
+	peerCounters, hasPeer := t.peers[p]
+	t.lk.RUnlock()
+	if !hasPeer {
+		t.lk.Lock()
+		if peerCounters, hasPeer = t.peers[p]; !hasPeer {
+			peerCounters = &counters{}
+			t.peers[p] = peerCounters
+		}
+		t.lk.Unlock()
+	}
+	if hasRequest {
+		add(requestCounters)
+	}
+	add(peerCounters)
+	add(&t.total)
+}
+
+// FinishRequest stops tracking the given request, returning what was
+// transferred for it
+func (t *Tracker) FinishRequest(requestID graphsync.RequestID) graphsync.TransferStats {
+	if t == nil {
+		return graphsync.TransferStats{}
+	}
+	t.lk.Lock()
+	c, ok := t.requests[requestID]
+	delete(t.requests, requestID)
+	t.lk.Unlock()
+	if !ok {
+		return graphsync.TransferStats{}
+	}
+	return c.stats()
+}
+
+// ForgetPeer discards the counts for the given peer
+func (t *Tracker) ForgetPeer(p peer.ID) {
+	if t == nil {
+		return
+	}
+	t.lk.Lock()
+	delete(t.peers, p)
+	t.lk.Unlock()
+}
+
+// Request returns what has been transferred so far for a request that is
+// still being tracked
+func (t *Tracker) Request(requestID graphsync.RequestID) (graphsync.TransferStats, bool) {
+	if t == nil {
+		return graphsync.TransferStats{}, false
+	}
+	t.lk.RLock()
+	c, ok := t.requests[requestID]
+	t.lk.RUnlock()
+	if !ok {
+		return graphsync.TransferStats{}, false
+	}
+	return c.stats(), true
+}
+
+// Peer returns what has been transferred to and from the given peer
+func (t *Tracker) Peer(p peer.ID) graphsync.TransferStats {
+	if t == nil {
+		return graphsync.TransferStats{}
+	}
+	t.lk.RLock()
+	c, ok := t.peers[p]
+	t.lk.RUnlock()
+	if !ok {
+		return graphsync.TransferStats{}
+	}
+	return c.stats()
+}
+
+// Total returns what has been transferred across all peers
+func (t *Tracker) Total() graphsync.TransferStats {
+	if t == nil {
+		return graphsync.TransferStats{}
+	}
+	return t.total.stats()
+}
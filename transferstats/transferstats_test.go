@@ -0,0 +1,81 @@
+package transferstats
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/testutil"
+)
+
+func TestTracker(t *testing.T) {
+	tracker := New()
+	peers := testutil.GeneratePeers(2)
+	request1, request2 := graphsync.NewRequestID(), graphsync.NewRequestID()
+	tracker.StartRequest(request1)
+	tracker.StartRequest(request2)
+
+	tracker.RecordReceived(peers[0], request1, 100)
+	tracker.RecordLocal(peers[0], request1, 50)
+	tracker.RecordQueued(peers[1], request2, 200)
+	tracker.RecordQueued(peers[1], request2, 300)
+	tracker.RecordSent(peers[1], request2, 200)
+
+	stats, ok := tracker.Request(request1)
+	require.True(t, ok)
+	require.Equal(t, graphsync.TransferStats{BlocksReceived: 1, BytesReceived: 100, BlocksLocal: 1, BytesLocal: 50}, stats)
+	require.Equal(t, graphsync.TransferStats{BlocksQueued: 2, BytesQueued: 500, BlocksSent: 1, BytesSent: 200}, tracker.Peer(peers[1]))
+	require.Equal(t, graphsync.TransferStats{
+		BlocksReceived: 1, BytesReceived: 100,
+		BlocksLocal: 1, BytesLocal: 50,
+		BlocksQueued: 2, BytesQueued: 500,
+		BlocksSent: 1, BytesSent: 200,
+	}, tracker.Total())
+
+	// finished requests are no longer tracked, but still count for peers and in total
+	require.Equal(t, stats, tracker.FinishRequest(request1))
+	_, ok = tracker.Request(request1)
+	require.False(t, ok)
+	require.Equal(t, uint64(100), tracker.Peer(peers[0]).BytesReceived)
+	require.Equal(t, uint64(100), tracker.Total().BytesReceived)
+
+	// blocks recorded after a request finishes do not start tracking it again
+	tracker.RecordReceived(peers[0], request1, 100)
+	_, ok = tracker.Request(request1)
+	require.False(t, ok)
+	require.Equal(t, uint64(200), tracker.Peer(peers[0]).BytesReceived)
+
+	tracker.ForgetPeer(peers[0])
+	require.Equal(t, graphsync.TransferStats{}, tracker.Peer(peers[0]))
+}
+
+func TestTrackerConcurrentAccess(t *testing.T) {
+	tracker := New()
+	peers := testutil.GeneratePeers(5)
+	requestID := graphsync.NewRequestID()
+	tracker.StartRequest(requestID)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tracker.RecordSent(peers[i%len(peers)], requestID, 10)
+			_, _ = tracker.Request(requestID)
+			_ = tracker.Total()
+		}(i)
+	}
+	wg.Wait()
+	stats, _ := tracker.Request(requestID)
+	require.Equal(t, uint64(100), stats.BlocksSent)
+	require.Equal(t, uint64(1000), tracker.Total().BytesSent)
+}
+
+func TestNilTracker(t *testing.T) {
+	var tracker *Tracker
+	p := testutil.GeneratePeers(1)[0]
+	tracker.RecordReceived(p, graphsync.NewRequestID(), 10)
+	require.Equal(t, graphsync.TransferStats{}, tracker.Total())
+	require.Equal(t, graphsync.TransferStats{}, tracker.FinishRequest(graphsync.NewRequestID()))
+}